@@ -1,391 +1,2401 @@
-﻿using System;
-using System.IO;
-using System.Linq;
-using NUnit.Framework;
-using StreamDb.Internal.DbStructure;
-using StreamDb.Tests.Helpers;
-
-// ReSharper disable PossibleNullReferenceException
-
-namespace StreamDb.Tests
-{
-    [TestFixture]
-    public class BasicTests
-    {
-        [Test]
-        public void can_create_a_new_blank_database_in_a_stream_and_use_it (){
-            using (var ms = new MemoryStream())
-            {
-                var subject = Database.TryConnect(ms);
-
-                Console.WriteLine($"Empty database is {ms.Length / 1024}kb");
-                var trueData = 0L;
-
-                using (var docStream = MakeTestDocument()){
-                    Console.WriteLine($"Writing {docStream.Length / 1024}kb document");
-                    subject.WriteDocument("images/staff/phil's face", docStream);
-                    trueData += docStream.Length;
-                }
-                
-                using (var docStream = MakeTestDocument()){
-                    Console.WriteLine($"Writing {docStream.Length / 1024}kb document");
-                    subject.WriteDocument("images/staff/paul's mum", docStream);
-                    trueData += docStream.Length;
-                }
-                
-                Assert.That(ms.Length, Is.GreaterThan(0), "Stream was not populated");
-                Console.WriteLine($"Filled database is {ms.Length / 1024}kb, with document data of {trueData / 1024}kb");
-
-                var recoveredData = 0;
-
-                var found = subject.Get("images/staff/phil's face", out var dataStream);
-                Assert.That(found, Is.True, "Failed to recover first document");
-                recoveredData += (int)dataStream.Length;
-                Console.WriteLine($"Recovered first document, size = {dataStream.Length / 1024}kb");
-                
-                found = subject.Get("images/staff/paul's mum", out dataStream);
-                Assert.That(found, Is.True, "Failed to recover second document");
-                recoveredData += (int)dataStream.Length;
-                Console.WriteLine($"Recovered second document, size = {dataStream.Length / 1024}kb");
-
-                Assert.That(recoveredData, Is.EqualTo(trueData), $"Recovered data was a different size to stored originals {trueData} in, {recoveredData} out.");
-            }
-        }
-
-        [Test, Repeat(2)]
-        public void can_create_a_database_with_a_file_stream ()
-        {
-            using (var fs = File.Open(@"C:\Temp\StreamDBTest.dat", FileMode.Create, FileAccess.ReadWrite, FileShare.None))
-            using (var db = Database.TryConnect(fs))
-            {
-
-                // write some documents
-                for (int i = 0; i < 10; i++)
-                {
-                    using (var docStream = MakeTestDocument())
-                    {
-                        Console.WriteLine($"Writing {docStream.Length / 1024}kb document");
-                        db.WriteDocument($"testdata-{i}", docStream);
-                    }
-                }
-                
-                // Now overwrite some of the documents...
-                for (int i = 3; i < 7; i++)
-                {
-                    using (var docStream = MakeTestDocument())
-                    {
-                        Console.WriteLine($"Writing {docStream.Length / 1024}kb document");
-                        db.WriteDocument($"testdata-{i}", docStream);
-                    }
-                }
-
-                Console.WriteLine("Database file is populated, and can be used by other tests");
-                db.Flush();
-            }
-
-            // We should be able to access the stored DB
-            
-            // We expect write operations to fail, but should be able to full access all data.
-            using (var fs = File.Open(@"C:\Temp\StreamDBTest.dat", FileMode.Open, FileAccess.Read, FileShare.None))
-            using (var db = Database.TryConnect(fs))
-            {
-
-                for (int i = 0; i < 10; i++)
-                {
-                    var found = db.Get($"testdata-{i}", out _);
-                    Assert.That(found, Is.True, $"Lost document #{i}");
-                }
-            }
-        }
-
-        [Test]
-        public void z_can_open_an_existing_database_from_a_file_stream()
-        {
-            using (var fs = File.Open(@"C:\Temp\StreamDBTest.dat", FileMode.Open, FileAccess.ReadWrite, FileShare.None))
-            using (var db = Database.TryConnect(fs))
-            {
-
-                for (int i = 0; i < 10; i++)
-                {
-                    var found = db.Get($"testdata-{i}", out var docStream);
-                    Assert.That(found, Is.True, $"Lost document #{i}");
-                    Console.WriteLine($"Read {docStream.Length / 1024}kb document at 'testdata-{i}'");
-                }
-            }
-        }
-
-        [Test]
-        public void database_can_be_accessed_with_a_readonly_stream ()
-        {
-            // We expect write operations to fail, but should be able to full access all data.
-            using (var fs = File.Open(@"C:\Temp\StreamDBTest.dat", FileMode.Open, FileAccess.Read, FileShare.None))
-            using (var db = Database.TryConnect(fs))
-            {
-
-                for (int i = 0; i < 10; i++)
-                {
-                    var found = db.Get($"testdata-{i}", out var docStream);
-                    Assert.That(found, Is.True, $"Lost document #{i}");
-                    Console.WriteLine($"Writing {docStream.Length / 1024}kb document");
-                }
-            }
-        }
-
-        [Test]
-        public void trying_to_read_a_damaged_stream_gives_a_failure_result (){
-            // at which point, you'd have a 'recover' method to call
-            BasicPage.QuickAndDirtyMode = false;
-
-            // Build a db in ram, then write over 1 byte per page
-            using (var ms = new MemoryStream())
-            {
-                var subject = Database.TryConnect(ms);
-
-                Console.WriteLine($"Empty database is {ms.Length / 1024}kb");
-
-                // Write a document
-                using (var docStream = MakeTestDocument()){
-                    Console.WriteLine($"Writing {docStream.Length / 1024}kb document");
-                    subject.WriteDocument("this document will be damaged", docStream);
-                }
-
-                // now damage the stream
-                for (int i = 0; i < ms.Length; i+= 1000)
-                {
-                    ms.Seek(i, SeekOrigin.Begin);
-                    ms.WriteByte(0);
-                }
-
-                // finally, try to read the document back
-                var ex = Assert.Throws<Exception>(()=>{subject.Get("this document will be damaged", out _);}, "Database did not notice damage");
-                Console.WriteLine(ex);
-                Assert.That(ex.ToString(), Contains.Substring("failed CRC check"), $"Message was \"{ex.Message}\"");
-            }
-        }
-        
-        [Test]
-        public void lookup_the_paths_for_a_document_id () {
-            using (var ms = new MemoryStream())
-            {
-                var subject = Database.TryConnect(ms);
-
-                var docId = subject.WriteDocument("original/path", MakeTestDocument());
-                subject.BindToPath(docId, "new/path/same/document");
-                
-                subject.WriteDocument("different", MakeTestDocument()); // should not be found
-
-                var found = string.Join(", ", subject.ListPaths(docId));
-                Assert.That(found, Is.EqualTo("original/path, new/path/same/document"));
-            }
-        }
-        
-        [Test]
-        public void can_bind_a_large_number_of_paths () {
-            using (var ms = new MemoryStream())
-            {
-                const int rounds = 250;
-
-                var subject = Database.TryConnect(ms);
-
-                var docId = subject.WriteDocument("original/path", MakeTestDocument());
-
-                var preLen = ms.Length;
-
-                // Bind a load of paths
-                for (int i = 0; i < rounds; i++)
-                {
-                    subject.BindToPath(docId, $"new/path/number_{i}");
-                }
-
-                var postLen = ms.Length;
-
-                Console.WriteLine($"Storage for {rounds} similar paths took {(postLen - preLen)/1024}KB. Total DB size = {postLen/1024}KB");
-
-                // read back
-                var found1 = subject.ListPaths(docId).ToList();
-                Assert.That(found1.Count, Is.EqualTo(rounds+1), "Paths were not recorded to cache");
-
-                // serialise
-                ms.Rewind();
-                var raw = ms.ToArray();
-                var result = Database.TryConnect(new MemoryStream(raw));
-
-                // read back
-                var found = result.ListPaths(docId).ToList();
-                Assert.That(found.Count, Is.EqualTo(rounds+1), "Paths were not recorded to storage");
-            }
-        }
-
-        [Test]
-        public void search_for_paths_with_a_path_prefix () {
-            using (var ms = new MemoryStream())
-            {
-                var subject = Database.TryConnect(ms);
-
-                // spam a few paths
-                subject.WriteDocument("Some may say that this is not a path", MakeTestDocument());
-                subject.WriteDocument("But the route you take is your own", MakeTestDocument());
-                subject.WriteDocument("test result uno", MakeTestDocument());
-                subject.WriteDocument("test result dos", MakeTestDocument());
-                subject.WriteDocument("{This is really all for padding}", MakeTestDocument());
-
-                var result = subject.Search("test result");
-
-                var found = string.Join(", ", result);
-                Assert.That(found, Is.EqualTo("test result uno, test result dos"));
-            }
-        }
-
-        [Test]
-        public void removing_a_document_removes_it_from_all_paths (){
-            using (var ms = new MemoryStream())
-            {
-                var subject = Database.TryConnect(ms);
-
-                var docId = subject.WriteDocument("original/path", MakeTestDocument());
-                subject.BindToPath(docId, "new/path/same/document");
-                
-                subject.Delete(docId);
-
-                var found = subject.ListPaths(docId).ToList();
-                Assert.That(found, Is.Empty);
-            }
-        }
-
-        [Test]
-        public void unbinding_a_document_from_a_path_does_not_remove_the_document_or_other_paths (){
-            using (var ms = new MemoryStream())
-            {
-                var subject = Database.TryConnect(ms);
-
-                var docId = subject.WriteDocument("original/path", MakeTestDocument());
-                subject.BindToPath(docId, "new/path/same/document");
-                
-                subject.UnbindPath(docId, "original/path");
-
-                var found = string.Join(", ", subject.ListPaths(docId));
-                Assert.That(found, Is.EqualTo("new/path/same/document"));
-            }
-        }
-
-        [Test]
-        public void unbinding_the_last_path_for_a_document_does_not_delete_it () {
-            using (var ms = new MemoryStream())
-            {
-                var testDoc = MakeTestDocument();
-                var subject = Database.TryConnect(ms);
-
-                var docId = subject.WriteDocument("original/path", testDoc);
-                subject.UnbindPath(docId, "original/path");
-
-                // check nothing is bound
-                var found = subject.ListPaths(docId).ToList();
-                Assert.That(found, Is.Empty, "Path were still bound, but should have been empty");
-
-                // bind a new path
-                subject.BindToPath(docId, "new/path");
-
-                // check we can read it
-                var ok = subject.Get("new/path", out var data);
-                Assert.That(ok, Is.True, "Get failed");
-
-                // check data is correct
-                var original = testDoc.ToHexString();
-                var result = data.ToHexString();
-                Assert.That(result, Is.EqualTo(original));
-            }
-        }
-        
-        [Test, Explicit("Slow test")]
-        public void stress_test_overwrite (){
-            BasicPage.QuickAndDirtyMode = true;
-            using (var doc = MakeTestDocument())
-            using (var ms = new MemoryStream())
-            {
-                var subject = Database.TryConnect(ms);
-
-                Console.WriteLine($"Empty database is {ms.Length / 1024}kb");
-
-                // write lots of documents, and overwrite them a lot of times
-                for (int overwrites = 0; overwrites < 10; overwrites++)
-                {
-                    Console.Write("Writing a 100 document block");
-
-                    for (int i = 0; i < 100; i++)
-                    {
-                        Console.Write(".");
-                        doc.Seek(0, SeekOrigin.Begin);
-                        subject.WriteDocument($"testdata-{i}", doc);
-                    }
-
-                    Console.WriteLine($"Done. Filled database is {(ms.Length / 1048576.0):#.00}MB");
-                }
-            }
-        }
-        
-        [Test, Explicit("Slow test")]
-        public void stress_test_unique_write (){
-            using (var doc = MakeTestDocument())
-            using (var ms = new MemoryStream())
-            {
-                var subject = Database.TryConnect(ms);
-
-                Console.WriteLine($"Empty database is {ms.Length / 1024}kb");
-
-                // write lots of documents, all in new document chains
-                Console.Write("Writing 1000 documents");
-
-                for (int i = 0; i < 1000; i++)
-                {
-                    Console.Write(".");
-                    doc.Seek(0, SeekOrigin.Begin);
-                    subject.WriteDocument($"testdata-{i}", doc);
-                }
-
-                Console.WriteLine($"Done. Filled database is {(ms.Length / 1048576.0):#.00}MB");
-            }
-        }
-        
-        [Test, Explicit("Slow test")]
-        public void stress_test_read (){
-            BasicPage.QuickAndDirtyMode = true;
-            using (var doc = MakeTestDocument())
-            using (var ms = new MemoryStream())
-            {
-                var subject = Database.TryConnect(ms);
-
-                Console.WriteLine("Writing doc");
-                doc.Seek(0, SeekOrigin.Begin);
-                subject.WriteDocument("test/data-path/doc", doc);
-
-
-                // Read the same document a load of times
-                Console.WriteLine("Reading doc 10'000 times");
-                for (int i = 0; i < 5_000; i++)
-                {
-                    var ok = subject.Get("test/data-path/doc", out _);
-                    Assert.That(ok, Is.True);
-                    
-                    ok = subject.Get($"this document is not here #{i}", out _);
-                    Assert.That(ok, Is.False);
-                }
-                Console.WriteLine("Done");
-            }
-        }
-
-        private static Stream MakeTestDocument()
-        {
-            var ms = new MemoryStream();
-            var rnd= new Random();
-            var buf = new byte[1024];
-            for (int i = 0; i < rnd.Next(102, 1024); i++)
-            {
-                rnd.NextBytes(buf);
-                ms.Write(buf, 0, buf.Length);
-            }
-            ms.Seek(0, SeekOrigin.Begin);
-            return ms;
-        }
-
-    }
-}
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using System.IO.Compression;
+using System.Linq;
+using System.Text;
+using NUnit.Framework;
+using StreamDb.Internal.Core;
+using StreamDb.Internal.DbStructure;
+using StreamDb.Internal.Support;
+using StreamDb.Interop;
+using StreamDb.Tests.Helpers;
+
+// ReSharper disable PossibleNullReferenceException
+
+namespace StreamDb.Tests
+{
+    [TestFixture]
+    public class BasicTests
+    {
+        [Test]
+        public void can_create_a_new_blank_database_in_a_stream_and_use_it (){
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms);
+
+                Console.WriteLine($"Empty database is {ms.Length / 1024}kb");
+                var trueData = 0L;
+
+                using (var docStream = MakeTestDocument()){
+                    Console.WriteLine($"Writing {docStream.Length / 1024}kb document");
+                    subject.WriteDocument("images/staff/phil's face", docStream);
+                    trueData += docStream.Length;
+                }
+                
+                using (var docStream = MakeTestDocument()){
+                    Console.WriteLine($"Writing {docStream.Length / 1024}kb document");
+                    subject.WriteDocument("images/staff/paul's mum", docStream);
+                    trueData += docStream.Length;
+                }
+                
+                Assert.That(ms.Length, Is.GreaterThan(0), "Stream was not populated");
+                Console.WriteLine($"Filled database is {ms.Length / 1024}kb, with document data of {trueData / 1024}kb");
+
+                var recoveredData = 0;
+
+                var found = subject.Get("images/staff/phil's face", out var dataStream);
+                Assert.That(found, Is.True, "Failed to recover first document");
+                recoveredData += (int)dataStream.Length;
+                Console.WriteLine($"Recovered first document, size = {dataStream.Length / 1024}kb");
+                
+                found = subject.Get("images/staff/paul's mum", out dataStream);
+                Assert.That(found, Is.True, "Failed to recover second document");
+                recoveredData += (int)dataStream.Length;
+                Console.WriteLine($"Recovered second document, size = {dataStream.Length / 1024}kb");
+
+                Assert.That(recoveredData, Is.EqualTo(trueData), $"Recovered data was a different size to stored originals {trueData} in, {recoveredData} out.");
+            }
+        }
+
+        [Test, Repeat(2)]
+        public void can_create_a_database_with_a_file_stream ()
+        {
+            var path = Path.GetTempFileName();
+            try
+            {
+                WriteTestDatabaseFile(path);
+
+                // We should be able to access the stored DB
+                
+                // We expect write operations to fail, but should be able to full access all data.
+                using (var fs = File.Open(path, FileMode.Open, FileAccess.Read, FileShare.None))
+                using (var db = Database.TryConnect(fs))
+                {
+
+                    for (int i = 0; i < 10; i++)
+                    {
+                        var found = db.Get($"testdata-{i}", out _);
+                        Assert.That(found, Is.True, $"Lost document #{i}");
+                    }
+                }
+            }
+            finally
+            {
+                File.Delete(path);
+            }
+        }
+
+        [Test]
+        public void z_can_open_an_existing_database_from_a_file_stream()
+        {
+            var path = Path.GetTempFileName();
+            try
+            {
+                WriteTestDatabaseFile(path);
+
+                using (var fs = File.Open(path, FileMode.Open, FileAccess.ReadWrite, FileShare.None))
+                using (var db = Database.TryConnect(fs))
+                {
+
+                    for (int i = 0; i < 10; i++)
+                    {
+                        var found = db.Get($"testdata-{i}", out var docStream);
+                        Assert.That(found, Is.True, $"Lost document #{i}");
+                        Console.WriteLine($"Read {docStream.Length / 1024}kb document at 'testdata-{i}'");
+                    }
+                }
+            }
+            finally
+            {
+                File.Delete(path);
+            }
+        }
+
+        [Test]
+        public void database_can_be_accessed_with_a_readonly_stream ()
+        {
+            var path = Path.GetTempFileName();
+            try
+            {
+                WriteTestDatabaseFile(path);
+
+                // We expect write operations to fail, but should be able to full access all data.
+                using (var fs = File.Open(path, FileMode.Open, FileAccess.Read, FileShare.None))
+                using (var db = Database.TryConnect(fs))
+                {
+
+                    for (int i = 0; i < 10; i++)
+                    {
+                        var found = db.Get($"testdata-{i}", out var docStream);
+                        Assert.That(found, Is.True, $"Lost document #{i}");
+                        Console.WriteLine($"Writing {docStream.Length / 1024}kb document");
+                    }
+                }
+            }
+            finally
+            {
+                File.Delete(path);
+            }
+        }
+
+        /// <summary>
+        /// Create a database file at the given path, holding ten test documents with some overwritten
+        /// </summary>
+        private static void WriteTestDatabaseFile(string path)
+        {
+            using (var fs = File.Open(path, FileMode.Create, FileAccess.ReadWrite, FileShare.None))
+            using (var db = Database.TryConnect(fs))
+            {
+
+                // write some documents
+                for (int i = 0; i < 10; i++)
+                {
+                    using (var docStream = MakeTestDocument())
+                    {
+                        Console.WriteLine($"Writing {docStream.Length / 1024}kb document");
+                        db.WriteDocument($"testdata-{i}", docStream);
+                    }
+                }
+                
+                // Now overwrite some of the documents...
+                for (int i = 3; i < 7; i++)
+                {
+                    using (var docStream = MakeTestDocument())
+                    {
+                        Console.WriteLine($"Writing {docStream.Length / 1024}kb document");
+                        db.WriteDocument($"testdata-{i}", docStream);
+                    }
+                }
+
+                db.Flush();
+            }
+        }
+
+        [Test]
+        public void trying_to_read_a_damaged_stream_gives_a_failure_result (){
+            // at which point, you'd have a 'recover' method to call
+            BasicPage.QuickAndDirtyMode = false;
+
+            // Build a db in ram, then write over 1 byte per page
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms);
+
+                Console.WriteLine($"Empty database is {ms.Length / 1024}kb");
+
+                // Write a document
+                using (var docStream = MakeTestDocument()){
+                    Console.WriteLine($"Writing {docStream.Length / 1024}kb document");
+                    subject.WriteDocument("this document will be damaged", docStream);
+                }
+
+                // now damage the document's last data page, which is the first read of its chain
+                var info = subject.GetDocumentInfo("this document will be damaged");
+                var pageId = int.Parse(System.Text.RegularExpressions.Regex.Match(info, @"file index = (\d+)").Groups[1].Value);
+                DamagePage(ms, pageId);
+
+                // finally, try to read the document back
+                var ex = Assert.Throws<Exception>(() => {
+                    subject.Get("this document will be damaged", out var stream);
+                    stream?.CopyTo(new MemoryStream());
+                }, "Database did not notice damage");
+                Console.WriteLine(ex);
+                Assert.That(ex.ToString(), Contains.Substring("failed CRC check"), $"Message was \"{ex.Message}\"");
+            }
+        }
+
+        [Test]
+        public void a_damaged_index_page_hides_its_documents_and_flags_the_database_for_repair () {
+            BasicPage.QuickAndDirtyMode = false;
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms);
+                using (var docStream = MakeTestDocument()) { subject.WriteDocument("indexed on a damaged page", docStream); }
+                Assert.That(subject.NeedsRepair, Is.False);
+
+                DamagePage(ms, new PageStorage(ms).Header().IndexLink.Newest);
+
+                Assert.That(subject.Get("indexed on a damaged page", out _), Is.False, "Database did not notice damage");
+                Assert.That(subject.NeedsRepair, Is.True, "Hidden document was not flagged for repair");
+            }
+        }
+
+        [Test]
+        public void entries_behind_a_damaged_index_page_can_be_read_but_not_changed () {
+            BasicPage.QuickAndDirtyMode = false;
+            using (var ms = new MemoryStream())
+            {
+                var subject = new PageStorage(ms);
+                var older = Guid.NewGuid();
+                subject.BindIndex(older, subject.WriteStream(new MemoryStream(new byte[] { 1 })), out _);
+                var firstIndexPage = subject.Header().IndexLink.Newest;
+                for (int i = 0; i < 10000 && subject.Header().IndexLink.Newest == firstIndexPage; i++)
+                {
+                    subject.BindIndex(Guid.NewGuid(), 0, out _);
+                }
+                Assert.That(subject.Header().IndexLink.Newest, Is.Not.EqualTo(firstIndexPage), "Index did not extend");
+
+                DamagePage(ms, subject.Header().IndexLink.Newest);
+
+                Assert.That(subject.GetDocumentHead(older), Is.GreaterThanOrEqualTo(0), "Lookup did not skip the damaged page");
+                Assert.That(subject.NeedsRepair, Is.True);
+                Assert.Throws<Exception>(() => subject.UnbindIndex(older), "Removed an entry behind the damaged page");
+                Assert.Throws<Exception>(() => subject.BindIndex(older, 0, out _), "Changed an entry behind the damaged page");
+                Assert.That(subject.GetDocumentHead(older), Is.GreaterThanOrEqualTo(0), "Entry was changed");
+
+                var added = Guid.NewGuid();
+                subject.BindIndex(added, 0, out _);
+                Assert.That(subject.GetDocumentHead(added), Is.EqualTo(0), "New entries can still be added above the damage");
+            }
+        }
+
+        /// <summary>
+        /// Flip the bits of one byte in a page's data, so it fails its CRC check
+        /// </summary>
+        private static void DamagePage(Stream storage, int pageId) {
+            var position = PageStorage.HEADER_SIZE + (pageId * (long)BasicPage.PageRawSize) + BasicPage.PageHeadersSize + 10;
+            storage.Seek(position, SeekOrigin.Begin);
+            var original = storage.ReadByte();
+            storage.Seek(position, SeekOrigin.Begin);
+            storage.WriteByte((byte)(original ^ 0xFF));
+        }
+        
+        [Test]
+        public void lookup_the_paths_for_a_document_id () {
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms);
+
+                var docId = subject.WriteDocument("original/path", MakeTestDocument());
+                subject.BindToPath(docId, "new/path/same/document");
+                
+                subject.WriteDocument("different", MakeTestDocument()); // should not be found
+
+                var found = string.Join(", ", subject.ListPaths(docId));
+                Assert.That(found, Is.EqualTo("original/path, new/path/same/document"));
+            }
+        }
+        
+        [Test]
+        public void can_bind_a_large_number_of_paths () {
+            using (var ms = new MemoryStream())
+            {
+                const int rounds = 250;
+
+                var subject = Database.TryConnect(ms);
+
+                var docId = subject.WriteDocument("original/path", MakeTestDocument());
+
+                var preLen = ms.Length;
+
+                // Bind a load of paths
+                for (int i = 0; i < rounds; i++)
+                {
+                    subject.BindToPath(docId, $"new/path/number_{i}");
+                }
+
+                var postLen = ms.Length;
+
+                Console.WriteLine($"Storage for {rounds} similar paths took {(postLen - preLen)/1024}KB. Total DB size = {postLen/1024}KB");
+
+                // read back
+                var found1 = subject.ListPaths(docId).ToList();
+                Assert.That(found1.Count, Is.EqualTo(rounds+1), "Paths were not recorded to cache");
+
+                // serialise
+                ms.Rewind();
+                var raw = ms.ToArray();
+                var result = Database.TryConnect(new MemoryStream(raw));
+
+                // read back
+                var found = result.ListPaths(docId).ToList();
+                Assert.That(found.Count, Is.EqualTo(rounds+1), "Paths were not recorded to storage");
+            }
+        }
+
+        [Test]
+        public void search_for_paths_with_a_path_prefix () {
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms);
+
+                // spam a few paths
+                subject.WriteDocument("Some may say that this is not a path", MakeTestDocument());
+                subject.WriteDocument("But the route you take is your own", MakeTestDocument());
+                subject.WriteDocument("test result uno", MakeTestDocument());
+                subject.WriteDocument("test result dos", MakeTestDocument());
+                subject.WriteDocument("{This is really all for padding}", MakeTestDocument());
+
+                var result = subject.Search("test result");
+
+                var found = string.Join(", ", result);
+                Assert.That(found, Is.EqualTo("test result uno, test result dos"));
+            }
+        }
+
+        [Test]
+        public void search_for_paths_with_a_path_suffix () {
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms);
+
+                subject.WriteDocument("img/a.jpg", MakeTestDocument());
+                subject.WriteDocument("img/b.png", MakeTestDocument());
+                subject.WriteDocument("docs/c.jpg", MakeTestDocument());
+                subject.WriteDocument("x.jpg.txt", MakeTestDocument());
+
+                Assert.That(subject.SearchSuffix(".jpg").OrderBy(p => p), Is.EqualTo(new[] { "docs/c.jpg", "img/a.jpg" }));
+
+                subject.Delete("img/a.jpg");
+                Assert.That(subject.SearchSuffix(".jpg"), Is.EqualTo(new[] { "docs/c.jpg" }));
+
+                var memory = Database.ConnectToEngine(new MemoryStorageEngine());
+                memory.WriteDocument("img/a.jpg", MakeTestDocument());
+                memory.WriteDocument("img/b.png", MakeTestDocument());
+                Assert.That(memory.SearchSuffix(".jpg"), Is.EqualTo(new[] { "img/a.jpg" }));
+
+                Assert.Throws<ArgumentException>(() => subject.SearchSuffix("").ToList());
+            }
+        }
+
+        [Test]
+        public void removing_a_document_removes_it_from_all_paths (){
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms);
+
+                var docId = subject.WriteDocument("original/path", MakeTestDocument());
+                subject.BindToPath(docId, "new/path/same/document");
+                
+                subject.Delete(docId);
+
+                var found = subject.ListPaths(docId).ToList();
+                Assert.That(found, Is.Empty);
+            }
+        }
+
+        [Test]
+        public void unbinding_a_document_from_a_path_does_not_remove_the_document_or_other_paths (){
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms);
+
+                var docId = subject.WriteDocument("original/path", MakeTestDocument());
+                subject.BindToPath(docId, "new/path/same/document");
+                
+                subject.UnbindPath(docId, "original/path");
+
+                var found = string.Join(", ", subject.ListPaths(docId));
+                Assert.That(found, Is.EqualTo("new/path/same/document"));
+            }
+        }
+
+        [Test]
+        public void unbinding_the_last_path_for_a_document_does_not_delete_it () {
+            using (var ms = new MemoryStream())
+            {
+                var testDoc = MakeTestDocument();
+                var subject = Database.TryConnect(ms);
+
+                var docId = subject.WriteDocument("original/path", testDoc);
+                subject.UnbindPath(docId, "original/path");
+
+                // check nothing is bound
+                var found = subject.ListPaths(docId).ToList();
+                Assert.That(found, Is.Empty, "Path were still bound, but should have been empty");
+
+                // bind a new path
+                subject.BindToPath(docId, "new/path");
+
+                // check we can read it
+                var ok = subject.Get("new/path", out var data);
+                Assert.That(ok, Is.True, "Get failed");
+
+                // check data is correct
+                var original = testDoc.ToHexString();
+                var result = data.ToHexString();
+                Assert.That(result, Is.EqualTo(original));
+            }
+        }
+        
+        [Test]
+        public void can_read_a_byte_range_from_a_document () {
+            var data = new byte[10000];
+            for (int i = 0; i < data.Length; i++) data[i] = (byte)(i % 251);
+            var subject = Database.TryConnect(new MemoryStream());
+            subject.WriteDocument("ranged", new MemoryStream(data));
+
+            // crosses a page boundary
+            var ok = subject.ReadRange("ranged", BasicPage.PageDataCapacity - 10, 20, out var part);
+            Assert.That(ok, Is.True);
+            var buf = new byte[100];
+            var read = part.Read(buf, 0, buf.Length);
+            Assert.That(read, Is.EqualTo(20), "Range length");
+            Assert.That(buf.Take(20), Is.EqualTo(data.Skip(BasicPage.PageDataCapacity - 10).Take(20)), "Range content");
+
+            // runs off the end
+            subject.ReadRange("ranged", 9990, 100, out var tail);
+            Assert.That(tail.Length, Is.EqualTo(10), "Tail length");
+
+            Assert.That(subject.ReadRange("not here", 0, 1, out _), Is.False, "Missing document");
+            Assert.Throws<ArgumentOutOfRangeException>(() => subject.ReadRange("ranged", 10001, 1, out _));
+        }
+
+        [Test]
+        public void a_byte_range_can_be_seeked_within () {
+            var data = new byte[10000];
+            for (int i = 0; i < data.Length; i++) data[i] = (byte)(i % 251);
+            var subject = Database.TryConnect(new MemoryStream());
+            subject.WriteDocument("ranged", new MemoryStream(data));
+            subject.ReadRange("ranged", 1000, 100, out var part);
+
+            Assert.That(part.Seek(10, SeekOrigin.Begin), Is.EqualTo(10), "Seek from start");
+            Assert.That(part.ReadByte(), Is.EqualTo(data[1010]));
+
+            Assert.That(part.Seek(20, SeekOrigin.Current), Is.EqualTo(31), "Seek from current");
+            Assert.That(part.ReadByte(), Is.EqualTo(data[1031]));
+
+            Assert.That(part.Seek(-5, SeekOrigin.End), Is.EqualTo(95), "Seek from end");
+            Assert.That(part.ReadByte(), Is.EqualTo(data[1095]));
+
+            Assert.That(part.Seek(500, SeekOrigin.Begin), Is.EqualTo(100), "Seek is limited to the range");
+            Assert.That(part.ReadByte(), Is.EqualTo(-1));
+        }
+
+        [Test]
+        public void a_range_over_two_gigabytes_is_not_truncated () {
+            var parent = new ZeroStream(5L * 1024 * 1024 * 1024);
+            parent.Seek(1024, SeekOrigin.Begin);
+
+            var subject = new Substream(parent, 3L * 1024 * 1024 * 1024);
+            Assert.That(subject.Length, Is.EqualTo(3L * 1024 * 1024 * 1024));
+            Assert.That(subject.AvailableData(), Is.EqualTo(3L * 1024 * 1024 * 1024));
+
+            subject.Seek(-10, SeekOrigin.End);
+            Assert.That(subject.Read(new byte[100], 0, 100), Is.EqualTo(10), "Read past the end of the range");
+        }
+
+        [Test]
+        public void can_write_a_document_as_a_multi_part_upload () {
+            var part1 = Enumerable.Repeat((byte)1, Database.UploadPartAlignment * 2).ToArray();
+            var part2 = Enumerable.Repeat((byte)2, Database.UploadPartAlignment).ToArray();
+            var part3 = Enumerable.Repeat((byte)3, 100).ToArray();
+            var subject = Database.TryConnect(new MemoryStream());
+
+            var session = subject.StartUpload("uploaded");
+            subject.UploadPart(session, 3, new MemoryStream(part3)); // out of order
+            subject.UploadPart(session, 1, new MemoryStream(new byte[]{ 9, 9, 9 }));
+            subject.UploadPart(session, 1, new MemoryStream(part1)); // replaces the first attempt
+            subject.UploadPart(session, 2, new MemoryStream(part2));
+
+            Assert.That(subject.Get("uploaded", out _), Is.False, "Path bound before completion");
+            subject.CompleteUpload(session);
+
+            var ok = subject.Get("uploaded", out var result);
+            Assert.That(ok, Is.True, "Path not bound after completion");
+            var ms = new MemoryStream();
+            result.CopyTo(ms);
+            Assert.That(ms.ToArray(), Is.EqualTo(part1.Concat(part2).Concat(part3).ToArray()));
+        }
+
+        [Test]
+        public void an_upload_can_be_resumed_after_reopening_and_expired_uploads_are_released () {
+            var part1 = Enumerable.Repeat((byte)1, Database.UploadPartAlignment * 4).ToArray();
+            var part2 = Enumerable.Repeat((byte)2, 100).ToArray();
+            var storage = new MemoryStream();
+            var first = Database.TryConnect(storage);
+            var session = first.StartUpload("resumed");
+            var abandoned = first.StartUpload("abandoned");
+            first.UploadPart(session, 1, new MemoryStream(part1));
+            first.UploadPart(abandoned, 1, new MemoryStream(part1));
+            // no dispose: the process stopped mid-upload
+            var afterCrash = storage.ToArray();
+            MemoryStream Crashed() { var copy = new MemoryStream(); copy.Write(afterCrash, 0, afterCrash.Length); return copy; }
+
+            var second = Database.TryConnect(Crashed());
+            var packed = new MemoryStream();
+            using (var gzip = new GZipStream(packed, CompressionMode.Compress, true)) { gzip.Write(part2, 0, part2.Length); }
+            packed.Seek(0, SeekOrigin.Begin);
+            second.UploadPart(session, 2, new GZipStream(packed, CompressionMode.Decompress), part2.Length); // can't seek
+            second.CompleteUpload(session);
+
+            Assert.That(second.Get("resumed", out var result), Is.True, "Resumed upload was not bound");
+            var ms = new MemoryStream();
+            result.CopyTo(ms);
+            Assert.That(ms.ToArray(), Is.EqualTo(part1.Concat(part2).ToArray()));
+
+            // the abandoned session has expired by the next open, and its pages are reused
+            var thirdStorage = Crashed();
+            var third = Database.TryConnect(thirdStorage, new DatabaseOptions { UploadExpiry = TimeSpan.Zero });
+            Assert.Throws<Exception>(() => third.CompleteUpload(abandoned));
+            var length = thirdStorage.Length;
+            third.WriteDocument("reuse", new MemoryStream(part1));
+            Assert.That(thirdStorage.Length, Is.EqualTo(length), "Expired upload pages were not released");
+        }
+
+        [Test]
+        public void upload_parts_must_fill_whole_pages_except_the_last () {
+            var subject = Database.TryConnect(new MemoryStream());
+
+            var session = subject.StartUpload("uploaded");
+            subject.UploadPart(session, 1, new MemoryStream(new byte[100]));
+            subject.UploadPart(session, 2, new MemoryStream(new byte[100]));
+
+            Assert.Throws<Exception>(() => subject.CompleteUpload(session));
+            subject.AbortUpload(session);
+            Assert.That(subject.Get("uploaded", out _), Is.False);
+        }
+
+        [Test]
+        public void an_upload_that_fails_to_complete_can_be_fixed_and_completed () {
+            var subject = Database.TryConnect(new MemoryStream());
+            var part1 = Enumerable.Repeat((byte)1, Database.UploadPartAlignment).ToArray();
+
+            var session = subject.StartUpload("uploaded");
+            subject.UploadPart(session, 1, new MemoryStream(new byte[100]));
+            subject.UploadPart(session, 2, new MemoryStream(new byte[100]));
+            Assert.Throws<Exception>(() => subject.CompleteUpload(session));
+
+            subject.UploadPart(session, 1, new MemoryStream(part1));
+            subject.CompleteUpload(session);
+
+            Assert.That(subject.Get("uploaded", out var result), Is.True);
+            Assert.That(result.Length, Is.EqualTo(part1.Length + 100));
+        }
+
+        [Test]
+        public void the_embedded_profile_takes_every_id_from_the_supplied_source () {
+            var issued = new List<Guid>();
+            var next = 0;
+            var options = DatabaseOptions.ForEmbedded(() => {
+                var bytes = new byte[16];
+                BitConverter.GetBytes(++next).CopyTo(bytes, 0);
+                var id = new Guid(bytes);
+                issued.Add(id);
+                return id;
+            }, memoryBudget: 8 * BasicPage.PageRawSize);
+            var subject = Database.TryConnect(new MemoryStream(), options);
+
+            var docId = subject.WriteDocument("flash/config", new MemoryStream(new byte[] { 1, 2, 3 }));
+            var session = subject.StartUpload("flash/log");
+            subject.UploadPart(session, 1, new MemoryStream(new byte[50_000]));
+            var uploadId = subject.CompleteUpload(session);
+
+            Assert.That(issued, Does.Contain(docId));
+            Assert.That(issued, Does.Contain(session), "Upload session did not use the id source");
+            Assert.That(issued, Does.Contain(uploadId));
+            Assert.That(subject.Get("flash/log", out var log), Is.True);
+            Assert.That(log.Length, Is.EqualTo(50_000));
+        }
+
+        [Test]
+        public void a_database_can_live_on_a_block_device () {
+            var device = new MemoryStream();
+            var flash = new BlockDeviceStream(device, eraseBlockSize: 16 * 1024, headerSlots: 3);
+            var subject = Database.TryConnect(flash);
+
+            var data = new byte[30_000];
+            new Random(4453).NextBytes(data);
+            subject.WriteDocument("dev/blob", new MemoryStream(data));
+            subject.WriteDocument("dev/small", new MemoryStream(new byte[] { 1, 2, 3 }));
+            subject.Flush();
+
+            var stats = flash.Stats;
+            Console.WriteLine(stats);
+            Assert.That(stats.HeaderWrites, Is.GreaterThan(3), "Header slots were not rotated");
+            Assert.That(stats.WriteAmplification, Is.GreaterThanOrEqualTo(1.0));
+            Assert.That((device.Length - flash.DataStart) % BasicPage.PageRawSize, Is.Zero, "Pages are not aligned");
+
+            // reopen from the raw device
+            var again = Database.TryConnect(new BlockDeviceStream(new MemoryStream(device.ToArray()), eraseBlockSize: 16 * 1024, headerSlots: 3));
+            Assert.That(again.Get("dev/blob", out var blob), Is.True);
+            var ms = new MemoryStream();
+            blob.CopyTo(ms);
+            Assert.That(ms.ToArray(), Is.EqualTo(data));
+        }
+
+        [Test]
+        public void soft_deleted_documents_can_be_restored_until_purged () {
+            var storage = new MemoryStream();
+            var subject = Database.TryConnect(storage);
+            var document = MakeTestDocument();
+            var id = subject.WriteDocument("keep/me", document);
+
+            subject.SoftDelete("keep/me");
+            Assert.That(subject.Get("keep/me", out _), Is.False, "Path still bound after soft delete");
+            Assert.That(subject.ListTrash().Single().DocumentId, Is.EqualTo(id));
+
+            // trash survives reconnection
+            subject = Database.TryConnect(storage);
+            Assert.That(subject.Undelete("keep/me"), Is.True, "Undelete failed");
+            Assert.That(subject.Get("keep/me", out var restored), Is.True, "Path not restored");
+            Assert.That(restored.Length, Is.EqualTo(document.Length));
+            Assert.That(subject.ListTrash(), Is.Empty);
+
+            subject.SoftDelete("keep/me");
+            Assert.That(subject.PurgeTrash(TimeSpan.Zero), Is.EqualTo(1));
+            Assert.That(subject.Undelete("keep/me"), Is.False, "Undelete after purge");
+            Assert.That(subject.ListPaths(id), Is.Empty);
+        }
+
+        [Test]
+        public void pinned_documents_are_not_released () {
+            var storage = new MemoryStream();
+            var subject = Database.TryConnect(storage);
+            var id = subject.WriteDocument("config", MakeTestDocument());
+            subject.Pin(id);
+
+            subject = Database.TryConnect(storage);
+            Assert.That(subject.IsPinned(id), Is.True, "Pin was not persisted");
+            Assert.Throws<Exception>(() => subject.Delete("config"));
+            Assert.Throws<Exception>(() => subject.Delete(id));
+
+            // replacing the path leaves the pinned document in place
+            subject.WriteDocument("config", MakeTestDocument());
+            subject.BindToPath(id, "config-old");
+            Assert.That(subject.Get("config-old", out _), Is.True, "Pinned document was released");
+
+            subject.Unpin(id);
+            subject.Delete(id);
+            Assert.That(subject.Get("config-old", out _), Is.False);
+        }
+
+        [Test]
+        public void renaming_a_path_prefix_moves_all_matching_paths () {
+            var subject = Database.TryConnect(new MemoryStream());
+            var one = subject.WriteDocument("a/one", MakeTestDocument());
+            var two = subject.WriteDocument("a/sub/two", MakeTestDocument());
+            subject.WriteDocument("b/one", MakeTestDocument()); // will be replaced
+            var other = subject.WriteDocument("ab/other", MakeTestDocument());
+
+            var moved = subject.RenamePrefix("a/", "b/");
+
+            Assert.That(moved, Is.EqualTo(2));
+            Assert.That(subject.Search("a/"), Is.Empty, "Old paths remain");
+            Assert.That(subject.GetIdByPath("b/one", out var id1) ? id1 : Guid.Empty, Is.EqualTo(one));
+            Assert.That(subject.GetIdByPath("b/sub/two", out var id2) ? id2 : Guid.Empty, Is.EqualTo(two));
+            Assert.That(subject.GetIdByPath("ab/other", out var id3) ? id3 : Guid.Empty, Is.EqualTo(other), "Unrelated path changed");
+        }
+
+        [Test]
+        public void path_bindings_can_carry_time_and_annotation () {
+            var storage = new MemoryStream();
+            var subject = Database.TryConnect(storage);
+            var before = DateTime.UtcNow;
+            var id = subject.WriteDocument("audited", MakeTestDocument(), "uploaded by job 42");
+            subject.WriteDocument("plain", MakeTestDocument());
+
+            subject = Database.TryConnect(storage);
+            var info = subject.GetBindingInfo("audited");
+            Assert.That(info, Is.Not.Null);
+            Assert.That(info.DocumentId, Is.EqualTo(id));
+            Assert.That(info.Annotation, Is.EqualTo("uploaded by job 42"));
+            Assert.That(info.BoundAt, Is.GreaterThanOrEqualTo(before));
+
+            var plain = subject.GetBindingInfo("plain");
+            Assert.That(plain.BoundAt, Is.Null, "Time recorded without the option");
+            Assert.That(plain.Annotation, Is.Null);
+            Assert.That(subject.GetBindingInfo("missing"), Is.Null);
+        }
+
+        [Test]
+        public void audit_log_records_changes_in_order () {
+            var storage = new MemoryStream();
+            var subject = Database.TryConnect(storage, new DatabaseOptions { EnableAuditLog = true });
+            var start = DateTime.UtcNow;
+
+            var id = subject.WriteDocument("one", new MemoryStream(new byte[] { 1, 2, 3 }));
+            subject.BindToPath(id, "two");
+            subject.UnbindPath(id, "one");
+            for (int i = 0; i < 200; i++) { subject.BindToPath(id, "a fairly long path name to fill the log pages/" + i); }
+            subject.Delete(id);
+
+            subject = Database.TryConnect(storage);
+            var log = subject.ReadAuditLog(start).ToList();
+
+            Assert.That(log.Count, Is.EqualTo(204));
+            Assert.That(log[0].Operation, Is.EqualTo(AuditOperation.WriteDocument));
+            Assert.That(log[0].Path, Is.EqualTo("one"));
+            Assert.That(log[0].Size, Is.EqualTo(3));
+            Assert.That(log[1].Operation, Is.EqualTo(AuditOperation.BindPath));
+            Assert.That(log[2].Operation, Is.EqualTo(AuditOperation.UnbindPath));
+            Assert.That(log[202].Path, Is.EqualTo("a fairly long path name to fill the log pages/199"));
+            Assert.That(log[203].Operation, Is.EqualTo(AuditOperation.DeleteDocument));
+            Assert.That(log.All(r => r.DocumentId == id), Is.True);
+
+            Assert.That(subject.ReadAuditLog(DateTime.UtcNow.AddMinutes(1)), Is.Empty);
+        }
+
+        [Test]
+        public void typed_values_round_trip_through_registered_codecs () {
+            var subject = Database.TryConnect(new MemoryStream());
+            subject.Codecs.Register(new PointCodec());
+
+            subject.Put("points/origin", new Point { X = 3, Y = -4 });
+
+            Assert.That(subject.Get<Point>("points/origin", out var point), Is.True);
+            Assert.That(point.X, Is.EqualTo(3));
+            Assert.That(point.Y, Is.EqualTo(-4));
+            Assert.That(subject.GetObject("points/origin"), Is.InstanceOf<Point>());
+            Assert.That(subject.Get<Point>("points/missing", out _), Is.False);
+
+            // documents written without a codec fail schema validation
+            subject.WriteDocument("points/raw", new MemoryStream(new byte[8]));
+            Assert.Throws<Exception>(() => subject.Get<Point>("points/raw", out _));
+        }
+
+        [Test]
+        public void typed_values_keep_their_schema_when_bound_to_other_paths () {
+            var storage = new MemoryStream();
+            var subject = Database.TryConnect(storage);
+            subject.Codecs.Register(new PointCodec());
+
+            var id = subject.Put("points/origin", new Point { X = 3, Y = -4 });
+            Assert.That(subject.GetBindingInfo("points/origin").Annotation, Is.Null, "Schema should not use the annotation");
+
+            subject.BindToPath(id, "points/alias", "user note");
+            subject.RenamePrefix("points/", "moved/");
+            Assert.That(subject.GetSchemaId("moved/alias"), Is.EqualTo("test.point.v1"));
+            Assert.That(subject.Get<Point>("moved/alias", out var point), Is.True);
+            Assert.That(point.Y, Is.EqualTo(-4));
+            Assert.That(subject.Get<Point>("moved/origin", out _), Is.True);
+
+            // documents written by earlier versions have the schema in the annotation
+            subject.WriteDocument("points/legacy", new MemoryStream(new byte[8]), CodecRegistry.SchemaAnnotationPrefix + "test.point.v1");
+            Assert.That(subject.Get<Point>("points/legacy", out _), Is.True);
+
+            var clone = new MemoryStream();
+            subject.CloneTo(clone);
+            var copy = Database.TryConnect(clone);
+            copy.Codecs.Register(new PointCodec());
+            Assert.That(copy.Get<Point>("moved/alias", out _), Is.True);
+        }
+
+        private class Point { public int X, Y; }
+
+        private class PointCodec : Codec<Point> {
+            public override string SchemaId => "test.point.v1";
+            public override void Encode(Point value, Stream output) {
+                var w = new BinaryWriter(output);
+                w.Write(value.X); w.Write(value.Y); w.Flush();
+            }
+            public override Point Decode(Stream input) {
+                var r = new BinaryReader(input);
+                return new Point { X = r.ReadInt32(), Y = r.ReadInt32() };
+            }
+        }
+
+        [Test]
+        public void deduplicated_documents_share_stored_chunks () {
+            var original = new byte[200_000];
+            new Random(4438).NextBytes(original);
+            var edited = original.Take(1000).Concat(new byte[] { 1, 2, 3, 4, 5 }).Concat(original.Skip(1000)).ToArray();
+
+            var storage = new MemoryStream();
+            var subject = Database.TryConnect(storage, new DatabaseOptions { Deduplicate = true });
+            subject.WriteDocument("backup/1", new MemoryStream(original));
+            var sizeAfterFirst = storage.Length;
+            subject.WriteDocument("backup/2", new MemoryStream(edited));
+            var growth = storage.Length - sizeAfterFirst;
+
+            Assert.That(growth, Is.LessThan(original.Length / 4), "Second copy was not deduplicated");
+
+            subject.Get("backup/2", out var result);
+            var ms = new MemoryStream();
+            result.CopyTo(ms);
+            Assert.That(ms.ToArray(), Is.EqualTo(edited), "Deduplicated document did not read back");
+
+            subject.ReadRange("backup/1", 150_000, 10, out var range);
+            var buf = new byte[10];
+            range.Read(buf, 0, 10);
+            Assert.That(buf, Is.EqualTo(original.Skip(150_000).Take(10).ToArray()), "Range read across chunks");
+
+            // plain databases can read deduplicated documents
+            var plain = Database.TryConnect(storage);
+            Assert.That(plain.Get("backup/1", out var plainRead), Is.True);
+            Assert.That(plainRead.Length, Is.EqualTo(original.Length));
+        }
+
+        [Test]
+        public void plain_documents_that_look_like_chunk_manifests_are_read_as_written () {
+            var data = Encoding.ASCII.GetBytes("SDB-CHUNK-MFST\r\n").Concat(BitConverter.GetBytes(100L)).Concat(BitConverter.GetBytes(1)).Concat(new byte[40]).ToArray();
+
+            var storage = new MemoryStream();
+            var plain = Database.TryConnect(storage);
+            plain.WriteDocument("looks/like/manifest", new MemoryStream(data));
+
+            var subject = Database.TryConnect(storage, new DatabaseOptions { Deduplicate = true });
+            subject.WriteDocument("other", new MemoryStream(new byte[5000]));
+
+            Assert.That(subject.Get("looks/like/manifest", out var result), Is.True);
+            var ms = new MemoryStream();
+            result.CopyTo(ms);
+            Assert.That(ms.ToArray(), Is.EqualTo(data), "Document was read as a manifest");
+
+            subject.Delete("looks/like/manifest");
+            Assert.That(subject.Get("other", out var other), Is.True);
+            Assert.That(other.Length, Is.EqualTo(5000), "Deleting the plain document dropped chunk references");
+        }
+
+        [Test]
+        public void demoted_documents_move_to_cold_storage_and_back () {
+            var data = new byte[50_000];
+            new Random(4439).NextBytes(data);
+
+            var hot = new MemoryStream();
+            var cold = new MemoryStream();
+            var subject = Database.TryConnect(hot, new DatabaseOptions { ColdStorage = cold });
+            var id = subject.WriteDocument("archive/doc", new MemoryStream(data));
+            Assert.That(subject.GetTier(id), Is.EqualTo(StorageTier.Hot));
+
+            var coldSizeBefore = cold.Length;
+            subject.Demote(id);
+            Assert.That(subject.GetTier(id), Is.EqualTo(StorageTier.Cold));
+            Assert.That(cold.Length - coldSizeBefore, Is.GreaterThan(data.Length), "Data was not written to cold storage");
+
+            Assert.That(subject.Get("archive/doc", out var result), Is.True);
+            var ms = new MemoryStream();
+            result.CopyTo(ms);
+            Assert.That(ms.ToArray(), Is.EqualTo(data), "Demoted document did not read back");
+
+            subject.Promote(id);
+            Assert.That(subject.GetTier(id), Is.EqualTo(StorageTier.Hot));
+            subject.Get("archive/doc", out result);
+            ms = new MemoryStream();
+            result.CopyTo(ms);
+            Assert.That(ms.ToArray(), Is.EqualTo(data), "Promoted document did not read back");
+        }
+
+        [Test]
+        public void hot_documents_that_look_like_cold_stubs_are_read_as_written () {
+            var data = Encoding.ASCII.GetBytes("SDB-COLD-STUB-\r\n").Concat(BitConverter.GetBytes(50_000L)).ToArray();
+            Assert.That(data.Length, Is.EqualTo(24));
+
+            var subject = Database.TryConnect(new MemoryStream(), new DatabaseOptions { ColdStorage = new MemoryStream(), PromoteOnRead = true });
+            var id = subject.WriteDocument("looks/like/stub", new MemoryStream(data));
+            Assert.That(subject.GetTier(id), Is.EqualTo(StorageTier.Hot));
+
+            Assert.That(subject.Get("looks/like/stub", out var result), Is.True);
+            var ms = new MemoryStream();
+            result.CopyTo(ms);
+            Assert.That(ms.ToArray(), Is.EqualTo(data), "Document was read as a cold stub");
+
+            subject.Demote(id);
+            Assert.That(subject.GetTier(id), Is.EqualTo(StorageTier.Cold), "Document was taken to be cold already");
+        }
+
+        [Test]
+        public void a_read_replica_follows_a_writer_on_the_same_file () {
+            var file = Path.GetTempFileName();
+            try
+            {
+                using (var writerFile = File.Open(file, FileMode.Create, FileAccess.ReadWrite, FileShare.ReadWrite))
+                {
+                    var writer = Database.TryConnect(writerFile);
+                    writer.WriteDocument("feed/1", new MemoryStream(new byte[] { 1, 2, 3 }));
+
+                    using (var replicaFile = File.Open(file, FileMode.Open, FileAccess.Read, FileShare.ReadWrite))
+                    {
+                        var replica = Database.TryConnect(replicaFile, new DatabaseOptions { ReadReplica = true });
+                        Assert.That(replica.Get("feed/1", out var first), Is.True);
+                        Assert.That(first.Length, Is.EqualTo(3));
+
+                        // writer grows the file after the replica opened it
+                        var big = new byte[100_000];
+                        new Random(4440).NextBytes(big);
+                        writer.WriteDocument("feed/2", new MemoryStream(big));
+
+                        Assert.That(replica.Get("feed/2", out var second), Is.True, "Replica did not see new path");
+                        var ms = new MemoryStream();
+                        second.CopyTo(ms);
+                        Assert.That(ms.ToArray(), Is.EqualTo(big));
+
+                        Assert.Throws<InvalidOperationException>(() => replica.WriteDocument("feed/3", new MemoryStream(new byte[] { 4 })));
+                    }
+                }
+            }
+            finally
+            {
+                File.Delete(file);
+            }
+        }
+
+        [Test]
+        public void a_database_can_run_over_the_in_memory_engine () {
+            var engine = new MemoryStorageEngine();
+            var subject = Database.ConnectToEngine(engine);
+
+            var id = subject.WriteDocument("mem/one", new MemoryStream(new byte[] { 1, 2, 3 }));
+            subject.BindToPath(id, "mem/alias");
+            subject.WriteDocument("mem/two", new MemoryStream(new byte[] { 4 }));
+            subject.WriteDocument("mem/two", new MemoryStream(new byte[] { 5 }));
+
+            Assert.That(subject.Search("mem/").OrderBy(p => p), Is.EqualTo(new[] { "mem/alias", "mem/one", "mem/two" }));
+            Assert.That(subject.ListPaths(id).Count(), Is.EqualTo(2));
+            subject.Get("mem/two", out var two);
+            Assert.That(two.ReadByte(), Is.EqualTo(5));
+
+            subject.Delete("mem/one");
+            Assert.That(subject.Get("mem/alias", out _), Is.False);
+            Assert.That(engine.GetDocumentIdByPath("mem/two"), Is.Not.Null, "Engine was not used for storage");
+        }
+
+        [Test]
+        public void document_stats_are_read_from_the_index () {
+            var storage = new MemoryStream();
+            var subject = Database.TryConnect(storage);
+
+            subject.WriteDocument("stat/small", new MemoryStream(new byte[] { 1, 2, 3 }));
+            subject.WriteDocument("stat/large", new MemoryStream(new byte[20_000]));
+            subject.WriteDocument("stat/large", new MemoryStream(new byte[30_000]));
+
+            var small = subject.Stat("stat/small");
+            Assert.That(small, Is.Not.Null);
+            Assert.That(small.Length, Is.EqualTo(3));
+            Assert.That(small.FromIndex, Is.True, "Stat opened the document");
+            Assert.That(small.LastModified, Is.EqualTo(DateTime.UtcNow.Date).Within(TimeSpan.FromDays(1)));
+            Assert.That(small.Flags, Is.EqualTo(DocumentFlags.None));
+
+            Assert.That(subject.Stat("stat/large").Length, Is.EqualTo(30_000), "Stat did not follow the new version");
+            Assert.That(subject.Stat("stat/missing"), Is.Null);
+
+            // stats survive a reconnect
+            var again = Database.TryConnect(storage);
+            Assert.That(again.Stat("stat/small").Length, Is.EqualTo(3));
+        }
+
+        [Test]
+        public void test_images_are_reproducible () {
+            var shape = new TestImage { Seed = 42, DocumentCount = 20, PathsPerDocument = 2, PercentFreed = 25 };
+
+            var first = shape.Build().ToArray();
+            var second = shape.Build().ToArray();
+
+            Assert.That(first, Is.EqualTo(second), "Same seed and shape gave different images");
+            Assert.That(shape.DeletedPaths, Is.Not.Empty, "Nothing was freed");
+
+            var db = Database.TryConnect(new MemoryStream(first));
+            foreach (var path in shape.LivePaths.Keys)
+            {
+                Assert.That(db.GetIdByPath(path, out var id), Is.True, $"Lost live path {path}");
+                Assert.That(id, Is.EqualTo(shape.LivePaths[path]), $"Wrong document at {path}");
+            }
+            foreach (var path in shape.DeletedPaths)
+            {
+                Assert.That(db.Get(path, out _), Is.False, $"Deleted path {path} is still readable");
+            }
+        }
+
+        [Test, Explicit("Slow test")]
+        public void stress_test_overwrite (){
+            BasicPage.QuickAndDirtyMode = true;
+            using (var doc = MakeTestDocument())
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms);
+
+                Console.WriteLine($"Empty database is {ms.Length / 1024}kb");
+
+                // write lots of documents, and overwrite them a lot of times
+                for (int overwrites = 0; overwrites < 10; overwrites++)
+                {
+                    Console.Write("Writing a 100 document block");
+
+                    for (int i = 0; i < 100; i++)
+                    {
+                        Console.Write(".");
+                        doc.Seek(0, SeekOrigin.Begin);
+                        subject.WriteDocument($"testdata-{i}", doc);
+                    }
+
+                    Console.WriteLine($"Done. Filled database is {(ms.Length / 1048576.0):#.00}MB");
+                }
+            }
+        }
+        
+        [Test, Explicit("Slow test")]
+        public void stress_test_unique_write (){
+            using (var doc = MakeTestDocument())
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms);
+
+                Console.WriteLine($"Empty database is {ms.Length / 1024}kb");
+
+                // write lots of documents, all in new document chains
+                Console.Write("Writing 1000 documents");
+
+                for (int i = 0; i < 1000; i++)
+                {
+                    Console.Write(".");
+                    doc.Seek(0, SeekOrigin.Begin);
+                    subject.WriteDocument($"testdata-{i}", doc);
+                }
+
+                Console.WriteLine($"Done. Filled database is {(ms.Length / 1048576.0):#.00}MB");
+            }
+        }
+        
+        [Test, Explicit("Slow test")]
+        public void stress_test_read (){
+            BasicPage.QuickAndDirtyMode = true;
+            using (var doc = MakeTestDocument())
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms);
+
+                Console.WriteLine("Writing doc");
+                doc.Seek(0, SeekOrigin.Begin);
+                subject.WriteDocument("test/data-path/doc", doc);
+
+
+                // Read the same document a load of times
+                Console.WriteLine("Reading doc 10'000 times");
+                for (int i = 0; i < 5_000; i++)
+                {
+                    var ok = subject.Get("test/data-path/doc", out _);
+                    Assert.That(ok, Is.True);
+                    
+                    ok = subject.Get($"this document is not here #{i}", out _);
+                    Assert.That(ok, Is.False);
+                }
+                Console.WriteLine("Done");
+            }
+        }
+
+        [Test]
+        public void fixed_documents_are_overwritten_in_place () {
+            var storage = new MemoryStream();
+            var subject = Database.TryConnect(storage);
+            subject.CreateFixedDocument("telemetry/ring", 2);
+            var sizeAfterCreate = storage.Length;
+
+            var written = new List<byte>();
+            var rnd = new Random(4456);
+            for (int i = 0; i < 20; i++)
+            {
+                var chunk = new byte[1000];
+                rnd.NextBytes(chunk);
+                subject.AppendToFixedDocument("telemetry/ring", chunk);
+                written.AddRange(chunk);
+            }
+
+            Assert.That(storage.Length, Is.EqualTo(sizeAfterCreate), "Appends should not allocate pages");
+            Assert.That(subject.ReadFixedDocument("telemetry/ring", out var stream), Is.True);
+            var held = new MemoryStream();
+            stream.CopyTo(held);
+
+            Assert.That(held.Length, Is.GreaterThan(7000).And.LessThan(2 * 4096), "Ring should be full");
+            Assert.That(held.ToArray(), Is.EqualTo(written.Skip(written.Count - (int)held.Length).ToArray()), "Ring should hold the newest data, in order");
+            Assert.That(subject.ReadFixedDocument("telemetry/missing", out _), Is.False);
+        }
+
+        [Test]
+        public void circular_logs_keep_the_newest_whole_records () {
+            var subject = Database.TryConnect(new MemoryStream());
+            subject.CreateFixedDocument("device/events", 1);
+
+            var positions = new List<long>();
+            for (int i = 0; i < 100; i++)
+            {
+                var record = Enumerable.Repeat((byte)i, 50 + i).ToArray();
+                positions.Add(subject.AppendRecord("device/events", record));
+            }
+
+            var held = subject.ReadRecords("device/events").ToList();
+            Console.WriteLine($"Log holds {held.Count} records");
+            Assert.That(held.Count, Is.GreaterThan(10).And.LessThan(100), "Old records should have been overwritten");
+            for (int i = 0; i < held.Count; i++)
+            {
+                var expected = 100 - held.Count + i;
+                Assert.That(held[i].Position, Is.EqualTo(positions[expected]));
+                Assert.That(held[i].Data, Is.EqualTo(Enumerable.Repeat((byte)expected, 50 + expected).ToArray()));
+            }
+
+            var since = subject.ReadRecords("device/events", positions[95]).ToList();
+            Assert.That(since.Select(r => r.Data[0]), Is.EqualTo(new byte[] { 95, 96, 97, 98, 99 }));
+        }
+
+        [Test]
+        public void series_entries_can_be_read_by_time_range () {
+            var subject = Database.TryConnect(new MemoryStream());
+            var start = new DateTime(2024, 3, 1, 0, 0, 0, DateTimeKind.Utc);
+            for (int i = 0; i < 24; i++)
+            {
+                subject.WriteSeries("sensors/temp", start.AddHours(i), new MemoryStream(new[] { (byte)i }));
+            }
+            subject.WriteSeries("sensors/temperature", start.AddHours(5), new MemoryStream(new byte[] { 99 }));
+            subject.WriteDocument("sensors/temp/notes", new MemoryStream(new byte[] { 100 }));
+
+            var result = subject.ReadSeries("sensors/temp", start.AddHours(4), start.AddHours(8)).ToList();
+
+            Assert.That(result.Select(e => e.Timestamp), Is.EqualTo(Enumerable.Range(4, 4).Select(h => start.AddHours(h))));
+            Assert.That(result.Select(e => e.Data.ReadByte()), Is.EqualTo(new[] { 4, 5, 6, 7 }));
+            Assert.That(subject.ReadSeries("sensors/temp", start.AddDays(1), start.AddDays(2)), Is.Empty);
+        }
+
+        [Test]
+        public void engine_documents_live_in_a_reserved_namespace () {
+            var subject = Database.TryConnect(new MemoryStream());
+            subject.WriteDocument("/user/doc", new MemoryStream(new byte[] { 1 }));
+
+            Assert.Throws<ArgumentException>(() => subject.WriteDocument("/.streamdb/config", new MemoryStream(new byte[] { 1 })));
+            Assert.Throws<ArgumentException>(() => subject.Delete("/.streamdb/config"));
+            Assert.Throws<ArgumentException>(() => subject.RenamePrefix("/", "/moved/"));
+
+            subject.SystemDocuments.SetSetting("retention", "30d");
+            subject.SystemDocuments.SetSetting("owner", "ops");
+
+            Assert.That(subject.SystemDocuments.GetSetting("retention"), Is.EqualTo("30d"));
+            Assert.That(subject.SystemDocuments.ReadConfig().Count, Is.EqualTo(2));
+            Assert.That(subject.SystemDocuments.List(), Is.EqualTo(new[] { SystemDocuments.ConfigName }));
+
+            Assert.That(subject.Search("/"), Is.EqualTo(new[] { "/user/doc" }), "System documents should be hidden");
+            Assert.That(subject.Search("/", includeHidden: true), Is.EquivalentTo(new[] { "/user/doc", "/.streamdb/config" }));
+        }
+
+        [Test]
+        public void trash_pins_and_audit_log_are_bound_in_the_reserved_namespace () {
+            var storage = new MemoryStream();
+            var options = new DatabaseOptions { EnableAuditLog = true, TrashRetention = TimeSpan.FromDays(1) };
+            var subject = Database.TryConnect(storage, options);
+            var id = subject.WriteDocument("/user/pinned", new MemoryStream(new byte[] { 1 }));
+            subject.Pin(id);
+            subject.WriteDocument("/user/deleted", new MemoryStream(new byte[] { 2 }));
+            subject.SoftDelete("/user/deleted");
+
+            var expected = new[] { SystemDocuments.AuditName, SystemDocuments.PinsName, SystemDocuments.TrashName };
+            Assert.That(subject.SystemDocuments.List(), Is.EquivalentTo(expected));
+            Assert.That(subject.Search("/"), Is.EqualTo(new[] { "/user/pinned" }));
+            Assert.That(subject.SystemDocuments.Get(SystemDocuments.PinsName, out var pins), Is.True);
+            Assert.That(pins.Length, Is.GreaterThan(0));
+            Assert.Throws<ArgumentException>(() => subject.SystemDocuments.Write(SystemDocuments.TrashName, new MemoryStream(new byte[] { 3 })));
+            Assert.Throws<ArgumentException>(() => subject.SystemDocuments.Delete(SystemDocuments.AuditName));
+            Assert.That(subject.CheckIndexConsistency(checkUnbound: true).IsConsistent, Is.True);
+
+            // stores written before the namespace have these records with no path
+            foreach (var name in expected) new PageStorage(storage).UnbindPath(SystemDocuments.PathOf(name));
+            Assert.That(Database.TryConnect(storage, new DatabaseOptions { ReadReplica = true }).SystemDocuments.List(), Is.Empty);
+
+            var reopened = Database.TryConnect(storage, options);
+            Assert.That(reopened.SystemDocuments.List(), Is.EquivalentTo(expected));
+            Assert.That(reopened.IsPinned(id), Is.True);
+            Assert.That(reopened.Undelete("/user/deleted"), Is.True);
+        }
+
+        [Test]
+        public void binding_attributes_control_listing_and_deletion () {
+            var storage = new MemoryStream();
+            var subject = Database.TryConnect(storage);
+            subject.WriteDocument("app/visible", new MemoryStream(new byte[] { 1 }));
+            subject.WriteDocument("app/internal", new MemoryStream(new byte[] { 2 }), "cache", BindingAttributes.Hidden);
+            subject.WriteDocument("app/firmware", new MemoryStream(new byte[] { 3 }), null, BindingAttributes.Immutable);
+
+            Assert.That(subject.Search("app/"), Is.EquivalentTo(new[] { "app/visible", "app/firmware" }));
+            Assert.That(subject.Search("app/", includeHidden: true), Is.EquivalentTo(new[] { "app/visible", "app/internal", "app/firmware" }));
+
+            var reopened = Database.TryConnect(storage);
+            var info = reopened.GetBindingInfo("app/internal");
+            Assert.That(info.Attributes, Is.EqualTo(BindingAttributes.Hidden), "Attributes were not stored");
+            Assert.That(info.Annotation, Is.EqualTo("cache"));
+
+            Assert.Throws<Exception>(() => subject.WriteDocument("app/firmware", new MemoryStream(new byte[] { 4 })));
+            Assert.Throws<Exception>(() => subject.Delete("app/firmware"));
+
+            Assert.That(subject.DeletePrefix("app/"), Is.EqualTo(1), "Only the visible, mutable path should go");
+            Assert.That(subject.Search("app/", includeHidden: true), Is.EquivalentTo(new[] { "app/internal", "app/firmware" }));
+
+            Assert.That(subject.SetAttributes("app/firmware", BindingAttributes.None), Is.True);
+            Assert.That(subject.DeletePrefix("app/", includeHidden: true), Is.EqualTo(2));
+            Assert.That(subject.Search("app/", includeHidden: true), Is.Empty);
+        }
+
+        [Test]
+        public void immutable_documents_are_only_released_with_force () {
+            var storage = new MemoryStream();
+            var subject = Database.TryConnect(storage);
+            var id = subject.WriteImmutableDocument("images/v1", new MemoryStream(new byte[] { 1, 2, 3 }));
+            subject.BindToPath(id, "images/current");
+
+            var reopened = Database.TryConnect(storage);
+            Assert.That(reopened.IsImmutable(id), Is.True, "Immutable flag was not stored");
+
+            subject.UnbindPath(id, "images/current"); // not the last path, so allowed
+            Assert.Throws<Exception>(() => subject.UnbindPath(id, "images/v1"));
+            Assert.Throws<Exception>(() => subject.WriteDocument("images/v1", new MemoryStream(new byte[] { 4 })));
+            Assert.Throws<Exception>(() => subject.Delete(id));
+            Assert.That(subject.DeletePrefix("images/"), Is.Zero);
+            Assert.That(subject.GetIdByPath("images/v1", out var stillBound), Is.True);
+            Assert.That(stillBound, Is.EqualTo(id));
+
+            subject.Delete(id, force: true);
+            Assert.That(subject.GetIdByPath("images/v1", out _), Is.False);
+            Assert.That(subject.IsImmutable(id), Is.False);
+        }
+
+        [Test]
+        public void access_control_is_stored_and_checked_by_the_authorizer () {
+            var storage = new MemoryStream();
+            var authorizer = new PrincipalAuthorizer { Principal = "alice" };
+            var subject = Database.TryConnect(storage, new DatabaseOptions { Authorizer = authorizer });
+
+            var id = subject.WriteDocument("shared/plan", new MemoryStream(new byte[] { 1, 2, 3 }));
+            var control = new AccessControl { Owner = "alice" };
+            control.Grants["bob"] = AccessRights.Read;
+            subject.SetAccessControl(id, control);
+
+            var reopened = Database.TryConnect(storage);
+            var stored = reopened.GetAccessControl(id);
+            Assert.That(stored.Owner, Is.EqualTo("alice"), "Access control was not stored");
+            Assert.That(stored.RightsOf("bob"), Is.EqualTo(AccessRights.Read));
+
+            authorizer.Principal = "bob";
+            Assert.That(subject.Get("shared/plan", out _), Is.True, "Read access was refused");
+            Assert.Throws<UnauthorizedAccessException>(() => subject.WriteDocument("shared/plan", new MemoryStream(new byte[] { 4 })));
+            Assert.Throws<UnauthorizedAccessException>(() => subject.Delete("shared/plan"));
+            Assert.Throws<UnauthorizedAccessException>(() => subject.SetAccessControl(id, null));
+
+            authorizer.Principal = "carol";
+            Assert.Throws<UnauthorizedAccessException>(() => subject.Get("shared/plan", out _));
+
+            authorizer.Principal = "alice";
+            subject.Delete("shared/plan");
+            Assert.That(subject.GetAccessControl(id), Is.Null, "Access control outlived the document");
+        }
+
+        [Test]
+        public void the_engines_own_records_cant_be_changed_by_document_id () {
+            var authorizer = new PrincipalAuthorizer { Principal = "alice" };
+            var subject = Database.TryConnect(new MemoryStream(), new DatabaseOptions { Authorizer = authorizer });
+            var id = subject.WriteDocument("private/plan", new MemoryStream(new byte[] { 1, 2, 3 }));
+            subject.SetAccessControl(id, new AccessControl { Owner = "alice" });
+            subject.Pin(id);
+
+            var reserved = new[] { ReservedDocIds.Access, ReservedDocIds.Pins, ReservedDocIds.Trash, ReservedDocIds.Immutables };
+            foreach (var engineId in reserved)
+            {
+                Assert.Throws<ArgumentException>(() => subject.Delete(engineId, force: true), $"Deleted {engineId}");
+                Assert.Throws<ArgumentException>(() => subject.BindToPath(engineId, "exposed"));
+                Assert.Throws<ArgumentException>(() => subject.UnbindPath(engineId, "exposed"));
+                Assert.Throws<ArgumentException>(() => subject.Pin(engineId));
+                Assert.Throws<ArgumentException>(() => subject.Unpin(engineId));
+                Assert.Throws<ArgumentException>(() => subject.SetAccessControl(engineId, null));
+                Assert.Throws<ArgumentException>(() => subject.Demote(engineId));
+            }
+            Assert.That(subject.GetIdByPath("exposed", out _), Is.False);
+
+            authorizer.Principal = "mallory";
+            Assert.Throws<UnauthorizedAccessException>(() => subject.Get("private/plan", out _), "Access control was lost");
+            authorizer.Principal = "alice";
+            Assert.That(subject.IsPinned(id), Is.True, "Pin list was lost");
+        }
+
+        [Test]
+        public void ed25519_signatures_match_the_rfc_test_vector () {
+            // RFC 8032, section 7.1, test 2
+            var privateKey = Hex("4ccd089b28ff96da9db6c346ec114e0f5b8a319f35aba624da8cf6ed4fb8a6fb");
+            var message = new byte[] { 0x72 };
+
+            var signature = Ed25519.Sign(privateKey, message);
+            Assert.That(Ed25519.PublicKey(privateKey), Is.EqualTo(Hex("3d4017c3e843895a92b70aa74d1b7ebc9c982ccf2ec4968cc0cd55f12af4660c")));
+            Assert.That(signature, Is.EqualTo(Hex("92a009a9f0d4cab8720e820b5f642540a2b27b5416503f8fb3762223ebdb69da085ac1e43e15996e458f3613d0f11d8c387b2eaeb4302aeeb00d291612bb0c00")));
+            Assert.That(Ed25519.Verify(Ed25519.PublicKey(privateKey), message, signature), Is.True);
+            Assert.That(Ed25519.Verify(Ed25519.PublicKey(privateKey), new byte[] { 0x73 }, signature), Is.False);
+        }
+
+        [Test]
+        public void signed_manifests_detect_changed_documents () {
+            var privateKey = new byte[32];
+            new Random(4464).NextBytes(privateKey);
+            var publicKey = Ed25519.PublicKey(privateKey);
+            var otherKey = Ed25519.PublicKey(new byte[32]);
+
+            var storage = new MemoryStream();
+            var subject = Database.TryConnect(storage);
+            subject.WriteDocument("assets/logo.png", new MemoryStream(new byte[] { 1, 2, 3 }));
+            subject.WriteDocument("assets/strings.txt", new MemoryStream(new byte[] { 4, 5, 6 }));
+            Assert.That(subject.VerifyManifest(publicKey).ManifestFound, Is.False);
+
+            subject.SignManifest(privateKey);
+            Assert.That(subject.VerifyManifest(publicKey).IsValid, Is.True, "Fresh manifest should be valid");
+            Assert.That(subject.VerifyManifest(otherKey).SignatureValid, Is.False, "Wrong key was accepted");
+            Assert.That(Database.TryConnect(storage, new DatabaseOptions { ManifestKey = publicKey }), Is.Not.Null);
+
+            subject.WriteDocument("assets/strings.txt", new MemoryStream(new byte[] { 6, 6, 6 }));
+            subject.WriteDocument("assets/extra", new MemoryStream(new byte[] { 7 }));
+            var report = subject.VerifyManifest(publicKey);
+            Assert.That(report.Changed, Is.EqualTo(new[] { "assets/strings.txt" }));
+            Assert.That(report.Unlisted, Is.EqualTo(new[] { "assets/extra" }));
+
+            var ex = Assert.Throws<ManifestVerificationException>(() => Database.TryConnect(storage, new DatabaseOptions { ManifestKey = publicKey }));
+            Assert.That(ex.Report.IsValid, Is.False);
+        }
+
+        [Test]
+        public void version_statistics_count_live_and_retained_pages () {
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms);
+                var docId = subject.WriteDocument("large", new MemoryStream(new byte[BasicPage.PageDataCapacity * 2 + 10]));
+                var other = subject.WriteDocument("small", new MemoryStream(new byte[] { 1, 2, 3 }));
+
+                subject.Pin(docId);
+                subject.Pin(other); // second write of the pin list keeps the first as its previous revision
+
+                var report = subject.VersionStatistics();
+                Console.WriteLine(report);
+
+                var large = report.Documents.Single(d => d.DocumentId == docId);
+                Assert.That(large.LivePages, Is.EqualTo(3));
+                Assert.That(large.RetainedPages, Is.Zero);
+
+                var pins = report.Documents.Single(d => d.DocumentId == ReservedDocIds.Pins);
+                Assert.That(pins.LivePages, Is.EqualTo(1));
+                Assert.That(pins.RetainedPages, Is.EqualTo(1));
+
+                Assert.That(report.RetainedPages, Is.EqualTo(report.Documents.Sum(d => d.RetainedPages)));
+                Assert.That(report.RetainedFraction, Is.GreaterThan(0.0).And.LessThan(1.0));
+            }
+        }
+
+        [Test]
+        public void old_versions_can_be_purged_to_reclaim_space () {
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms, new DatabaseOptions { EnableAuditLog = true });
+                var ids = new List<Guid>();
+                for (int i = 0; i < 100; i++) // enough audit records to grow the log past one page
+                {
+                    ids.Add(subject.WriteDocument("doc/" + i, new MemoryStream(new byte[] { (byte)i })));
+                }
+                subject.Pin(ids[0]);
+                subject.Pin(ids[1]);
+
+                Assert.That(subject.VersionStatistics().Documents.Single(d => d.DocumentId == ReservedDocIds.Pins).RetainedPages, Is.EqualTo(1));
+
+                Assert.That(subject.PurgeOldVersions(ReservedDocIds.Pins), Is.True, "Pin list had a previous version");
+                Assert.That(subject.PurgeOldVersions(ReservedDocIds.Pins), Is.False, "Previous version was already purged");
+                Assert.That(subject.PurgeOldVersions(ids[5]), Is.False, "Documents written once have no previous version");
+
+                Assert.That(subject.VersionStatistics().Documents.Single(d => d.DocumentId == ReservedDocIds.Pins).RetainedPages, Is.Zero);
+                Assert.That(subject.IsPinned(ids[0]) && subject.IsPinned(ids[1]), Is.True, "Current version was lost");
+
+                var auditCount = subject.ReadAuditLog(DateTime.MinValue).Count();
+                subject.PurgeAllOldVersions();
+                Assert.That(subject.VersionStatistics().RetainedPages, Is.Zero);
+
+                // new writes reuse released pages, so would overwrite any that were still in use
+                for (int i = 0; i < 10; i++) { subject.WriteDocument("more/" + i, new MemoryStream(new byte[BasicPage.PageDataCapacity])); }
+                Assert.That(subject.ReadAuditLog(DateTime.MinValue).Count(), Is.EqualTo(auditCount + 10), "Pages still in the audit log were released");
+
+                subject.Pin(ids[2]); // versions work as normal after a purge
+                Assert.That(subject.IsPinned(ids[2]), Is.True);
+                Assert.That(subject.VersionStatistics().Documents.Single(d => d.DocumentId == ReservedDocIds.Pins).RetainedPages, Is.EqualTo(1));
+            }
+        }
+
+        [Test]
+        public void the_index_can_be_migrated_to_shards () {
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms);
+                var ids = new List<Guid>();
+                for (int i = 0; i < 300; i++) { ids.Add(subject.WriteDocument("before/" + i, new MemoryStream(new byte[i + 1]))); }
+                subject.Delete("before/7");
+
+                Assert.That(subject.ShardIndex(), Is.True, "Flat index was not migrated");
+                Assert.That(subject.ShardIndex(), Is.False, "Index was migrated twice");
+                Assert.That(new PageStorage(ms).Header().IndexSharded, Is.True);
+
+                for (int i = 0; i < 300; i++) { ids.Add(subject.WriteDocument("after/" + i, new MemoryStream(new byte[i + 1]))); }
+                subject.Delete("after/9");
+
+                var reconnected = Database.TryConnect(ms);
+                for (int i = 0; i < 300; i++)
+                {
+                    foreach (var prefix in new[] { "before/", "after/" })
+                    {
+                        var path = prefix + i;
+                        var expected = (path == "before/7" || path == "after/9") ? null : (long?)(i + 1);
+                        Assert.That(reconnected.Stat(path)?.Length, Is.EqualTo(expected), path);
+                    }
+                }
+                Assert.That(reconnected.VersionStatistics().Documents.Count(d => ids.Contains(d.DocumentId)), Is.EqualTo(598));
+                Assert.That(reconnected.CheckIntegrity().IsValid, Is.True);
+            }
+        }
+
+        [Test]
+        public void document_and_free_page_counts_are_kept_in_storage () {
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms);
+                for (int i = 0; i < 50; i++) { subject.WriteDocument("doc/" + i, new MemoryStream(new byte[5000])); }
+                subject.WriteDocument("doc/0", new MemoryStream(new byte[10])); // replacing doesn't add a document
+                for (int i = 40; i < 50; i++) { subject.Delete("doc/" + i); }
+
+                Assert.That(subject.Count(), Is.EqualTo(40));
+                subject.CalculateStatistics(out _, out var freePages);
+                Assert.That(freePages, Is.GreaterThan(0), "Deleted documents should release pages");
+
+                var reconnected = Database.TryConnect(ms);
+                Assert.That(reconnected.Count(), Is.EqualTo(40));
+                reconnected.CalculateStatistics(out _, out var reconnectedFree);
+                Assert.That(reconnectedFree, Is.EqualTo(freePages));
+                Assert.That(reconnected.CheckIntegrity().CountersCorrected, Is.False, "Counters drifted from the index and free list");
+
+                // Store wrong counts, as an interrupted write might leave them
+                var storage = new PageStorage(ms);
+                foreach (var page in CountersPages(ms))
+                {
+                    page.Write(BitConverter.GetBytes(1234L), 0, 8, 8);
+                    storage.CommitPage(page);
+                }
+
+                var stale = Database.TryConnect(ms);
+                Assert.That(stale.Count(), Is.EqualTo(1234));
+                var report = stale.CheckIntegrity();
+                Assert.That(report.CountersCorrected, Is.True);
+                Assert.That(report.IsValid, Is.True);
+                Assert.That(stale.Count(), Is.EqualTo(40));
+                Assert.That(Database.TryConnect(ms).Count(), Is.EqualTo(40), "Corrected counters were not stored");
+            }
+        }
+
+        [Test]
+        public void a_torn_counters_page_leaves_the_previous_counts_to_be_read () {
+            BasicPage.QuickAndDirtyMode = false;
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms);
+                for (int i = 0; i < 10; i++) { subject.WriteDocument("doc/" + i, new MemoryStream(new byte[5000])); }
+
+                var pages = CountersPages(ms);
+                Assert.That(pages.Count, Is.EqualTo(2), "Counters should be written to two pages in turn");
+                var previous = new byte[16];
+                pages[0].Read(previous, 0, 8, previous.Length);
+
+                // tear the newest counters page, as a crash while it was being written might
+                DamagePage(ms, pages[1].PageId);
+
+                var logger = new RecordingLogger();
+                var reconnected = Database.TryConnect(ms, new DatabaseOptions { Logger = logger });
+                Assert.That(reconnected.Count(), Is.EqualTo(BitConverter.ToInt64(previous, 0)));
+                Assert.That(logger.Contains("recounted"), Is.False, "The older counters page was not used");
+            }
+        }
+
+        /// <summary>
+        /// Pages holding stored document and free page counters, oldest first
+        /// </summary>
+        private static List<BasicPage> CountersPages(Stream storage) {
+            var pages = new PageStorage(storage);
+            var found = new List<KeyValuePair<long, BasicPage>>();
+            var pageCount = (storage.Length - PageStorage.HEADER_SIZE) / BasicPage.PageRawSize;
+            for (int i = 0; i < pageCount; i++)
+            {
+                var page = pages.GetRawPage(i, ignoreCrc: true);
+                if (page.DataLength < 32) continue;
+                var stored = new byte[32];
+                page.Read(stored, 0, 0, stored.Length);
+                if (Encoding.ASCII.GetString(stored, 0, 8) != "SDB-CNTR") continue;
+                found.Add(new KeyValuePair<long, BasicPage>(BitConverter.ToInt64(stored, 24), page));
+            }
+            return found.OrderBy(p => p.Key).Select(p => p.Value).ToList();
+        }
+
+        [Test]
+        public void documents_can_be_written_from_streams_that_cant_seek () {
+            var original = new byte[20000];
+            new Random(4472).NextBytes(original);
+            var compressed = new MemoryStream();
+            using (var gz = new GZipStream(compressed, CompressionMode.Compress, leaveOpen: true)) { gz.Write(original, 0, original.Length); }
+
+            Stream Unpack() => new GZipStream(new MemoryStream(compressed.ToArray()), CompressionMode.Decompress);
+            byte[] ReadAll(Stream s) { var copy = new MemoryStream(); s.CopyTo(copy); return copy.ToArray(); }
+
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms);
+
+                subject.WriteDocument("with length", Unpack(), original.Length);
+                Assert.That(subject.Get("with length", out var stored), Is.True);
+                Assert.That(ReadAll(stored), Is.EqualTo(original));
+                Assert.That(subject.Stat("with length").Length, Is.EqualTo(original.Length), "Length was not recorded");
+
+                subject.WriteDocument("without length", Unpack());
+                Assert.That(subject.Get("without length", out stored), Is.True);
+                Assert.That(ReadAll(stored), Is.EqualTo(original));
+
+                subject.CalculateStatistics(out _, out var freeBefore);
+                Assert.Throws<Exception>(() => subject.WriteDocument("too short", Unpack(), original.Length + 1));
+                Assert.That(subject.Get("too short", out _), Is.False);
+                Assert.That(subject.Count(), Is.EqualTo(2));
+
+                subject.CalculateStatistics(out _, out var freeAfter);
+                Assert.That(freeAfter - freeBefore, Is.GreaterThanOrEqualTo(BasicPage.CountRequired(original.Length + 1)), "Pages of the failed write were not released");
+            }
+        }
+
+        [Test]
+        public void documents_can_be_created_by_writing_to_a_stream () {
+            var original = new byte[150000];
+            new Random(4474).NextBytes(original);
+
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms);
+
+                Guid id;
+                using (var writer = subject.CreateDocument("written"))
+                {
+                    for (int offset = 0; offset < original.Length; offset += 7001)
+                    {
+                        writer.Write(original, offset, Math.Min(7001, original.Length - offset));
+                    }
+                    Assert.That(subject.Get("written", out _), Is.False, "Document was visible before the writer was closed");
+                    writer.Dispose();
+                    id = writer.DocumentId;
+                }
+
+                Assert.That(subject.Get("written", out var stored), Is.True);
+                var copy = new MemoryStream();
+                stored.CopyTo(copy);
+                Assert.That(copy.ToArray(), Is.EqualTo(original));
+                Assert.That(subject.GetBindingInfo("written").DocumentId, Is.EqualTo(id));
+
+                subject.CalculateStatistics(out _, out var freeBefore);
+                var aborted = subject.CreateDocument("aborted");
+                aborted.Write(original, 0, original.Length);
+                aborted.Abort();
+                aborted.Dispose();
+                Assert.That(subject.Get("aborted", out _), Is.False);
+                subject.CalculateStatistics(out _, out var freeAfter);
+                Assert.That(freeAfter, Is.GreaterThan(freeBefore), "Aborted data was not released");
+
+                var emptyWriter = subject.CreateDocument("empty");
+                emptyWriter.Dispose();
+                Assert.That(emptyWriter.DocumentId, Is.Not.EqualTo(Guid.Empty), "Empty document was not stored like `WriteDocument` would");
+            }
+        }
+
+        [Test]
+        public void temporary_documents_are_released_unless_bound () {
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms);
+                var kept = subject.PutTemp(new MemoryStream(new byte[] { 1, 2, 3 }));
+                var dropped = subject.PutTemp(new MemoryStream(new byte[] { 4, 5, 6 }));
+                subject.BindToPath(kept, "committed");
+                Assert.That(subject.Count(), Is.EqualTo(2));
+
+                // Simulate a crash: the connection is never disposed
+                var reopened = Database.TryConnect(ms);
+                Assert.That(reopened.Get("committed", out var stream), Is.True);
+                Assert.That(stream.Length, Is.EqualTo(3));
+                Assert.That(reopened.Count(), Is.EqualTo(1), "Unbound temporary document survived a reopen");
+
+                var staged = reopened.PutTemp(new MemoryStream(new byte[] { 7, 8, 9 }));
+                reopened.Pin(staged);
+                reopened.PutTemp(new MemoryStream(new byte[] { 10 }));
+                Assert.That(reopened.Count(), Is.EqualTo(3));
+
+                reopened.Dispose();
+                var closed = new MemoryStream();
+                var image = ms.ToArray(); // `Dispose` closed the storage stream, but its content can still be copied
+                closed.Write(image, 0, image.Length);
+                Assert.That(Database.TryConnect(closed, new DatabaseOptions { ReadReplica = true }).Count(), Is.EqualTo(2), "Unbound temporary document survived dispose");
+            }
+        }
+
+        [Test]
+        public void clones_copy_only_matching_documents () {
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms);
+                var shared = subject.WriteDocument("tenant-a/one", new MemoryStream(new byte[] { 1, 2, 3 }), "first");
+                subject.BindToPath(shared, "tenant-a/alias", null, BindingAttributes.Hidden);
+                subject.WriteImmutableDocument("tenant-a/audit", new MemoryStream(new byte[] { 4, 5 }));
+                subject.WriteDocument("tenant-b/two", new MemoryStream(new byte[4096]));
+                for (int i = 0; i < 10; i++) subject.WriteDocument("tenant-a/churn", new MemoryStream(new byte[2048]));
+
+                var clone = new MemoryStream();
+                var copied = subject.CloneTo(clone, path => path.StartsWith("tenant-a/"));
+                Assert.That(copied, Is.EqualTo(3));
+                Assert.That(clone.Length, Is.LessThan(ms.Length), "Clone was not compacted");
+
+                var result = Database.TryConnect(clone);
+                Assert.That(result.Search("").ToList(), Is.EquivalentTo(new[] { "tenant-a/one", "tenant-a/audit", "tenant-a/churn" }));
+                Assert.That(result.Get("tenant-b/two", out _), Is.False);
+
+                var binding = result.GetBindingInfo("tenant-a/one");
+                Assert.That(binding.Annotation, Is.EqualTo("first"));
+                var alias = result.GetBindingInfo("tenant-a/alias");
+                Assert.That(alias.DocumentId, Is.EqualTo(binding.DocumentId), "Shared document was copied twice");
+                Assert.That(alias.IsHidden, Is.True);
+                Assert.That(result.IsImmutable(result.GetBindingInfo("tenant-a/audit").DocumentId), Is.True);
+
+                Assert.That(result.Get("tenant-a/one", out var stream), Is.True);
+                var copy = new MemoryStream();
+                stream.CopyTo(copy);
+                Assert.That(copy.ToArray(), Is.EqualTo(new byte[] { 1, 2, 3 }));
+
+                Assert.Throws<ArgumentException>(() => subject.CloneTo(clone));
+            }
+        }
+
+        [Test]
+        public void stats_snapshots_are_kept_as_system_documents () {
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms);
+                subject.WriteDocument("one", new MemoryStream(new byte[10_000]));
+                subject.WriteDocument("one", new MemoryStream(new byte[10]));
+
+                subject.CalculateStatistics(out var total, out var free);
+                var name = subject.WriteStatsSnapshot();
+                Assert.That(subject.SystemDocuments.ListStatsSnapshots().ToList(), Is.EqualTo(new[] { name }));
+                Assert.That(subject.SystemDocuments.Get(name, out var stream), Is.True);
+                var json = new StreamReader(stream).ReadToEnd();
+                Assert.That(json.StartsWith("{\"time\":\""), Is.True);
+                Assert.That(json, Does.Contain($"\"totalPages\":{total},\"freePages\":{free},"));
+                Assert.That(subject.Search("").ToList(), Is.EqualTo(new[] { "one" }), "Snapshot was visible to a normal search");
+            }
+
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms, new DatabaseOptions { StatsInterval = TimeSpan.FromMilliseconds(20) });
+                var deadline = DateTime.UtcNow.AddSeconds(10);
+                while (subject.SystemDocuments.ListStatsSnapshots().Count() < 2 && DateTime.UtcNow < deadline) System.Threading.Thread.Sleep(10);
+                Assert.That(subject.SystemDocuments.ListStatsSnapshots().Count(), Is.GreaterThanOrEqualTo(2), "Snapshots were not written on a timer");
+                subject.Dispose();
+            }
+        }
+
+        [Test]
+        public void crc_checks_can_be_sampled () {
+            var storage = new MemoryStream();
+            var data = new byte[BasicPage.PageDataCapacity * 8];
+            new Random(4488).NextBytes(data);
+            Database.TryConnect(storage).WriteDocument("doc", new MemoryStream(data));
+
+            // damage the last page, which is the first read of every chain walk
+            var info = Database.TryConnect(storage).GetDocumentInfo("doc");
+            var pageId = int.Parse(System.Text.RegularExpressions.Regex.Match(info, @"file index = (\d+)").Groups[1].Value);
+            storage.Seek(PageStorage.HEADER_SIZE + (pageId * (long)BasicPage.PageRawSize) + BasicPage.PageHeadersSize + 10, SeekOrigin.Begin);
+            storage.WriteByte(0xFF);
+
+            BasicPage.QuickAndDirtyMode = false;
+            var sampled = Database.TryConnect(storage, new DatabaseOptions { CrcSampleRate = 4 });
+            Assert.That(sampled.Get("doc", out var stream), Is.True);
+            stream.CopyTo(new MemoryStream());
+            var stats = sampled.CrcSamplingStatistics();
+            Assert.That(stats.PagesRead, Is.GreaterThanOrEqualTo(8));
+            Assert.That(stats.PagesChecked, Is.EqualTo(stats.PagesRead / 4));
+            Assert.That(stats.Failures, Is.Zero);
+
+            var checkedAll = Database.TryConnect(storage);
+            Assert.Throws<Exception>(() => { checkedAll.Get("doc", out var s); s.CopyTo(new MemoryStream()); });
+            Assert.That(checkedAll.CrcSamplingStatistics().Failures, Is.EqualTo(1));
+        }
+
+        [Test]
+        public void documents_can_be_analysed_for_fragmentation () {
+            var subject = Database.TryConnect(new MemoryStream());
+            var first = subject.WriteDocument("first", new MemoryStream(new byte[BasicPage.PageDataCapacity * 3]));
+            subject.WriteDocument("spacer", new MemoryStream(new byte[] { 1, 2, 3 }));
+
+            var tidy = subject.AnalyzeDocument(first);
+            Assert.That(tidy, Is.Not.Null);
+            Assert.That(tidy.PageCount, Is.EqualTo(3));
+            Assert.That(tidy.Runs, Is.EqualTo(1), tidy.ToString());
+            Assert.That(tidy.MaxGap, Is.EqualTo(1));
+            Assert.That(tidy.SequentialReadEfficiency, Is.EqualTo(1.0));
+
+            subject.Delete(first, force: true);
+            var scattered = subject.AnalyzeDocument(subject.WriteDocument("scattered", new MemoryStream(new byte[BasicPage.PageDataCapacity * 6])));
+            Assert.That(scattered, Is.Not.Null);
+            Assert.That(scattered.PageCount, Is.EqualTo(6));
+            Assert.That(scattered.Runs, Is.GreaterThan(1), scattered.ToString());
+            Assert.That(scattered.MaxGap, Is.GreaterThan(1));
+            Assert.That(scattered.SequentialReadEfficiency, Is.LessThan(1.0));
+
+            Assert.That(subject.AnalyzeDocument(Guid.NewGuid()), Is.Null);
+        }
+
+        [Test]
+        public void fragmented_documents_can_be_rewritten_contiguously () {
+            var storage = new MemoryStream();
+            var subject = Database.TryConnect(storage);
+            var first = subject.WriteDocument("first", new MemoryStream(new byte[BasicPage.PageDataCapacity * 3]));
+            subject.WriteDocument("spacer", new MemoryStream(new byte[] { 1, 2, 3 }));
+            subject.Delete(first, force: true);
+
+            var data = new byte[BasicPage.PageDataCapacity * 6 + 100];
+            new Random(4492).NextBytes(data);
+            var id = subject.WriteDocument("scattered", new MemoryStream(data));
+            Assert.That(subject.AnalyzeDocument(id).Runs, Is.GreaterThan(1));
+
+            Assert.That(subject.OptimizeDocument(id), Is.True);
+            var report = subject.AnalyzeDocument(id);
+            Assert.That(report.Runs, Is.EqualTo(1), report.ToString());
+            Assert.That(report.PageCount, Is.EqualTo(7));
+            Assert.That(subject.OptimizeDocument(id), Is.False, "Contiguous documents should be left alone");
+            Assert.That(subject.OptimizeDocument(Guid.NewGuid()), Is.False);
+
+            var reconnected = Database.TryConnect(storage);
+            Assert.That(reconnected.Get("scattered", out var stream), Is.True);
+            var result = new MemoryStream();
+            stream.CopyTo(result);
+            Assert.That(result.ToArray(), Is.EqualTo(data));
+            Assert.That(reconnected.CheckIntegrity().IsValid, Is.True);
+        }
+
+        [Test]
+        public void in_memory_databases_can_be_forked () {
+            var seeded = Database.TryConnect(new CopyOnWriteMemoryStream());
+            var data = new byte[BasicPage.PageDataCapacity * 3];
+            new Random(4496).NextBytes(data);
+            seeded.WriteDocument("shared", new MemoryStream(data));
+
+            var fork = seeded.ForkInMemory();
+            fork.WriteDocument("fork only", new MemoryStream(new byte[] { 1, 2, 3 }));
+            fork.Delete("shared", force: true);
+            seeded.WriteDocument("seed only", new MemoryStream(new byte[] { 4, 5, 6 }));
+
+            Assert.That(seeded.Get("shared", out var original), Is.True);
+            var result = new MemoryStream();
+            original.CopyTo(result);
+            Assert.That(result.ToArray(), Is.EqualTo(data));
+            Assert.That(seeded.Get("fork only", out _), Is.False);
+
+            Assert.That(fork.Get("shared", out _), Is.False);
+            Assert.That(fork.Get("seed only", out _), Is.False);
+            Assert.That(fork.Get("fork only", out _), Is.True);
+
+            var second = seeded.ForkInMemory();
+            Assert.That(second.Get("seed only", out _), Is.True);
+            Assert.That(second.CheckIntegrity().IsValid, Is.True);
+            Assert.That(fork.CheckIntegrity().IsValid, Is.True);
+
+            Assert.Throws<InvalidOperationException>(() => Database.TryConnect(new MemoryStream()).ForkInMemory());
+        }
+
+        [Test]
+        public void forked_memory_streams_share_blocks_until_written () {
+            var source = new CopyOnWriteMemoryStream();
+            var data = new byte[CopyOnWriteMemoryStream.BlockSize * 4 + 10];
+            new Random(4496).NextBytes(data);
+            source.Write(data, 0, data.Length);
+
+            var fork = source.Fork();
+            Assert.That(fork.Length, Is.EqualTo(data.Length));
+            Assert.That(fork.UnsharedBlocks, Is.Zero);
+            Assert.That(source.UnsharedBlocks, Is.Zero);
+
+            fork.Seek(CopyOnWriteMemoryStream.BlockSize + 5, SeekOrigin.Begin);
+            fork.WriteByte(0xAA);
+            Assert.That(fork.UnsharedBlocks, Is.EqualTo(1));
+
+            var fromSource = new byte[data.Length];
+            source.Seek(0, SeekOrigin.Begin);
+            Assert.That(source.Read(fromSource, 0, fromSource.Length), Is.EqualTo(data.Length));
+            Assert.That(fromSource, Is.EqualTo(data));
+
+            fork.Seek(CopyOnWriteMemoryStream.BlockSize + 5, SeekOrigin.Begin);
+            Assert.That(fork.ReadByte(), Is.EqualTo(0xAA));
+
+            // truncated data reads as zeros if the stream grows again
+            fork.SetLength(10);
+            fork.SetLength(data.Length);
+            fork.Seek(0, SeekOrigin.Begin);
+            var fromFork = new byte[data.Length];
+            fork.Read(fromFork, 0, fromFork.Length);
+            Assert.That(fromFork.Take(10), Is.EqualTo(data.Take(10)));
+            Assert.That(fromFork.Skip(10).All(b => b == 0), Is.True);
+        }
+
+        [Test]
+        public void forked_memory_streams_copy_one_block_per_page_written () {
+            var source = new CopyOnWriteMemoryStream();
+            source.Write(new byte[PageStorage.HEADER_SIZE + BasicPage.PageRawSize * 4], 0, PageStorage.HEADER_SIZE + BasicPage.PageRawSize * 4);
+
+            var fork = source.Fork();
+            fork.Seek(PageStorage.HEADER_SIZE + BasicPage.PageRawSize * 2, SeekOrigin.Begin);
+            fork.Write(new byte[BasicPage.PageRawSize], 0, BasicPage.PageRawSize);
+            Assert.That(fork.UnsharedBlocks, Is.EqualTo(1), "a whole page should fit in one block");
+
+            fork.Seek(0, SeekOrigin.Begin);
+            fork.Write(new byte[PageStorage.HEADER_SIZE], 0, PageStorage.HEADER_SIZE);
+            Assert.That(fork.UnsharedBlocks, Is.EqualTo(2), "the header should have a block of its own");
+        }
+
+        [Test]
+        public void forked_memory_streams_fold_layers_back_once_forks_are_disposed () {
+            var source = new CopyOnWriteMemoryStream();
+            var forks = new List<CopyOnWriteMemoryStream>();
+            for (int i = 0; i < 5; i++)
+            {
+                source.Seek(PageStorage.HEADER_SIZE + BasicPage.PageRawSize * i, SeekOrigin.Begin);
+                source.WriteByte((byte)(i + 1));
+                forks.Add(source.Fork());
+            }
+            Assert.That(source.SharedLayers, Is.EqualTo(5));
+
+            foreach (var fork in forks) fork.Dispose();
+            source.Seek(0, SeekOrigin.Begin);
+            source.WriteByte(9);
+
+            Assert.That(source.SharedLayers, Is.EqualTo(0));
+            Assert.That(source.UnsharedBlocks, Is.EqualTo(6));
+            for (int i = 0; i < 5; i++)
+            {
+                source.Seek(PageStorage.HEADER_SIZE + BasicPage.PageRawSize * i, SeekOrigin.Begin);
+                Assert.That(source.ReadByte(), Is.EqualTo(i + 1));
+            }
+        }
+
+        [Test]
+        public void forked_memory_streams_keep_layers_a_live_fork_still_uses () {
+            var source = new CopyOnWriteMemoryStream();
+            source.WriteByte(1);
+            var first = source.Fork();
+            source.WriteByte(2);
+            var second = source.Fork();
+
+            first.Dispose();
+            source.WriteByte(3);
+            Assert.That(source.SharedLayers, Is.EqualTo(2), "the second fork still reads through both frozen layers");
+
+            second.Seek(0, SeekOrigin.Begin);
+            Assert.That(second.ReadByte(), Is.EqualTo(1));
+            Assert.That(second.ReadByte(), Is.EqualTo(2));
+            Assert.That(second.ReadByte(), Is.EqualTo(-1));
+        }
+
+        [Test]
+        public void in_memory_storage_spills_to_a_file_when_it_grows () {
+            var storage = new SpillingStream(64 * 1024);
+            var subject = Database.TryConnect(storage);
+            subject.WriteDocument("small", new MemoryStream(new byte[] { 1, 2, 3 }));
+            Assert.That(storage.IsSpilled, Is.False);
+
+            var data = new byte[BasicPage.PageDataCapacity * 40];
+            new Random(4497).NextBytes(data);
+            subject.WriteDocument("large", new MemoryStream(data));
+            Assert.That(storage.IsSpilled, Is.True);
+            var path = storage.SpillPath;
+            Assert.That(File.Exists(path), Is.True);
+
+            Assert.That(subject.Get("small", out var small), Is.True);
+            Assert.That(small.Length, Is.EqualTo(3));
+            Assert.That(subject.Get("large", out var large), Is.True);
+            var result = new MemoryStream();
+            large.CopyTo(result);
+            Assert.That(result.ToArray(), Is.EqualTo(data));
+            Assert.That(subject.CheckIntegrity().IsValid, Is.True);
+
+            subject.Dispose();
+            Assert.That(File.Exists(path), Is.False, "Temporary file was not removed");
+        }
+
+        [Test]
+        public void searches_can_be_resumed_from_a_cursor () {
+            var storage = new MemoryStream();
+            var subject = Database.TryConnect(storage);
+            var id = subject.WriteDocument("other/0", new MemoryStream(new byte[] { 1 }));
+            for (int i = 0; i < 25; i++) subject.BindToPath(id, $"scan/{i:D2}");
+
+            var first = subject.SearchPaged("scan/", 10);
+            Assert.That(first.Paths, Is.EqualTo(Enumerable.Range(0, 10).Select(i => $"scan/{i:D2}")));
+            Assert.That(first.Cursor, Is.Not.Null);
+
+            // resume from a new connection, after the last returned path is unbound
+            subject.UnbindPath(id, "scan/09");
+            var reconnected = Database.TryConnect(storage);
+            var second = reconnected.SearchPaged("scan/", 10, first.Cursor);
+            Assert.That(second.Paths, Is.EqualTo(Enumerable.Range(10, 10).Select(i => $"scan/{i:D2}")));
+
+            var last = reconnected.SearchPaged("scan/", 10, second.Cursor);
+            Assert.That(last.Paths, Is.EqualTo(Enumerable.Range(20, 5).Select(i => $"scan/{i:D2}")));
+            Assert.That(last.Cursor, Is.Null);
+
+            Assert.Throws<ArgumentException>(() => reconnected.SearchPaged("other/", 10, first.Cursor));
+            Assert.Throws<ArgumentException>(() => reconnected.SearchPaged("scan/", 10, "not a cursor"));
+        }
+
+        [Test]
+        public void snapshots_are_not_affected_by_later_writes () {
+            var storage = new MemoryStream();
+            var subject = Database.TryConnect(storage);
+            var before = new byte[BasicPage.PageDataCapacity * 3];
+            new Random(4499).NextBytes(before);
+            subject.WriteDocument("changed", new MemoryStream(before));
+            subject.WriteDocument("deleted", new MemoryStream(new byte[] { 1, 2, 3 }));
+
+            using (var snapshot = subject.OpenSnapshot())
+            {
+                // replace twice, so the chain read by the snapshot is released, then write more to reuse free pages
+                subject.WriteDocument("changed", new MemoryStream(new byte[BasicPage.PageDataCapacity * 2]));
+                subject.WriteDocument("changed", new MemoryStream(new byte[BasicPage.PageDataCapacity * 2]));
+                subject.Delete("deleted", force: true);
+                subject.WriteDocument("added", new MemoryStream(new byte[BasicPage.PageDataCapacity * 8]));
+
+                Assert.That(snapshot.Search(""), Is.EqualTo(new[] { "changed", "deleted" }));
+                Assert.That(snapshot.Get("changed", out var stream), Is.True);
+                var result = new MemoryStream();
+                stream.CopyTo(result);
+                Assert.That(result.ToArray(), Is.EqualTo(before));
+                Assert.That(snapshot.Stat("changed").Length, Is.EqualTo(before.Length));
+                Assert.That(snapshot.Get("deleted", out var deleted), Is.True);
+                Assert.That(deleted.Length, Is.EqualTo(3));
+                Assert.That(snapshot.Get("added", out _), Is.False);
+
+                var zip = new MemoryStream();
+                Assert.That(ZipTransfer.ExportZip(subject, zip), Is.EqualTo(2), "Exports take their own snapshot, alongside this one");
+            }
+
+            Assert.That(subject.CheckIntegrity().IsValid, Is.True);
+            Assert.That(Database.TryConnect(storage).CheckIntegrity().CountersCorrected, Is.False, "Held pages were not released");
+        }
+
+        [Test]
+        public void snapshots_of_fixed_documents_are_not_affected_by_later_appends () {
+            var storage = new MemoryStream();
+            var subject = Database.TryConnect(storage);
+            subject.CreateFixedDocument("ring", 1);
+            subject.AppendToFixedDocument("ring", new byte[] { 1, 2, 3 });
+            subject.CreateFixedDocument("log", 1);
+            subject.AppendRecord("log", new byte[] { 4, 5, 6 });
+            byte[] ReadAll(Stream s) { var copy = new MemoryStream(); s.CopyTo(copy); return copy.ToArray(); }
+
+            Assert.That(subject.Get("ring", out var ringBefore), Is.True);
+            Assert.That(subject.Get("log", out var logBefore), Is.True);
+            var expectedRing = ReadAll(ringBefore);
+            var expectedLog = ReadAll(logBefore);
+
+            using (var snapshot = subject.OpenSnapshot())
+            {
+                subject.AppendToFixedDocument("ring", new byte[] { 7, 8, 9 });
+                subject.AppendRecord("log", new byte[] { 10, 11, 12 });
+
+                Assert.That(snapshot.Get("ring", out var ring), Is.True);
+                Assert.That(ReadAll(ring), Is.EqualTo(expectedRing));
+                Assert.That(snapshot.Get("log", out var log), Is.True);
+                Assert.That(ReadAll(log), Is.EqualTo(expectedLog));
+            }
+
+            Assert.That(subject.ReadRecords("log").Count(), Is.EqualTo(2));
+        }
+
+        [Test]
+        public void writes_can_be_checked_before_they_are_stored () {
+            var subject = Database.TryConnect(new MemoryStream());
+            var seen = new List<string>();
+            subject.OnBeforePut(put => seen.Add(put.Path + "=" + new StreamReader(put.Data).ReadToEnd()));
+            subject.OnBeforePut(put => {
+                if (new StreamReader(put.Data).ReadToEnd().Contains("virus")) throw new InvalidDataException("Rejected by scan");
+            });
+
+            subject.WriteDocument("clean", new MemoryStream(Encoding.UTF8.GetBytes("hello")));
+            var ex = Assert.Throws<InvalidDataException>(() => subject.WriteDocument("dirty", new MemoryStream(Encoding.UTF8.GetBytes("a virus"))));
+            Assert.That(ex.Message, Is.EqualTo("Rejected by scan"));
+            var piped = new MemoryStream(Encoding.UTF8.GetBytes("piped"));
+            subject.WriteDocument("piped", piped, piped.Length);
+
+            var session = subject.StartUpload("uploaded");
+            subject.UploadPart(session, 1, new MemoryStream(Encoding.UTF8.GetBytes("virus")));
+            Assert.Throws<InvalidDataException>(() => subject.CompleteUpload(session));
+
+            Assert.That(seen, Is.EqualTo(new[] { "clean=hello", "dirty=a virus", "piped=piped", "uploaded=virus" }));
+            Assert.That(subject.Search(""), Is.EqualTo(new[] { "clean", "piped" }));
+            Assert.That(subject.Get("piped", out var stream), Is.True);
+            Assert.That(new StreamReader(stream).ReadToEnd(), Is.EqualTo("piped"), "Checked data was not written intact");
+            Assert.That(subject.CheckIntegrity().IsValid, Is.True);
+        }
+
+        [Test]
+        public void an_upload_rejected_by_a_check_releases_its_pages () {
+            var subject = Database.TryConnect(new MemoryStream());
+            subject.OnBeforePut(put => { if (put.Path == "rejected") throw new InvalidDataException("Rejected by scan"); });
+            var data = new byte[BasicPage.PageDataCapacity * 10];
+
+            var session = subject.StartUpload("rejected");
+            subject.UploadPart(session, 1, new MemoryStream(data));
+            subject.CalculateStatistics(out _, out var freeBefore);
+            Assert.Throws<InvalidDataException>(() => subject.CompleteUpload(session));
+            subject.CalculateStatistics(out _, out var freeAfter);
+
+            Assert.That(freeAfter - freeBefore, Is.GreaterThanOrEqualTo(10), "Upload chain was not released");
+        }
+
+        [Test]
+        public void committed_changes_are_delivered_to_hooks_in_log_order () {
+            var storage = new MemoryStream();
+            var subject = Database.TryConnect(storage, new DatabaseOptions { EnableAuditLog = true });
+            subject.WriteDocument("before", new MemoryStream(new byte[] { 1 }));
+
+            var delivered = new List<AuditRecord>();
+            subject.OnAfterCommit(change => {
+                delivered.Add(change);
+                if (change.Path == "source") subject.WriteDocument("derived", new MemoryStream(new byte[] { 2 })); // downstream write from a hook
+            });
+            subject.OnAfterCommit(change => throw new Exception("broken hook"));
+
+            subject.WriteDocument("source", new MemoryStream(new byte[] { 3 }));
+            subject.BindToPath(subject.GetIdByPath("source", out var id) ? id : Guid.Empty, "alias");
+            subject.Delete("before");
+
+            Assert.That(delivered.Select(c => c.Operation + " " + c.Path), Is.EqualTo(new[] {
+                "WriteDocument source", "WriteDocument derived", "BindPath alias", "DeleteDocument before"
+            }));
+            Assert.That(delivered.Select(c => c.Sequence), Is.EqualTo(new long[] { 1, 2, 3, 4 }));
+
+            var log = subject.ReadAuditLogFrom(2).ToList();
+            Assert.That(log.Select(c => c.Sequence), Is.EqualTo(new long[] { 2, 3, 4 }));
+            Assert.That(log.Select(c => c.Path), Is.EqualTo(delivered.Skip(1).Select(c => c.Path)));
+
+            Assert.Throws<InvalidOperationException>(() => Database.TryConnect(new MemoryStream()).OnAfterCommit(_ => { }));
+        }
+
+        [Test]
+        public void paths_and_the_document_index_can_be_cross_checked_and_repaired () {
+            var engine = new MemoryStorageEngine();
+            var subject = Database.ConnectToEngine(engine, new DatabaseOptions { Deduplicate = true }); // chunks have no paths either
+            var lost = subject.WriteDocument("lost", new MemoryStream(new byte[] { 1 }));
+            subject.WriteDocument("fine", new MemoryStream(new byte[] { 2 }));
+            subject.WriteDocument("chunked", new MemoryStream(new byte[20000]));
+            var temp = subject.PutTemp(new MemoryStream(new byte[] { 3 }));
+            var pinned = subject.PutTemp(new MemoryStream(new byte[] { 4 }));
+            subject.Pin(pinned);
+
+            engine.UnbindIndex(lost); // path left pointing at nothing
+            var orphan = Guid.NewGuid();
+            engine.BindIndex(orphan, engine.WriteStream(new MemoryStream(new byte[] { 5 })), out _); // document with no path
+
+            var quick = subject.CheckIndexConsistency();
+            Assert.That(quick.DanglingPaths, Is.EqualTo(new[] { "lost" }));
+            Assert.That(quick.UnboundDocuments, Is.Empty, "Unbound documents were not asked for");
+
+            var full = subject.CheckIndexConsistency(checkUnbound: true);
+            Assert.That(full.UnboundDocuments, Is.EqualTo(new[] { orphan }), "Temporary and pinned documents should be kept");
+            Assert.That(full.Repaired, Is.False);
+            Assert.That(subject.Search(""), Does.Contain("lost"));
+
+            var repaired = subject.CheckIndexConsistency(checkUnbound: true, repair: true);
+            Assert.That(repaired.Repaired, Is.True);
+            Assert.That(repaired.ToString(), Does.Contain("1 dangling paths, 1 unbound documents; repaired"));
+            Assert.That(subject.Search("").OrderBy(p => p), Is.EqualTo(new[] { "chunked", "fine" }));
+            Assert.That(engine.GetDocumentHead(orphan), Is.EqualTo(-1));
+            Assert.That(engine.GetDocumentHead(temp), Is.GreaterThanOrEqualTo(0));
+            Assert.That(subject.CheckIndexConsistency(checkUnbound: true).IsConsistent, Is.True);
+
+            var paged = Database.TryConnect(new MemoryStream(), new DatabaseOptions { Deduplicate = true });
+            paged.WriteDocument("chunked", new MemoryStream(new byte[20000]));
+            paged.PutTemp(new MemoryStream(new byte[] { 1 }));
+            Assert.That(paged.CheckIndexConsistency(checkUnbound: true).ToString(), Is.EqualTo("1 paths and 2 documents checked; no errors"));
+        }
+
+        [Test]
+        public void databases_can_be_opened_and_closed_from_a_file_path () {
+            var path = Path.Combine(Path.GetTempPath(), "streamdb-" + Guid.NewGuid() + ".db");
+            try
+            {
+                var created = Database.Open(path);
+                created.WriteDocument("kept", new MemoryStream(new byte[] { 1, 2, 3 }));
+                created.Close();
+                Assert.That(File.Exists(path), Is.True);
+                Assert.That(File.Exists(path + Database.WriteAheadLogSuffix), Is.False, "Empty write-ahead log was not removed on close");
+
+                using (var reopened = Database.Open(path))
+                using (var replica = Database.Open(path, new DatabaseOptions { ReadReplica = true }))
+                {
+                    Assert.That(reopened.Get("kept", out var stream), Is.True);
+                    Assert.That(stream.Length, Is.EqualTo(3));
+                    Assert.That(replica.Search(""), Is.EqualTo(new[] { "kept" }));
+                }
+
+                Assert.Throws<FileNotFoundException>(() => Database.Open(path + ".missing", new DatabaseOptions { ReadReplica = true }));
+            }
+            finally
+            {
+                File.Delete(path);
+            }
+        }
+
+        [Test]
+        public void damage_found_on_open_is_handled_by_the_recovery_policy () {
+            var storage = new MemoryStream();
+            var original = Database.TryConnect(storage);
+            original.WriteDocument("first", new MemoryStream(new byte[] { 1 }));
+            original.WriteDocument("second", new MemoryStream(new byte[] { 2 }));
+
+            var damagedPage = new PageStorage(storage).Header().PathLookupLink.Newest;
+            storage.Seek(PageStorage.HEADER_SIZE + (damagedPage * (long)BasicPage.PageRawSize) + BasicPage.PageHeadersSize + 10, SeekOrigin.Begin);
+            storage.WriteByte(0xFF);
+            var image = storage.ToArray();
+            MemoryStream Damaged() { var copy = new MemoryStream(); copy.Write(image, 0, image.Length); return copy; }
+
+            Assert.That(Database.TryConnect(Damaged()), Is.Not.Null, "Default policy does not check");
+            var ex = Assert.Throws<StorageRecoveryException>(() => Database.TryConnect(Damaged(), new DatabaseOptions { Recovery = RecoveryPolicy.Fail }));
+            Assert.That(ex.Report.FailedPages, Is.EqualTo(new[] { damagedPage }));
+
+            var readOnly = Database.TryConnect(Damaged(), new DatabaseOptions { Recovery = RecoveryPolicy.ReadOnly });
+            Assert.Throws<InvalidOperationException>(() => readOnly.PutTemp(new MemoryStream(new byte[] { 3 })));
+
+            var quarantined = Damaged();
+            Database.TryConnect(quarantined, new DatabaseOptions { Recovery = RecoveryPolicy.Quarantine });
+            Assert.That(new PageStorage(quarantined).BadPages(), Is.EqualTo(new[] { damagedPage }));
+
+            var repaired = Damaged();
+            var subject = Database.TryConnect(repaired, new DatabaseOptions { Recovery = RecoveryPolicy.Repair });
+            Assert.That(subject.HealthCheck().IsHealthy, Is.True);
+            Assert.That(subject.Search(""), Is.EqualTo(new[] { "first" }), "Should fall back to the previous path lookup");
+            Assert.That(new PageStorage(repaired).BadPages(), Is.EqualTo(new[] { damagedPage }));
+            subject.WriteDocument("third", new MemoryStream(new byte[] { 3 }));
+            Assert.That(subject.Search("").OrderBy(p => p), Is.EqualTo(new[] { "first", "third" }));
+        }
+
+        [Test]
+        public void open_document_streams_are_counted_and_limited () {
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms, new DatabaseOptions { MaxOpenStreams = 2 });
+                subject.WriteDocument("a", new MemoryStream(new byte[20000]));
+                subject.WriteDocument("b", new MemoryStream(new byte[20000]));
+
+                Assert.That(subject.Get("a", out var first), Is.True);
+                Assert.That(subject.ReadRange("b", 100, 50, out var second), Is.True);
+                first.ReadByte();
+                second.ReadByte();
+                Assert.That(subject.OpenStreamCount, Is.EqualTo(2));
+                var heldMemory = subject.CacheMemoryUsed;
+
+                var ex = Assert.Throws<StreamLimitException>(() => subject.Get("a", out _));
+                Assert.That(ex.Limit, Is.EqualTo(2));
+                using (var snapshot = subject.OpenSnapshot())
+                {
+                    Assert.Throws<StreamLimitException>(() => snapshot.Get("b", out _));
+                }
+
+                first.Dispose();
+                first.Dispose(); // only counted once
+                second.Dispose();
+                Assert.That(subject.OpenStreamCount, Is.EqualTo(0));
+                Assert.That(subject.CacheMemoryUsed, Is.LessThan(heldMemory), "Pages held by disposed streams were not released");
+
+                Assert.That(subject.Get("a", out var third), Is.True);
+                third.Dispose();
+            }
+        }
+
+        [Test]
+        public void opening_a_stream_at_the_limit_can_wait_for_one_to_be_disposed () {
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms, new DatabaseOptions { MaxOpenStreams = 1, OpenStreamWait = TimeSpan.FromSeconds(10) });
+                subject.WriteDocument("a", new MemoryStream(new byte[] { 1, 2, 3 }));
+
+                Assert.That(subject.Get("a", out var held), Is.True);
+                var release = System.Threading.Tasks.Task.Run(() => { System.Threading.Thread.Sleep(100); held.Dispose(); });
+
+                Assert.That(subject.Get("a", out var next), Is.True, "Did not wait for the open stream to be disposed");
+                release.Wait();
+                Assert.That(next.ReadByte(), Is.EqualTo(1));
+                next.Dispose();
+                Assert.That(subject.OpenStreamCount, Is.EqualTo(0));
+            }
+        }
+
+        [Test]
+        public void closing_a_document_stream_releases_it_and_unclosed_streams_are_logged () {
+            var log = new RecordingLogger();
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms, new DatabaseOptions { Logger = log });
+                subject.WriteDocument("kept/closed", new MemoryStream(new byte[20000]));
+                subject.WriteDocument("kept/leaked", new MemoryStream(new byte[20000]));
+
+                Assert.That(subject.Get("kept/closed", out var stream), Is.True);
+                stream.ReadByte();
+                stream.Close();
+                Assert.That(subject.OpenStreamCount, Is.EqualTo(0));
+                Assert.That(log.Contains("not disposed"), Is.False);
+
+                OpenAndDrop(subject, "kept/leaked");
+                GC.Collect();
+                GC.WaitForPendingFinalizers();
+
+                Assert.That(subject.OpenStreamCount, Is.EqualTo(0));
+                Assert.That(log.Contains("Document stream was not disposed path=kept/leaked"), Is.True);
+            }
+        }
+
+        [System.Runtime.CompilerServices.MethodImpl(System.Runtime.CompilerServices.MethodImplOptions.NoInlining)]
+        private static void OpenAndDrop(Database db, string path)
+        {
+            db.Get(path, out var stream);
+            stream.ReadByte();
+        }
+
+        [Test]
+        public void paths_can_be_listed_in_a_named_collation_that_is_kept_with_the_database () {
+            Assert.That(new[] { "item10", "item9", "item1", "item09x", "other" }.OrderBy(p => p, PathCollation.Numeric),
+                Is.EqualTo(new[] { "item1", "item9", "item09x", "item10", "other" }));
+
+            var ms = new MemoryStream();
+            var subject = Database.TryConnect(ms, new DatabaseOptions { Collation = PathCollation.Numeric });
+            foreach (var i in new[] { 10, 9, 100, 1, 2 }) subject.WriteDocument($"item{i}", new MemoryStream(new byte[] { 1 }));
+
+            var first = subject.SearchPaged("item", 3);
+            Assert.That(first.Paths, Is.EqualTo(new[] { "item1", "item2", "item9" }));
+            Assert.That(subject.SearchPaged("item", 3, first.Cursor).Paths, Is.EqualTo(new[] { "item10", "item100" }));
+            subject.Flush();
+
+            // the collation is picked up from storage
+            var reopened = Database.TryConnect(new MemoryStream(ms.ToArray()));
+            Assert.That(reopened.Collation.Name, Is.EqualTo("numeric"));
+            Assert.That(reopened.SearchPaged("item", 10).Paths.Last(), Is.EqualTo("item100"));
+
+            Assert.Throws<InvalidOperationException>(() => Database.TryConnect(new MemoryStream(ms.ToArray()), new DatabaseOptions { Collation = PathCollation.Ordinal }));
+
+            // custom collations must be given again on each connection
+            var reversed = new PathCollation("test-reversed", (a, b) => string.CompareOrdinal(b, a));
+            var custom = new MemoryStream();
+            Database.TryConnect(custom, new DatabaseOptions { Collation = reversed }).Flush();
+            Assert.Throws<InvalidOperationException>(() => Database.TryConnect(new MemoryStream(custom.ToArray())));
+            Assert.That(Database.TryConnect(new MemoryStream(custom.ToArray()), new DatabaseOptions { Collation = reversed }).Collation.Name, Is.EqualTo("test-reversed"));
+        }
+
+        [Test]
+        public void paths_can_be_listed_by_range_in_collation_order () {
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms);
+                foreach (var path in new[] { "a/1", "a/2", "b/1", "b/2", "c/1", "d" }) subject.WriteDocument(path, new MemoryStream(new byte[] { 1 }));
+
+                Assert.That(subject.ListRange("a/2", "c/1", 10), Is.EqualTo(new[] { "a/2", "b/1", "b/2" }), "range should include its start and exclude its end");
+                Assert.That(subject.ListRange("b", null, 2), Is.EqualTo(new[] { "b/1", "b/2" }));
+                Assert.That(subject.ListRange("", "a/2", 10), Is.EqualTo(new[] { "a/1" }));
+                Assert.That(subject.ListRange("c", "b", 10), Is.Empty);
+            }
+
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms, new DatabaseOptions { Collation = PathCollation.Numeric });
+                foreach (var i in new[] { 1, 5, 9, 10, 50, 100 }) subject.WriteDocument($"key{i}", new MemoryStream(new byte[] { 1 }));
+
+                Assert.That(subject.ListRange("key5", "key100", 10), Is.EqualTo(new[] { "key5", "key9", "key10", "key50" }));
+            }
+        }
+
+        [Test]
+        public void transaction_changes_are_only_visible_once_committed () {
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms);
+                subject.WriteDocument("old", MakeTestDocument());
+                var pinned = subject.WriteDocument("pinned", MakeTestDocument());
+                subject.Pin(pinned);
+
+                using (var tx = subject.Begin())
+                {
+                    var id = tx.Write("new/one", new MemoryStream(new byte[] { 1, 2, 3 }));
+                    tx.BindPath(id, "new/alias");
+                    tx.Delete("old");
+
+                    Assert.That(subject.Get("new/one", out _), Is.False, "Write was visible before commit");
+                    Assert.That(subject.Get("old", out _), Is.True, "Delete was applied before commit");
+
+                    tx.Commit();
+                    Assert.That(tx.IsFinished, Is.True);
+                }
+
+                Assert.That(subject.Search("new/").OrderBy(p => p), Is.EqualTo(new[] { "new/alias", "new/one" }));
+                Assert.That(subject.Get("old", out _), Is.False, "Delete was not applied");
+                var count = subject.Count();
+
+                using (var tx = subject.Begin())
+                {
+                    tx.Write("rolled/back", MakeTestDocument());
+                } // disposed without commit
+                Assert.That(subject.Get("rolled/back", out _), Is.False);
+                Assert.That(subject.Count(), Is.EqualTo(count), "Rolled back data was not released");
+
+                var failing = subject.Begin();
+                failing.Write("never", MakeTestDocument());
+                failing.Delete("pinned");
+                Assert.Throws<Exception>(() => failing.Commit());
+                Assert.That(subject.Get("never", out _), Is.False, "Part of a failed commit was applied");
+                Assert.That(subject.Count(), Is.EqualTo(count), "Data from a failed commit was not released");
+                Assert.Throws<InvalidOperationException>(() => failing.Write("again", MakeTestDocument()));
+
+                // a transaction left open by a crash is released on the next open
+                subject.Begin().Write("crashed", MakeTestDocument());
+                subject.Flush();
+                var reopened = Database.TryConnect(new MemoryStream(ms.ToArray()));
+                Assert.That(reopened.Count(), Is.EqualTo(count));
+            }
+        }
+
+        /// <summary>
+        /// Readable stream of zeros with a fixed length, that holds no data
+        /// </summary>
+        private class ZeroStream : Stream {
+            private readonly long _length;
+            public ZeroStream(long length) { _length = length; }
+            public override int Read(byte[] buffer, int offset, int count) {
+                var n = (int)Math.Max(0, Math.Min(count, _length - Position));
+                Array.Clear(buffer, offset, n);
+                Position += n;
+                return n;
+            }
+            public override long Seek(long offset, SeekOrigin origin) {
+                Position = origin == SeekOrigin.Begin ? offset : origin == SeekOrigin.Current ? Position + offset : _length + offset;
+                return Position;
+            }
+            public override void Flush() { }
+            public override void SetLength(long value) { throw new NotSupportedException(); }
+            public override void Write(byte[] buffer, int offset, int count) { throw new NotSupportedException(); }
+            public override bool CanRead => true;
+            public override bool CanSeek => true;
+            public override bool CanWrite => false;
+            public override long Length => _length;
+            public override long Position { get; set; }
+        }
+
+        private static byte[] Hex(string hex)
+        {
+            var result = new byte[hex.Length / 2];
+            for (int i = 0; i < result.Length; i++) result[i] = Convert.ToByte(hex.Substring(i * 2, 2), 16);
+            return result;
+        }
+
+        private static Stream MakeTestDocument()
+        {
+            var ms = new MemoryStream();
+            var rnd= new Random();
+            var buf = new byte[1024];
+            for (int i = 0; i < rnd.Next(102, 1024); i++)
+            {
+                rnd.NextBytes(buf);
+                ms.Write(buf, 0, buf.Length);
+            }
+            ms.Seek(0, SeekOrigin.Begin);
+            return ms;
+        }
+
+        private class PrincipalAuthorizer : IAuthorizer
+        {
+            public string Principal;
+
+            public bool Authorize(AccessRequest request)
+            {
+                if (request.Control == null) return true;
+                return (request.Control.RightsOf(Principal) & request.Rights) == request.Rights;
+            }
+        }
+
+    }
+}
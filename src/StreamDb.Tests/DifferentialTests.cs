@@ -0,0 +1,160 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using System.Linq;
+using NUnit.Framework;
+using StreamDb.Internal.Core;
+using StreamDb.Internal.DbStructure;
+
+// ReSharper disable PossibleNullReferenceException
+
+namespace StreamDb.Tests
+{
+    /// <summary>
+    /// Run the same random operations against `PageStorage` and the in-memory reference engine,
+    /// and check they stay in step. This catches index and free-list bugs that only show after many mixed operations.
+    /// </summary>
+    [TestFixture]
+    public class DifferentialTests {
+        [Test]
+        public void page_storage_matches_the_reference_engine ([Values(1, 2, 3, 4, 5, 6, 7, 8)] int seed) {
+            var rnd = new Random(seed);
+            var real = new PageStorage(new MemoryStream());
+            var reference = new MemoryStorageEngine();
+            var history = new List<string>();
+
+            var docs = Enumerable.Range(0, 24).Select(i => RandomGuid(rnd)).ToArray();
+            var paths = new[] { "a/1", "a/2", "a/3", "a/b/1", "a/b/2", "b/1", "b/2", "c/1", "c/a/1", "readme" };
+            var recordChain = RandomGuid(rnd);
+
+            for (int step = 0; step < 400; step++)
+            {
+                switch (rnd.Next(7))
+                {
+                    case 0:
+                    case 1:
+                    {
+                        var doc = docs[rnd.Next(docs.Length)];
+                        var data = RandomData(rnd);
+                        history.Add($"write {doc} ({data.Length} bytes)");
+                        foreach (var engine in new IStorageEngine[] { real, reference })
+                        {
+                            engine.BindIndex(doc, engine.WriteStream(new MemoryStream(data)), out var expired);
+                            engine.ReleaseChain(expired);
+                        }
+                        break;
+                    }
+
+                    case 2:
+                    {
+                        var doc = docs[rnd.Next(docs.Length)];
+                        history.Add($"delete {doc}");
+                        foreach (var engine in new IStorageEngine[] { real, reference })
+                        {
+                            var head = engine.GetDocumentHead(doc);
+                            engine.UnbindIndex(doc);
+                            engine.ReleaseChain(head);
+                        }
+                        break;
+                    }
+
+                    case 3:
+                    {
+                        var path = paths[rnd.Next(paths.Length)];
+                        var doc = docs[rnd.Next(docs.Length)];
+                        history.Add($"bind {path} -> {doc}");
+                        real.BindPath(path, doc, out var realPrevious);
+                        reference.BindPath(path, doc, out var referencePrevious);
+                        Assert.That(realPrevious, Is.EqualTo(referencePrevious), Describe("Previous binding differs", history));
+                        break;
+                    }
+
+                    case 4:
+                    {
+                        var path = paths[rnd.Next(paths.Length)];
+                        history.Add($"unbind {path}");
+                        real.UnbindPath(path);
+                        reference.UnbindPath(path);
+                        break;
+                    }
+
+                    case 5:
+                    {
+                        var from = new[] { "a/", "b/", "c/", "a/b/" }[rnd.Next(4)];
+                        var to = new[] { "a/", "b/", "c/", "c/a/" }[rnd.Next(4)];
+                        history.Add($"rename {from} -> {to}");
+                        var realCount = real.RenamePrefix(from, to, out var realReplaced);
+                        var referenceCount = reference.RenamePrefix(from, to, out var referenceReplaced);
+                        Assert.That(realCount, Is.EqualTo(referenceCount), Describe("Rename count differs", history));
+                        Assert.That(realReplaced, Is.EquivalentTo(referenceReplaced), Describe("Replaced documents differ", history));
+                        break;
+                    }
+
+                    case 6:
+                    {
+                        var record = RandomData(rnd).Take(rnd.Next(1, 200)).ToArray();
+                        history.Add($"append record ({record.Length} bytes)");
+                        real.AppendRecord(recordChain, record);
+                        reference.AppendRecord(recordChain, record);
+                        break;
+                    }
+                }
+
+                if (step % 20 == 19) AssertSameState(real, reference, docs, recordChain, history);
+            }
+
+            AssertSameState(real, reference, docs, recordChain, history);
+            Assert.That(real.CheckIntegrity(1).IsValid, Is.True, "Page storage failed integrity check");
+        }
+
+        private static void AssertSameState(IStorageEngine real, IStorageEngine reference, Guid[] docs, Guid recordChain, List<string> history)
+        {
+            foreach (var doc in docs)
+            {
+                var realHead = real.GetDocumentHead(doc);
+                var referenceHead = reference.GetDocumentHead(doc);
+                Assert.That(realHead >= 0, Is.EqualTo(referenceHead >= 0), Describe($"Existence of {doc} differs", history));
+                if (realHead < 0) continue;
+
+                Assert.That(ReadAll(real.GetStream(realHead)), Is.EqualTo(ReadAll(reference.GetStream(referenceHead))), Describe($"Content of {doc} differs", history));
+                Assert.That(real.GetPathsForDocument(doc), Is.EquivalentTo(reference.GetPathsForDocument(doc)), Describe($"Paths for {doc} differ", history));
+            }
+
+            var realPaths = real.SearchPaths("").ToList();
+            Assert.That(realPaths, Is.EquivalentTo(reference.SearchPaths("")), Describe("Bound paths differ", history));
+            foreach (var path in realPaths)
+            {
+                Assert.That(real.GetDocumentIdByPath(path), Is.EqualTo(reference.GetDocumentIdByPath(path)), Describe($"Binding for {path} differs", history));
+            }
+
+            Assert.That(real.ReadRecords(recordChain), Is.EqualTo(reference.ReadRecords(recordChain)), Describe("Records differ", history));
+        }
+
+        private static string Describe(string problem, List<string> history)
+        {
+            return problem + ". Last operations:\r\n" + string.Join("\r\n", history.Skip(Math.Max(0, history.Count - 20)));
+        }
+
+        private static byte[] RandomData(Random rnd)
+        {
+            var sizes = new[] { 1, 100, BasicPage.PageDataCapacity - 1, BasicPage.PageDataCapacity, BasicPage.PageDataCapacity + 1, rnd.Next(1, BasicPage.PageDataCapacity * 3) };
+            var data = new byte[sizes[rnd.Next(sizes.Length)]];
+            rnd.NextBytes(data);
+            return data;
+        }
+
+        private static Guid RandomGuid(Random rnd)
+        {
+            var bytes = new byte[16];
+            rnd.NextBytes(bytes);
+            return new Guid(bytes);
+        }
+
+        private static byte[] ReadAll(Stream stream)
+        {
+            var ms = new MemoryStream();
+            stream.CopyTo(ms);
+            return ms.ToArray();
+        }
+    }
+}
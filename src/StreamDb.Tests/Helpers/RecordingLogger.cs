@@ -0,0 +1,34 @@
+﻿using System;
+using System.Collections.Generic;
+using System.Linq;
+
+namespace StreamDb.Tests.Helpers
+{
+    /// <summary>
+    /// Logger that keeps all messages in memory, and echoes them to the console
+    /// </summary>
+    public class RecordingLogger : ILogger
+    {
+        public readonly List<string> Messages = new List<string>();
+
+        public void Debug(string message, params object[] fields) { Record("DEBUG", message, fields); }
+        public void Warn(string message, params object[] fields) { Record("WARN", message, fields); }
+
+        public bool Contains(string fragment)
+        {
+            lock (Messages) { return Messages.Any(m => m.Contains(fragment)); }
+        }
+
+        private void Record(string level, string message, object[] fields)
+        {
+            var pairs = new List<string>();
+            for (int i = 0; i + 1 < fields.Length; i += 2)
+            {
+                pairs.Add($"{fields[i]}={fields[i + 1]}");
+            }
+            var line = $"{level}: {message} {string.Join(" ", pairs)}";
+            Console.WriteLine(line);
+            lock (Messages) { Messages.Add(line); }
+        }
+    }
+}
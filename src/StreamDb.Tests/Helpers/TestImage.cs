@@ -0,0 +1,95 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+
+namespace StreamDb.Tests.Helpers
+{
+    /// <summary>
+    /// Builds databases of a configurable shape. The same settings and seed will always
+    /// produce exactly the same storage bytes, so tests using these images are reproducible.
+    /// </summary>
+    public class TestImage
+    {
+        /// <summary> Seed for all random choices </summary>
+        public int Seed { get; set; } = 1234;
+
+        /// <summary> Number of documents to write </summary>
+        public int DocumentCount { get; set; } = 10;
+
+        /// <summary> Smallest document size in bytes </summary>
+        public int MinDocumentSize { get; set; } = 16;
+
+        /// <summary> Largest document size in bytes </summary>
+        public int MaxDocumentSize { get; set; } = 16 * 1024;
+
+        /// <summary> Number of paths bound to each document (at least 1) </summary>
+        public int PathsPerDocument { get; set; } = 1;
+
+        /// <summary> Percentage of documents (0..100) that are deleted after writing </summary>
+        public int PercentFreed { get; set; } = 0;
+
+        /// <summary> Paths that remain bound after building, with their document IDs </summary>
+        public readonly Dictionary<string, Guid> LivePaths = new Dictionary<string, Guid>();
+
+        /// <summary> Paths whose documents were deleted during building </summary>
+        public readonly List<string> DeletedPaths = new List<string>();
+
+        /// <summary>
+        /// Build a new image in memory. The returned stream contains the raw storage.
+        /// </summary>
+        public MemoryStream Build()
+        {
+            var rnd = new Random(Seed);
+            var ms = new MemoryStream();
+            var db = Database.TryConnect(ms, new DatabaseOptions { IdSource = SeededIds(rnd) });
+
+            LivePaths.Clear();
+            DeletedPaths.Clear();
+
+            var docIds = new List<Guid>();
+            for (int i = 0; i < DocumentCount; i++)
+            {
+                var size = rnd.Next(MinDocumentSize, MaxDocumentSize + 1);
+                var data = new byte[size];
+                rnd.NextBytes(data);
+
+                var path = $"doc/{i}/path-0";
+                var id = db.WriteDocument(path, new MemoryStream(data));
+                LivePaths.Add(path, id);
+                for (int p = 1; p < PathsPerDocument; p++)
+                {
+                    var extra = $"doc/{i}/path-{p}";
+                    db.BindToPath(id, extra);
+                    LivePaths.Add(extra, id);
+                }
+                docIds.Add(id);
+            }
+
+            foreach (var id in docIds)
+            {
+                if (rnd.Next(100) >= PercentFreed) continue;
+                foreach (var path in db.ListPaths(id))
+                {
+                    LivePaths.Remove(path);
+                    DeletedPaths.Add(path);
+                }
+                db.Delete(id);
+            }
+
+            db.Flush();
+            return ms;
+        }
+
+        /// <summary>
+        /// Document ID source driven by a seeded random generator
+        /// </summary>
+        public static Func<Guid> SeededIds(Random rnd)
+        {
+            return () => {
+                var bytes = new byte[16];
+                rnd.NextBytes(bytes);
+                return new Guid(bytes);
+            };
+        }
+    }
+}
@@ -0,0 +1,367 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using System.IO.Compression;
+using System.Linq;
+using System.Text;
+using System.Text.RegularExpressions;
+using NUnit.Framework;
+using StreamDb.Internal.Core;
+using StreamDb.Internal.DbStructure;
+using StreamDb.Internal.Support;
+using StreamDb.Interop;
+using StreamDb.Tests.Helpers;
+
+// ReSharper disable PossibleNullReferenceException
+
+namespace StreamDb.Tests
+{
+    [TestFixture]
+    public class InteropTests
+    {
+        [Test]
+        public void can_import_keys_from_a_bolt_file () {
+            var bolt = BuildBoltFile();
+
+            using (var ms = new MemoryStream())
+            {
+                var subject = Database.TryConnect(ms);
+
+                var count = BoltImport.ImportInto(bolt, subject);
+
+                Assert.That(count, Is.EqualTo(3), "Document count");
+                Assert.That(string.Join(", ", subject.Search("").OrderBy(p => p)), Is.EqualTo("widgets/blue, widgets/red, widgets/sizes/large"));
+
+                subject.Get("widgets/sizes/large", out var data);
+                Assert.That(Encoding.UTF8.GetString(((MemoryStream)CopyOf(data)).ToArray()), Is.EqualTo("XL"));
+            }
+        }
+
+        [Test]
+        public void bolt_import_rejects_files_that_are_not_bolt () {
+            var junk = new MemoryStream(new byte[8192]);
+            var subject = Database.TryConnect(new MemoryStream());
+
+            var ex = Assert.Throws<Exception>(() => BoltImport.ImportInto(junk, subject));
+            Assert.That(ex.Message, Contains.Substring("not a valid bolt database"));
+        }
+
+        [Test]
+        public void sqlar_rows_round_trip_through_export_and_import () {
+            var source = Database.TryConnect(new MemoryStream());
+            var compressible = Encoding.UTF8.GetBytes(string.Join(",", Enumerable.Repeat("the same thing again", 200)));
+            var random = new byte[500];
+            new Random().NextBytes(random);
+            source.WriteDocument("text/repeats.txt", new MemoryStream(compressible));
+            source.WriteDocument("bin/noise.dat", new MemoryStream(random));
+
+            var rows = new List<SqlarRow>();
+            var exported = SqlArchive.ExportSqlar(source, rows.Add);
+
+            Assert.That(exported, Is.EqualTo(2), "Export count");
+            var textRow = rows.Single(r => r.Name == "text/repeats.txt");
+            Assert.That(textRow.Size, Is.EqualTo(compressible.Length), "Original size");
+            Assert.That(textRow.Data.Length, Is.LessThan(compressible.Length), "Text was not compressed");
+            Assert.That(rows.Single(r => r.Name == "bin/noise.dat").Data, Is.EqualTo(random), "Noise should be stored raw");
+
+            rows.Add(new SqlarRow { Name = "a-directory", Mode = 0x41ED, Size = 0 });
+
+            var target = Database.TryConnect(new MemoryStream());
+            var imported = SqlArchive.ImportSqlar(rows, target);
+
+            Assert.That(imported, Is.EqualTo(2), "Directory rows should be skipped");
+            target.Get("text/repeats.txt", out var text);
+            Assert.That(((MemoryStream)CopyOf(text)).ToArray(), Is.EqualTo(compressible));
+            target.Get("bin/noise.dat", out var noise);
+            Assert.That(((MemoryStream)CopyOf(noise)).ToArray(), Is.EqualTo(random));
+        }
+
+        [Test]
+        public void zip_archives_round_trip_through_export_and_import () {
+            var source = Database.TryConnect(new MemoryStream());
+            var large = new byte[20000]; // several pages, to check short reads from the inflater
+            for (int i = 0; i < large.Length; i++) large[i] = (byte)(i % 7);
+            source.WriteDocument("site/index.html", new MemoryStream(Encoding.UTF8.GetBytes("<h1>Hello</h1>")));
+            source.WriteDocument("site/img/large.bin", new MemoryStream(large));
+
+            var zip = new MemoryStream();
+            var exported = ZipTransfer.ExportZip(source, zip);
+            Assert.That(exported, Is.EqualTo(2), "Export count");
+
+            // add a directory entry, which should be ignored
+            zip.Rewind();
+            using (var archive = new ZipArchive(zip, ZipArchiveMode.Update, true)) { archive.CreateEntry("site/empty/"); }
+
+            zip.Rewind();
+            var target = Database.TryConnect(new MemoryStream());
+            var imported = ZipTransfer.ImportZip(zip, target);
+
+            Assert.That(imported, Is.EqualTo(2), "Import count");
+            target.Get("site/img/large.bin", out var data);
+            Assert.That(((MemoryStream)CopyOf(data)).ToArray(), Is.EqualTo(large));
+        }
+
+        [Test]
+        public void operation_scripts_rebuild_an_equivalent_database () {
+            var source = Database.TryConnect(new MemoryStream());
+            var large = new byte[20000];
+            new Random(4441).NextBytes(large);
+            source.WriteDocument("a/first", new MemoryStream(Encoding.UTF8.GetBytes("first")), "note");
+            var id = source.WriteDocument("a/large", new MemoryStream(large));
+            source.BindToPath(id, "b/alias");
+            source.WriteDocument("a/replaced", new MemoryStream(Encoding.UTF8.GetBytes("old")));
+            source.WriteDocument("a/replaced", new MemoryStream(Encoding.UTF8.GetBytes("new")));
+
+            var script = new MemoryStream();
+            var exported = OperationScript.ExportOps(source, script);
+            Assert.That(exported, Is.EqualTo(4), "Export count");
+
+            script.Rewind();
+            var target = Database.TryConnect(new MemoryStream());
+            var replayed = OperationScript.ReplayOps(script, target);
+            Assert.That(replayed, Is.EqualTo(4), "Replay count");
+
+            target.Get("b/alias", out var alias);
+            Assert.That(((MemoryStream)CopyOf(alias)).ToArray(), Is.EqualTo(large));
+            Assert.That(target.GetIdByPath("a/large", out var largeId) && target.GetIdByPath("b/alias", out var aliasId) && largeId == aliasId, Is.True, "Alias was not bound to the same document");
+            target.Get("a/replaced", out var replaced);
+            Assert.That(Encoding.UTF8.GetString(((MemoryStream)CopyOf(replaced)).ToArray()), Is.EqualTo("new"));
+            Assert.That(target.GetBindingInfo("a/first").Annotation, Is.EqualTo("note"));
+        }
+
+        [Test]
+        public void differential_scripts_update_a_backup_copy () {
+            var current = Database.TryConnect(new MemoryStream());
+            current.WriteDocument("keep", new MemoryStream(Encoding.UTF8.GetBytes("unchanged")));
+            current.WriteDocument("edit", new MemoryStream(Encoding.UTF8.GetBytes("before")));
+            current.WriteDocument("gone", new MemoryStream(Encoding.UTF8.GetBytes("removed later")));
+
+            var full = new MemoryStream();
+            OperationScript.ExportOps(current, full);
+            full.Rewind();
+            var backup = Database.TryConnect(new MemoryStream());
+            OperationScript.ReplayOps(full, backup);
+
+            current.WriteDocument("edit", new MemoryStream(Encoding.UTF8.GetBytes("after")));
+            current.WriteDocument("new", new MemoryStream(Encoding.UTF8.GetBytes("added")));
+            current.Delete("gone");
+
+            var diff = new MemoryStream();
+            var ops = OperationScript.DiffSince(backup, current, diff);
+            Assert.That(ops, Is.EqualTo(3), "Diff should hold one edit, one add and one delete");
+            Assert.That(diff.Length, Is.LessThan(full.Length + 10), "Diff is larger than a full export");
+
+            diff.Rewind();
+            OperationScript.ReplayOps(diff, backup);
+
+            Assert.That(backup.Search("").OrderBy(p => p), Is.EqualTo(new[] { "edit", "keep", "new" }));
+            backup.Get("edit", out var edited);
+            Assert.That(Encoding.UTF8.GetString(((MemoryStream)CopyOf(edited)).ToArray()), Is.EqualTo("after"));
+
+            var again = new MemoryStream();
+            Assert.That(OperationScript.DiffSince(backup, current, again), Is.Zero, "Backup should now match");
+        }
+
+        [Test]
+        public void verified_exports_stop_at_damaged_documents () {
+            var storage = new MemoryStream();
+            var source = Database.TryConnect(storage);
+            var large = new byte[20000];
+            new Random(4465).NextBytes(large);
+            source.WriteDocument("good", new MemoryStream(Encoding.UTF8.GetBytes("fine")));
+            source.WriteDocument("damaged", new MemoryStream(large));
+
+            Assert.That(OperationScript.ExportOps(source, new MemoryStream(), verify: true), Is.EqualTo(2), "Undamaged export");
+
+            // change one byte of data in the document's last page
+            var pageId = int.Parse(Regex.Match(source.GetDocumentInfo("damaged"), @"file index = (\d+)").Groups[1].Value);
+            var offset = PageStorage.HEADER_SIZE + (pageId * (long)BasicPage.PageRawSize) + BasicPage.PageHeadersSize + 10;
+            storage.Seek(offset, SeekOrigin.Begin);
+            var old = storage.ReadByte();
+            storage.Seek(offset, SeekOrigin.Begin);
+            storage.WriteByte((byte)(old ^ 0xFF));
+
+            var ex = Assert.Throws<ExportVerificationException>(() => OperationScript.ExportOps(source, new MemoryStream(), verify: true));
+            Assert.That(ex.Path, Is.EqualTo("damaged"));
+            Assert.That(ex.PageId, Is.EqualTo(pageId));
+
+            // A signed manifest also catches content that was changed without damaging pages
+            storage.Seek(offset, SeekOrigin.Begin);
+            storage.WriteByte((byte)old);
+            source.SignManifest(new byte[Ed25519.KeySize]);
+            source.WriteDocument("good", new MemoryStream(Encoding.UTF8.GetBytes("edited")));
+
+            ex = Assert.Throws<ExportVerificationException>(() => ZipTransfer.ExportZip(source, new MemoryStream(), verify: true));
+            Assert.That(ex.Path, Is.EqualTo("good"));
+            Assert.That(ex.PageId, Is.EqualTo(-1));
+        }
+
+        [Test]
+        public void webdav_handler_maps_file_operations_to_the_database () {
+            var db = Database.TryConnect(new MemoryStream());
+            var subject = new WebDavHandler(db, "/dav");
+
+            var put = subject.Handle(new WebDavRequest { Method = "PUT", Path = "/dav/docs/hello%20world.txt", Body = new MemoryStream(Encoding.UTF8.GetBytes("hi")) });
+            Assert.That(put.StatusCode, Is.EqualTo(201), "PUT");
+            Assert.That(db.GetIdByPath("docs/hello world.txt", out _), Is.True, "Document not stored at decoded path");
+
+            var list = subject.Handle(new WebDavRequest { Method = "PROPFIND", Path = "/dav/", Headers = { { "Depth", "1" } } });
+            var xml = Encoding.UTF8.GetString(((MemoryStream)list.Body).ToArray());
+            Console.WriteLine(xml);
+            Assert.That(list.StatusCode, Is.EqualTo(207), "PROPFIND");
+            Assert.That(xml, Contains.Substring("<href>/dav/docs/</href>"), "Directory listing");
+
+            var move = subject.Handle(new WebDavRequest { Method = "MOVE", Path = "/dav/docs/hello%20world.txt", Headers = { { "Destination", "http://localhost/dav/docs/moved.txt" } } });
+            Assert.That(move.StatusCode, Is.EqualTo(201), "MOVE");
+
+            var get = subject.Handle(new WebDavRequest { Method = "GET", Path = "/dav/docs/moved.txt" });
+            Assert.That(get.StatusCode, Is.EqualTo(200), "GET after move");
+            Assert.That(((MemoryStream)CopyOf(get.Body)).ToArray(), Is.EqualTo(Encoding.UTF8.GetBytes("hi")));
+            Assert.That(subject.Handle(new WebDavRequest { Method = "GET", Path = "/dav/docs/hello%20world.txt" }).StatusCode, Is.EqualTo(404), "Old path after move");
+
+            var range = subject.Handle(new WebDavRequest { Method = "GET", Path = "/dav/docs/moved.txt", Headers = { { "Range", "bytes=1-" } } });
+            Assert.That(range.StatusCode, Is.EqualTo(206), "Range GET");
+            Assert.That(range.Headers["Content-Range"], Is.EqualTo("bytes 1-1/2"));
+            Assert.That(((MemoryStream)CopyOf(range.Body)).ToArray(), Is.EqualTo(Encoding.UTF8.GetBytes("i")));
+            var badRange = subject.Handle(new WebDavRequest { Method = "GET", Path = "/dav/docs/moved.txt", Headers = { { "Range", "bytes=5-" } } });
+            Assert.That(badRange.StatusCode, Is.EqualTo(416), "Unsatisfiable range");
+
+            var delete = subject.Handle(new WebDavRequest { Method = "DELETE", Path = "/dav/docs" });
+            Assert.That(delete.StatusCode, Is.EqualTo(204), "DELETE directory");
+            Assert.That(db.Search("docs/"), Is.Empty, "Directory contents remain");
+        }
+
+        [Test]
+        public void health_checks_are_served_at_healthz () {
+            var storage = new MemoryStream();
+            var db = Database.TryConnect(storage);
+            db.WriteDocument("doc", new MemoryStream(new byte[20000]));
+            var subject = new WebDavHandler(db, "/dav");
+
+            Assert.That(db.HealthCheck().IsHealthy, Is.True, "Quick check of good storage");
+            Assert.That(db.HealthCheck(HealthCheckLevel.Standard).PagesChecked, Is.GreaterThan(1));
+            var ok = subject.Handle(new WebDavRequest { Method = "GET", Path = "/healthz" });
+            Assert.That(ok.StatusCode, Is.EqualTo(200));
+            Assert.That(ok.Headers["Content-Type"], Does.Contain("json"));
+            Assert.That(Encoding.UTF8.GetString(((MemoryStream)ok.Body).ToArray()), Contains.Substring("\"status\":\"ok\""));
+
+            // damage a data page, which only the deep check reads
+            var pageId = int.Parse(Regex.Match(db.GetDocumentInfo("doc"), @"file index = (\d+)").Groups[1].Value);
+            storage.Seek(PageStorage.HEADER_SIZE + (pageId * (long)BasicPage.PageRawSize) + BasicPage.PageHeadersSize + 10, SeekOrigin.Begin);
+            storage.WriteByte(0xFF);
+
+            Assert.That(db.HealthCheck(HealthCheckLevel.Quick).IsHealthy, Is.True);
+            var deep = db.HealthCheck(HealthCheckLevel.Deep);
+            Assert.That(deep.IsHealthy, Is.False);
+            Assert.That(deep.FailedPages, Is.EqualTo(new[] { pageId }));
+
+            var failed = subject.Handle(new WebDavRequest { Method = "GET", Path = "/healthz?level=deep" });
+            Assert.That(failed.StatusCode, Is.EqualTo(503));
+            Assert.That(Encoding.UTF8.GetString(((MemoryStream)failed.Body).ToArray()), Contains.Substring("\"level\":\"deep\""));
+        }
+
+        [Test]
+        public void proto_codec_uses_message_type_as_schema () {
+            var codec = ProtoCodec.For<byte[]>((m, s) => s.Write(m, 0, m.Length), s => ((MemoryStream)CopyOf(s)).ToArray());
+            var subject = Database.TryConnect(new MemoryStream());
+            subject.Codecs.Register(codec);
+
+            subject.Put("messages/1", new byte[] { 8, 150, 1 });
+
+            Assert.That(codec.SchemaId, Is.EqualTo("proto:System.Byte[]"));
+            Assert.That(subject.GetSchemaId("messages/1"), Is.EqualTo("proto:System.Byte[]"));
+            Assert.That(subject.Get<byte[]>("messages/1", out var message), Is.True);
+            Assert.That(message, Is.EqualTo(new byte[] { 8, 150, 1 }));
+        }
+
+        private static Stream CopyOf(Stream s) {
+            var ms = new MemoryStream();
+            s.CopyTo(ms);
+            return ms.Rewind();
+        }
+
+        /// <summary>
+        /// A minimal bolt file: two meta pages, an empty free list, and a root leaf page.
+        /// The root holds bucket 'widgets' as an inline page, which holds two keys and an inline bucket 'sizes'.
+        /// </summary>
+        private static Stream BuildBoltFile() {
+            const int pageSize = 4096;
+            var file = new byte[pageSize * 4];
+
+            WriteMeta(file, 0, pageSize, txid: 1);
+            WriteMeta(file, 1, pageSize, txid: 0);
+            WritePageHeader(file, 2 * pageSize, 2, 0x10, 0);
+
+            var sizes = InlineLeaf(new[] { Leaf(0, "large", Encoding.UTF8.GetBytes("XL")) });
+            var widgets = InlineLeaf(new[] {
+                Leaf(0, "blue", Encoding.UTF8.GetBytes("#00F")),
+                Leaf(0, "red", Encoding.UTF8.GetBytes("#F00")),
+                Leaf(1, "sizes", InlineBucket(sizes))
+            });
+            var root = InlineLeaf(new[] { Leaf(1, "widgets", InlineBucket(widgets)) });
+            BitConverter.GetBytes((ulong)3).CopyTo(root, 0);
+            root.CopyTo(file, 3 * pageSize);
+
+            return new MemoryStream(file);
+        }
+
+        private static void WriteMeta(byte[] file, int pageId, int pageSize, ulong txid) {
+            var start = pageId * pageSize;
+            WritePageHeader(file, start, (ulong)pageId, 0x04, 0);
+            var meta = new byte[64];
+            BitConverter.GetBytes(0xED0CDAED).CopyTo(meta, 0);
+            BitConverter.GetBytes(2u).CopyTo(meta, 4);
+            BitConverter.GetBytes((uint)pageSize).CopyTo(meta, 8);
+            BitConverter.GetBytes(3UL).CopyTo(meta, 16); // root bucket page
+            BitConverter.GetBytes(2UL).CopyTo(meta, 32); // free list page
+            BitConverter.GetBytes(4UL).CopyTo(meta, 40); // high water mark
+            BitConverter.GetBytes(txid).CopyTo(meta, 48);
+
+            var hash = 14695981039346656037UL;
+            unchecked {
+                for (int i = 0; i < 56; i++) { hash ^= meta[i]; hash *= 1099511628211UL; }
+            }
+            BitConverter.GetBytes(hash).CopyTo(meta, 56);
+            meta.CopyTo(file, start + 16);
+        }
+
+        private static void WritePageHeader(byte[] buf, int offset, ulong id, ushort flags, ushort count) {
+            BitConverter.GetBytes(id).CopyTo(buf, offset);
+            BitConverter.GetBytes(flags).CopyTo(buf, offset + 8);
+            BitConverter.GetBytes(count).CopyTo(buf, offset + 10);
+        }
+
+        private static KeyValuePair<uint, KeyValuePair<string, byte[]>> Leaf(uint flags, string key, byte[] value) {
+            return new KeyValuePair<uint, KeyValuePair<string, byte[]>>(flags, new KeyValuePair<string, byte[]>(key, value));
+        }
+
+        private static byte[] InlineBucket(byte[] inlinePage) {
+            var result = new byte[16 + inlinePage.Length]; // root = 0, sequence = 0, then the page
+            inlinePage.CopyTo(result, 16);
+            return result;
+        }
+
+        private static byte[] InlineLeaf(KeyValuePair<uint, KeyValuePair<string, byte[]>>[] entries) {
+            var headerAndElements = 16 + (16 * entries.Length);
+            var data = new List<byte>();
+            var page = new byte[headerAndElements];
+            WritePageHeader(page, 0, 0, 0x02, (ushort)entries.Length);
+
+            for (int i = 0; i < entries.Length; i++)
+            {
+                var elem = 16 + (i * 16);
+                var key = Encoding.UTF8.GetBytes(entries[i].Value.Key);
+                var value = entries[i].Value.Value;
+                var pos = headerAndElements + data.Count - elem;
+
+                BitConverter.GetBytes(entries[i].Key).CopyTo(page, elem);
+                BitConverter.GetBytes((uint)pos).CopyTo(page, elem + 4);
+                BitConverter.GetBytes((uint)key.Length).CopyTo(page, elem + 8);
+                BitConverter.GetBytes((uint)value.Length).CopyTo(page, elem + 12);
+                data.AddRange(key);
+                data.AddRange(value);
+            }
+            return page.Concat(data).ToArray();
+        }
+    }
+}
@@ -1,50 +1,125 @@
-﻿using NUnit.Framework;
-using StreamDb.Internal.DbStructure;
-
-// ReSharper disable PossibleNullReferenceException
-
-namespace StreamDb.Tests
-{
-    [TestFixture]
-    public class PageDataTests{
-
-        [Test]
-        public void simple_page_fields_round_trip () {
-            var subject = new BasicPage(0);
-
-            Assert.That(subject.DataLength, Is.EqualTo(0), "Unexpected default length");
-            Assert.That(subject.PrevPageId, Is.EqualTo(-1), "Unexpected default page ID");
-
-            subject.Write(new byte[] { 1, 2, 3, 4, 5, 6 }, 0, 0, 6);
-            subject.PrevPageId = 32790;
-
-            Assert.That(subject.DataLength, Is.EqualTo(6), "Unexpected modified length");
-            Assert.That(subject.PrevPageId, Is.EqualTo(32790), "Unexpected modified page ID");
-        }
-        
-        [Test]
-        public void simple_page_crc_checks_work () {
-            var subject = new BasicPage(0)
-            {
-                DataLength = 0,
-                PrevPageId = 20,
-            };
-
-
-            subject.Write(new byte[] { 1, 2, 3, 4, 5, 6 }, 0, 0, 6);
-            subject.UpdateCRC();
-
-            Assert.That(subject.CrcHash, Is.Not.Zero, "CRC did not update");
-
-            Assert.That(subject.ValidateCrc(), Is.True, "CRC check failed, but should have passed");
-
-            subject.PrevPageId = 30;
-            Assert.That(subject.ValidateCrc(), Is.False, "CRC check passed, but should have failed");
-            
-            subject.UpdateCRC();
-            Assert.That(subject.ValidateCrc(), Is.True, "CRC check failed, but should have passed");
-            subject.Write(new byte[] { 1, 2, 99, 4, 5, 6 }, 0, 0, 6);
-            Assert.That(subject.ValidateCrc(), Is.False, "CRC check passed, but should have failed");
-        }
-    }
+﻿using System;
+using System.Collections.Generic;
+using NUnit.Framework;
+using StreamDb.Internal.DbStructure;
+
+// ReSharper disable PossibleNullReferenceException
+
+namespace StreamDb.Tests
+{
+    [TestFixture]
+    public class PageDataTests{
+
+        [Test]
+        public void simple_page_fields_round_trip () {
+            var subject = new BasicPage(0);
+
+            Assert.That(subject.DataLength, Is.EqualTo(0), "Unexpected default length");
+            Assert.That(subject.PrevPageId, Is.EqualTo(-1), "Unexpected default page ID");
+
+            subject.Write(new byte[] { 1, 2, 3, 4, 5, 6 }, 0, 0, 6);
+            subject.PrevPageId = 32790;
+
+            Assert.That(subject.DataLength, Is.EqualTo(6), "Unexpected modified length");
+            Assert.That(subject.PrevPageId, Is.EqualTo(32790), "Unexpected modified page ID");
+        }
+        
+        [Test]
+        public void simple_page_crc_checks_work () {
+            var subject = new BasicPage(0)
+            {
+                DataLength = 0,
+                PrevPageId = 20,
+            };
+
+
+            subject.Write(new byte[] { 1, 2, 3, 4, 5, 6 }, 0, 0, 6);
+            subject.UpdateCRC();
+
+            Assert.That(subject.CrcHash, Is.Not.Zero, "CRC did not update");
+
+            Assert.That(subject.ValidateCrc(), Is.True, "CRC check failed, but should have passed");
+
+            subject.PrevPageId = 30;
+            Assert.That(subject.ValidateCrc(), Is.False, "CRC check passed, but should have failed");
+            
+            subject.UpdateCRC();
+            Assert.That(subject.ValidateCrc(), Is.True, "CRC check failed, but should have passed");
+            subject.Write(new byte[] { 1, 2, 99, 4, 5, 6 }, 0, 0, 6);
+            Assert.That(subject.ValidateCrc(), Is.False, "CRC check passed, but should have failed");
+        }
+
+        [Test]
+        public void index_page_reuses_slots_of_removed_entries () {
+            var subject = new IndexPage();
+            var inserted = new List<Guid>();
+            Guid rejected;
+            while (true)
+            {
+                var id = Guid.NewGuid();
+                if (!subject.TryInsert(id, inserted.Count)) { rejected = id; break; }
+                inserted.Add(id);
+            }
+
+            foreach (var id in inserted) { Assert.That(subject.Remove(id), Is.True); }
+            Assert.That(subject.TombstoneCount(), Is.EqualTo(inserted.Count));
+            Assert.That(subject.Search(inserted[0], out _), Is.False, "Removed entry was still found");
+
+            Assert.That(subject.TryInsert(rejected, 1234), Is.True, "Tombstones were not reused");
+            Assert.That(subject.Search(rejected, out var link), Is.True);
+            Assert.That(link.TryGetLink(0, out var pageId) ? pageId : -1, Is.EqualTo(1234));
+        }
+
+        [Test]
+        public void compacting_an_index_page_keeps_live_entries () {
+            var subject = new IndexPage();
+            var live = new Dictionary<Guid, int>();
+            var dead = new List<Guid>();
+            for (int i = 0; i < 200; i++)
+            {
+                var id = Guid.NewGuid();
+                if (!subject.TryInsert(id, i)) continue;
+                if (i % 2 == 0) live.Add(id, i);
+                else dead.Add(id);
+            }
+            foreach (var id in dead) { subject.Remove(id); }
+
+            Assert.That(subject.Compact(), Is.EqualTo(dead.Count));
+            Assert.That(subject.TombstoneCount(), Is.Zero);
+
+            var restored = new IndexPage();
+            restored.Defrost(subject.Freeze());
+            foreach (var entry in live)
+            {
+                Assert.That(restored.Search(entry.Key, out var link), Is.True, "Lost a live entry");
+                Assert.That(link.TryGetLink(0, out var pageId) ? pageId : -1, Is.EqualTo(entry.Value));
+            }
+            foreach (var id in dead) { Assert.That(restored.Search(id, out _), Is.False); }
+        }
+
+        [Test]
+        public void rebalancing_lets_sequential_ids_fill_an_index_page () {
+            var subject = new IndexPage();
+            var plainInserts = 0;
+            for (int i = 1; subject.TryInsert(new Guid(i, 0, 0, new byte[8]), i); i++) { plainInserts++; }
+            Assert.That(plainInserts, Is.LessThan(10), "Sequential ids should exhaust one path of the tree");
+
+            for (int i = plainInserts + 1; i <= IndexPage.Capacity; i++)
+            {
+                var id = new Guid(i, 0, 0, new byte[8]);
+                Assert.That(subject.TryInsert(id, i) || subject.TryRebalanceInsert(id, i), Is.True, $"Failed to insert entry {i}");
+            }
+            Assert.That(subject.LiveCount(), Is.EqualTo(IndexPage.Capacity));
+            Assert.That(subject.TryRebalanceInsert(Guid.NewGuid(), 0), Is.False, "Full page accepted another entry");
+            Assert.That(subject.Pivot, Is.Not.EqualTo(ReservedDocIds.Neutral));
+
+            var restored = new IndexPage();
+            restored.Defrost(subject.Freeze());
+            for (int i = 1; i <= IndexPage.Capacity; i++)
+            {
+                Assert.That(restored.Search(new Guid(i, 0, 0, new byte[8]), out var link), Is.True, $"Lost entry {i}");
+                Assert.That(link.TryGetLink(0, out var pageId) ? pageId : -1, Is.EqualTo(i));
+            }
+        }
+    }
 }
\ No newline at end of file
@@ -1,287 +1,1252 @@
-﻿using System;
-using System.Collections.Generic;
-using System.IO;
-using NUnit.Framework;
-using StreamDb.Internal.Core;
-// ReSharper disable PossibleNullReferenceException
-
-namespace StreamDb.Tests
-{
-    [TestFixture]
-    public class PageStreamStorageTests {
-        [Test]
-        public void create_from_memory_stream () {
-            var storage = new MemoryStream();
-            var sampleData = new byte[] { 1, 4, 7, 2, 5, 8, 3, 6, 9 };
-            var sampleDataStream = new MemoryStream(sampleData);
-            sampleDataStream.Seek(0, SeekOrigin.Begin);
-
-            var subject = new PageStorage(storage);
-            
-            Console.WriteLine($"Storage after headers is {storage.Length} bytes");
-
-            var pageId = subject.WriteStream(sampleDataStream);
-
-            Console.WriteLine($"Storage after writing data is {storage.Length} bytes");
-
-            Assert.That(storage.Length, Is.GreaterThan(0), "Storage was not written");
-            Assert.That(pageId, Is.GreaterThanOrEqualTo(0), "Bad page ID");
-
-            var result = subject.GetStream(pageId);
-            Assert.That(result, Is.Not.Null, "Failed to read stream");
-            Assert.That(result.Length, Is.EqualTo(sampleData.Length), "Data length was wrong");
-
-            var final = new byte[result.Length];
-            var read = result.Read(final, 0, final.Length);
-            Assert.That(read, Is.EqualTo(final.Length), "Data was not read to end");
-            Assert.That(final, Is.EquivalentTo(sampleData), "Read and written data were different");
-        }
-         
-        [Test]
-        public void cycling_page_usage()
-        {
-            var storage = new MemoryStream();
-            var sampleData = new byte[] { 1, 4, 7, 2, 5, 8, 3, 6, 9 };
-            var sampleDataStream = new MemoryStream(sampleData);
-            sampleDataStream.Seek(0, SeekOrigin.Begin);
-
-            var subject = new PageStorage(storage);
-            
-            Console.WriteLine($"Storage after headers is {storage.Length} bytes");
-
-            for (int i = 0; i < 10; i++)
-            {
-                sampleDataStream.Seek(0, SeekOrigin.Begin);
-                var pageId = subject.WriteStream(sampleDataStream);
-                subject.ReleaseChain(pageId);
-            }
-
-            Console.WriteLine($"Storage after writing data is {storage.Length} bytes");
-        }
-
-        [Test]
-        public void reusing_large_page_chains () {
-
-            var storage = new MemoryStream();
-            var sampleData = new byte[32767];
-            for (int i = 0; i < sampleData.Length; i++) { sampleData[i] = (byte)i; }
-
-            var sampleDataStream = new MemoryStream(sampleData);
-            sampleDataStream.Seek(0, SeekOrigin.Begin);
-
-            var subject = new PageStorage(storage);
-            
-            Console.WriteLine($"Storage after headers is {storage.Length} bytes");
-
-            var toRelease = new Queue<int>();
-
-            for (int i = 0; i < 10; i++)
-            {
-                sampleDataStream.Seek(0, SeekOrigin.Begin);
-                toRelease.Enqueue(subject.WriteStream(sampleDataStream));
-
-                if (toRelease.Count > 2) {
-                    subject.ReleaseChain(toRelease.Dequeue());
-                }
-            }
-
-            Console.WriteLine($"Storage after writing data is {storage.Length} bytes");
-        }
-
-        [Test]
-        public void freeing_a_large_number_of_pages()
-        {
-            var storage = new MemoryStream();
-            var sampleData = new byte[1];
-            for (int i = 0; i < sampleData.Length; i++) { sampleData[i] = (byte)i; }
-
-            var sampleDataStream = new MemoryStream(sampleData);
-            sampleDataStream.Seek(0, SeekOrigin.Begin);
-
-            var subject = new PageStorage(storage);
-            
-            Console.WriteLine($"Storage after headers is {storage.Length} bytes");
-
-            var toRelease = new Queue<int>();
-
-            for (int i = 0; i < 3000; i++) // a free page can hold about 1020 page refs
-            {
-                sampleDataStream.Seek(0, SeekOrigin.Begin);
-                toRelease.Enqueue(subject.WriteStream(sampleDataStream));
-            }
-
-            while (toRelease.Count > 0) {
-                subject.ReleaseChain(toRelease.Dequeue());
-            }
-
-            Console.WriteLine($"Storage after writing data is {storage.Length} bytes");
-
-            // Try to reuse the pages
-            for (int i = 0; i < 3000; i++)
-            {
-                sampleDataStream.Seek(0, SeekOrigin.Begin);
-                toRelease.Enqueue(subject.WriteStream(sampleDataStream));
-            }
-
-            Console.WriteLine($"Storage after re-writing data is {storage.Length} bytes");
-        }
-
-        [Test]
-        public void writing_to_index ()
-        {
-            var storage = new MemoryStream();
-            var subject = new PageStorage(storage);
-
-            var newPageId = 123;
-            var docId = Guid.NewGuid();
-            subject.BindIndex(docId, newPageId, out var oldPageId);
-
-            var result = subject.GetDocumentHead(docId);
-
-            Assert.That(result, Is.EqualTo(newPageId));
-            Assert.That(oldPageId, Is.EqualTo(-1));
-        }
-        
-        [Test]
-        public void removing_from_index ()
-        {
-            var storage = new MemoryStream();
-            var subject = new PageStorage(storage);
-
-            var newPageId = 123;
-            var otherPageId = 321;
-            var docId = Guid.NewGuid();
-            var otherId = Guid.NewGuid();
-            subject.BindIndex(docId, newPageId, out var oldPageId);
-            subject.BindIndex(otherId, otherPageId, out _);
-
-            var result = subject.GetDocumentHead(docId);
-
-            Assert.That(result, Is.EqualTo(newPageId));
-            Assert.That(oldPageId, Is.EqualTo(-1));
-
-
-            subject.UnbindIndex(docId);
-            
-            Assert.That(subject.GetDocumentHead(docId), Is.EqualTo(-1), "Document is still in the index");
-            Assert.That(subject.GetDocumentHead(otherId), Is.EqualTo(otherPageId), "Lost a document we didn't target");
-        }
-
-        [Test]
-        public void writing_many_pages_to_the_index () {
-            var storage = new MemoryStream();
-            var subject = new PageStorage(storage);
-
-            
-            var firstPageId = 123;
-            var firstDocId = Guid.NewGuid();
-            subject.BindIndex(firstDocId, firstPageId, out _);
-
-            for (int i = 0; i < 1000; i++)
-            {
-                subject.BindIndex(Guid.NewGuid(), i, out _);
-            }
-            
-            var lastPageId = 123;
-            var lastDocId = Guid.NewGuid();
-            subject.BindIndex(lastDocId, lastPageId, out _);
-
-
-            Assert.That(subject.GetDocumentHead(firstDocId), Is.EqualTo(firstPageId));
-            Assert.That(subject.GetDocumentHead(lastDocId), Is.EqualTo(lastPageId));
-            
-            Console.WriteLine($"Storage after writing data is {storage.Length} bytes");
-        }
-
-        [Test]
-        public void path_lookup_data () {
-            var storage = new MemoryStream();
-            var subject = new PageStorage(storage);
-
-            var val1 = Guid.NewGuid();
-            var val2 = Guid.NewGuid();
-
-            subject.BindPath("this is my path", val1, out _);
-            subject.BindPath("this is another path", val2, out _);
-
-            var result1 = subject.GetDocumentIdByPath("this is my path");
-            var result2 = subject.GetDocumentIdByPath("this path is not presend");
-
-            Assert.That(result1, Is.EqualTo(val1));
-            Assert.That(result2, Is.Null);
-        }
-
-        [Test]
-        public void path_replacement_cycling()
-        {
-            var storage = new MemoryStream();
-            var subject = new PageStorage(storage);
-
-            var valIn = Guid.NewGuid();
-            Guid? prev = null;
-
-            for (int i = 0; i < 10; i++)
-            {
-                subject.BindPath("this path will get replaced a lot", valIn, out var valOut);
-                Assert.That(valOut, Is.EqualTo(prev), $"Failed on cycle {i}");
-                prev = valIn;
-                valIn = Guid.NewGuid();
-            }
-            Console.WriteLine($"Storage after writing data is {storage.Length} bytes");
-        }
-
-        [Test]
-        public void lookup_paths_for_a_document_id()
-        {
-            var storage = new MemoryStream();
-            var subject = new PageStorage(storage);
-            
-            var target = Guid.NewGuid();
-
-            subject.BindPath("one"  , target        , out _);
-            subject.BindPath("two"  , Guid.NewGuid(), out _);
-            subject.BindPath("three", target        , out _);
-            subject.BindPath("four" , target        , out _);
-            subject.BindPath("five" , Guid.NewGuid(), out _);
-            subject.BindPath("six"  , Guid.NewGuid(), out _);
-
-            var list = string.Join(",", subject.GetPathsForDocument(target));
-            Assert.That(list, Is.EqualTo("one,three,four"));
-        }
-
-        [Test]
-        public void search_paths_by_prefix () {
-            var storage = new MemoryStream();
-            var subject = new PageStorage(storage);
-            
-            subject.BindPath("find me/one"  , Guid.NewGuid(), out _);
-            subject.BindPath("find me/two"  , Guid.NewGuid(), out _);
-            subject.BindPath("miss me/three", Guid.NewGuid(), out _);
-            subject.BindPath("find me/four" , Guid.NewGuid(), out _);
-            subject.BindPath("miss me/five" , Guid.NewGuid(), out _);
-            subject.BindPath("miss me/six"  , Guid.NewGuid(), out _);
-
-            var list = string.Join(",", subject.SearchPaths("find me/"));
-            Assert.That(list, Is.EqualTo("find me/one,find me/two,find me/four"));
-        }
-
-        [Test]
-        public void unbinding_paths () {
-            var storage = new MemoryStream();
-            var subject = new PageStorage(storage);
-            
-            subject.BindPath("find me/one"  , Guid.NewGuid(), out _);
-            subject.BindPath("find me/two"  , Guid.NewGuid(), out _);
-            subject.BindPath("miss me/three", Guid.NewGuid(), out _);
-            subject.BindPath("find me/four" , Guid.NewGuid(), out _);
-            subject.BindPath("miss me/five" , Guid.NewGuid(), out _);
-            subject.BindPath("miss me/six"  , Guid.NewGuid(), out _);
-
-            subject.UnbindPath("find me/one");
-            subject.UnbindPath("find me/four");
-
-            var list = string.Join(",", subject.SearchPaths("find me/"));
-            Assert.That(list, Is.EqualTo("find me/two"));
-        }
-    }
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using System.Linq;
+using System.Text;
+using NUnit.Framework;
+using StreamDb.Internal.Core;
+using StreamDb.Internal.DbStructure;
+using StreamDb.Internal.Support;
+using StreamDb.Tests.Helpers;
+// ReSharper disable PossibleNullReferenceException
+
+namespace StreamDb.Tests
+{
+    [TestFixture]
+    public class PageStreamStorageTests {
+        [Test]
+        public void create_from_memory_stream () {
+            var storage = new MemoryStream();
+            var sampleData = new byte[] { 1, 4, 7, 2, 5, 8, 3, 6, 9 };
+            var sampleDataStream = new MemoryStream(sampleData);
+            sampleDataStream.Seek(0, SeekOrigin.Begin);
+
+            var subject = new PageStorage(storage);
+            
+            Console.WriteLine($"Storage after headers is {storage.Length} bytes");
+
+            var pageId = subject.WriteStream(sampleDataStream);
+
+            Console.WriteLine($"Storage after writing data is {storage.Length} bytes");
+
+            Assert.That(storage.Length, Is.GreaterThan(0), "Storage was not written");
+            Assert.That(pageId, Is.GreaterThanOrEqualTo(0), "Bad page ID");
+
+            var result = subject.GetStream(pageId);
+            Assert.That(result, Is.Not.Null, "Failed to read stream");
+            Assert.That(result.Length, Is.EqualTo(sampleData.Length), "Data length was wrong");
+
+            var final = new byte[result.Length];
+            var read = result.Read(final, 0, final.Length);
+            Assert.That(read, Is.EqualTo(final.Length), "Data was not read to end");
+            Assert.That(final, Is.EquivalentTo(sampleData), "Read and written data were different");
+        }
+
+        [Test]
+        public void a_short_stream_written_over_released_pages_keeps_its_own_length () {
+            var storage = new MemoryStream();
+            var subject = new PageStorage(storage);
+
+            var longData = new byte[BasicPage.PageDataCapacity * 3];
+            for (int i = 0; i < longData.Length; i++) { longData[i] = 0xFF; }
+            subject.ReleaseChain(subject.WriteStream(new MemoryStream(longData)));
+
+            var shortData = new byte[] { 1, 2, 3 };
+            var pageId = subject.WriteStream(new MemoryStream(shortData));
+
+            var result = subject.GetStream(pageId);
+            Assert.That(result.Length, Is.EqualTo(shortData.Length), "Reused page kept its old length");
+            var final = new byte[10];
+            var read = result.Read(final, 0, final.Length);
+            Assert.That(read, Is.EqualTo(shortData.Length), "Read past the end of the data");
+            Assert.That(final.Take(read), Is.EqualTo(shortData), "Read and written data were different");
+        }
+         
+        [Test]
+        public void cycling_page_usage()
+        {
+            var storage = new MemoryStream();
+            var sampleData = new byte[] { 1, 4, 7, 2, 5, 8, 3, 6, 9 };
+            var sampleDataStream = new MemoryStream(sampleData);
+            sampleDataStream.Seek(0, SeekOrigin.Begin);
+
+            var subject = new PageStorage(storage);
+            
+            Console.WriteLine($"Storage after headers is {storage.Length} bytes");
+
+            for (int i = 0; i < 10; i++)
+            {
+                sampleDataStream.Seek(0, SeekOrigin.Begin);
+                var pageId = subject.WriteStream(sampleDataStream);
+                subject.ReleaseChain(pageId);
+            }
+
+            Console.WriteLine($"Storage after writing data is {storage.Length} bytes");
+        }
+
+        [Test]
+        public void reusing_large_page_chains () {
+
+            var storage = new MemoryStream();
+            var sampleData = new byte[32767];
+            for (int i = 0; i < sampleData.Length; i++) { sampleData[i] = (byte)i; }
+
+            var sampleDataStream = new MemoryStream(sampleData);
+            sampleDataStream.Seek(0, SeekOrigin.Begin);
+
+            var subject = new PageStorage(storage);
+            
+            Console.WriteLine($"Storage after headers is {storage.Length} bytes");
+
+            var toRelease = new Queue<int>();
+
+            for (int i = 0; i < 10; i++)
+            {
+                sampleDataStream.Seek(0, SeekOrigin.Begin);
+                toRelease.Enqueue(subject.WriteStream(sampleDataStream));
+
+                if (toRelease.Count > 2) {
+                    subject.ReleaseChain(toRelease.Dequeue());
+                }
+            }
+
+            Console.WriteLine($"Storage after writing data is {storage.Length} bytes");
+        }
+
+        [Test]
+        public void freeing_a_large_number_of_pages()
+        {
+            var storage = new MemoryStream();
+            var sampleData = new byte[1];
+            for (int i = 0; i < sampleData.Length; i++) { sampleData[i] = (byte)i; }
+
+            var sampleDataStream = new MemoryStream(sampleData);
+            sampleDataStream.Seek(0, SeekOrigin.Begin);
+
+            var subject = new PageStorage(storage);
+            
+            Console.WriteLine($"Storage after headers is {storage.Length} bytes");
+
+            var toRelease = new Queue<int>();
+
+            for (int i = 0; i < 3000; i++) // a free page can hold about 1020 page refs
+            {
+                sampleDataStream.Seek(0, SeekOrigin.Begin);
+                toRelease.Enqueue(subject.WriteStream(sampleDataStream));
+            }
+
+            while (toRelease.Count > 0) {
+                subject.ReleaseChain(toRelease.Dequeue());
+            }
+
+            Console.WriteLine($"Storage after writing data is {storage.Length} bytes");
+
+            // Try to reuse the pages
+            for (int i = 0; i < 3000; i++)
+            {
+                sampleDataStream.Seek(0, SeekOrigin.Begin);
+                toRelease.Enqueue(subject.WriteStream(sampleDataStream));
+            }
+
+            Console.WriteLine($"Storage after re-writing data is {storage.Length} bytes");
+        }
+
+        [Test]
+        public void writing_to_index ()
+        {
+            var storage = new MemoryStream();
+            var subject = new PageStorage(storage);
+
+            var newPageId = 123;
+            var docId = Guid.NewGuid();
+            subject.BindIndex(docId, newPageId, out var oldPageId);
+
+            var result = subject.GetDocumentHead(docId);
+
+            Assert.That(result, Is.EqualTo(newPageId));
+            Assert.That(oldPageId, Is.EqualTo(-1));
+        }
+        
+        [Test]
+        public void removing_from_index ()
+        {
+            var storage = new MemoryStream();
+            var subject = new PageStorage(storage);
+
+            var newPageId = 123;
+            var otherPageId = 321;
+            var docId = Guid.NewGuid();
+            var otherId = Guid.NewGuid();
+            subject.BindIndex(docId, newPageId, out var oldPageId);
+            subject.BindIndex(otherId, otherPageId, out _);
+
+            var result = subject.GetDocumentHead(docId);
+
+            Assert.That(result, Is.EqualTo(newPageId));
+            Assert.That(oldPageId, Is.EqualTo(-1));
+
+
+            subject.UnbindIndex(docId);
+            
+            Assert.That(subject.GetDocumentHead(docId), Is.EqualTo(-1), "Document is still in the index");
+            Assert.That(subject.GetDocumentHead(otherId), Is.EqualTo(otherPageId), "Lost a document we didn't target");
+        }
+
+        [Test]
+        public void writing_many_pages_to_the_index () {
+            var storage = new MemoryStream();
+            var subject = new PageStorage(storage);
+
+            
+            var firstPageId = 123;
+            var firstDocId = Guid.NewGuid();
+            subject.BindIndex(firstDocId, firstPageId, out _);
+
+            for (int i = 0; i < 1000; i++)
+            {
+                subject.BindIndex(Guid.NewGuid(), i, out _);
+            }
+            
+            var lastPageId = 123;
+            var lastDocId = Guid.NewGuid();
+            subject.BindIndex(lastDocId, lastPageId, out _);
+
+
+            Assert.That(subject.GetDocumentHead(firstDocId), Is.EqualTo(firstPageId));
+            Assert.That(subject.GetDocumentHead(lastDocId), Is.EqualTo(lastPageId));
+            
+            Console.WriteLine($"Storage after writing data is {storage.Length} bytes");
+        }
+
+        [Test]
+        public void path_lookup_data () {
+            var storage = new MemoryStream();
+            var subject = new PageStorage(storage);
+
+            var val1 = Guid.NewGuid();
+            var val2 = Guid.NewGuid();
+
+            subject.BindPath("this is my path", val1, out _);
+            subject.BindPath("this is another path", val2, out _);
+
+            var result1 = subject.GetDocumentIdByPath("this is my path");
+            var result2 = subject.GetDocumentIdByPath("this path is not presend");
+
+            Assert.That(result1, Is.EqualTo(val1));
+            Assert.That(result2, Is.Null);
+        }
+
+        [Test]
+        public void path_replacement_cycling()
+        {
+            var storage = new MemoryStream();
+            var subject = new PageStorage(storage);
+
+            var valIn = Guid.NewGuid();
+            Guid? prev = null;
+
+            for (int i = 0; i < 10; i++)
+            {
+                subject.BindPath("this path will get replaced a lot", valIn, out var valOut);
+                Assert.That(valOut, Is.EqualTo(prev), $"Failed on cycle {i}");
+                prev = valIn;
+                valIn = Guid.NewGuid();
+            }
+            Console.WriteLine($"Storage after writing data is {storage.Length} bytes");
+        }
+
+        [Test]
+        public void lookup_paths_for_a_document_id()
+        {
+            var storage = new MemoryStream();
+            var subject = new PageStorage(storage);
+            
+            var target = Guid.NewGuid();
+
+            subject.BindPath("one"  , target        , out _);
+            subject.BindPath("two"  , Guid.NewGuid(), out _);
+            subject.BindPath("three", target        , out _);
+            subject.BindPath("four" , target        , out _);
+            subject.BindPath("five" , Guid.NewGuid(), out _);
+            subject.BindPath("six"  , Guid.NewGuid(), out _);
+
+            var list = string.Join(",", subject.GetPathsForDocument(target));
+            Assert.That(list, Is.EqualTo("one,three,four"));
+        }
+
+        [Test]
+        public void search_paths_by_prefix () {
+            var storage = new MemoryStream();
+            var subject = new PageStorage(storage);
+            
+            subject.BindPath("find me/one"  , Guid.NewGuid(), out _);
+            subject.BindPath("find me/two"  , Guid.NewGuid(), out _);
+            subject.BindPath("miss me/three", Guid.NewGuid(), out _);
+            subject.BindPath("find me/four" , Guid.NewGuid(), out _);
+            subject.BindPath("miss me/five" , Guid.NewGuid(), out _);
+            subject.BindPath("miss me/six"  , Guid.NewGuid(), out _);
+
+            var list = string.Join(",", subject.SearchPaths("find me/"));
+            Assert.That(list, Is.EqualTo("find me/one,find me/two,find me/four"));
+        }
+
+        [Test]
+        public void unbinding_paths () {
+            var storage = new MemoryStream();
+            var subject = new PageStorage(storage);
+            
+            subject.BindPath("find me/one"  , Guid.NewGuid(), out _);
+            subject.BindPath("find me/two"  , Guid.NewGuid(), out _);
+            subject.BindPath("miss me/three", Guid.NewGuid(), out _);
+            subject.BindPath("find me/four" , Guid.NewGuid(), out _);
+            subject.BindPath("miss me/five" , Guid.NewGuid(), out _);
+            subject.BindPath("miss me/six"  , Guid.NewGuid(), out _);
+
+            subject.UnbindPath("find me/one");
+            subject.UnbindPath("find me/four");
+
+            var list = string.Join(",", subject.SearchPaths("find me/"));
+            Assert.That(list, Is.EqualTo("find me/two"));
+        }
+
+        [Test]
+        public void storage_operations_are_reported_to_the_logger () {
+            var storage = new MemoryStream();
+            var log = new RecordingLogger();
+            var subject = new PageStorage(storage, new DatabaseOptions { Logger = log });
+
+            var pageId = subject.WriteStream(new MemoryStream(new byte[] { 1, 2, 3 }));
+            subject.BindIndex(Guid.NewGuid(), pageId, out _);
+            subject.ReleaseChain(pageId);
+
+            Assert.That(log.Contains("Allocated pages"), Is.True, "Allocation was not logged");
+            Assert.That(log.Contains("Header link flipped link=index"), Is.True, "Link flip was not logged");
+            Assert.That(log.Contains("Released chain"), Is.True, "Release was not logged");
+        }
+
+        [Test]
+        public void crc_failures_are_reported_to_the_logger () {
+            var storage = new MemoryStream();
+            var log = new RecordingLogger();
+            var subject = new PageStorage(storage, new DatabaseOptions { Logger = log });
+
+            BasicPage.QuickAndDirtyMode = false;
+            var pageId = subject.WriteStream(new MemoryStream(new byte[] { 1, 2, 3 }));
+            storage.Seek(PageStorage.HEADER_SIZE + (pageId * BasicPage.PageRawSize) + 20, SeekOrigin.Begin);
+            storage.WriteByte(0xFF);
+
+            Assert.Throws<Exception>(() => subject.GetRawPage(pageId));
+            Assert.That(log.Contains("WARN: Page failed CRC check pageId=" + pageId), Is.True, "CRC failure was not logged");
+        }
+
+        [Test]
+        public void streams_read_page_at_a_time_when_over_the_memory_budget () {
+            var storage = new MemoryStream();
+            var subject = new PageStorage(storage, new DatabaseOptions { MemoryBudget = BasicPage.PageRawSize * 3 });
+
+            var big = new byte[20000];
+            new Random(4451).NextBytes(big);
+            var bigId = subject.WriteStream(new MemoryStream(big));
+            var smallId = subject.WriteStream(new MemoryStream(new byte[] { 1, 2, 3 }));
+
+            using (var small = subject.GetStream(smallId))
+            using (var stream = subject.GetStream(bigId))
+            {
+                Assert.That(small.IsPageAtATime, Is.False, "Small stream should fit the budget");
+                Assert.That(stream.IsPageAtATime, Is.True, "Large stream should not be cached");
+                Assert.That(subject.CacheMemoryUsed, Is.EqualTo(BasicPage.PageRawSize), "Large stream still holds memory");
+
+                var ms = new MemoryStream();
+                stream.CopyTo(ms);
+                Assert.That(ms.ToArray(), Is.EqualTo(big));
+            }
+            Assert.That(subject.CacheMemoryUsed, Is.Zero, "Disposed streams did not release memory");
+        }
+
+        [Test]
+        public void path_lookup_failures_are_reported_distinctly () {
+            var storage = new MemoryStream();
+            var subject = new PageStorage(storage);
+
+            BasicPage.QuickAndDirtyMode = false;
+            var docId = Guid.NewGuid();
+            subject.BindPath("damaged/path", docId, out _);
+            var pathPage = subject.Header().PathLookupLink.Newest;
+            storage.Seek(PageStorage.HEADER_SIZE + (pathPage * BasicPage.PageRawSize) + 20, SeekOrigin.Begin);
+            storage.WriteByte(0xFF); // binding a path drops the cached lookup, so this will be read
+
+            var ex = Assert.Throws<PathLookupException>(() => subject.GetPathsForDocument(docId));
+            Assert.That(ex.PageId, Is.EqualTo(pathPage));
+            Assert.That(ex.InnerException.ToString(), Contains.Substring("failed CRC check"));
+            Assert.Throws<PathLookupException>(() => subject.SearchPaths("damaged/"));
+        }
+
+        [Test]
+        public void index_lookups_skip_damaged_index_pages () {
+            var storage = new MemoryStream();
+            var subject = new PageStorage(storage);
+
+            BasicPage.QuickAndDirtyMode = false;
+            var firstDocId = Guid.NewGuid();
+            subject.BindIndex(firstDocId, 123, out _);
+            for (int i = 0; i < 1000; i++)
+            {
+                subject.BindIndex(Guid.NewGuid(), i, out _);
+            }
+            Assert.That(subject.NeedsRepair, Is.False);
+
+            // damage the newest index page. The first document is indexed in the oldest.
+            var topIndexPage = subject.Header().IndexLink.Newest;
+            storage.Seek(PageStorage.HEADER_SIZE + (topIndexPage * BasicPage.PageRawSize) + 20, SeekOrigin.Begin);
+            storage.WriteByte(0xFF);
+
+            Assert.That(subject.GetDocumentHead(firstDocId), Is.EqualTo(123), "Lookup did not get past the damaged page");
+            Assert.That(subject.GetDocumentHead(Guid.NewGuid()), Is.EqualTo(-1));
+            Assert.That(subject.NeedsRepair, Is.True);
+            Assert.That(subject.DamagedIndexPages(), Is.EqualTo(new[] { topIndexPage }));
+        }
+
+        [Test]
+        public void storage_operations_are_reported_to_the_tracer () {
+            var storage = new MemoryStream();
+            var tracer = new RecordingTracer();
+            var subject = new PageStorage(storage, new DatabaseOptions { Tracer = tracer });
+
+            var pageId = subject.WriteStream(new MemoryStream(new byte[5000]));
+            subject.BindIndex(Guid.NewGuid(), pageId, out _);
+            subject.BindPath("traced", Guid.NewGuid(), out _);
+            subject.GetDocumentIdByPath("traced");
+            subject.GetDocumentIdByPath("traced");
+            subject.GetStream(pageId).ReadByte();
+
+            var all = string.Join("\n", tracer.Spans);
+            Console.WriteLine(all);
+            Assert.That(all, Contains.Substring("StreamDb.WriteStream bytes=5000 pages=2"));
+            Assert.That(all, Contains.Substring("StreamDb.BindIndex documentId="));
+            Assert.That(all, Contains.Substring("StreamDb.BindPath path=traced"));
+            Assert.That(all, Contains.Substring("StreamDb.PathLookup cacheHit=True"));
+            Assert.That(all, Contains.Substring("StreamDb.GetStream endPageId=" + pageId + " pages=2 bytes=5000"));
+        }
+
+        [Test]
+        public void header_reports_core_links () {
+            var storage = new MemoryStream();
+            var subject = new PageStorage(storage);
+
+            var empty = subject.Header();
+            Assert.That(empty.MagicValid, Is.True, "Magic");
+            Assert.That(empty.FormatVersion, Is.EqualTo(PageStorage.FORMAT_VERSION), "Version");
+            Assert.That(empty.PageCount, Is.Zero, "Page count");
+            Assert.That(empty.IndexLink.Newest, Is.EqualTo(-1), "Index link");
+            Assert.That(empty.PathLookupLink.Newest, Is.EqualTo(-1), "Path link");
+
+            subject.BindPath("first", Guid.NewGuid(), out _);
+            subject.BindPath("second", Guid.NewGuid(), out _);
+
+            var populated = subject.Header();
+            Console.WriteLine($"Paths: {populated.PathLookupLink}; Pages: {populated.PageCount}");
+            Assert.That(populated.PathLookupLink.IsValid, Is.True, "Path link validity");
+            Assert.That(populated.PathLookupLink.Newest, Is.GreaterThanOrEqualTo(0), "Newest path link");
+            Assert.That(populated.PathLookupLink.Previous, Is.GreaterThanOrEqualTo(0), "Previous path link");
+            Assert.That(populated.PathLookupLink.Newest, Is.Not.EqualTo(populated.PathLookupLink.Previous), "Path link revisions");
+            Assert.That(populated.PageCount, Is.GreaterThan(0), "Page count");
+        }
+
+        [Test]
+        public void storage_with_an_unknown_format_version_is_not_opened () {
+            var storage = new MemoryStream();
+            new PageStorage(storage).BindPath("doc", Guid.NewGuid(), out _);
+            Assert.That(storage.ToArray().Take(PageStorage.MAGIC_SIZE), Is.EqualTo(new byte[] { 0x55, 0xAA, 0xFE, 0xED, 0xFA, 0xCE, 0xDA, 0x7A }), "Version 1 header changed");
+            Assert.That(new PageStorage(storage).Header().FormatVersion, Is.EqualTo(1));
+
+            storage.Seek(PageStorage.HEADER_MAGIC.Length, SeekOrigin.Begin);
+            storage.Write(PageStorage.VersionTag(2), 0, 2);
+
+            var ex = Assert.Throws<Exception>(() => new PageStorage(storage));
+            Assert.That(ex.Message, Contains.Substring("version 2"));
+        }
+
+        [Test]
+        public void dumping_pages_decodes_content_by_guessed_type () {
+            var storage = new MemoryStream();
+            var subject = new PageStorage(storage);
+
+            var docId = Guid.NewGuid();
+            var dataPageId = subject.WriteStream(new MemoryStream(new byte[] { 0xDE, 0xAD, 0xBE, 0xEF }));
+            subject.BindIndex(docId, dataPageId, out _);
+            subject.BindPath("some/path", docId, out _);
+
+            var header = subject.Header();
+            var dataDump = new StringWriter();
+            var indexDump = new StringWriter();
+            var pathDump = new StringWriter();
+            subject.DumpPage(dataPageId, dataDump);
+            subject.DumpPage(header.IndexLink.Newest, indexDump);
+            subject.DumpPage(header.PathLookupLink.Newest, pathDump);
+
+            Console.WriteLine(dataDump);
+            Console.WriteLine(indexDump);
+            Console.WriteLine(pathDump);
+
+            Assert.That(dataDump.ToString(), Contains.Substring("(Data)"));
+            Assert.That(dataDump.ToString(), Contains.Substring("deadbeef"));
+            Assert.That(indexDump.ToString(), Contains.Substring("(Index)"));
+            Assert.That(indexDump.ToString(), Contains.Substring(docId + " -> " + dataPageId));
+            Assert.That(pathDump.ToString(), Contains.Substring("(PathLookup)"));
+            Assert.That(pathDump.ToString(), Contains.Substring("Trie nodes: 9"));
+        }
+
+        [Test]
+        public void validated_path_cache_sees_writes_from_other_connections () {
+            var storage = new MemoryStream();
+            var writer = new PageStorage(storage);
+            var cached = new PageStorage(storage);
+            var validated = new PageStorage(storage, new DatabaseOptions { PathCache = PathCacheConsistency.Validated });
+            var first = Guid.NewGuid();
+            var second = Guid.NewGuid();
+
+            writer.BindPath("shared", first, out _);
+            Assert.That(cached.GetDocumentIdByPath("shared"), Is.EqualTo(first));
+            Assert.That(validated.GetDocumentIdByPath("shared"), Is.EqualTo(first));
+
+            writer.BindPath("shared", second, out _);
+            Assert.That(cached.GetDocumentIdByPath("shared"), Is.EqualTo(first), "Cached mode should keep its loaded copy");
+            Assert.That(validated.GetDocumentIdByPath("shared"), Is.EqualTo(second), "Validated mode did not reload");
+        }
+
+        [Test]
+        public void transient_storage_errors_are_retried_by_policy () {
+            var storage = new FlakyStream();
+            var log = new RecordingLogger();
+            var retry = new RetryPolicy { Attempts = 2, InitialDelay = TimeSpan.Zero };
+            var subject = new PageStorage(storage, new DatabaseOptions { Logger = log, Retry = retry });
+            storage.FailEvery = 3;
+
+            var endPage = subject.WriteStream(new MemoryStream(new byte[BasicPage.PageDataCapacity * 4]));
+            Assert.That(subject.GetStream(endPage).Length, Is.EqualTo(BasicPage.PageDataCapacity * 4));
+            Assert.That(log.Contains("Retrying storage operation"), Is.True, "Retries were not logged");
+
+            var flaky = new FlakyStream();
+            var noRetry = new PageStorage(flaky);
+            flaky.FailEvery = 3;
+            Assert.Throws<IOException>(() => noRetry.WriteStream(new MemoryStream(new byte[BasicPage.PageDataCapacity * 4])));
+        }
+
+        [Test]
+        public void changing_the_no_retry_policy_does_not_change_the_default () {
+            RetryPolicy.None.Attempts = 5;
+            RetryPolicy.None.IsRetryable = ex => true;
+
+            Assert.That(RetryPolicy.None.Attempts, Is.EqualTo(1));
+            var flaky = new FlakyStream();
+            var noRetry = new PageStorage(flaky);
+            flaky.FailEvery = 3;
+            Assert.Throws<IOException>(() => noRetry.WriteStream(new MemoryStream(new byte[BasicPage.PageDataCapacity * 4])));
+        }
+
+        [Test]
+        public void failed_writes_release_their_pages () {
+            var storage = new FlakyStream();
+            var subject = new PageStorage(storage);
+            subject.ReleaseChain(subject.WriteStream(new MemoryStream(new byte[10]))); // set up the free list and counters
+            storage.FailAfter = 12; // after the pages are allocated, part-way through writing data
+            Assert.Throws<IOException>(() => subject.WriteStream(new MemoryStream(new byte[BasicPage.PageDataCapacity * 8])));
+            Assert.That(subject.FreePageCount(), Is.EqualTo(8), "Pages of the failed write were not all released");
+
+            var sizeAfterFailure = storage.Length;
+            subject.WriteStream(new MemoryStream(new byte[BasicPage.PageDataCapacity * 8]));
+            Assert.That(storage.Length, Is.EqualTo(sizeAfterFailure), "Released pages were not reused");
+        }
+
+        [Test]
+        public void fenced_writers_fail_after_being_superseded () {
+            var storage = new MemoryStream();
+            var first = new PageStorage(storage, new DatabaseOptions { UseWriteFence = true });
+            first.WriteStream(new MemoryStream(new byte[] { 1, 2, 3 }));
+            Assert.That(first.FenceEpoch, Is.EqualTo(1));
+
+            var second = new PageStorage(storage, new DatabaseOptions { UseWriteFence = true });
+            Assert.That(second.FenceEpoch, Is.EqualTo(2));
+
+            var ex = Assert.Throws<StaleWriterException>(() => first.WriteStream(new MemoryStream(new byte[] { 4, 5, 6 })));
+            Assert.That(ex.CurrentEpoch, Is.EqualTo(2));
+            Assert.DoesNotThrow(() => second.WriteStream(new MemoryStream(new byte[] { 4, 5, 6 })));
+        }
+
+        [Test]
+        public void looped_chains_are_reported_with_context () {
+            var storage = new MemoryStream();
+            var subject = new PageStorage(storage);
+            var endPage = subject.WriteStream(new MemoryStream(new byte[BasicPage.PageDataCapacity * 3]));
+
+            // link the first page back to the end, making a loop
+            var first = subject.GetRawPage(subject.GetRawPage(endPage).PrevPageId);
+            var start = subject.GetRawPage(first.PrevPageId);
+            start.PrevPageId = endPage;
+            subject.CommitPage(start);
+
+            var ex = Assert.Throws<ChainException>(() => subject.ReleaseChain(endPage));
+            Assert.That(ex.RootPageId, Is.EqualTo(endPage));
+            Assert.That(ex.LoopEntryPageId, Is.EqualTo(endPage));
+            Assert.That(ex.PagesVisited, Is.EqualTo(3));
+        }
+
+        [Test]
+        public void chains_longer_than_the_limit_are_rejected () {
+            var storage = new MemoryStream();
+            var subject = new PageStorage(storage, new DatabaseOptions { MaxChainLength = 4 });
+            var endPage = subject.WriteStream(new MemoryStream(new byte[BasicPage.PageDataCapacity * 5]));
+
+            var ex = Assert.Throws<ChainException>(() => subject.GetStream(endPage).ReadByte());
+            Assert.That(ex.IsLoop, Is.False);
+            Assert.That(ex.PagesVisited, Is.EqualTo(5));
+        }
+
+        [Test]
+        public void integrity_check_finds_corrupted_pages () {
+            var storage = new MemoryStream();
+            var subject = new PageStorage(storage);
+            subject.WriteStream(new MemoryStream(new byte[BasicPage.PageDataCapacity * 10]));
+            var damaged = subject.WriteStream(new MemoryStream(new byte[] { 1, 2, 3 }));
+
+            var clean = subject.CheckIntegrity(3);
+            Assert.That(clean.IsValid, Is.True, clean.ToString());
+            Assert.That(clean.PagesChecked, Is.EqualTo(11));
+
+            storage.Seek(PageStorage.HEADER_SIZE + (damaged * BasicPage.PageRawSize) + 20, SeekOrigin.Begin);
+            storage.WriteByte(0xFF);
+
+            var report = subject.CheckIntegrity(3);
+            Assert.That(report.IsValid, Is.False);
+            Assert.That(report.FailedPages, Is.EquivalentTo(new[] { damaged }));
+        }
+
+        [Test]
+        public void large_streams_can_be_written_by_a_worker_pool () {
+            var storage = new MemoryStream();
+            var subject = new PageStorage(storage, new DatabaseOptions { WriteWorkers = 4, ExtentPages = 3 });
+            var data = new byte[BasicPage.PageDataCapacity * 20 + 17];
+            new Random(4424).NextBytes(data);
+
+            var endPage = subject.WriteStream(new MemoryStream(data));
+
+            var result = new MemoryStream();
+            subject.GetStream(endPage).CopyTo(result);
+            Assert.That(result.ToArray(), Is.EqualTo(data));
+        }
+
+        [Test]
+        public void failed_worker_pool_writes_release_their_pages () {
+            var storage = new FlakyStream();
+            var subject = new PageStorage(storage, new DatabaseOptions { WriteWorkers = 4, ExtentPages = 3 });
+            subject.ReleaseChain(subject.WriteStream(new MemoryStream(new byte[10]))); // set up the free list and counters
+            var data = new byte[BasicPage.PageDataCapacity * 20];
+
+            storage.FailAfter = 28; // after the pages are allocated, in one of the workers
+            Assert.Throws<Exception>(() => subject.WriteStream(new MemoryStream(data, false), data.Length));
+            Assert.That(subject.FreePageCount(), Is.EqualTo(20), "Pages of the failed write were not all released");
+
+            // the source fails while workers are still writing earlier extents
+            Assert.Throws<IOException>(() => subject.WriteStream(new FailingSource(data, failAfterReads: 4), data.Length));
+            Assert.That(subject.FreePageCount(), Is.EqualTo(20), "Pages of the failed read were not all released");
+
+            var sizeAfterFailure = storage.Length;
+            var endPage = subject.WriteStream(new MemoryStream(data, false), data.Length);
+            Assert.That(storage.Length, Is.EqualTo(sizeAfterFailure), "Released pages were not reused");
+            Assert.That(subject.CheckIntegrity(1).IsValid, Is.True);
+            Assert.That(subject.GetStream(endPage).Length, Is.EqualTo(data.Length));
+        }
+
+        [Test]
+        public void cached_free_list_allocates_exactly_as_storage_does () {
+            var plain = new MemoryStream();
+            var cached = new MemoryStream();
+            RunFreeListWorkload(new PageStorage(plain));
+            RunFreeListWorkload(new PageStorage(cached, new DatabaseOptions { CacheFreeList = true }));
+
+            Assert.That(cached.ToArray(), Is.EqualTo(plain.ToArray()), "Cached free list made different allocations");
+
+            // a second connection loads the list left by the first
+            var reopened = new PageStorage(cached, new DatabaseOptions { CacheFreeList = true });
+            Assert.That(reopened.FreePageCount(), Is.GreaterThan(BasicPage.MaxInt32Index), "Workload should span several free list pages");
+            RunFreeListWorkload(reopened);
+            RunFreeListWorkload(new PageStorage(plain));
+            Assert.That(cached.ToArray(), Is.EqualTo(plain.ToArray()), "Reloaded free list made different allocations");
+        }
+
+        private static void RunFreeListWorkload(PageStorage subject)
+        {
+            var chains = new List<int>();
+            for (int i = 0; i < 30; i++) chains.Add(subject.WriteStream(new MemoryStream(new byte[BasicPage.PageDataCapacity * 80])));
+            for (int i = 0; i < chains.Count; i += 2) subject.ReleaseChain(chains[i]);
+            for (int i = 0; i < 5; i++) chains.Add(subject.WriteStream(new MemoryStream(new byte[BasicPage.PageDataCapacity * 50])));
+
+            subject.ReleaseChain(chains[1]);
+            subject.BindIndex(Guid.Parse("00000000-0000-0000-0000-000000000003"), chains[3], out _);
+            subject.RelocatePage(chains[3], chains[1]); // the released end page is free again
+            for (int i = 5; i < chains.Count; i += 2) subject.ReleaseChain(chains[i]);
+        }
+
+        [Test]
+        public void released_pages_wait_out_their_grace_period () {
+            var storage = new MemoryStream();
+            var subject = new PageStorage(storage, new DatabaseOptions { DeferFreeCommits = 2 });
+            var docA = Guid.Parse("00000000-0000-0000-0000-00000000000a");
+            var docB = Guid.Parse("00000000-0000-0000-0000-00000000000b");
+
+            var first = subject.WriteStream(new MemoryStream(new byte[BasicPage.PageDataCapacity * 10]));
+            subject.BindIndex(docA, first, out _);
+            subject.UnbindIndex(docA);
+            subject.ReleaseChain(first);
+            Assert.That(subject.DeferredPageCount, Is.EqualTo(10));
+            var free = subject.FreePageCount();
+
+            var lengthBefore = storage.Length;
+            var second = subject.WriteStream(new MemoryStream(new byte[BasicPage.PageDataCapacity * 10]));
+            Assert.That(storage.Length, Is.GreaterThan(lengthBefore), "Deferred pages were reused too soon");
+
+            subject.BindIndex(docB, second, out _); // first commit after release
+            Assert.That(subject.DeferredPageCount, Is.EqualTo(10));
+            subject.BindIndex(docA, second, out _); // second commit
+            Assert.That(subject.DeferredPageCount, Is.EqualTo(0), "Pages were not released after their grace period");
+            Assert.That(subject.FreePageCount(), Is.GreaterThanOrEqualTo(free + 10));
+
+            subject.UnbindIndex(docA);
+            subject.UnbindIndex(docB);
+            subject.ReleaseChain(second);
+            Assert.That(subject.DeferredPageCount, Is.EqualTo(10));
+            subject.ReleaseDeferredPages();
+            Assert.That(subject.DeferredPageCount, Is.EqualTo(0), "Pages were not released on request");
+        }
+
+        [Test]
+        public void pages_left_waiting_by_a_crash_are_freed_when_storage_is_next_opened () {
+            var deferring = new MemoryStream();
+            var subject = new PageStorage(deferring, new DatabaseOptions { DeferFreeCommits = 100 });
+            subject.ReleaseChain(subject.WriteStream(new MemoryStream(new byte[BasicPage.PageDataCapacity * 10])));
+            Assert.That(subject.DeferredPageCount, Is.EqualTo(10));
+
+            var holding = new MemoryStream();
+            var held = new PageStorage(holding);
+            held.HoldReleasedPages(); // never ended
+            held.ReleaseChain(held.WriteStream(new MemoryStream(new byte[BasicPage.PageDataCapacity * 10])));
+            Assert.That(held.DeferredPageCount, Is.EqualTo(10));
+
+            foreach (var crashed in new[] { deferring, holding })
+            {
+                var before = new PageStorage(new MemoryStream(crashed.ToArray()), new DatabaseOptions { ReadReplica = true }).FreePageCount();
+                var reopenedStorage = Copy(crashed);
+                var reopened = new PageStorage(reopenedStorage);
+                Assert.That(reopened.DeferredPageCount, Is.Zero);
+                Assert.That(reopened.FreePageCount(), Is.GreaterThanOrEqualTo(before + 10), "Waiting pages were lost");
+
+                var again = new PageStorage(Copy(reopenedStorage));
+                Assert.That(again.FreePageCount(), Is.EqualTo(reopened.FreePageCount()), "Pages were freed twice");
+
+                var length = reopenedStorage.Length;
+                reopened.WriteStream(new MemoryStream(new byte[BasicPage.PageDataCapacity * 10]));
+                Assert.That(reopenedStorage.Length, Is.EqualTo(length), "Recovered pages were not reused");
+            }
+        }
+
+        [Test]
+        public void pages_reused_from_the_free_list_are_blank () {
+            var subject = new PageStorage(new MemoryStream());
+            var endPageId = subject.WriteStream(new MemoryStream(new byte[BasicPage.PageDataCapacity * 3]));
+            subject.ReleaseChain(endPageId);
+
+            var block = new int[3];
+            subject.AllocatePageBlock(block);
+            Assert.That(block, Contains.Item(endPageId), "Released pages were not reused");
+            foreach (var pageId in block)
+            {
+                var page = subject.GetRawPage(pageId);
+                Assert.That(page.DataLength, Is.Zero, $"Page {pageId} kept its old length");
+                Assert.That(page.PrevPageId, Is.EqualTo(-1), $"Page {pageId} kept its old link");
+            }
+        }
+
+        [Test]
+        public void cached_pages_are_not_checked_again () {
+            var storage = new MemoryStream();
+            var subject = new PageStorage(storage, new DatabaseOptions { PageCachePages = 16 });
+            var endPage = subject.WriteStream(new MemoryStream(new byte[] { 1, 2, 3 }));
+
+            storage.Seek(PageStorage.HEADER_SIZE + (endPage * BasicPage.PageRawSize) + 20, SeekOrigin.Begin);
+            storage.WriteByte(0xFF);
+
+            BasicPage.QuickAndDirtyMode = false;
+            var result = new MemoryStream();
+            subject.GetStream(endPage).CopyTo(result);
+            Assert.That(result.ToArray(), Is.EqualTo(new byte[] { 1, 2, 3 }), "Cached page should be served as written");
+
+            var report = subject.CheckIntegrity(1);
+            Assert.That(report.FailedPages, Is.EquivalentTo(new[] { endPage }), "Integrity check should read storage");
+
+            var uncached = new PageStorage(storage);
+            Assert.Throws<Exception>(() => uncached.GetStream(endPage).CopyTo(new MemoryStream()));
+        }
+
+        [Test]
+        public void operations_over_the_slow_threshold_are_logged () {
+            var log = new RecordingLogger();
+            var subject = new PageStorage(new MemoryStream(), new DatabaseOptions { Logger = log, SlowOperationThreshold = TimeSpan.Zero });
+            var endPage = subject.WriteStream(new MemoryStream(new byte[BasicPage.PageDataCapacity * 3]));
+            subject.ReleaseChain(endPage);
+
+            Assert.That(log.Contains("WARN: Slow operation operation=StreamDb.WriteStream durationMs="), Is.True);
+            Assert.That(log.Contains("pages=3"), Is.True);
+            Assert.That(log.Contains("operation=StreamDb.ReleaseChain"), Is.True);
+
+            var quiet = new RecordingLogger();
+            var relaxed = new PageStorage(new MemoryStream(), new DatabaseOptions { Logger = quiet, SlowOperationThreshold = TimeSpan.FromHours(1) });
+            relaxed.ReleaseChain(relaxed.WriteStream(new MemoryStream(new byte[] { 1, 2, 3 })));
+            Assert.That(quiet.Contains("Slow operation"), Is.False);
+        }
+
+        [Test]
+        public void cloned_page_streams_can_be_read_in_parallel () {
+            var subject = new PageStorage(new MemoryStream());
+            var data = new byte[BasicPage.PageDataCapacity * 20 + 123];
+            new Random(4493).NextBytes(data);
+            var endPage = subject.WriteStream(new MemoryStream(data));
+
+            var original = subject.GetStream(endPage);
+            var clones = Enumerable.Range(0, 8).Select(i => original.Clone()).ToList();
+            original.Dispose(); // clones keep the shared pages
+
+            var results = new byte[clones.Count][];
+            var threads = clones.Select((clone, i) => new System.Threading.Thread(() => {
+                var ms = new MemoryStream();
+                var buf = new byte[1000 + i * 37]; // odd sizes, so reads straddle pages differently
+                int read;
+                while ((read = clone.Read(buf, 0, buf.Length)) > 0) ms.Write(buf, 0, read);
+                results[i] = ms.ToArray();
+            })).ToList();
+            threads.ForEach(t => t.Start());
+            threads.ForEach(t => t.Join());
+
+            foreach (var result in results) Assert.That(result, Is.EqualTo(data));
+            clones.ForEach(c => c.Dispose());
+            Assert.Throws<ObjectDisposedException>(() => clones[0].Clone());
+            Assert.Throws<ObjectDisposedException>(() => clones[0].Read(new byte[10], 0, 10));
+            Assert.Throws<ObjectDisposedException>(() => clones[0].Seek(0, SeekOrigin.Begin));
+        }
+
+        [Test]
+        public void page_streams_seek_like_other_streams () {
+            var subject = new PageStorage(new MemoryStream());
+            var data = new byte[BasicPage.PageDataCapacity * 2 + 10];
+            new Random(4494).NextBytes(data);
+            var stream = subject.GetStream(subject.WriteStream(new MemoryStream(data)));
+            var buf = new byte[20];
+
+            Assert.That(stream.Seek(-5, SeekOrigin.End), Is.EqualTo(data.Length - 5));
+            Assert.That(stream.Read(buf, 0, buf.Length), Is.EqualTo(5));
+            Assert.That(buf.Take(5), Is.EqualTo(data.Skip(data.Length - 5)));
+            Assert.That(stream.Read(buf, 0, buf.Length), Is.Zero, "Read at end");
+
+            // straddling a page boundary
+            Assert.That(stream.Seek(BasicPage.PageDataCapacity - 3, SeekOrigin.Begin), Is.EqualTo(BasicPage.PageDataCapacity - 3));
+            Assert.That(stream.Read(buf, 0, 6), Is.EqualTo(6));
+            Assert.That(buf.Take(6), Is.EqualTo(data.Skip(BasicPage.PageDataCapacity - 3).Take(6)));
+            Assert.That(stream.Seek(-6, SeekOrigin.Current), Is.EqualTo(BasicPage.PageDataCapacity - 3));
+            Assert.That(stream.Seek(0, SeekOrigin.Current), Is.EqualTo(BasicPage.PageDataCapacity - 3));
+
+            // past the end is allowed, but reads nothing
+            Assert.That(stream.Seek(100, SeekOrigin.End), Is.EqualTo(data.Length + 100));
+            Assert.That(stream.Read(buf, 0, buf.Length), Is.Zero);
+            Assert.That(stream.Seek(long.MaxValue / 2, SeekOrigin.Begin), Is.EqualTo(long.MaxValue / 2));
+            Assert.That(stream.Read(buf, 0, buf.Length), Is.Zero);
+
+            // before the start is refused, and the position is kept
+            stream.Seek(10, SeekOrigin.Begin);
+            Assert.Throws<IOException>(() => stream.Seek(-1, SeekOrigin.Begin));
+            Assert.Throws<IOException>(() => stream.Seek(-11, SeekOrigin.Current));
+            Assert.Throws<IOException>(() => stream.Seek(-data.Length - 1, SeekOrigin.End));
+            Assert.Throws<ArgumentOutOfRangeException>(() => stream.Position = -1);
+            Assert.Throws<ArgumentException>(() => stream.Seek(0, (SeekOrigin)7));
+            Assert.That(stream.Position, Is.EqualTo(10));
+            Assert.That(stream.Seek(-data.Length, SeekOrigin.End), Is.Zero);
+        }
+
+        [Test]
+        public void streams_of_unknown_length_are_written_without_buffering_the_whole_document () {
+            var data = Enumerable.Range(0, BasicPage.PageDataCapacity * 40 + 123).Select(i => (byte)(i % 251)).ToArray();
+            var packed = new MemoryStream();
+            using (var gzip = new System.IO.Compression.GZipStream(packed, System.IO.Compression.CompressionMode.Compress, true))
+            {
+                gzip.Write(data, 0, data.Length);
+            }
+            packed.Seek(0, SeekOrigin.Begin);
+
+            var subject = new PageStorage(new MemoryStream(), new DatabaseOptions { ExtentPages = 16 });
+            var source = new System.IO.Compression.GZipStream(packed, System.IO.Compression.CompressionMode.Decompress); // can't seek, and has no length
+            var endPage = subject.WriteStream(source);
+
+            var result = new MemoryStream();
+            subject.GetStream(endPage).CopyTo(result);
+            Assert.That(result.ToArray(), Is.EqualTo(data));
+            Assert.That(subject.AnalyzeChain(endPage).PageCount, Is.EqualTo(41));
+            Assert.That(subject.FreePageCount(), Is.EqualTo(0), "More pages were allocated than the data needed");
+        }
+
+        [Test]
+        public void a_path_lookup_loaded_while_a_bind_is_waiting_is_not_kept_after_the_bind () {
+            var tracer = new RecordingTracer();
+            var subject = new PageStorage(new MemoryStream(), new DatabaseOptions { Tracer = tracer, PathCache = PathCacheConsistency.Cached });
+            subject.BindPath("first", Guid.NewGuid(), out _);
+
+            // Stand in for a reader on another thread, that loads the lookup after the bind has dropped the cache but before it takes the lock
+            tracer.OnStart = name => { if (name == "StreamDb.BindPath") subject.GetDocumentIdByPath("first"); };
+            var id = Guid.NewGuid();
+            subject.BindPath("second", id, out _);
+            tracer.OnStart = null;
+
+            Assert.That(subject.GetDocumentIdByPath("second"), Is.EqualTo(id), "An out of date path lookup was kept in the cache");
+        }
+
+        [Test]
+        public void pages_left_in_the_write_ahead_log_by_a_crash_are_written_again_on_open () {
+            var wal = new MemoryStream();
+            var storage = new FlakyStream();
+            var subject = new PageStorage(storage, new DatabaseOptions { WriteAheadLog = wal });
+            var id = Guid.NewGuid();
+
+            subject.BindIndex(id, subject.WriteStream(new MemoryStream(new byte[] { 1, 2, 3 })), out _);
+            Assert.That(wal.Length, Is.Zero, "Log was not cleared at the end of the change");
+
+            // crash while the index page is being updated in place
+            var second = subject.WriteStream(new MemoryStream(new byte[] { 4, 5, 6 }));
+            storage.FailAfter = 0;
+            Assert.Throws<IOException>(() => subject.BindIndex(id, second, out _));
+            Assert.That(wal.Length, Is.GreaterThan(0), "Page was not logged before it was written");
+
+            var afterCrash = storage.ToArray();
+            MemoryStream Crashed() { var copy = new MemoryStream(); copy.Write(afterCrash, 0, afterCrash.Length); return copy; }
+            var withoutLog = new PageStorage(Crashed());
+            Assert.That(withoutLog.GetDocumentHead(id), Is.Not.EqualTo(second));
+
+            var recovered = new PageStorage(Crashed(), new DatabaseOptions { WriteAheadLog = wal });
+            Assert.That(recovered.GetDocumentHead(id), Is.EqualTo(second), "Logged page was not written again");
+            Assert.That(wal.Length, Is.Zero, "Log was not cleared after replay");
+        }
+
+        [Test]
+        public void a_torn_final_record_in_the_write_ahead_log_is_ignored () {
+            var wal = new MemoryStream();
+            var storage = new FlakyStream();
+            var subject = new PageStorage(storage, new DatabaseOptions { WriteAheadLog = wal });
+            var id = Guid.NewGuid();
+            var first = subject.WriteStream(new MemoryStream(new byte[] { 1, 2, 3 }));
+            subject.BindIndex(id, first, out _);
+
+            // crash after the log was flushed, but before storage was written
+            var second = subject.WriteStream(new MemoryStream(new byte[] { 4, 5, 6 }));
+            storage.FailAfter = 0;
+            Assert.Throws<IOException>(() => subject.BindIndex(id, second, out _));
+            var afterCrash = storage.ToArray();
+            var logged = wal.ToArray();
+            Assert.That(logged.Length, Is.EqualTo(LogRecordSize), "Expected the one index page to be logged");
+
+            PageStorage Reopen(byte[] log, int length) {
+                var copy = new MemoryStream();
+                copy.Write(afterCrash, 0, afterCrash.Length);
+                var logCopy = new MemoryStream();
+                logCopy.Write(log, 0, length);
+                var result = new PageStorage(copy, new DatabaseOptions { WriteAheadLog = logCopy });
+                Assert.That(logCopy.Length, Is.Zero, "Log was not cleared on open");
+                return result;
+            }
+
+            // a whole record followed by one cut short: the whole one is replayed
+            var withTornTail = logged.Concat(logged.Take(LogRecordSize / 2)).ToArray();
+            Assert.That(Reopen(withTornTail, withTornTail.Length).GetDocumentHead(id), Is.EqualTo(second));
+
+            // the only record cut short, or damaged: storage is left as it was before the change
+            Assert.That(Reopen(logged, logged.Length - 100).GetDocumentHead(id), Is.EqualTo(first));
+            var damaged = (byte[])logged.Clone();
+            damaged[damaged.Length - 1] ^= 0xFF;
+            Assert.That(Reopen(damaged, damaged.Length).GetDocumentHead(id), Is.EqualTo(first));
+        }
+
+        [Test]
+        public void the_write_ahead_log_holds_only_index_pages_and_is_flushed_once_per_change () {
+            var wal = new FlushCountingStream();
+            var subject = new PageStorage(new MemoryStream(), new DatabaseOptions { WriteAheadLog = wal });
+            var id = Guid.NewGuid();
+            subject.BindIndex(id, subject.WriteStream(new MemoryStream(new byte[] { 1, 2, 3 })), out _);
+
+            var largest = 0L;
+            wal.Flushes = 0;
+            wal.OnWrite = () => largest = Math.Max(largest, wal.Length);
+            var big = subject.WriteStream(new MemoryStream(new byte[BasicPage.PageDataCapacity * 200]));
+            Assert.That(wal.Flushes, Is.Zero, "Document data was logged");
+
+            subject.BindIndex(id, big, out _);
+            Assert.That(wal.Flushes, Is.EqualTo(2), "Expected one flush to log the change, and one to clear it");
+            Assert.That(largest, Is.EqualTo(LogRecordSize));
+            Assert.That(wal.Length, Is.Zero);
+        }
+
+        [Test]
+        public void memory_streams_are_written_straight_from_their_buffer () {
+            var data = new byte[BasicPage.PageDataCapacity * 20 + 17];
+            new Random(4473).NextBytes(data);
+
+            foreach (var workers in new[] { 1, 4 })
+            {
+                var subject = new PageStorage(new MemoryStream(), new DatabaseOptions { WriteWorkers = workers, ExtentPages = 3 });
+
+                // Buffer is visible, starts part-way into its array, and has been partly read
+                var source = new MemoryStream(data, 5, data.Length - 5, writable: false, publiclyVisible: true);
+                source.Seek(100, SeekOrigin.Begin);
+                var endPage = subject.WriteStream(source, 50000);
+                Assert.That(source.Position, Is.EqualTo(50100), "Source was not advanced past the data written");
+
+                var result = new MemoryStream();
+                subject.GetStream(endPage).CopyTo(result);
+                Assert.That(result.ToArray(), Is.EqualTo(data.Skip(105).Take(50000).ToArray()), $"Wrong data with {workers} workers");
+
+                Assert.Throws<Exception>(() => subject.WriteStream(source, data.Length), "Source was shorter than the length given");
+            }
+        }
+
+        [Test]
+        public void sync_options_control_flushes_for_each_write_class () {
+            var eagerStorage = new FlushCountingStream();
+            var eager = new PageStorage(eagerStorage);
+            var before = eagerStorage.Flushes;
+            eager.BindIndex(Guid.NewGuid(), eager.WriteStream(new MemoryStream(new byte[20000])), out _);
+            Assert.That(eagerStorage.Flushes - before, Is.GreaterThanOrEqualTo(2), "Default should flush data and index");
+
+            var lazyStorage = new FlushCountingStream();
+            var sync = new SyncOptions { DocumentData = SyncMode.None, Index = SyncMode.None, Paths = SyncMode.None, FreeList = SyncMode.None };
+            var lazy = new PageStorage(lazyStorage, new DatabaseOptions { Sync = sync });
+            before = lazyStorage.Flushes;
+            var id = Guid.NewGuid();
+            lazy.BindIndex(id, lazy.WriteStream(new MemoryStream(new byte[20000])), out _);
+            Assert.That(lazyStorage.Flushes - before, Is.Zero, "Nothing should flush");
+            Assert.That(lazy.GetStream(lazy.GetDocumentHead(id)).Length, Is.EqualTo(20000));
+        }
+
+        [Test]
+        public void pages_can_be_relocated_without_breaking_their_chain () {
+            var storage = new MemoryStream();
+            var subject = new PageStorage(storage);
+            var data = new byte[10000];
+            new Random(4454).NextBytes(data);
+
+            var docId = Guid.NewGuid();
+            var endPageId = subject.WriteStream(new MemoryStream(data));
+            subject.BindIndex(docId, endPageId, out _);
+            var middlePageId = subject.GetRawPage(endPageId).PrevPageId;
+
+            // make some free pages to move into
+            var spareEnd = subject.WriteStream(new MemoryStream(new byte[10000]));
+            var spareMiddle = subject.GetRawPage(spareEnd).PrevPageId;
+            subject.ReleaseChain(spareEnd);
+
+            subject.RelocatePage(middlePageId, spareMiddle);
+            subject.RelocatePage(endPageId, spareEnd);
+
+            Assert.That(subject.GetDocumentHead(docId), Is.EqualTo(spareEnd), "Index was not updated");
+            Assert.That(subject.GetRawPage(spareEnd).PrevPageId, Is.EqualTo(spareMiddle), "Back link was not updated");
+            Assert.That(subject.GuessPageType(middlePageId), Is.EqualTo(PageType.Free));
+            Assert.That(subject.GuessPageType(endPageId), Is.EqualTo(PageType.Free));
+
+            var result = new MemoryStream();
+            subject.GetStream(spareEnd).CopyTo(result);
+            Assert.That(result.ToArray(), Is.EqualTo(data), "Data changed during relocation");
+
+            Assert.Throws<Exception>(() => subject.RelocatePage(middlePageId, endPageId), "Free pages should not be relocated");
+        }
+
+        [Test]
+        public void relocating_a_shard_top_is_seen_by_later_lookups () {
+            var storage = new MemoryStream();
+            var subject = new PageStorage(storage);
+            var docId = Guid.NewGuid();
+            var endPageId = subject.WriteStream(new MemoryStream(new byte[100]));
+            subject.BindIndex(docId, endPageId, out _);
+            Assert.That(subject.MigrateToShardedIndex(), Is.True);
+            Assert.That(subject.GetDocumentHead(docId), Is.EqualTo(endPageId)); // index root is now cached
+
+            var shardTops = Enumerable.Range(0, (int)(storage.Length / BasicPage.PageRawSize)).Where(p => subject.GuessPageType(p) == PageType.Index).ToList();
+            var spares = shardTops.Select(_ => subject.WriteStream(new MemoryStream(new byte[100]))).ToList();
+            foreach (var spare in spares) subject.ReleaseChain(spare);
+            for (int i = 0; i < shardTops.Count; i++) subject.RelocatePage(shardTops[i], spares[i]);
+
+            Assert.That(subject.GetDocumentHead(docId), Is.EqualTo(endPageId), "Lookup used a shard top from before the move");
+            Assert.That(spares.All(p => subject.GuessPageType(p) == PageType.Index), Is.True);
+        }
+
+        [Test]
+        public void pages_that_keep_failing_are_moved_off_and_never_reused () {
+            var storage = new MemoryStream();
+            var subject = new PageStorage(storage, new DatabaseOptions { BadPageFailures = 3 });
+            BasicPage.QuickAndDirtyMode = false;
+            var data = new byte[10000];
+            new Random(4455).NextBytes(data);
+
+            var docId = Guid.NewGuid();
+            var endPageId = subject.WriteStream(new MemoryStream(data));
+            subject.BindIndex(docId, endPageId, out _);
+            var flakyPageId = subject.GetRawPage(endPageId).PrevPageId;
+
+            // a sector that reads badly some of the time
+            var position = PageStorage.HEADER_SIZE + (flakyPageId * BasicPage.PageRawSize) + 100;
+            storage.Seek(position, SeekOrigin.Begin);
+            var original = (byte)storage.ReadByte();
+            storage.Seek(position, SeekOrigin.Begin);
+            storage.WriteByte((byte)~original);
+            for (int i = 0; i < 3; i++) { Assert.Throws<Exception>(() => subject.GetStream(endPageId).CopyTo(Stream.Null)); }
+            storage.Seek(position, SeekOrigin.Begin);
+            storage.WriteByte(original);
+
+            // the next write moves the data off
+            subject.WriteStream(new MemoryStream(new byte[] { 1, 2, 3 }));
+            Assert.That(subject.BadPages(), Is.EqualTo(new[] { flakyPageId }));
+            Assert.That(subject.GuessPageType(flakyPageId), Is.EqualTo(PageType.Bad));
+
+            var result = new MemoryStream();
+            subject.GetStream(subject.GetDocumentHead(docId)).CopyTo(result);
+            Assert.That(result.ToArray(), Is.EqualTo(data), "Data changed while moving off the bad page");
+
+            // released pages are recycled, but the bad one never is
+            for (int i = 0; i < 10; i++)
+            {
+                var pageId = subject.WriteStream(new MemoryStream(new byte[10000]));
+                for (var page = subject.GetRawPage(pageId); page != null; page = subject.GetRawPage(page.PrevPageId))
+                {
+                    Assert.That(page.PageId, Is.Not.EqualTo(flakyPageId), "Bad page was allocated");
+                }
+                subject.ReleaseChain(pageId);
+            }
+
+            var reopened = new PageStorage(storage);
+            Assert.That(reopened.BadPages(), Is.EqualTo(new[] { flakyPageId }), "Bad page map was not stored");
+        }
+
+        [Test]
+        public void free_pages_can_be_marked_bad () {
+            var storage = new MemoryStream();
+            var subject = new PageStorage(storage);
+            var pageId = subject.WriteStream(new MemoryStream(new byte[100]));
+            subject.ReleaseChain(pageId);
+            Assert.That(subject.GuessPageType(pageId), Is.EqualTo(PageType.Free));
+
+            subject.MarkBadPage(pageId);
+
+            Assert.That(subject.GuessPageType(pageId), Is.EqualTo(PageType.Bad));
+            var next = subject.WriteStream(new MemoryStream(new byte[100]));
+            Assert.That(next, Is.Not.EqualTo(pageId), "Bad page was allocated");
+        }
+
+        [Test]
+        public void framed_records_survive_page_chains_and_skip_damage () {
+            var subject = new PageStorage(new MemoryStream());
+            var records = new List<byte[]>();
+            for (int i = 0; i < 50; i++) { records.Add(Enumerable.Repeat((byte)i, 200 + i * 3).ToArray()); }
+
+            var pageId = subject.WriteStream(RecordFraming.Pack(records));
+            var stored = subject.GetStream(pageId);
+            Assert.That(stored.Length, Is.GreaterThan(BasicPage.PageDataCapacity * 2), "Records should cross page boundaries");
+
+            var read = RecordFraming.Read(stored).Select(r => r.Value).ToList();
+            Assert.That(read, Is.EqualTo(records));
+
+            // damage one record, and the rest should still be read
+            var copy = new MemoryStream();
+            stored.Seek(0, SeekOrigin.Begin);
+            stored.CopyTo(copy);
+            var damagedAt = RecordFraming.Read(copy).ElementAt(10).Key;
+            copy.Seek(damagedAt + RecordFraming.FrameHeaderSize + 5, SeekOrigin.Begin);
+            copy.WriteByte(0xFF);
+
+            var afterDamage = RecordFraming.Read(copy).Select(r => r.Value[0]).ToList();
+            Assert.That(afterDamage, Is.EqualTo(Enumerable.Range(0, 50).Where(i => i != 10).Select(i => (byte)i).ToList()));
+        }
+
+        [Test]
+        public void a_torn_record_append_keeps_the_records_already_written () {
+            BasicPage.QuickAndDirtyMode = false;
+            var records = Enumerable.Range(0, 20).Select(i => new byte[] { (byte)i, 1, 2, 3, 4, 5, 6, 7 }).ToList();
+
+            foreach (var cutoff in new[] { 10, 100, 1000, 3000 })
+            {
+                var baseStream = new MemoryStream();
+                var stream = new CutoffStream(baseStream);
+                var subject = new PageStorage(stream);
+                var chain = Guid.NewGuid();
+                foreach (var record in records) { subject.AppendRecord(chain, record); }
+
+                stream.CutoffAfter(cutoff);
+                try { subject.AppendRecord(chain, new byte[] { 99 }); }
+                catch (Exception ex) { Console.WriteLine("Exception was triggered, as expected: " + ex.Message); }
+                Assert.That(stream.HasCutoff(), Is.True, "Failed to break output stream");
+
+                var result = new PageStorage(new MemoryStream(baseStream.ToArray()));
+                var read = result.ReadRecords(chain).ToList();
+                Assert.That(read.Take(records.Count), Is.EqualTo(records), $"Committed records were damaged with cutoff at {cutoff} bytes");
+            }
+        }
+
+        /// <summary> Copy storage into a new stream that can grow </summary>
+        private static MemoryStream Copy(MemoryStream source) {
+            var copy = new MemoryStream();
+            source.WriteTo(copy);
+            return copy;
+        }
+
+        /// <summary> Size of a write-ahead log record: magic, page ID and CRC, then the page image </summary>
+        private const int LogRecordSize = 12 + BasicPage.PageRawSize;
+
+        private class FlushCountingStream : MemoryStream {
+            public int Flushes;
+            public Action OnWrite;
+            public override void Flush() { Flushes++; base.Flush(); }
+            public override void Write(byte[] buffer, int offset, int count) { base.Write(buffer, offset, count); OnWrite?.Invoke(); }
+        }
+
+        /// <summary>
+        /// Throws an IOException on every n-th write, once `FailEvery` is set, or once after `FailAfter` more writes
+        /// </summary>
+        private class FlakyStream : MemoryStream {
+            public int FailEvery;
+            public int FailAfter = -1;
+            private int _writes;
+            public override void Write(byte[] buffer, int offset, int count) {
+                if (FailEvery > 0 && ++_writes % FailEvery == 0) throw new IOException("Simulated transient failure");
+                if (FailAfter >= 0 && FailAfter-- == 0) throw new IOException("Simulated failure");
+                base.Write(buffer, offset, count);
+            }
+        }
+
+        /// <summary>
+        /// Source stream that throws an IOException once it has been read from `failAfterReads` times
+        /// </summary>
+        private class FailingSource : MemoryStream {
+            private int _reads;
+            public FailingSource(byte[] data, int failAfterReads) : base(data, false) { _reads = failAfterReads; }
+            public override int Read(byte[] buffer, int offset, int count) {
+                if (_reads-- <= 0) throw new IOException("Simulated read failure");
+                return base.Read(buffer, offset, count);
+            }
+        }
+
+        private class RecordingTracer : ITracer {
+            public readonly List<string> Spans = new List<string>();
+            public Action<string> OnStart;
+            public ISpan StartSpan(string operationName) { OnStart?.Invoke(operationName); return new Span(this, operationName); }
+
+            private class Span : ISpan {
+                private readonly RecordingTracer _parent;
+                private readonly StringBuilder _sb;
+                public Span(RecordingTracer parent, string name) { _parent = parent; _sb = new StringBuilder(name); }
+                public void SetAttribute(string key, object value) { _sb.Append($" {key}={value}"); }
+                public void Dispose() { _parent.Spans.Add(_sb.ToString()); }
+            }
+        }
+    }
 }
\ No newline at end of file
@@ -0,0 +1,55 @@
+﻿using System;
+using System.Collections.Generic;
+using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Kinds of access that can be granted on a document
+    /// </summary>
+    [Flags]
+    public enum AccessRights : byte
+    {
+        /// <summary> No access </summary>
+        None = 0,
+
+        /// <summary> The document can be read </summary>
+        Read = 1,
+
+        /// <summary> The document can be replaced, unbound or deleted </summary>
+        Write = 2,
+
+        /// <summary> The document's access control can be changed </summary>
+        Admin = 4,
+
+        /// <summary> All rights </summary>
+        All = Read | Write | Admin
+    }
+
+    /// <summary>
+    /// Owner and access grants stored for a single document. See `Database.SetAccessControl`.
+    /// The database only stores this; an `IAuthorizer` decides what it means.
+    /// </summary>
+    public class AccessControl
+    {
+        /// <summary>
+        /// Principal that owns the document, if any
+        /// </summary>
+        public string? Owner { get; set; }
+
+        /// <summary>
+        /// Rights granted to principals other than the owner, by principal name
+        /// </summary>
+        [NotNull] public Dictionary<string, AccessRights> Grants { get; set; } = new Dictionary<string, AccessRights>();
+
+        /// <summary>
+        /// Rights granted to a principal, including ownership. Returns `None` if the principal has no grant.
+        /// </summary>
+        public AccessRights RightsOf(string? principal)
+        {
+            if (principal == null) return AccessRights.None;
+            if (principal == Owner) return AccessRights.All;
+            return Grants.TryGetValue(principal, out var rights) ? rights : AccessRights.None;
+        }
+    }
+}
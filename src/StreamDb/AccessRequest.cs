@@ -0,0 +1,30 @@
+﻿using System;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// An operation the database is about to carry out on behalf of a caller. See `IAuthorizer`
+    /// </summary>
+    public class AccessRequest
+    {
+        /// <summary>
+        /// The rights the operation needs
+        /// </summary>
+        public AccessRights Rights { get; set; }
+
+        /// <summary>
+        /// Path given by the caller, if the operation was made by path
+        /// </summary>
+        public string? Path { get; set; }
+
+        /// <summary>
+        /// Document the operation applies to, or `Guid.Empty` if a new document is being written to an unbound path
+        /// </summary>
+        public Guid DocumentId { get; set; }
+
+        /// <summary>
+        /// Access control stored for the document, or null if none has been set
+        /// </summary>
+        public AccessControl? Control { get; set; }
+    }
+}
@@ -0,0 +1,76 @@
+﻿using System;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Kinds of change recorded in the audit log
+    /// </summary>
+    public enum AuditOperation : byte
+    {
+        /// <summary> A document was written and bound to a path </summary>
+        WriteDocument = 1,
+        /// <summary> An existing document was bound to an additional path </summary>
+        BindPath = 2,
+        /// <summary> A single path binding was removed </summary>
+        UnbindPath = 3,
+        /// <summary> A document and all its paths were deleted </summary>
+        DeleteDocument = 4,
+        /// <summary> A path was moved to the trash </summary>
+        SoftDelete = 5,
+        /// <summary> A path was restored from the trash </summary>
+        Undelete = 6,
+        /// <summary> Trash entries were purged. Size is the number of entries removed </summary>
+        PurgeTrash = 7,
+        /// <summary> Paths were moved from one prefix to another. Size is the number of paths moved </summary>
+        RenamePrefix = 8,
+        /// <summary> A multi-part upload was completed </summary>
+        CompleteUpload = 9,
+        /// <summary> A document was pinned </summary>
+        Pin = 10,
+        /// <summary> A document was unpinned </summary>
+        Unpin = 11,
+        /// <summary> A document's data was moved to cold storage </summary>
+        Demote = 12,
+        /// <summary> A document's data was moved back to the main storage </summary>
+        Promote = 13
+    }
+
+    /// <summary>
+    /// A single entry in the audit log
+    /// </summary>
+    public class AuditRecord
+    {
+        /// <summary>
+        /// Time of the change (UTC)
+        /// </summary>
+        public DateTime Timestamp { get; set; }
+
+        /// <summary>
+        /// What kind of change was made
+        /// </summary>
+        public AuditOperation Operation { get; set; }
+
+        /// <summary>
+        /// Document affected, or `Guid.Empty` if not applicable
+        /// </summary>
+        public Guid DocumentId { get; set; }
+
+        /// <summary>
+        /// Path affected, if any. For `RenamePrefix`, this is "old prefix -> new prefix"
+        /// </summary>
+        public string? Path { get; set; }
+
+        /// <summary>
+        /// Data size in bytes, or a count for bulk operations. Zero if not applicable.
+        /// </summary>
+        public long Size { get; set; }
+
+        /// <summary>
+        /// Position of the entry in the audit log, starting at zero. This is not stored, but counted as the log is read.
+        /// </summary>
+        public long Sequence { get; set; }
+
+        /// <inheritdoc />
+        public override string ToString() => $"{Timestamp:O} {Operation} {Path} {DocumentId} {Size}";
+    }
+}
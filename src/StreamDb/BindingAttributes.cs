@@ -0,0 +1,23 @@
+﻿using System;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Attribute bits stored with a path binding
+    /// </summary>
+    [Flags]
+    public enum BindingAttributes : byte
+    {
+        /// <summary> A normal binding </summary>
+        None = 0,
+
+        /// <summary> Left out of `Search`, `ListPaths` and `DeletePrefix` unless hidden paths are asked for </summary>
+        Hidden = 1,
+
+        /// <summary> Bound by the engine, or by an application for its own state. Treated as hidden </summary>
+        System = 2,
+
+        /// <summary> The binding can't be replaced, unbound or deleted until the attribute is cleared with `Database.SetAttributes` </summary>
+        Immutable = 4
+    }
+}
@@ -0,0 +1,41 @@
+﻿using System;
+using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Details of a single path binding
+    /// </summary>
+    public class BindingInfo
+    {
+        /// <summary>
+        /// The bound path
+        /// </summary>
+        [NotNull] public string Path { get; set; } = "";
+
+        /// <summary>
+        /// ID of the document bound to the path
+        /// </summary>
+        public Guid DocumentId { get; set; }
+
+        /// <summary>
+        /// Time the binding was made (UTC). Null if the time was not recorded.
+        /// </summary>
+        public DateTime? BoundAt { get; set; }
+
+        /// <summary>
+        /// Note supplied by the caller when binding, if any
+        /// </summary>
+        public string? Annotation { get; set; }
+
+        /// <summary>
+        /// Attribute bits of the binding
+        /// </summary>
+        public BindingAttributes Attributes { get; set; }
+
+        /// <summary>
+        /// True if the binding should be left out of normal listings
+        /// </summary>
+        public bool IsHidden => (Attributes & (BindingAttributes.Hidden | BindingAttributes.System)) != 0;
+    }
+}
@@ -0,0 +1,39 @@
+﻿namespace StreamDb
+{
+    /// <summary>
+    /// Write counts for a `BlockDeviceStream`, for judging flash wear
+    /// </summary>
+    public class BlockDeviceStats
+    {
+        /// <summary>
+        /// Bytes written by the database
+        /// </summary>
+        public long LogicalBytesWritten { get; set; }
+
+        /// <summary>
+        /// Bytes written to the device, including header slot copies
+        /// </summary>
+        public long PhysicalBytesWritten { get; set; }
+
+        /// <summary>
+        /// Number of erase blocks touched by writes. A block written twice counts twice.
+        /// </summary>
+        public long EraseBlockWrites { get; set; }
+
+        /// <summary>
+        /// Number of times a header slot was written
+        /// </summary>
+        public long HeaderWrites { get; set; }
+
+        /// <summary>
+        /// Physical bytes written for each logical byte. 1.0 is ideal.
+        /// </summary>
+        public double WriteAmplification => LogicalBytesWritten == 0 ? 0 : (double)PhysicalBytesWritten / LogicalBytesWritten;
+
+        /// <inheritdoc />
+        public override string ToString()
+        {
+            return $"{LogicalBytesWritten} bytes written; {PhysicalBytesWritten} bytes to device ({WriteAmplification:0.00}x); {EraseBlockWrites} erase block writes; {HeaderWrites} header writes";
+        }
+    }
+}
@@ -0,0 +1,311 @@
+﻿using System;
+using System.IO;
+using JetBrains.Annotations;
+using StreamDb.Internal.Core;
+using StreamDb.Internal.DbStructure;
+using StreamDb.Internal.Support;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Presents a raw block device or flash partition as database storage.
+    /// Pass this to `Database.TryConnect` in place of a file stream.
+    /// <para></para>
+    /// Pages are placed so that each one starts on a page boundary inside an erase block, rather than
+    /// straddling two erase blocks. The storage header, which is rewritten on every change, is rotated
+    /// across several slots in their own erase blocks, so no single block takes all the header wear.
+    /// Write counts are available from `Stats`.
+    /// </summary>
+    public class BlockDeviceStream : Stream
+    {
+        /*
+
+            Device layout:
+            [ Header slot 0 (erase block) | Header slot 1 (erase block) | ... | Pages from here (erase block aligned) ... ]
+
+            Header slot:
+            [ Magic (int32) | Sequence (int64) | Data length (int64) | Storage header (HEADER_SIZE bytes) | CRC32 of preceding (uint32) ]
+
+            The slot with the highest sequence and a valid CRC is current. Each header change is written to the next slot in turn.
+            Data length is the logical size of the page area, as the device itself may be a fixed size.
+
+        */
+
+        private const int SlotMagic = 0x53444248; // "SDBH"
+        private const int SlotSize = 4 + 8 + 8 + PageStorage.HEADER_SIZE + 4;
+
+        [NotNull] private readonly Stream _device;
+        [NotNull] private readonly object _lock = new object();
+        [NotNull] private readonly byte[] _header = new byte[PageStorage.HEADER_SIZE];
+        private readonly int _eraseBlockSize;
+        private readonly int _headerSlots;
+        private readonly long _dataStart;
+
+        private bool _hasHeader;
+        private long _sequence;
+        private int _nextSlot;
+        private long _dataLength;
+        private bool _lengthDirty;
+        private long _position;
+        [NotNull] private readonly BlockDeviceStats _stats = new BlockDeviceStats();
+
+        /// <summary>
+        /// Wrap a device stream.
+        /// </summary>
+        /// <param name="device">Readable, writable and seekable stream over the raw device</param>
+        /// <param name="eraseBlockSize">Erase block size of the device. Must be a multiple of the page size (4096 bytes)</param>
+        /// <param name="headerSlots">Number of erase blocks the header is rotated across</param>
+        public BlockDeviceStream([NotNull]Stream device, int eraseBlockSize = 64 * 1024, int headerSlots = 4)
+        {
+            _device = device ?? throw new ArgumentNullException(nameof(device));
+            if (!device.CanRead || !device.CanWrite || !device.CanSeek) throw new Exception("Block device stream must be readable, writable and seekable");
+            if (eraseBlockSize < BasicPage.PageRawSize || eraseBlockSize % BasicPage.PageRawSize != 0) throw new ArgumentOutOfRangeException(nameof(eraseBlockSize), $"Erase block size must be a multiple of {BasicPage.PageRawSize}");
+            if (headerSlots < 1) throw new ArgumentOutOfRangeException(nameof(headerSlots), "At least one header slot is needed");
+
+            _eraseBlockSize = eraseBlockSize;
+            _headerSlots = headerSlots;
+            _dataStart = (long)eraseBlockSize * headerSlots;
+            LoadHeader();
+        }
+
+        /// <summary>
+        /// Device offset where the page area starts
+        /// </summary>
+        public long DataStart => _dataStart;
+
+        /// <summary>
+        /// A copy of the write counts so far
+        /// </summary>
+        [NotNull]public BlockDeviceStats Stats
+        {
+            get
+            {
+                lock (_lock)
+                {
+                    return new BlockDeviceStats {
+                        LogicalBytesWritten = _stats.LogicalBytesWritten,
+                        PhysicalBytesWritten = _stats.PhysicalBytesWritten,
+                        EraseBlockWrites = _stats.EraseBlockWrites,
+                        HeaderWrites = _stats.HeaderWrites
+                    };
+                }
+            }
+        }
+
+        private void LoadHeader()
+        {
+            var best = -1;
+            for (int slot = 0; slot < _headerSlots; slot++)
+            {
+                var offset = (long)slot * _eraseBlockSize;
+                if (_device.Length < offset + SlotSize) continue;
+
+                var buffer = new byte[SlotSize];
+                _device.Seek(offset, SeekOrigin.Begin);
+                if (ReadFully(_device, buffer) < SlotSize) continue;
+
+                var r = new BinaryReader(new MemoryStream(buffer));
+                if (r.ReadInt32() != SlotMagic) continue;
+                var sequence = r.ReadInt64();
+                var dataLength = r.ReadInt64();
+                var header = r.ReadBytes(PageStorage.HEADER_SIZE);
+                var crc = r.ReadUInt32();
+                if (crc != SlotCrc(buffer)) continue; // torn write; an older slot will do
+                if (best >= 0 && sequence <= _sequence) continue;
+
+                best = slot;
+                _sequence = sequence;
+                _dataLength = dataLength;
+                header.CopyTo(_header, 0);
+            }
+
+            _hasHeader = best >= 0;
+            _nextSlot = (best + 1) % _headerSlots;
+        }
+
+        private void WriteHeaderSlot()
+        {
+            _sequence++;
+            var ms = new MemoryStream(SlotSize);
+            var w = new BinaryWriter(ms);
+            w.Write(SlotMagic);
+            w.Write(_sequence);
+            w.Write(_dataLength);
+            w.Write(_header);
+            w.Write(0u);
+            var buffer = ms.ToArray();
+            var crc = BitConverter.GetBytes(SlotCrc(buffer));
+            Array.Copy(crc, 0, buffer, SlotSize - 4, 4);
+
+            WritePhysical((long)_nextSlot * _eraseBlockSize, buffer, 0, SlotSize);
+            _nextSlot = (_nextSlot + 1) % _headerSlots;
+            _hasHeader = true;
+            _lengthDirty = false;
+            _stats.HeaderWrites++;
+        }
+
+        private static uint SlotCrc([NotNull]byte[] slot)
+        {
+            var body = new byte[SlotSize - 4];
+            Array.Copy(slot, body, body.Length);
+            return Crc32.Compute(body);
+        }
+
+        private void WritePhysical(long offset, [NotNull]byte[] buffer, int index, int count)
+        {
+            _device.Seek(offset, SeekOrigin.Begin);
+            _device.Write(buffer, index, count);
+
+            _stats.PhysicalBytesWritten += count;
+            _stats.EraseBlockWrites += ((offset + count - 1) / _eraseBlockSize) - (offset / _eraseBlockSize) + 1;
+        }
+
+        private static int ReadFully([NotNull]Stream source, [NotNull]byte[] buffer)
+        {
+            var total = 0;
+            while (total < buffer.Length)
+            {
+                var read = source.Read(buffer, total, buffer.Length - total);
+                if (read < 1) break;
+                total += read;
+            }
+            return total;
+        }
+
+        /// <inheritdoc />
+        public override int Read(byte[] buffer, int offset, int count)
+        {
+            if (buffer == null) throw new ArgumentNullException(nameof(buffer));
+            lock (_lock)
+            {
+                var available = (int)Math.Max(0, Math.Min(count, Length - _position));
+                var done = 0;
+
+                // header part
+                while (done < available && _position < PageStorage.HEADER_SIZE)
+                {
+                    buffer[offset + done] = _header[_position];
+                    done++;
+                    _position++;
+                }
+
+                // page part
+                while (done < available)
+                {
+                    _device.Seek(_dataStart + _position - PageStorage.HEADER_SIZE, SeekOrigin.Begin);
+                    var read = _device.Read(buffer, offset + done, available - done);
+                    if (read < 1) break;
+                    done += read;
+                    _position += read;
+                }
+                return done;
+            }
+        }
+
+        /// <inheritdoc />
+        public override void Write(byte[] buffer, int offset, int count)
+        {
+            if (buffer == null) throw new ArgumentNullException(nameof(buffer));
+            lock (_lock)
+            {
+                _stats.LogicalBytesWritten += count;
+                var done = 0;
+
+                // header part: update the in-memory copy, then write a whole new slot
+                var headerChanged = false;
+                while (done < count && _position < PageStorage.HEADER_SIZE)
+                {
+                    _header[_position] = buffer[offset + done];
+                    done++;
+                    _position++;
+                    headerChanged = true;
+                }
+
+                // page part
+                if (done < count)
+                {
+                    WritePhysical(_dataStart + _position - PageStorage.HEADER_SIZE, buffer, offset + done, count - done);
+                    _position += count - done;
+                    var dataEnd = _position - PageStorage.HEADER_SIZE;
+                    if (dataEnd > _dataLength)
+                    {
+                        _dataLength = dataEnd;
+                        _lengthDirty = true;
+                    }
+                }
+
+                if (headerChanged) WriteHeaderSlot();
+            }
+        }
+
+        /// <summary>
+        /// Write the header slot if the data length has changed, then flush the device
+        /// </summary>
+        public override void Flush()
+        {
+            lock (_lock)
+            {
+                if (_lengthDirty && _hasHeader) WriteHeaderSlot();
+                _device.Flush();
+            }
+        }
+
+        /// <inheritdoc />
+        public override long Seek(long offset, SeekOrigin origin)
+        {
+            lock (_lock)
+            {
+                switch (origin)
+                {
+                    case SeekOrigin.Begin: _position = offset; break;
+                    case SeekOrigin.Current: _position += offset; break;
+                    case SeekOrigin.End: _position = Length + offset; break;
+                    default: throw new Exception("Non exhaustive switch");
+                }
+                if (_position < 0) throw new IOException("Seek before start of storage");
+                return _position;
+            }
+        }
+
+        /// <inheritdoc />
+        public override void SetLength(long value) { throw new NotSupportedException("Block device storage can't be resized"); }
+
+        /// <inheritdoc />
+        public override bool CanRead => true;
+
+        /// <inheritdoc />
+        public override bool CanSeek => true;
+
+        /// <inheritdoc />
+        public override bool CanWrite => true;
+
+        /// <summary>
+        /// Logical length of the storage: the header plus the used page area. Zero for a blank device.
+        /// </summary>
+        public override long Length
+        {
+            get
+            {
+                lock (_lock) { return _hasHeader ? PageStorage.HEADER_SIZE + _dataLength : 0; }
+            }
+        }
+
+        /// <inheritdoc />
+        public override long Position
+        {
+            get { lock (_lock) { return _position; } }
+            set { Seek(value, SeekOrigin.Begin); }
+        }
+
+        /// <inheritdoc />
+        protected override void Dispose(bool disposing)
+        {
+            if (disposing)
+            {
+                Flush();
+                _device.Dispose();
+            }
+            base.Dispose(disposing);
+        }
+    }
+}
@@ -0,0 +1,39 @@
+﻿using System;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Thrown when a page chain can't be walked safely: either it links back on itself,
+    /// or it is longer than the configured maximum chain length.
+    /// Either case indicates storage damage.
+    /// </summary>
+    public class ChainException : Exception
+    {
+        /// <summary>
+        /// Page ID the walk started from (the end of the chain)
+        /// </summary>
+        public int RootPageId { get; }
+
+        /// <summary>
+        /// Number of distinct pages visited before the problem was found
+        /// </summary>
+        public int PagesVisited { get; }
+
+        /// <summary>
+        /// The page that was reached a second time, or -1 if the chain was too long rather than looped
+        /// </summary>
+        public int LoopEntryPageId { get; }
+
+        /// <summary>
+        /// True if the chain links back on itself
+        /// </summary>
+        public bool IsLoop => LoopEntryPageId >= 0;
+
+        public ChainException(int rootPageId, int pagesVisited, int loopEntryPageId, string message) : base(message)
+        {
+            RootPageId = rootPageId;
+            PagesVisited = pagesVisited;
+            LoopEntryPageId = loopEntryPageId;
+        }
+    }
+}
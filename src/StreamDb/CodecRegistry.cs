@@ -0,0 +1,73 @@
+﻿using System;
+using System.Collections.Generic;
+using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Maps schema IDs and value types to codecs. Each schema ID and each type can only be registered once.
+    /// </summary>
+    public class CodecRegistry
+    {
+        /// <summary>
+        /// Prefix used by earlier versions to store the schema ID in a path binding's annotation.
+        /// Schema IDs are now stored with the document, but annotations with this prefix are still read.
+        /// </summary>
+        public const string SchemaAnnotationPrefix = "schema:";
+
+        [NotNull] private readonly Dictionary<string, ICodec> _bySchema = new Dictionary<string, ICodec>();
+        [NotNull] private readonly Dictionary<Type, ICodec> _byType = new Dictionary<Type, ICodec>();
+
+        /// <summary>
+        /// Add a codec. Throws if its schema ID or value type is already registered.
+        /// </summary>
+        public CodecRegistry Register(ICodec codec)
+        {
+            if (codec == null) throw new ArgumentNullException(nameof(codec));
+            if (string.IsNullOrEmpty(codec.SchemaId)) throw new Exception("Codec schema ID must not be empty");
+
+            lock (_bySchema)
+            {
+                if (_bySchema.ContainsKey(codec.SchemaId)) throw new Exception($"Schema {codec.SchemaId} is already registered");
+                if (_byType.ContainsKey(codec.ValueType)) throw new Exception($"A codec for {codec.ValueType.Name} is already registered");
+
+                _bySchema.Add(codec.SchemaId, codec);
+                _byType.Add(codec.ValueType, codec);
+            }
+            return this;
+        }
+
+        /// <summary>
+        /// Find the codec for a schema ID
+        /// </summary>
+        public bool TryGetBySchema(string? schemaId, out ICodec? codec)
+        {
+            codec = null;
+            if (schemaId == null) return false;
+            lock (_bySchema) { return _bySchema.TryGetValue(schemaId, out codec); }
+        }
+
+        /// <summary>
+        /// Find the codec for a value type. Throws if none is registered.
+        /// </summary>
+        [NotNull]public ICodec ForType([NotNull]Type type)
+        {
+            lock (_bySchema)
+            {
+                if (_byType.TryGetValue(type, out var codec) && codec != null) return codec;
+            }
+            throw new Exception($"No codec is registered for {type.Name}");
+        }
+
+        /// <summary>
+        /// Read the schema ID from a binding annotation, as written by earlier versions, or null if there is none.
+        /// Use `Database.GetSchemaId` to find the schema ID of any document
+        /// </summary>
+        public static string? SchemaOf(BindingInfo? binding)
+        {
+            var note = binding?.Annotation;
+            if (note == null || !note.StartsWith(SchemaAnnotationPrefix, StringComparison.Ordinal)) return null;
+            return note.Substring(SchemaAnnotationPrefix.Length);
+        }
+    }
+}
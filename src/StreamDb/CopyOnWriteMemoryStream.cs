@@ -0,0 +1,337 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using System.Threading;
+using JetBrains.Annotations;
+using StreamDb.Internal.Core;
+using StreamDb.Internal.DbStructure;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// In-memory storage that can be forked cheaply. Pass this to `Database.TryConnect` in place of a `MemoryStream`,
+    /// then use `Database.ForkInMemory` (or `Fork` here) to make isolated writable copies.
+    /// <para></para>
+    /// Data is held in blocks lined up with database pages: the first block holds the storage header, and each block
+    /// after it holds exactly one page. A fork shares every block with its source, and each side copies a block only
+    /// when it first writes to it, so forking a large seeded store costs little time or memory.
+    /// Once a fork is disposed, the blocks only its source still uses are folded back into the source.
+    /// All members are thread safe.
+    /// </summary>
+    public class CopyOnWriteMemoryStream : Stream
+    {
+        /// <summary>
+        /// Size of the blocks that are shared and copied
+        /// </summary>
+        public const int BlockSize = BasicPage.PageRawSize;
+
+        /// <summary>
+        /// Size of the first block, which holds the storage header. Pages start after this,
+        /// so writing one page only ever copies one block.
+        /// </summary>
+        public const int HeaderBlockSize = PageStorage.HEADER_SIZE;
+
+        /// <summary>
+        /// Blocks frozen by a fork. These are never changed again, and may be shared by any number of streams.
+        /// A null block is a hole, which reads as zeros.
+        /// </summary>
+        private class Layer
+        {
+            public readonly Layer? Below;
+            [NotNull] public readonly Dictionary<long, byte[]?> Blocks;
+            public int Users = 1; // streams and layers that read through this one
+            public Layer(Layer? below, [NotNull]Dictionary<long, byte[]?> blocks) { Below = below; Blocks = blocks; }
+        }
+
+        [NotNull] private readonly object _lock = new object();
+        private Layer? _shared;
+        [NotNull] private Dictionary<long, byte[]?> _own = new Dictionary<long, byte[]?>(); // blocks written since the last fork
+        private long _length;
+        private long _position;
+        private bool _disposed;
+
+        /// <summary>
+        /// Create a new empty stream
+        /// </summary>
+        public CopyOnWriteMemoryStream() { }
+
+        private CopyOnWriteMemoryStream(Layer? shared, long length)
+        {
+            _shared = shared;
+            _length = length;
+        }
+
+        /// <summary>
+        /// Make an isolated copy of the stream's current contents. Writes to either stream are not seen by the other.
+        /// The copy starts at position zero.
+        /// </summary>
+        [NotNull]public CopyOnWriteMemoryStream Fork()
+        {
+            lock (_lock)
+            {
+                CheckNotDisposed();
+                Collapse();
+
+                // Freeze our own blocks, so both sides share them from here on.
+                // The new layer takes over our reference to the old top layer.
+                if (_own.Count > 0)
+                {
+                    _shared = new Layer(_shared, _own);
+                    _own = new Dictionary<long, byte[]?>();
+                }
+                if (_shared != null) Interlocked.Increment(ref _shared.Users);
+                return new CopyOnWriteMemoryStream(_shared, _length);
+            }
+        }
+
+        /// <summary>
+        /// Number of blocks this stream holds its own copy of. Blocks shared with forks are not counted.
+        /// </summary>
+        public int UnsharedBlocks { get { lock (_lock) { return _own.Count; } } }
+
+        /// <summary>
+        /// Number of frozen layers this stream reads through. Layers no other stream uses any more
+        /// are folded back into this stream's own blocks on its next read, write or fork.
+        /// </summary>
+        public int SharedLayers
+        {
+            get
+            {
+                lock (_lock)
+                {
+                    var count = 0;
+                    for (var layer = _shared; layer != null; layer = layer.Below) count++;
+                    return count;
+                }
+            }
+        }
+
+        /// <inheritdoc />
+        public override int Read(byte[] buffer, int offset, int count)
+        {
+            if (buffer == null) throw new ArgumentNullException(nameof(buffer));
+            if (offset < 0 || count < 0 || offset + count > buffer.Length) throw new ArgumentOutOfRangeException(nameof(count), "Read is outside the buffer");
+
+            lock (_lock)
+            {
+                CheckNotDisposed();
+                Collapse();
+
+                var available = (int)Math.Max(0, Math.Min(count, _length - _position));
+                var done = 0;
+                while (done < available)
+                {
+                    var blockIdx = BlockIndex(_position);
+                    var blockOffset = (int)(_position - BlockStart(blockIdx));
+                    var chunk = Math.Min(available - done, BlockLength(blockIdx) - blockOffset);
+
+                    var block = FindBlock(blockIdx);
+                    if (block == null) Array.Clear(buffer, offset + done, chunk);
+                    else Buffer.BlockCopy(block, blockOffset, buffer, offset + done, chunk);
+
+                    done += chunk;
+                    _position += chunk;
+                }
+                return done;
+            }
+        }
+
+        /// <inheritdoc />
+        public override void Write(byte[] buffer, int offset, int count)
+        {
+            if (buffer == null) throw new ArgumentNullException(nameof(buffer));
+            if (offset < 0 || count < 0 || offset + count > buffer.Length) throw new ArgumentOutOfRangeException(nameof(count), "Write is outside the buffer");
+
+            lock (_lock)
+            {
+                CheckNotDisposed();
+                Collapse();
+
+                var done = 0;
+                while (done < count)
+                {
+                    var blockIdx = BlockIndex(_position);
+                    var blockOffset = (int)(_position - BlockStart(blockIdx));
+                    var chunk = Math.Min(count - done, BlockLength(blockIdx) - blockOffset);
+
+                    Buffer.BlockCopy(buffer, offset + done, OwnBlock(blockIdx), blockOffset, chunk);
+
+                    done += chunk;
+                    _position += chunk;
+                }
+                _length = Math.Max(_length, _position);
+            }
+        }
+
+        /// <inheritdoc />
+        public override void SetLength(long value)
+        {
+            if (value < 0) throw new ArgumentOutOfRangeException(nameof(value), "Stream length must not be negative");
+            lock (_lock)
+            {
+                CheckNotDisposed();
+                if (value < _length)
+                {
+                    // Data past the end must read as zeros if the stream grows again
+                    var firstWhole = BlockIndex(value);
+                    var partial = (int)(value - BlockStart(firstWhole));
+                    if (partial > 0)
+                    {
+                        var block = FindBlock(firstWhole);
+                        if (block != null) Array.Clear(OwnBlock(firstWhole), partial, BlockLength(firstWhole) - partial);
+                        firstWhole++;
+                    }
+                    var lastBlock = BlockIndex(_length - 1);
+                    for (var i = firstWhole; i <= lastBlock; i++)
+                    {
+                        if (FindBlock(i) != null) _own[i] = null;
+                    }
+                }
+                _length = value;
+            }
+        }
+
+        /// <summary>
+        /// Move the position. Seeking past the end is allowed, but seeking before the start throws `IOException`.
+        /// </summary>
+        public override long Seek(long offset, SeekOrigin origin)
+        {
+            lock (_lock)
+            {
+                long target;
+                switch (origin)
+                {
+                    case SeekOrigin.Begin: target = offset; break;
+                    case SeekOrigin.Current: target = _position + offset; break;
+                    case SeekOrigin.End: target = _length + offset; break;
+                    default: throw new ArgumentException($"Unknown seek origin {origin}", nameof(origin));
+                }
+                if (target < 0) throw new IOException($"Can't seek to {target}, which is before the start of the stream");
+                _position = target;
+                return _position;
+            }
+        }
+
+        /// <summary>
+        /// Index of the block holding a stream position
+        /// </summary>
+        private static long BlockIndex(long position) => position < HeaderBlockSize ? 0 : 1 + (position - HeaderBlockSize) / BlockSize;
+
+        /// <summary>
+        /// Stream position of the first byte in a block
+        /// </summary>
+        private static long BlockStart(long blockIdx) => blockIdx == 0 ? 0 : HeaderBlockSize + (blockIdx - 1) * BlockSize;
+
+        /// <summary>
+        /// Number of bytes in a block
+        /// </summary>
+        private static int BlockLength(long blockIdx) => blockIdx == 0 ? HeaderBlockSize : BlockSize;
+
+        /// <summary>
+        /// Fold shared layers that no other stream reads through any more into our own blocks.
+        /// Without this, a stream that is forked repeatedly reads through an ever longer chain of layers,
+        /// and keeps copying blocks that nothing else can see.
+        /// </summary>
+        private void Collapse()
+        {
+            // Only this stream (or a layer it has already folded) refers to a layer with one user,
+            // and new users are only added by forking this stream, so the count can't change under us.
+            while (_shared != null && Volatile.Read(ref _shared.Users) == 1)
+            {
+                foreach (var pair in _shared.Blocks)
+                {
+                    if (!_own.ContainsKey(pair.Key)) _own.Add(pair.Key, pair.Value);
+                }
+                _shared = _shared.Below; // we take over the folded layer's reference to the one below
+            }
+        }
+
+        /// <summary>
+        /// Drop one reference to a layer. Layers with no users left drop their reference to the layer below,
+        /// so the remaining user of that layer can fold it in.
+        /// </summary>
+        private static void Release(Layer? layer)
+        {
+            while (layer != null && Interlocked.Decrement(ref layer.Users) == 0) layer = layer.Below;
+        }
+
+        private void CheckNotDisposed()
+        {
+            if (_disposed) throw new ObjectDisposedException(nameof(CopyOnWriteMemoryStream));
+        }
+
+        /// <summary>
+        /// Find the current content of a block, or null if it has never been written
+        /// </summary>
+        private byte[]? FindBlock(long blockIdx)
+        {
+            if (_own.TryGetValue(blockIdx, out var block)) return block;
+            for (var layer = _shared; layer != null; layer = layer.Below)
+            {
+                if (layer.Blocks.TryGetValue(blockIdx, out block)) return block;
+            }
+            return null;
+        }
+
+        /// <summary>
+        /// Get a block this stream can write to, copying it out of the shared layers if needed
+        /// </summary>
+        [NotNull]private byte[] OwnBlock(long blockIdx)
+        {
+            if (_own.TryGetValue(blockIdx, out var own) && own != null) return own;
+
+            var result = new byte[BlockLength(blockIdx)];
+            var shared = FindBlock(blockIdx);
+            if (shared != null) Buffer.BlockCopy(shared, 0, result, 0, result.Length);
+            _own[blockIdx] = result;
+            return result;
+        }
+
+        /// <summary>
+        /// Release this stream's blocks. Layers it shared with forks stay alive for as long as those forks do.
+        /// </summary>
+        protected override void Dispose(bool disposing)
+        {
+            if (disposing)
+            {
+                lock (_lock)
+                {
+                    if (!_disposed)
+                    {
+                        _disposed = true;
+                        Release(_shared);
+                        _shared = null;
+                        _own = new Dictionary<long, byte[]?>();
+                    }
+                }
+            }
+            base.Dispose(disposing);
+        }
+
+        /// <inheritdoc />
+        public override void Flush() { }
+
+        /// <inheritdoc />
+        public override bool CanRead => !_disposed;
+
+        /// <inheritdoc />
+        public override bool CanSeek => !_disposed;
+
+        /// <inheritdoc />
+        public override bool CanWrite => !_disposed;
+
+        /// <inheritdoc />
+        public override long Length { get { lock (_lock) { return _length; } } }
+
+        /// <inheritdoc />
+        public override long Position
+        {
+            get { lock (_lock) { return _position; } }
+            set
+            {
+                if (value < 0) throw new ArgumentOutOfRangeException(nameof(value), "Stream position must not be negative");
+                lock (_lock) { _position = value; }
+            }
+        }
+    }
+}
@@ -0,0 +1,34 @@
+﻿namespace StreamDb
+{
+    /// <summary>
+    /// Counts of document page reads under CRC sampling. See `DatabaseOptions.CrcSampleRate`
+    /// </summary>
+    public class CrcSamplingStats
+    {
+        /// <summary>
+        /// Document data pages read since the database was opened
+        /// </summary>
+        public long PagesRead { get; set; }
+
+        /// <summary>
+        /// Document data pages whose CRC was checked
+        /// </summary>
+        public long PagesChecked { get; set; }
+
+        /// <summary>
+        /// Checked pages that failed their CRC check
+        /// </summary>
+        public long Failures { get; set; }
+
+        /// <summary>
+        /// Estimated number of unchecked pages that would have failed, assuming damage is spread evenly over reads
+        /// </summary>
+        public double EstimatedMissedFailures => PagesChecked == 0 ? 0 : (double)Failures * (PagesRead - PagesChecked) / PagesChecked;
+
+        /// <inheritdoc />
+        public override string ToString()
+        {
+            return $"{PagesRead} pages read; {PagesChecked} checked; {Failures} failed";
+        }
+    }
+}
@@ -1,218 +1,2512 @@
-﻿using System;
-using System.Collections.Generic;
-using System.IO;
-using System.Linq;
-using JetBrains.Annotations;
-using StreamDb.Internal.Core;
-using StreamDb.Internal.DbStructure;
-
-namespace StreamDb
-{
-    /// <summary>
-    /// This is the entry point to the data storage. Access the database through the methods here.
-    /// </summary>
-    /// <remarks>
-    /// The idea behind the DB is:
-    /// 1. All documents have a single unique DocID (guid). This is assigned by the DB engine.
-    /// 2. Each document may be connected to as many 'paths' as needed. These are arbitrary strings.
-    ///
-    /// The database is optimised for many more reads than writes, and rare deletes.
-    /// The upper limit of individual document size is determined by internal counters. Currently this is 256 MB.
-    /// The overall database storage limit is determined by pageID limit (2147483647) times page data capacity (4061 bytes); this is 8000 GB
-    ///
-    /// The database is designed to allow for rapid connect/disconnect cycles to support multiple access.
-    /// It should also be 100% thread safe within a single process.
-    /// </remarks>
-    public class Database : IDisposable
-    {
-        [NotNull]   private readonly Stream       _fs;
-        [NotNull]   private readonly IDatabaseBackend    _pages;
-
-        private Database(Stream fs)
-        {
-            _fs = fs ?? throw new ArgumentNullException(nameof(fs));
-            // ####### HERE #########
-            // Is where we pick the underlying engine.
-            _pages = new PageStorageBackend(_fs);
-        }
-
-        /// <summary>
-        /// Open a connection to a datastore by seekable stream.
-        /// Throws an exception if the stream does not support seeking and reading.
-        /// <para></para>
-        /// If an empty stream is provided (length == 0), it will be initialised. Otherwise it must be
-        /// a valid storage stream.
-        /// </summary>
-        public static Database TryConnect(Stream storage)
-        {
-            if (storage == null || !storage.CanSeek || !storage.CanRead) throw new ArgumentException("Storage stream must support seeking and reading", nameof(storage));
-
-            if (storage.Length == 0)
-            {
-                if (!storage.CanWrite) throw new ArgumentException("Attempted to initialise a read-only stream", nameof(storage));
-                storage.Seek(0, SeekOrigin.Begin);
-            }
-
-            return new Database(storage);
-        }
-
-        /// <summary>
-        /// Flush, close and dispose of the underlying stream.
-        /// </summary>
-        public void Dispose() { _fs.Flush(); _fs.Dispose(); }
-
-        [NotNull]private readonly object _pathWriteLock = new object();
-
-        /// <summary>
-        /// Write a document to the given path. If an existing document uses this path, it will be deleted.
-        /// </summary>
-        /// <param name="path">Path that can be used with `Get` and `Search` operations to recover this document</param>
-        /// <param name="data">Stream containing document data. It will be read from current position to end.</param>
-        public Guid WriteDocument(string path, Stream? data)
-        {
-            if (data == null) throw new ArgumentNullException(nameof(data));
-            var id = _pages.WriteDocument(data);
-            if (id == Guid.Empty) throw new Exception("Failed to write document data");
-
-            var oldId = _pages.BindPathToDocument(path, id);
-
-            if (oldId != Guid.Empty && oldId != id)
-            {
-                var others = _pages.ListPathsForDocument(oldId).Any();
-                if (!others) _pages.DeleteDocument(oldId);
-            }
-            return id;
-        }
-
-        /// <summary>
-        /// Read a document at the given path.
-        /// Returns true if found, false if not found.
-        /// </summary>
-        public bool Get(string path, out Stream? stream)
-        {
-            stream = null;
-
-            var id = _pages.GetDocumentIdByPath(path);
-            if (id == Guid.Empty) return false;
-
-            stream = _pages.ReadDocument(id);
-            return stream != null;
-        }
-
-        /// <summary>
-        /// Try to look up the document ID bound to a path.
-        /// </summary>
-        public bool GetIdByPath(string path, out Guid id) {
-            id = _pages.GetDocumentIdByPath(path);
-            return id != Guid.Empty;
-        }
-        
-
-        /// <summary>
-        /// Get a summary of the document at a given path
-        /// </summary>
-        public string GetDocumentInfo(string path)
-        {
-            var id = _pages.GetDocumentIdByPath(path);
-            return _pages.GetInfo(id);
-        }
-
-        /// <summary>
-        /// Add a new path binding to a document ID.
-        /// If the path is already bound to a document, the old document ID will be returned
-        /// </summary>
-        /// <param name="documentId">ID of an existing document (this is not checked)</param>
-        /// <param name="newPath">path that can be used for `Get` and `Search` operations</param>
-        public Guid BindToPath(Guid documentId, string newPath)
-        {
-            lock (_pathWriteLock)
-            {
-                return _pages.BindPathToDocument(newPath, documentId);
-            }
-        }
-
-        /// <summary>
-        /// For a given document ID, find all paths that are bound to it.
-        /// </summary>
-        /// <param name="documentId">A document stored in the database</param>
-        /// <returns>Enumeration of paths. This may not be multi-enumerable</returns>
-        [NotNull, ItemNotNull]
-        public IEnumerable<string> ListPaths(Guid documentId)
-        {
-            return _pages.ListPathsForDocument(documentId);
-        }
-
-        /// <summary>
-        /// Delete a document from the database, and unbind all paths to it.
-        /// If the document does not exist, the request will be silently ignored.
-        /// </summary>
-        /// <param name="documentId">Id of the document to delete.</param>
-        public void Delete(Guid documentId)
-        {
-            _pages.DeletePathsForDocument(documentId);
-            _pages.RemoveFromIndex(documentId);
-            _pages.DeleteDocument(documentId);
-        }
-        
-        /// <summary>
-        /// Delete a document from the database, and unbind all paths to it.
-        /// If the document does not exist, the request will be silently ignored.
-        /// </summary>
-        /// <param name="path">Any path that the document is bound to</param>
-        public void Delete(string path)
-        {
-            var id = _pages.GetDocumentIdByPath(path);
-            _pages.DeletePathsForDocument(id);
-            _pages.RemoveFromIndex(id);
-            _pages.DeleteDocument(id);
-        }
-
-        /// <summary>
-        /// Remove a single path binding for a document.
-        /// If the path is not currently bound to that document, the request will be silently ignored
-        /// </summary>
-        /// <param name="documentId">Id of document currently bound to the path</param>
-        /// <param name="path">Path to unbind</param>
-        public void UnbindPath(Guid documentId, string path)
-        {
-            _pages.DeleteSinglePathForDocument(documentId, path);
-        }
-
-        /// <summary>
-        /// Given the start of a path string, returns all matching paths that have a document bound to them
-        /// </summary>
-        /// <param name="pathPrefix">Start of a path string</param>
-        [NotNull, ItemNotNull]
-        public IEnumerable<string> Search(string pathPrefix)
-        {
-            return _pages.SearchPaths(pathPrefix);
-        }
-
-        /// <summary>
-        /// Scan the database for statistics.
-        /// </summary>
-        /// <param name="totalPages">The number of pages in storage (based on storage size)</param>
-        /// <param name="freePages">The number of free pages that can be written without increasing storage</param>
-        public void CalculateStatistics(out int totalPages, out int freePages)
-        {
-            totalPages = (int) (_fs.Length / BasicPage.PageRawSize);
-            freePages = _pages.CountFreePages();
-        }
-
-        /// <summary>
-        /// Attempt to synchronously flush the underlying storage
-        /// </summary>
-        public void Flush()
-        {
-            _fs.Flush();
-        }
-
-        /// <summary>
-        /// If you call this method, CRC checks will be ignored on READ (still calculated for WRITE).
-        /// This makes read-heavy workloads about 10x faster, but data corruption will go unreported. 
-        /// </summary>
-        public static void SetQuickAndDirtyMode() {
-            BasicPage.QuickAndDirtyMode = true;
-        }
-    }
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using System.Linq;
+using System.Globalization;
+using System.Security.Cryptography;
+using System.Text;
+using System.Threading;
+using System.Threading.Tasks;
+using JetBrains.Annotations;
+using StreamDb.Internal.Core;
+using StreamDb.Internal.DbStructure;
+using StreamDb.Internal.Support;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// This is the entry point to the data storage. Access the database through the methods here.
+    /// </summary>
+    /// <remarks>
+    /// The idea behind the DB is:
+    /// 1. All documents have a single unique DocID (guid). This is assigned by the DB engine.
+    /// 2. Each document may be connected to as many 'paths' as needed. These are arbitrary strings.
+    ///
+    /// The database is optimised for many more reads than writes, and rare deletes.
+    /// The upper limit of individual document size is determined by internal counters. Currently this is 256 MB.
+    /// The overall database storage limit is determined by pageID limit (2147483647) times page data capacity (4061 bytes); this is 8000 GB
+    ///
+    /// The database is designed to allow for rapid connect/disconnect cycles to support multiple access.
+    /// It should also be 100% thread safe within a single process.
+    /// </remarks>
+    public class Database : IDisposable
+    {
+        [NotNull]   private readonly Stream       _fs;
+        [NotNull]   private readonly IDatabaseBackend    _pages;
+                    private readonly TimeSpan?           _trashRetention;
+                    private readonly TimeSpan            _uploadExpiry;
+                    private readonly bool                _auditEnabled;
+        [NotNull]   private readonly CodecRegistry       _codecs;
+                    private readonly WriterLoop?         _writer;
+                    private readonly IAuthorizer?        _authorizer;
+                    private readonly bool                _canWrite;
+        [NotNull]   private readonly ILogger             _logger;
+        [NotNull]   private readonly StreamLimit         _streams;
+        [NotNull]   private          PathCollation       _collation = PathCollation.Ordinal;
+                    private          Timer?              _statsTimer;
+                    private          FileStream?         _ownedLog; // write-ahead log opened by `Open`
+
+        /// <summary>
+        /// Path prefix reserved for documents managed by the engine. User writes to these paths are rejected,
+        /// and they are left out of `Search` and `ListPaths` unless asked for. Use `SystemDocuments` to access them.
+        /// </summary>
+        public const string SystemNamespace = "/.streamdb/";
+
+        /// <summary>
+        /// Added to the storage file path by `Open` to name the write-ahead log file, if `DatabaseOptions.WriteAheadLog` is not given
+        /// </summary>
+        public const string WriteAheadLogSuffix = "-wal";
+
+        private Database(Stream fs, DatabaseOptions? options, IStorageEngine? engine = null)
+        {
+            _fs = fs ?? throw new ArgumentNullException(nameof(fs));
+            _trashRetention = options?.TrashRetention;
+            _uploadExpiry = options?.UploadExpiry ?? TimeSpan.FromDays(1);
+            _auditEnabled = options?.EnableAuditLog ?? false;
+            _codecs = options?.Codecs ?? new CodecRegistry();
+            _authorizer = options?.Authorizer;
+            _canWrite = options?.ReadReplica != true && (engine != null || fs.CanWrite);
+            _logger = options?.Logger ?? NullLogger.Instance;
+            _streams = new StreamLimit(options?.MaxOpenStreams, options?.OpenStreamWait, _logger);
+            SystemDocuments = new SystemDocuments(this);
+            // ####### HERE #########
+            // Is where we pick the underlying engine.
+            _pages = engine == null ? new PageStorageBackend(_fs, options) : new PageStorageBackend(engine, options);
+            if (options?.SingleWriter == true)
+            {
+                _writer = new WriterLoop(options.Logger ?? NullLogger.Instance);
+                _pages = new SingleWriterBackend(_pages, _writer);
+            }
+        }
+
+        /// <summary>
+        /// Open a connection to a datastore by seekable stream.
+        /// Throws an exception if the stream does not support seeking and reading.
+        /// <para></para>
+        /// If an empty stream is provided (length == 0), it will be initialised. Otherwise it must be
+        /// a valid storage stream.
+        /// <para></para>
+        /// For a large in-memory database, pass `new MemoryStream(capacity)` to reserve space up front.
+        /// Don't pass `new MemoryStream(byte[])` for an empty store: that stream wraps a fixed-size buffer and can't grow.
+        /// </summary>
+        /// <param name="storage">Seekable stream to use as storage</param>
+        /// <param name="options">Optional settings (logging, tracing). If null, defaults are used</param>
+        public static Database TryConnect(Stream storage, DatabaseOptions? options = null)
+        {
+            if (storage == null || !storage.CanSeek || !storage.CanRead) throw new ArgumentException("Storage stream must support seeking and reading", nameof(storage));
+
+            if (storage.Length == 0)
+            {
+                if (options?.ReadReplica == true) throw new ArgumentException("Replica storage is empty. The writer must create the database first", nameof(storage));
+                if (!storage.CanWrite) throw new ArgumentException("Attempted to initialise a read-only stream", nameof(storage));
+                storage.Seek(0, SeekOrigin.Begin);
+            }
+
+            var db = CheckCollation(CheckManifest(CheckRecovery(new Database(storage, options), options), options), options);
+            db.BindSystemRecords();
+            db.ReleaseTemps(); // left by a connection that did not close
+            db.StartStatsSnapshots(options?.StatsInterval);
+            return db;
+        }
+
+        /// <summary>
+        /// Open a database stored in a file, creating the file if it does not exist.
+        /// The connection owns the file, and closes it on `Close` or `Dispose` after a final flush through to disk.
+        /// While a writing connection is open, other processes can only open the file as a `DatabaseOptions.ReadReplica`.
+        /// <para></para>
+        /// If `DatabaseOptions.Sync` is not given, index, path and free list changes are flushed through to disk
+        /// (`SyncMode.Durable`) at the end of each operation. Document data is written before the index change that uses it,
+        /// so it reaches the disk with that change.
+        /// <para></para>
+        /// If `DatabaseOptions.WriteAheadLog` is not given, a writing connection keeps its write-ahead log in a file beside the
+        /// storage file (named with `WriteAheadLogSuffix`). The log is empty, and deleted, after a clean close. If a crash leaves
+        /// it behind, the next `Open` of the same path replays it.
+        /// </summary>
+        /// <param name="filePath">Path of the storage file</param>
+        /// <param name="options">Optional settings. If `ReadReplica` is set, the file must already exist and is opened read-only</param>
+        public static Database Open([NotNull]string filePath, DatabaseOptions? options = null)
+        {
+            if (string.IsNullOrEmpty(filePath)) throw new ArgumentException("A file path is required", nameof(filePath));
+
+            var replica = options?.ReadReplica == true;
+            if (options?.Sync == null)
+            {
+                options = options?.Copy() ?? new DatabaseOptions();
+                options.Sync = new SyncOptions { Index = SyncMode.Durable, Paths = SyncMode.Durable, FreeList = SyncMode.Durable };
+            }
+
+            var file = replica
+                ? new FileStream(filePath, FileMode.Open, FileAccess.Read, FileShare.ReadWrite)
+                : new FileStream(filePath, FileMode.OpenOrCreate, FileAccess.ReadWrite, FileShare.Read);
+            FileStream? log = null;
+            try
+            {
+                if (!replica && options?.WriteAheadLog == null)
+                {
+                    log = new FileStream(filePath + WriteAheadLogSuffix, FileMode.OpenOrCreate, FileAccess.ReadWrite, FileShare.None);
+                    options = options?.Copy() ?? new DatabaseOptions();
+                    options.WriteAheadLog = log;
+                }
+
+                var db = TryConnect(file, options);
+                db._ownedLog = log;
+                return db;
+            }
+            catch
+            {
+                file.Dispose();
+                log?.Dispose();
+                throw;
+            }
+        }
+
+        /// <summary>
+        /// Open a database over a storage engine other than the default page storage,
+        /// such as `MemoryStorageEngine` for fast tests of code that uses the database.
+        /// </summary>
+        /// <param name="engine">Storage engine to use</param>
+        /// <param name="options">Optional settings. Settings for the storage stream (such as cold storage) still apply</param>
+        public static Database ConnectToEngine([NotNull]IStorageEngine engine, DatabaseOptions? options = null)
+        {
+            if (engine == null) throw new ArgumentNullException(nameof(engine));
+            var db = CheckCollation(CheckManifest(CheckRecovery(new Database(Stream.Null, options, engine), options, engine), options), options);
+            db.BindSystemRecords();
+            db.ReleaseTemps();
+            db.StartStatsSnapshots(options?.StatsInterval);
+            return db;
+        }
+
+        /// <summary>
+        /// Check the storage header and the pages it links to, and deal with any damage as `DatabaseOptions.Recovery` says.
+        /// Returns the database to use, which is a new read-only connection for `RecoveryPolicy.ReadOnly`.
+        /// </summary>
+        [NotNull]private static Database CheckRecovery([NotNull]Database db, DatabaseOptions? options, IStorageEngine? engine = null)
+        {
+            var policy = options?.Recovery ?? RecoveryPolicy.Open;
+            if (options == null || policy == RecoveryPolicy.Open) return db;
+
+            var report = db._pages.HealthCheck(HealthCheckLevel.Quick);
+            if (report.IsHealthy) return db;
+            db._logger.Warn("Storage problems found on open", "policy", policy, "problems", report.Problems.Count);
+
+            if (policy == RecoveryPolicy.Fail || (!db._canWrite && policy != RecoveryPolicy.ReadOnly))
+            {
+                db._writer?.Dispose(); // the storage stream belongs to the caller
+                throw new StorageRecoveryException(report, "Damaged storage was not opened");
+            }
+
+            switch (policy)
+            {
+                case RecoveryPolicy.ReadOnly:
+                    if (!db._canWrite) return db;
+                    db._writer?.Dispose();
+                    var readOnly = options.Copy();
+                    readOnly.ReadReplica = true;
+                    return new Database(db._fs, readOnly, engine);
+
+                case RecoveryPolicy.Repair:
+                    if (!db._pages.RepairHeaderLinks())
+                    {
+                        db._writer?.Dispose();
+                        throw new StorageRecoveryException(report, "Damaged storage could not be repaired");
+                    }
+                    var remaining = db._pages.HealthCheck(HealthCheckLevel.Quick);
+                    db._pages.QuarantinePages(report.FailedPages.Union(remaining.FailedPages).ToArray()); // unlinked damaged pages must not be reused either
+                    return db;
+
+                case RecoveryPolicy.Quarantine:
+                    db._pages.QuarantinePages(report.FailedPages.ToArray());
+                    return db;
+
+                default: throw new ArgumentOutOfRangeException(nameof(options), $"Unknown recovery policy {policy}");
+            }
+        }
+
+        [NotNull]private static Database CheckManifest([NotNull]Database db, DatabaseOptions? options)
+        {
+            if (options?.ManifestKey == null) return db;
+
+            var report = db.VerifyManifest(options.ManifestKey);
+            if (report.IsValid) return db;
+
+            db._writer?.Dispose(); // the storage stream belongs to the caller
+            throw new ManifestVerificationException(report);
+        }
+
+        /// <summary>
+        /// Pick the path collation from the options and the name stored with the database, storing it if this is the first time it is set.
+        /// </summary>
+        [NotNull]private static Database CheckCollation([NotNull]Database db, DatabaseOptions? options)
+        {
+            var requested = options?.Collation;
+            string? stored;
+            try
+            {
+                stored = db.SystemDocuments.GetSetting(CollationSetting);
+            }
+            catch (Exception ex)
+            {
+                // damaged storage can still be opened (see `DatabaseOptions.Recovery`), so don't stop here
+                db._logger.Warn("Could not read the stored path collation", "error", ex.Message);
+                db._collation = requested ?? PathCollation.Ordinal;
+                return db;
+            }
+
+            if (stored == null)
+            {
+                if (requested == null) return db;
+                if (db._canWrite) db.SystemDocuments.SetSetting(CollationSetting, requested.Name);
+                db._collation = requested;
+                return db;
+            }
+
+            var collation = requested ?? PathCollation.BuiltIn(stored);
+            if (collation != null && collation.Name == stored)
+            {
+                db._collation = collation;
+                return db;
+            }
+
+            db._writer?.Dispose(); // the storage stream belongs to the caller
+            throw new InvalidOperationException(requested == null
+                ? $"Database uses the path collation '{stored}', which is not built in. Give it in DatabaseOptions.Collation"
+                : $"Database uses the path collation '{stored}', but '{requested.Name}' was given");
+        }
+
+        /// <summary> Configuration setting holding the name of the path collation. See `SystemDocuments.GetSetting` </summary>
+        private const string CollationSetting = "collation";
+
+        /// <summary>
+        /// Ordering used for sorted listings and range queries. See `DatabaseOptions.Collation`
+        /// </summary>
+        [NotNull]public PathCollation Collation => _collation;
+
+        /// <summary>
+        /// Flush, close and dispose of the underlying stream. File storage is flushed through to disk.
+        /// This is the same as `Dispose`.
+        /// </summary>
+        public void Close()
+        {
+            Dispose();
+        }
+
+        /// <summary>
+        /// Flush, close and dispose of the underlying stream. File storage is flushed through to disk.
+        /// </summary>
+        public void Dispose()
+        {
+            lock (_statsLock)
+            {
+                _statsTimer?.Dispose();
+                _statsTimer = null;
+            }
+            try
+            {
+                ReleaseTemps();
+                if (_canWrite) _pages.ReleaseDeferredPages();
+            }
+            finally
+            {
+                _writer?.Dispose();
+                if (_fs is FileStream file) file.Flush(flushToDisk: true);
+                else _fs.Flush();
+                _fs.Dispose();
+                CloseOwnedLog();
+            }
+        }
+
+        /// <summary>
+        /// Close the write-ahead log file opened by `Open`. It is deleted if nothing is left to replay.
+        /// </summary>
+        private void CloseOwnedLog()
+        {
+            var log = _ownedLog;
+            if (log == null) return;
+            _ownedLog = null;
+
+            var empty = log.Length == 0;
+            log.Dispose();
+            if (empty) File.Delete(log.Name);
+        }
+
+        [NotNull]private readonly object _pathWriteLock = new object();
+
+        /// <summary>
+        /// Write a document to the given path. If an existing document uses this path, it will be deleted.
+        /// </summary>
+        /// <param name="path">Path that can be used with `Get` and `Search` operations to recover this document</param>
+        /// <param name="data">Stream containing document data. It will be read from current position to end.</param>
+        /// <param name="annotation">Optional note stored with the path binding. See `GetBindingInfo`</param>
+        /// <param name="attributes">Attribute bits stored with the path binding</param>
+        public Guid WriteDocument(string path, Stream? data, string? annotation = null, BindingAttributes attributes = BindingAttributes.None)
+        {
+            CheckUserPath(path);
+            return WriteDocumentAt(path, data, annotation, attributes);
+        }
+
+        /// <summary>
+        /// Write a document to the given path, from a stream with a known length that can't seek (a network or pipe stream, for example).
+        /// Exactly `length` bytes are read, directly into storage, without buffering the document in memory.
+        /// If the stream ends early, nothing is written and an exception is thrown.
+        /// </summary>
+        /// <param name="path">Path that can be used with `Get` and `Search` operations to recover this document</param>
+        /// <param name="data">Stream containing document data. It will be read from current position</param>
+        /// <param name="length">Number of bytes to read from the stream</param>
+        public Guid WriteDocument(string path, Stream? data, long length)
+        {
+            if (data == null) throw new ArgumentNullException(nameof(data));
+            CheckUserPath(path);
+            return WriteDocumentAt(path, new KnownLengthStream(data, length), null, BindingAttributes.None);
+        }
+
+        /// <summary>
+        /// Write a document that can never be changed or released (for audit artifacts, firmware images and so on).
+        /// The document can be bound to more paths, but its last path can't be unbound or replaced,
+        /// and it can't be deleted unless the force flag is given to `Delete` or `UnbindPath`.
+        /// Pages are still released if the document is force-deleted.
+        /// </summary>
+        /// <param name="path">Path that can be used for `Get` and `Search` operations</param>
+        /// <param name="data">Stream containing document data. It will be read from current position to end.</param>
+        /// <param name="annotation">Optional note stored with the path binding. See `GetBindingInfo`</param>
+        public Guid WriteImmutableDocument(string path, Stream? data, string? annotation = null)
+        {
+            CheckUserPath(path);
+            lock (_pathWriteLock) // taken before `_immutableLock`, as in the other path writes
+            lock (_immutableLock)
+            {
+                var id = WriteDocumentAt(path, data, annotation, BindingAttributes.None);
+                var list = ReadImmutables();
+                if (list.DocumentIds.Add(id)) WriteImmutables(list);
+                return id;
+            }
+        }
+
+        [NotNull]private readonly object _immutableLock = new object();
+
+        /// <summary>
+        /// Returns true if the document was written with `WriteImmutableDocument`
+        /// </summary>
+        public bool IsImmutable(Guid documentId)
+        {
+            if (documentId == Guid.Empty || ReservedDocIds.IsReserved(documentId)) return false;
+            lock (_immutableLock)
+            {
+                return ReadImmutables().DocumentIds.Contains(documentId);
+            }
+        }
+
+        [NotNull]private ImmutableList ReadImmutables()
+        {
+            var list = new ImmutableList();
+            var stream = _pages.ReadDocument(ReservedDocIds.Immutables);
+            if (stream != null) list.Defrost(stream);
+            return list;
+        }
+
+        private void WriteImmutables([NotNull]ImmutableList list)
+        {
+            _pages.WriteDocumentVersion(ReservedDocIds.Immutables, list.Freeze());
+        }
+
+        /// <summary>
+        /// Remove a document from the immutable list once it has been force-deleted
+        /// </summary>
+        private void ForgetImmutable(Guid documentId)
+        {
+            lock (_immutableLock)
+            {
+                var list = ReadImmutables();
+                if (list.DocumentIds.Remove(documentId)) WriteImmutables(list);
+            }
+        }
+
+        /// <summary>
+        /// Documents kept by the engine under `SystemNamespace`, such as the database configuration
+        /// </summary>
+        [NotNull]public SystemDocuments SystemDocuments { get; }
+
+        /// <summary>
+        /// Write a document to a path under `SystemNamespace`. See `SystemDocuments`
+        /// </summary>
+        internal Guid WriteSystemDocument([NotNull]string path, [NotNull]Stream data)
+        {
+            if (!IsSystemPath(path)) throw new Exception($"'{path}' is not a system path");
+            return WriteDocumentAt(path, data, null, BindingAttributes.System);
+        }
+
+        /// <summary>
+        /// Delete a document at a path under `SystemNamespace`. See `SystemDocuments`
+        /// </summary>
+        internal void DeleteSystemDocument([NotNull]string path)
+        {
+            if (!IsSystemPath(path)) throw new Exception($"'{path}' is not a system path");
+            DeleteAt(path);
+        }
+
+        /// <summary>
+        /// Bind the trash, pin list and audit log under `SystemNamespace`. Stores written before the namespace existed hold
+        /// these with no path, so they are bound the first time a writing connection opens the store.
+        /// </summary>
+        private void BindSystemRecords()
+        {
+            if (!_canWrite) return;
+            try
+            {
+                BindSystemRecord(SystemDocuments.TrashName, ReservedDocIds.Trash);
+                BindSystemRecord(SystemDocuments.PinsName, ReservedDocIds.Pins);
+                BindSystemRecord(SystemDocuments.AuditName, ReservedDocIds.Audit);
+            }
+            catch (Exception ex)
+            {
+                // damaged storage can still be opened (see `DatabaseOptions.Recovery`), so don't stop here
+                _logger.Warn("Could not bind engine records under the system namespace", "error", ex.Message);
+            }
+        }
+
+        /// <summary>
+        /// Bind one of the engine's own records to its system path, if the record exists and is not bound yet.
+        /// The record keeps its reserved ID, so the engine reads and writes it as before.
+        /// </summary>
+        private void BindSystemRecord([NotNull]string name, Guid id)
+        {
+            var path = SystemDocuments.PathOf(name);
+            if (_pages.GetDocumentIdByPath(path) == id || _pages.GetDocumentStat(id) == null) return;
+            _pages.BindPathToDocument(path, id, null, BindingAttributes.System);
+        }
+
+        /// <summary>
+        /// Returns true if the path is in the namespace reserved for the engine
+        /// </summary>
+        public static bool IsSystemPath(string? path)
+        {
+            return path != null && path.StartsWith(SystemNamespace, StringComparison.Ordinal);
+        }
+
+        internal static void CheckUserPath(string? path)
+        {
+            if (IsSystemPath(path)) throw new ArgumentException($"Paths starting '{SystemNamespace}' are reserved for the engine", nameof(path));
+        }
+
+        /// <summary>
+        /// Throws if the ID is one the engine uses for its own records (access lists, pins, trash and the like)
+        /// </summary>
+        internal static void CheckUserDocId(Guid documentId)
+        {
+            if (ReservedDocIds.IsReserved(documentId)) throw new ArgumentException($"Document ID {documentId} is reserved for the engine", nameof(documentId));
+        }
+
+        /// <summary>
+        /// Throws if the path is bound with the `Immutable` attribute
+        /// </summary>
+        private void CheckMutable(string? path)
+        {
+            if (path == null) return;
+            var binding = _pages.GetBindingInfo(path);
+            if (binding != null && (binding.Attributes & BindingAttributes.Immutable) != 0) throw new Exception($"Path '{path}' is immutable");
+        }
+
+        /// <summary>
+        /// True if the path is bound, and its binding should be left out of normal listings
+        /// </summary>
+        private bool IsHiddenPath([NotNull]string path)
+        {
+            return IsSystemPath(path) || (_pages.GetBindingInfo(path)?.IsHidden ?? false);
+        }
+
+        /// <summary>
+        /// Throws if the path is the last binding of an immutable document, so rebinding or unbinding it would release the document
+        /// </summary>
+        private void CheckReplaceable(string? path)
+        {
+            if (path == null) return;
+            var oldId = _pages.GetDocumentIdByPath(path);
+            if (oldId != Guid.Empty) CheckReleasable(oldId, path, false);
+        }
+
+        /// <summary>
+        /// Throws if the document is immutable and would be left with no paths once `leavingPath` is removed.
+        /// If `leavingPath` is null, any immutable document is rejected.
+        /// </summary>
+        private void CheckReleasable(Guid documentId, string? leavingPath, bool force)
+        {
+            if (force || !IsImmutable(documentId)) return;
+            if (leavingPath != null && _pages.ListPathsForDocument(documentId).Any(p => p != leavingPath)) return;
+            throw new Exception($"Document {documentId} is immutable, and can't be released without the force flag");
+        }
+
+        private Guid WriteDocumentAt(string path, Stream? data, string? annotation, BindingAttributes attributes, string? schema = null)
+        {
+            if (data == null) throw new ArgumentNullException(nameof(data));
+            Authorize(AccessRights.Write, path, Guid.Empty);
+            CheckMutable(path);
+            CheckReplaceable(path);
+            if (!IsSystemPath(path)) data = CheckBeforePut(path, annotation, attributes, data);
+            var size = data.CanSeek ? data.Length - data.Position : (data as KnownLengthStream)?.Length ?? 0;
+            var id = _pages.WriteDocument(data);
+            if (id == Guid.Empty) throw new Exception("Failed to write document data");
+            if (schema != null) SetSchema(id, schema); // before binding, so readers never see the path without it
+
+            lock (_pathWriteLock)
+            {
+                BindNewDocument(path, id, annotation, attributes);
+                Audit(AuditOperation.WriteDocument, path, id, size);
+            }
+            return id;
+        }
+
+        [NotNull, ItemNotNull] private readonly List<Action<PutRequest>> _beforePut = new List<Action<PutRequest>>();
+
+        /// <summary>
+        /// Register a check that is run before every document write, such as content validation, virus scanning or schema checks.
+        /// The check is given the path, binding details and data. Throw from the check to reject the write:
+        /// nothing is stored, and the exception is passed to the caller.
+        /// <para></para>
+        /// Checks run in the order they were registered, on the writing thread. They are run for `WriteDocument`, `WriteImmutableDocument`,
+        /// `Put`, `PutTemp` and `CompleteUpload`, but not for writes to system paths or `AppendToFixedDocument`.
+        /// If a check is registered, data from streams that can't seek is buffered in memory so each check can read it.
+        /// </summary>
+        public void OnBeforePut([NotNull]Action<PutRequest> check)
+        {
+            if (check == null) throw new ArgumentNullException(nameof(check));
+            lock (_beforePut) { _beforePut.Add(check); }
+        }
+
+        /// <summary>
+        /// Run registered `OnBeforePut` checks against data about to be written. Returns the stream to write from,
+        /// which is a buffered copy if the original can't seek.
+        /// </summary>
+        [NotNull]private Stream CheckBeforePut(string? path, string? annotation, BindingAttributes attributes, [NotNull]Stream data)
+        {
+            Action<PutRequest>[] checks;
+            lock (_beforePut)
+            {
+                if (_beforePut.Count < 1) return data;
+                checks = _beforePut.ToArray();
+            }
+
+            if (!data.CanSeek)
+            {
+                var buffered = new MemoryStream();
+                data.CopyTo(buffered);
+                if (data is KnownLengthStream known && buffered.Length != known.Length) throw new Exception($"Data stream ended after {buffered.Length} bytes, but {known.Length} were expected");
+                buffered.Seek(0, SeekOrigin.Begin);
+                data = buffered;
+            }
+
+            var start = data.Position;
+            foreach (var check in checks)
+            {
+                check(new PutRequest(path, annotation, attributes, data));
+                data.Seek(start, SeekOrigin.Begin);
+            }
+            return data;
+        }
+
+        /// <summary>
+        /// Start a multi-part upload to the given path. Returns a session ID to use with `UploadPart` and `CompleteUpload`.
+        /// The path is not bound until the upload is completed.
+        /// <para></para>
+        /// Sessions are stored with the database, so an upload can be resumed with the same session ID after the database
+        /// is reopened. Sessions not completed within `DatabaseOptions.UploadExpiry` are released when the database is opened or closed.
+        /// </summary>
+        /// <param name="path">Path the document will be written to on completion</param>
+        public Guid StartUpload(string path)
+        {
+            if (path == null) throw new ArgumentNullException(nameof(path));
+            CheckUserPath(path);
+            return _pages.StartUpload(path);
+        }
+
+        /// <summary>
+        /// Write one part of a multi-part upload. Parts can arrive in any order, and a part can be re-sent to replace it.
+        /// All parts except the last must be a multiple of `UploadPartAlignment` bytes long.
+        /// </summary>
+        /// <param name="sessionId">ID from `StartUpload`</param>
+        /// <param name="partNumber">Position of this part in the final document. Parts are joined in ascending order</param>
+        /// <param name="data">Stream containing part data. It will be read from current position to end.</param>
+        public void UploadPart(Guid sessionId, int partNumber, Stream? data)
+        {
+            if (data == null) throw new ArgumentNullException(nameof(data));
+            _pages.UploadPart(sessionId, partNumber, data);
+        }
+
+        /// <summary>
+        /// Write one part of a multi-part upload, from a stream with a known length that can't seek (a network or pipe stream, for example).
+        /// Exactly `length` bytes are read. See `UploadPart(Guid, int, Stream)`.
+        /// </summary>
+        /// <param name="sessionId">ID from `StartUpload`</param>
+        /// <param name="partNumber">Position of this part in the final document. Parts are joined in ascending order</param>
+        /// <param name="data">Stream containing part data. It will be read from current position</param>
+        /// <param name="length">Number of bytes to read from the stream</param>
+        public void UploadPart(Guid sessionId, int partNumber, Stream? data, long length)
+        {
+            if (data == null) throw new ArgumentNullException(nameof(data));
+            _pages.UploadPart(sessionId, partNumber, new KnownLengthStream(data, length));
+        }
+
+        /// <summary>
+        /// Join the parts of a multi-part upload into a document, and bind it to the path given in `StartUpload`.
+        /// If an existing document uses this path, it will be deleted.
+        /// </summary>
+        public Guid CompleteUpload(Guid sessionId)
+        {
+            string? path = _pages.GetUploadPath(sessionId);
+            if (path == null) throw new Exception($"Unknown upload session {sessionId}");
+
+            Authorize(AccessRights.Write, path, Guid.Empty);
+            var id = _pages.CompleteUpload(sessionId);
+
+            var joined = _pages.ReadDocument(id);
+            try
+            {
+                if (joined != null) CheckBeforePut(path, null, BindingAttributes.None, joined);
+            }
+            catch
+            {
+                _pages.DeleteDocument(id); // this finds the joined chain through the index, so must come before any unbinding
+                throw;
+            }
+
+            lock (_pathWriteLock)
+            {
+                BindNewDocument(path, id);
+                Audit(AuditOperation.CompleteUpload, path, id);
+            }
+            return id;
+        }
+
+        /// <summary>
+        /// Abandon a multi-part upload, releasing any data written so far.
+        /// If the session does not exist, the request will be silently ignored.
+        /// </summary>
+        public void AbortUpload(Guid sessionId)
+        {
+            _pages.AbortUpload(sessionId);
+        }
+
+        /// <summary>
+        /// Create a document at the given path by writing to a stream, rather than supplying one.
+        /// Data is stored as it is written. The document is bound to the path when the writer is disposed;
+        /// call `DocumentWriter.Abort` instead to discard it. If an existing document uses this path, it will be deleted on completion.
+        /// </summary>
+        /// <param name="path">Path the document will be written to</param>
+        [NotNull]public DocumentWriter CreateDocument(string path)
+        {
+            var sessionId = StartUpload(path);
+            return new DocumentWriter(this, path, sessionId);
+        }
+
+        /// <summary>
+        /// Upload parts (other than the last) must be a multiple of this size in bytes
+        /// </summary>
+        public const int UploadPartAlignment = BasicPage.PageDataCapacity;
+
+        private void BindNewDocument(string path, Guid id, string? annotation = null, BindingAttributes attributes = BindingAttributes.None)
+        {
+            CheckMutable(path);
+            CheckReplaceable(path);
+            var oldId = _pages.BindPathToDocument(path, id, annotation, attributes);
+
+            if (oldId != Guid.Empty && oldId != id)
+            {
+                var others = _pages.ListPathsForDocument(oldId).Any();
+                if (!others && !IsPinned(oldId) && !IsImmutable(oldId))
+                {
+                    _pages.DeleteDocument(oldId);
+                    ForgetSchema(oldId);
+                    Audit(AuditOperation.DeleteDocument, null, oldId);
+                }
+            }
+        }
+
+        /// <summary>
+        /// Read entries from the audit log, oldest first.
+        /// The log is only written when `DatabaseOptions.EnableAuditLog` is set.
+        /// </summary>
+        /// <param name="since">Only return entries at or after this time (UTC)</param>
+        [NotNull, ItemNotNull]
+        public IEnumerable<AuditRecord> ReadAuditLog(DateTime since)
+        {
+            var cutoff = since.ToUniversalTime();
+            return _pages.ReadAuditRecords().Where(r => r.Timestamp >= cutoff);
+        }
+
+        /// <summary>
+        /// Read entries from the audit log, oldest first, starting at a position in the log.
+        /// Use this to catch up a consumer of `OnAfterCommit` from the last `AuditRecord.Sequence` it handled.
+        /// </summary>
+        /// <param name="sequence">Only return entries with this sequence number or later</param>
+        [NotNull, ItemNotNull]
+        public IEnumerable<AuditRecord> ReadAuditLogFrom(long sequence)
+        {
+            return _pages.ReadAuditRecords().Where(r => r.Sequence >= sequence);
+        }
+
+        [NotNull, ItemNotNull] private readonly List<Action<AuditRecord>> _afterCommit = new List<Action<AuditRecord>>();
+        [NotNull, ItemNotNull] private readonly Queue<AuditRecord> _commitQueue = new Queue<AuditRecord>();
+        private long _auditSequence = -1; // next sequence number, or -1 if not counted yet
+        private bool _delivering;
+        private bool _auditBound; // audit log has been bound under `SystemNamespace` by this connection
+
+        /// <summary>
+        /// Register a hook that is called after every committed change, with the change's audit log entry.
+        /// Use this to keep downstream indexes up to date. Requires `DatabaseOptions.EnableAuditLog`.
+        /// <para></para>
+        /// Hooks are called one change at a time, in the order the changes were written to the audit log, and never concurrently.
+        /// Changes to the same path are always logged in the order they were made.
+        /// A change is usually delivered on the thread that made it, before the write returns; if another thread is
+        /// already delivering changes, that thread delivers it instead. Hooks may write to the database; those changes
+        /// are delivered after the current one.
+        /// <para></para>
+        /// A hook that throws is logged and skipped for that change only; the change is not undone.
+        /// To handle every change exactly once, store the `AuditRecord.Sequence` of the last change handled with your index,
+        /// ignore changes at or before it, and use `ReadAuditLogFrom` after a restart or a gap in sequence numbers.
+        /// </summary>
+        public void OnAfterCommit([NotNull]Action<AuditRecord> hook)
+        {
+            if (hook == null) throw new ArgumentNullException(nameof(hook));
+            if (!_auditEnabled) throw new InvalidOperationException("Commit hooks are delivered from the audit log. Set DatabaseOptions.EnableAuditLog to use them");
+            lock (_afterCommit)
+            {
+                if (_auditSequence < 0) _auditSequence = _pages.ReadAuditRecords().LongCount();
+                _afterCommit.Add(hook);
+            }
+        }
+
+        private void Audit(AuditOperation operation, string? path, Guid documentId, long size = 0)
+        {
+            if (!_auditEnabled) return;
+            var record = new AuditRecord {
+                Timestamp = DateTime.UtcNow,
+                Operation = operation,
+                Path = path,
+                DocumentId = documentId,
+                Size = size
+            };
+
+            lock (_afterCommit)
+            {
+                _pages.AppendAuditRecord(record);
+                if (!_auditBound)
+                {
+                    BindSystemRecord(SystemDocuments.AuditName, ReservedDocIds.Audit);
+                    _auditBound = true;
+                }
+                if (_auditSequence < 0) return; // no hooks
+                record.Sequence = _auditSequence++;
+                _commitQueue.Enqueue(record);
+                if (_delivering) return; // another call is delivering, and will pick this up
+                _delivering = true;
+            }
+            DeliverCommits();
+        }
+
+        /// <summary>
+        /// Call `OnAfterCommit` hooks for queued changes, until the queue is empty.
+        /// Hooks are called outside the lock, so they can write to the database.
+        /// </summary>
+        private void DeliverCommits()
+        {
+            while (true)
+            {
+                AuditRecord record;
+                Action<AuditRecord>[] hooks;
+                lock (_afterCommit)
+                {
+                    if (_commitQueue.Count < 1)
+                    {
+                        _delivering = false;
+                        return;
+                    }
+                    record = _commitQueue.Dequeue();
+                    hooks = _afterCommit.ToArray();
+                }
+
+                foreach (var hook in hooks)
+                {
+                    try { hook(record); }
+                    catch (Exception ex) { _logger.Warn("Commit hook failed", "sequence", record.Sequence, "error", ex.Message); }
+                }
+            }
+        }
+
+        /// <summary>
+        /// Read a document at the given path.
+        /// Returns true if found, false if not found.
+        /// Dispose or close the stream when finished with it, to release its cached pages. Streams left for the garbage collector
+        /// are logged as a warning. See `DatabaseOptions.MaxOpenStreams`
+        /// </summary>
+        public bool Get(string path, out Stream? stream)
+        {
+            stream = OpenDocument(path);
+            if (stream == null) return false;
+            stream = _streams.Track(stream, path);
+            return true;
+        }
+
+        /// <summary>
+        /// Number of document streams given out by `Get`, `ReadRange` and snapshots that have not yet been disposed.
+        /// See `DatabaseOptions.MaxOpenStreams`
+        /// </summary>
+        public int OpenStreamCount => _streams.Open;
+
+        /// <summary>
+        /// Bytes of memory currently held by caches: the path lookup, and pages held by open document streams.
+        /// See `DatabaseOptions.MemoryBudget`
+        /// </summary>
+        public long CacheMemoryUsed => _pages.CacheMemoryUsed;
+
+        /// <summary>
+        /// Open a document by path for internal use, without counting it against the open stream limit
+        /// </summary>
+        private Stream? OpenDocument(string path)
+        {
+            var id = _pages.GetDocumentIdByPath(path);
+            if (id == Guid.Empty) return null;
+            Authorize(AccessRights.Read, path, id);
+
+            return _pages.ReadDocument(id);
+        }
+
+        /// <summary>
+        /// Codecs used by `Put` and `Get` to convert typed values
+        /// </summary>
+        [NotNull]public CodecRegistry Codecs => _codecs;
+
+        /// <summary>
+        /// Encode a value with its registered codec, and write it to the given path.
+        /// The codec's schema ID is stored with the document, so it is kept when the document is bound to other paths,
+        /// and it is checked when reading. If an existing document uses this path, it will be deleted.
+        /// </summary>
+        public Guid Put<T>(string path, T value)
+        {
+            var codec = _codecs.ForType(typeof(T));
+            var ms = new MemoryStream();
+            codec.Encode(value!, ms);
+            ms.Seek(0, SeekOrigin.Begin);
+            CheckUserPath(path);
+            return WriteDocumentAt(path, ms, null, BindingAttributes.None, codec.SchemaId);
+        }
+
+        /// <summary>
+        /// Read and decode a typed value from the given path.
+        /// Returns true if found, false if not found.
+        /// Throws an exception if the document was not written with the codec registered for `T`.
+        /// </summary>
+        public bool Get<T>(string path, out T value)
+        {
+            value = default!;
+            var codec = _codecs.ForType(typeof(T));
+            var binding = _pages.GetBindingInfo(path);
+            if (binding == null) return false;
+
+            var schema = SchemaOf(binding);
+            if (schema != codec.SchemaId) throw new Exception($"Document at '{path}' has schema '{schema ?? "none"}', but {typeof(T).Name} uses '{codec.SchemaId}'");
+            Authorize(AccessRights.Read, path, binding.DocumentId);
+
+            var stream = _pages.ReadDocument(binding.DocumentId);
+            if (stream == null) return false;
+            value = (T)codec.Decode(stream);
+            return true;
+        }
+
+        /// <summary>
+        /// Read and decode a value from the given path, using whichever registered codec matches its stored schema ID.
+        /// Returns null if the path is not bound. Throws if the document has no schema, or the schema is not registered.
+        /// </summary>
+        public object? GetObject(string path)
+        {
+            var binding = _pages.GetBindingInfo(path);
+            if (binding == null) return null;
+
+            var schema = SchemaOf(binding);
+            if (!_codecs.TryGetBySchema(schema, out var codec) || codec == null) throw new Exception($"Document at '{path}' has schema '{schema ?? "none"}', which is not registered");
+            Authorize(AccessRights.Read, path, binding.DocumentId);
+
+            var stream = _pages.ReadDocument(binding.DocumentId);
+            return stream == null ? null : codec.Decode(stream);
+        }
+
+        /// <summary>
+        /// Read the codec schema ID of the document at a path (see `Put`).
+        /// Returns null if the path is not bound, or the document was not written by a codec.
+        /// </summary>
+        public string? GetSchemaId(string path)
+        {
+            return SchemaOf(_pages.GetBindingInfo(path));
+        }
+
+        /// <summary>
+        /// Schema ID stored for a binding's document. Documents written before schemas were stored with the document
+        /// have it in the binding annotation instead.
+        /// </summary>
+        private string? SchemaOf(BindingInfo? binding)
+        {
+            if (binding == null) return null;
+            lock (_schemaLock)
+            {
+                if (ReadSchemas().Entries.TryGetValue(binding.DocumentId, out var schema)) return schema;
+            }
+            return CodecRegistry.SchemaOf(binding);
+        }
+
+        [NotNull]private readonly object _schemaLock = new object();
+
+        private void SetSchema(Guid documentId, [NotNull]string schema)
+        {
+            lock (_schemaLock)
+            {
+                var list = ReadSchemas();
+                list.Entries[documentId] = schema;
+                WriteSchemas(list);
+            }
+        }
+
+        /// <summary>
+        /// Drop the schema ID of a deleted document
+        /// </summary>
+        private void ForgetSchema(Guid documentId)
+        {
+            if (documentId == Guid.Empty) return;
+            lock (_schemaLock)
+            {
+                var list = ReadSchemas();
+                if (list.Entries.Remove(documentId)) WriteSchemas(list);
+            }
+        }
+
+        [NotNull]private SchemaList ReadSchemas()
+        {
+            var list = new SchemaList();
+            var stream = _pages.ReadDocument(ReservedDocIds.Schemas);
+            if (stream != null) list.Defrost(stream);
+            return list;
+        }
+
+        private void WriteSchemas([NotNull]SchemaList list)
+        {
+            _pages.WriteDocumentVersion(ReservedDocIds.Schemas, list.Freeze());
+        }
+
+        /// <summary>
+        /// Read part of a document at the given path, without reading the data before it.
+        /// Returns true if found, false if not found.
+        /// If the range runs past the end of the document, the stream will be shorter than requested.
+        /// </summary>
+        /// <param name="path">Path of the document</param>
+        /// <param name="offset">Byte offset to start reading. Must be between zero and document length (inclusive)</param>
+        /// <param name="length">Maximum number of bytes to read</param>
+        /// <param name="stream">Stream positioned at the start of the range</param>
+        public bool ReadRange(string path, long offset, long length, out Stream? stream)
+        {
+            stream = null;
+            if (length < 0) throw new ArgumentOutOfRangeException(nameof(length), "Range length must not be negative");
+            var document = OpenDocument(path);
+            if (document == null) return false;
+
+            var documentLength = document.Length;
+            if (offset < 0 || offset > documentLength)
+            {
+                document.Dispose();
+                throw new ArgumentOutOfRangeException(nameof(offset), $"Range start {offset} is outside the document (length {documentLength})");
+            }
+
+            document.Seek(offset, SeekOrigin.Begin);
+            var available = Math.Min(length, document.Length - offset);
+            stream = _streams.Track(new Substream(document, available), path, document);
+            return true;
+        }
+
+        /// <summary>
+        /// Try to look up the document ID bound to a path.
+        /// </summary>
+        public bool GetIdByPath(string path, out Guid id) {
+            id = _pages.GetDocumentIdByPath(path);
+            return id != Guid.Empty;
+        }
+        
+
+        /// <summary>
+        /// Get a summary of the document at a given path
+        /// </summary>
+        public string GetDocumentInfo(string path)
+        {
+            var id = _pages.GetDocumentIdByPath(path);
+            return _pages.GetInfo(id);
+        }
+
+        /// <summary>
+        /// Get the length, flags and last modified date of the document at a given path.
+        /// This is normally read from the index without opening the document.
+        /// Returns null if no document is bound to the path.
+        /// </summary>
+        public DocumentStat? Stat(string path)
+        {
+            var id = _pages.GetDocumentIdByPath(path);
+            if (id == Guid.Empty) return null;
+            return _pages.GetDocumentStat(id);
+        }
+
+        /// <summary>
+        /// Add a new path binding to a document ID.
+        /// If the path is already bound to a document, the old document ID will be returned
+        /// </summary>
+        /// <param name="documentId">ID of an existing document (this is not checked)</param>
+        /// <param name="newPath">path that can be used for `Get` and `Search` operations</param>
+        /// <param name="annotation">Optional note stored with the path binding. See `GetBindingInfo`</param>
+        /// <param name="attributes">Attribute bits stored with the path binding</param>
+        public Guid BindToPath(Guid documentId, string newPath, string? annotation = null, BindingAttributes attributes = BindingAttributes.None)
+        {
+            CheckUserPath(newPath);
+            CheckUserDocId(documentId);
+            lock (_pathWriteLock)
+            {
+                Authorize(AccessRights.Write, newPath, Guid.Empty);
+                CheckMutable(newPath);
+                CheckReplaceable(newPath);
+                var previous = _pages.BindPathToDocument(newPath, documentId, annotation, attributes);
+                Audit(AuditOperation.BindPath, newPath, documentId);
+                return previous;
+            }
+        }
+
+        /// <summary>
+        /// Change the attribute bits of an existing path binding. The document and annotation are kept.
+        /// Returns false if the path is not bound.
+        /// </summary>
+        public bool SetAttributes(string path, BindingAttributes attributes)
+        {
+            CheckUserPath(path);
+            lock (_pathWriteLock)
+            {
+                var binding = _pages.GetBindingInfo(path);
+                if (binding == null) return false;
+                Authorize(AccessRights.Write, path, binding.DocumentId);
+                _pages.BindPathToDocument(path, binding.DocumentId, binding.Annotation, attributes);
+                return true;
+            }
+        }
+
+        /// <summary>
+        /// Get the document ID bound to a path, with the time and annotation recorded when it was bound (if any).
+        /// Returns null if the path is not bound.
+        /// </summary>
+        public BindingInfo? GetBindingInfo(string path)
+        {
+            return _pages.GetBindingInfo(path);
+        }
+
+        /// <summary>
+        /// Move every path starting with `oldPrefix` so it starts with `newPrefix` instead (e.g. to rename a directory).
+        /// All paths are moved in a single update, so readers see either all old or all new paths.
+        /// If a target path was already bound to another document, that binding is replaced, and the old document is deleted if it has no other paths
+        /// (unless it is pinned or immutable).
+        /// Returns the number of paths moved.
+        /// </summary>
+        public int RenamePrefix(string oldPrefix, string newPrefix)
+        {
+            if (oldPrefix == null) throw new ArgumentNullException(nameof(oldPrefix));
+            if (newPrefix == null) throw new ArgumentNullException(nameof(newPrefix));
+            if (SystemNamespace.StartsWith(oldPrefix, StringComparison.Ordinal) || IsSystemPath(oldPrefix) || IsSystemPath(newPrefix))
+            {
+                throw new ArgumentException($"Renames must not touch paths starting '{SystemNamespace}'");
+            }
+
+            lock (_pathWriteLock)
+            {
+                foreach (var path in _pages.SearchPaths(oldPrefix))
+                {
+                    Authorize(AccessRights.Write, path, Guid.Empty);
+                    CheckMutable(path);
+                }
+                var count = _pages.RenamePrefix(oldPrefix, newPrefix, out var replaced);
+                Audit(AuditOperation.RenamePrefix, oldPrefix + " -> " + newPrefix, Guid.Empty, count);
+                foreach (var oldId in replaced)
+                {
+                    if (_pages.ListPathsForDocument(oldId).Any() || IsPinned(oldId) || IsImmutable(oldId)) continue;
+                    _pages.DeleteDocument(oldId);
+                    ForgetSchema(oldId);
+                    Audit(AuditOperation.DeleteDocument, null, oldId);
+                }
+                return count;
+            }
+        }
+
+        /// <summary>
+        /// For a given document ID, find all paths that are bound to it.
+        /// </summary>
+        /// <param name="documentId">A document stored in the database</param>
+        /// <returns>Enumeration of paths. This may not be multi-enumerable</returns>
+        /// <param name="includeHidden">If true, include hidden and system paths (see `BindingAttributes`), and paths under `SystemNamespace`</param>
+        [NotNull, ItemNotNull]
+        public IEnumerable<string> ListPaths(Guid documentId, bool includeHidden = false)
+        {
+            CheckUserDocId(documentId);
+            var paths = _pages.ListPathsForDocument(documentId);
+            return includeHidden ? paths : paths.Where(p => !IsHiddenPath(p));
+        }
+
+        /// <summary>
+        /// Delete a document from the database, and unbind all paths to it.
+        /// If the document does not exist, the request will be silently ignored.
+        /// Throws an exception if the document is pinned, or is immutable and `force` is not set,
+        /// and an `ArgumentException` for IDs reserved for the engine's own records.
+        /// </summary>
+        /// <param name="documentId">Id of the document to delete.</param>
+        /// <param name="force">If true, immutable documents are deleted too</param>
+        public void Delete(Guid documentId, bool force = false)
+        {
+            CheckUserDocId(documentId);
+            Authorize(AccessRights.Write, null, documentId);
+            lock (_pathWriteLock)
+            {
+                if (IsPinned(documentId)) throw new Exception($"Document {documentId} is pinned, and can't be deleted");
+                CheckReleasable(documentId, null, force);
+                foreach (var path in _pages.ListPathsForDocument(documentId)) { CheckMutable(path); }
+                _pages.DeletePathsForDocument(documentId);
+                _pages.RemoveFromIndex(documentId);
+                _pages.DeleteDocument(documentId);
+                if (force) ForgetImmutable(documentId);
+                ForgetAccessControl(documentId);
+                ForgetSchema(documentId);
+                Audit(AuditOperation.DeleteDocument, null, documentId);
+            }
+        }
+        
+        /// <summary>
+        /// Delete a document from the database, and unbind all paths to it.
+        /// If the document does not exist, the request will be silently ignored.
+        /// Throws an exception if the document is pinned, or is immutable and `force` is not set.
+        /// </summary>
+        /// <param name="path">Any path that the document is bound to</param>
+        /// <param name="force">If true, immutable documents are deleted too</param>
+        public void Delete(string path, bool force = false)
+        {
+            CheckUserPath(path);
+            DeleteAt(path, force);
+        }
+
+        private void DeleteAt(string path, bool force = false)
+        {
+            lock (_pathWriteLock)
+            {
+                var id = _pages.GetDocumentIdByPath(path);
+                Authorize(AccessRights.Write, path, id);
+                foreach (var bound in _pages.ListPathsForDocument(id)) { CheckMutable(bound); }
+                if (IsPinned(id)) throw new Exception($"Document {id} is pinned, and can't be deleted");
+                CheckReleasable(id, null, force);
+                _pages.DeletePathsForDocument(id);
+                _pages.RemoveFromIndex(id);
+                _pages.DeleteDocument(id);
+                if (force) ForgetImmutable(id);
+                ForgetAccessControl(id);
+                ForgetSchema(id);
+                if (id != Guid.Empty) Audit(AuditOperation.DeleteDocument, path, id);
+            }
+        }
+
+        [NotNull]private readonly object _trashLock = new object();
+
+        /// <summary>
+        /// Unbind a path, keeping the document so it can be restored with `Undelete`.
+        /// The document's pages are only released when the trash entry is purged.
+        /// If the path is not bound, the request will be silently ignored.
+        /// </summary>
+        /// <param name="path">Path to delete</param>
+        public void SoftDelete(string path)
+        {
+            CheckUserPath(path);
+            Authorize(AccessRights.Write, path, Guid.Empty);
+            CheckMutable(path);
+            lock (_trashLock)
+            {
+                var id = _pages.GetDocumentIdByPath(path);
+                if (id == Guid.Empty) return;
+
+                var trash = ReadTrash();
+                trash.Entries.Add(new TrashEntry { Path = path, DocumentId = id, DeletedAt = DateTime.UtcNow });
+                WriteTrash(trash);
+                lock (_pathWriteLock)
+                {
+                    _pages.DeleteSinglePathForDocument(id, path);
+                    Audit(AuditOperation.SoftDelete, path, id);
+                }
+
+                if (_trashRetention != null) PurgeTrash(_trashRetention.Value);
+            }
+        }
+
+        /// <summary>
+        /// Restore the most recently soft-deleted document at a path.
+        /// If another document has since been written to the path, it is replaced.
+        /// Returns true if a document was restored, false if there was nothing in the trash for the path.
+        /// </summary>
+        public bool Undelete(string path)
+        {
+            lock (_trashLock)
+            {
+                var trash = ReadTrash();
+                var entry = trash.Entries.Where(e => e.Path == path).OrderByDescending(e => e.DeletedAt).FirstOrDefault();
+                if (entry == null) return false;
+                Authorize(AccessRights.Write, path, Guid.Empty);
+
+                trash.Entries.Remove(entry);
+                WriteTrash(trash);
+
+                if (_pages.ReadDocument(entry.DocumentId) == null) return false; // document was removed some other way
+                lock (_pathWriteLock)
+                {
+                    BindNewDocument(path, entry.DocumentId);
+                    Audit(AuditOperation.Undelete, path, entry.DocumentId);
+                }
+                return true;
+            }
+        }
+
+        /// <summary>
+        /// List all soft-deleted path bindings, oldest first
+        /// </summary>
+        [NotNull, ItemNotNull]
+        public IEnumerable<TrashEntry> ListTrash()
+        {
+            lock (_trashLock)
+            {
+                return ReadTrash().Entries.OrderBy(e => e.DeletedAt).ToList();
+            }
+        }
+
+        /// <summary>
+        /// Permanently delete trash entries older than the given age.
+        /// Documents are released once no paths or trash entries refer to them.
+        /// Returns the number of entries purged.
+        /// </summary>
+        /// <param name="olderThan">Minimum age of entries to purge. Use `TimeSpan.Zero` to empty the trash</param>
+        public int PurgeTrash(TimeSpan olderThan)
+        {
+            lock (_trashLock)
+            {
+                var cutoff = DateTime.UtcNow - olderThan;
+                var trash = ReadTrash();
+                var expired = trash.Entries.Where(e => e.DeletedAt <= cutoff).ToList();
+                if (expired.Count < 1) return 0;
+
+                foreach (var entry in expired) { trash.Entries.Remove(entry); }
+                WriteTrash(trash); // update the trash first, so a failure can only leak pages
+
+                foreach (var id in expired.Select(e => e.DocumentId).Distinct())
+                {
+                    if (trash.Entries.Any(e => e.DocumentId == id)) continue;
+                    if (_pages.ListPathsForDocument(id).Any()) continue;
+                    if (IsPinned(id) || IsImmutable(id)) continue;
+                    _pages.DeleteDocument(id);
+                    ForgetSchema(id);
+                    Audit(AuditOperation.DeleteDocument, null, id);
+                }
+                Audit(AuditOperation.PurgeTrash, null, Guid.Empty, expired.Count);
+                return expired.Count;
+            }
+        }
+
+        [NotNull]private TrashList ReadTrash()
+        {
+            var trash = new TrashList();
+            var stream = _pages.ReadDocument(ReservedDocIds.Trash);
+            if (stream != null) trash.Defrost(stream);
+            return trash;
+        }
+
+        private void WriteTrash([NotNull]TrashList trash)
+        {
+            _pages.WriteDocumentVersion(ReservedDocIds.Trash, trash.Freeze());
+            BindSystemRecord(SystemDocuments.TrashName, ReservedDocIds.Trash);
+        }
+
+        [NotNull]private readonly object _pinLock = new object();
+
+        /// <summary>
+        /// Protect a document from being deleted or released by maintenance (such as trash purges or path replacement).
+        /// Pins are stored in the database, so they persist across connections.
+        /// </summary>
+        /// <param name="documentId">Id of the document to protect</param>
+        public void Pin(Guid documentId)
+        {
+            CheckUserDocId(documentId);
+            lock (_pinLock)
+            {
+                var pins = ReadPins();
+                if (pins.DocumentIds.Add(documentId)) WritePins(pins);
+                Audit(AuditOperation.Pin, null, documentId);
+            }
+        }
+
+        /// <summary>
+        /// Remove the protection added by `Pin`.
+        /// If the document is not pinned, the request will be silently ignored.
+        /// </summary>
+        /// <param name="documentId">Id of a pinned document</param>
+        public void Unpin(Guid documentId)
+        {
+            CheckUserDocId(documentId);
+            lock (_pinLock)
+            {
+                var pins = ReadPins();
+                if (pins.DocumentIds.Remove(documentId)) WritePins(pins);
+                Audit(AuditOperation.Unpin, null, documentId);
+            }
+        }
+
+        /// <summary>
+        /// Returns true if the document has been pinned
+        /// </summary>
+        public bool IsPinned(Guid documentId)
+        {
+            if (documentId == Guid.Empty || ReservedDocIds.IsReserved(documentId)) return false;
+            lock (_pinLock)
+            {
+                return ReadPins().DocumentIds.Contains(documentId);
+            }
+        }
+
+        [NotNull]private PinList ReadPins()
+        {
+            var pins = new PinList();
+            var stream = _pages.ReadDocument(ReservedDocIds.Pins);
+            if (stream != null) pins.Defrost(stream);
+            return pins;
+        }
+
+        private void WritePins([NotNull]PinList pins)
+        {
+            _pages.WriteDocumentVersion(ReservedDocIds.Pins, pins.Freeze());
+            BindSystemRecord(SystemDocuments.PinsName, ReservedDocIds.Pins);
+        }
+
+        [NotNull]private readonly object _tempLock = new object();
+
+        /// <summary>
+        /// Store a document with no path, for staging work like "upload, then commit". Returns its document ID.
+        /// Bind it with `BindToPath` to keep it. If it is not bound to any path (or pinned) when this connection is disposed,
+        /// it is deleted. If the connection is never disposed (for example, the process crashed), it is deleted the next time the database is opened.
+        /// </summary>
+        /// <remarks>Opening the database releases unbound temporary documents from every connection, so don't stage
+        /// documents in one connection while another connection to the same storage is being opened.</remarks>
+        /// <param name="data">Stream containing document data. It will be read from current position to end.</param>
+        public Guid PutTemp(Stream? data)
+        {
+            if (data == null) throw new ArgumentNullException(nameof(data));
+            Authorize(AccessRights.Write, null, Guid.Empty);
+            data = CheckBeforePut(null, null, BindingAttributes.None, data);
+
+            lock (_tempLock)
+            {
+                var id = WriteTemp(data);
+                Audit(AuditOperation.WriteDocument, null, id);
+                return id;
+            }
+        }
+
+        /// <summary>
+        /// Write a document with no path, and add it to the temporary list so it is released if never bound
+        /// </summary>
+        private Guid WriteTemp([NotNull]Stream data)
+        {
+            lock (_tempLock)
+            {
+                var id = _pages.WriteDocument(data);
+                var temps = ReadTemps();
+                temps.DocumentIds.Add(id);
+                _pages.WriteDocumentVersion(ReservedDocIds.Temps, temps.Freeze());
+                return id;
+            }
+        }
+
+        /// <summary>
+        /// Remove documents from the temporary list, without deleting them
+        /// </summary>
+        private void ForgetTemps([NotNull]ICollection<Guid> documentIds)
+        {
+            if (documentIds.Count < 1) return;
+            lock (_tempLock)
+            {
+                var temps = ReadTemps();
+                temps.DocumentIds.ExceptWith(documentIds);
+                _pages.WriteDocumentVersion(ReservedDocIds.Temps, temps.Freeze());
+            }
+        }
+
+        /// <summary>
+        /// Delete temporary documents (see `PutTemp`) that were never bound to a path or pinned, and clear the list.
+        /// Upload sessions older than `DatabaseOptions.UploadExpiry` are released too.
+        /// </summary>
+        private void ReleaseTemps()
+        {
+            if (!_canWrite) return;
+            var expired = _pages.ReleaseUploads(DateTime.UtcNow - _uploadExpiry);
+            if (expired > 0) _logger.Debug("Released expired upload sessions", "count", expired);
+            lock (_tempLock)
+            {
+                var temps = ReadTemps();
+                if (temps.DocumentIds.Count < 1) return;
+
+                foreach (var id in temps.DocumentIds)
+                {
+                    if (_pages.ListPathsForDocument(id).Any() || IsPinned(id)) continue; // committed
+                    _pages.DeleteDocument(id);
+                    ForgetSchema(id);
+                    Audit(AuditOperation.DeleteDocument, null, id);
+                }
+                _pages.WriteDocumentVersion(ReservedDocIds.Temps, new TempList().Freeze());
+            }
+        }
+
+        [NotNull]private TempList ReadTemps()
+        {
+            var temps = new TempList();
+            var stream = _pages.ReadDocument(ReservedDocIds.Temps);
+            if (stream != null) temps.Defrost(stream);
+            return temps;
+        }
+
+        /// <summary>
+        /// Start a set of writes, binds and deletes that become visible together when committed. See `Transaction`.
+        /// Dispose of the transaction to roll it back if it is not committed.
+        /// </summary>
+        [NotNull]public Transaction Begin()
+        {
+            return new Transaction(this);
+        }
+
+        /// <summary>
+        /// Write the data for a transaction's `Write`. The document is held in the temporary list until the transaction finishes.
+        /// </summary>
+        [NotNull]internal TransactionStep StageDocument([NotNull]string path, Stream? data, string? annotation, BindingAttributes attributes)
+        {
+            if (data == null) throw new ArgumentNullException(nameof(data));
+            CheckUserPath(path);
+            Authorize(AccessRights.Write, path, Guid.Empty);
+            data = CheckBeforePut(path, annotation, attributes, data);
+            var size = data.CanSeek ? data.Length - data.Position : (data as KnownLengthStream)?.Length ?? 0;
+            var id = WriteTemp(data);
+            return new TransactionStep { Operation = TransactionOperation.Write, Path = path, DocumentId = id, Annotation = annotation, Attributes = attributes, Size = size };
+        }
+
+        /// <summary>
+        /// Apply a transaction's steps as a single change to the path lookup.
+        /// All checks are made before anything is changed. Documents left with no paths are then deleted,
+        /// as they would be if the same changes were made one at a time.
+        /// </summary>
+        internal void CommitTransaction([NotNull, ItemNotNull]IList<TransactionStep> steps)
+        {
+            var staged = steps.Where(s => s.Operation == TransactionOperation.Write).Select(s => s.DocumentId).ToList();
+            lock (_pathWriteLock)
+            {
+                var changes = new List<BindingInfo>();
+                var changeSteps = new List<TransactionStep>();
+                foreach (var step in steps)
+                {
+                    if (step.Operation == TransactionOperation.Delete)
+                    {
+                        var id = _pages.GetDocumentIdByPath(step.Path);
+                        step.DocumentId = id;
+                        if (id == Guid.Empty) continue;
+                        Authorize(AccessRights.Write, step.Path, id);
+                        if (IsPinned(id)) throw new Exception($"Document {id} is pinned, and can't be deleted");
+                        CheckReleasable(id, null, false);
+                        foreach (var bound in _pages.ListPathsForDocument(id).ToList())
+                        {
+                            CheckMutable(bound);
+                            changes.Add(new BindingInfo { Path = bound, DocumentId = Guid.Empty });
+                            changeSteps.Add(step);
+                        }
+                        continue;
+                    }
+
+                    Authorize(AccessRights.Write, step.Path, Guid.Empty);
+                    CheckMutable(step.Path);
+                    CheckReplaceable(step.Path);
+                    changes.Add(new BindingInfo { Path = step.Path, DocumentId = step.DocumentId, Annotation = step.Annotation, Attributes = step.Attributes });
+                    changeSteps.Add(step);
+                }
+
+                var previous = _pages.ApplyPathChanges(changes);
+
+                foreach (var step in steps)
+                {
+                    switch (step.Operation)
+                    {
+                        case TransactionOperation.Write: Audit(AuditOperation.WriteDocument, step.Path, step.DocumentId, step.Size); break;
+                        case TransactionOperation.Bind: Audit(AuditOperation.BindPath, step.Path, step.DocumentId); break;
+                        case TransactionOperation.Delete: if (step.DocumentId != Guid.Empty) Audit(AuditOperation.DeleteDocument, step.Path, step.DocumentId); break;
+                    }
+                }
+
+                // Binding a path to an existing document leaves the replaced one alone, as `BindToPath` does
+                var released = new HashSet<Guid>(staged);
+                for (int i = 0; i < changes.Count; i++)
+                {
+                    if (changeSteps[i].Operation != TransactionOperation.Bind) released.Add(previous[i]);
+                }
+
+                var deleted = new HashSet<Guid>(steps.Where(s => s.Operation == TransactionOperation.Delete).Select(s => s.DocumentId));
+                foreach (var id in released)
+                {
+                    if (id == Guid.Empty || _pages.ListPathsForDocument(id).Any() || IsPinned(id)) continue;
+                    if (deleted.Contains(id))
+                    {
+                        _pages.DeleteDocument(id);
+                        ForgetAccessControl(id);
+                        ForgetSchema(id);
+                        continue;
+                    }
+                    if (IsImmutable(id)) continue;
+                    _pages.DeleteDocument(id);
+                    ForgetSchema(id);
+                    Audit(AuditOperation.DeleteDocument, null, id);
+                }
+            }
+            ForgetTemps(staged);
+        }
+
+        /// <summary>
+        /// Release the documents written by a transaction that was not committed
+        /// </summary>
+        internal void RollbackTransaction([NotNull, ItemNotNull]IList<TransactionStep> steps)
+        {
+            var staged = steps.Where(s => s.Operation == TransactionOperation.Write).Select(s => s.DocumentId).ToList();
+            foreach (var id in staged)
+            {
+                if (_pages.ListPathsForDocument(id).Any()) continue; // bound outside the transaction with `BindToPath`
+                _pages.DeleteDocument(id);
+            }
+            ForgetTemps(staged);
+        }
+
+        [NotNull]private readonly object _accessLock = new object();
+
+        /// <summary>
+        /// Store an owner and access grants for a document, replacing any already stored.
+        /// Pass null to remove them. These are passed to the `IAuthorizer` set in `DatabaseOptions`, which decides what they allow.
+        /// Changing access control needs `AccessRights.Admin`.
+        /// </summary>
+        /// <param name="documentId">Id of the document</param>
+        /// <param name="control">Owner and grants, or null</param>
+        public void SetAccessControl(Guid documentId, AccessControl? control)
+        {
+            if (documentId == Guid.Empty) throw new ArgumentException("Document ID must not be empty", nameof(documentId));
+            CheckUserDocId(documentId);
+            lock (_accessLock)
+            {
+                Authorize(AccessRights.Admin, null, documentId);
+                var list = ReadAccessList();
+                if (control == null)
+                {
+                    if (!list.Entries.Remove(documentId)) return;
+                }
+                else
+                {
+                    list.Entries[documentId] = control;
+                }
+                WriteAccessList(list);
+            }
+        }
+
+        /// <summary>
+        /// Read the owner and access grants stored for a document.
+        /// Returns null if none have been set.
+        /// </summary>
+        public AccessControl? GetAccessControl(Guid documentId)
+        {
+            if (documentId == Guid.Empty || ReservedDocIds.IsReserved(documentId)) return null;
+            lock (_accessLock)
+            {
+                return ReadAccessList().Entries.TryGetValue(documentId, out var control) ? control : null;
+            }
+        }
+
+        /// <summary>
+        /// Drop the access control of a deleted document
+        /// </summary>
+        private void ForgetAccessControl(Guid documentId)
+        {
+            if (documentId == Guid.Empty) return;
+            lock (_accessLock)
+            {
+                var list = ReadAccessList();
+                if (list.Entries.Remove(documentId)) WriteAccessList(list);
+            }
+        }
+
+        [NotNull]private AccessList ReadAccessList()
+        {
+            var list = new AccessList();
+            var stream = _pages.ReadDocument(ReservedDocIds.Access);
+            if (stream != null) list.Defrost(stream);
+            return list;
+        }
+
+        private void WriteAccessList([NotNull]AccessList list)
+        {
+            _pages.WriteDocumentVersion(ReservedDocIds.Access, list.Freeze());
+        }
+
+        /// <summary>
+        /// Throws `UnauthorizedAccessException` if the `IAuthorizer` refuses the operation
+        /// </summary>
+        /// <param name="rights">Rights the operation needs</param>
+        /// <param name="path">Path the caller gave, if any</param>
+        /// <param name="documentId">Document the operation applies to. If empty, this is looked up from the path</param>
+        private void Authorize(AccessRights rights, string? path, Guid documentId)
+        {
+            if (!IsAuthorized(rights, path, documentId))
+            {
+                throw new UnauthorizedAccessException($"{rights} access to '{path ?? documentId.ToString()}' was refused");
+            }
+        }
+
+        private bool IsAuthorized(AccessRights rights, string? path, Guid documentId)
+        {
+            if (_authorizer == null || IsSystemPath(path)) return true;
+            if (documentId == Guid.Empty && path != null) documentId = _pages.GetDocumentIdByPath(path);
+
+            return _authorizer.Authorize(new AccessRequest {
+                Rights = rights,
+                Path = path,
+                DocumentId = documentId,
+                Control = GetAccessControl(documentId)
+            });
+        }
+
+        /// <summary>
+        /// Move a document's data to the cold storage given in `DatabaseOptions.ColdStorage`.
+        /// The document keeps its ID and paths, and can still be read as normal.
+        /// If the document is already cold, nothing happens.
+        /// </summary>
+        /// <param name="documentId">Id of the document to move</param>
+        public void Demote(Guid documentId)
+        {
+            CheckUserDocId(documentId);
+            _pages.MoveToTier(documentId, StorageTier.Cold);
+            Audit(AuditOperation.Demote, null, documentId);
+        }
+
+        /// <summary>
+        /// Move a demoted document's data back to the main storage.
+        /// If the document is already hot, nothing happens.
+        /// </summary>
+        /// <param name="documentId">Id of the document to move</param>
+        public void Promote(Guid documentId)
+        {
+            CheckUserDocId(documentId);
+            _pages.MoveToTier(documentId, StorageTier.Hot);
+            Audit(AuditOperation.Promote, null, documentId);
+        }
+
+        /// <summary>
+        /// Report which storage holds a document's data
+        /// </summary>
+        /// <param name="documentId">Id of an existing document</param>
+        public StorageTier GetTier(Guid documentId)
+        {
+            CheckUserDocId(documentId);
+            return _pages.GetTier(documentId);
+        }
+
+        /// <summary>
+        /// Create a fixed size document at the given path, for ring-buffer workloads like logs and telemetry.
+        /// Its pages are allocated once, and `AppendToFixedDocument` overwrites them in place, oldest data first.
+        /// If an existing document uses this path, it will be deleted.
+        /// </summary>
+        /// <param name="path">Path of the new document</param>
+        /// <param name="sizePages">Number of pages to allocate. Each page holds a little under 4KB</param>
+        public Guid CreateFixedDocument(string path, int sizePages)
+        {
+            if (path == null) throw new ArgumentNullException(nameof(path));
+            if (sizePages < 1) throw new ArgumentOutOfRangeException(nameof(sizePages), "Fixed documents must have at least one page");
+            CheckUserPath(path);
+            Authorize(AccessRights.Write, path, Guid.Empty);
+
+            var id = _pages.CreateFixedDocument(sizePages);
+            lock (_pathWriteLock)
+            {
+                BindNewDocument(path, id);
+                Audit(AuditOperation.WriteDocument, path, id, (long)sizePages * UploadPartAlignment);
+            }
+            return id;
+        }
+
+        /// <summary>
+        /// Append data to a fixed document. When the document is full, the oldest data is overwritten.
+        /// A single append must fit in the document.
+        /// </summary>
+        /// <param name="path">Path of a document created with `CreateFixedDocument`</param>
+        /// <param name="data">Bytes to append</param>
+        public void AppendToFixedDocument(string path, byte[] data)
+        {
+            if (data == null) throw new ArgumentNullException(nameof(data));
+            var id = _pages.GetDocumentIdByPath(path);
+            if (id == Guid.Empty) throw new Exception($"No document at '{path}'");
+            Authorize(AccessRights.Write, path, id);
+            _pages.AppendToFixedDocument(id, data);
+        }
+
+        /// <summary>
+        /// Read the data currently held in a fixed document, oldest first.
+        /// Returns true if found, false if not found.
+        /// </summary>
+        public bool ReadFixedDocument(string path, out Stream? stream)
+        {
+            stream = null;
+
+            var id = _pages.GetDocumentIdByPath(path);
+            if (id == Guid.Empty) return false;
+            Authorize(AccessRights.Read, path, id);
+
+            stream = _pages.ReadFixedDocument(id);
+            return stream != null;
+        }
+
+        /// <summary>
+        /// Append a record to a circular log: a fixed document (see `CreateFixedDocument`) holding framed records.
+        /// When the log is full, the oldest records are overwritten. Returns the position of the new record.
+        /// </summary>
+        /// <param name="path">Path of a fixed document</param>
+        /// <param name="record">Record contents. Must not be empty, and must fit in the document</param>
+        public long AppendRecord(string path, byte[] record)
+        {
+            if (record == null) throw new ArgumentNullException(nameof(record));
+            var id = _pages.GetDocumentIdByPath(path);
+            if (id == Guid.Empty) throw new Exception($"No document at '{path}'");
+            Authorize(AccessRights.Write, path, id);
+            return _pages.AppendLogRecord(id, record);
+        }
+
+        /// <summary>
+        /// Read the records held in a circular log, oldest first.
+        /// Records that have been partly overwritten are skipped.
+        /// </summary>
+        /// <param name="path">Path of a fixed document written with `AppendRecord`</param>
+        /// <param name="since">Only return records at or after this position. See `LogRecord.Position`</param>
+        [NotNull, ItemNotNull]
+        public IEnumerable<LogRecord> ReadRecords(string path, long since = 0)
+        {
+            var id = _pages.GetDocumentIdByPath(path);
+            if (id == Guid.Empty) throw new Exception($"No document at '{path}'");
+            Authorize(AccessRights.Read, path, id);
+            return _pages.ReadLogRecords(id, since);
+        }
+
+        /// <summary>
+        /// Remove a single path binding for a document.
+        /// If the path is not currently bound to that document, the request will be silently ignored.
+        /// Throws an exception if this is the last path of an immutable document, and `force` is not set.
+        /// </summary>
+        /// <param name="documentId">Id of document currently bound to the path</param>
+        /// <param name="path">Path to unbind</param>
+        /// <param name="force">If true, the last path of an immutable document can be removed</param>
+        public void UnbindPath(Guid documentId, string path, bool force = false)
+        {
+            CheckUserPath(path);
+            CheckUserDocId(documentId);
+            Authorize(AccessRights.Write, path, documentId);
+            CheckMutable(path);
+            lock (_pathWriteLock)
+            {
+                if (_pages.GetDocumentIdByPath(path) == documentId) CheckReleasable(documentId, path, force);
+                _pages.DeleteSinglePathForDocument(documentId, path);
+                Audit(AuditOperation.UnbindPath, path, documentId);
+            }
+        }
+
+        /// <summary>
+        /// Write one entry of a time series. Entries are stored as normal documents, at a path made from the series name
+        /// and the timestamp (see `SeriesPath`), so they can be found by time with `ReadSeries`.
+        /// Writing a second entry with the same timestamp replaces the first.
+        /// </summary>
+        /// <param name="seriesName">Name of the series. This is used as a path prefix</param>
+        /// <param name="timestamp">Time of the entry. Converted to UTC</param>
+        /// <param name="data">Entry data. It will be read from current position to end.</param>
+        public Guid WriteSeries(string seriesName, DateTime timestamp, Stream? data)
+        {
+            return WriteDocument(SeriesPath(seriesName, timestamp), data);
+        }
+
+        /// <summary>
+        /// Read the entries of a time series with timestamps from `from` (inclusive) to `to` (exclusive), oldest first.
+        /// Each entry's data is opened as it is enumerated.
+        /// </summary>
+        /// <param name="seriesName">Name of the series</param>
+        /// <param name="from">Start of the time range (inclusive)</param>
+        /// <param name="to">End of the time range (exclusive)</param>
+        [NotNull, ItemNotNull]
+        public IEnumerable<SeriesEntry> ReadSeries(string seriesName, DateTime from, DateTime to)
+        {
+            var prefix = SeriesPrefix(seriesName);
+            var fromTicks = from.ToUniversalTime().Ticks;
+            var toTicks = to.ToUniversalTime().Ticks;
+
+            var inRange = new List<KeyValuePair<long, string>>();
+            foreach (var path in Search(prefix))
+            {
+                if (!long.TryParse(path.Substring(prefix.Length), out var ticks)) continue; // not a series entry
+                if (ticks >= fromTicks && ticks < toTicks) inRange.Add(new KeyValuePair<long, string>(ticks, path));
+            }
+
+            foreach (var entry in inRange.OrderBy(e => e.Key))
+            {
+                if (!GetIdByPath(entry.Value, out var id)) continue; // removed since the search
+                Authorize(AccessRights.Read, entry.Value, id);
+                yield return new SeriesEntry {
+                    Timestamp = new DateTime(entry.Key, DateTimeKind.Utc),
+                    Path = entry.Value,
+                    DocumentId = id,
+                    Data = _pages.ReadDocument(id)
+                };
+            }
+        }
+
+        /// <summary>
+        /// Path used to store a time series entry: the series name, a separator, and the UTC timestamp
+        /// as zero-padded ticks, so paths sort in time order.
+        /// </summary>
+        [NotNull]public static string SeriesPath(string seriesName, DateTime timestamp)
+        {
+            return SeriesPrefix(seriesName) + timestamp.ToUniversalTime().Ticks.ToString("D19");
+        }
+
+        [NotNull]private static string SeriesPrefix(string seriesName)
+        {
+            if (string.IsNullOrEmpty(seriesName)) throw new ArgumentException("Series name must not be empty", nameof(seriesName));
+            return seriesName + "/@";
+        }
+
+        /// <summary>
+        /// Given the start of a path string, returns all matching paths that have a document bound to them
+        /// </summary>
+        /// <param name="pathPrefix">Start of a path string</param>
+        /// <param name="includeHidden">If true, include hidden and system paths (see `BindingAttributes`), and paths under `SystemNamespace`</param>
+        [NotNull, ItemNotNull]
+        public IEnumerable<string> Search(string pathPrefix, bool includeHidden = false)
+        {
+            var paths = _pages.SearchPaths(pathPrefix);
+            return includeHidden ? paths : paths.Where(p => !IsHiddenPath(p));
+        }
+
+        /// <summary>
+        /// Given the end of a path string (such as a file extension), returns all matching paths that have a document bound to them.
+        /// This follows the path lookup's reverse links from each path end, rather than checking every path.
+        /// </summary>
+        /// <param name="pathSuffix">End of a path string. Must not be empty</param>
+        /// <param name="includeHidden">If true, include hidden and system paths (see `BindingAttributes`), and paths under `SystemNamespace`</param>
+        [NotNull, ItemNotNull]
+        public IEnumerable<string> SearchSuffix(string pathSuffix, bool includeHidden = false)
+        {
+            if (string.IsNullOrEmpty(pathSuffix)) throw new ArgumentException("Suffix must not be empty", nameof(pathSuffix));
+            var paths = _pages.SearchPathSuffix(pathSuffix);
+            return includeHidden ? paths : paths.Where(p => !IsHiddenPath(p));
+        }
+
+        /// <summary>
+        /// Given the start of a path string, return one page of matching paths, in the order of the database's `Collation`.
+        /// Pass the returned `Cursor` back in to get the next page, until it comes back null.
+        /// <para></para>
+        /// The cursor holds the last path returned, so it stays valid across restarts and other connections, and a scan
+        /// resumes after that path even if it has since been unbound. Paths bound behind the cursor during a scan are not seen.
+        /// </summary>
+        /// <param name="pathPrefix">Start of a path string</param>
+        /// <param name="pageSize">Maximum number of paths to return</param>
+        /// <param name="cursor">Cursor from the previous page, or null to start from the beginning</param>
+        /// <param name="includeHidden">If true, include hidden and system paths (see `BindingAttributes`), and paths under `SystemNamespace`</param>
+        [NotNull]public SearchResultPage SearchPaged(string pathPrefix, int pageSize, string? cursor = null, bool includeHidden = false)
+        {
+            if (pathPrefix == null) throw new ArgumentNullException(nameof(pathPrefix));
+            if (pageSize < 1) throw new ArgumentOutOfRangeException(nameof(pageSize), "Page size must be at least one");
+
+            var after = cursor == null ? null : DecodeSearchCursor(cursor, pathPrefix);
+            var matches = Search(pathPrefix, includeHidden);
+            if (after != null) matches = matches.Where(p => _collation.Compare(p, after) > 0);
+
+            var page = new SearchResultPage();
+            page.Paths.AddRange(matches.OrderBy(p => p, _collation).Take(pageSize + 1));
+            if (page.Paths.Count > pageSize)
+            {
+                page.Paths.RemoveAt(pageSize);
+                page.Cursor = EncodeSearchCursor(pathPrefix, page.Paths[pageSize - 1]);
+            }
+            return page;
+        }
+
+        /// <summary>
+        /// List bound paths from `startPath` (inclusive) up to `endPath` (exclusive), in the order of the database's `Collation`.
+        /// Unlike `Search`, the range does not have to share a prefix, so this can scan any slice of the path space.
+        /// </summary>
+        /// <param name="startPath">First path in the range. Use "" to start from the beginning</param>
+        /// <param name="endPath">Path after the end of the range, or null to run to the end</param>
+        /// <param name="limit">Maximum number of paths to return</param>
+        /// <param name="includeHidden">If true, include hidden and system paths (see `BindingAttributes`), and paths under `SystemNamespace`</param>
+        [NotNull, ItemNotNull]
+        public List<string> ListRange([NotNull]string startPath, string? endPath, int limit, bool includeHidden = false)
+        {
+            if (startPath == null) throw new ArgumentNullException(nameof(startPath));
+            if (limit < 1) throw new ArgumentOutOfRangeException(nameof(limit), "Limit must be at least one");
+            if (endPath != null && _collation.Compare(startPath, endPath) >= 0) return new List<string>();
+
+            // In ordinal order, every path in the range starts with the common prefix of its ends, so the search can be narrowed
+            var prefix = "";
+            if (_collation == PathCollation.Ordinal && endPath != null)
+            {
+                var length = 0;
+                while (length < startPath.Length && length < endPath.Length && startPath[length] == endPath[length]) length++;
+                prefix = startPath.Substring(0, length);
+            }
+
+            return Search(prefix, includeHidden)
+                .Where(p => _collation.Compare(p, startPath) >= 0 && (endPath == null || _collation.Compare(p, endPath) < 0))
+                .OrderBy(p => p, _collation)
+                .Take(limit)
+                .ToList();
+        }
+
+        private const string SearchCursorVersion = "1";
+
+        [NotNull]private static string EncodeSearchCursor([NotNull]string pathPrefix, [NotNull]string lastPath)
+        {
+            return SearchCursorVersion + ":" + Convert.ToBase64String(Encoding.UTF8.GetBytes(pathPrefix + "\0" + lastPath));
+        }
+
+        [NotNull]private static string DecodeSearchCursor([NotNull]string cursor, [NotNull]string pathPrefix)
+        {
+            string decoded;
+            try
+            {
+                if (!cursor.StartsWith(SearchCursorVersion + ":")) throw new FormatException();
+                decoded = Encoding.UTF8.GetString(Convert.FromBase64String(cursor.Substring(SearchCursorVersion.Length + 1)));
+            }
+            catch (FormatException)
+            {
+                throw new ArgumentException("Search cursor is not valid", nameof(cursor));
+            }
+            if (!decoded.StartsWith(pathPrefix + "\0", StringComparison.Ordinal)) throw new ArgumentException("Search cursor belongs to a search with a different prefix", nameof(cursor));
+            return decoded.Substring(pathPrefix.Length + 1);
+        }
+
+        /// <summary>
+        /// Unbind every path starting with the given prefix. Documents left with no paths are deleted, unless pinned.
+        /// Immutable paths, the last paths of immutable documents, and paths under `SystemNamespace` are always kept,
+        /// as are paths the `IAuthorizer` does not allow writing to.
+        /// Returns the number of paths removed.
+        /// </summary>
+        /// <param name="pathPrefix">Start of a path string</param>
+        /// <param name="includeHidden">If true, hidden and system paths (see `BindingAttributes`) are removed too</param>
+        public int DeletePrefix(string pathPrefix, bool includeHidden = false)
+        {
+            if (pathPrefix == null) throw new ArgumentNullException(nameof(pathPrefix));
+
+            var removed = 0;
+            lock (_pathWriteLock)
+            {
+                foreach (var path in Search(pathPrefix, includeHidden).ToList())
+                {
+                    if (IsSystemPath(path)) continue;
+                    var binding = _pages.GetBindingInfo(path);
+                    if (binding == null || (binding.Attributes & BindingAttributes.Immutable) != 0) continue;
+                    if (IsImmutable(binding.DocumentId) && !_pages.ListPathsForDocument(binding.DocumentId).Any(p => p != path)) continue;
+                    if (!IsAuthorized(AccessRights.Write, path, binding.DocumentId)) continue;
+
+                    _pages.DeleteSinglePathForDocument(binding.DocumentId, path);
+                    Audit(AuditOperation.UnbindPath, path, binding.DocumentId);
+                    removed++;
+
+                    if (_pages.ListPathsForDocument(binding.DocumentId).Any() || IsPinned(binding.DocumentId)) continue;
+                    _pages.DeleteDocument(binding.DocumentId);
+                    ForgetSchema(binding.DocumentId);
+                    Audit(AuditOperation.DeleteDocument, path, binding.DocumentId);
+                }
+            }
+            return removed;
+        }
+
+        /// <summary>
+        /// Copy documents into a new database, keeping only those with a path that passes the filter
+        /// (to extract one tenant's data, or produce a trimmed copy for support, for example).
+        /// Each document is written once, however many of its paths match, and the matching paths are bound to it with their
+        /// annotations and attributes. Immutable documents stay immutable, and codec schema IDs are kept. Paths under `SystemNamespace` are not copied.
+        /// <para></para>
+        /// Only live data is written, so the copy has no free pages or old versions.
+        /// Returns the number of documents copied.
+        /// </summary>
+        /// <param name="destination">Empty, seekable, writable stream for the new database. It is flushed but left open</param>
+        /// <param name="filter">Returns true for paths to copy. If null, every path is copied</param>
+        public int CloneTo([NotNull]Stream destination, Func<string, bool>? filter = null)
+        {
+            if (destination == null) throw new ArgumentNullException(nameof(destination));
+            if (!destination.CanSeek || !destination.CanRead || !destination.CanWrite) throw new ArgumentException("Clone destination must support seeking, reading and writing", nameof(destination));
+            if (destination.Length != 0) throw new ArgumentException("Clone destination must be empty", nameof(destination));
+
+            var target = new Database(destination, null);
+            var copied = new Dictionary<Guid, Guid>(); // source ID => target ID
+            foreach (var path in Search("", includeHidden: true))
+            {
+                if (IsSystemPath(path)) continue;
+                if (filter != null && !filter(path)) continue;
+
+                var binding = _pages.GetBindingInfo(path);
+                if (binding == null) continue; // removed since the search
+
+                if (copied.TryGetValue(binding.DocumentId, out var targetId))
+                {
+                    target.BindToPath(targetId, path, binding.Annotation, binding.Attributes);
+                    continue;
+                }
+
+                var data = _pages.ReadDocument(binding.DocumentId) ?? new MemoryStream(new byte[0]);
+                var schema = SchemaOf(binding);
+                if (IsImmutable(binding.DocumentId))
+                {
+                    targetId = target.WriteImmutableDocument(path, data, binding.Annotation);
+                    if (binding.Attributes != BindingAttributes.None) target.SetAttributes(path, binding.Attributes);
+                    if (schema != null) target.SetSchema(targetId, schema);
+                }
+                else
+                {
+                    targetId = target.WriteDocumentAt(path, data, binding.Annotation, binding.Attributes, schema);
+                }
+                copied.Add(binding.DocumentId, targetId);
+            }
+
+            target._writer?.Dispose();
+            target.Flush();
+            return copied.Count;
+        }
+
+        /// <summary>
+        /// Open an isolated, writable copy of this database, for what-if changes or parallel tests from one seeded store.
+        /// Storage pages are shared until either database writes to them (see `CopyOnWriteMemoryStream`), so this is cheap
+        /// even for large stores. Changes to either database are not seen by the other.
+        /// Dispose the copy when it is no longer needed, so pages only this database still uses stop being shared.
+        /// <para></para>
+        /// The database must be stored in a `CopyOnWriteMemoryStream`. Writes still in progress on other threads when the fork
+        /// is taken may leave allocated but unused pages in the copy.
+        /// </summary>
+        /// <param name="options">Settings for the copy. If null, defaults are used</param>
+        [NotNull]public Database ForkInMemory(DatabaseOptions? options = null)
+        {
+            if (!(_fs is CopyOnWriteMemoryStream memory)) throw new InvalidOperationException("Only databases stored in a CopyOnWriteMemoryStream can be forked");
+            return TryConnect(memory.Fork(), options);
+        }
+
+        /// <summary>
+        /// Number of documents stored, including system documents. A document bound to several paths is counted once.
+        /// This reads a counter kept with the index, so does not scan the database. `CheckIntegrity` corrects the counter if it has drifted.
+        /// </summary>
+        public long Count()
+        {
+            return _pages.CountDocuments();
+        }
+
+        /// <summary>
+        /// Read statistics for the database. This does not scan storage.
+        /// </summary>
+        /// <param name="totalPages">The number of pages in storage (based on storage size)</param>
+        /// <param name="freePages">The number of free pages that can be written without increasing storage</param>
+        public void CalculateStatistics(out int totalPages, out int freePages)
+        {
+            totalPages = (int) (_fs.Length / BasicPage.PageRawSize);
+            freePages = _pages.CountFreePages();
+        }
+
+        [NotNull]private readonly object _statsLock = new object();
+
+        /// <summary>
+        /// Write the current document and page counts as a JSON system document named `stats/` and the UTC time (see `SystemDocuments.StatsPrefix`),
+        /// so growth and fragmentation can be followed from the store itself. Only the newest `SystemDocuments.MaxStatsSnapshots` are kept.
+        /// This is called on a timer if `DatabaseOptions.StatsInterval` is set.
+        /// Returns the name of the snapshot document.
+        /// </summary>
+        [NotNull]public string WriteStatsSnapshot()
+        {
+            var now = DateTime.UtcNow;
+            CalculateStatistics(out var totalPages, out var freePages);
+            var documents = Count();
+            var freeFraction = totalPages > 0 ? (double)freePages / totalPages : 0.0;
+
+            var json = "{"
+                + "\"time\":\"" + now.ToString("yyyy-MM-ddTHH:mm:ssZ", CultureInfo.InvariantCulture) + "\","
+                + "\"documents\":" + documents.ToString(CultureInfo.InvariantCulture) + ","
+                + "\"totalPages\":" + totalPages.ToString(CultureInfo.InvariantCulture) + ","
+                + "\"freePages\":" + freePages.ToString(CultureInfo.InvariantCulture) + ","
+                + "\"freeFraction\":" + freeFraction.ToString("0.####", CultureInfo.InvariantCulture)
+                + "}";
+
+            var name = SystemDocuments.StatsPrefix + now.ToString("yyyyMMddTHHmmssfffZ", CultureInfo.InvariantCulture);
+            SystemDocuments.Write(name, new MemoryStream(Encoding.UTF8.GetBytes(json)));
+
+            var old = SystemDocuments.ListStatsSnapshots().ToList();
+            for (int i = 0; i < old.Count - SystemDocuments.MaxStatsSnapshots; i++)
+            {
+                SystemDocuments.Delete(old[i]);
+            }
+            return name;
+        }
+
+        private void StartStatsSnapshots(TimeSpan? interval)
+        {
+            if (interval == null || !_canWrite) return;
+            if (interval.Value <= TimeSpan.Zero) throw new ArgumentException("Stats interval must be positive", nameof(interval));
+            _statsTimer = new Timer(_ => SnapshotOnTimer(), null, interval.Value, interval.Value);
+        }
+
+        private void SnapshotOnTimer()
+        {
+            lock (_statsLock)
+            {
+                if (_statsTimer == null) return; // disposed
+                try
+                {
+                    WriteStatsSnapshot();
+                }
+                catch (Exception ex)
+                {
+                    _logger.Warn("Failed to write stats snapshot", "error", ex.Message);
+                }
+            }
+        }
+
+        /// <summary>
+        /// Read every page of storage and check its CRC. This can take some time on large databases.
+        /// CRCs are always checked, even in quick-and-dirty mode.
+        /// </summary>
+        /// <param name="workers">Number of threads used to check pages</param>
+        [NotNull]public IntegrityReport CheckIntegrity(int workers = 4)
+        {
+            return _pages.CheckIntegrity(workers);
+        }
+
+        /// <summary>
+        /// Check the database is in a usable state, for service health probes and self-tests.
+        /// `Quick` checks the storage header and the pages it links to; `Standard` also spot-checks random pages;
+        /// `Deep` reads every page, as `CheckIntegrity` does.
+        /// This does not throw for damaged storage, but reports the problems found.
+        /// </summary>
+        /// <param name="level">How thoroughly to check</param>
+        [NotNull]public HealthReport HealthCheck(HealthCheckLevel level = HealthCheckLevel.Quick)
+        {
+            return _pages.HealthCheck(level);
+        }
+
+        /// <summary>
+        /// Cross-check path bindings against the document index. Every bound path should lead to a document in the index,
+        /// and (optionally) every document in the index should have at least one path, unless it is pinned, immutable,
+        /// temporary (see `PutTemp`) or in the trash. Pin documents that are deliberately kept without a path.
+        /// This reads every path and the whole index.
+        /// </summary>
+        /// <remarks>A document being written is in the index a moment before its path is bound,
+        /// so only repair unbound documents while no other writes are in progress.</remarks>
+        /// <param name="checkUnbound">If true, also look for documents with no paths</param>
+        /// <param name="repair">If true, unbind dangling paths and delete unbound documents.
+        /// Nothing is changed if the connection can't write</param>
+        [NotNull]public IndexConsistencyReport CheckIndexConsistency(bool checkUnbound = false, bool repair = false)
+        {
+            lock (_trashLock) // same lock order as `Undelete`
+            lock (_tempLock)
+            lock (_pathWriteLock)
+            {
+                var indexed = new HashSet<Guid>(_pages.ListDocumentIds());
+                var report = new IndexConsistencyReport { DocumentsChecked = indexed.Count };
+
+                var bound = new HashSet<Guid>();
+                var dangling = new List<BindingInfo>();
+                foreach (var path in _pages.SearchPaths("").ToList())
+                {
+                    var binding = _pages.GetBindingInfo(path);
+                    if (binding == null) continue;
+                    report.PathsChecked++;
+                    bound.Add(binding.DocumentId);
+                    if (indexed.Contains(binding.DocumentId) || ReservedDocIds.IsReserved(binding.DocumentId)) continue; // engine records bound under `SystemNamespace`
+                    report.DanglingPaths.Add(path);
+                    dangling.Add(binding);
+                }
+
+                if (checkUnbound)
+                {
+                    var kept = new HashSet<Guid>(ReadTemps().DocumentIds);
+                    kept.UnionWith(ReadTrash().Entries.Select(e => e.DocumentId));
+                    lock (_pinLock) { kept.UnionWith(ReadPins().DocumentIds); }
+                    lock (_immutableLock) { kept.UnionWith(ReadImmutables().DocumentIds); }
+                    report.UnboundDocuments.AddRange(indexed.Where(id => !bound.Contains(id) && !kept.Contains(id)).OrderBy(id => id));
+                }
+
+                if (!repair || !_canWrite || report.IsConsistent) return report;
+
+                foreach (var binding in dangling)
+                {
+                    _pages.DeleteSinglePathForDocument(binding.DocumentId, binding.Path);
+                    Audit(AuditOperation.UnbindPath, binding.Path, binding.DocumentId);
+                }
+                foreach (var id in report.UnboundDocuments)
+                {
+                    _pages.DeleteDocument(id);
+                    ForgetAccessControl(id);
+                    ForgetSchema(id);
+                    Audit(AuditOperation.DeleteDocument, null, id);
+                }
+                report.Repaired = true;
+                return report;
+            }
+        }
+
+        /// <summary>
+        /// Counts of document page reads and CRC checks since the database was opened, for judging a `DatabaseOptions.CrcSampleRate`.
+        /// Without sampling, every read is checked.
+        /// </summary>
+        [NotNull]public CrcSamplingStats CrcSamplingStatistics()
+        {
+            return _pages.CrcSampling();
+        }
+
+        /// <summary>
+        /// Report how scattered a document's pages are in storage: page count, runs of consecutive pages, the largest gap,
+        /// and an estimate of how much of a read is sequential. Use this to pick documents worth rewriting for locality.
+        /// For deduplicated documents, this covers the chunk list rather than the chunks.
+        /// Returns null if the document is not found.
+        /// </summary>
+        /// <param name="documentId">Id of the document to analyse</param>
+        public FragmentationReport? AnalyzeDocument(Guid documentId)
+        {
+            CheckUserDocId(documentId);
+            return _pages.AnalyzeDocument(documentId);
+        }
+
+        /// <summary>
+        /// Rewrite a fragmented document onto new contiguous pages, and release its old pages. The document keeps its ID,
+        /// paths and previous revision. This is a targeted alternative to compacting the whole database.
+        /// Storage grows by the document's size until the released pages are reused.
+        /// Returns false if the document was not found, or was already contiguous.
+        /// </summary>
+        /// <param name="documentId">Id of the document to rewrite. See `AnalyzeDocument`</param>
+        public bool OptimizeDocument(Guid documentId)
+        {
+            CheckUserDocId(documentId);
+            return _pages.OptimizeDocument(documentId);
+        }
+
+        /// <summary>
+        /// Count the pages used by each document's current data, and by the previous revision kept after each write.
+        /// Use this to judge what the two-revision safety net costs. This reads every document chain, so can take some time.
+        /// </summary>
+        [NotNull]public VersionReport VersionStatistics()
+        {
+            return _pages.VersionStatistics();
+        }
+
+        /// <summary>
+        /// Split the document index into 256 shards by the first byte of document IDs, so lookups in stores
+        /// with very many documents walk a short chain rather than the whole index.
+        /// The existing index is migrated in one step; databases without a sharded index keep working as before.
+        /// Returns false if the index was already sharded, or the storage engine has no index pages.
+        /// </summary>
+        public bool ShardIndex()
+        {
+            return _pages.ShardIndex();
+        }
+
+        /// <summary>
+        /// Release the previous revision kept for a document, reclaiming its space now rather than on the next write.
+        /// After this, a failed or torn write to the document can't fall back to the older copy.
+        /// Returns true if a previous revision was released.
+        /// This accepts the IDs of the engine's own records (such as `ReservedDocIds.Pins`), as their current revision is kept.
+        /// </summary>
+        /// <param name="documentId">Id of the document</param>
+        public bool PurgeOldVersions(Guid documentId)
+        {
+            Authorize(AccessRights.Write, null, documentId);
+            return _pages.PurgeOldVersion(documentId);
+        }
+
+        /// <summary>
+        /// Release the previous revision kept for every document, including system documents.
+        /// Use `VersionStatistics` to see how much this will reclaim.
+        /// Returns the number of revisions released.
+        /// </summary>
+        public int PurgeAllOldVersions()
+        {
+            return _pages.PurgeAllOldVersions();
+        }
+
+        /// <summary>
+        /// True if lookups have found and skipped damaged index pages since connecting.
+        /// Documents indexed in those pages can't be read. Use `CheckIntegrity` to find the damage.
+        /// </summary>
+        public bool NeedsRepair => _pages.NeedsRepair();
+
+        /// <summary>
+        /// Hash every bound path, sign the listing with an Ed25519 private key, and store it as the system document
+        /// `SystemDocuments.ManifestName`. Sign a database once it is complete, such as an asset bundle about to be shipped.
+        /// Readers can then check it with `VerifyManifest`, or on open with `DatabaseOptions.ManifestKey`.
+        /// Any later change to a path makes the manifest fail, until it is signed again.
+        /// </summary>
+        /// <param name="privateKey">32 byte Ed25519 private key</param>
+        public void SignManifest([NotNull]byte[] privateKey)
+        {
+            if (privateKey == null) throw new ArgumentNullException(nameof(privateKey));
+            if (privateKey.Length != Ed25519.KeySize) throw new ArgumentException($"Private key must be {Ed25519.KeySize} bytes", nameof(privateKey));
+
+            var manifest = new Manifest();
+            using (var sha = SHA256.Create())
+            {
+                foreach (var path in ManifestPaths())
+                {
+                    manifest.Entries[path] = HashPath(sha, path);
+                }
+            }
+            manifest.Signature = Ed25519.Sign(privateKey, manifest.SignedContent());
+            SystemDocuments.Write(SystemDocuments.ManifestName, manifest.Freeze());
+        }
+
+        /// <summary>
+        /// Check the stored manifest's signature against a public key, and every bound path against the manifest.
+        /// Paths under `SystemNamespace` are not included.
+        /// </summary>
+        /// <param name="publicKey">32 byte Ed25519 public key, matching the private key given to `SignManifest`</param>
+        [NotNull]public ManifestReport VerifyManifest([NotNull]byte[] publicKey)
+        {
+            if (publicKey == null) throw new ArgumentNullException(nameof(publicKey));
+
+            var report = new ManifestReport();
+            if (!SystemDocuments.Get(SystemDocuments.ManifestName, out var stream) || stream == null) return report;
+            report.ManifestFound = true;
+
+            var manifest = new Manifest();
+            using (stream) { manifest.Defrost(stream); }
+            report.SignatureValid = Ed25519.Verify(publicKey, manifest.SignedContent(), manifest.Signature);
+            if (!report.SignatureValid) return report; // contents can't be trusted
+
+            var bound = new HashSet<string>(ManifestPaths());
+            using (var sha = SHA256.Create())
+            {
+                foreach (var entry in manifest.Entries)
+                {
+                    if (!bound.Remove(entry.Key)) report.Missing.Add(entry.Key);
+                    else if (!HashPath(sha, entry.Key).SequenceEqual(entry.Value)) report.Changed.Add(entry.Key);
+                }
+            }
+            report.Unlisted.AddRange(bound.OrderBy(p => p, StringComparer.Ordinal));
+            return report;
+        }
+
+        /// <summary>
+        /// Start reading documents with checks against their stored records, so an export or backup fails on damaged data
+        /// rather than copying it. See `VerifiedReader`. The manifest, if any, is read once here.
+        /// </summary>
+        [NotNull]public VerifiedReader StartVerifiedRead()
+        {
+            IDictionary<string, byte[]> hashes = new Dictionary<string, byte[]>();
+            if (SystemDocuments.Get(SystemDocuments.ManifestName, out var stream) && stream != null)
+            {
+                var manifest = new Manifest();
+                using (stream) { manifest.Defrost(stream); }
+                hashes = manifest.Entries;
+            }
+            return new VerifiedReader(this, hashes);
+        }
+
+        /// <summary>
+        /// Start reading documents from a snapshot, with checks against their stored records. See `VerifiedReader`.
+        /// The manifest, if any, is read from the snapshot.
+        /// </summary>
+        /// <param name="snapshot">Snapshot taken from this database with `OpenSnapshot`</param>
+        [NotNull]public VerifiedReader StartVerifiedRead([NotNull]DatabaseSnapshot snapshot)
+        {
+            if (snapshot == null) throw new ArgumentNullException(nameof(snapshot));
+            IDictionary<string, byte[]> hashes = new Dictionary<string, byte[]>();
+            if (snapshot.Get(SystemDocuments.PathOf(SystemDocuments.ManifestName), out var stream) && stream != null)
+            {
+                var manifest = new Manifest();
+                using (stream) { manifest.Defrost(stream); }
+                hashes = manifest.Entries;
+            }
+            return new VerifiedReader(this, hashes, snapshot);
+        }
+
+        /// <summary>
+        /// Capture the database as it stands now: every path binding, and the data of every bound document.
+        /// Reads from the snapshot are not affected by writes made after it was taken, so exports built on it see a single
+        /// generation of the database even while writes continue. See `DatabaseSnapshot`.
+        /// <para></para>
+        /// Pages released while the snapshot is open are not reused until it is disposed. Documents changed in place
+        /// (fixed-size documents and the audit log) may still show later writes.
+        /// </summary>
+        [NotNull]public DatabaseSnapshot OpenSnapshot()
+        {
+            var snapshot = _pages.OpenSnapshot();
+            snapshot.AuthorizeRead = (path, id) => Authorize(AccessRights.Read, path, id);
+            snapshot.TrackStream = (path, s) => _streams.Track(s, path);
+            return snapshot;
+        }
+
+        [NotNull, ItemNotNull]private IEnumerable<string> ManifestPaths()
+        {
+            return _pages.SearchPaths("").Where(p => !IsSystemPath(p)).ToList();
+        }
+
+        [NotNull]private byte[] HashPath([NotNull]HashAlgorithm sha, [NotNull]string path)
+        {
+            var id = _pages.GetDocumentIdByPath(path);
+            var stream = id == Guid.Empty ? null : _pages.ReadDocument(id);
+            return sha.ComputeHash(stream ?? new MemoryStream());
+        }
+
+        /// <summary>
+        /// Run a set of changes as one unit on the database writer, and wait for it to finish.
+        /// No other writes are applied while it runs. Exceptions are thrown back to the caller.
+        /// <para></para>
+        /// Without `DatabaseOptions.SingleWriter`, the changes run directly on the calling thread.
+        /// </summary>
+        /// <param name="mutation">Changes to make. The database passed in is this one</param>
+        public void Submit([NotNull]Action<Database> mutation)
+        {
+            if (_writer == null) mutation(this);
+            else _writer.Submit(() => mutation(this));
+        }
+
+        /// <summary>
+        /// Queue a set of changes for the database writer, without waiting ("fire and forget").
+        /// Queued changes are applied in order. The returned task completes when the changes have been applied,
+        /// and carries any exception thrown. Call `Dispose` to wait for all queued changes.
+        /// <para></para>
+        /// Without `DatabaseOptions.SingleWriter`, the changes run directly on the calling thread before this returns.
+        /// </summary>
+        /// <param name="mutation">Changes to make. The database passed in is this one</param>
+        [NotNull]public Task Post([NotNull]Action<Database> mutation)
+        {
+            if (_writer != null) return _writer.Post(() => mutation(this));
+
+            var done = new TaskCompletionSource<bool>();
+            try
+            {
+                mutation(this);
+                done.SetResult(true);
+            }
+            catch (Exception ex)
+            {
+                done.SetException(ex);
+            }
+            return done.Task;
+        }
+
+        /// <summary>
+        /// Attempt to synchronously flush the underlying storage
+        /// </summary>
+        public void Flush()
+        {
+            _fs.Flush();
+        }
+
+        /// <summary>
+        /// If you call this method, CRC checks will be ignored on READ (still calculated for WRITE).
+        /// This makes read-heavy workloads about 10x faster, but data corruption will go unreported. 
+        /// </summary>
+        public static void SetQuickAndDirtyMode() {
+            BasicPage.QuickAndDirtyMode = true;
+        }
+    }
 }
\ No newline at end of file
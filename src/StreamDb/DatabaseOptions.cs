@@ -0,0 +1,284 @@
+﻿using System;
+using System.IO;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Optional settings for a database connection.
+    /// Any setting left as `null` will use the default behaviour.
+    /// </summary>
+    public class DatabaseOptions
+    {
+        /// <summary>
+        /// Receiver for engine diagnostics. Defaults to discarding all messages.
+        /// </summary>
+        public ILogger? Logger { get; set; }
+
+        /// <summary>
+        /// Span source for tracing storage operations. Defaults to no tracing.
+        /// </summary>
+        public ITracer? Tracer { get; set; }
+
+        /// <summary>
+        /// If set, any storage operation (bind, write, release, read...) that takes at least this long is logged as a
+        /// "Slow operation" warning, with its duration and the document, path and pages it touched. Long page chains
+        /// and fragmented documents show up here. Spans for slow operations also get a `slow` attribute.
+        /// Defaults to no slow operation log.
+        /// </summary>
+        public TimeSpan? SlowOperationThreshold { get; set; }
+
+        /// <summary>
+        /// Checks each read and write made through `Database` against the caller's permissions.
+        /// Defaults to allowing everything.
+        /// </summary>
+        public IAuthorizer? Authorizer { get; set; }
+
+        /// <summary>
+        /// Ed25519 public key for a signed manifest (see `Database.SignManifest`). If set, the database is checked
+        /// against its manifest when opened, and `ManifestVerificationException` is thrown if the manifest is missing,
+        /// not signed by this key, or does not match the documents. Defaults to no check.
+        /// </summary>
+        public byte[]? ManifestKey { get; set; }
+
+        /// <summary>
+        /// What to do if the storage header, or the pages it links to, are found damaged when the database is opened:
+        /// fail, repair, open read-only, or quarantine the damaged pages. Any setting other than `Open` runs a quick
+        /// `Database.HealthCheck` on open. Defaults to `RecoveryPolicy.Open`, which does no check.
+        /// </summary>
+        public RecoveryPolicy Recovery { get; set; }
+
+        /// <summary>
+        /// Settings for small devices: storage on a raw flash or block device stream, little memory, and no
+        /// system random source. IDs come only from `idSource`, caches are held to `memoryBudget` bytes,
+        /// and all writes happen in order on the calling thread with no background workers.
+        /// Leave `Deduplicate` off in this profile, as it needs SHA-256.
+        /// </summary>
+        /// <param name="idSource">Source of new document and upload IDs, for example from a hardware random generator</param>
+        /// <param name="memoryBudget">Bytes of memory allowed for caches. See `MemoryBudget`</param>
+        public static DatabaseOptions ForEmbedded(Func<Guid> idSource, long memoryBudget = 64 * 1024)
+        {
+            return new DatabaseOptions {
+                IdSource = idSource ?? throw new ArgumentNullException(nameof(idSource)),
+                MemoryBudget = memoryBudget,
+                WriteWorkers = 1,
+                ExtentPages = 16,
+                MaxChainLength = 65_536,
+                PathCache = PathCacheConsistency.Cached,
+                SingleWriter = false,
+                Deduplicate = false
+            };
+        }
+
+        /// <summary>
+        /// A shallow copy of these options, for the engine to adjust without changing the caller's settings
+        /// </summary>
+        internal DatabaseOptions Copy()
+        {
+            return (DatabaseOptions)MemberwiseClone();
+        }
+
+        /// <summary>
+        /// Source of new document and upload IDs. Defaults to `Guid.NewGuid`.
+        /// Supply a seeded source to get reproducible storage images for testing.
+        /// The source must never return `Guid.Empty` or repeat an ID.
+        /// </summary>
+        public Func<Guid>? IdSource { get; set; }
+
+        /// <summary>
+        /// Number of workers used to build and commit pages when writing large documents.
+        /// Defaults to 1 (pages are written in order on the calling thread).
+        /// </summary>
+        public int? WriteWorkers { get; set; }
+
+        /// <summary>
+        /// Number of pages in each extent handed to a write worker. Documents no larger than one extent
+        /// are always written on the calling thread. Defaults to 256 pages (about 1 MB).
+        /// </summary>
+        public int? ExtentPages { get; set; }
+
+        /// <summary>
+        /// Longest page chain that will be followed before storage is assumed to be damaged.
+        /// Defaults to 1,000,000 pages (about 4 GB).
+        /// </summary>
+        public int? MaxChainLength { get; set; }
+
+        /// <summary>
+        /// Number of CRC failures on a single page before it is treated as a bad sector.
+        /// Once such a page reads cleanly, its data is moved to a new page on the next write, and the slot is never used again.
+        /// Defaults to 3.
+        /// </summary>
+        public int? BadPageFailures { get; set; }
+
+        /// <summary>
+        /// How long soft-deleted documents stay in the trash. If set, expired entries are purged
+        /// during each `SoftDelete` call. Defaults to keeping entries until `PurgeTrash` is called.
+        /// </summary>
+        public TimeSpan? TrashRetention { get; set; }
+
+        /// <summary>
+        /// How long a multi-part upload (see `Database.StartUpload`) can stay open. Sessions are kept across restarts so an
+        /// interrupted upload can be resumed; sessions started longer ago than this are released when the database is opened
+        /// or closed. Defaults to 1 day.
+        /// </summary>
+        public TimeSpan? UploadExpiry { get; set; }
+
+        /// <summary>
+        /// If true, opening the database takes a new write epoch, and every write checks the epoch is still current.
+        /// A connection whose epoch has been superseded by a later opener will throw `StaleWriterException` instead of writing.
+        /// Defaults to false.
+        /// </summary>
+        public bool UseWriteFence { get; set; }
+
+        /// <summary>
+        /// How to retry storage reads and writes that fail with transient errors. Defaults to `RetryPolicy.None`.
+        /// </summary>
+        public RetryPolicy? Retry { get; set; }
+
+        /// <summary>
+        /// How path lookups are cached. Defaults to `PathCacheConsistency.Cached`.
+        /// Use `Validated` if other connections may write to the same storage.
+        /// </summary>
+        public PathCacheConsistency? PathCache { get; set; }
+
+        /// <summary>
+        /// If true, the time of each path binding is stored with it, and can be read with `Database.GetBindingInfo`.
+        /// Bindings made with an annotation always record their time. Defaults to false.
+        /// </summary>
+        public bool RecordBindingTimes { get; set; }
+
+        /// <summary>
+        /// If true, every change made through the database is recorded in an append-only audit log
+        /// stored alongside the documents. Read it with `Database.ReadAuditLog`. Defaults to false.
+        /// </summary>
+        public bool EnableAuditLog { get; set; }
+
+        /// <summary>
+        /// Codecs for typed `Put` and `Get` calls. Defaults to an empty registry, which can be filled through `Database.Codecs`.
+        /// </summary>
+        public CodecRegistry? Codecs { get; set; }
+
+        /// <summary>
+        /// If true, new documents are split into content-defined chunks, and each distinct chunk is stored only once.
+        /// This saves space when many documents share content (e.g. backups), at some cost in write speed.
+        /// Documents written either way can always be read. Defaults to false.
+        /// </summary>
+        public bool Deduplicate { get; set; }
+
+        /// <summary>
+        /// Optional second storage stream, for documents moved out of the main storage with `Database.Demote`.
+        /// This is intended for larger, slower storage. Defaults to null, in which case documents can't be demoted.
+        /// </summary>
+        public Stream? ColdStorage { get; set; }
+
+        /// <summary>
+        /// If true, reading a demoted document moves it back to the main storage, so recently used documents stay hot.
+        /// Defaults to false.
+        /// </summary>
+        public bool PromoteOnRead { get; set; }
+
+        /// <summary>
+        /// If true, the connection is a read-only replica of storage that another process may be writing to.
+        /// Path lookups are validated against storage on every call, all writes are refused, and reads that
+        /// race with a writer are retried before failing with `ReplicaInconsistencyException`. Defaults to false.
+        /// </summary>
+        public bool ReadReplica { get; set; }
+
+        /// <summary>
+        /// How each class of write (document data, index, paths, free list) is flushed to storage.
+        /// Defaults to flushing the stream at the end of every operation.
+        /// </summary>
+        public SyncOptions? Sync { get; set; }
+
+        /// <summary>
+        /// If true, all changes to storage are applied by a single writer, in the order they were made.
+        /// Reads are not queued, and run alongside the writer. Changes can also be queued without waiting,
+        /// with `Database.Post`. Defaults to false, where each calling thread writes under a lock.
+        /// </summary>
+        public bool SingleWriter { get; set; }
+
+        /// <summary>
+        /// Maximum bytes of memory used for caches: the path lookup, and the pages held by open document streams.
+        /// When the budget is used up, the path lookup cache is dropped, and document streams read one page at a time
+        /// instead of holding their whole chain. Defaults to no limit.
+        /// </summary>
+        public long? MemoryBudget { get; set; }
+
+        /// <summary>
+        /// Ordering of paths in sorted listings (`Database.SearchPaged`) and range queries. The collation's name is stored
+        /// with the database the first time it is set, and later connections must use a collation with the same name.
+        /// Built-in collations (`PathCollation.Ordinal` and `PathCollation.Numeric`) are picked up from storage without
+        /// setting this. Defaults to the stored collation, or `PathCollation.Ordinal` if none is stored.
+        /// </summary>
+        public PathCollation? Collation { get; set; }
+
+        /// <summary>
+        /// Maximum number of document streams (from `Database.Get`, `Database.ReadRange` and snapshots) open at once.
+        /// Opening another throws `StreamLimitException`, so a caller that doesn't dispose its streams can't hold
+        /// unbounded memory in their page caches. Defaults to no limit. See `Database.OpenStreamCount`
+        /// </summary>
+        public int? MaxOpenStreams { get; set; }
+
+        /// <summary>
+        /// If set, opening a stream at the `MaxOpenStreams` limit waits up to this long for another stream to be disposed,
+        /// before throwing `StreamLimitException`. Defaults to throwing straight away.
+        /// </summary>
+        public TimeSpan? OpenStreamWait { get; set; }
+
+        /// <summary>
+        /// If true, the free page list is read into memory when storage is opened, and kept in step with every allocation and release.
+        /// Allocating and releasing pages then go straight to the free-list page they need, instead of walking the list on disk.
+        /// The list in storage is still updated as the durable record. Use this only where this connection is the only writer.
+        /// Defaults to false.
+        /// </summary>
+        public bool CacheFreeList { get; set; }
+
+        /// <summary>
+        /// If set, released pages are held back from reuse until this many index or path changes have been committed after their release.
+        /// This gives readers of an earlier state, and crash recovery, a margin against pages being overwritten too soon.
+        /// Held pages are added to the free list when the database is disposed. If the process stops first, they are not reused.
+        /// Can be combined with `DeferFreePeriod`, in which case both must pass. Defaults to releasing pages immediately.
+        /// </summary>
+        public int? DeferFreeCommits { get; set; }
+
+        /// <summary>
+        /// If set, released pages are held back from reuse until this much time has passed since their release.
+        /// Pages are checked each time storage is synced. See `DeferFreeCommits`. Defaults to releasing pages immediately.
+        /// </summary>
+        public TimeSpan? DeferFreePeriod { get; set; }
+
+        /// <summary>
+        /// If set above 1, only one in this many reads of document data pages has its CRC checked, trading safety for read speed.
+        /// Index, path lookup and free list pages are always checked. Use `Database.CrcSamplingStatistics` to see how many sampled
+        /// checks failed. This sits between checking every page (the default) and `Database.SetQuickAndDirtyMode`, which checks none.
+        /// </summary>
+        public int? CrcSampleRate { get; set; }
+
+        /// <summary>
+        /// If set, up to this many recently read or written pages are kept in memory. A cached page was either checked when read,
+        /// or written by this connection, so it is served without reading storage or checking its CRC again, until it is evicted
+        /// or written again. Damage to storage underneath a cached page is not seen until then, though `Database.CheckIntegrity`
+        /// always reads storage. Use this only where this connection is the only writer. Defaults to no cache.
+        /// </summary>
+        public int? PageCachePages { get; set; }
+
+        /// <summary>
+        /// If set, a readable, writable and seekable stream (usually a file beside the storage file) for a write-ahead log.
+        /// Index pages are changed in place, so at the end of each change the index pages it touched are appended to the log
+        /// and flushed to disk together, then written to storage, which is flushed to disk before the log is cleared.
+        /// If a crash leaves a change unfinished, the pages in the log are written again when the database is next opened
+        /// with the same log, so no index page is left torn. Document data and path lookups are always written to new pages,
+        /// so are not logged. This costs a flush of the log and of storage per index change, whatever `Sync` says.
+        /// The log is kept outside the storage file, as the file's header has no room to point at one without a format change.
+        /// Read replicas ignore this. A stream given here is not disposed with the database.
+        /// Defaults to a file beside the storage file for `Database.Open`, and to no log for other connections.
+        /// </summary>
+        public Stream? WriteAheadLog { get; set; }
+
+        /// <summary>
+        /// If set, a snapshot of document and page counts is written under `Database.SystemNamespace` at this interval,
+        /// so operators can read the history of growth and fragmentation with a normal `Get`. See `Database.WriteStatsSnapshot`.
+        /// Defaults to no snapshots.
+        /// </summary>
+        public TimeSpan? StatsInterval { get; set; }
+    }
+}
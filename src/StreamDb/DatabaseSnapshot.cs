@@ -0,0 +1,119 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using System.Linq;
+using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// A read-only view of a database as it was at one moment: every path binding, and the data of every bound document.
+    /// Writes made after the snapshot was taken are not seen, so exports and backups taken from it are never a mix of
+    /// old and new bindings. Get one from `Database.OpenSnapshot`.
+    /// <para></para>
+    /// While a snapshot is open, pages released by writes are not reused, so storage grows with the data replaced in that time.
+    /// Dispose of snapshots promptly, and before the database is closed.
+    /// Fixed documents and circular logs are overwritten in place, so they are copied into memory when the snapshot is taken.
+    /// </summary>
+    public class DatabaseSnapshot : IDisposable
+    {
+        [NotNull] private readonly Dictionary<string, BindingInfo> _bindings = new Dictionary<string, BindingInfo>(StringComparer.Ordinal);
+        [NotNull] private readonly IDictionary<Guid, DocumentStat> _stats;
+        [NotNull] private readonly Func<Guid, Stream?> _open;
+        private IDisposable? _hold;
+        private bool _disposed;
+
+        /// <param name="bindings">Every path binding at the time of the snapshot</param>
+        /// <param name="stats">Index details of bound documents, where known</param>
+        /// <param name="open">Opens a document's data as it was at the time of the snapshot</param>
+        /// <param name="hold">Keeps the snapshot's pages from being reused. Disposed with the snapshot</param>
+        internal DatabaseSnapshot([NotNull, ItemNotNull]IEnumerable<BindingInfo> bindings, [NotNull]IDictionary<Guid, DocumentStat> stats,
+            [NotNull]Func<Guid, Stream?> open, IDisposable? hold)
+        {
+            foreach (var binding in bindings) _bindings[binding.Path] = binding;
+            _stats = stats;
+            _open = open;
+            _hold = hold;
+            TakenAt = DateTime.UtcNow;
+        }
+
+        /// <summary>
+        /// Checks reads against the caller's permissions. Set by the database that took the snapshot.
+        /// </summary>
+        internal Action<string, Guid>? AuthorizeRead { get; set; }
+
+        /// <summary>
+        /// Wraps streams given out by `Get`, to count them against `DatabaseOptions.MaxOpenStreams`
+        /// </summary>
+        internal Func<string, Stream, Stream>? TrackStream { get; set; }
+
+        /// <summary>
+        /// Time the snapshot was taken (UTC)
+        /// </summary>
+        public DateTime TakenAt { get; }
+
+        /// <summary>
+        /// Given the start of a path string, returns all matching paths that had a document bound to them, in ordinal order
+        /// </summary>
+        /// <param name="pathPrefix">Start of a path string</param>
+        /// <param name="includeHidden">If true, include hidden and system paths (see `BindingAttributes`), and paths under `Database.SystemNamespace`</param>
+        [NotNull, ItemNotNull]public IEnumerable<string> Search([NotNull]string pathPrefix, bool includeHidden = false)
+        {
+            if (pathPrefix == null) throw new ArgumentNullException(nameof(pathPrefix));
+            return _bindings.Values
+                .Where(b => b.Path.StartsWith(pathPrefix, StringComparison.Ordinal))
+                .Where(b => includeHidden || !(b.IsHidden || b.Path.StartsWith(Database.SystemNamespace, StringComparison.Ordinal)))
+                .Select(b => b.Path)
+                .OrderBy(p => p, StringComparer.Ordinal);
+        }
+
+        /// <summary>
+        /// Details of a path binding at the time of the snapshot. Returns null if the path was not bound.
+        /// </summary>
+        public BindingInfo? GetBindingInfo([NotNull]string path)
+        {
+            return _bindings.TryGetValue(path, out var binding) ? binding : null;
+        }
+
+        /// <summary>
+        /// Index details of the document at a path, at the time of the snapshot.
+        /// Returns null if the path was not bound, or the index did not hold the details.
+        /// </summary>
+        public DocumentStat? Stat([NotNull]string path)
+        {
+            var binding = GetBindingInfo(path);
+            if (binding == null) return null;
+            return _stats.TryGetValue(binding.DocumentId, out var stat) ? stat : null;
+        }
+
+        /// <summary>
+        /// Read the document bound to a path at the time of the snapshot.
+        /// Returns true if found, false if the path was not bound.
+        /// </summary>
+        public bool Get([NotNull]string path, out Stream? stream)
+        {
+            stream = null;
+            if (_disposed) throw new ObjectDisposedException(nameof(DatabaseSnapshot));
+
+            var binding = GetBindingInfo(path);
+            if (binding == null) return false;
+            AuthorizeRead?.Invoke(path, binding.DocumentId);
+
+            stream = _open(binding.DocumentId);
+            if (stream == null) return false;
+            if (TrackStream != null) stream = TrackStream(path, stream);
+            return true;
+        }
+
+        /// <summary>
+        /// Let released pages be reused again. The snapshot can't be read after this.
+        /// </summary>
+        public void Dispose()
+        {
+            _disposed = true;
+            var hold = _hold;
+            _hold = null;
+            hold?.Dispose();
+        }
+    }
+}
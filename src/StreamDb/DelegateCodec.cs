@@ -0,0 +1,38 @@
+﻿using System;
+using System.IO;
+using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// A codec built from a pair of functions. Useful for wrapping an existing serialiser without writing a codec class.
+    /// </summary>
+    public class DelegateCodec<T> : Codec<T>
+    {
+        [NotNull] private readonly Action<T, Stream> _encode;
+        [NotNull] private readonly Func<Stream, T> _decode;
+
+        /// <summary>
+        /// Create a codec from an encode and decode function
+        /// </summary>
+        /// <param name="schemaId">Identifier stored with documents. This must be stable</param>
+        /// <param name="encode">Writes a value to a stream</param>
+        /// <param name="decode">Reads a value from a stream</param>
+        public DelegateCodec(string schemaId, Action<T, Stream> encode, Func<Stream, T> decode)
+        {
+            if (string.IsNullOrEmpty(schemaId)) throw new ArgumentNullException(nameof(schemaId));
+            SchemaId = schemaId;
+            _encode = encode ?? throw new ArgumentNullException(nameof(encode));
+            _decode = decode ?? throw new ArgumentNullException(nameof(decode));
+        }
+
+        /// <inheritdoc />
+        public override string SchemaId { get; }
+
+        /// <inheritdoc />
+        public override void Encode(T value, Stream output) => _encode(value, output);
+
+        /// <inheritdoc />
+        public override T Decode(Stream input) => _decode(input);
+    }
+}
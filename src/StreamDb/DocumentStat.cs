@@ -0,0 +1,50 @@
+﻿using System;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Storage flags for a document, kept in the index
+    /// </summary>
+    [Flags]
+    public enum DocumentFlags : byte
+    {
+        /// <summary> A plain document </summary>
+        None = 0,
+        /// <summary> The document is stored as deduplicated chunks. See `DatabaseOptions.Deduplicate` </summary>
+        Deduplicated = 1,
+        /// <summary> The document's data is in cold storage. See `Database.Demote` </summary>
+        Cold = 2
+    }
+
+    /// <summary>
+    /// Summary information about a stored document
+    /// </summary>
+    public class DocumentStat
+    {
+        /// <summary>
+        /// ID of the document
+        /// </summary>
+        public Guid DocumentId { get; set; }
+
+        /// <summary>
+        /// Length of the document data in bytes
+        /// </summary>
+        public long Length { get; set; }
+
+        /// <summary>
+        /// Date the document was last written (UTC). This is stored to the day.
+        /// Null for documents written before the index held this information.
+        /// </summary>
+        public DateTime? LastModified { get; set; }
+
+        /// <summary>
+        /// Storage flags for the document
+        /// </summary>
+        public DocumentFlags Flags { get; set; }
+
+        /// <summary>
+        /// True if everything here was read from the index. False if the document had to be opened to find its length.
+        /// </summary>
+        public bool FromIndex { get; set; }
+    }
+}
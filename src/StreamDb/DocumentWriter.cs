@@ -0,0 +1,143 @@
+﻿using System;
+using System.IO;
+using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// A write-only stream that stores a new document as data arrives, for producers that don't have a stream to hand over.
+    /// Get one from `Database.CreateDocument`.
+    /// <para></para>
+    /// Data is written to storage as upload parts (see `Database.StartUpload`) as it fills a buffer, so the document
+    /// is never held in memory. Nothing is visible at the path until the writer is disposed, when the document is bound in one step.
+    /// Call `Abort` instead to release everything written so far.
+    /// </summary>
+    public class DocumentWriter : Stream
+    {
+        /// <summary> Number of pages' worth of data sent in each upload part </summary>
+        private const int PartPages = 16;
+
+        [NotNull] private readonly Database _db;
+        [NotNull] private readonly string _path;
+        [NotNull] private readonly byte[] _buffer;
+        private readonly Guid _sessionId;
+        private int _buffered;
+        private int _nextPart;
+        private long _position;
+        private bool _finished;
+
+        internal DocumentWriter([NotNull]Database db, [NotNull]string path, Guid sessionId)
+        {
+            _db = db;
+            _path = path;
+            _sessionId = sessionId;
+            _buffer = new byte[PartPages * Database.UploadPartAlignment];
+        }
+
+        /// <summary>
+        /// ID of the stored document. This is `Guid.Empty` until the writer has been disposed.
+        /// </summary>
+        public Guid DocumentId { get; private set; }
+
+        /// <inheritdoc />
+        public override void Write(byte[] buffer, int offset, int count)
+        {
+            if (buffer == null) throw new ArgumentNullException(nameof(buffer));
+            if (_finished) throw new ObjectDisposedException(nameof(DocumentWriter), "Document writer has been completed or aborted");
+
+            while (count > 0)
+            {
+                var chunk = Math.Min(count, _buffer.Length - _buffered);
+                Buffer.BlockCopy(buffer, offset, _buffer, _buffered, chunk);
+                _buffered += chunk;
+                _position += chunk;
+                offset += chunk;
+                count -= chunk;
+
+                if (_buffered == _buffer.Length) SendPart();
+            }
+        }
+
+        /// <summary>
+        /// Stop writing, and release all data written so far. Nothing is bound to the path.
+        /// Does nothing if the writer has already been completed or aborted.
+        /// </summary>
+        public void Abort()
+        {
+            if (_finished) return;
+            _finished = true;
+            _db.AbortUpload(_sessionId);
+        }
+
+        /// <summary>
+        /// Write the remaining data and bind the document to its path
+        /// </summary>
+        protected override void Dispose(bool disposing)
+        {
+            if (disposing && !_finished)
+            {
+                if (_nextPart == 0 && _buffered == 0)
+                {
+                    // Uploads can't be empty. Write the empty document directly.
+                    _finished = true;
+                    _db.AbortUpload(_sessionId);
+                    DocumentId = _db.WriteDocument(_path, new MemoryStream(new byte[0]));
+                }
+                else
+                {
+                    if (_buffered > 0) SendPart();
+                    _finished = true;
+                    try { DocumentId = _db.CompleteUpload(_sessionId); }
+                    catch { _db.AbortUpload(_sessionId); throw; }
+                }
+            }
+            base.Dispose(disposing);
+        }
+
+        /// <summary>
+        /// Send the buffer as the next upload part. Aborts the upload if the part can't be written.
+        /// </summary>
+        private void SendPart()
+        {
+            try
+            {
+                _db.UploadPart(_sessionId, _nextPart, new MemoryStream(_buffer, 0, _buffered, false));
+            }
+            catch
+            {
+                Abort();
+                throw;
+            }
+            _nextPart++;
+            _buffered = 0;
+        }
+
+        /// <inheritdoc />
+        public override void Flush() { }
+
+        /// <inheritdoc />
+        public override int Read(byte[] buffer, int offset, int count) { throw new NotSupportedException("Document writer is write-only"); }
+
+        /// <inheritdoc />
+        public override long Seek(long offset, SeekOrigin origin) { throw new NotSupportedException("Document writer is forward-only"); }
+
+        /// <inheritdoc />
+        public override void SetLength(long value) { throw new NotSupportedException("Document writer is forward-only"); }
+
+        /// <inheritdoc />
+        public override bool CanRead => false;
+        /// <inheritdoc />
+        public override bool CanSeek => false;
+        /// <inheritdoc />
+        public override bool CanWrite => !_finished;
+        /// <inheritdoc />
+        public override long Length => _position;
+
+        /// <inheritdoc />
+        public override long Position
+        {
+            get => _position;
+            set => throw new NotSupportedException("Document writer is forward-only");
+        }
+    }
+}
@@ -0,0 +1,29 @@
+﻿using System;
+using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Thrown by a verified read (see `Database.StartVerifiedRead`) when a document's stored data is damaged.
+    /// Exports stop at the first damaged document, so a finished export is known to be good.
+    /// </summary>
+    public class ExportVerificationException : Exception
+    {
+        /// <summary>
+        /// Path of the damaged document
+        /// </summary>
+        [NotNull] public string Path { get; }
+
+        /// <summary>
+        /// The page that failed its CRC check, or -1 if the pages were good but the content was wrong
+        /// </summary>
+        public int PageId { get; }
+
+        public ExportVerificationException([NotNull]string path, int pageId, string message, Exception? innerException = null)
+            : base($"Verification of '{path}' failed: {message}", innerException)
+        {
+            Path = path;
+            PageId = pageId;
+        }
+    }
+}
@@ -0,0 +1,49 @@
+﻿using System;
+using System.Collections.Generic;
+using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// How a document's pages are laid out in storage. See `Database.AnalyzeDocument`
+    /// </summary>
+    public class FragmentationReport
+    {
+        /// <summary>
+        /// ID of the document
+        /// </summary>
+        public Guid DocumentId { get; set; }
+
+        /// <summary>
+        /// Page IDs of the document's chain, in the order they are read (first page of data first)
+        /// </summary>
+        [NotNull] public List<int> PageIds { get; } = new List<int>();
+
+        /// <summary>
+        /// Number of pages in the document's chain
+        /// </summary>
+        public int PageCount => PageIds.Count;
+
+        /// <summary>
+        /// Number of runs of consecutive page IDs in read order. A perfectly laid out document has one run.
+        /// </summary>
+        public int Runs { get; set; }
+
+        /// <summary>
+        /// Largest distance, in pages, between one page and the next in read order. This is 1 for a single run.
+        /// </summary>
+        public int MaxGap { get; set; }
+
+        /// <summary>
+        /// Estimated sequential read efficiency: the fraction of page reads that follow straight on from the previous page
+        /// (the first read counts as sequential). 1.0 is a single run; close to zero means nearly every read is a seek.
+        /// </summary>
+        public double SequentialReadEfficiency => PageCount < 1 ? 1.0 : (PageCount - Runs + 1) / (double)PageCount;
+
+        /// <inheritdoc />
+        public override string ToString()
+        {
+            return $"{PageCount} pages in {Runs} runs; max gap = {MaxGap}; sequential read efficiency = {SequentialReadEfficiency:P0}";
+        }
+    }
+}
@@ -0,0 +1,25 @@
+﻿namespace StreamDb
+{
+    /// <summary>
+    /// How thoroughly `Database.HealthCheck` examines storage
+    /// </summary>
+    public enum HealthCheckLevel
+    {
+        /// <summary>
+        /// Check the storage header, and that the pages it links to are intact and link inside storage.
+        /// This reads only a handful of pages, so is cheap enough for frequent liveness probes.
+        /// </summary>
+        Quick = 0,
+
+        /// <summary>
+        /// The quick checks, plus the CRC and links of a random sample of pages
+        /// </summary>
+        Standard = 1,
+
+        /// <summary>
+        /// The quick checks, plus a full scan of every page and the stored counters (see `Database.CheckIntegrity`).
+        /// This can take some time on large databases.
+        /// </summary>
+        Deep = 2
+    }
+}
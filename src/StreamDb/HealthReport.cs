@@ -0,0 +1,44 @@
+﻿using System.Collections.Generic;
+using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Result of `Database.HealthCheck`
+    /// </summary>
+    public class HealthReport
+    {
+        /// <summary>
+        /// How thoroughly storage was checked
+        /// </summary>
+        public HealthCheckLevel Level { get; set; }
+
+        /// <summary>
+        /// Number of pages read and checked
+        /// </summary>
+        public int PagesChecked { get; set; }
+
+        /// <summary>
+        /// IDs of pages found damaged (failed CRC, or linked outside storage), in ascending order
+        /// </summary>
+        [NotNull] public List<int> FailedPages { get; } = new List<int>();
+
+        /// <summary>
+        /// Description of each problem found
+        /// </summary>
+        [NotNull, ItemNotNull] public List<string> Problems { get; } = new List<string>();
+
+        /// <summary>
+        /// True if no problems were found
+        /// </summary>
+        public bool IsHealthy => Problems.Count == 0;
+
+        /// <inheritdoc />
+        public override string ToString()
+        {
+            return IsHealthy
+                ? $"{Level}: healthy; {PagesChecked} pages checked"
+                : $"{Level}: {Problems.Count} problems; {PagesChecked} pages checked. {string.Join("; ", Problems)}";
+        }
+    }
+}
@@ -0,0 +1,22 @@
+﻿using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Decides whether reads and writes made through `Database` are allowed.
+    /// Supply an implementation in `DatabaseOptions` to enforce permissions in a multi-user server.
+    /// </summary>
+    /// <remarks>
+    /// The database has no idea of who is calling. Implementations should find the current principal
+    /// from their own context (for example the request being served), and check it against `AccessRequest.Control`.
+    /// Documents under `Database.SystemNamespace` are managed by the engine, and are not checked.
+    /// </remarks>
+    public interface IAuthorizer
+    {
+        /// <summary>
+        /// Return true to allow the operation. If false is returned, the database throws `UnauthorizedAccessException`
+        /// and makes no change.
+        /// </summary>
+        bool Authorize([NotNull]AccessRequest request);
+    }
+}
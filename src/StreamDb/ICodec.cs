@@ -0,0 +1,64 @@
+﻿using System;
+using System.IO;
+using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Converts values of one type to and from document data.
+    /// Register codecs with a `CodecRegistry` to use `Database.Put` and `Database.Get` with typed values.
+    /// </summary>
+    public interface ICodec
+    {
+        /// <summary>
+        /// Identifier stored with each document written by this codec.
+        /// This must stay the same for as long as documents in this format exist.
+        /// </summary>
+        [NotNull]string SchemaId { get; }
+
+        /// <summary>
+        /// Type of value this codec handles
+        /// </summary>
+        [NotNull]Type ValueType { get; }
+
+        /// <summary>
+        /// Write a value to a stream
+        /// </summary>
+        void Encode(object value, [NotNull]Stream output);
+
+        /// <summary>
+        /// Read a value from a stream
+        /// </summary>
+        object Decode([NotNull]Stream input);
+    }
+
+    /// <summary>
+    /// Base class for codecs of a single value type
+    /// </summary>
+    public abstract class Codec<T> : ICodec
+    {
+        /// <inheritdoc />
+        public abstract string SchemaId { get; }
+
+        /// <inheritdoc />
+        public Type ValueType => typeof(T);
+
+        /// <summary>
+        /// Write a value to a stream
+        /// </summary>
+        public abstract void Encode(T value, [NotNull]Stream output);
+
+        /// <summary>
+        /// Read a value from a stream
+        /// </summary>
+        public abstract T Decode([NotNull]Stream input);
+
+        void ICodec.Encode(object value, Stream output)
+        {
+            if (!(value is T typed)) throw new Exception($"Codec {SchemaId} can't encode values of type {value?.GetType().Name ?? "null"}");
+            Encode(typed, output);
+        }
+
+        object ICodec.Decode(Stream input) => Decode(input)!;
+    }
+}
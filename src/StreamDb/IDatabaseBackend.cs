@@ -1,89 +1,297 @@
-﻿using System;
-using System.Collections.Generic;
-using System.IO;
-using JetBrains.Annotations;
-
-namespace StreamDb
-{
-    public interface IDatabaseBackend
-    {
-        // ############## Write ##############
-        
-        /// <summary>
-        /// Write a new document to data pages and the index.
-        /// Returns new document ID.
-        /// </summary>
-        /// <param name="data">Stream to use as document source. It will be read from current position to end.</param>
-        Guid WriteDocument(Stream data);
-
-        /// <summary>
-        /// Bind a document ID to a path. If there was an existing document in that path,
-        /// its ID will be returned.
-        /// </summary>
-        Guid BindPathToDocument(string path, Guid id);
-
-        // ############## Delete ##############
-
-        /// <summary>
-        /// Delete a document page chain. Does NOT directly affect the path index or document index
-        /// </summary>
-        void DeleteDocument(Guid oldId);
-
-        /// <summary>
-        /// Delete a document page chain. Does NOT directly affect the path index or document index
-        /// </summary>
-        void DeleteSinglePathForDocument(Guid documentId, string path);
-
-        /// <summary>
-        /// Remove a document from the main index.
-        /// You should also call `DeletePathsForDocument` and `DeleteDocument`
-        /// </summary>
-        /// <remarks>
-        /// This really just marks the document as invalid. We might add some garbage collection later.
-        /// </remarks>
-        void RemoveFromIndex(Guid id);
-
-        /// <summary>
-        /// Unbind all paths for the given document ID.
-        /// This does not delete the document page chain or update the document index
-        /// </summary>
-        void DeletePathsForDocument(Guid id);
-        
-        // ############## Read ##############
-
-        /// <summary>
-        /// Try to find a document ID for a given path.
-        /// Returns empty guid if not found.
-        /// There is no guarantee that the document will still be present in the page table. You will need to do a subsequent read.
-        /// </summary>
-        Guid GetDocumentIdByPath(string path);
-
-        /// <summary>
-        /// Return all paths bound to a document that share a path prefix
-        /// </summary>
-        [NotNull]IEnumerable<string> SearchPaths(string pathPrefix);
-
-        /// <summary>
-        /// List all paths that match a document id
-        /// </summary>
-        [NotNull]IEnumerable<string> ListPathsForDocument(Guid documentId);
-
-        /// <summary>
-        /// Present a stream to read from a document, recovered by ID.
-        /// Returns null if the document is not found.
-        /// </summary>
-        Stream? ReadDocument(Guid id);
-
-        // ############## Info ##############
-        
-        /// <summary>
-        /// Scan the free page chain, count how many slots are occupied
-        /// </summary>
-        int CountFreePages();
-        
-        /// <summary>
-        /// Get a summary string for a document, by ID
-        /// </summary>
-        string GetInfo(Guid id);
-    }
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    public interface IDatabaseBackend
+    {
+        // ############## Write ##############
+        
+        /// <summary>
+        /// Write a new document to data pages and the index.
+        /// Returns new document ID.
+        /// </summary>
+        /// <param name="data">Stream to use as document source. It will be read from current position to end.</param>
+        Guid WriteDocument(Stream data);
+
+        /// <summary>
+        /// Bind a document ID to a path. If there was an existing document in that path,
+        /// its ID will be returned.
+        /// An optional annotation can be stored with the binding.
+        /// </summary>
+        Guid BindPathToDocument(string path, Guid id, string? annotation = null, BindingAttributes attributes = BindingAttributes.None);
+
+        /// <summary>
+        /// Write a new version of a document, keeping its ID.
+        /// If the ID is not yet in the index, it will be added.
+        /// </summary>
+        /// <param name="id">Document ID to update</param>
+        /// <param name="data">Stream to use as document source. It will be read from current position to end.</param>
+        void WriteDocumentVersion(Guid id, Stream data);
+
+        /// <summary>
+        /// Rebind every path starting with `oldPrefix` to start with `newPrefix`, in one update.
+        /// Returns the number of paths moved. Documents that were bound to target paths are returned in `replacedIds`.
+        /// </summary>
+        int RenamePrefix(string oldPrefix, string newPrefix, out Guid[] replacedIds);
+
+        /// <summary>
+        /// Bind and unbind a set of paths as a single change to the path lookup. A change with an empty `DocumentId` unbinds its path.
+        /// Returns the document previously bound to each changed path, or `Guid.Empty`, in the same order as the changes.
+        /// </summary>
+        [NotNull]Guid[] ApplyPathChanges([NotNull, ItemNotNull]IList<BindingInfo> changes);
+
+        /// <summary>
+        /// Add an entry to the end of the audit log
+        /// </summary>
+        void AppendAuditRecord(AuditRecord record);
+
+        /// <summary>
+        /// Begin a multi-part upload that will be bound to the given path. Returns a session ID to use with `UploadPart`.
+        /// Sessions are stored, so they can be continued after the database is reopened.
+        /// </summary>
+        Guid StartUpload([NotNull]string path);
+
+        /// <summary>
+        /// Path given when an upload was started, or null if there is no such session
+        /// </summary>
+        string? GetUploadPath(Guid sessionId);
+
+        /// <summary>
+        /// Write one part of an upload to storage. Re-sending a part number replaces the earlier data.
+        /// All parts except the last must be a multiple of `BasicPage.PageDataCapacity` in length.
+        /// </summary>
+        void UploadPart(Guid sessionId, int partNumber, Stream data);
+
+        /// <summary>
+        /// Join all uploaded parts, in part number order, into a new document.
+        /// Returns new document ID.
+        /// </summary>
+        Guid CompleteUpload(Guid sessionId);
+
+        /// <summary>
+        /// Abandon an upload, releasing any parts written so far
+        /// </summary>
+        void AbortUpload(Guid sessionId);
+
+        /// <summary>
+        /// Abandon all uploads started before the given time (UTC), releasing their parts. Returns the number of sessions released.
+        /// </summary>
+        int ReleaseUploads(DateTime startedBefore);
+
+        // ############## Delete ##############
+
+        /// <summary>
+        /// Delete a document page chain. Does NOT directly affect the path index or document index
+        /// </summary>
+        void DeleteDocument(Guid oldId);
+
+        /// <summary>
+        /// Delete a document page chain. Does NOT directly affect the path index or document index
+        /// </summary>
+        void DeleteSinglePathForDocument(Guid documentId, string path);
+
+        /// <summary>
+        /// Remove a document from the main index.
+        /// You should also call `DeletePathsForDocument` and `DeleteDocument`
+        /// </summary>
+        /// <remarks>
+        /// This really just marks the document as invalid. We might add some garbage collection later.
+        /// </remarks>
+        void RemoveFromIndex(Guid id);
+
+        /// <summary>
+        /// Unbind all paths for the given document ID.
+        /// This does not delete the document page chain or update the document index
+        /// </summary>
+        void DeletePathsForDocument(Guid id);
+        
+        // ############## Read ##############
+
+        /// <summary>
+        /// Try to find a document ID for a given path.
+        /// Returns empty guid if not found.
+        /// There is no guarantee that the document will still be present in the page table. You will need to do a subsequent read.
+        /// </summary>
+        Guid GetDocumentIdByPath(string path);
+
+        /// <summary>
+        /// Get the document ID and binding metadata for a path.
+        /// Returns null if the path is not bound.
+        /// </summary>
+        BindingInfo? GetBindingInfo(string path);
+
+        /// <summary>
+        /// Read all audit log entries, oldest first, numbered from zero in `AuditRecord.Sequence`
+        /// </summary>
+        [NotNull, ItemNotNull]IEnumerable<AuditRecord> ReadAuditRecords();
+
+        /// <summary>
+        /// Return all paths bound to a document that share a path prefix
+        /// </summary>
+        [NotNull]IEnumerable<string> SearchPaths(string pathPrefix);
+
+        /// <summary>
+        /// Return all paths bound to a document that share a path suffix
+        /// </summary>
+        [NotNull]IEnumerable<string> SearchPathSuffix(string pathSuffix);
+
+        /// <summary>
+        /// List all paths that match a document id
+        /// </summary>
+        [NotNull]IEnumerable<string> ListPathsForDocument(Guid documentId);
+
+        /// <summary>
+        /// Present a stream to read from a document, recovered by ID.
+        /// Returns null if the document is not found.
+        /// </summary>
+        Stream? ReadDocument(Guid id);
+
+        // ############## Info ##############
+        
+        /// <summary>
+        /// Number of released pages that can be reused. This is kept as a stored counter, so doesn't scan the free page chain.
+        /// </summary>
+        int CountFreePages();
+
+        /// <summary>
+        /// Number of documents stored. This is kept as a stored counter, so doesn't scan the index.
+        /// </summary>
+        long CountDocuments();
+
+        /// <summary>
+        /// IDs of every document in the index, whether or not it is bound to a path. This scans the index.
+        /// Deduplication chunks are not included.
+        /// </summary>
+        [NotNull]Guid[] ListDocumentIds();
+
+        /// <summary>
+        /// True if damaged index pages have been skipped, and storage should be repaired
+        /// </summary>
+        bool NeedsRepair();
+        
+        /// <summary>
+        /// Get a summary string for a document, by ID
+        /// </summary>
+        string GetInfo(Guid id);
+
+        /// <summary>
+        /// Get summary information for a document, from the index if possible.
+        /// Returns null if the document is not found.
+        /// </summary>
+        DocumentStat? GetDocumentStat(Guid id);
+
+        /// <summary>
+        /// Scan all storage and check every page is intact
+        /// </summary>
+        /// <param name="workers">Number of threads checking pages</param>
+        [NotNull]IntegrityReport CheckIntegrity(int workers);
+
+        /// <summary>
+        /// Check storage is in a usable state, to the given depth. See `HealthCheckLevel`
+        /// </summary>
+        [NotNull]HealthReport HealthCheck(HealthCheckLevel level);
+
+        /// <summary>
+        /// Add released pages still waiting out their grace period to the free list. See `DatabaseOptions.DeferFreeCommits`
+        /// </summary>
+        void ReleaseDeferredPages();
+
+        /// <summary>
+        /// Counts of document page reads and sampled CRC checks. See `DatabaseOptions.CrcSampleRate`
+        /// </summary>
+        [NotNull]CrcSamplingStats CrcSampling();
+
+        /// <summary>
+        /// Report how a document's pages are laid out. Returns null if the document is not found
+        /// </summary>
+        FragmentationReport? AnalyzeDocument(Guid id);
+
+        /// <summary>
+        /// Rewrite a document's pages as one contiguous run, if they are scattered. Returns false if nothing was rewritten
+        /// </summary>
+        bool OptimizeDocument(Guid id);
+
+        /// <summary>
+        /// Capture every path binding and the data of every bound document, as one consistent view. See `DatabaseSnapshot`
+        /// </summary>
+        [NotNull]DatabaseSnapshot OpenSnapshot();
+
+        /// <summary>
+        /// Split the document index into shards by document ID, if the storage supports it.
+        /// Returns false if nothing was changed
+        /// </summary>
+        bool ShardIndex();
+
+        /// <summary>
+        /// Point storage header links away from damaged pages. Returns false if the index or path lookup can't be recovered.
+        /// </summary>
+        bool RepairHeaderLinks();
+
+        /// <summary>
+        /// Add damaged pages to the bad-page map without moving them, so they are never reused
+        /// </summary>
+        void QuarantinePages([NotNull]int[] pageIds);
+
+        /// <summary>
+        /// Bytes of memory currently held by caches, including pages held by open document streams. See `DatabaseOptions.MemoryBudget`
+        /// </summary>
+        long CacheMemoryUsed { get; }
+
+        /// <summary>
+        /// Release the previous revision of a document, if it has one. Returns true if storage was released
+        /// </summary>
+        bool PurgeOldVersion(Guid id);
+
+        /// <summary>
+        /// Release the previous revision of every document. Returns the number of revisions released
+        /// </summary>
+        int PurgeAllOldVersions();
+
+        /// <summary>
+        /// Count the storage used by current and previous revisions of every document
+        /// </summary>
+        [NotNull]VersionReport VersionStatistics();
+
+        // ############## Tiers ##############
+
+        /// <summary>
+        /// Report which storage tier holds a document's data
+        /// </summary>
+        StorageTier GetTier(Guid id);
+
+        /// <summary>
+        /// Move a document's data to the given tier. Does nothing if it is already there.
+        /// </summary>
+        void MoveToTier(Guid id, StorageTier tier);
+
+        // ############## Fixed documents ##############
+
+        /// <summary>
+        /// Allocate a fixed size document of `sizePages` pages, which is written in place as a ring buffer. Returns the new document ID.
+        /// </summary>
+        Guid CreateFixedDocument(int sizePages);
+
+        /// <summary>
+        /// Append data to a fixed document, overwriting the oldest data if it is full
+        /// </summary>
+        void AppendToFixedDocument(Guid id, [NotNull]byte[] data);
+
+        /// <summary>
+        /// Read the data held in a fixed document, oldest first. Returns null if the document is not found.
+        /// </summary>
+        Stream? ReadFixedDocument(Guid id);
+
+        /// <summary>
+        /// Append a framed record to a fixed document, used as a circular log. Returns the record's position in the log.
+        /// </summary>
+        long AppendLogRecord(Guid id, [NotNull]byte[] record);
+
+        /// <summary>
+        /// Read the whole records held in a circular log, oldest first, starting at the given position
+        /// </summary>
+        [NotNull, ItemNotNull]IEnumerable<LogRecord> ReadLogRecords(Guid id, long since);
+    }
 }
\ No newline at end of file
@@ -0,0 +1,24 @@
+﻿using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Receives diagnostic messages from the storage engine.
+    /// Supply an implementation in `DatabaseOptions` to see what the engine is doing.
+    /// </summary>
+    /// <remarks>
+    /// Fields are given as alternating name/value pairs, e.g. `Debug("Released chain", "endPageId", 12, "pages", 3)`
+    /// </remarks>
+    public interface ILogger
+    {
+        /// <summary>
+        /// Routine operation detail. Can be very chatty.
+        /// </summary>
+        void Debug([NotNull]string message, [NotNull]params object?[] fields);
+
+        /// <summary>
+        /// Something went wrong, or looks suspicious. The operation may still fail or continue.
+        /// </summary>
+        void Warn([NotNull]string message, [NotNull]params object?[] fields);
+    }
+}
@@ -0,0 +1,28 @@
+﻿using System;
+using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Optional tracing hook. Implement this to forward storage operations to
+    /// OpenTelemetry (`ActivitySource`) or any other tracing system.
+    /// </summary>
+    public interface ITracer
+    {
+        /// <summary>
+        /// Start a span for a named operation. The span is ended when disposed.
+        /// </summary>
+        [NotNull]ISpan StartSpan([NotNull]string operationName);
+    }
+
+    /// <summary>
+    /// A single traced operation, as started by `ITracer.StartSpan`
+    /// </summary>
+    public interface ISpan : IDisposable
+    {
+        /// <summary>
+        /// Attach a named value to the span (pages touched, bytes, cache hits...)
+        /// </summary>
+        void SetAttribute([NotNull]string key, object? value);
+    }
+}
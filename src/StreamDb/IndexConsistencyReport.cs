@@ -0,0 +1,52 @@
+﻿using System;
+using System.Collections.Generic;
+using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Result of cross-checking path bindings against the document index. See `Database.CheckIndexConsistency`
+    /// </summary>
+    public class IndexConsistencyReport
+    {
+        /// <summary>
+        /// Number of bound paths checked
+        /// </summary>
+        public int PathsChecked { get; set; }
+
+        /// <summary>
+        /// Number of documents found in the index
+        /// </summary>
+        public int DocumentsChecked { get; set; }
+
+        /// <summary>
+        /// Paths bound to a document ID that is not in the index. Reading these paths finds nothing.
+        /// </summary>
+        [NotNull, ItemNotNull] public List<string> DanglingPaths { get; } = new List<string>();
+
+        /// <summary>
+        /// Documents in the index with no paths, that are not pinned, immutable, temporary or in the trash.
+        /// Only filled if unbound documents were checked for.
+        /// </summary>
+        [NotNull] public List<Guid> UnboundDocuments { get; } = new List<Guid>();
+
+        /// <summary>
+        /// True if the problems listed were repaired: dangling paths unbound, and unbound documents deleted
+        /// </summary>
+        public bool Repaired { get; set; }
+
+        /// <summary>
+        /// True if no problems were found
+        /// </summary>
+        public bool IsConsistent => DanglingPaths.Count == 0 && UnboundDocuments.Count == 0;
+
+        /// <inheritdoc />
+        public override string ToString()
+        {
+            var checkedText = $"{PathsChecked} paths and {DocumentsChecked} documents checked";
+            if (IsConsistent) return checkedText + "; no errors";
+            var repaired = Repaired ? "; repaired" : "";
+            return $"{checkedText}; {DanglingPaths.Count} dangling paths, {UnboundDocuments.Count} unbound documents{repaired}";
+        }
+    }
+}
@@ -0,0 +1,41 @@
+﻿using System.Collections.Generic;
+using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Result of a full storage scan
+    /// </summary>
+    public class IntegrityReport
+    {
+        /// <summary>
+        /// Number of pages read and checked
+        /// </summary>
+        public int PagesChecked { get; set; }
+
+        /// <summary>
+        /// IDs of pages whose stored CRC did not match their content, in ascending order
+        /// </summary>
+        [NotNull] public List<int> FailedPages { get; } = new List<int>();
+
+        /// <summary>
+        /// True if the stored document or free page counts did not match a full count.
+        /// They are corrected by the check, unless the connection can't write.
+        /// </summary>
+        public bool CountersCorrected { get; set; }
+
+        /// <summary>
+        /// True if no problems were found
+        /// </summary>
+        public bool IsValid => FailedPages.Count == 0;
+
+        /// <inheritdoc />
+        public override string ToString()
+        {
+            var counters = CountersCorrected ? "; stored counters corrected" : "";
+            return IsValid
+                ? $"{PagesChecked} pages checked; no errors{counters}"
+                : $"{PagesChecked} pages checked; {FailedPages.Count} failed CRC: {string.Join(", ", FailedPages)}{counters}";
+        }
+    }
+}
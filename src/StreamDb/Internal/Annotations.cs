@@ -1,14 +1,14 @@
-﻿// ReSharper disable once CheckNamespace
-namespace JetBrains.Annotations
-{
-    using System;
-
-    /// <summary>Marked element could be <c>null</c></summary>
-    [AttributeUsage(AttributeTargets.All)] internal sealed class CanBeNullAttribute : Attribute { }
-    /// <summary>Marked element could never be <c>null</c></summary>
-    [AttributeUsage(AttributeTargets.All)] internal sealed class NotNullAttribute : Attribute { }
-    /// <summary>IEnumerable, Task.Result, or Lazy.Value property can never be null.</summary>
-    [AttributeUsage(AttributeTargets.All)] internal sealed class ItemNotNullAttribute : Attribute { }
-    /// <summary>IEnumerable, Task.Result, or Lazy.Value property can be null.</summary>
-    [AttributeUsage(AttributeTargets.All)] internal sealed class ItemCanBeNullAttribute : Attribute { }
+﻿// ReSharper disable once CheckNamespace
+namespace JetBrains.Annotations
+{
+    using System;
+
+    /// <summary>Marked element could be <c>null</c></summary>
+    [AttributeUsage(AttributeTargets.All)] internal sealed class CanBeNullAttribute : Attribute { }
+    /// <summary>Marked element could never be <c>null</c></summary>
+    [AttributeUsage(AttributeTargets.All)] internal sealed class NotNullAttribute : Attribute { }
+    /// <summary>IEnumerable, Task.Result, or Lazy.Value property can never be null.</summary>
+    [AttributeUsage(AttributeTargets.All)] internal sealed class ItemNotNullAttribute : Attribute { }
+    /// <summary>IEnumerable, Task.Result, or Lazy.Value property can be null.</summary>
+    [AttributeUsage(AttributeTargets.All)] internal sealed class ItemCanBeNullAttribute : Attribute { }
 }
\ No newline at end of file
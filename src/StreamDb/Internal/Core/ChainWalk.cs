@@ -0,0 +1,37 @@
+﻿using System.Collections.Generic;
+using JetBrains.Annotations;
+
+namespace StreamDb.Internal.Core
+{
+    /// <summary>
+    /// Guards a walk down a page chain against loops and runaway lengths.
+    /// Call `Visit` with each page before following its link.
+    /// </summary>
+    internal class ChainWalk
+    {
+        [NotNull] private readonly HashSet<int> _seen = new HashSet<int>();
+        private readonly int _rootPageId;
+        private readonly int _maxLength;
+
+        public ChainWalk(int rootPageId, int maxLength)
+        {
+            _rootPageId = rootPageId;
+            _maxLength = maxLength;
+        }
+
+        /// <summary>
+        /// Number of pages visited so far
+        /// </summary>
+        public int Count => _seen.Count;
+
+        /// <summary>
+        /// Record a page on the walk. Throws a `ChainException` if the page was already visited,
+        /// or if the walk has gone past the maximum chain length
+        /// </summary>
+        public void Visit(int pageId)
+        {
+            if (!_seen.Add(pageId)) throw new ChainException(_rootPageId, _seen.Count, pageId, $"Loop in chain {_rootPageId} at ID = {pageId} after {_seen.Count} pages");
+            if (_seen.Count > _maxLength) throw new ChainException(_rootPageId, _seen.Count, -1, $"Chain {_rootPageId} is longer than the limit of {_maxLength} pages");
+        }
+    }
+}
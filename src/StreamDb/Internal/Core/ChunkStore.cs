@@ -0,0 +1,238 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using System.Security.Cryptography;
+using JetBrains.Annotations;
+using StreamDb.Internal.DbStructure;
+
+namespace StreamDb.Internal.Core
+{
+    /// <summary>
+    /// Content-addressed chunk storage for deduplicated documents.
+    /// Incoming data is split at content-defined boundaries (a gear rolling hash), so that an insert or
+    /// delete early in a file only changes the chunks around it. Each distinct chunk is stored once,
+    /// as an unpathed document whose index ID is taken from the chunk's SHA-256 hash.
+    /// The document itself becomes a manifest listing its chunks.
+    /// </summary>
+    internal class ChunkStore
+    {
+        public const int MinChunkSize = 2048;
+        public const int MaxChunkSize = 65536;
+        private const ulong BoundaryMask = ((1UL << 13) - 1) << 51; // top bits see the last 64 bytes. Average chunk about 8KB above the minimum
+
+        /*
+            Manifest layout:
+                [ Magic (16 bytes) | Total length (int64) | Chunk count (int32) ]
+                then for each chunk: [ Chunk Guid (16 bytes) | Chunk length (int32) ]
+        */
+        [NotNull] private static readonly byte[] ManifestMagic = { 0x53, 0x44, 0x42, 0x2D, 0x43, 0x48, 0x55, 0x4E, 0x4B, 0x2D, 0x4D, 0x46, 0x53, 0x54, 0x0D, 0x0A };
+        private const int ManifestHeaderSize = 16 + 8 + 4;
+
+        [NotNull] private static readonly ulong[] Gear = BuildGearTable();
+        [NotNull] private readonly IStorageEngine _core;
+        [NotNull] private readonly ILogger _log;
+        [NotNull] private readonly object _refLock = new object();
+
+        public ChunkStore([NotNull]IStorageEngine core, [NotNull]ILogger log)
+        {
+            _core = core;
+            _log = log;
+        }
+
+        /// <summary>
+        /// Split a stream into chunks, store any that are new, and write a manifest chain. Returns the manifest's end page ID.
+        /// Finding, storing and counting the chunks is all done under one lock, so no chunk can be released
+        /// by another document between being found here and being counted.
+        /// </summary>
+        public int WriteDeduplicated([NotNull]Stream data)
+        {
+            var chunks = new List<KeyValuePair<Guid, int>>();
+            long total = 0;
+            var stored = 0;
+
+            lock (_refLock)
+            {
+                var counts = ReadReferences();
+                using (var sha = SHA256.Create())
+                {
+                    foreach (var chunk in SplitChunks(data))
+                    {
+                        var hash = sha.ComputeHash(chunk) ?? throw new Exception("Failed to hash chunk");
+                        var id = new Guid(Slice(hash, 16));
+
+                        if (!counts.ContainsKey(id) && _core.GetDocumentHead(id) < 0)
+                        {
+                            var head = _core.WriteStream(new MemoryStream(chunk));
+                            _core.BindIndex(id, head, out _);
+                            stored++;
+                        }
+                        counts.TryGetValue(id, out var current);
+                        counts[id] = current + 1;
+                        chunks.Add(new KeyValuePair<Guid, int>(id, chunk.Length));
+                        total += chunk.Length;
+                    }
+                }
+                WriteReferences(counts);
+            }
+
+            _log.Debug("Deduplicated document", "bytes", total, "chunks", chunks.Count, "newChunks", stored);
+
+            var manifest = new MemoryStream();
+            var w = new BinaryWriter(manifest);
+            w.Write(ManifestMagic);
+            w.Write(total);
+            w.Write(chunks.Count);
+            foreach (var chunk in chunks)
+            {
+                w.Write(chunk.Key.ToByteArray());
+                w.Write(chunk.Value);
+            }
+            manifest.Seek(0, SeekOrigin.Begin);
+            return _core.WriteStream(manifest);
+        }
+
+        /// <summary>
+        /// Return a stream of the original document from its chunk manifest.
+        /// Only call this for documents whose index entry has the `Deduplicated` flag.
+        /// </summary>
+        [NotNull]public Stream OpenDocument([NotNull]Stream manifest)
+        {
+            var chunks = ReadManifest(manifest, out var total);
+            return new ChunkedDocumentStream(_core, chunks, total);
+        }
+
+        /// <summary>
+        /// Drop the chunk references of a manifest, releasing any chunks no longer used.
+        /// Only call this for documents whose index entry has the `Deduplicated` flag.
+        /// </summary>
+        public void ReleaseManifest([NotNull]Stream manifest)
+        {
+            var chunks = ReadManifest(manifest, out _);
+
+            lock (_refLock)
+            {
+                var counts = ReadReferences();
+                var unused = new List<Guid>();
+                foreach (var chunk in chunks)
+                {
+                    if (!counts.TryGetValue(chunk.Key, out var current)) continue;
+                    if (current > 1) { counts[chunk.Key] = current - 1; continue; }
+                    counts.Remove(chunk.Key);
+                    unused.Add(chunk.Key);
+                }
+                WriteReferences(counts);
+
+                foreach (var id in unused)
+                {
+                    var head = _core.GetDocumentHead(id);
+                    _core.UnbindIndex(id);
+                    _core.ReleaseChain(head);
+                }
+            }
+        }
+
+        [NotNull]private static List<KeyValuePair<Guid, int>> ReadManifest([NotNull]Stream manifest, out long total)
+        {
+            if (manifest.Length < ManifestHeaderSize) throw new Exception("Deduplicated document is too short to hold a chunk manifest");
+
+            manifest.Seek(0, SeekOrigin.Begin);
+            var r = new BinaryReader(manifest);
+            var magic = r.ReadBytes(ManifestMagic.Length);
+            for (int i = 0; i < ManifestMagic.Length; i++) { if (magic[i] != ManifestMagic[i]) throw new Exception("Deduplicated document has no chunk manifest"); }
+
+            total = r.ReadInt64();
+            var count = r.ReadInt32();
+            var chunks = new List<KeyValuePair<Guid, int>>(count);
+            for (int i = 0; i < count; i++)
+            {
+                chunks.Add(new KeyValuePair<Guid, int>(new Guid(r.ReadBytes(16)), r.ReadInt32()));
+            }
+            return chunks;
+        }
+
+        /// <summary>
+        /// Index IDs of every stored chunk. These are documents with no paths, referenced only by manifests.
+        /// </summary>
+        [NotNull]public HashSet<Guid> ChunkIds()
+        {
+            lock (_refLock)
+            {
+                return new HashSet<Guid>(ReadReferences().Keys);
+            }
+        }
+
+        /// <summary>
+        /// Store the reference count of each chunk, replacing the previous counts. Call inside `_refLock`.
+        /// </summary>
+        private void WriteReferences([NotNull]Dictionary<Guid, int> counts)
+        {
+            var ms = new MemoryStream();
+            var w = new BinaryWriter(ms);
+            w.Write(counts.Count);
+            foreach (var kvp in counts) { w.Write(kvp.Key.ToByteArray()); w.Write(kvp.Value); }
+            ms.Seek(0, SeekOrigin.Begin);
+
+            _core.BindIndex(ReservedDocIds.ChunkRefCounts, _core.WriteStream(ms), out var expired);
+            _core.ReleaseChain(expired);
+        }
+
+        /// <summary>
+        /// Read the stored reference count of each chunk. Call inside `_refLock`.
+        /// </summary>
+        [NotNull]private Dictionary<Guid, int> ReadReferences()
+        {
+            var counts = new Dictionary<Guid, int>();
+            var head = _core.GetDocumentHead(ReservedDocIds.ChunkRefCounts);
+            if (head < 0) return counts;
+
+            var r = new BinaryReader(_core.GetStream(head));
+            var n = r.ReadInt32();
+            for (int i = 0; i < n; i++) { counts[new Guid(r.ReadBytes(16))] = r.ReadInt32(); }
+            return counts;
+        }
+
+        /// <summary>
+        /// Cut a stream into chunks where the rolling hash hits a boundary pattern, within the min and max sizes
+        /// </summary>
+        [NotNull, ItemNotNull]private static IEnumerable<byte[]> SplitChunks([NotNull]Stream data)
+        {
+            var buffer = new byte[MaxChunkSize];
+            var length = 0;
+            ulong hash = 0;
+            int b;
+            while ((b = data.ReadByte()) >= 0)
+            {
+                buffer[length++] = (byte)b;
+                hash = (hash << 1) + Gear[b];
+
+                if (length < MinChunkSize) continue;
+                if ((hash & BoundaryMask) != 0 && length < MaxChunkSize) continue;
+
+                yield return Slice(buffer, length);
+                length = 0;
+                hash = 0;
+            }
+            if (length > 0) yield return Slice(buffer, length);
+        }
+
+        [NotNull]private static byte[] Slice([NotNull]byte[] source, int length)
+        {
+            var result = new byte[length];
+            Buffer.BlockCopy(source, 0, result, 0, length);
+            return result;
+        }
+
+        [NotNull]private static ulong[] BuildGearTable()
+        {
+            // Fixed seed: chunk boundaries must be the same for every connection
+            var table = new ulong[256];
+            ulong x = 0x9E3779B97F4A7C15;
+            for (int i = 0; i < table.Length; i++)
+            {
+                x ^= x << 13; x ^= x >> 7; x ^= x << 17;
+                table[i] = x;
+            }
+            return table;
+        }
+    }
+}
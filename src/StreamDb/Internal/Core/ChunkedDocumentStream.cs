@@ -0,0 +1,108 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using JetBrains.Annotations;
+
+namespace StreamDb.Internal.Core
+{
+    /// <summary>
+    /// Read-only, seekable view of a deduplicated document, presenting its chunks as one continuous stream
+    /// </summary>
+    internal class ChunkedDocumentStream : Stream
+    {
+        [NotNull] private readonly IStorageEngine _core;
+        [NotNull] private readonly List<KeyValuePair<Guid, int>> _chunks;
+        [NotNull] private readonly long[] _starts;
+        private readonly long _length;
+
+        private int _openIndex = -1;
+        private Stream? _open;
+
+        public ChunkedDocumentStream([NotNull]IStorageEngine core, [NotNull]List<KeyValuePair<Guid, int>> chunks, long length)
+        {
+            _core = core;
+            _chunks = chunks;
+            _length = length;
+            _starts = new long[chunks.Count];
+            long offset = 0;
+            for (int i = 0; i < chunks.Count; i++)
+            {
+                _starts[i] = offset;
+                offset += chunks[i].Value;
+            }
+        }
+
+        /// <inheritdoc />
+        public override int Read(byte[] buffer, int offset, int count)
+        {
+            if (buffer == null) throw new Exception("Destination buffer must not be null");
+            var written = 0;
+            while (written < count && Position < _length)
+            {
+                var index = ChunkAt(Position);
+                var chunk = OpenChunk(index);
+                chunk.Seek(Position - _starts[index], SeekOrigin.Begin);
+
+                var actual = chunk.Read(buffer, offset + written, (int)Math.Min(count - written, _chunks[index].Value - (Position - _starts[index])));
+                if (actual < 1) throw new Exception($"Chunk {_chunks[index].Key} is shorter than its manifest entry");
+                written += actual;
+                Position += actual;
+            }
+            return written;
+        }
+
+        private int ChunkAt(long position)
+        {
+            var index = Array.BinarySearch(_starts, position);
+            return index >= 0 ? index : ~index - 1;
+        }
+
+        [NotNull]private Stream OpenChunk(int index)
+        {
+            if (_open != null && _openIndex == index) return _open;
+
+            var head = _core.GetDocumentHead(_chunks[index].Key);
+            if (head < 0) throw new Exception($"Chunk {_chunks[index].Key} is missing");
+            _open = _core.GetStream(head);
+            _openIndex = index;
+            return _open;
+        }
+
+        /// <inheritdoc />
+        public override long Seek(long offset, SeekOrigin origin)
+        {
+            switch (origin)
+            {
+                case SeekOrigin.Begin: Position = offset; break;
+                case SeekOrigin.Current: Position += offset; break;
+                case SeekOrigin.End: Position = _length + offset; break;
+            }
+            Position = Math.Max(0, Math.Min(Position, _length));
+            return Position;
+        }
+
+        /// <inheritdoc />
+        public override void Flush() { }
+
+        /// <inheritdoc />
+        public override void SetLength(long value) { throw new InvalidOperationException("Document stream is not writable"); }
+
+        /// <inheritdoc />
+        public override void Write(byte[] buffer, int offset, int count) { throw new InvalidOperationException("Document stream is not writable"); }
+
+        /// <inheritdoc />
+        public override bool CanRead => true;
+
+        /// <inheritdoc />
+        public override bool CanSeek => true;
+
+        /// <inheritdoc />
+        public override bool CanWrite => false;
+
+        /// <inheritdoc />
+        public override long Length => _length;
+
+        /// <inheritdoc />
+        public override long Position { get; set; }
+    }
+}
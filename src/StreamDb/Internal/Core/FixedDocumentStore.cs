@@ -0,0 +1,159 @@
+﻿using System;
+using System.IO;
+using JetBrains.Annotations;
+using StreamDb.Internal.DbStructure;
+
+namespace StreamDb.Internal.Core
+{
+    /// <summary>
+    /// Fixed size documents that are written in place, as a ring buffer.
+    /// The chain is allocated once when the document is created, and appends overwrite the oldest data
+    /// once the ring is full. This avoids allocating and releasing pages for logs and telemetry.
+    /// </summary>
+    internal class FixedDocumentStore
+    {
+        /*
+            Fixed document layout:
+                [ Magic (16 bytes) | Head (int64) | Tail (int64) ] then the ring of data bytes
+
+            Head and Tail are logical positions: Head is the count of bytes ever appended,
+            Tail is the position of the oldest byte still held. Position `p` is stored at ring offset `p % capacity`.
+        */
+        [NotNull] private static readonly byte[] FixedMagic = { 0x53, 0x44, 0x42, 0x2D, 0x46, 0x49, 0x58, 0x45, 0x44, 0x2D, 0x52, 0x49, 0x4E, 0x47, 0x0D, 0x0A };
+        public const int HeaderSize = 16 + 8 + 8;
+
+        [NotNull] private readonly IStorageEngine _core;
+        [NotNull] private readonly object _writeLock = new object();
+
+        public FixedDocumentStore([NotNull]IStorageEngine core)
+        {
+            _core = core;
+        }
+
+        /// <summary>
+        /// Write an empty fixed document of the given number of pages. Returns the chain ID.
+        /// </summary>
+        public int Create(int sizePages)
+        {
+            if (sizePages < 1) throw new Exception("Fixed documents must have at least one page");
+
+            var ms = new MemoryStream(new byte[(long)sizePages * BasicPage.PageDataCapacity]);
+            var w = new BinaryWriter(ms);
+            w.Write(FixedMagic);
+            w.Write(0L); // head
+            w.Write(0L); // tail
+            ms.Seek(0, SeekOrigin.Begin);
+            return _core.WriteStream(ms);
+        }
+
+        /// <summary>
+        /// Add data at the head of the ring. If the ring is full, the oldest data is overwritten.
+        /// Returns the logical position the data was written at.
+        /// </summary>
+        public long Append(int chainId, [NotNull]byte[] data)
+        {
+            lock (_writeLock)
+            {
+                ReadCursor(chainId, out var head, out var tail, out var capacity);
+                if (data.Length > capacity) throw new Exception($"Can't append {data.Length} bytes to a fixed document holding {capacity}");
+
+                var newHead = head + data.Length;
+                var newTail = Math.Max(tail, newHead - capacity);
+
+                // give up the oldest data before overwriting it, so a failed write never leaves the cursor over changed bytes
+                if (newTail != tail) WriteCursor(chainId, head, newTail);
+
+                var offset = (int)(head % capacity);
+                var first = Math.Min(data.Length, capacity - offset);
+                _core.OverwriteChain(chainId, HeaderSize + offset, Slice(data, 0, first));
+                if (first < data.Length) _core.OverwriteChain(chainId, HeaderSize, Slice(data, first, data.Length - first));
+
+                WriteCursor(chainId, newHead, newTail);
+                return head;
+            }
+        }
+
+        /// <summary>
+        /// Read all data held in the ring, oldest first.
+        /// `tail` is set to the logical position of the first byte returned.
+        /// </summary>
+        [NotNull]public Stream Read(int chainId, out long tail)
+        {
+            using (var stored = _core.GetStream(chainId))
+            {
+                ReadCursor(stored, out var head, out tail, out var capacity);
+                var ring = new byte[capacity];
+                stored.Seek(HeaderSize, SeekOrigin.Begin);
+                ReadFully(stored, ring);
+
+                var result = new byte[head - tail];
+                var offset = (int)(tail % capacity);
+                var first = Math.Min(result.Length, capacity - offset);
+                Buffer.BlockCopy(ring, offset, result, 0, first);
+                Buffer.BlockCopy(ring, 0, result, first, result.Length - first);
+                return new MemoryStream(result, false);
+            }
+        }
+
+        /// <summary>
+        /// Returns true if the stored data is a fixed document
+        /// </summary>
+        public static bool IsFixed([NotNull]Stream stored)
+        {
+            if (stored.Length < HeaderSize) return false;
+
+            stored.Seek(0, SeekOrigin.Begin);
+            var magic = new BinaryReader(stored).ReadBytes(FixedMagic.Length);
+            stored.Seek(0, SeekOrigin.Begin);
+            for (int i = 0; i < FixedMagic.Length; i++) { if (magic[i] != FixedMagic[i]) return false; }
+            return true;
+        }
+
+        private void ReadCursor(int chainId, out long head, out long tail, out int capacity)
+        {
+            using (var stored = _core.GetStream(chainId))
+            {
+                ReadCursor(stored, out head, out tail, out capacity);
+            }
+        }
+
+        private static void ReadCursor([NotNull]Stream stored, out long head, out long tail, out int capacity)
+        {
+            if (!IsFixed(stored)) throw new Exception("Document is not a fixed document");
+
+            var r = new BinaryReader(stored);
+            stored.Seek(FixedMagic.Length, SeekOrigin.Begin);
+            head = r.ReadInt64();
+            tail = r.ReadInt64();
+            capacity = (int)(stored.Length - HeaderSize);
+            if (tail < 0 || head < tail || head - tail > capacity) throw new Exception("Fixed document cursor is damaged");
+        }
+
+        private void WriteCursor(int chainId, long head, long tail)
+        {
+            var ms = new MemoryStream(16);
+            var w = new BinaryWriter(ms);
+            w.Write(head);
+            w.Write(tail);
+            _core.OverwriteChain(chainId, FixedMagic.Length, ms.ToArray());
+        }
+
+        private static void ReadFully([NotNull]Stream source, [NotNull]byte[] buffer)
+        {
+            var read = 0;
+            while (read < buffer.Length)
+            {
+                var count = source.Read(buffer, read, buffer.Length - read);
+                if (count < 1) throw new Exception("Fixed document was truncated");
+                read += count;
+            }
+        }
+
+        [NotNull]private static byte[] Slice([NotNull]byte[] source, int offset, int length)
+        {
+            var result = new byte[length];
+            Buffer.BlockCopy(source, offset, result, 0, length);
+            return result;
+        }
+    }
+}
@@ -0,0 +1,92 @@
+﻿using System.Collections.Generic;
+using System.Linq;
+using JetBrains.Annotations;
+
+namespace StreamDb.Internal.Core
+{
+    /// <summary>
+    /// In-memory copy of the shape of the free list: the list pages in chain order, how many entries each holds,
+    /// and which list page holds each free page ID. This lets allocation and release go straight to the list page they need,
+    /// instead of walking the chain on disk. The on-disk free list is still the durable record, and is updated as before.
+    /// See `DatabaseOptions.CacheFreeList`
+    /// </summary>
+    /// <remarks>
+    /// This is not thread safe. `PageStorage` only uses it while holding its storage lock.
+    /// </remarks>
+    internal class FreePageIndex
+    {
+        [NotNull] private readonly List<int> _listPages = new List<int>(); // top of chain first
+        [NotNull] private readonly Dictionary<int, int> _entryCounts = new Dictionary<int, int>(); // list page => entries
+        [NotNull] private readonly Dictionary<int, int> _owners = new Dictionary<int, int>(); // free page => list page
+
+        /// <summary>
+        /// List pages from the top of the chain (the page the header links to) to the bottom
+        /// </summary>
+        [NotNull] public IReadOnlyList<int> ListPages => _listPages;
+
+        /// <summary>
+        /// Number of free page IDs held in list entries. Empty list pages are not included
+        /// </summary>
+        public int EntryCount => _owners.Count;
+
+        /// <summary>
+        /// Record a list page read while loading, or added to the bottom of the chain
+        /// </summary>
+        public void AddListPage(int listPageId)
+        {
+            _listPages.Add(listPageId);
+            _entryCounts[listPageId] = 0;
+        }
+
+        /// <summary>
+        /// Forget the bottom list page, once it has been handed out as a free page itself
+        /// </summary>
+        public void RemoveBottomListPage()
+        {
+            if (_listPages.Count < 1) return;
+            var last = _listPages[_listPages.Count - 1];
+            _listPages.RemoveAt(_listPages.Count - 1);
+            _entryCounts.Remove(last);
+        }
+
+        /// <summary>
+        /// Record a free page ID written into a list page
+        /// </summary>
+        public void AddEntry(int listPageId, int freePageId)
+        {
+            _owners[freePageId] = listPageId;
+            _entryCounts[listPageId] = (_entryCounts.TryGetValue(listPageId, out var count) ? count : 0) + 1;
+        }
+
+        /// <summary>
+        /// Record a free page ID taken out of its list page
+        /// </summary>
+        public void RemoveEntry(int freePageId)
+        {
+            if (!_owners.TryGetValue(freePageId, out var listPageId)) return;
+            _owners.Remove(freePageId);
+            if (_entryCounts.TryGetValue(listPageId, out var count)) _entryCounts[listPageId] = count - 1;
+        }
+
+        /// <summary>
+        /// Find the list page holding a free page ID. Returns false if the page is not listed as free
+        /// </summary>
+        public bool TryGetOwner(int freePageId, out int listPageId)
+        {
+            return _owners.TryGetValue(freePageId, out listPageId);
+        }
+
+        /// <summary>
+        /// The list page closest to the top of the chain with space for another entry, or the bottom page if all are full.
+        /// Returns -1 if there are no list pages.
+        /// </summary>
+        public int FirstPageWithSpace(int entriesPerPage)
+        {
+            foreach (var pageId in _listPages.Where(pageId => _entryCounts[pageId] < entriesPerPage))
+            {
+                return pageId;
+            }
+            return _listPages.Count > 0 ? _listPages[_listPages.Count - 1] : -1;
+        }
+    }
+}
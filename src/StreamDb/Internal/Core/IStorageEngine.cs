@@ -0,0 +1,171 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using JetBrains.Annotations;
+
+namespace StreamDb.Internal.Core
+{
+    /// <summary>
+    /// Chain-level storage used by the database back-end.
+    /// Data is written as chains, identified by an integer ID. Chains are bound into the index by document ID,
+    /// and document IDs are bound to paths.
+    /// <para></para>
+    /// `PageStorage` is the real engine. `MemoryStorageEngine` is a simple reference implementation, for tests.
+    /// </summary>
+    public interface IStorageEngine
+    {
+        // ############## Chains ##############
+
+        /// <summary>
+        /// Write a data stream from its current position to end as a new chain. Returns the chain ID.
+        /// </summary>
+        int WriteStream([NotNull]Stream dataStream);
+
+        /// <summary>
+        /// Get a read-only stream over a chain
+        /// </summary>
+        [NotNull]Stream GetStream(int chainId);
+
+        /// <summary>
+        /// Join a set of chains, in the order given, so they read as a single stream. Returns the ID of the joined chain.
+        /// Every chain except the last must hold a whole number of full pages.
+        /// </summary>
+        int JoinChains([NotNull]int[] chainIds);
+
+        /// <summary>
+        /// Write bytes into an existing chain, in place. The length of the chain does not change, so the write must fit inside it.
+        /// </summary>
+        void OverwriteChain(int chainId, long offset, [NotNull]byte[] data);
+
+        /// <summary>
+        /// Release a chain so its space can be reused. Invalid IDs (less than zero) are ignored.
+        /// </summary>
+        void ReleaseChain(int chainId);
+
+        /// <summary>
+        /// Append a small record to a record chain, bound in the index under `chainId`
+        /// </summary>
+        void AppendRecord(Guid chainId, [NotNull]byte[] record);
+
+        /// <summary>
+        /// Read all records from a record chain, oldest first
+        /// </summary>
+        [NotNull, ItemNotNull]IEnumerable<byte[]> ReadRecords(Guid chainId);
+
+        // ############## Index ##############
+
+        /// <summary>
+        /// Bind a chain to a document ID. The previous chain is kept as a fall-back; the one before that is returned in `expiredChainId` (or -1).
+        /// The length (-1 if not known) and flags are stored with the binding, and can be read back with `GetIndexStat`.
+        /// </summary>
+        void BindIndex(Guid documentId, int chainId, out int expiredChainId, long length = -1, DocumentFlags flags = DocumentFlags.None);
+
+        /// <summary>
+        /// Remove a document ID from the index. Its chains are not released.
+        /// </summary>
+        void UnbindIndex(Guid documentId);
+
+        /// <summary>
+        /// Get the chain bound to a document ID, or -1 if not bound
+        /// </summary>
+        int GetDocumentHead(Guid documentId);
+
+        /// <summary>
+        /// Get the chain bound to a document ID, or -1 if not bound, and the flags stored with the binding.
+        /// Both come from the same read of the index, so they match even while the document is being rebound.
+        /// </summary>
+        int GetDocumentHead(Guid documentId, out DocumentFlags flags);
+
+        /// <summary>
+        /// Get the length, flags and modified date stored with a document's binding, or null if none are stored
+        /// </summary>
+        DocumentStat? GetIndexStat(Guid documentId);
+
+        // ############## Paths ##############
+
+        /// <summary>
+        /// Bind an exact path to a document ID. Any document previously bound to the path is returned.
+        /// </summary>
+        void BindPath([NotNull]string path, Guid documentId, out Guid? previousDocId, string? annotation = null, BindingAttributes attributes = BindingAttributes.None);
+
+        /// <summary>
+        /// Remove a path binding, if it exists
+        /// </summary>
+        void UnbindPath([NotNull]string exactPath);
+
+        /// <summary>
+        /// Get the document bound to an exact path, or null
+        /// </summary>
+        Guid? GetDocumentIdByPath([NotNull]string exactPath);
+
+        /// <summary>
+        /// Get the document and binding metadata for an exact path, or null
+        /// </summary>
+        BindingInfo? GetBindingInfo([NotNull]string exactPath);
+
+        /// <summary>
+        /// List all paths bound to a document
+        /// </summary>
+        [NotNull, ItemNotNull]IEnumerable<string> GetPathsForDocument(Guid documentId);
+
+        /// <summary>
+        /// List all bound paths starting with a prefix
+        /// </summary>
+        [NotNull, ItemNotNull]IEnumerable<string> SearchPaths([NotNull]string pathPrefix);
+
+        /// <summary>
+        /// List all bound paths ending with a suffix
+        /// </summary>
+        [NotNull, ItemNotNull]IEnumerable<string> SearchPathSuffix([NotNull]string pathSuffix);
+
+        /// <summary>
+        /// Move every path starting with `oldPrefix` to start with `newPrefix`. Returns the number of paths moved.
+        /// </summary>
+        int RenamePrefix([NotNull]string oldPrefix, [NotNull]string newPrefix, out Guid[] replacedDocIds);
+
+        /// <summary>
+        /// Bind and unbind a set of paths, in order, as a single change. A change with an empty `DocumentId` unbinds its path.
+        /// Returns the document bound to each path before its change (`Guid.Empty` if none), in the same order as the changes.
+        /// </summary>
+        [NotNull]Guid[] ApplyPathChanges([NotNull, ItemNotNull]IList<BindingInfo> changes);
+
+        // ############## Info ##############
+
+        /// <summary>
+        /// Check all stored data is intact
+        /// </summary>
+        [NotNull]IntegrityReport CheckIntegrity(int workers);
+
+        /// <summary>
+        /// Check storage is in a usable state, to the given depth
+        /// </summary>
+        [NotNull]HealthReport HealthCheck(HealthCheckLevel level);
+
+        /// <summary>
+        /// Number of documents bound in the index, not counting reserved IDs
+        /// </summary>
+        long DocumentCount();
+
+        /// <summary>
+        /// IDs of documents bound in the index, not counting reserved IDs
+        /// </summary>
+        [NotNull]Guid[] DocumentIds();
+
+        /// <summary>
+        /// Forget the previous revision of a document. Returns the chain that is no longer referenced,
+        /// for the caller to release, or -1 if there is none
+        /// </summary>
+        int DropPreviousVersion(Guid documentId);
+
+        /// <summary>
+        /// Forget the previous revision of every document. Returns the chains that are no longer referenced,
+        /// for the caller to release
+        /// </summary>
+        [NotNull]int[] DropAllPreviousVersions();
+
+        /// <summary>
+        /// Count the storage used by current and previous revisions of indexed documents
+        /// </summary>
+        [NotNull]VersionReport VersionStatistics();
+    }
+}
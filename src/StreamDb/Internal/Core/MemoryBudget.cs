@@ -0,0 +1,69 @@
+﻿using System;
+using JetBrains.Annotations;
+
+namespace StreamDb.Internal.Core
+{
+    /// <summary>
+    /// Tracks memory held by caches (the path lookup and page streams) against an optional limit.
+    /// When a reservation would go over the limit, the evict callback is given a chance to free space first.
+    /// See `DatabaseOptions.MemoryBudget`
+    /// </summary>
+    internal class MemoryBudget
+    {
+        [NotNull] private readonly object _lock = new object();
+        private readonly long _limit;
+        private long _used;
+
+        /// <param name="limit">Maximum bytes held by caches, or null for no limit</param>
+        public MemoryBudget(long? limit)
+        {
+            if (limit < 0) throw new ArgumentOutOfRangeException(nameof(limit), "Memory budget must not be negative");
+            _limit = limit ?? long.MaxValue;
+        }
+
+        /// <summary>
+        /// Called when a reservation would exceed the limit. Should drop a cache (releasing its reservation),
+        /// and return true if anything was freed.
+        /// </summary>
+        public Func<bool>? Evict { get; set; }
+
+        /// <summary>
+        /// True if a limit was set
+        /// </summary>
+        public bool IsLimited => _limit != long.MaxValue;
+
+        /// <summary>
+        /// Bytes currently reserved
+        /// </summary>
+        public long Used { get { lock (_lock) { return _used; } } }
+
+        /// <summary>
+        /// Try to reserve bytes for a cache. Returns false if the budget can't cover them, even after eviction.
+        /// </summary>
+        public bool TryReserve(long bytes)
+        {
+            if (TryAdd(bytes)) return true;
+            var evict = Evict;
+            if (evict == null || !evict()) return false;
+            return TryAdd(bytes);
+        }
+
+        /// <summary>
+        /// Return bytes previously reserved
+        /// </summary>
+        public void Release(long bytes)
+        {
+            lock (_lock) { _used = Math.Max(0, _used - bytes); }
+        }
+
+        private bool TryAdd(long bytes)
+        {
+            lock (_lock)
+            {
+                if (_used + bytes > _limit) return false;
+                _used += bytes;
+                return true;
+            }
+        }
+    }
+}
@@ -0,0 +1,371 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using System.Linq;
+using JetBrains.Annotations;
+using StreamDb.Internal.DbStructure;
+using StreamDb.Internal.Support;
+
+namespace StreamDb.Internal.Core
+{
+    /// <summary>
+    /// A simple storage engine that keeps everything in dictionaries.
+    /// This is a reference for the behaviour of `PageStorage`, and a fast fake for testing the layers above it.
+    /// Nothing is persisted.
+    /// </summary>
+    public class MemoryStorageEngine : IStorageEngine
+    {
+        [NotNull] private readonly object _lock = new object();
+        [NotNull] private readonly Dictionary<int, byte[]> _chains = new Dictionary<int, byte[]>();
+        [NotNull] private readonly Dictionary<int, List<byte[]>> _records = new Dictionary<int, List<byte[]>>();
+        [NotNull] private readonly Dictionary<Guid, int[]> _index = new Dictionary<Guid, int[]>(); // [newest, previous]
+        [NotNull] private readonly Dictionary<Guid, DocumentStat> _stats = new Dictionary<Guid, DocumentStat>();
+        [NotNull] private readonly Dictionary<string, BindingInfo> _paths = new Dictionary<string, BindingInfo>();
+        private readonly bool _recordBindingTimes;
+        private int _nextChainId;
+
+        public MemoryStorageEngine(DatabaseOptions? options = null)
+        {
+            _recordBindingTimes = options?.RecordBindingTimes ?? false;
+        }
+
+        /// <summary>
+        /// Number of chains written and not yet released
+        /// </summary>
+        public int LiveChainCount { get { lock (_lock) { return _chains.Count + _records.Count; } } }
+
+        /// <inheritdoc />
+        public int WriteStream(Stream dataStream)
+        {
+            if (dataStream == null) throw new Exception("Data stream must be valid");
+            var ms = new MemoryStream();
+            dataStream.CopyTo(ms);
+            if (dataStream is KnownLengthStream known && known.Position < known.Length) throw new Exception($"Data stream ended after {known.Position} bytes, but {known.Length} were expected");
+            if (ms.Length < 1) return -1; // like an empty page chain
+            lock (_lock)
+            {
+                var id = _nextChainId++;
+                _chains.Add(id, ms.ToArray());
+                return id;
+            }
+        }
+
+        /// <inheritdoc />
+        public Stream GetStream(int chainId)
+        {
+            if (chainId < 0) return new MemoryStream(new byte[0], false);
+            lock (_lock)
+            {
+                if (!_chains.TryGetValue(chainId, out var data)) throw new Exception($"Chain {chainId} does not exist");
+                return new MemoryStream(data, false);
+            }
+        }
+
+        /// <inheritdoc />
+        public int JoinChains(int[] chainIds)
+        {
+            if (chainIds == null || chainIds.Length < 1) throw new Exception("No chains given to join");
+            lock (_lock)
+            {
+                var parts = chainIds.Select(id => _chains.TryGetValue(id, out var data) ? data : throw new Exception($"Invalid chain end {id}")).ToList();
+                for (int i = 0; i < parts.Count - 1; i++)
+                {
+                    if (parts[i].Length < 1 || parts[i].Length % BasicPage.PageDataCapacity != 0) throw new Exception($"Chain {i} of {parts.Count} does not fill its last page, so can't be joined");
+                }
+
+                var last = chainIds[chainIds.Length - 1];
+                for (int i = 0; i < chainIds.Length - 1; i++) { _chains.Remove(chainIds[i]); }
+                _chains[last] = parts.SelectMany(p => p).ToArray();
+                return last;
+            }
+        }
+
+        /// <inheritdoc />
+        public void OverwriteChain(int chainId, long offset, byte[] data)
+        {
+            if (data == null) throw new Exception("Data must not be null");
+            lock (_lock)
+            {
+                if (!_chains.TryGetValue(chainId, out var chain)) throw new Exception($"Chain {chainId} does not exist");
+                if (offset < 0 || offset + data.Length > chain.Length) throw new Exception($"Write of {data.Length} bytes at {offset} does not fit in chain {chainId} ({chain.Length} bytes)");
+                Buffer.BlockCopy(data, 0, chain, (int)offset, data.Length);
+            }
+        }
+
+        /// <inheritdoc />
+        public void ReleaseChain(int chainId)
+        {
+            if (chainId < 0) return;
+            lock (_lock)
+            {
+                if (!_chains.Remove(chainId) && !_records.Remove(chainId)) throw new Exception($"Chain {chainId} was released twice, or never written");
+            }
+        }
+
+        /// <inheritdoc />
+        public void AppendRecord(Guid chainId, byte[] record)
+        {
+            if (record == null || record.Length < 1) throw new Exception("Record must not be empty");
+            lock (_lock)
+            {
+                var head = GetDocumentHead(chainId);
+                if (head < 0)
+                {
+                    head = _nextChainId++;
+                    _records.Add(head, new List<byte[]>());
+                    BindIndex(chainId, head, out _);
+                }
+                _records[head].Add(record.ToArray());
+            }
+        }
+
+        /// <inheritdoc />
+        public IEnumerable<byte[]> ReadRecords(Guid chainId)
+        {
+            lock (_lock)
+            {
+                var head = GetDocumentHead(chainId);
+                if (head < 0 || !_records.TryGetValue(head, out var records)) return new byte[0][];
+                return records.Select(r => r.ToArray()).ToList();
+            }
+        }
+
+        /// <inheritdoc />
+        public void BindIndex(Guid documentId, int chainId, out int expiredChainId, long length = -1, DocumentFlags flags = DocumentFlags.None)
+        {
+            lock (_lock)
+            {
+                _stats[documentId] = new DocumentStat { DocumentId = documentId, Length = length <= IndexPage.MaxMetadataLength ? length : -1, Flags = flags, LastModified = DateTime.UtcNow.Date, FromIndex = true };
+                expiredChainId = -1;
+                if (_index.TryGetValue(documentId, out var link))
+                {
+                    expiredChainId = link[1];
+                    _index[documentId] = new[] { chainId, link[0] };
+                }
+                else
+                {
+                    _index.Add(documentId, new[] { chainId, -1 });
+                }
+            }
+        }
+
+        /// <inheritdoc />
+        public void UnbindIndex(Guid documentId)
+        {
+            lock (_lock) { _index.Remove(documentId); _stats.Remove(documentId); }
+        }
+
+        /// <inheritdoc />
+        public int GetDocumentHead(Guid documentId)
+        {
+            lock (_lock) { return _index.TryGetValue(documentId, out var link) ? link[0] : -1; }
+        }
+
+        /// <inheritdoc />
+        public int GetDocumentHead(Guid documentId, out DocumentFlags flags)
+        {
+            lock (_lock)
+            {
+                flags = _stats.TryGetValue(documentId, out var stat) ? stat.Flags : DocumentFlags.None;
+                return _index.TryGetValue(documentId, out var link) ? link[0] : -1;
+            }
+        }
+
+        /// <inheritdoc />
+        public DocumentStat? GetIndexStat(Guid documentId)
+        {
+            lock (_lock)
+            {
+                if (!_stats.TryGetValue(documentId, out var stat)) return null;
+                return new DocumentStat { DocumentId = stat.DocumentId, Length = stat.Length, Flags = stat.Flags, LastModified = stat.LastModified, FromIndex = true };
+            }
+        }
+
+        /// <inheritdoc />
+        public void BindPath(string path, Guid documentId, out Guid? previousDocId, string? annotation = null, BindingAttributes attributes = BindingAttributes.None)
+        {
+            if (string.IsNullOrEmpty(path)) throw new Exception("Path must not be null or empty");
+            lock (_lock)
+            {
+                previousDocId = _paths.TryGetValue(path, out var previous) ? previous.DocumentId : (Guid?)null;
+                _paths[path] = new BindingInfo { Path = path, DocumentId = documentId, Annotation = annotation, Attributes = attributes, BoundAt = _recordBindingTimes || annotation != null ? DateTime.UtcNow : (DateTime?)null };
+            }
+        }
+
+        /// <inheritdoc />
+        public void UnbindPath(string exactPath)
+        {
+            lock (_lock) { _paths.Remove(exactPath); }
+        }
+
+        /// <inheritdoc />
+        public Guid? GetDocumentIdByPath(string exactPath)
+        {
+            lock (_lock) { return _paths.TryGetValue(exactPath, out var binding) ? binding.DocumentId : (Guid?)null; }
+        }
+
+        /// <inheritdoc />
+        public BindingInfo? GetBindingInfo(string exactPath)
+        {
+            lock (_lock)
+            {
+                if (!_paths.TryGetValue(exactPath, out var binding)) return null;
+                return new BindingInfo { Path = binding.Path, DocumentId = binding.DocumentId, Annotation = binding.Annotation, Attributes = binding.Attributes, BoundAt = binding.BoundAt };
+            }
+        }
+
+        /// <inheritdoc />
+        public IEnumerable<string> GetPathsForDocument(Guid documentId)
+        {
+            lock (_lock) { return _paths.Values.Where(b => b.DocumentId == documentId).Select(b => b.Path).ToList(); }
+        }
+
+        /// <inheritdoc />
+        public IEnumerable<string> SearchPaths(string pathPrefix)
+        {
+            if (pathPrefix == null) throw new Exception("Prefix must not be null");
+            lock (_lock) { return _paths.Keys.Where(p => IsUnder(p, pathPrefix)).ToList(); }
+        }
+
+        /// <inheritdoc />
+        public IEnumerable<string> SearchPathSuffix(string pathSuffix)
+        {
+            if (string.IsNullOrEmpty(pathSuffix)) throw new Exception("Suffix must not be null or empty");
+            lock (_lock) { return _paths.Keys.Where(p => p.EndsWith(pathSuffix, StringComparison.Ordinal)).ToList(); }
+        }
+
+        /// <inheritdoc />
+        public int RenamePrefix(string oldPrefix, string newPrefix, out Guid[] replacedDocIds)
+        {
+            replacedDocIds = new Guid[0];
+            if (oldPrefix == null || newPrefix == null) throw new Exception("Prefixes must not be null");
+            if (oldPrefix == newPrefix) return 0;
+
+            lock (_lock)
+            {
+                var moves = _paths.Values.Where(b => IsUnder(b.Path, oldPrefix)).ToList();
+                foreach (var move in moves) { _paths.Remove(move.Path); }
+
+                var replaced = new List<Guid>();
+                foreach (var move in moves)
+                {
+                    var target = newPrefix + move.Path.Substring(oldPrefix.Length);
+                    if (_paths.TryGetValue(target, out var previous)) replaced.Add(previous.DocumentId);
+                    _paths[target] = new BindingInfo { Path = target, DocumentId = move.DocumentId, Annotation = move.Annotation, Attributes = move.Attributes, BoundAt = move.BoundAt };
+                }
+                replacedDocIds = replaced.Distinct().ToArray();
+                return moves.Count;
+            }
+        }
+
+        /// <inheritdoc />
+        public Guid[] ApplyPathChanges(IList<BindingInfo> changes)
+        {
+            if (changes == null) throw new Exception("Changes must not be null");
+            var previousDocIds = new Guid[changes.Count];
+            lock (_lock)
+            {
+                for (int i = 0; i < changes.Count; i++)
+                {
+                    var change = changes[i];
+                    if (string.IsNullOrEmpty(change.Path)) throw new Exception("Path must not be null or empty");
+                    if (_paths.TryGetValue(change.Path, out var previous)) previousDocIds[i] = previous.DocumentId;
+
+                    if (change.DocumentId == Guid.Empty) { _paths.Remove(change.Path); continue; }
+                    _paths[change.Path] = new BindingInfo { Path = change.Path, DocumentId = change.DocumentId, Annotation = change.Annotation, Attributes = change.Attributes,
+                        BoundAt = _recordBindingTimes || change.Annotation != null ? DateTime.UtcNow : (DateTime?)null };
+                }
+            }
+            return previousDocIds;
+        }
+
+        /// <summary>
+        /// Prefix searches match longer paths only, as in the path trie
+        /// </summary>
+        private static bool IsUnder([NotNull]string path, [NotNull]string prefix)
+        {
+            return path.Length > prefix.Length && path.StartsWith(prefix, StringComparison.Ordinal);
+        }
+
+        /// <inheritdoc />
+        public IntegrityReport CheckIntegrity(int workers)
+        {
+            return new IntegrityReport { PagesChecked = LiveChainCount };
+        }
+
+        /// <inheritdoc />
+        public HealthReport HealthCheck(HealthCheckLevel level)
+        {
+            return new HealthReport { Level = level, PagesChecked = level == HealthCheckLevel.Deep ? LiveChainCount : 0 };
+        }
+
+        /// <inheritdoc />
+        public long DocumentCount()
+        {
+            lock (_lock) { return _index.Keys.Count(id => !ReservedDocIds.IsReserved(id)); }
+        }
+
+        /// <inheritdoc />
+        public Guid[] DocumentIds()
+        {
+            lock (_lock) { return _index.Keys.Where(id => !ReservedDocIds.IsReserved(id)).ToArray(); }
+        }
+
+        /// <inheritdoc />
+        public int DropPreviousVersion(Guid documentId)
+        {
+            lock (_lock)
+            {
+                if (!_index.TryGetValue(documentId, out var link)) return -1;
+                var expired = link[1];
+                link[1] = -1;
+                return expired;
+            }
+        }
+
+        /// <inheritdoc />
+        public int[] DropAllPreviousVersions()
+        {
+            lock (_lock)
+            {
+                var expired = new List<int>();
+                foreach (var link in _index.Values)
+                {
+                    if (link[1] >= 0) expired.Add(link[1]);
+                    link[1] = -1;
+                }
+                return expired.ToArray();
+            }
+        }
+
+        /// <inheritdoc />
+        public VersionReport VersionStatistics()
+        {
+            lock (_lock)
+            {
+                var report = new VersionReport();
+                foreach (var entry in _index)
+                {
+                    report.Documents.Add(new DocumentVersionStat {
+                        DocumentId = entry.Key,
+                        LivePages = PagesFor(entry.Value[0]),
+                        RetainedPages = PagesFor(entry.Value[1])
+                    });
+                }
+                return report;
+            }
+        }
+
+        /// <summary>
+        /// Number of pages `PageStorage` would use for a chain
+        /// </summary>
+        private int PagesFor(int chainId)
+        {
+            long length = 0;
+            if (chainId < 0) return 0;
+            if (_chains.TryGetValue(chainId, out var data)) length = data.Length;
+            else if (_records.TryGetValue(chainId, out var records)) length = records.Sum(r => (long)r.Length);
+            return (int)((length + BasicPage.PageDataCapacity - 1) / BasicPage.PageDataCapacity);
+        }
+    }
+}
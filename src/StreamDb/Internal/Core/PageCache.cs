@@ -0,0 +1,93 @@
+﻿using System;
+using System.Collections.Generic;
+using JetBrains.Annotations;
+using StreamDb.Internal.DbStructure;
+
+namespace StreamDb.Internal.Core
+{
+    /// <summary>
+    /// Least-recently-used cache of pages whose CRC has been checked, or which this connection wrote itself.
+    /// Hits are trusted without checking the CRC again, until the page is evicted or committed with new content.
+    /// See `DatabaseOptions.PageCachePages`
+    /// </summary>
+    /// <remarks>
+    /// Pages are copied in and out, as callers change the pages they read before committing them.
+    /// </remarks>
+    internal class PageCache
+    {
+        [NotNull] private readonly object _lock = new object();
+        [NotNull] private readonly Dictionary<int, LinkedListNode<BasicPage>> _pages = new Dictionary<int, LinkedListNode<BasicPage>>();
+        [NotNull] private readonly LinkedList<BasicPage> _recent = new LinkedList<BasicPage>(); // most recently used first
+        private readonly int _capacity;
+        private long _hits;
+
+        /// <param name="capacity">Maximum number of pages held</param>
+        public PageCache(int capacity)
+        {
+            if (capacity < 1) throw new ArgumentOutOfRangeException(nameof(capacity), "Page cache must hold at least one page");
+            _capacity = capacity;
+        }
+
+        /// <summary>
+        /// Number of reads served from the cache, without reading storage or checking a CRC
+        /// </summary>
+        public long Hits { get { lock (_lock) { return _hits; } } }
+
+        /// <summary>
+        /// Get a copy of a cached page. Returns false if the page is not cached.
+        /// </summary>
+        public bool TryGet(int pageId, out BasicPage? page)
+        {
+            lock (_lock)
+            {
+                if (!_pages.TryGetValue(pageId, out var node) || node?.Value == null)
+                {
+                    page = null;
+                    return false;
+                }
+                _recent.Remove(node);
+                _recent.AddFirst(node);
+                _hits++;
+                page = Copy(node.Value);
+                return true;
+            }
+        }
+
+        /// <summary>
+        /// Store a copy of a page known to match its CRC, replacing any older copy
+        /// </summary>
+        public void Put([NotNull]BasicPage page)
+        {
+            lock (_lock)
+            {
+                Remove(page.PageId);
+                _pages[page.PageId] = _recent.AddFirst(Copy(page));
+                while (_recent.Count > _capacity && _recent.Last != null)
+                {
+                    _pages.Remove(_recent.Last.Value.PageId);
+                    _recent.RemoveLast();
+                }
+            }
+        }
+
+        /// <summary>
+        /// Drop a page from the cache, if present
+        /// </summary>
+        public void Remove(int pageId)
+        {
+            lock (_lock)
+            {
+                if (!_pages.TryGetValue(pageId, out var node) || node == null) return;
+                _pages.Remove(pageId);
+                _recent.Remove(node);
+            }
+        }
+
+        [NotNull]private static BasicPage Copy([NotNull]BasicPage page)
+        {
+            var copy = new BasicPage(page.PageId);
+            Buffer.BlockCopy(page._data, 0, copy._data, 0, BasicPage.PageRawSize);
+            return copy;
+        }
+    }
+}
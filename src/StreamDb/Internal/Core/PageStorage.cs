@@ -1,623 +1,3550 @@
-﻿using System;
-using System.Collections.Generic;
-using System.IO;
-using JetBrains.Annotations;
-using StreamDb.Internal.DbStructure;
-using StreamDb.Internal.Support;
-
-namespace StreamDb.Internal.Core
-{
-    /// <summary>
-    /// A simplified version of the original PageTable. This one uses only reverse links and a streaming interface.
-    /// The start of this database is not a full page, but a set of versioned links out to:
-    ///  - an index page chain
-    ///  - a path-lookup page chain
-    ///  - a free-list page chain
-    /// All page version links point to the end of a chain.
-    /// Pages cannot be updated in this store -- write a new copy and release the old one.
-    /// <para></para>
-    /// Unlike the PageTable, this handles its free page list directly and internally. The main index and path lookup are normal documents with no special position.
-    /// </summary>
-    public class PageStorage {
-        [NotNull] private readonly Stream _fs;
-        [NotNull] private readonly object _fslock = new object();
-
-        // ReSharper disable InconsistentNaming
-        /// <summary> A magic number we use to recognise our database format </summary>
-        [NotNull] public static readonly byte[] HEADER_MAGIC = { 0x55, 0xAA, 0xFE, 0xED, 0xFA, 0xCE, 0xDA, 0x7A };
-
-        public const int MAGIC_SIZE = 8;
-        public const int HEADER_SIZE = (VersionedLink.ByteSize * 3) + MAGIC_SIZE;
-        public const int FREE_PAGE_SLOTS = 128;
-        // ReSharper restore InconsistentNaming
-        
-        private volatile ReverseTrie<SerialGuid>? _pathLookupCache;
-
-        public PageStorage([NotNull]Stream fs)
-        {
-            _fs = fs;
-            if (!fs.CanRead) throw new Exception("Database stream must be readable");
-            if (!fs.CanSeek) throw new Exception("Database stream must support seeking");
-
-            // Create empty database?
-            if (fs.Length == 0) {
-                InitialiseDb(fs);
-                return;
-            }
-
-            if (fs.Length < HEADER_SIZE) throw new Exception("Stream is not empty, but is to short to read header information");
-
-            // Not empty -- quick sanity check that our stream is a real DB
-            fs.Seek(0, SeekOrigin.Begin);
-            foreach (var b in HEADER_MAGIC)
-            {
-                if (fs.ReadByte() != b) throw new Exception("Supplied stream is not a StreamDB file");
-            }
-        }
-
-        public static void InitialiseDb([NotNull]Stream fs)
-        {
-            if (!fs.CanWrite) throw new Exception("Tried to initialise a read-only stream");
-
-            fs.Seek(0, SeekOrigin.Begin);
-            foreach (var b in HEADER_MAGIC) { fs.WriteByte(b); }
-
-            // write disabled links for the three core chains
-            var indexVersion = new VersionedLink();
-            var pathLookupVersion = new VersionedLink();
-            var freeListVersion = new VersionedLink();
-
-            indexVersion.Freeze().CopyTo(fs);
-            pathLookupVersion.Freeze().CopyTo(fs);
-            freeListVersion.Freeze().CopyTo(fs);
-            fs.Flush();
-        }
-
-        /// <summary>
-        /// Get a read-only page stream for a page chain, given it's end ID
-        /// </summary>
-        public SimplePageStream GetStream(int endPageId) {
-            return new SimplePageStream(this, endPageId);
-        }
-
-        /// <summary>
-        /// Write a data stream from its current position to end to a new page chain. Returns the end page ID.
-        /// This ID should then be stored either inside the index document, or to one of the core versions.
-        /// </summary>
-        public int WriteStream(Stream dataStream) {
-            if (dataStream == null) throw new Exception("Data stream must be valid");
-
-            var bytesRequired = dataStream.Length - dataStream.Position;
-            var pagesRequired = BasicPage.CountRequired(bytesRequired);
-
-            var pages = new int[pagesRequired];
-            AllocatePageBlock(pages);
-
-            return WriteStreamInternal(dataStream, pagesRequired, pages);
-        }
-
-        /// <summary>
-        /// Reserve a set of new pages for use, and return their IDs.
-        /// This may allocate new pages and/or reuse released pages.
-        /// </summary>
-        /// <param name="block">Array for pages required. All slots will be filled with new page IDs</param>
-        public void AllocatePageBlock(int[] block)
-        {
-            if (block == null) throw new Exception("Requested free pages for a null block");
-            if (block.Length < 1) return;
-
-            lock (_fslock) {
-                // Exhaust the free page list to fill our block.
-                // If we run out of free pages, allocate the rest at the end of the stream
-                var stopIdx = ReassignReleasedPages(block);
-                DirectlyAllocatePages(block, stopIdx);
-            }
-        }
-
-        /// <summary>
-        /// Release all pages in a chain. They can be reused on next write.
-        /// If the page ID given is invalid, the release command is silently ignored
-        /// </summary>
-        public void ReleaseChain(int endPageId) {
-            if (endPageId < 0) return;
-
-            var pagesSeen = new HashSet<int>();
-            var currentPage = GetRawPage(endPageId);
-            // walk down the chain
-            while (currentPage != null)
-            {
-                if (pagesSeen.Contains(currentPage.PageId)) throw new Exception($"Loop in chain {endPageId} at ID = {currentPage.PageId}");
-                pagesSeen.Add(currentPage.PageId);
-
-                ReleaseSinglePage(currentPage.PageId);
-                currentPage = GetRawPage(currentPage.PrevPageId);
-            }
-        }
-
-        /// <summary>
-        /// Read a page from the storage stream to memory. This will check the CRC.
-        /// </summary>
-        public BasicPage? GetRawPage(int pageId, bool ignoreCrc = false)
-        {
-            if (pageId < 0) return null;
-            var result = new BasicPage(pageId);
-            lock (_fslock)
-            {
-                _fs.Seek(HEADER_SIZE + (pageId * BasicPage.PageRawSize), SeekOrigin.Begin);
-                result.Defrost(_fs);
-            }
-            if (!ignoreCrc && !result.ValidateCrc()) throw new Exception($"Reading page {pageId} failed CRC check");
-            return result;
-        }
-
-        /// <summary>
-        /// Write a page from memory to storage. This will update the CRC before writing.
-        /// </summary>
-        public void CommitPage(BasicPage page) {
-            if (page == null) throw new Exception("Can't commit a null page");
-            if (page.PageId < 0) throw new Exception("Page ID must be valid");
-
-            var pageId = page.PageId;
-            page.UpdateCRC();
-
-            var ms = new MemoryStream(BasicPage.PageRawSize);
-            page.Freeze().CopyTo(ms);
-            ms.Seek(0, SeekOrigin.Begin);
-            var buffer = ms.ToArray() ?? throw new Exception($"Failed to serialise page {pageId}");
-
-            lock (_fslock)
-            {
-                _fs.Seek(HEADER_SIZE + (pageId * BasicPage.PageRawSize), SeekOrigin.Begin);
-                _fs.Write(buffer, 0, buffer.Length);
-                _fs.Flush();
-            }
-        }
-        
-        /// <summary>
-        /// Map a document GUID to a page ID.
-        /// If the document has an existing page, the versions will be incremented.
-        /// If a version expires, the page ID will be returned in `expiredPageId`
-        /// </summary>
-        /// <param name="documentId">Unique ID for the document</param>
-        /// <param name="newPageId">top page id for most recent version of the document</param>
-        /// <param name="expiredPageId">an expired version of the document, or `-1` if no versions have expired</param>
-        public void BindIndex(Guid documentId, int newPageId, out int expiredPageId)
-        {
-            lock (_fslock)
-            {
-                var indexLink = GetIndexPageLink();
-                if (!indexLink.TryGetLink(0, out var indexTopPageId))
-                {
-                    indexTopPageId = -1;
-                }
-
-                // Try to update an existing document
-                var currentPage = GetRawPage(indexTopPageId);
-                while (currentPage != null)
-                {
-                    var indexSnap = new IndexPage();
-                    indexSnap.Defrost(currentPage.BodyStream());
-
-                    var found = indexSnap.Update(documentId, newPageId, out expiredPageId);
-                    if (found)
-                    {
-                        var stream = indexSnap.Freeze();
-                        currentPage.Write(stream, 0, stream.Length);
-                        CommitPage(currentPage);
-                        return;
-                    }
-
-                    currentPage = GetRawPage(currentPage.PrevPageId);
-                }
-
-                // Try to insert a new link in an existing index page
-                expiredPageId = -1;
-                currentPage = GetRawPage(indexTopPageId);
-                while (currentPage != null)
-                {
-                    var indexSnap = new IndexPage();
-                    indexSnap.Defrost(currentPage.BodyStream());
-
-                    var found = indexSnap.TryInsert(documentId, newPageId);
-                    if (found)
-                    {
-                        var stream = indexSnap.Freeze();
-                        currentPage.Write(stream, 0, stream.Length);
-                        CommitPage(currentPage);
-                        return;
-                    }
-
-                    currentPage = GetRawPage(currentPage.PrevPageId);
-                }
-
-                // need to extend into a new index, and write to a new version of the head
-                var newIndex = new IndexPage();
-                var ok = newIndex.TryInsert(documentId, newPageId);
-                if (!ok) throw new Exception("Failed to write index to blank index page");
-                var slot = new int[1];
-                AllocatePageBlock(slot);
-                var newPage = GetRawPage(slot[0]) ?? throw new Exception("Failed to read newly allocated page");
-                newPage.PrevPageId = indexTopPageId;
-                var newStream = newIndex.Freeze();
-                newPage.Write(newStream, 0, newStream.Length);
-                CommitPage(newPage);
-
-                // set new head link
-                indexLink.WriteNewLink(newPage.PageId, out _); // Index is always extended, we never clean it up
-                SetIndexPageLink(indexLink);
-                _fs.Flush();
-            }
-        }
-
-        /// <summary>
-        /// Remove a mapping from a document GUID.
-        /// The page chain is not affected.
-        /// If no such document id is bound, nothing happens
-        /// </summary>
-        public void UnbindIndex(Guid documentId)
-        {
-            lock (_fslock)
-            {
-                var indexLink = GetIndexPageLink();
-                if (!indexLink.TryGetLink(0, out var indexTopPageId)) {
-                     return; // no index to unbind
-                }
-
-                // Search for the binding, and remove if found
-                var currentPage = GetRawPage(indexTopPageId);
-                while (currentPage != null)
-                {
-                    var indexSnap = new IndexPage();
-                    indexSnap.Defrost(currentPage.BodyStream());
-
-                    var found = indexSnap.Remove(documentId);
-                    if (found)
-                    {
-                        var stream = indexSnap.Freeze();
-                        currentPage.Write(stream, 0, stream.Length);
-                        CommitPage(currentPage);
-                        _fs.Flush();
-                        return;
-                    }
-
-                    currentPage = GetRawPage(currentPage.PrevPageId);
-                }
-            }
-        }
-
-        /// <summary>
-        /// Get the top page ID for a document ID by reading the index.
-        /// If the document ID can't be found, returns -1
-        /// </summary>
-        public int GetDocumentHead(Guid documentId)
-        {
-            var indexLink = GetIndexPageLink();
-            if (!indexLink.TryGetLink(0, out var indexTopPageId))
-            {
-                indexTopPageId = -1;
-            }
-
-            // Try to update an existing document
-            var currentPage = GetRawPage(indexTopPageId);
-            while (currentPage != null)
-            {
-                var indexSnap = new IndexPage();
-                indexSnap.Defrost(currentPage.BodyStream());
-
-                var found = indexSnap.Search(documentId, out var link);
-                if (found && link != null)
-                {
-                    if (link.TryGetLink(0, out var result)) return result;
-                }
-
-                currentPage = GetRawPage(currentPage.PrevPageId);
-            }
-            return -1;
-        }
-
-        /// <summary>
-        /// Bind an exact path to a document ID.
-        /// If an existing document was bound to the same path, its ID will be returned
-        /// </summary>
-        /// <param name="path">Exact path for document</param>
-        /// <param name="documentId">new document id</param>
-        /// <param name="previousDocId">old document id that has been replaced, if any.</param>
-        public void BindPath(string path, Guid documentId, out Guid? previousDocId)
-        {
-            previousDocId = null;
-            if (string.IsNullOrEmpty(path)) throw new Exception("Path must not be null or empty");
-            _pathLookupCache = null;
-
-            lock (_fslock)
-            {
-                // Read current path document (if it exists)
-                var pathLink = GetPathLookupLink();
-                var pathIndex = new ReverseTrie<SerialGuid>();
-                if (pathLink.TryGetLink(0, out var pathPageId))
-                {
-                    pathIndex.Defrost(GetStream(pathPageId));
-                }
-
-                // Bind the path
-                var serialGuid = pathIndex.Add(path, documentId);
-                if (serialGuid != null) previousDocId = serialGuid.Value;
-
-                // Write back to new chain
-                var newPageId = WriteStream(pathIndex.Freeze());
-
-                // Update version link
-                pathLink.WriteNewLink(newPageId, out var expired);
-                SetPathLookupLink(pathLink);
-
-                ReleaseChain(expired);
-                _fs.Flush();
-            }
-        }
-
-        /// <summary>
-        /// Read the path lookup, and return the DocumentID stored at the exact path.
-        /// Returns null if there is not document stored.
-        /// </summary>
-        public Guid? GetDocumentIdByPath(string exactPath)
-        {
-            var pathIndex = GetPathLookupIndex();
-
-            var found = pathIndex.Get(exactPath);
-            if (found == null) return null;
-            return found.Value;
-        }
-
-        /// <summary>
-        /// Return all paths currently bound for the given document ID.
-        /// If no paths are bound, an empty enumeration is given.
-        /// </summary>
-        [NotNull]public IEnumerable<string> GetPathsForDocument(Guid documentId)
-        {
-            var pathIndex = GetPathLookupIndex();
-
-            return pathIndex.GetPathsForEntry(documentId);
-        }
-
-        /// <summary>
-        /// Return all paths currently bound that start with the given prefix.
-        /// The prefix should not be null or empty.
-        /// If no paths are bound, an empty enumeration is given.
-        /// </summary>
-        [NotNull]public IEnumerable<string> SearchPaths(string pathPrefix)
-        {
-            var pathIndex = GetPathLookupIndex();
-
-            return pathIndex.Search(pathPrefix);
-        }
-
-        /// <summary>
-        /// Remove a path binding if it exists. If the path is not bound, nothing happens.
-        /// Linked documents are not removed.
-        /// </summary>
-        public void UnbindPath(string exactPath)
-        {
-            _pathLookupCache = null;
-            lock (_fslock)
-            {
-                var pathLink = GetPathLookupLink();
-                var pathIndex = new ReverseTrie<SerialGuid>();
-                if (!pathLink.TryGetLink(0, out var pathPageId)) return;
-                pathIndex.Defrost(GetStream(pathPageId));
-
-                // Unbind the path
-                pathIndex.Delete(exactPath);
-
-                // Write back to new chain
-                var newPageId = WriteStream(pathIndex.Freeze());
-
-                // Update version link
-                pathLink.WriteNewLink(newPageId, out var expired);
-                SetPathLookupLink(pathLink);
-
-                ReleaseChain(expired);
-                _fs.Flush();
-            }
-        }
-
-
-
-
-
-
-
-        [NotNull]private ReverseTrie<SerialGuid> GetPathLookupIndex()
-        {
-            var pathIndex = _pathLookupCache;
-            if (pathIndex != null) return pathIndex;
-
-            lock (_fslock)
-            {
-                var pathLink = GetPathLookupLink();
-                pathIndex = new ReverseTrie<SerialGuid>();
-                if (pathLink.TryGetLink(0, out var pathPageId)) pathIndex.Defrost(GetStream(pathPageId));
-                _pathLookupCache = pathIndex;
-            }
-
-            return pathIndex;
-        }
-
-        /// <summary>
-        /// Write a stream to a known set of page IDs
-        /// </summary>
-        private int WriteStreamInternal([NotNull]Stream dataStream, int pagesRequired, [NotNull]int[] pages)
-        {
-            var prev = -1;
-            for (int i = 0; i < pagesRequired; i++)
-            {
-                var page = GetRawPage(pages[i]);
-                if (page == null) throw new Exception($"Failed to load page {pages[i]}");
-                page.Write(dataStream, 0, BasicPage.PageDataCapacity);
-                page.PrevPageId = prev;
-
-                CommitPage(page);
-                prev = page.PageId;
-            }
-
-            return prev;
-        }
-
-        /// <summary>
-        /// Allocate pages to a block without checking the free page list
-        /// </summary>
-        private void DirectlyAllocatePages([NotNull]int[] block, int startIdx)
-        {
-            for (int i = startIdx; i < block.Length; i++)
-            {
-                var pageId = (int) ((1 + _fs.Length - HEADER_SIZE) / BasicPage.PageRawSize);
-                block[i] = pageId;
-                CommitPage(new BasicPage(block[i]));
-            }
-        }
-
-        /// <summary>
-        /// Recover pages from the free list. Returns the last index that couldn't be filled (array length if everything was filled)
-        /// </summary>
-        private int ReassignReleasedPages([NotNull]int[] block)
-        {
-            var hasList = GetFreeListLink().TryGetLink(0, out var topPageId);
-            if (!hasList) return 0;
-
-            var topPage = GetRawPage(topPageId);
-            if (topPage == null) return 0;
-
-            // Structure of free pages' data (see also `ReleaseSinglePage`)
-            // [Entry count: int32] -> n
-            // n * [PageId: int32]
-
-            // The plan:
-            // - walk back through the chain
-            // - if we hit an empty end page that is not the top page, use that as the free page, and tidy up the back link. Go up a page if possible
-            // - if we're on a non empty end page, use the entries and clear them
-            // - if we're on an empty top page, give up and return our position
-
-            var linkStack = new Stack<int>();
-            var currentPage = topPage;
-            // walk down the chain
-            while (currentPage.PrevPageId >= 0) {
-                linkStack.Push(currentPage.PageId);
-                currentPage = GetRawPage(currentPage.PrevPageId) ?? throw new Exception("Free page chain is broken.");
-            }
-
-            int i;
-            for (i = 0; i < block.Length; i++) // each required page
-            {
-                // check if free list page is non-empty
-                var length = currentPage.ReadDataInt32(0);
-                if (length < 1) // page is empty
-                {
-                    if (currentPage.PageId == topPageId) return i; // ran out of free data
-
-                    block[i] = currentPage.PageId; // use this empty page
-                    currentPage = GetRawPage(linkStack.Pop()) ?? throw new Exception("Free page walk up lost");
-                    currentPage.PrevPageId = -1; // break link to the recovered page
-                    CommitPage(currentPage);
-                }
-                else // page has free links remaining
-                {
-                    block[i] = currentPage.ReadDataInt32(length); // copy id
-                    currentPage.WriteDataInt32(0, length - 1); // remove from stack
-                    CommitPage(currentPage); // save changes
-                }
-            }
-
-            return i;
-        }
-        
-        /// <summary>
-        /// Add a single page to release chain.
-        /// This will create free list pages as required
-        /// </summary>
-        private void ReleaseSinglePage(int pageToReleaseId)
-        {
-            // Note: if we need to extend the free list, we should use the last page in the current list.
-            // So, we can't assume pages are full based on prevPageId value.
-            lock (_fslock)
-            {
-                var freeLink = GetFreeListLink();
-                var hasList = freeLink.TryGetLink(0, out var topPageId);
-                if (!hasList) {
-                    // need to create a new page and set it up
-                    var slot = new int[1];
-                    DirectlyAllocatePages(slot, 0);
-                    freeLink.WriteNewLink(slot[0], out _);
-                    topPageId = slot[0];
-                    SetFreeListLink(freeLink);
-                    _fs.Flush();
-                }
-
-                // Structure of free pages' data (see also `ReassignReleasedPages`)
-                // [Entry count: int32] -> n
-                // n * [PageId: int32]
-
-                var currentPage = GetRawPage(topPageId) ?? throw new Exception($"Lost free list page (id = {topPageId})");
-                while (currentPage != null)
-                {
-                    // check if there's space on this page
-                    var length = currentPage.ReadDataInt32(0);
-
-                    if (length < BasicPage.MaxInt32Index) // Space remains. Write value and exit
-                    {
-                        length++;
-                        currentPage.WriteDataInt32(length, pageToReleaseId);
-                        currentPage.WriteDataInt32(0, length);
-                        CommitPage(currentPage);
-                        return;
-                    }
-
-                    // walk page chain
-                    if (currentPage.PrevPageId >= 0) {
-                        currentPage = GetRawPage(currentPage.PrevPageId);
-                    } else {
-                        // use the new free page to extend the list.
-                        var newFreePage = GetRawPage(pageToReleaseId) ?? throw new Exception($"Failed to read released page {pageToReleaseId}");
-                        newFreePage.ZeroAllData();
-                        newFreePage.PrevPageId = -1;
-                        CommitPage(newFreePage);
-                        currentPage.PrevPageId = newFreePage.PageId;
-                        CommitPage(currentPage);
-                        return;
-                    }
-                }
-
-                throw new Exception("Page extension failed");
-            }
-        }
-
-        [NotNull]private VersionedLink GetIndexPageLink() { return GetLink(0); }
-        private void SetIndexPageLink(VersionedLink value) { SetLink(0, value); }
-        
-        [NotNull]private VersionedLink GetPathLookupLink() { return GetLink(1); }
-        private void SetPathLookupLink(VersionedLink value) { SetLink(1, value); }
-
-        [NotNull]private VersionedLink GetFreeListLink() { return GetLink(2); }
-        private void SetFreeListLink(VersionedLink value) { SetLink(2, value); }
-
-        private void SetLink(int headOffset, VersionedLink value)
-        {
-            if (value == null) throw new Exception("Attempted to set invalid header link");
-            var strm = value.Freeze();
-            lock (_fslock)
-            {
-                _fs.Seek(MAGIC_SIZE + (VersionedLink.ByteSize * headOffset), SeekOrigin.Begin);
-                strm.CopyTo(_fs);
-            }
-        }
-
-        [NotNull]private VersionedLink GetLink(int headOffset)
-        {
-            var result = new VersionedLink();
-            lock (_fslock)
-            {
-                _fs.Seek(MAGIC_SIZE + (VersionedLink.ByteSize * headOffset), SeekOrigin.Begin);
-                result.Defrost(_fs);
-            }
-            return result;
-        }
-
-    }
+﻿using System;
+using System.Collections.Concurrent;
+using System.Collections.Generic;
+using System.IO;
+using System.Linq;
+using System.Threading;
+using System.Threading.Tasks;
+using JetBrains.Annotations;
+using StreamDb.Internal.DbStructure;
+using StreamDb.Internal.Support;
+
+namespace StreamDb.Internal.Core
+{
+    /// <summary>
+    /// A simplified version of the original PageTable. This one uses only reverse links and a streaming interface.
+    /// The start of this database is not a full page, but a set of versioned links out to:
+    ///  - an index page chain
+    ///  - a path-lookup page chain
+    ///  - a free-list page chain
+    /// All page version links point to the end of a chain.
+    /// Pages cannot be updated in this store -- write a new copy and release the old one.
+    /// <para></para>
+    /// Unlike the PageTable, this handles its free page list directly and internally. The main index and path lookup are normal documents with no special position.
+    /// </summary>
+    public class PageStorage : IStorageEngine {
+        [NotNull] private readonly Stream _fs;
+        [NotNull] private readonly object _fslock = new object();
+        [NotNull] private readonly ILogger _log;
+        [NotNull] private readonly ITracer _trace;
+        [NotNull] private readonly RetryPolicy _retry;
+        private readonly int _writeWorkers;
+        private readonly int _extentPages;
+        private readonly int _maxChainLength;
+        private long _fenceEpoch;
+
+        [NotNull] private static readonly byte[] CountersMagic = { (byte)'S', (byte)'D', (byte)'B', (byte)'-', (byte)'C', (byte)'N', (byte)'T', (byte)'R' };
+
+        // ReSharper disable InconsistentNaming
+        /// <summary> A magic number we use to recognise our database format. It is followed by the format version tag (see `VersionTag`) </summary>
+        [NotNull] public static readonly byte[] HEADER_MAGIC = { 0x55, 0xAA, 0xFE, 0xED, 0xFA, 0xCE };
+
+        /// <summary> Size of the magic number and the format version tag together </summary>
+        public const int MAGIC_SIZE = 8;
+
+        /// <summary> Storage format written and read by this version. Storage with any other format version is not opened </summary>
+        public const int FORMAT_VERSION = 1;
+        public const int HEADER_SIZE = (VersionedLink.ByteSize * 3) + MAGIC_SIZE;
+        public const int FREE_PAGE_SLOTS = 128;
+
+        /// <summary> Number of random pages checked by a `Standard` health check </summary>
+        public const int HealthSamplePages = 64;
+
+        /// <summary> Key in `Exception.Data` holding the ID of a page that failed its CRC check </summary>
+        public const string PageIdDataKey = "StreamDb.PageId";
+        // ReSharper restore InconsistentNaming
+        
+        /// <summary>
+        /// The path lookup last read from storage, shared by all threads. A loaded trie is never changed: writers load their own
+        /// copy, write it to a new chain, and then drop the cache, so a reader holding the old trie sees a consistent older state.
+        /// The cache is only replaced under `_fslock`, and is always dropped when the path lookup link moves (see `SetPathLookupLink`),
+        /// so a lookup loaded while a write was waiting for the lock can't outlive that write.
+        /// </summary>
+        private volatile CachedPathLookup? _pathLookupCache;
+
+        /// <summary>
+        /// Whether the index is sharded, and its root if so, keyed by the header link it was read under (see `CurrentIndexRoot`).
+        /// Dropped whenever this storage moves the index link or rewrites the root in place; `_indexRootGeneration` counts the
+        /// drops, so a reader that started before one can't store what it read.
+        /// </summary>
+        private volatile CachedIndexRoot? _indexRootCache;
+        private int _indexRootGeneration;
+        [NotNull] private readonly object _indexRootLock = new object();
+        private readonly PathCacheConsistency _pathCacheMode;
+        private readonly bool _recordBindingTimes;
+        private readonly bool _readReplica;
+        private readonly SyncMode _syncData, _syncIndex, _syncPaths, _syncFreeList;
+        private const int ReplicaReadAttempts = 5;
+        [NotNull] private readonly HashSet<int> _damagedIndexPages = new HashSet<int>();
+        [NotNull] private readonly MemoryBudget _memory;
+        [NotNull] private readonly HashSet<int> _badPages = new HashSet<int>();
+        [NotNull] private readonly Dictionary<int, int> _crcFailures = new Dictionary<int, int>();
+        private readonly int _badPageFailures;
+        private bool _badPagesLoaded, _movingBadPages;
+        private long _documentCount = -1, _freePageCount = -1; // -1 until loaded
+        private int _countersPageId = -1, _countersSparePageId = -1; // newest counters page, and the older one the next save overwrites
+        private long _countersSequence;
+        private bool _countersDirty, _savingCounters;
+        private readonly bool _cacheFreeList;
+        private FreePageIndex? _freeIndex; // null unless `DatabaseOptions.CacheFreeList` is set
+        private readonly int _deferFreeCommits;
+        private readonly TimeSpan _deferFreePeriod;
+        [NotNull] private readonly Queue<DeferredPage> _deferredPages = new Queue<DeferredPage>();
+        private long _commitCount;
+        private readonly int _crcSampleRate;
+        private readonly PageCache? _pageCache; // null unless `DatabaseOptions.PageCachePages` is set
+        private readonly WriteAheadLog? _wal; // null unless `DatabaseOptions.WriteAheadLog` is set
+        [NotNull] private readonly Dictionary<int, byte[]> _walPending = new Dictionary<int, byte[]>(); // index pages waiting for the end of their change. See `CommitIndexPage`
+        private long _dataPagesRead, _dataPagesChecked, _dataPageFailures;
+        private bool _releasingDeferred, _deferredDirty, _savingDeferred;
+        private int _releaseHolds; // see `HoldReleasedPages`
+
+        /// <summary>
+        /// A released page waiting out its grace period. See `DatabaseOptions.DeferFreeCommits`
+        /// </summary>
+        private class DeferredPage
+        {
+            public readonly int PageId;
+            public readonly long ReleasedAtCommit;
+            public readonly DateTime ReleasedAt;
+            public DeferredPage(int pageId, long releasedAtCommit, DateTime releasedAt) { PageId = pageId; ReleasedAtCommit = releasedAtCommit; ReleasedAt = releasedAt; }
+        }
+
+        /// <summary>
+        /// A loaded path lookup, and the page it was read from
+        /// </summary>
+        private class CachedPathLookup
+        {
+            [NotNull] public readonly ReverseTrie<PathBinding> Trie;
+            public readonly int PageId;
+            public readonly long Bytes; // reserved from the memory budget
+            public CachedPathLookup([NotNull]ReverseTrie<PathBinding> trie, int pageId, long bytes) { Trie = trie; PageId = pageId; Bytes = bytes; }
+        }
+
+        /// <summary>
+        /// The index root read under a header link. A null root means the index was flat.
+        /// The root is shared by readers, so it must not be changed.
+        /// </summary>
+        private class CachedIndexRoot
+        {
+            [NotNull] public readonly byte[] Link;
+            public readonly int TopPageId;
+            public readonly IndexRoot? Root;
+            public CachedIndexRoot([NotNull]byte[] link, int topPageId, IndexRoot? root) { Link = link; TopPageId = topPageId; Root = root; }
+        }
+
+        public PageStorage([NotNull]Stream fs, DatabaseOptions? options = null)
+        {
+            _fs = fs;
+            _log = options?.Logger ?? NullLogger.Instance;
+            _trace = options?.Tracer ?? NullTracer.Instance;
+            if (options?.SlowOperationThreshold is TimeSpan slow) _trace = new SlowOperationTracer(_trace, _log, slow);
+            _retry = options?.Retry ?? RetryPolicy.None;
+            _readReplica = options?.ReadReplica ?? false;
+            _pathCacheMode = _readReplica ? PathCacheConsistency.Validated : options?.PathCache ?? PathCacheConsistency.Cached;
+            _recordBindingTimes = options?.RecordBindingTimes ?? false;
+            _writeWorkers = Math.Max(1, options?.WriteWorkers ?? 1);
+            _extentPages = Math.Max(1, options?.ExtentPages ?? 256);
+            _maxChainLength = Math.Max(1, options?.MaxChainLength ?? 1_000_000);
+            _syncData = options?.Sync?.DocumentData ?? SyncMode.Flush;
+            _syncIndex = options?.Sync?.Index ?? SyncMode.Flush;
+            _syncPaths = options?.Sync?.Paths ?? SyncMode.Flush;
+            _syncFreeList = options?.Sync?.FreeList ?? SyncMode.Flush;
+            _memory = new MemoryBudget(options?.MemoryBudget) { Evict = EvictPathLookupCache };
+            _badPageFailures = Math.Max(1, options?.BadPageFailures ?? 3);
+            _cacheFreeList = (options?.CacheFreeList ?? false) && !_readReplica;
+            _deferFreeCommits = Math.Max(0, options?.DeferFreeCommits ?? 0);
+            _deferFreePeriod = options?.DeferFreePeriod ?? TimeSpan.Zero;
+            _crcSampleRate = Math.Max(1, options?.CrcSampleRate ?? 1);
+            if (options?.PageCachePages > 0 && !_readReplica) _pageCache = new PageCache(options.PageCachePages.Value);
+            if (!fs.CanRead) throw new Exception("Database stream must be readable");
+            if (!fs.CanSeek) throw new Exception("Database stream must support seeking");
+
+            // Create empty database?
+            if (fs.Length == 0) {
+                InitialiseDb(fs);
+            }
+            else
+            {
+                if (fs.Length < HEADER_SIZE) throw new Exception("Stream is not empty, but is to short to read header information");
+
+                // Not empty -- quick sanity check that our stream is a real DB, in a format we understand
+                fs.Seek(0, SeekOrigin.Begin);
+                foreach (var b in HEADER_MAGIC)
+                {
+                    if (fs.ReadByte() != b) throw new Exception("Supplied stream is not a StreamDB file");
+                }
+                var version = ReadVersionTag(fs);
+                if (version != FORMAT_VERSION) throw new Exception($"Storage format version {version} is not supported. This version of StreamDB reads format version {FORMAT_VERSION}");
+            }
+
+            if (options?.WriteAheadLog != null && !_readReplica)
+            {
+                _wal = new WriteAheadLog(options.WriteAheadLog);
+                ReplayWriteAheadLog();
+            }
+
+            if (_cacheFreeList) lock (_fslock) { LoadFreeIndex(); }
+            if (options?.UseWriteFence == true && !_readReplica) AcquireFence();
+            if (!_readReplica && fs.CanWrite) RecoverDeferredPages();
+        }
+
+        /// <summary>
+        /// Add pages left waiting by an earlier connection (see `SaveDeferred`) to the free list.
+        /// Pages that made it onto the free list before the list was updated are skipped.
+        /// </summary>
+        private void RecoverDeferredPages()
+        {
+            lock (_fslock)
+            {
+                var waiting = ReadDeferred();
+                if (waiting.Count < 1) return;
+
+                var free = FreePageIds();
+                var released = 0;
+                _releasingDeferred = true;
+                try
+                {
+                    foreach (var pageId in waiting)
+                    {
+                        if (free.Contains(pageId)) continue;
+                        ReleaseSinglePage(pageId);
+                        released++;
+                    }
+                }
+                finally
+                {
+                    _releasingDeferred = false;
+                }
+                _deferredDirty = true; // none are waiting now
+                Sync(_syncFreeList);
+                _log.Warn("Released pages left waiting by an earlier connection", "pages", released);
+            }
+        }
+
+        /// <summary>
+        /// Write any pages left in the write-ahead log by a change that did not finish, then clear the log.
+        /// Records torn by the crash were never applied to storage, and are dropped.
+        /// </summary>
+        private void ReplayWriteAheadLog()
+        {
+            if (_wal == null || !_wal.HasRecords) return;
+            lock (_fslock)
+            {
+                var count = _wal.Replay((pageId, image) => {
+                    _fs.Seek(HEADER_SIZE + ((long)pageId * BasicPage.PageRawSize), SeekOrigin.Begin);
+                    _fs.Write(image, 0, image.Length);
+                });
+                CheckpointWriteAheadLog();
+                if (count > 0) _log.Warn("Replayed write-ahead log of an unfinished change", "pages", count);
+            }
+        }
+
+        /// <summary>
+        /// Flush storage through to disk, then clear the write-ahead log. Call under `_fslock`
+        /// </summary>
+        private void CheckpointWriteAheadLog()
+        {
+            if (_wal == null) return;
+            _retry.Run(() => {
+                if (_fs is FileStream file) file.Flush(flushToDisk: true);
+                else _fs.Flush();
+            }, _log, "flush");
+            _wal.Clear();
+        }
+
+        /// <summary>
+        /// True if this connection is a read-only replica. See `DatabaseOptions.ReadReplica`
+        /// </summary>
+        public bool IsReadReplica => _readReplica;
+
+        /// <summary>
+        /// True if damaged pages were found in the index chain. Lookups skip those pages, so
+        /// documents indexed in them can't be found until the storage is repaired.
+        /// </summary>
+        public bool NeedsRepair { get { lock (_damagedIndexPages) { return _damagedIndexPages.Count > 0; } } }
+
+        /// <summary>
+        /// IDs of index pages that failed their CRC check, or had a broken link, in ascending order
+        /// </summary>
+        [NotNull] public int[] DamagedIndexPages()
+        {
+            lock (_damagedIndexPages) { return _damagedIndexPages.OrderBy(id => id).ToArray(); }
+        }
+
+        /// <summary>
+        /// Bytes of memory currently held by caches. See `DatabaseOptions.MemoryBudget`
+        /// </summary>
+        public long CacheMemoryUsed => _memory.Used;
+
+        /// <summary>
+        /// Memory budget shared by the caches of this storage
+        /// </summary>
+        [NotNull]internal MemoryBudget Memory => _memory;
+
+        /// <summary>
+        /// Run a read operation. On a read replica, a read that fails because a writer changed storage underneath it
+        /// (pages reused, a torn index page, a link past the end of the file) is retried from the header.
+        /// If it keeps failing, `ReplicaInconsistencyException` is thrown.
+        /// </summary>
+        internal T ReplicaRead<T>([NotNull]Func<T> read, string what)
+        {
+            if (!_readReplica) return read();
+            for (int attempt = 1; ; attempt++)
+            {
+                try
+                {
+                    return read();
+                }
+                catch (Exception ex)
+                {
+                    if (attempt >= ReplicaReadAttempts) throw new ReplicaInconsistencyException($"Storage changed while reading {what}. Try again later", ex);
+                    _log.Debug("Replica read raced with a writer; retrying", "what", what, "attempt", attempt);
+                    Task.Delay(10 * attempt).Wait();
+                }
+            }
+        }
+
+        /// <summary>
+        /// Write epoch held by this connection, or zero if writes are not fenced
+        /// </summary>
+        public long FenceEpoch => _fenceEpoch;
+
+        /// <summary>
+        /// Take a new write epoch, one greater than the last recorded.
+        /// Any other fenced connection to the same storage will fail its next write.
+        /// </summary>
+        public void AcquireFence()
+        {
+            lock (_fslock)
+            {
+                _fenceEpoch = 0; // don't check our own fence while moving it
+                var epoch = ReadFenceEpoch() + 1;
+
+                var ms = new MemoryStream();
+                new BinaryWriter(ms).Write(epoch);
+                ms.Seek(0, SeekOrigin.Begin);
+
+                var pageId = WriteStream(ms);
+                BindIndex(ReservedDocIds.Fence, pageId, out var expired);
+                ReleaseChain(expired);
+                _fs.Flush();
+
+                _fenceEpoch = epoch;
+                _log.Debug("Acquired write fence", "epoch", epoch);
+            }
+        }
+
+        /// <summary>
+        /// Throws if this connection is a read replica, or `StaleWriterException` if this connection's write epoch has been superseded.
+        /// Does nothing if writes are not fenced.
+        /// </summary>
+        /// <remarks>
+        /// This is a detection mechanism, not a lock: the check and the write that follows are not atomic across processes.
+        /// It stops a writer that has lost ownership from continuing, but a concurrent takeover during a single write can still race.
+        /// </remarks>
+        private void CheckFence()
+        {
+            if (_readReplica) throw new InvalidOperationException("This connection is a read replica. Writes are not allowed");
+            if (_fenceEpoch == 0) return;
+            var current = ReadFenceEpoch();
+            if (current == _fenceEpoch) return;
+
+            _log.Warn("Stale writer detected", "epoch", _fenceEpoch, "current", current);
+            throw new StaleWriterException(_fenceEpoch, current);
+        }
+
+        private long ReadFenceEpoch()
+        {
+            var pageId = GetDocumentHead(ReservedDocIds.Fence);
+            if (pageId < 0) return 0;
+            var stream = GetStream(pageId, sampleCrc: false);
+            if (stream.Length < 8) return 0;
+            return new BinaryReader(stream).ReadInt64();
+        }
+
+        public static void InitialiseDb([NotNull]Stream fs)
+        {
+            if (!fs.CanWrite) throw new Exception("Tried to initialise a read-only stream");
+
+            fs.Seek(0, SeekOrigin.Begin);
+            foreach (var b in HEADER_MAGIC) { fs.WriteByte(b); }
+            foreach (var b in VersionTag(FORMAT_VERSION)) { fs.WriteByte(b); }
+
+            // write disabled links for the three core chains
+            var indexVersion = new VersionedLink();
+            var pathLookupVersion = new VersionedLink();
+            var freeListVersion = new VersionedLink();
+
+            indexVersion.Freeze().CopyTo(fs);
+            pathLookupVersion.Freeze().CopyTo(fs);
+            freeListVersion.Freeze().CopyTo(fs);
+            fs.Flush();
+        }
+
+        /// <summary>
+        /// Encode a format version for the two header bytes after `HEADER_MAGIC`. Later versions are stored big-endian.
+        /// Version 1 was written before the header had a version, so its tag is the end of the original magic number.
+        /// </summary>
+        [NotNull]public static byte[] VersionTag(int version)
+        {
+            if (version < 1 || version > ushort.MaxValue) throw new ArgumentOutOfRangeException(nameof(version));
+            return version == 1 ? new byte[] { 0xDA, 0x7A } : new[] { (byte)(version >> 8), (byte)version };
+        }
+
+        /// <summary>
+        /// Read a format version tag (see `VersionTag`) from the current position of the stream
+        /// </summary>
+        private static int ReadVersionTag([NotNull]Stream fs)
+        {
+            var high = fs.ReadByte();
+            var low = fs.ReadByte();
+            if (high < 0 || low < 0) return 0;
+            if (high == 0xDA && low == 0x7A) return 1;
+            return (high << 8) | low;
+        }
+
+        /// <summary>
+        /// Read the storage header for inspection.
+        /// This does not throw for a damaged header, but reports what it finds.
+        /// </summary>
+        [NotNull]public StorageHeader Header()
+        {
+            var result = new StorageHeader {
+                HeaderSize = HEADER_SIZE
+            };
+            lock (_fslock)
+            {
+                result.StreamLength = _fs.Length;
+                result.PageCount = (int) Math.Max(0, (_fs.Length - HEADER_SIZE) / BasicPage.PageRawSize);
+                if (_fs.Length < HEADER_SIZE) return result;
+
+                var magicOk = true;
+                _fs.Seek(0, SeekOrigin.Begin);
+                foreach (var b in HEADER_MAGIC) { if (_fs.ReadByte() != b) magicOk = false; }
+                result.MagicValid = magicOk;
+                if (magicOk) result.FormatVersion = ReadVersionTag(_fs);
+
+                result.IndexLink = DescribeLink(GetIndexPageLink());
+                try { result.IndexSharded = result.IndexLink.Newest >= 0 && ReadIndexRoot(result.IndexLink.Newest) != null; }
+                catch { result.IndexSharded = false; }
+                result.PathLookupLink = DescribeLink(GetPathLookupLink());
+                result.FreeListLink = DescribeLink(GetFreeListLink());
+            }
+            return result;
+        }
+
+        /// <summary>
+        /// Write a human readable description of a page to the given writer.
+        /// The page type is guessed by checking the core chains.
+        /// </summary>
+        public void DumpPage(int pageId, [NotNull]TextWriter w)
+        {
+            var pageCount = (_fs.Length - HEADER_SIZE) / BasicPage.PageRawSize;
+            var page = (pageId < pageCount) ? GetRawPage(pageId, ignoreCrc: true) : null;
+            if (page == null) {
+                w.WriteLine($"Page {pageId} is not valid");
+                return;
+            }
+            w.Write(PageDiagnostics.DescribePage(page, GuessPageType(pageId)));
+        }
+
+        /// <summary>
+        /// Guess what a page is used for, by walking the index, path-lookup and free-list chains.
+        /// Any page not found in those chains is assumed to be document data.
+        /// </summary>
+        public PageType GuessPageType(int pageId)
+        {
+            if (pageId < 0) return PageType.Unknown;
+            lock (_fslock)
+            {
+                if (IsBadPage(pageId)) return PageType.Bad;
+                if (GetIndexPageLink().TryGetLink(0, out var indexId) && indexId == pageId && ReadIndexRoot(indexId) != null) return PageType.IndexRoot;
+                if (IndexChainTops().Any(top => ChainContains(top, pageId))) return PageType.Index;
+
+                var pathLink = GetPathLookupLink();
+                if (pathLink.TryGetLink(0, out var pathId) && ChainContains(pathId, pageId)) return PageType.PathLookup;
+                if (pathLink.TryGetLink(1, out var oldPathId) && ChainContains(oldPathId, pageId)) return PageType.PathLookup;
+
+                if (GetFreeListLink().TryGetLink(0, out var freeId))
+                {
+                    var seen = new HashSet<int>();
+                    var current = GetRawPage(freeId, ignoreCrc: true);
+                    while (current != null && seen.Add(current.PageId))
+                    {
+                        if (current.PageId == pageId) return PageType.FreeList;
+                        var length = current.ReadDataInt32(0);
+                        for (int i = 1; i <= length && i <= BasicPage.MaxInt32Index; i++)
+                        {
+                            if (current.ReadDataInt32(i) == pageId) return PageType.Free;
+                        }
+                        current = GetRawPage(current.PrevPageId, ignoreCrc: true);
+                    }
+                }
+            }
+            return PageType.Data;
+        }
+
+        /// <summary>
+        /// Read every page in storage and validate its CRC. This ignores quick-and-dirty mode.
+        /// Pages are read in order on the calling thread and handed to a pool of workers through a bounded queue.
+        /// </summary>
+        /// <param name="workers">Number of threads checking CRCs</param>
+        [NotNull]public IntegrityReport CheckIntegrity(int workers)
+        {
+            workers = Math.Max(1, workers);
+            var report = new IntegrityReport();
+            var failed = new ConcurrentBag<int>();
+
+            using (var span = _trace.StartSpan("StreamDb.CheckIntegrity"))
+            using (var queue = new BlockingCollection<BasicPage>(workers * 4))
+            {
+                var checkers = new Task[workers];
+                for (int i = 0; i < workers; i++)
+                {
+                    checkers[i] = Task.Run(() => {
+                        foreach (var page in queue.GetConsumingEnumerable())
+                        {
+                            if (!page.ValidateCrc(evenInQuickMode: true)) failed.Add(page.PageId);
+                        }
+                    });
+                }
+
+                try
+                {
+                    var pageCount = (int) ((_fs.Length - HEADER_SIZE) / BasicPage.PageRawSize);
+                    for (int pageId = 0; pageId < pageCount; pageId++)
+                    {
+                        queue.Add(ReadStoredPage(pageId));
+                        report.PagesChecked++;
+                    }
+                }
+                finally
+                {
+                    queue.CompleteAdding();
+                    Task.WaitAll(checkers);
+                }
+
+                report.FailedPages.AddRange(failed.OrderBy(id => id));
+                span.SetAttribute("pages", report.PagesChecked);
+                span.SetAttribute("failed", report.FailedPages.Count);
+            }
+
+            foreach (var pageId in report.FailedPages) { _log.Warn("Page failed CRC check", "pageId", pageId); }
+
+            try { report.CountersCorrected = VerifyCounters(); }
+            catch (Exception ex) { _log.Warn("Could not verify stored counters", "error", ex.Message); }
+            return report;
+        }
+
+        /// <summary>
+        /// Check storage is in a usable state, to the given depth. See `HealthCheckLevel`.
+        /// This does not throw for damaged storage, but reports what it finds.
+        /// </summary>
+        /// <param name="level">How thoroughly to check</param>
+        [NotNull]public HealthReport HealthCheck(HealthCheckLevel level)
+        {
+            var report = new HealthReport { Level = level };
+            var failed = new HashSet<int>();
+
+            using (var span = _trace.StartSpan("StreamDb.HealthCheck"))
+            {
+                var header = Header();
+                if (!header.MagicValid) report.Problems.Add("Storage header does not start with the StreamDb magic bytes");
+
+                CheckHeaderLink(report, failed, "index", header.IndexLink, header.PageCount);
+                CheckHeaderLink(report, failed, "path lookup", header.PathLookupLink, header.PageCount);
+                CheckHeaderLink(report, failed, "free list", header.FreeListLink, header.PageCount);
+                if (NeedsRepair) report.Problems.Add("Index has damaged pages: " + string.Join(", ", DamagedIndexPages()));
+
+                if (level == HealthCheckLevel.Standard && header.PageCount > 0)
+                {
+                    var rnd = new Random();
+                    var count = Math.Min(HealthSamplePages, header.PageCount);
+                    for (int i = 0; i < count; i++)
+                    {
+                        var pageId = rnd.Next(header.PageCount);
+                        if (!CheckPage(report, pageId, header.PageCount)) failed.Add(pageId);
+                    }
+                }
+
+                if (level == HealthCheckLevel.Deep)
+                {
+                    var integrity = CheckIntegrity(workers: 4);
+                    report.PagesChecked += integrity.PagesChecked;
+                    foreach (var pageId in integrity.FailedPages) { failed.Add(pageId); }
+                    if (integrity.CountersCorrected) report.Problems.Add("Stored document or free page counts were wrong, and have been corrected");
+                }
+
+                report.FailedPages.AddRange(failed.OrderBy(id => id));
+                if (report.FailedPages.Count > 0) report.Problems.Add("Damaged pages: " + string.Join(", ", report.FailedPages));
+
+                span.SetAttribute("level", level.ToString());
+                span.SetAttribute("pages", report.PagesChecked);
+                span.SetAttribute("problems", report.Problems.Count);
+            }
+
+            foreach (var problem in report.Problems) { _log.Warn("Health check problem", "level", level, "problem", problem); }
+            return report;
+        }
+
+        /// <summary>
+        /// Check a core chain link from the header, and the page at each revision it points to
+        /// </summary>
+        private void CheckHeaderLink([NotNull]HealthReport report, [NotNull]HashSet<int> failed, [NotNull]string name, [NotNull]HeaderLinkInfo link, int pageCount)
+        {
+            if (!link.IsValid)
+            {
+                report.Problems.Add($"Header link to the {name} chain can't be decoded");
+                return;
+            }
+            foreach (var pageId in new[] { link.Newest, link.Previous })
+            {
+                if (pageId < 0) continue;
+                if (pageId >= pageCount)
+                {
+                    report.Problems.Add($"Header link to the {name} chain points to page {pageId}, past the end of storage");
+                    continue;
+                }
+                if (!CheckPage(report, pageId, pageCount)) failed.Add(pageId);
+            }
+        }
+
+        /// <summary>
+        /// Read a single page, and check its CRC and that its link stays inside storage. Returns false if the page is damaged.
+        /// </summary>
+        private bool CheckPage([NotNull]HealthReport report, int pageId, int pageCount)
+        {
+            report.PagesChecked++;
+            BasicPage? page;
+            try { page = ReadStoredPage(pageId); }
+            catch (Exception ex)
+            {
+                _log.Debug("Health check could not read page", "pageId", pageId, "error", ex.Message);
+                return false;
+            }
+            if (!page.ValidateCrc(evenInQuickMode: true)) return false;
+            return page.PrevPageId < pageCount && page.PrevPageId >= -1;
+        }
+
+        /// <summary>
+        /// Get a read-only page stream for a page chain, given it's end ID
+        /// </summary>
+        /// <param name="endPageId">Last page of the chain</param>
+        /// <param name="sampleCrc">If true, the chain is document data, and page CRCs are checked at the `DatabaseOptions.CrcSampleRate`.
+        /// Set false for engine structures, which are always checked</param>
+        public SimplePageStream GetStream(int endPageId, bool sampleCrc = true) {
+            return new SimplePageStream(this, endPageId, sampleCrc);
+        }
+
+        /// <summary>
+        /// Read a page of document data. With CRC sampling (see `DatabaseOptions.CrcSampleRate`), only one read in N is checked.
+        /// Structure pages must be read with `GetRawPage`, which always checks.
+        /// </summary>
+        internal BasicPage? GetDataPage(int pageId)
+        {
+            if (pageId < 0) return null;
+            var reads = Interlocked.Increment(ref _dataPagesRead);
+            if (_crcSampleRate > 1 && reads % _crcSampleRate != 0) return GetRawPage(pageId, ignoreCrc: true);
+
+            Interlocked.Increment(ref _dataPagesChecked);
+            try
+            {
+                return GetRawPage(pageId);
+            }
+            catch (Exception ex) when (ex.Data.Contains(PageIdDataKey))
+            {
+                Interlocked.Increment(ref _dataPageFailures);
+                throw;
+            }
+        }
+
+        /// <summary>
+        /// Counts of document page reads, CRC checks and failures since storage was opened
+        /// </summary>
+        [NotNull]public CrcSamplingStats CrcSampling => new CrcSamplingStats {
+            PagesRead = Interlocked.Read(ref _dataPagesRead),
+            PagesChecked = Interlocked.Read(ref _dataPagesChecked),
+            Failures = Interlocked.Read(ref _dataPageFailures)
+        };
+
+        /// <inheritdoc />
+        Stream IStorageEngine.GetStream(int chainId) { return GetStream(chainId); }
+
+        /// <summary>
+        /// Tracer supplied in the options. Used by page streams to report reads.
+        /// </summary>
+        [NotNull]internal ITracer Tracer => _trace;
+
+        /// <summary>
+        /// Start a loop- and length-checked walk down the chain ending at the given page
+        /// </summary>
+        [NotNull]internal ChainWalk StartWalk(int endPageId) => new ChainWalk(endPageId, _maxChainLength);
+
+        /// <summary>
+        /// Read the page IDs of a chain, and measure how scattered they are in storage. See `FragmentationReport`
+        /// </summary>
+        [NotNull]public FragmentationReport AnalyzeChain(int endPageId)
+        {
+            var report = new FragmentationReport();
+            if (endPageId < 0) return report;
+
+            var walk = StartWalk(endPageId);
+            var ids = new Stack<int>();
+            var page = GetRawPage(endPageId);
+            while (page != null)
+            {
+                walk.Visit(page.PageId);
+                ids.Push(page.PageId);
+                page = GetRawPage(page.PrevPageId);
+            }
+
+            report.PageIds.AddRange(ids);
+            report.Runs = report.PageCount > 0 ? 1 : 0;
+            for (int i = 1; i < report.PageCount; i++)
+            {
+                var gap = Math.Abs(report.PageIds[i] - report.PageIds[i - 1]);
+                if (report.PageIds[i] != report.PageIds[i - 1] + 1) report.Runs++;
+                report.MaxGap = Math.Max(report.MaxGap, gap);
+            }
+            return report;
+        }
+
+        /// <summary>
+        /// Write a data stream from its current position to end to a new page chain. Returns the end page ID.
+        /// This ID should then be stored either inside the index document, or to one of the core versions.
+        /// <para></para>
+        /// Streams that report a length without seeking (like `KnownLengthStream`) are written directly.
+        /// Streams with no known length are written in blocks as they are read (see `WriteStreamIncremental`).
+        /// </summary>
+        public int WriteStream(Stream dataStream) {
+            if (dataStream == null) throw new Exception("Data stream must be valid");
+
+            var length = RemainingLength(dataStream);
+            if (length >= 0) return WriteStream(dataStream, length);
+            return WriteStreamIncremental(dataStream);
+        }
+
+        /// <summary>
+        /// Write a stream of unknown length to a new page chain, a block of pages at a time as data arrives,
+        /// so memory use does not grow with the document. Returns the end page ID.
+        /// Blocks double in size up to `DatabaseOptions.ExtentPages`, to keep the chain mostly contiguous. Each block is read
+        /// before its pages are allocated, so exactly the pages needed are used. If the write fails, all its pages are released.
+        /// </summary>
+        private int WriteStreamIncremental([NotNull]Stream dataStream) {
+            CheckFence();
+            MoveSuspectPages();
+
+            using (var span = _trace.StartSpan("StreamDb.WriteStream"))
+            {
+                var buffers = new List<byte[]>();
+                var lengths = new List<int>();
+                var written = new List<int>();
+                var blockSize = 1;
+                var prev = -1;
+                long bytes = 0;
+                var ended = false;
+
+                try
+                {
+                    while (!ended)
+                    {
+                        lengths.Clear();
+                        while (lengths.Count < blockSize)
+                        {
+                            if (buffers.Count <= lengths.Count) buffers.Add(new byte[BasicPage.PageDataCapacity]);
+                            var read = ReadFully(dataStream, buffers[lengths.Count]);
+                            if (read > 0) lengths.Add(read);
+                            if (read < BasicPage.PageDataCapacity) { ended = true; break; }
+                        }
+                        if (lengths.Count < 1) break;
+
+                        var block = new int[lengths.Count];
+                        AllocatePageBlock(block);
+                        written.AddRange(block);
+
+                        for (int i = 0; i < block.Length; i++)
+                        {
+                            // start from a blank page, so nothing is kept from a released page being reused
+                            var page = new BasicPage(block[i]) { PrevPageId = prev };
+                            page.Write(buffers[i], 0, 0, lengths[i]);
+                            CommitPage(page);
+                            prev = page.PageId;
+                            bytes += lengths[i];
+                        }
+
+                        blockSize = Math.Min(_extentPages, blockSize * 2);
+                    }
+                }
+                catch
+                {
+                    // Nothing refers to these pages yet, so they would be lost to the free list
+                    span.SetAttribute("failed", true);
+                    ReleasePageBlock(written.ToArray());
+                    throw;
+                }
+
+                span.SetAttribute("bytes", bytes);
+                span.SetAttribute("pages", written.Count);
+                Sync(_syncData);
+                return prev;
+            }
+        }
+
+        /// <summary>
+        /// Write exactly `length` bytes from a data stream to a new page chain. Returns the end page ID.
+        /// The pages are allocated up front, and filled directly from the stream, which does not need to support seeking.
+        /// If the stream ends early, the pages are released and an exception is thrown. Data past `length` is not read.
+        /// <para></para>
+        /// A `MemoryStream` with a visible buffer is copied straight from that buffer. Other streams are read directly into
+        /// page buffers, or (with write workers) into one buffer per extent.
+        /// </summary>
+        public int WriteStream(Stream dataStream, long length) {
+            if (dataStream == null) throw new Exception("Data stream must be valid");
+            if (length < 0) throw new Exception("Stream length must not be negative");
+            CheckFence();
+            MoveSuspectPages();
+
+            using (var span = _trace.StartSpan("StreamDb.WriteStream"))
+            {
+                var bytesRequired = length;
+                var pagesRequired = BasicPage.CountRequired(bytesRequired);
+                span.SetAttribute("bytes", bytesRequired);
+                span.SetAttribute("pages", pagesRequired);
+
+                // A memory stream's buffer can be copied straight into pages, without reading through the stream
+                var memory = dataStream as MemoryStream;
+                ArraySegment<byte> segment = default;
+                var direct = memory != null && memory.TryGetBuffer(out segment) && segment.Array != null;
+                if (direct && memory!.Length - memory.Position < length) throw new Exception($"Data stream ended after {memory.Length - memory.Position} bytes, but {length} were expected");
+
+                var pages = new int[pagesRequired];
+                AllocatePageBlock(pages);
+
+                try
+                {
+                    int endPageId;
+                    if (direct)
+                    {
+                        span.SetAttribute("direct", true);
+                        endPageId = WriteBuffer(segment.Array!, segment.Offset + (int)memory!.Position, (int)length, pages);
+                        memory.Seek(length, SeekOrigin.Current);
+                    }
+                    else
+                    {
+                        var source = new KnownLengthStream(dataStream, length);
+                        if (_writeWorkers > 1 && pagesRequired > _extentPages)
+                        {
+                            span.SetAttribute("workers", _writeWorkers);
+                            endPageId = WriteStreamExtents(source, pagesRequired, pages);
+                        }
+                        else
+                        {
+                            endPageId = WriteStreamInternal(source, pagesRequired, pages);
+                        }
+                        if (source.Position < length) throw new Exception($"Data stream ended after {source.Position} bytes, but {length} were expected");
+                    }
+
+                    Sync(_syncData);
+                    return endPageId;
+                }
+                catch
+                {
+                    // Nothing refers to these pages yet, so they would be lost to the free list
+                    span.SetAttribute("failed", true);
+                    ReleasePageBlock(pages);
+                    throw;
+                }
+            }
+        }
+
+        /// <summary>
+        /// Put a block of allocated pages back on the free list, after a write to them has failed.
+        /// The pages may not form a chain, so each is released on its own. Failures here are logged rather than
+        /// thrown, so the caller's original error is kept; any page that can't be released stays allocated but unused.
+        /// </summary>
+        private void ReleasePageBlock([NotNull]int[] pages)
+        {
+            var released = 0;
+            try
+            {
+                lock (_fslock)
+                {
+                    foreach (var pageId in pages)
+                    {
+                        ReleaseSinglePage(pageId);
+                        released++;
+                    }
+                    Sync(_syncFreeList);
+                }
+                _log.Debug("Released pages of a failed write", "count", released);
+            }
+            catch (Exception ex)
+            {
+                _log.Warn("Failed to release pages of a failed write", "released", released, "leaked", pages.Length - released, "error", ex.Message);
+            }
+        }
+
+        /// <summary>
+        /// Link a set of page chains end-to-start, in the order given, so they read as a single stream.
+        /// Returns the end page ID of the joined chain.
+        /// Every chain except the last must hold a whole number of full pages.
+        /// </summary>
+        /// <param name="endPageIds">End page IDs of the chains to join</param>
+        public int JoinChains(int[] endPageIds)
+        {
+            if (endPageIds == null || endPageIds.Length < 1) throw new Exception("No chains given to join");
+            CheckFence();
+
+            lock (_fslock)
+            {
+                // check everything before changing anything, so a failed join leaves the chains separate
+                for (int i = 0; i < endPageIds.Length - 1; i++)
+                {
+                    var end = GetRawPage(endPageIds[i]) ?? throw new Exception($"Invalid chain end {endPageIds[i]}");
+                    if (end.DataLength != BasicPage.PageDataCapacity) throw new Exception($"Chain {i} of {endPageIds.Length} does not fill its last page, so can't be joined");
+                }
+
+                for (int i = 1; i < endPageIds.Length; i++)
+                {
+                    var start = GetRawPage(endPageIds[i]) ?? throw new Exception($"Invalid chain end {endPageIds[i]}");
+                    var walk = StartWalk(endPageIds[i]);
+                    while (start.PrevPageId >= 0)
+                    {
+                        walk.Visit(start.PageId);
+                        start = GetRawPage(start.PrevPageId) ?? throw new Exception($"Broken chain {endPageIds[i]}");
+                    }
+
+                    start.PrevPageId = endPageIds[i - 1];
+                    CommitPage(start);
+                }
+                Sync(_syncData);
+                return endPageIds[endPageIds.Length - 1];
+            }
+        }
+
+        /// <summary>
+        /// Write bytes into an existing chain, in place. Only the pages covering the write are changed.
+        /// The length of the chain does not change, so the write must fit inside it.
+        /// </summary>
+        /// <remarks>
+        /// Each page is replaced as a whole, but a write over several pages is not atomic.
+        /// A page torn by a crash fails its CRC check.
+        /// </remarks>
+        public void OverwriteChain(int endPageId, long offset, byte[] data)
+        {
+            if (data == null) throw new Exception("Data must not be null");
+            if (offset < 0) throw new Exception("Offset must not be negative");
+
+            lock (_fslock)
+            {
+                CheckFence();
+
+                // collect the chain start-to-end
+                var pages = new List<BasicPage>();
+                var walk = StartWalk(endPageId);
+                var page = GetRawPage(endPageId) ?? throw new Exception($"Invalid chain end {endPageId}");
+                while (page != null)
+                {
+                    walk.Visit(page.PageId);
+                    pages.Add(page);
+                    page = GetRawPage(page.PrevPageId);
+                }
+                pages.Reverse();
+
+                var length = pages.Sum(p => (long)p.DataLength);
+                if (offset + data.Length > length) throw new Exception($"Write of {data.Length} bytes at {offset} does not fit in chain {endPageId} ({length} bytes)");
+
+                var pageIdx = 0;
+                while (pageIdx < pages.Count && offset >= pages[pageIdx].DataLength) { offset -= pages[pageIdx].DataLength; pageIdx++; }
+
+                var written = 0;
+                var pageOffset = (int)offset;
+                while (written < data.Length)
+                {
+                    var target = pages[pageIdx];
+                    var count = Math.Min(data.Length - written, (int)target.DataLength - pageOffset);
+                    target.Write(data, written, pageOffset, count);
+                    CommitPage(target);
+
+                    written += count;
+                    pageIdx++;
+                    pageOffset = 0;
+                }
+                Sync(_syncData);
+            }
+        }
+
+        /// <summary>
+        /// Append a small record to a record chain, bound in the index under `chainId`.
+        /// Records are packed into pages with a two-byte length prefix. The filled end page is written to a new page,
+        /// and the index is moved onto it, so a torn write can't damage records already committed.
+        /// When the end page is full, a new page is linked on instead. Earlier pages are never rewritten.
+        /// </summary>
+        /// <remarks>
+        /// Record chains have partly filled pages in the middle, so they can't be read with `GetStream`. Use `ReadRecords`.
+        /// </remarks>
+        public void AppendRecord(Guid chainId, byte[] record)
+        {
+            if (record == null || record.Length < 1) throw new Exception("Record must not be empty");
+            if (record.Length + 2 > BasicPage.PageDataCapacity) throw new Exception($"Record is too large ({record.Length} bytes)");
+
+            lock (_fslock)
+            {
+                CheckFence();
+                var endPageId = GetDocumentHead(chainId);
+                var end = GetRawPage(endPageId);
+
+                var slot = new int[1];
+                AllocatePageBlock(slot);
+                BasicPage page;
+                if (end == null || end.DataLength + 2 + record.Length > BasicPage.PageDataCapacity)
+                {
+                    page = new BasicPage(slot[0]) { PrevPageId = endPageId };
+                }
+                else
+                {
+                    page = new BasicPage(slot[0]) { PrevPageId = end.PrevPageId };
+                    page.Write(end.BodyStream(), 0, end.DataLength);
+                }
+
+                var offset = (int)page.DataLength;
+                page.Write(new[] { (byte)(record.Length >> 8), (byte)record.Length }, 0, offset, 2);
+                page.Write(record, 0, offset + 2, record.Length);
+                CommitPage(page);
+                Sync(_syncData);
+
+                BindIndex(chainId, page.PageId, out var expired);
+
+                // An expired version shares all but its end page with the live chain
+                var unshared = new List<int>();
+                if (expired >= 0 && TryFindUnsharedPages(expired, page.PageId, unshared))
+                {
+                    foreach (var pageId in unshared) { ReleaseSinglePage(pageId); }
+                    Sync(_syncFreeList);
+                }
+            }
+        }
+
+        /// <summary>
+        /// Read all records from a record chain, oldest first. Returns an empty set if the chain does not exist.
+        /// </summary>
+        [NotNull, ItemNotNull]public IEnumerable<byte[]> ReadRecords(Guid chainId)
+        {
+            var pages = new Stack<BasicPage>();
+            var endPageId = GetDocumentHead(chainId);
+            var walk = StartWalk(endPageId);
+            var page = GetRawPage(endPageId);
+            while (page != null)
+            {
+                walk.Visit(page.PageId);
+                pages.Push(page);
+                page = GetRawPage(page.PrevPageId);
+            }
+
+            var header = new byte[2];
+            foreach (var current in pages)
+            {
+                var offset = 0;
+                while (offset + 2 <= current.DataLength)
+                {
+                    current.Read(header, 0, offset, 2);
+                    var length = (header[0] << 8) | header[1];
+                    if (length < 1 || offset + 2 + length > current.DataLength) throw new Exception($"Record chain {chainId} is damaged at page {current.PageId}");
+
+                    var record = new byte[length];
+                    current.Read(record, 0, offset + 2, length);
+                    yield return record;
+                    offset += 2 + length;
+                }
+            }
+        }
+
+        /// <summary>
+        /// Reserve a set of new pages for use, and return their IDs.
+        /// This may allocate new pages and/or reuse released pages. Either way, the pages are blank when returned.
+        /// </summary>
+        /// <param name="block">Array for pages required. All slots will be filled with new page IDs</param>
+        public void AllocatePageBlock(int[] block)
+        {
+            if (block == null) throw new Exception("Requested free pages for a null block");
+            if (block.Length < 1) return;
+
+            lock (_fslock) {
+                // Exhaust the free page list to fill our block.
+                // If we run out of free pages, allocate the rest at the end of the stream
+                var stopIdx = ReassignReleasedPages(block);
+                if (stopIdx > 0)
+                {
+                    ClearReusedPages(block, stopIdx);
+                    Sync(_syncFreeList);
+                }
+                DirectlyAllocatePages(block, stopIdx);
+                _log.Debug("Allocated pages", "count", block.Length, "reused", stopIdx);
+            }
+        }
+
+        /// <summary>
+        /// Blank pages taken from the free list (no data, no back link), flushed with the free list change that handed them out.
+        /// Released pages keep their old contents, which would otherwise look like live chain pages to a recovery scan
+        /// until the new owner writes them.
+        /// </summary>
+        private void ClearReusedPages([NotNull]int[] block, int count)
+        {
+            for (int i = 0; i < count; i++)
+            {
+                CommitPage(new BasicPage(block[i]));
+            }
+        }
+
+        /// <summary>
+        /// Release all pages in a chain. They can be reused on next write.
+        /// If the page ID given is invalid, the release command is silently ignored
+        /// </summary>
+        public void ReleaseChain(int endPageId) {
+            if (endPageId < 0) return;
+            CheckFence();
+
+            using (var span = _trace.StartSpan("StreamDb.ReleaseChain"))
+            {
+                span.SetAttribute("endPageId", endPageId);
+                var walk = StartWalk(endPageId);
+                var currentPage = GetRawPage(endPageId);
+                // walk down the chain
+                while (currentPage != null)
+                {
+                    try {
+                        walk.Visit(currentPage.PageId);
+                    } catch (ChainException ex) {
+                        _log.Warn("Bad chain detected while releasing", "endPageId", endPageId, "pageId", currentPage.PageId, "visited", ex.PagesVisited);
+                        throw;
+                    }
+
+                    ReleaseSinglePage(currentPage.PageId);
+                    currentPage = GetRawPage(currentPage.PrevPageId);
+                }
+                Sync(_syncFreeList);
+                span.SetAttribute("pages", walk.Count);
+                _log.Debug("Released chain", "endPageId", endPageId, "pages", walk.Count);
+            }
+        }
+
+        /// <summary>
+        /// Move the contents of a page to a free page, and fix every reference to it: the back link of the next page
+        /// in its chain, or the index entry or header link if it is the end of a chain. The old page is then released.
+        /// <para></para>
+        /// This is the building block for defragmenting storage and moving data off bad sectors.
+        /// Streams already open on the page's chain, and parts of unfinished uploads, are not updated.
+        /// </summary>
+        /// <param name="oldId">Page to move. It must be part of a live chain: document data, index, or path lookup</param>
+        /// <param name="newId">Free page to move to. It is taken out of the free list</param>
+        public void RelocatePage(int oldId, int newId)
+        {
+            if (oldId == newId) throw new ArgumentException("Can't relocate a page onto itself");
+            using (var span = _trace.StartSpan("StreamDb.RelocatePage"))
+            lock (_fslock)
+            {
+                CheckFence();
+                span.SetAttribute("oldId", oldId);
+                span.SetAttribute("newId", newId);
+
+                var type = GuessPageType(oldId);
+                if (type == PageType.Free || type == PageType.FreeList) throw new Exception($"Page {oldId} belongs to the free list, and can't be relocated");
+                var references = RedirectReferences(oldId, newId, apply: false);
+                if (references < 1) throw new Exception($"Page {oldId} is not part of any live chain");
+
+                var source = GetRawPage(oldId) ?? throw new Exception($"Failed to read page {oldId}");
+                if (!TryClaimFreePage(newId)) throw new Exception($"Page {newId} is not in the free list");
+                MovePage(source, newId);
+
+                ReleaseSinglePage(oldId);
+                Sync(_syncFreeList);
+                span.SetAttribute("references", references);
+                _log.Debug("Relocated page", "oldId", oldId, "newId", newId, "type", type);
+            }
+        }
+
+        /// <summary>
+        /// Copy a chain onto new pages at the end of storage, so it can be read in one sequential run, and point every
+        /// reference to the old chain end at the copy. The old chain is then released.
+        /// Returns the new end page ID, or the old one if the chain was already a single run.
+        /// <para></para>
+        /// Storage grows by the chain's length until the released pages are reused.
+        /// Streams already open on the old chain are not updated.
+        /// </summary>
+        /// <param name="endPageId">End page of a live chain: document data, index, or path lookup</param>
+        public int OptimizeChain(int endPageId)
+        {
+            using (var span = _trace.StartSpan("StreamDb.OptimizeChain"))
+            lock (_fslock)
+            {
+                CheckFence();
+                span.SetAttribute("endPageId", endPageId);
+
+                var before = AnalyzeChain(endPageId);
+                span.SetAttribute("pages", before.PageCount);
+                span.SetAttribute("runs", before.Runs);
+                if (before.Runs <= 1) return endPageId;
+                if (RedirectReferences(endPageId, endPageId, apply: false) < 1) throw new Exception($"Page {endPageId} is not the end of a live chain");
+
+                var block = new int[before.PageCount];
+                DirectlyAllocatePages(block, 0);
+                try
+                {
+                    for (int i = 0; i < block.Length; i++)
+                    {
+                        var source = GetRawPage(before.PageIds[i]) ?? throw new Exception($"Failed to read page {before.PageIds[i]}");
+                        var target = new BasicPage(block[i]);
+                        Array.Copy(source._data, target._data, BasicPage.PageRawSize);
+                        target.PrevPageId = i > 0 ? block[i - 1] : -1;
+                        CommitPage(target);
+                    }
+                    Sync(_syncData);
+                }
+                catch
+                {
+                    span.SetAttribute("failed", true);
+                    ReleasePageBlock(block);
+                    throw;
+                }
+
+                var newEndPageId = block[block.Length - 1];
+                RedirectReferences(endPageId, newEndPageId, apply: true);
+                SetPathLookupCache(null);
+                Sync(_syncIndex, commit: true);
+
+                ReleaseChain(endPageId);
+                _log.Debug("Optimized chain", "oldEndPageId", endPageId, "newEndPageId", newEndPageId, "pages", block.Length, "runs", before.Runs);
+                return newEndPageId;
+            }
+        }
+
+        /// <summary>
+        /// Copy a page to an already claimed slot, and point all references at the copy. The old slot is not released.
+        /// </summary>
+        private void MovePage([NotNull]BasicPage source, int newId)
+        {
+            var target = new BasicPage(newId);
+            Array.Copy(source._data, target._data, BasicPage.PageRawSize);
+            CommitPage(target);
+
+            RedirectReferences(source.PageId, newId, apply: true);
+            SetPathLookupCache(null);
+            Sync(_syncIndex, commit: true);
+        }
+
+        /// <summary>
+        /// Mark a page slot as unusable, for example because the storage under it is failing.
+        /// The slot is taken out of the free list and will never be allocated again. If the page holds live data,
+        /// that data is first moved to a new page (see `RelocatePage`).
+        /// <para></para>
+        /// The list of bad pages is kept in storage, under `ReservedDocIds.BadPages`.
+        /// </summary>
+        public void MarkBadPage(int pageId)
+        {
+            using (var span = _trace.StartSpan("StreamDb.MarkBadPage"))
+            lock (_fslock)
+            {
+                CheckFence();
+                span.SetAttribute("pageId", pageId);
+                if (pageId < 0 || HEADER_SIZE + ((long)pageId + 1) * BasicPage.PageRawSize > _fs.Length) throw new Exception($"Page {pageId} is not in storage");
+                if (IsBadPage(pageId)) return;
+
+                var type = GuessPageType(pageId);
+                span.SetAttribute("type", type);
+                switch (type)
+                {
+                    case PageType.FreeList:
+                        throw new Exception($"Page {pageId} holds the free list, and can't be marked bad");
+
+                    case PageType.Free:
+                        if (!TryClaimFreePage(pageId)) throw new Exception($"Failed to take page {pageId} out of the free list");
+                        Sync(_syncFreeList);
+                        break;
+
+                    default:
+                        if (RedirectReferences(pageId, -1, apply: false) < 1) break; // not in any live chain. Nothing to move.
+                        var source = GetRawPage(pageId) ?? throw new Exception($"Failed to read page {pageId}");
+                        var slot = new int[1];
+                        AllocatePageBlock(slot);
+                        MovePage(source, slot[0]);
+                        span.SetAttribute("newId", slot[0]);
+                        break;
+                }
+
+                _badPages.Add(pageId);
+                lock (_crcFailures) { _crcFailures.Remove(pageId); }
+                SaveBadPages();
+                _log.Warn("Page marked as bad. It will not be used again", "pageId", pageId, "type", type);
+            }
+        }
+
+        /// <summary>
+        /// Take damaged pages out of use without moving them, as they can't be read cleanly.
+        /// Free pages are claimed from the free list, and every listed page is added to the bad-page map,
+        /// so it is never allocated or released again. Chains that run through a quarantined page still point at it.
+        /// </summary>
+        public void QuarantinePages([NotNull]IEnumerable<int> pageIds)
+        {
+            lock (_fslock)
+            {
+                CheckFence();
+                var added = false;
+                foreach (var pageId in pageIds)
+                {
+                    if (pageId < 0 || HEADER_SIZE + ((long)pageId + 1) * BasicPage.PageRawSize > _fs.Length) continue;
+                    if (IsBadPage(pageId)) continue;
+                    if (GuessPageType(pageId) == PageType.Free && TryClaimFreePage(pageId)) Sync(_syncFreeList);
+
+                    _badPages.Add(pageId);
+                    added = true;
+                    _log.Warn("Page quarantined. It will not be used again", "pageId", pageId);
+                }
+                if (added) SaveBadPages();
+            }
+        }
+
+        /// <summary>
+        /// Point each header link away from damaged pages: to its previous revision if the newest is damaged,
+        /// or to the newest alone if the previous is damaged. A free list with no undamaged revision is emptied,
+        /// leaking its pages rather than handing out damaged ones.
+        /// Returns false if the index or path lookup link has no undamaged revision.
+        /// </summary>
+        public bool RepairHeaderLinks()
+        {
+            lock (_fslock)
+            {
+                CheckFence();
+                var repaired = true;
+                for (int headOffset = 0; headOffset < LinkNames.Length; headOffset++)
+                {
+                    var link = DescribeLink(GetLink(headOffset));
+                    var newestOk = link.IsValid && IsReadablePage(link.Newest);
+                    var previousOk = link.IsValid && IsReadablePage(link.Previous);
+                    if (link.IsValid && (link.Newest < 0 || newestOk) && (link.Previous < 0 || previousOk)) continue; // nothing wrong
+
+                    var replacement = new VersionedLink();
+                    if (newestOk) replacement.WriteNewLink(link.Newest, out _);
+                    else if (previousOk) replacement.WriteNewLink(link.Previous, out _);
+                    else if (headOffset != 2) // only the free list can start again empty
+                    {
+                        repaired = false;
+                        continue;
+                    }
+
+                    SetLink(headOffset, replacement);
+                    replacement.TryGetLink(0, out var pageId);
+                    _log.Warn("Header link repaired", "link", LinkNames[headOffset], "pageId", pageId);
+                }
+
+                SetPathLookupCache(null);
+                _freeIndex = null;
+                LoadFreeIndex();
+                _fs.Flush();
+                return repaired;
+            }
+        }
+
+        /// <summary>
+        /// True if a page is inside storage and passes its CRC check
+        /// </summary>
+        private bool IsReadablePage(int pageId)
+        {
+            if (pageId < 0 || HEADER_SIZE + ((long)pageId + 1) * BasicPage.PageRawSize > _fs.Length) return false;
+            var page = GetRawPage(pageId, ignoreCrc: true);
+            return page != null && page.ValidateCrc(evenInQuickMode: true);
+        }
+
+        /// <summary>
+        /// IDs of pages in the bad-page map, in ascending order
+        /// </summary>
+        [NotNull] public int[] BadPages()
+        {
+            lock (_fslock)
+            {
+                LoadBadPages();
+                return _badPages.OrderBy(id => id).ToArray();
+            }
+        }
+
+        private bool IsBadPage(int pageId)
+        {
+            lock (_fslock)
+            {
+                LoadBadPages();
+                return _badPages.Contains(pageId);
+            }
+        }
+
+        /// <summary>
+        /// Read the bad-page map from storage, once per connection.
+        /// Pages marked bad by other connections after this are not seen.
+        /// </summary>
+        private void LoadBadPages()
+        {
+            if (_badPagesLoaded) return;
+            _badPagesLoaded = true; // set first: reading the map walks the index, which must not come back here
+
+            // Structure of the bad-page map: n * [PageId: int32]
+            var endPageId = GetDocumentHead(ReservedDocIds.BadPages);
+            if (endPageId < 0) return;
+            using (var stream = GetStream(endPageId, sampleCrc: false))
+            {
+                var r = new BinaryReader(stream);
+                var count = stream.Length / 4;
+                for (int i = 0; i < count; i++) { _badPages.Add(r.ReadInt32()); }
+            }
+        }
+
+        private void SaveBadPages()
+        {
+            var ms = new MemoryStream();
+            var w = new BinaryWriter(ms);
+            foreach (var id in _badPages.OrderBy(id => id)) { w.Write(id); }
+            ms.Seek(0, SeekOrigin.Begin);
+
+            var pageId = WriteStream(ms);
+            BindIndex(ReservedDocIds.BadPages, pageId, out var expired);
+            ReleaseChain(expired);
+        }
+
+        /// <summary>
+        /// Number of live documents in the index, not counting reserved IDs.
+        /// This is read from the stored counters, so doesn't walk the index unless the counters are missing or damaged.
+        /// </summary>
+        public long DocumentCount()
+        {
+            lock (_fslock)
+            {
+                LoadCounters();
+                return _documentCount;
+            }
+        }
+
+        /// <summary>
+        /// Number of released pages that can be reused without growing storage.
+        /// This is read from the stored counters, so doesn't walk the free list unless the counters are missing or damaged.
+        /// </summary>
+        public long FreePageCount()
+        {
+            lock (_fslock)
+            {
+                LoadCounters();
+                return _freePageCount;
+            }
+        }
+
+        /// <summary>
+        /// Read the document and free page counters, once per connection (every time for a read replica, as the writer moves them on).
+        /// The counters are kept in two pages, both held by the index entry for `ReservedDocIds.Counters`, and the one with the higher sequence wins.
+        /// If neither can be read, they are counted from the index and free list, and stored at the next sync.
+        /// </summary>
+        private void LoadCounters()
+        {
+            if (_documentCount >= 0 && !_readReplica) return;
+
+            var link = GetDocumentLink(ReservedDocIds.Counters);
+            var newest = -1;
+            var previous = -1;
+            link?.TryGetLink(0, out newest);
+            link?.TryGetLink(1, out previous);
+
+            var found = false;
+            foreach (var pageId in new[] { newest, previous })
+            {
+                if (!TryReadCounters(pageId, out var documents, out var freePages, out var sequence)) continue;
+                if (found && sequence <= _countersSequence) continue;
+
+                found = true;
+                _countersPageId = pageId;
+                _countersSparePageId = pageId == newest ? previous : newest;
+                _countersSequence = sequence;
+                _documentCount = documents;
+                _freePageCount = freePages;
+            }
+            if (found) return;
+
+            _countersPageId = newest;
+            _countersSparePageId = previous;
+            _countersSequence = 0;
+            _documentCount = CountIndexedDocuments();
+            _freePageCount = CountFreeListPages();
+            _countersDirty = true;
+            if (newest >= 0) _log.Warn("Stored counters were damaged, and have been recounted", "pageId", newest);
+        }
+
+        /// <summary>
+        /// Read one counters page. Returns false if the page is missing, fails its CRC check, or doesn't hold counters.
+        /// Pages written before the sequence was stored read as sequence zero.
+        /// </summary>
+        private bool TryReadCounters(int pageId, out long documents, out long freePages, out long sequence)
+        {
+            documents = freePages = sequence = 0;
+
+            // Structure of the counters page: [Magic: 8 bytes][Documents: int64][Free pages: int64][Sequence: int64]
+            var page = pageId >= 0 ? GetRawPage(pageId, ignoreCrc: true) : null;
+            if (page == null || !page.ValidateCrc(evenInQuickMode: true) || page.DataLength < 24) return false;
+
+            var stored = new byte[32];
+            page.Read(stored, 0, 0, (int)Math.Min(stored.Length, page.DataLength));
+            if (!stored.Take(CountersMagic.Length).SequenceEqual(CountersMagic)) return false;
+
+            documents = BitConverter.ToInt64(stored, 8);
+            freePages = BitConverter.ToInt64(stored, 16);
+            sequence = BitConverter.ToInt64(stored, 24);
+            return true;
+        }
+
+        /// <summary>
+        /// Apply a change to the counters. `LoadCounters` must be called before the change is made to storage,
+        /// or a recount would include it twice.
+        /// </summary>
+        private void AdjustCounters(int documents, int freePages)
+        {
+            if (documents == 0 && freePages == 0) return;
+            _documentCount += documents;
+            _freePageCount += freePages;
+            _countersDirty = true;
+        }
+
+        /// <summary>
+        /// Write changed counters over the older of their two pages, with the next sequence number, so a torn write leaves the newer
+        /// page to be read. This is done as part of `Sync`, so counters are flushed with the link flips they follow.
+        /// Each of the two pages is created on first use, which is itself a write that moves the counters.
+        /// </summary>
+        private void SaveCounters()
+        {
+            if (!_countersDirty || _savingCounters || _readReplica || !_fs.CanWrite) return;
+            _savingCounters = true;
+            try
+            {
+                if (_countersSparePageId < 0)
+                {
+                    // Bind new pages as the newer versions, so the index entry holds both pages.
+                    // Both are taken on first use, so later saves never allocate.
+                    var slots = new int[_countersPageId < 0 ? 2 : 1];
+                    AllocatePageBlock(slots);
+                    foreach (var slot in slots)
+                    {
+                        BindIndex(ReservedDocIds.Counters, slot, out var expired);
+                        ReleaseChain(expired);
+                    }
+                    if (_countersPageId < 0) _countersPageId = slots[0]; // blank until the save after this one
+                    _countersSparePageId = slots[slots.Length - 1];
+                }
+
+                var sequence = _countersSequence + 1;
+                var stored = new byte[32];
+                Array.Copy(CountersMagic, stored, CountersMagic.Length);
+                Array.Copy(BitConverter.GetBytes(_documentCount), 0, stored, 8, 8);
+                Array.Copy(BitConverter.GetBytes(_freePageCount), 0, stored, 16, 8);
+                Array.Copy(BitConverter.GetBytes(sequence), 0, stored, 24, 8);
+
+                var page = new BasicPage(_countersSparePageId);
+                page.Write(stored, 0, 0, stored.Length);
+                CommitPage(page);
+
+                _countersSparePageId = _countersPageId;
+                _countersPageId = page.PageId;
+                _countersSequence = sequence;
+                _countersDirty = false;
+            }
+            finally
+            {
+                _savingCounters = false;
+            }
+        }
+
+        /// <summary>
+        /// Count live documents by walking the whole index. Reserved IDs are not counted.
+        /// </summary>
+        private long CountIndexedDocuments()
+        {
+            return IndexedDocuments().Count;
+        }
+
+        /// <summary>
+        /// IDs of live documents in the index, not counting reserved IDs. This walks the whole index.
+        /// </summary>
+        [NotNull]public Guid[] DocumentIds()
+        {
+            return ReplicaRead(() => {
+                lock (_fslock) { return IndexedDocuments().ToArray(); }
+            }, "index");
+        }
+
+        /// <summary>
+        /// Find live documents by walking the whole index. Reserved IDs are not included.
+        /// </summary>
+        [NotNull]private List<Guid> IndexedDocuments()
+        {
+            var seen = new HashSet<Guid>();
+            var live = new List<Guid>();
+            foreach (var indexTopPageId in IndexChainTops())
+            {
+                var walk = StartWalk(indexTopPageId);
+                var currentPage = NextIndexPage(indexTopPageId, walk);
+                while (currentPage != null)
+                {
+                    var indexSnap = new IndexPage();
+                    indexSnap.Defrost(currentPage.BodyStream());
+                    foreach (var entry in indexSnap.Entries())
+                    {
+                        if (!seen.Add(entry.Key)) continue; // newer pages take precedence
+                        if (entry.Value.TryGetLink(0, out _) && !ReservedDocIds.IsReserved(entry.Key)) live.Add(entry.Key);
+                    }
+                    currentPage = NextIndexPage(currentPage.PrevPageId, walk);
+                }
+            }
+            return live;
+        }
+
+        /// <summary>
+        /// Count reusable pages by walking the free list: each listed page ID, plus each emptied list page other than the top,
+        /// as `ReassignReleasedPages` hands those out too.
+        /// </summary>
+        private long CountFreeListPages()
+        {
+            if (!GetFreeListLink().TryGetLink(0, out var topPageId)) return 0;
+
+            // Structure of free pages' data: see `ReleaseSinglePage`
+            var count = 0L;
+            var walk = StartWalk(topPageId);
+            var currentPage = GetRawPage(topPageId);
+            while (currentPage != null)
+            {
+                walk.Visit(currentPage.PageId);
+                var length = currentPage.ReadDataInt32(0);
+                if (length > 0) count += length;
+                else if (currentPage.PageId != topPageId) count++;
+                currentPage = GetRawPage(currentPage.PrevPageId);
+            }
+            return count;
+        }
+
+        /// <summary>
+        /// Check the stored counters against a full count of the index and free list, and store the right values if they differ.
+        /// Returns true if the stored counters were wrong.
+        /// </summary>
+        public bool VerifyCounters()
+        {
+            lock (_fslock)
+            {
+                LoadCounters();
+                var documents = CountIndexedDocuments();
+                var freePages = CountFreeListPages();
+                if (documents == _documentCount && freePages == _freePageCount) return false;
+
+                _log.Warn("Stored counters were wrong", "documents", _documentCount, "countedDocuments", documents, "freePages", _freePageCount, "countedFreePages", freePages);
+                if (_readReplica || !_fs.CanWrite) return true;
+                _documentCount = documents;
+                _freePageCount = freePages;
+                _countersDirty = true;
+                Sync(_syncIndex, commit: true);
+                return true;
+            }
+        }
+
+        /// <summary>
+        /// Count a CRC failure against a page. Once a page has failed `DatabaseOptions.BadPageFailures` times,
+        /// it is moved off at the next write.
+        /// </summary>
+        private void NoteCrcFailure(int pageId)
+        {
+            int failures;
+            lock (_crcFailures)
+            {
+                _crcFailures.TryGetValue(pageId, out failures);
+                _crcFailures[pageId] = ++failures;
+            }
+            if (failures == _badPageFailures) _log.Warn("Page keeps failing CRC checks. It will be moved once it reads cleanly", "pageId", pageId, "failures", failures);
+        }
+
+        /// <summary>
+        /// Mark as bad every page that has failed its CRC check too many times, and now reads cleanly.
+        /// Pages that still fail are left alone, so a damaged page is not copied with a fresh CRC.
+        /// </summary>
+        private void MoveSuspectPages()
+        {
+            int[] suspects;
+            lock (_crcFailures) { suspects = _crcFailures.Where(kvp => kvp.Value >= _badPageFailures).Select(kvp => kvp.Key).ToArray(); }
+            if (suspects.Length < 1 || _readReplica) return;
+
+            lock (_fslock)
+            {
+                if (_movingBadPages) return; // marking writes the map, which comes back here
+                _movingBadPages = true;
+                try
+                {
+                    foreach (var pageId in suspects)
+                    {
+                        var page = GetRawPage(pageId, ignoreCrc: true);
+                        if (page == null || !page.ValidateCrc()) continue;
+                        try
+                        {
+                            MarkBadPage(pageId);
+                        }
+                        catch (Exception ex)
+                        {
+                            // don't fail the write that found it. Start counting again.
+                            _log.Warn("Failed to move data off a bad page", "pageId", pageId, "error", ex.Message);
+                            lock (_crcFailures) { _crcFailures.Remove(pageId); }
+                        }
+                    }
+                }
+                finally
+                {
+                    _movingBadPages = false;
+                }
+            }
+        }
+
+        /// <summary>
+        /// Find (and if `apply` is set, rewrite) every reference to `oldId` from header links, index entries,
+        /// and the back links of live chains. Returns the number of references found.
+        /// </summary>
+        private int RedirectReferences(int oldId, int newId, bool apply)
+        {
+            var found = 0;
+            var chainEnds = new HashSet<int>();
+            if (apply && _countersPageId == oldId) _countersPageId = newId; // the index entry is updated below
+            if (apply && _countersSparePageId == oldId) _countersSparePageId = newId;
+
+            // Header links
+            for (int headOffset = 0; headOffset < 3; headOffset++)
+            {
+                var link = GetLink(headOffset);
+                if (link.TryGetLink(0, out var newest)) chainEnds.Add(newest);
+                if (link.TryGetLink(1, out var previous)) chainEnds.Add(previous);
+                if (!link.ReplacePageId(oldId, newId)) continue;
+                found++;
+                if (apply) SetLink(headOffset, link);
+            }
+
+            // Shard tops in a sharded index root
+            if (GetIndexPageLink().TryGetLink(0, out var rootPageId))
+            {
+                var rootPage = GetRawPage(rootPageId, ignoreCrc: true);
+                if (rootPage != null && IndexRoot.IsRoot(rootPage))
+                {
+                    var root = new IndexRoot();
+                    root.Defrost(rootPage.BodyStream());
+                    if (root.ReplacePageId(oldId, newId))
+                    {
+                        found++;
+                        if (apply)
+                        {
+                            var stream = root.Freeze();
+                            rootPage.Write(stream, 0, stream.Length);
+                            CommitIndexPage(rootPage);
+                            DropIndexRootCache(); // same page and link, new shard tops
+                        }
+                    }
+                }
+            }
+
+            // Index entries
+            foreach (var indexTopPageId in IndexChainTops())
+            {
+                chainEnds.Add(indexTopPageId);
+                var walk = StartWalk(indexTopPageId);
+                var currentPage = NextIndexPage(indexTopPageId, walk, out var damaged);
+                while (currentPage != null)
+                {
+                    var indexSnap = new IndexPage();
+                    indexSnap.Defrost(currentPage.BodyStream());
+                    var changed = false;
+                    foreach (var entry in indexSnap.Entries())
+                    {
+                        if (entry.Value.TryGetLink(0, out var newest)) chainEnds.Add(newest);
+                        if (entry.Value.TryGetLink(1, out var previous)) chainEnds.Add(previous);
+                        if (!entry.Value.ReplacePageId(oldId, newId)) continue;
+                        found++;
+                        changed = true;
+                    }
+                    if (changed && apply)
+                    {
+                        var stream = indexSnap.Freeze();
+                        currentPage.Write(stream, 0, stream.Length);
+                        CommitIndexPage(currentPage);
+                    }
+                    currentPage = NextIndexPage(currentPage.PrevPageId, walk, out damaged);
+                }
+                if (damaged) throw new Exception("Index has damaged pages. Repair it before moving pages, or references behind the damage would be missed");
+            }
+
+            // Back links inside chains
+            foreach (var end in chainEnds)
+            {
+                var walk = StartWalk(end);
+                var currentPage = GetRawPage(end);
+                while (currentPage != null)
+                {
+                    walk.Visit(currentPage.PageId);
+                    if (currentPage.PrevPageId == oldId)
+                    {
+                        found++;
+                        if (apply)
+                        {
+                            currentPage.PrevPageId = newId;
+                            CommitPage(currentPage);
+                        }
+                    }
+                    currentPage = GetRawPage(currentPage.PrevPageId);
+                }
+            }
+            return found;
+        }
+
+        /// <summary>
+        /// Remove a specific page ID from the free list, so it can be used directly.
+        /// Returns false if the page is not listed as free.
+        /// </summary>
+        private bool TryClaimFreePage(int pageId)
+        {
+            if (!GetFreeListLink().TryGetLink(0, out var topPageId)) return false;
+            LoadCounters();
+
+            var startPageId = topPageId;
+            if (_freeIndex != null && !_freeIndex.TryGetOwner(pageId, out startPageId)) return false;
+
+            // Structure of free pages' data: see `ReleaseSinglePage`
+            var walk = StartWalk(startPageId);
+            var currentPage = GetRawPage(startPageId);
+            while (currentPage != null)
+            {
+                walk.Visit(currentPage.PageId);
+                var length = currentPage.ReadDataInt32(0);
+                for (int i = 1; i <= length; i++)
+                {
+                    if (currentPage.ReadDataInt32(i) != pageId) continue;
+
+                    currentPage.WriteDataInt32(i, currentPage.ReadDataInt32(length)); // move the last entry into the gap
+                    currentPage.WriteDataInt32(0, length - 1);
+                    CommitPage(currentPage);
+                    AdjustCounters(0, -1);
+                    _freeIndex?.RemoveEntry(pageId);
+                    return true;
+                }
+                currentPage = GetRawPage(currentPage.PrevPageId);
+            }
+            return false;
+        }
+
+        /// <summary>
+        /// Read the next page of an index walk.
+        /// Pages that fail their CRC check are skipped (following their back link) and recorded in `DamagedIndexPages`,
+        /// so one bad page doesn't hide the documents indexed in older pages. Returns null at the end of the chain.
+        /// <para></para>
+        /// Only for walks that read the index. Walks that change it must use the overload that stops at damage.
+        /// </summary>
+        private BasicPage? NextIndexPage(int pageId, [NotNull]ChainWalk walk)
+        {
+            return NextIndexPage(pageId, walk, stopAtDamage: false, out _);
+        }
+
+        /// <summary>
+        /// Read the next page of an index walk that may change index pages.
+        /// This stops at the first page that fails its CRC check, recording it in `DamagedIndexPages` and setting `damaged`.
+        /// Entries behind a damaged page may be stale copies of entries held in it, so they must not be changed until the index is repaired.
+        /// </summary>
+        private BasicPage? NextIndexPage(int pageId, [NotNull]ChainWalk walk, out bool damaged)
+        {
+            return NextIndexPage(pageId, walk, stopAtDamage: true, out damaged);
+        }
+
+        private BasicPage? NextIndexPage(int pageId, [NotNull]ChainWalk walk, bool stopAtDamage, out bool damaged)
+        {
+            damaged = false;
+            while (pageId >= 0)
+            {
+                bool inRange;
+                lock (_fslock) { inRange = HEADER_SIZE + ((long)pageId + 1) * BasicPage.PageRawSize <= _fs.Length; }
+                if (!inRange)
+                {
+                    if (_readReplica) throw new Exception($"Index page {pageId} is past the end of storage");
+                    MarkDamagedIndexPage(pageId, "link past end of storage");
+                    damaged = true;
+                    return null;
+                }
+
+                var page = GetRawPage(pageId, ignoreCrc: true) ?? throw new Exception($"Failed to read index page {pageId}");
+                walk.Visit(page.PageId);
+                if (page.ValidateCrc()) return page;
+
+                if (_readReplica) throw new Exception($"Reading index page {pageId} failed CRC check"); // may be torn by a writer; let `ReplicaRead` retry
+                NoteCrcFailure(pageId);
+                MarkDamagedIndexPage(pageId, "failed CRC check");
+                damaged = true;
+                if (stopAtDamage) return null;
+                pageId = page.PrevPageId;
+            }
+            return null;
+        }
+
+        private void MarkDamagedIndexPage(int pageId, string reason)
+        {
+            bool added;
+            lock (_damagedIndexPages) { added = _damagedIndexPages.Add(pageId); }
+            if (added) _log.Warn("Skipping damaged index page. Storage needs repair", "pageId", pageId, "reason", reason);
+        }
+
+        /// <summary>
+        /// Read a page from the storage stream to memory. This will check the CRC.
+        /// <para></para>
+        /// With a page cache (see `DatabaseOptions.PageCachePages`), pages that were checked or written by this connection
+        /// are served from memory without checking again.
+        /// </summary>
+        public BasicPage? GetRawPage(int pageId, bool ignoreCrc = false)
+        {
+            if (pageId < 0) return null;
+            if (_pageCache != null && _pageCache.TryGet(pageId, out var cached)) return cached;
+
+            var result = ReadStoredPage(pageId);
+            if (ignoreCrc) return result;
+            if (!result.ValidateCrc()) {
+                _log.Warn("Page failed CRC check", "pageId", pageId);
+                if (!_readReplica) NoteCrcFailure(pageId);
+                var ex = new Exception($"Reading page {pageId} failed CRC check");
+                ex.Data[PageIdDataKey] = pageId;
+                throw ex;
+            }
+            if (!BasicPage.QuickAndDirtyMode) _pageCache?.Put(result); // in quick mode, the CRC was not really checked
+            return result;
+        }
+
+        /// <summary>
+        /// Read a page from the storage stream, bypassing the page cache. The CRC is not checked.
+        /// Integrity scans use this, so they see what is really stored.
+        /// </summary>
+        [NotNull]private BasicPage ReadStoredPage(int pageId)
+        {
+            var result = new BasicPage(pageId);
+            lock (_fslock)
+            {
+                if (_walPending.TryGetValue(pageId, out var pending))
+                {
+                    result.Defrost(new MemoryStream(pending)); // written by a change that has not reached storage yet
+                    return result;
+                }
+                _retry.Run(() => {
+                    _fs.Seek(HEADER_SIZE + (pageId * BasicPage.PageRawSize), SeekOrigin.Begin);
+                    result.Defrost(_fs);
+                }, _log, "read page");
+            }
+            return result;
+        }
+
+        /// <summary>
+        /// Write a page from memory to storage. This will update the CRC before writing.
+        /// </summary>
+        public void CommitPage(BasicPage page) {
+            var buffer = SerialisePage(page);
+            lock (_fslock)
+            {
+                _walPending.Remove(page.PageId); // this write replaces any held by `CommitIndexPage`
+                WritePageImage(page.PageId, buffer);
+                _pageCache?.Put(page);
+            }
+        }
+
+        /// <summary>
+        /// Write an index page, which is changed in place. With a write-ahead log, the page is held in memory
+        /// (and served to reads) until the `Sync` that ends the change, which logs and writes all held pages together.
+        /// Without a log, this is the same as `CommitPage`.
+        /// </summary>
+        private void CommitIndexPage([NotNull]BasicPage page)
+        {
+            if (_wal == null) { CommitPage(page); return; }
+
+            var buffer = SerialisePage(page);
+            lock (_fslock)
+            {
+                _walPending[page.PageId] = buffer;
+                _pageCache?.Put(page);
+            }
+        }
+
+        /// <summary>
+        /// Update the page's CRC, and copy it out as stored
+        /// </summary>
+        [NotNull]private static byte[] SerialisePage(BasicPage? page)
+        {
+            if (page == null) throw new Exception("Can't commit a null page");
+            if (page.PageId < 0) throw new Exception("Page ID must be valid");
+            page.UpdateCRC();
+
+            var ms = new MemoryStream(BasicPage.PageRawSize);
+            page.Freeze().CopyTo(ms);
+            return ms.ToArray() ?? throw new Exception($"Failed to serialise page {page.PageId}");
+        }
+
+        /// <summary>
+        /// Write a serialised page to its place in storage. Call under `_fslock`
+        /// </summary>
+        private void WritePageImage(int pageId, [NotNull]byte[] buffer)
+        {
+            try
+            {
+                _retry.Run(() => {
+                    _fs.Seek(HEADER_SIZE + ((long)pageId * BasicPage.PageRawSize), SeekOrigin.Begin);
+                    _fs.Write(buffer, 0, buffer.Length);
+                }, _log, "write page");
+            }
+            catch
+            {
+                _pageCache?.Remove(pageId); // storage may hold the old or new content, or neither
+                throw;
+            }
+        }
+
+        /// <summary>
+        /// Log the index pages held by `CommitIndexPage` with a single flush, write them to storage, then checkpoint the log.
+        /// If writing storage fails, the log is kept, so the pages are written again when the database is next opened. Call under `_fslock`
+        /// </summary>
+        private void WriteLoggedPages()
+        {
+            if (_wal == null || _walPending.Count < 1) return;
+
+            // If either step fails, the pages are still held, and are logged and written again at the next sync
+            _wal.Append(_walPending);
+            foreach (var pending in _walPending) WritePageImage(pending.Key, pending.Value);
+            _walPending.Clear();
+            CheckpointWriteAheadLog();
+        }
+        
+        /// <summary>
+        /// Map a document GUID to a page ID.
+        /// If the document has an existing page, the versions will be incremented.
+        /// If a version expires, the page ID will be returned in `expiredPageId`
+        /// </summary>
+        /// <param name="documentId">Unique ID for the document</param>
+        /// <param name="newPageId">top page id for most recent version of the document</param>
+        /// <param name="expiredPageId">an expired version of the document, or `-1` if no versions have expired</param>
+        /// <param name="length">length of the document in bytes, or -1 if not known. This is stored in the index for `GetIndexStat`</param>
+        /// <param name="flags">storage flags for the document, stored in the index</param>
+        public void BindIndex(Guid documentId, int newPageId, out int expiredPageId, long length = -1, DocumentFlags flags = DocumentFlags.None)
+        {
+            using (var span = _trace.StartSpan("StreamDb.BindIndex"))
+            lock (_fslock)
+            {
+                CheckFence();
+                LoadCounters();
+                var pagesTouched = 0;
+                var counted = ReservedDocIds.IsReserved(documentId) ? 0 : 1;
+                span.SetAttribute("documentId", documentId);
+                var indexTopPageId = IndexChainTop(documentId);
+
+                // Try to update an existing document
+                var walk = StartWalk(indexTopPageId);
+                var currentPage = NextIndexPage(indexTopPageId, walk, out var damaged);
+                while (currentPage != null)
+                {
+                    pagesTouched++;
+                    var indexSnap = new IndexPage();
+                    indexSnap.Defrost(currentPage.BodyStream());
+
+                    var wasLive = indexSnap.Search(documentId, out _);
+                    var found = indexSnap.Update(documentId, newPageId, out expiredPageId, length, flags);
+                    if (found)
+                    {
+                        var stream = indexSnap.Freeze();
+                        currentPage.Write(stream, 0, stream.Length);
+                        CommitIndexPage(currentPage);
+                        if (!wasLive) AdjustCounters(counted, 0); // revived a removed entry
+                        Sync(_syncIndex, commit: true);
+                        span.SetAttribute("pages", pagesTouched);
+                        return;
+                    }
+
+                    currentPage = NextIndexPage(currentPage.PrevPageId, walk, out damaged);
+                }
+                if (damaged && FindDocumentLink(documentId, out _) != null) throw new Exception($"Document {documentId} is indexed behind a damaged index page. Repair the index before changing it");
+
+                // Try to insert a new link in an existing index page
+                expiredPageId = -1;
+                walk = StartWalk(indexTopPageId);
+                currentPage = NextIndexPage(indexTopPageId, walk, out _);
+                while (currentPage != null)
+                {
+                    pagesTouched++;
+                    var indexSnap = new IndexPage();
+                    indexSnap.Defrost(currentPage.BodyStream());
+
+                    var found = indexSnap.TryInsert(documentId, newPageId, length, flags);
+                    if (!found && indexSnap.Compact() > 0)
+                    {
+                        // Removed entries were blocking the insert. Try again with them cleared out.
+                        span.SetAttribute("compacted", currentPage.PageId);
+                        found = indexSnap.TryInsert(documentId, newPageId, length, flags);
+                    }
+                    if (!found && indexSnap.TryRebalanceInsert(documentId, newPageId, length, flags))
+                    {
+                        // The entry's region was full, but the page was not. Rebuilt around a new pivot.
+                        span.SetAttribute("rebalanced", currentPage.PageId);
+                        found = true;
+                    }
+                    if (found)
+                    {
+                        var stream = indexSnap.Freeze();
+                        currentPage.Write(stream, 0, stream.Length);
+                        CommitIndexPage(currentPage);
+                        AdjustCounters(counted, 0);
+                        Sync(_syncIndex, commit: true);
+                        span.SetAttribute("pages", pagesTouched);
+                        return;
+                    }
+
+                    currentPage = NextIndexPage(currentPage.PrevPageId, walk, out _);
+                }
+
+                // need to extend into a new index, and write to a new version of the head
+                var newIndex = new IndexPage();
+                var ok = newIndex.TryInsert(documentId, newPageId, length, flags);
+                if (!ok) throw new Exception("Failed to write index to blank index page");
+                var slot = new int[1];
+                AllocatePageBlock(slot);
+                var newPage = GetRawPage(slot[0]) ?? throw new Exception("Failed to read newly allocated page");
+                newPage.PrevPageId = indexTopPageId;
+                var newStream = newIndex.Freeze();
+                newPage.Write(newStream, 0, newStream.Length);
+                CommitPage(newPage);
+
+                // set new head link
+                SetIndexChainTop(documentId, newPage.PageId);
+                AdjustCounters(counted, 0);
+                Sync(_syncIndex, commit: true);
+                span.SetAttribute("pages", pagesTouched + 1);
+                span.SetAttribute("extended", true);
+            }
+        }
+
+        /// <summary>
+        /// Remove a mapping from a document GUID.
+        /// The page chain is not affected.
+        /// If no such document id is bound, nothing happens
+        /// </summary>
+        public void UnbindIndex(Guid documentId)
+        {
+            lock (_fslock)
+            {
+                CheckFence();
+                var indexTopPageId = IndexChainTop(documentId);
+                if (indexTopPageId < 0) {
+                     return; // no index to unbind
+                }
+                LoadCounters();
+
+                // Search for the binding, and remove if found
+                var walk = StartWalk(indexTopPageId);
+                var currentPage = NextIndexPage(indexTopPageId, walk, out var damaged);
+                while (currentPage != null)
+                {
+                    var indexSnap = new IndexPage();
+                    indexSnap.Defrost(currentPage.BodyStream());
+
+                    var wasLive = indexSnap.Search(documentId, out _);
+                    var found = indexSnap.Remove(documentId);
+                    if (found)
+                    {
+                        var stream = indexSnap.Freeze();
+                        currentPage.Write(stream, 0, stream.Length);
+                        CommitIndexPage(currentPage);
+                        if (wasLive && !ReservedDocIds.IsReserved(documentId)) AdjustCounters(-1, 0);
+                        Sync(_syncIndex, commit: true);
+                        return;
+                    }
+
+                    currentPage = NextIndexPage(currentPage.PrevPageId, walk, out damaged);
+                }
+                if (damaged && FindDocumentLink(documentId, out _) != null) throw new Exception($"Document {documentId} is indexed behind a damaged index page. Repair the index before changing it");
+            }
+        }
+
+        /// <summary>
+        /// True if the index is split into shards by document ID. See `MigrateToShardedIndex`
+        /// </summary>
+        public bool IsIndexSharded
+        {
+            get
+            {
+                lock (_fslock) { return GetIndexPageLink().TryGetLink(0, out var topPageId) && ReadIndexRoot(topPageId) != null; }
+            }
+        }
+
+        /// <summary>
+        /// Move a flat index (one chain of index pages) to a sharded index: a root page with a separate chain
+        /// for each value of the first byte of document IDs, so a lookup walks 1/256th of the index.
+        /// Live entries are copied with their links and metadata; the header is then flipped to the new root,
+        /// and the old chain is released. If this is interrupted before the flip, the flat index is still used.
+        /// Returns false if the index was already sharded.
+        /// </summary>
+        public bool MigrateToShardedIndex()
+        {
+            using (var span = _trace.StartSpan("StreamDb.ShardIndex"))
+            lock (_fslock)
+            {
+                CheckFence();
+                var indexLink = GetIndexPageLink();
+                var hasIndex = indexLink.TryGetLink(0, out var flatTopPageId);
+                if (hasIndex && ReadIndexRoot(flatTopPageId) != null) return false;
+
+                // Counters are stored on first sync. Make sure that has happened before the index is copied.
+                LoadCounters();
+                SaveCounters();
+                indexLink = GetIndexPageLink();
+                hasIndex = indexLink.TryGetLink(0, out flatTopPageId);
+
+                // Copy live entries into shards. Pages nearer the top win, as they do for lookups.
+                var shards = new List<IndexPage>?[IndexRoot.ShardCount];
+                var seen = new HashSet<Guid>();
+                var entries = 0;
+                var walk = StartWalk(hasIndex ? flatTopPageId : -1);
+                var currentPage = NextIndexPage(hasIndex ? flatTopPageId : -1, walk);
+                while (currentPage != null)
+                {
+                    var indexSnap = new IndexPage();
+                    indexSnap.Defrost(currentPage.BodyStream());
+                    foreach (var entry in indexSnap.Entries())
+                    {
+                        if (!entry.Value.TryGetLink(0, out _) || !seen.Add(entry.Key)) continue; // removed or hidden
+
+                        var shard = IndexRoot.ShardOf(entry.Key);
+                        var pages = shards[shard] ?? (shards[shard] = new List<IndexPage> { new IndexPage() });
+                        if (!pages[pages.Count - 1].TryCopyEntry(indexSnap, entry.Key))
+                        {
+                            var next = new IndexPage();
+                            if (!next.TryCopyEntry(indexSnap, entry.Key)) throw new Exception("Failed to copy index entry to blank index page");
+                            pages.Add(next);
+                        }
+                        entries++;
+                    }
+                    currentPage = NextIndexPage(currentPage.PrevPageId, walk);
+                }
+                if (NeedsRepair) throw new Exception("Index has damaged pages. Repair it before sharding, or their entries would be lost");
+
+                // Write each shard as a chain, oldest page first
+                var root = new IndexRoot();
+                for (int shard = 0; shard < IndexRoot.ShardCount; shard++)
+                {
+                    var pages = shards[shard];
+                    if (pages == null) continue;
+
+                    var ids = new int[pages.Count];
+                    AllocatePageBlock(ids);
+                    var prev = -1;
+                    for (int i = 0; i < pages.Count; i++)
+                    {
+                        var page = new BasicPage(ids[i]) { PrevPageId = prev };
+                        var stream = pages[i].Freeze();
+                        page.Write(stream, 0, stream.Length);
+                        CommitPage(page);
+                        prev = ids[i];
+                    }
+                    root.ShardTops[shard] = prev;
+                }
+
+                // Start a fresh header link: the previous version would be a flat index page
+                WriteIndexRoot(root, new VersionedLink());
+                Sync(_syncIndex, commit: true);
+                span.SetAttribute("entries", entries);
+                _log.Debug("Index sharded", "entries", entries);
+
+                if (hasIndex)
+                {
+                    try { ReleaseChain(flatTopPageId); }
+                    catch (Exception ex) { _log.Warn("Failed to release old index chain", "pageId", flatTopPageId, "error", ex.Message); }
+                }
+                return true;
+            }
+        }
+
+        /// <summary>
+        /// Drop the previous version link of a document from the index, leaving only the newest.
+        /// Returns the end page of the dropped chain, which the caller should release, or -1 if there was nothing to drop.
+        /// </summary>
+        public int DropPreviousVersion(Guid documentId)
+        {
+            if (documentId == ReservedDocIds.Counters) return -1; // both versions are in use, see `LoadCounters`
+            int[] expired;
+            lock (_fslock) { expired = DropPreviousVersions(IndexChainTop(documentId), id => id == documentId, stopAtFirst: true); }
+            return expired.Length > 0 ? expired[0] : -1;
+        }
+
+        /// <summary>
+        /// Drop the previous version link of every document in the index.
+        /// Returns the end pages of the dropped chains, which the caller should release.
+        /// </summary>
+        [NotNull]public int[] DropAllPreviousVersions()
+        {
+            lock (_fslock)
+            {
+                return IndexChainTops().SelectMany(top => DropPreviousVersions(top, id => id != ReservedDocIds.Counters, stopAtFirst: false)).ToArray(); // counters use both versions
+            }
+        }
+
+        [NotNull]private int[] DropPreviousVersions(int indexTopPageId, [NotNull]Func<Guid, bool> match, bool stopAtFirst)
+        {
+            var expired = new List<int>();
+            var unshared = new List<int>();
+            lock (_fslock)
+            {
+                CheckFence();
+                var walk = StartWalk(indexTopPageId);
+                var currentPage = NextIndexPage(indexTopPageId, walk, out _);
+                while (currentPage != null)
+                {
+                    var indexSnap = new IndexPage();
+                    indexSnap.Defrost(currentPage.BodyStream());
+                    var changed = false;
+                    var found = false;
+                    foreach (var entry in indexSnap.Entries())
+                    {
+                        if (!match(entry.Key)) continue;
+                        if (!entry.Value.TryGetLink(0, out var newest)) continue; // removed
+                        found = true;
+
+                        entry.Value.DropPrevious(out var previous);
+                        if (previous < 0) continue;
+                        changed = true;
+
+                        // Record chains share pages with their previous version, so only the pages not shared are released here
+                        if (!TryFindUnsharedPages(previous, newest, unshared)) expired.Add(previous);
+                    }
+                    if (changed)
+                    {
+                        var stream = indexSnap.Freeze();
+                        currentPage.Write(stream, 0, stream.Length);
+                        CommitIndexPage(currentPage);
+                        Sync(_syncIndex, commit: true);
+                    }
+                    if (unshared.Count > 0)
+                    {
+                        foreach (var pageId in unshared) { ReleaseSinglePage(pageId); }
+                        unshared.Clear();
+                        Sync(_syncFreeList);
+                    }
+                    if (found && stopAtFirst) break;
+
+                    currentPage = NextIndexPage(currentPage.PrevPageId, walk, out _); // versions behind a damaged page are kept
+                }
+            }
+            return expired.ToArray();
+        }
+
+        /// <summary>
+        /// Get the top page ID for a document ID by reading the index.
+        /// If the document ID can't be found, returns -1
+        /// </summary>
+        public int GetDocumentHead(Guid documentId)
+        {
+            return ReplicaRead(() => FindDocumentHead(documentId), "index");
+        }
+
+        /// <summary>
+        /// Get the top page ID for a document ID, and the flags stored with it, from the same read of the index.
+        /// If the document ID can't be found, returns -1
+        /// </summary>
+        public int GetDocumentHead(Guid documentId, out DocumentFlags flags)
+        {
+            var found = ReplicaRead(() => {
+                var link = FindDocumentLink(documentId, out var stat);
+                var head = link != null && link.TryGetLink(0, out var result) ? result : -1;
+                return new KeyValuePair<int, DocumentFlags>(head, stat?.Flags ?? DocumentFlags.None);
+            }, "index");
+            flags = found.Value;
+            return found.Key;
+        }
+
+        private int FindDocumentHead(Guid documentId)
+        {
+            var link = FindDocumentLink(documentId, out _);
+            return link != null && link.TryGetLink(0, out var result) ? result : -1;
+        }
+
+        /// <summary>
+        /// Get the index link (current and previous versions) for a document ID.
+        /// If the document ID can't be found, returns null
+        /// </summary>
+        private VersionedLink? GetDocumentLink(Guid documentId)
+        {
+            return ReplicaRead(() => FindDocumentLink(documentId, out _), "index");
+        }
+
+        private VersionedLink? FindDocumentLink(Guid documentId, out DocumentStat? stat)
+        {
+            stat = null;
+            var indexTopPageId = IndexChainTop(documentId);
+
+            var walk = StartWalk(indexTopPageId);
+            var currentPage = NextIndexPage(indexTopPageId, walk);
+            while (currentPage != null)
+            {
+                var indexSnap = new IndexPage();
+                indexSnap.Defrost(currentPage.BodyStream());
+
+                var found = indexSnap.Search(documentId, out var link);
+                if (found && link != null && link.TryGetLink(0, out _))
+                {
+                    stat = indexSnap.GetMetadata(documentId);
+                    return link;
+                }
+
+                currentPage = NextIndexPage(currentPage.PrevPageId, walk);
+            }
+            return null;
+        }
+
+        /// <summary>
+        /// Read the length, flags and modified date stored in the index for a document, without opening its page chain.
+        /// Returns null if the document is not bound, or was bound before the index held this information.
+        /// </summary>
+        public DocumentStat? GetIndexStat(Guid documentId)
+        {
+            return ReplicaRead(() => FindIndexStat(documentId), "index");
+        }
+
+        private DocumentStat? FindIndexStat(Guid documentId)
+        {
+            var indexTopPageId = IndexChainTop(documentId);
+            if (indexTopPageId < 0) return null;
+
+            var walk = StartWalk(indexTopPageId);
+            var currentPage = NextIndexPage(indexTopPageId, walk);
+            while (currentPage != null)
+            {
+                var indexSnap = new IndexPage();
+                indexSnap.Defrost(currentPage.BodyStream());
+
+                if (indexSnap.Search(documentId, out var link) && link != null)
+                {
+                    if (!link.TryGetLink(0, out _)) return null; // removed
+                    return indexSnap.GetMetadata(documentId);
+                }
+
+                currentPage = NextIndexPage(currentPage.PrevPageId, walk);
+            }
+            return null;
+        }
+
+        /// <summary>
+        /// Count the pages used by the current and previous revision of every document in the index.
+        /// This walks every document chain, so reads a lot of storage on large databases.
+        /// </summary>
+        [NotNull]public VersionReport VersionStatistics()
+        {
+            return ReplicaRead(() => {
+                var report = new VersionReport();
+                foreach (var indexTopPageId in IndexChainTops())
+                {
+                    var walk = StartWalk(indexTopPageId);
+                    var currentPage = NextIndexPage(indexTopPageId, walk);
+                    while (currentPage != null)
+                    {
+                        var indexSnap = new IndexPage();
+                        indexSnap.Defrost(currentPage.BodyStream());
+                        foreach (var entry in indexSnap.Entries())
+                        {
+                            if (!entry.Value.TryGetLink(0, out var newest)) continue; // removed
+                            entry.Value.TryGetLink(1, out var previous);
+                            var live = ChainPages(newest);
+                            if (entry.Key == ReservedDocIds.Counters) live.UnionWith(ChainPages(previous)); // both versions are in use, see `LoadCounters`
+                            report.Documents.Add(new DocumentVersionStat {
+                                DocumentId = entry.Key,
+                                LivePages = live.Count,
+                                RetainedPages = ChainPages(previous).Count(id => !live.Contains(id)) // record logs grow in place, so share pages
+                            });
+                        }
+                        currentPage = NextIndexPage(currentPage.PrevPageId, walk);
+                    }
+                }
+                return report;
+            }, "index");
+        }
+
+        [NotNull]private HashSet<int> ChainPages(int endPageId)
+        {
+            var result = new HashSet<int>();
+            var walk = StartWalk(endPageId);
+            var current = GetRawPage(endPageId, ignoreCrc: true);
+            while (current != null)
+            {
+                walk.Visit(current.PageId);
+                result.Add(current.PageId);
+                current = GetRawPage(current.PrevPageId, ignoreCrc: true);
+            }
+            return result;
+        }
+
+        /// <summary>
+        /// Bind an exact path to a document ID.
+        /// If an existing document was bound to the same path, its ID will be returned
+        /// </summary>
+        /// <param name="path">Exact path for document</param>
+        /// <param name="documentId">new document id</param>
+        /// <param name="previousDocId">old document id that has been replaced, if any.</param>
+        /// <param name="annotation">optional note to store with the binding</param>
+        /// <param name="attributes">attribute bits to store with the binding</param>
+        public void BindPath(string path, Guid documentId, out Guid? previousDocId, string? annotation = null, BindingAttributes attributes = BindingAttributes.None)
+        {
+            previousDocId = null;
+            if (string.IsNullOrEmpty(path)) throw new Exception("Path must not be null or empty");
+            SetPathLookupCache(null);
+
+            using (var span = _trace.StartSpan("StreamDb.BindPath"))
+            lock (_fslock)
+            {
+                span.SetAttribute("path", path);
+                // Read current path document (if it exists)
+                var pathLink = GetPathLookupLink();
+                var pathIndex = pathLink.TryGetLink(0, out var pathPageId) ? LoadPathLookup(pathPageId) : new ReverseTrie<PathBinding>();
+
+                // Bind the path
+                var binding = new PathBinding { Value = documentId, Annotation = annotation, Attributes = attributes };
+                if (_recordBindingTimes || annotation != null) binding.BoundAt = DateTime.UtcNow;
+                var previous = pathIndex.Add(path, binding);
+                if (previous != null) previousDocId = previous.Value;
+
+                // Write back to new chain
+                var frozen = pathIndex.Freeze();
+                span.SetAttribute("bytes", frozen.Length);
+                var newPageId = WriteStream(frozen);
+
+                // Update version link
+                pathLink.WriteNewLink(newPageId, out var expired);
+                SetPathLookupLink(pathLink);
+
+                ReleaseChain(expired);
+                Sync(_syncPaths, commit: true);
+            }
+        }
+
+        /// <summary>
+        /// Read the path lookup, and return the DocumentID stored at the exact path.
+        /// Returns null if there is not document stored.
+        /// </summary>
+        public Guid? GetDocumentIdByPath(string exactPath)
+        {
+            var pathIndex = GetPathLookupIndex();
+
+            var found = pathIndex.Get(exactPath);
+            if (found == null) return null;
+            return found.Value;
+        }
+
+        /// <summary>
+        /// Return all paths currently bound for the given document ID.
+        /// If no paths are bound, an empty enumeration is given.
+        /// </summary>
+        /// <summary>
+        /// Get the document ID and metadata for a bound path. Returns null if the path is not bound.
+        /// </summary>
+        public BindingInfo? GetBindingInfo(string exactPath)
+        {
+            var found = GetPathLookupIndex().Get(exactPath);
+            if (found == null) return null;
+            return new BindingInfo { Path = exactPath, DocumentId = found.Value, BoundAt = found.BoundAt, Annotation = found.Annotation, Attributes = found.Attributes };
+        }
+
+        [NotNull]public IEnumerable<string> GetPathsForDocument(Guid documentId)
+        {
+            var pathIndex = GetPathLookupIndex();
+
+            return pathIndex.GetPathsForEntry(documentId);
+        }
+
+        /// <summary>
+        /// Return all paths currently bound that start with the given prefix.
+        /// The prefix should not be null or empty.
+        /// If no paths are bound, an empty enumeration is given.
+        /// </summary>
+        [NotNull]public IEnumerable<string> SearchPaths(string pathPrefix)
+        {
+            var pathIndex = GetPathLookupIndex();
+
+            return pathIndex.Search(pathPrefix);
+        }
+
+        /// <summary>
+        /// Return all paths currently bound that end with the given suffix.
+        /// The suffix must not be null or empty.
+        /// </summary>
+        [NotNull]public IEnumerable<string> SearchPathSuffix(string pathSuffix)
+        {
+            var pathIndex = GetPathLookupIndex();
+
+            return pathIndex.SearchSuffix(pathSuffix);
+        }
+
+        /// <summary>
+        /// Move every path that starts with `oldPrefix` to start with `newPrefix` instead,
+        /// as a single change to the path lookup. Returns the number of paths moved.
+        /// Any document bound to a target path before the move is returned in `replacedDocIds`.
+        /// </summary>
+        public int RenamePrefix(string oldPrefix, string newPrefix, out Guid[] replacedDocIds)
+        {
+            replacedDocIds = new Guid[0];
+            if (oldPrefix == null || newPrefix == null) throw new Exception("Prefixes must not be null");
+            if (oldPrefix == newPrefix) return 0;
+            SetPathLookupCache(null);
+
+            using (var span = _trace.StartSpan("StreamDb.RenamePrefix"))
+            lock (_fslock)
+            {
+                var pathLink = GetPathLookupLink();
+                if (!pathLink.TryGetLink(0, out var pathPageId)) return 0;
+                var pathIndex = LoadPathLookup(pathPageId);
+
+                var moves = new List<KeyValuePair<string, PathBinding>>();
+                foreach (var path in pathIndex.Search(oldPrefix).ToList())
+                {
+                    var value = pathIndex.Get(path);
+                    if (value != null) moves.Add(new KeyValuePair<string, PathBinding>(path, value));
+                }
+                span.SetAttribute("paths", moves.Count);
+                if (moves.Count < 1) return 0;
+
+                // Remove all sources before adding targets, so overlapping prefixes (e.g. "a/" -> "a/b/") don't collide
+                foreach (var move in moves) { pathIndex.Delete(move.Key); }
+
+                var replaced = new List<Guid>();
+                foreach (var move in moves)
+                {
+                    var previous = pathIndex.Add(newPrefix + move.Key.Substring(oldPrefix.Length), move.Value);
+                    if (previous != null) replaced.Add(previous.Value);
+                }
+                replacedDocIds = replaced.Distinct().ToArray();
+
+                // Write back to new chain
+                var newPageId = WriteStream(pathIndex.Freeze());
+
+                // Update version link
+                pathLink.WriteNewLink(newPageId, out var expired);
+                SetPathLookupLink(pathLink);
+
+                ReleaseChain(expired);
+                Sync(_syncPaths, commit: true);
+                return moves.Count;
+            }
+        }
+
+        /// <summary>
+        /// Bind and unbind a set of paths, in order, as a single change to the path lookup,
+        /// so readers see either none or all of the changes. A change with an empty `DocumentId` unbinds its path.
+        /// Returns the document bound to each path before its change (`Guid.Empty` if none), in the same order as the changes.
+        /// </summary>
+        [NotNull]public Guid[] ApplyPathChanges(IList<BindingInfo> changes)
+        {
+            if (changes == null) throw new Exception("Changes must not be null");
+            var previousDocIds = new Guid[changes.Count];
+            if (changes.Count < 1) return previousDocIds;
+            SetPathLookupCache(null);
+
+            using (var span = _trace.StartSpan("StreamDb.ApplyPathChanges"))
+            lock (_fslock)
+            {
+                span.SetAttribute("paths", changes.Count);
+                var pathLink = GetPathLookupLink();
+                var pathIndex = pathLink.TryGetLink(0, out var pathPageId) ? LoadPathLookup(pathPageId) : new ReverseTrie<PathBinding>();
+
+                for (int i = 0; i < changes.Count; i++)
+                {
+                    var change = changes[i];
+                    if (string.IsNullOrEmpty(change.Path)) throw new Exception("Path must not be null or empty");
+
+                    if (change.DocumentId == Guid.Empty)
+                    {
+                        previousDocIds[i] = pathIndex.Get(change.Path)?.Value ?? Guid.Empty;
+                        pathIndex.Delete(change.Path);
+                        continue;
+                    }
+
+                    var binding = new PathBinding { Value = change.DocumentId, Annotation = change.Annotation, Attributes = change.Attributes };
+                    if (_recordBindingTimes || change.Annotation != null) binding.BoundAt = DateTime.UtcNow;
+                    previousDocIds[i] = pathIndex.Add(change.Path, binding)?.Value ?? Guid.Empty;
+                }
+
+                // Write back to new chain
+                var newPageId = WriteStream(pathIndex.Freeze());
+
+                // Update version link
+                pathLink.WriteNewLink(newPageId, out var expired);
+                SetPathLookupLink(pathLink);
+
+                ReleaseChain(expired);
+                Sync(_syncPaths, commit: true);
+            }
+            return previousDocIds;
+        }
+
+        /// <summary>
+        /// Remove a path binding if it exists. If the path is not bound, nothing happens.
+        /// Linked documents are not removed.
+        /// </summary>
+        public void UnbindPath(string exactPath)
+        {
+            SetPathLookupCache(null);
+            lock (_fslock)
+            {
+                var pathLink = GetPathLookupLink();
+                if (!pathLink.TryGetLink(0, out var pathPageId)) return;
+                var pathIndex = LoadPathLookup(pathPageId);
+
+                // Unbind the path
+                pathIndex.Delete(exactPath);
+
+                // Write back to new chain
+                var newPageId = WriteStream(pathIndex.Freeze());
+
+                // Update version link
+                pathLink.WriteNewLink(newPageId, out var expired);
+                SetPathLookupLink(pathLink);
+
+                ReleaseChain(expired);
+                Sync(_syncPaths, commit: true);
+            }
+        }
+
+
+
+
+
+
+
+        /// <summary>
+        /// Replace the cached path lookup, releasing the memory held by the old one
+        /// </summary>
+        private void SetPathLookupCache(CachedPathLookup? value)
+        {
+            var old = Interlocked.Exchange(ref _pathLookupCache, value);
+            if (old != null && old != value) _memory.Release(old.Bytes);
+        }
+
+        private bool EvictPathLookupCache()
+        {
+            if (_pathLookupCache == null) return false;
+            SetPathLookupCache(null);
+            _log.Debug("Dropped path lookup cache to stay in memory budget");
+            return true;
+        }
+
+        [NotNull]private ReverseTrie<PathBinding> GetPathLookupIndex()
+        {
+            using (var span = _trace.StartSpan("StreamDb.PathLookup"))
+            {
+                var cached = _pathLookupCache;
+                if (cached != null && _pathCacheMode == PathCacheConsistency.Validated)
+                {
+                    // check the header link hasn't moved since we loaded
+                    GetPathLookupLink().TryGetLink(0, out var currentPageId);
+                    if (currentPageId != cached.PageId) cached = null;
+                }
+                span.SetAttribute("cacheHit", cached != null);
+                if (cached != null) return cached.Trie;
+
+                return ReplicaRead(() => {
+                    lock (_fslock)
+                    {
+                        var pathLink = GetPathLookupLink();
+                        long bytes = 0;
+                        var pathIndex = pathLink.TryGetLink(0, out var pathPageId) ? LoadPathLookup(pathPageId, out bytes) : new ReverseTrie<PathBinding>();
+
+                        // Only keep the lookup if the memory budget allows. Otherwise it will be read again on the next lookup.
+                        if (_memory.TryReserve(bytes)) SetPathLookupCache(new CachedPathLookup(pathIndex, pathPageId, bytes));
+                        else SetPathLookupCache(null);
+                        span.SetAttribute("cached", _pathLookupCache != null);
+                        return pathIndex;
+                    }
+                }, "path lookup");
+            }
+        }
+
+        /// <summary>
+        /// Read the path lookup from its page chain.
+        /// Any failure (I/O, CRC, bad chain, or bad trie data) is thrown as a `PathLookupException`
+        /// </summary>
+        [NotNull]private ReverseTrie<PathBinding> LoadPathLookup(int pathPageId) => LoadPathLookup(pathPageId, out _);
+
+        /// <summary>
+        /// Read the path lookup from its page chain, giving the stored size of the lookup
+        /// </summary>
+        [NotNull]private ReverseTrie<PathBinding> LoadPathLookup(int pathPageId, out long bytes)
+        {
+            var pathIndex = new ReverseTrie<PathBinding>();
+            try
+            {
+                using (var stream = GetStream(pathPageId, sampleCrc: false))
+                {
+                    bytes = stream.Length;
+                    pathIndex.Defrost(stream);
+                }
+            }
+            catch (Exception ex)
+            {
+                throw new PathLookupException(pathPageId, $"Failed to load the path lookup from page {pathPageId}: {ex.Message}", ex);
+            }
+            return pathIndex;
+        }
+
+        /// <summary>
+        /// Write a stream to a known set of page IDs
+        /// </summary>
+        private int WriteStreamInternal([NotNull]Stream dataStream, int pagesRequired, [NotNull]int[] pages)
+        {
+            var prev = -1;
+            for (int i = 0; i < pagesRequired; i++)
+            {
+                // start from a blank page, so nothing is kept from a released page being reused
+                var page = new BasicPage(pages[i]) { PrevPageId = prev };
+                page.Write(dataStream, 0, BasicPage.PageDataCapacity);
+
+                CommitPage(page);
+                prev = page.PageId;
+            }
+
+            return prev;
+        }
+
+        /// <summary>
+        /// Write a stream to a known set of page IDs, splitting it into extents that are built and committed by a pool of workers.
+        /// The input is read in order on the calling thread. At most `_writeWorkers` extents are held in memory at once.
+        /// </summary>
+        /// <remarks>
+        /// Because all page IDs are known before writing starts, each page's back-link can be set
+        /// without waiting for the previous extent, so extents don't need linking afterwards.
+        /// <para></para>
+        /// On failure, the caller releases all of `pages` (see `ReleasePageBlock`), so no worker may still be writing when this throws.
+        /// </remarks>
+        private int WriteStreamExtents([NotNull]Stream dataStream, int pagesRequired, [NotNull]int[] pages)
+        {
+            var slots = new SemaphoreSlim(_writeWorkers);
+            var workers = new List<Task>();
+
+            try
+            {
+                for (int first = 0; first < pagesRequired; first += _extentPages)
+                {
+                    var pageCount = Math.Min(_extentPages, pagesRequired - first);
+                    var buffer = new byte[pageCount * BasicPage.PageDataCapacity];
+                    var length = ReadFully(dataStream, buffer);
+                    var firstPage = first;
+
+                    slots.Wait();
+                    workers.Add(Task.Run(() => {
+                        try { WriteExtent(buffer, 0, length, pages, firstPage, pageCount); }
+                        finally { slots.Release(); }
+                    }));
+                }
+            }
+            catch
+            {
+                // the source failed: let extents already handed out finish, so their pages can be released safely
+                try { Task.WaitAll(workers.ToArray()); }
+                catch (AggregateException ex) { _log.Debug("Extent writes also failed", "count", ex.InnerExceptions.Count); }
+                throw;
+            }
+
+            WaitForExtents(workers);
+            return pages[pagesRequired - 1];
+        }
+
+        /// <summary>
+        /// Write data that is already in memory to a known set of page IDs. Pages are filled straight from the buffer;
+        /// with write workers, each worker takes its own extent of the buffer, so nothing is copied ahead of the pages.
+        /// </summary>
+        private int WriteBuffer([NotNull]byte[] buffer, int offset, int length, [NotNull]int[] pages)
+        {
+            if (pages.Length < 1) return -1;
+            if (_writeWorkers < 2 || pages.Length <= _extentPages)
+            {
+                WriteExtent(buffer, offset, length, pages, 0, pages.Length);
+                return pages[pages.Length - 1];
+            }
+
+            var workers = new List<Task>();
+            var slots = new SemaphoreSlim(_writeWorkers);
+            for (int first = 0; first < pages.Length; first += _extentPages)
+            {
+                var pageCount = Math.Min(_extentPages, pages.Length - first);
+                var extentOffset = first * BasicPage.PageDataCapacity;
+                var firstPage = first;
+
+                slots.Wait();
+                workers.Add(Task.Run(() => {
+                    try { WriteExtent(buffer, offset + extentOffset, length - extentOffset, pages, firstPage, pageCount); }
+                    finally { slots.Release(); }
+                }));
+            }
+
+            WaitForExtents(workers);
+            return pages[pages.Length - 1];
+        }
+
+        private static void WaitForExtents([NotNull, ItemNotNull]List<Task> workers)
+        {
+            try
+            {
+                Task.WaitAll(workers.ToArray());
+            }
+            catch (AggregateException ex)
+            {
+                // keep every failure, not just the first
+                throw new Exception("Failed to write document extents", ex.InnerExceptions.Count == 1 ? ex.InnerException : ex.Flatten());
+            }
+        }
+
+        /// <summary>
+        /// Write `pageCount` pages from `firstPage`, taking data from `buffer` at `offset`. `length` is the data available from `offset`.
+        /// </summary>
+        private void WriteExtent([NotNull]byte[] buffer, int offset, int length, [NotNull]int[] pages, int firstPage, int pageCount)
+        {
+            for (int i = 0; i < pageCount; i++)
+            {
+                var idx = firstPage + i;
+                var pageOffset = i * BasicPage.PageDataCapacity;
+                var page = new BasicPage(pages[idx]) { PrevPageId = idx > 0 ? pages[idx - 1] : -1 };
+                page.Write(buffer, offset + pageOffset, 0, Math.Max(0, Math.Min(BasicPage.PageDataCapacity, length - pageOffset)));
+                CommitPage(page);
+            }
+        }
+
+        /// <summary>
+        /// Bytes left to read in a stream, or -1 if the stream can't tell without being read
+        /// </summary>
+        private static long RemainingLength([NotNull]Stream dataStream)
+        {
+            if (dataStream.CanSeek) return dataStream.Length - dataStream.Position;
+            if (dataStream is KnownLengthStream known) return known.Length - known.Position;
+            return -1;
+        }
+
+        private static int ReadFully([NotNull]Stream input, [NotNull]byte[] buffer)
+        {
+            var total = 0;
+            while (total < buffer.Length)
+            {
+                var read = input.Read(buffer, total, buffer.Length - total);
+                if (read < 1) break;
+                total += read;
+            }
+            return total;
+        }
+
+        /// <summary>
+        /// Allocate pages to a block without checking the free page list
+        /// </summary>
+        private void DirectlyAllocatePages([NotNull]int[] block, int startIdx)
+        {
+            for (int i = startIdx; i < block.Length; i++)
+            {
+                var pageId = (int) ((1 + _fs.Length - HEADER_SIZE) / BasicPage.PageRawSize);
+                block[i] = pageId;
+                CommitPage(new BasicPage(block[i]));
+            }
+        }
+
+        /// <summary>
+        /// Recover pages from the free list. Returns the last index that couldn't be filled (array length if everything was filled)
+        /// </summary>
+        private int ReassignReleasedPages([NotNull]int[] block)
+        {
+            var hasList = GetFreeListLink().TryGetLink(0, out var topPageId);
+            if (!hasList) return 0;
+
+            var topPage = GetRawPage(topPageId);
+            if (topPage == null) return 0;
+            LoadCounters();
+
+            // Structure of free pages' data (see also `ReleaseSinglePage`)
+            // [Entry count: int32] -> n
+            // n * [PageId: int32]
+
+            // The plan:
+            // - walk back through the chain
+            // - if we hit an empty end page that is not the top page, use that as the free page, and tidy up the back link. Go up a page if possible
+            // - if we're on a non empty end page, use the entries and clear them
+            // - if we're on an empty top page, give up and return our position
+
+            var chain = FreeListChain(topPageId);
+            var linkStack = new Stack<int>(chain.Take(chain.Count - 1));
+            var bottomPageId = chain[chain.Count - 1];
+            var currentPage = bottomPageId == topPageId ? topPage : GetRawPage(bottomPageId) ?? throw new Exception("Free page chain is broken.");
+
+            int i;
+            for (i = 0; i < block.Length; i++) // each required page
+            {
+                // check if free list page is non-empty
+                var length = currentPage.ReadDataInt32(0);
+                if (length < 1) // page is empty
+                {
+                    if (currentPage.PageId == topPageId) return i; // ran out of free data
+
+                    block[i] = currentPage.PageId; // use this empty page
+                    currentPage = GetRawPage(linkStack.Pop()) ?? throw new Exception("Free page walk up lost");
+                    currentPage.PrevPageId = -1; // break link to the recovered page
+                    CommitPage(currentPage);
+                    AdjustCounters(0, -1);
+                    _freeIndex?.RemoveBottomListPage();
+                }
+                else // page has free links remaining
+                {
+                    block[i] = currentPage.ReadDataInt32(length); // copy id
+                    currentPage.WriteDataInt32(0, length - 1); // remove from stack
+                    CommitPage(currentPage); // save changes
+                    AdjustCounters(0, -1);
+                    _freeIndex?.RemoveEntry(block[i]);
+                    if (IsBadPage(block[i])) i--; // dropped from the free list, but never handed out
+                }
+            }
+
+            return i;
+        }
+
+        /// <summary>
+        /// Page IDs of the free list chain, from the top page down. This comes from the free page index if it is loaded,
+        /// otherwise the chain is walked.
+        /// </summary>
+        [NotNull]private List<int> FreeListChain(int topPageId)
+        {
+            if (_freeIndex != null && _freeIndex.ListPages.Count > 0 && _freeIndex.ListPages[0] == topPageId) return _freeIndex.ListPages.ToList();
+
+            var chain = new List<int>();
+            var walk = StartWalk(topPageId);
+            var currentPage = GetRawPage(topPageId) ?? throw new Exception("Free page chain is broken.");
+            while (true)
+            {
+                walk.Visit(currentPage.PageId);
+                chain.Add(currentPage.PageId);
+                if (currentPage.PrevPageId < 0) return chain;
+                currentPage = GetRawPage(currentPage.PrevPageId) ?? throw new Exception("Free page chain is broken.");
+            }
+        }
+
+        /// <summary>
+        /// IDs of every page in the free list, including the list's own pages. This walks the whole list.
+        /// </summary>
+        [NotNull]private HashSet<int> FreePageIds()
+        {
+            // Structure of free pages' data: see `ReleaseSinglePage`
+            var result = new HashSet<int>();
+            if (!GetFreeListLink().TryGetLink(0, out var topPageId)) return result;
+            foreach (var listPageId in FreeListChain(topPageId))
+            {
+                var page = GetRawPage(listPageId) ?? throw new Exception($"Lost free list page (id = {listPageId})");
+                result.Add(listPageId);
+                var length = page.ReadDataInt32(0);
+                for (int i = 1; i <= length && i <= BasicPage.MaxInt32Index; i++) { result.Add(page.ReadDataInt32(i)); }
+            }
+            return result;
+        }
+
+        /// <summary>
+        /// Read the whole free list into memory, if `DatabaseOptions.CacheFreeList` is set. Does nothing if it is already loaded.
+        /// </summary>
+        private void LoadFreeIndex()
+        {
+            if (!_cacheFreeList || _freeIndex != null) return;
+
+            // Structure of free pages' data: see `ReleaseSinglePage`
+            var index = new FreePageIndex();
+            if (GetFreeListLink().TryGetLink(0, out var topPageId))
+            {
+                foreach (var listPageId in FreeListChain(topPageId))
+                {
+                    var page = GetRawPage(listPageId) ?? throw new Exception($"Lost free list page (id = {listPageId})");
+                    index.AddListPage(listPageId);
+                    var length = page.ReadDataInt32(0);
+                    for (int i = 1; i <= length && i <= BasicPage.MaxInt32Index; i++)
+                    {
+                        index.AddEntry(listPageId, page.ReadDataInt32(i));
+                    }
+                }
+            }
+            _freeIndex = index;
+            _log.Debug("Loaded free page index", "listPages", index.ListPages.Count, "entries", index.EntryCount);
+        }
+
+        /// <summary>
+        /// Add a single page to release chain.
+        /// This will create free list pages as required
+        /// </summary>
+        private void ReleaseSinglePage(int pageToReleaseId)
+        {
+            // Note: if we need to extend the free list, we should use the last page in the current list.
+            // So, we can't assume pages are full based on prevPageId value.
+            lock (_fslock)
+            {
+                if (IsBadPage(pageToReleaseId)) return;
+                if ((IsDeferringFree || _releaseHolds > 0) && !_releasingDeferred)
+                {
+                    _deferredPages.Enqueue(new DeferredPage(pageToReleaseId, _commitCount, DateTime.UtcNow));
+                    _deferredDirty = true;
+                    return;
+                }
+                LoadCounters();
+                var freeLink = GetFreeListLink();
+                var hasList = freeLink.TryGetLink(0, out var topPageId);
+                if (!hasList) {
+                    // need to create a new page and set it up
+                    var slot = new int[1];
+                    DirectlyAllocatePages(slot, 0);
+                    freeLink.WriteNewLink(slot[0], out _);
+                    topPageId = slot[0];
+                    SetFreeListLink(freeLink);
+                    Sync(_syncFreeList);
+                    _freeIndex?.AddListPage(topPageId);
+                }
+
+                // Structure of free pages' data (see also `ReassignReleasedPages`)
+                // [Entry count: int32] -> n
+                // n * [PageId: int32]
+
+                // With the free page index, start at the first list page with space, rather than walking down to it
+                var startPageId = _freeIndex?.FirstPageWithSpace(BasicPage.MaxInt32Index) ?? topPageId;
+                if (startPageId < 0) startPageId = topPageId;
+
+                var walk = StartWalk(startPageId);
+                var currentPage = GetRawPage(startPageId) ?? throw new Exception($"Lost free list page (id = {startPageId})");
+                while (currentPage != null)
+                {
+                    walk.Visit(currentPage.PageId);
+                    // check if there's space on this page
+                    var length = currentPage.ReadDataInt32(0);
+
+                    if (length < BasicPage.MaxInt32Index) // Space remains. Write value and exit
+                    {
+                        length++;
+                        currentPage.WriteDataInt32(length, pageToReleaseId);
+                        currentPage.WriteDataInt32(0, length);
+                        CommitPage(currentPage);
+                        AdjustCounters(0, 1);
+                        _freeIndex?.AddEntry(currentPage.PageId, pageToReleaseId);
+                        return;
+                    }
+
+                    // walk page chain
+                    if (currentPage.PrevPageId >= 0) {
+                        currentPage = GetRawPage(currentPage.PrevPageId);
+                    } else {
+                        // use the new free page to extend the list.
+                        var newFreePage = GetRawPage(pageToReleaseId) ?? throw new Exception($"Failed to read released page {pageToReleaseId}");
+                        newFreePage.ZeroAllData();
+                        newFreePage.PrevPageId = -1;
+                        CommitPage(newFreePage);
+                        currentPage.PrevPageId = newFreePage.PageId;
+                        CommitPage(currentPage);
+                        AdjustCounters(0, 1); // an empty list page is handed out like a listed one
+                        _freeIndex?.AddListPage(newFreePage.PageId);
+                        return;
+                    }
+                }
+
+                throw new Exception("Page extension failed");
+            }
+        }
+
+        /// <summary>
+        /// True if released pages wait out a grace period before they can be reused
+        /// </summary>
+        private bool IsDeferringFree => _deferFreeCommits > 0 || _deferFreePeriod > TimeSpan.Zero;
+
+        /// <summary>
+        /// Number of released pages still waiting out their grace period. These are not counted as free pages.
+        /// See `DatabaseOptions.DeferFreeCommits`
+        /// </summary>
+        public int DeferredPageCount { get { lock (_fslock) { return _deferredPages.Count; } } }
+
+        /// <summary>
+        /// Add every released page to the free list now, whether or not its grace period has passed.
+        /// This should be called before the connection is closed. Pages still waiting are recorded in storage,
+        /// but are not reused until the next connection opens it.
+        /// </summary>
+        public void ReleaseDeferredPages()
+        {
+            lock (_fslock)
+            {
+                if (_deferredPages.Count < 1) return;
+                ReleaseDeferred(force: true);
+                Sync(_syncFreeList);
+            }
+        }
+
+        /// <summary>
+        /// Keep released pages off the free list until the returned handle is disposed, so replaced and deleted chains
+        /// can still be read. Pages released in the meantime wait with the deferred pages (see `DeferredPageCount`).
+        /// Holds can overlap; pages are released once the last one ends.
+        /// </summary>
+        [NotNull]public IDisposable HoldReleasedPages()
+        {
+            if (_readReplica) throw new InvalidOperationException("A read replica can't hold pages released by the writer");
+            lock (_fslock) { _releaseHolds++; }
+            return new ReleaseHold(this);
+        }
+
+        private void EndReleaseHold()
+        {
+            lock (_fslock)
+            {
+                if (_releaseHolds < 1) return;
+                _releaseHolds--;
+                if (_releaseHolds > 0 || _deferredPages.Count < 1) return;
+                ReleaseDeferred(force: !IsDeferringFree); // pages held only by us can go now; others wait out their grace period
+                Sync(_syncFreeList);
+            }
+        }
+
+        /// <summary>
+        /// Handle from `HoldReleasedPages`
+        /// </summary>
+        private class ReleaseHold : IDisposable
+        {
+            [NotNull] private readonly PageStorage _owner;
+            private bool _ended;
+            public ReleaseHold([NotNull]PageStorage owner) { _owner = owner; }
+
+            public void Dispose()
+            {
+                if (_ended) return;
+                _ended = true;
+                _owner.EndReleaseHold();
+            }
+        }
+
+        /// <summary>
+        /// Run a set of reads with no storage changes in between
+        /// </summary>
+        public T ReadExclusive<T>([NotNull]Func<T> read)
+        {
+            lock (_fslock) { return read(); }
+        }
+
+        /// <summary>
+        /// Move released pages whose grace period has passed (or all of them, if forced) onto the free list
+        /// </summary>
+        private void ReleaseDeferred(bool force)
+        {
+            if (_releasingDeferred || _releaseHolds > 0 || _deferredPages.Count < 1) return;
+            _releasingDeferred = true;
+            try
+            {
+                var now = DateTime.UtcNow;
+                var released = 0;
+                while (_deferredPages.Count > 0)
+                {
+                    var next = _deferredPages.Peek();
+                    var due = force || (_commitCount - next.ReleasedAtCommit >= _deferFreeCommits && now - next.ReleasedAt >= _deferFreePeriod);
+                    if (!due) break;
+
+                    ReleaseSinglePage(next.PageId);
+                    _deferredPages.Dequeue();
+                    _deferredDirty = true;
+                    released++;
+                }
+                if (released > 0) _log.Debug("Released deferred pages", "count", released, "waiting", _deferredPages.Count);
+            }
+            finally
+            {
+                _releasingDeferred = false;
+            }
+        }
+
+        /// <summary>
+        /// Store the IDs of pages waiting to be released under `ReservedDocIds.DeferredPages`, so they are not lost if the connection
+        /// ends without `ReleaseDeferredPages`. `RecoverDeferredPages` adds them to the free list when storage is next opened.
+        /// </summary>
+        private void SaveDeferred()
+        {
+            if (!_deferredDirty || _savingDeferred || _readReplica || !_fs.CanWrite) return;
+            _savingDeferred = true;
+            var wasReleasing = _releasingDeferred;
+            try
+            {
+                _deferredDirty = false;
+                var expired = new List<int>();
+                if (_deferredPages.Count < 1)
+                {
+                    // Nothing waiting: remove the list rather than keep an empty one
+                    var link = FindDocumentLink(ReservedDocIds.DeferredPages, out _);
+                    if (link == null) return;
+                    if (link.TryGetLink(0, out var newest)) expired.Add(newest);
+                    if (link.TryGetLink(1, out var previous)) expired.Add(previous);
+                    UnbindIndex(ReservedDocIds.DeferredPages);
+                }
+                else
+                {
+                    // Structure of the deferred list: [Count: int32] then Count * [PageId: int32]
+                    var ms = new MemoryStream();
+                    var w = new BinaryWriter(ms);
+                    w.Write(_deferredPages.Count);
+                    foreach (var deferred in _deferredPages) { w.Write(deferred.PageId); }
+                    ms.Seek(0, SeekOrigin.Begin);
+
+                    BindIndex(ReservedDocIds.DeferredPages, WriteStream(ms), out var old);
+                    expired.Add(old);
+                }
+
+                // Old lists are only read when opening storage, so they don't need to wait out a grace period
+                _releasingDeferred = true;
+                foreach (var chain in expired) { ReleaseChain(chain); }
+            }
+            finally
+            {
+                _releasingDeferred = wasReleasing;
+                _savingDeferred = false;
+            }
+        }
+
+        /// <summary>
+        /// Read the stored list of pages waiting to be released. See `SaveDeferred`
+        /// </summary>
+        [NotNull]private List<int> ReadDeferred()
+        {
+            var result = new List<int>();
+            var head = FindDocumentHead(ReservedDocIds.DeferredPages);
+            if (head < 0) return result;
+
+            var r = new BinaryReader(GetStream(head));
+            var count = r.ReadInt32();
+            for (int i = 0; i < count; i++) { result.Add(r.ReadInt32()); }
+            return result;
+        }
+
+        /// <summary>
+        /// Push writes to storage, as hard as the given mode asks.
+        /// </summary>
+        /// <param name="mode">How hard to push</param>
+        /// <param name="commit">True if this follows a change readers switch over to (an index or path lookup update).
+        /// Commits are counted for `DatabaseOptions.DeferFreeCommits`</param>
+        private void Sync(SyncMode mode, bool commit = false)
+        {
+            lock (_fslock)
+            {
+                if (commit && !_savingDeferred) _commitCount++; // readers never switch over to the deferred list
+                ReleaseDeferred(force: false);
+                SaveDeferred(); // before anything else can reuse the pages just released
+                SaveCounters();
+                if (_walPending.Count > 0)
+                {
+                    WriteLoggedPages(); // this flushes storage through to disk
+                    return;
+                }
+                if (mode == SyncMode.None) return;
+                _retry.Run(() => {
+                    if (mode == SyncMode.Durable && _fs is FileStream file) file.Flush(flushToDisk: true);
+                    else _fs.Flush();
+                }, _log, "flush");
+            }
+        }
+
+        [NotNull]private VersionedLink GetIndexPageLink() { return GetLink(0); }
+
+        /// <summary>
+        /// Top page of the index chain that holds, or would hold, a document ID. Returns -1 if that chain is empty.
+        /// For a flat index this is the whole index; for a sharded index it is the document's shard.
+        /// </summary>
+        private int IndexChainTop(Guid documentId)
+        {
+            var root = CurrentIndexRoot(out var topPageId);
+            if (topPageId < 0) return -1;
+            return root == null ? topPageId : root.ShardTops[IndexRoot.ShardOf(documentId)];
+        }
+
+        /// <summary>
+        /// Top pages of every index chain, for walks over the entire index
+        /// </summary>
+        [NotNull]private int[] IndexChainTops()
+        {
+            var root = CurrentIndexRoot(out var topPageId);
+            if (topPageId < 0) return new int[0];
+            return root == null ? new[] { topPageId } : root.ShardTops.Where(top => top >= 0).ToArray();
+        }
+
+        /// <summary>
+        /// Root of the current index, or null if the index is flat. `topPageId` is the page the header link points to,
+        /// or -1 if there is no index yet.
+        /// The answer is cached until the header link changes, so lookups don't read and check the top page each time.
+        /// Read replicas don't cache it.
+        /// The returned root is shared, and must not be changed.
+        /// </summary>
+        private IndexRoot? CurrentIndexRoot(out int topPageId)
+        {
+            var generation = Volatile.Read(ref _indexRootGeneration);
+            var link = GetIndexPageLink();
+            var linkBytes = new byte[VersionedLink.ByteSize];
+            link.Freeze().Read(linkBytes, 0, linkBytes.Length);
+
+            var cached = _indexRootCache;
+            if (cached != null && cached.Link.SequenceEqual(linkBytes))
+            {
+                topPageId = cached.TopPageId;
+                return cached.Root;
+            }
+
+            if (!link.TryGetLink(0, out topPageId)) return null;
+            var root = ReadIndexRoot(topPageId);
+            if (_readReplica) return root; // another process may relocate the root without moving the link
+            lock (_indexRootLock)
+            {
+                if (generation == _indexRootGeneration) _indexRootCache = new CachedIndexRoot(linkBytes, topPageId, root);
+            }
+            return root;
+        }
+
+        /// <summary>
+        /// Forget the cached index root, after the header link has moved or the root page has been rewritten
+        /// </summary>
+        private void DropIndexRootCache()
+        {
+            lock (_indexRootLock)
+            {
+                _indexRootGeneration++;
+                _indexRootCache = null;
+            }
+        }
+
+        /// <summary>
+        /// Read the root page of a sharded index. Returns null if the page is a plain index page.
+        /// </summary>
+        private IndexRoot? ReadIndexRoot(int pageId)
+        {
+            var page = GetRawPage(pageId, ignoreCrc: true);
+            if (page == null || !IndexRoot.IsRoot(page)) return null;
+            if (!page.ValidateCrc()) throw new Exception($"Reading index root page {pageId} failed CRC check");
+
+            var root = new IndexRoot();
+            root.Defrost(page.BodyStream());
+            return root;
+        }
+
+        /// <summary>
+        /// Point the index chain for a document ID at a new top page, after the chain has been extended.
+        /// A sharded index writes a new root page, so the header link flip stays atomic.
+        /// </summary>
+        private void SetIndexChainTop(Guid documentId, int newTopPageId)
+        {
+            var indexLink = GetIndexPageLink();
+            var root = indexLink.TryGetLink(0, out var topPageId) ? ReadIndexRoot(topPageId) : null;
+            if (root == null)
+            {
+                indexLink.WriteNewLink(newTopPageId, out _); // Index is always extended, we never clean it up
+                SetIndexPageLink(indexLink);
+                return;
+            }
+
+            root.ShardTops[IndexRoot.ShardOf(documentId)] = newTopPageId;
+            WriteIndexRoot(root, indexLink);
+        }
+
+        /// <summary>
+        /// Write an index root to a new page, and flip the header link to it.
+        /// The root from two versions ago is released.
+        /// </summary>
+        private void WriteIndexRoot([NotNull]IndexRoot root, [NotNull]VersionedLink indexLink)
+        {
+            var slot = new int[1];
+            AllocatePageBlock(slot);
+            var page = new BasicPage(slot[0]);
+            var stream = root.Freeze();
+            page.Write(stream, 0, stream.Length);
+            CommitPage(page);
+
+            indexLink.WriteNewLink(page.PageId, out var expiredRoot);
+            SetIndexPageLink(indexLink);
+            if (expiredRoot >= 0) ReleaseSinglePage(expiredRoot);
+        }
+        private void SetIndexPageLink(VersionedLink value) { SetLink(0, value); }
+        
+        [NotNull]private VersionedLink GetPathLookupLink() { return GetLink(1); }
+        private void SetPathLookupLink(VersionedLink value)
+        {
+            SetLink(1, value);
+            SetPathLookupCache(null); // a reader may have cached the old lookup since the caller first dropped it
+        }
+
+        [NotNull]private VersionedLink GetFreeListLink() { return GetLink(2); }
+        private void SetFreeListLink(VersionedLink value) { SetLink(2, value); }
+
+        /// <summary>
+        /// Add the pages of an old chain version to `unshared`, from its end back to where it joins the live chain.
+        /// Returns false, adding nothing, if the chains share no pages: the old chain can then be released as a whole.
+        /// </summary>
+        private bool TryFindUnsharedPages(int oldEndPageId, int liveEndPageId, [NotNull]List<int> unshared)
+        {
+            var live = ChainPages(liveEndPageId);
+            var found = new List<int>();
+            var walk = StartWalk(oldEndPageId);
+            var current = GetRawPage(oldEndPageId, ignoreCrc: true);
+            while (current != null)
+            {
+                if (live.Contains(current.PageId))
+                {
+                    unshared.AddRange(found);
+                    return true;
+                }
+                walk.Visit(current.PageId);
+                found.Add(current.PageId);
+                current = GetRawPage(current.PrevPageId, ignoreCrc: true);
+            }
+            return false;
+        }
+
+        private bool ChainContains(int endPageId, int targetPageId)
+        {
+            var seen = new HashSet<int>();
+            var current = GetRawPage(endPageId, ignoreCrc: true);
+            while (current != null && seen.Add(current.PageId))
+            {
+                if (current.PageId == targetPageId) return true;
+                current = GetRawPage(current.PrevPageId, ignoreCrc: true);
+            }
+            return false;
+        }
+
+        [NotNull]private static HeaderLinkInfo DescribeLink([NotNull]VersionedLink link)
+        {
+            try
+            {
+                link.TryGetLink(0, out var newest);
+                link.TryGetLink(1, out var previous);
+                return new HeaderLinkInfo { IsValid = true, Newest = newest, Previous = previous };
+            }
+            catch
+            {
+                return new HeaderLinkInfo { IsValid = false };
+            }
+        }
+
+        [NotNull, ItemNotNull]private static readonly string[] LinkNames = { "index", "path-lookup", "free-list" };
+
+        private void SetLink(int headOffset, VersionedLink value)
+        {
+            if (value == null) throw new Exception("Attempted to set invalid header link");
+            var strm = value.Freeze();
+            lock (_fslock)
+            {
+                _retry.Run(() => {
+                    strm.Seek(0, SeekOrigin.Begin);
+                    _fs.Seek(MAGIC_SIZE + (VersionedLink.ByteSize * headOffset), SeekOrigin.Begin);
+                    strm.CopyTo(_fs);
+                }, _log, "write header");
+            }
+            if (headOffset == 0) DropIndexRootCache();
+            value.TryGetLink(0, out var newest);
+            _log.Debug("Header link flipped", "link", LinkNames[headOffset], "pageId", newest);
+        }
+
+        [NotNull]private VersionedLink GetLink(int headOffset)
+        {
+            var result = new VersionedLink();
+            lock (_fslock)
+            {
+                _retry.Run(() => {
+                    _fs.Seek(MAGIC_SIZE + (VersionedLink.ByteSize * headOffset), SeekOrigin.Begin);
+                    result.Defrost(_fs);
+                }, _log, "read header");
+            }
+            return result;
+        }
+
+    }
 }
\ No newline at end of file
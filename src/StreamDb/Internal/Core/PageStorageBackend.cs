@@ -1,115 +1,651 @@
-﻿using System;
-using System.Collections.Generic;
-using System.IO;
-using JetBrains.Annotations;
-
-namespace StreamDb.Internal.Core
-{
-    /// <summary>
-    /// A db implementation that uses `PageStreamStorage` as the back-end
-    /// </summary>
-    internal class PageStorageBackend : IDatabaseBackend
-    {
-        [NotNull]private readonly PageStorage _core;
-
-        public PageStorageBackend(Stream fs) {
-            if (fs == null) throw new Exception("Storage stream must not be null");
-            _core = new PageStorage(fs);
-        }
-
-        /// <inheritdoc />
-        public Guid WriteDocument(Stream data)
-        {
-            var pageHead = _core.WriteStream(data);
-            var docId = Guid.NewGuid();
-            _core.BindIndex(docId, pageHead, out _);
-            return docId;
-        }
-
-        /// <inheritdoc />
-        public Guid BindPathToDocument(string path, Guid id)
-        {
-            _core.BindPath(path, id, out var prev);
-            return prev ?? Guid.Empty;
-        }
-
-        /// <inheritdoc />
-        public void DeleteDocument(Guid oldId) {
-            var all = _core.GetPathsForDocument(oldId);
-            foreach (var path in all)
-            {
-                _core.UnbindPath(path);
-            }
-            var pageId = _core.GetDocumentHead(oldId);
-            _core.UnbindIndex(oldId);
-            _core.ReleaseChain(pageId);
-        }
-
-        /// <inheritdoc />
-        public void DeleteSinglePathForDocument(Guid documentId, string path) {
-            _core.UnbindPath(path);
-        }
-
-        /// <inheritdoc />
-        public void RemoveFromIndex(Guid id) {
-            _core.UnbindIndex(id);
-        }
-
-        /// <inheritdoc />
-        public void DeletePathsForDocument(Guid id) {
-            var all = _core.GetPathsForDocument(id);
-            foreach (var path in all)
-            {
-                _core.UnbindPath(path);
-            }
-        }
-
-        /// <inheritdoc />
-        public Guid GetDocumentIdByPath(string path) { 
-            return _core.GetDocumentIdByPath(path) ?? Guid.Empty;
-        }
-
-        /// <inheritdoc />
-        public IEnumerable<string> SearchPaths(string pathPrefix) {
-            return _core.SearchPaths(pathPrefix);
-        }
-
-        /// <inheritdoc />
-        public IEnumerable<string> ListPathsForDocument(Guid documentId) { 
-            return _core.GetPathsForDocument(documentId);
-        }
-
-        /// <inheritdoc />
-        public Stream? ReadDocument(Guid id) {
-            try
-            {
-                var pageHead = _core.GetDocumentHead(id);
-                if (pageHead < 0) return null;
-                return _core.GetStream(pageHead);
-            }
-            catch (Exception ex)
-            {
-                throw new Exception("Data integrity check failed", ex);
-            }
-        }
-        
-        /// <inheritdoc />
-        public string GetInfo(Guid id) {
-            try
-            {
-                var pageHead = _core.GetDocumentHead(id);
-                if (pageHead < 0) return "Document not found";
-                var page = _core.GetRawPage(pageHead);
-                if (page == null) return "Failed to read document header";
-                return $"{page.DataLength} bytes; file index = {page.PageId}; CRC = {page.CrcHash:X};";
-            }
-            catch (Exception ex)
-            {
-                return "Data integrity check failed: " + ex.Message;
-            }
-        }
-
-        /// <inheritdoc />
-        public int CountFreePages() { return 0; }
-    }
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using System.Linq;
+using JetBrains.Annotations;
+using StreamDb.Internal.DbStructure;
+using StreamDb.Internal.Support;
+
+namespace StreamDb.Internal.Core
+{
+    /// <summary>
+    /// A db implementation that uses `PageStreamStorage` as the back-end.
+    /// Any other `IStorageEngine` can be used in its place.
+    /// </summary>
+    internal class PageStorageBackend : IDatabaseBackend
+    {
+        [NotNull]private readonly IStorageEngine _core;
+        [NotNull]private readonly Func<Guid> _newId;
+        [NotNull]private readonly ChunkStore _chunks;
+        [NotNull]private readonly TierStore _tiers;
+        [NotNull]private readonly FixedDocumentStore _fixed;
+        private readonly bool _deduplicate;
+        private readonly bool _promoteOnRead;
+        [NotNull]private readonly object _uploadLock = new object();
+        private UploadList? _uploads; // loaded from storage on first use
+
+        public PageStorageBackend(Stream fs, DatabaseOptions? options = null)
+            : this(new PageStorage(fs ?? throw new Exception("Storage stream must not be null"), options), options) { }
+
+        public PageStorageBackend([NotNull]IStorageEngine core, DatabaseOptions? options = null) {
+            _core = core;
+            _newId = options?.IdSource ?? Guid.NewGuid;
+            _chunks = new ChunkStore(_core, options?.Logger ?? NullLogger.Instance);
+            var cold = options?.ColdStorage == null ? null : new PageStorage(options.ColdStorage, options);
+            _tiers = new TierStore(_core, cold, options?.Logger ?? NullLogger.Instance);
+            _fixed = new FixedDocumentStore(_core);
+            _deduplicate = options?.Deduplicate ?? false;
+            _promoteOnRead = options?.PromoteOnRead ?? false;
+        }
+
+        /// <inheritdoc />
+        public Guid WriteDocument(Stream data)
+        {
+            var length = KnownLength(data);
+            var pageHead = _deduplicate ? _chunks.WriteDeduplicated(data) : _core.WriteStream(data);
+            var docId = _newId();
+            try
+            {
+                _core.BindIndex(docId, pageHead, out _, length, _deduplicate ? DocumentFlags.Deduplicated : DocumentFlags.None);
+            }
+            catch
+            {
+                if (!_deduplicate) ReleaseUnbound(pageHead);
+                throw;
+            }
+            return docId;
+        }
+
+        /// <inheritdoc />
+        public Guid BindPathToDocument(string path, Guid id, string? annotation = null, BindingAttributes attributes = BindingAttributes.None)
+        {
+            _core.BindPath(path, id, out var prev, annotation, attributes);
+            return prev ?? Guid.Empty;
+        }
+
+        /// <inheritdoc />
+        public void WriteDocumentVersion(Guid id, Stream data)
+        {
+            var length = KnownLength(data);
+            var pageHead = _core.WriteStream(data);
+            int expiredPageId;
+            try
+            {
+                _core.BindIndex(id, pageHead, out expiredPageId, length);
+            }
+            catch
+            {
+                ReleaseUnbound(pageHead);
+                throw;
+            }
+            _core.ReleaseChain(expiredPageId);
+        }
+
+        /// <inheritdoc />
+        public int RenamePrefix(string oldPrefix, string newPrefix, out Guid[] replacedIds)
+        {
+            return _core.RenamePrefix(oldPrefix, newPrefix, out replacedIds);
+        }
+
+        /// <inheritdoc />
+        public Guid[] ApplyPathChanges(IList<BindingInfo> changes)
+        {
+            return _core.ApplyPathChanges(changes);
+        }
+
+        /// <inheritdoc />
+        public void AppendAuditRecord(AuditRecord record)
+        {
+            if (record == null) throw new Exception("Audit record must not be null");
+            _core.AppendRecord(ReservedDocIds.Audit, AuditLog.Encode(record));
+        }
+
+        /// <inheritdoc />
+        public IEnumerable<AuditRecord> ReadAuditRecords()
+        {
+            return _core.ReadRecords(ReservedDocIds.Audit).Select((data, index) => {
+                var record = AuditLog.Decode(data);
+                record.Sequence = index;
+                return record;
+            });
+        }
+
+        /// <inheritdoc />
+        public Guid StartUpload(string path)
+        {
+            if (path == null) throw new Exception("Upload path must not be null");
+            var sessionId = _newId();
+            lock (_uploadLock)
+            {
+                var uploads = Uploads();
+                uploads.Sessions.Add(sessionId, new UploadSession { Path = path, StartedAt = DateTime.UtcNow });
+                SaveUploads(uploads);
+            }
+            return sessionId;
+        }
+
+        /// <inheritdoc />
+        public string? GetUploadPath(Guid sessionId)
+        {
+            lock (_uploadLock)
+            {
+                return Uploads().Sessions.TryGetValue(sessionId, out var session) ? session?.Path : null;
+            }
+        }
+
+        /// <inheritdoc />
+        public void UploadPart(Guid sessionId, int partNumber, Stream data)
+        {
+            if (data == null) throw new Exception("Data stream must be valid");
+            if (KnownLength(data) == 0) throw new Exception("Upload parts must not be empty");
+            GetUpload(sessionId); // fail before writing anything
+
+            // If the process exits between the write and saving the session, the part's pages are lost
+            var endPageId = _core.WriteStream(data);
+            int replaced;
+            lock (_uploadLock)
+            {
+                var uploads = Uploads();
+                if (!uploads.Sessions.TryGetValue(sessionId, out var session) || session == null)
+                {
+                    ReleaseUnbound(endPageId); // aborted while we were writing
+                    throw new Exception($"Unknown upload session {sessionId}");
+                }
+                replaced = session.SetPart(partNumber, endPageId);
+                SaveUploads(uploads);
+            }
+            _core.ReleaseChain(replaced);
+        }
+
+        /// <inheritdoc />
+        public Guid CompleteUpload(Guid sessionId)
+        {
+            int pageHead;
+            lock (_uploadLock)
+            {
+                var chains = GetUpload(sessionId).PartChains();
+                if (chains.Length < 1) throw new Exception("Upload has no parts");
+
+                // Join before removing the session, so a join that fails its checks leaves the upload in place
+                // to be retried or aborted. Nothing else can touch the session's chains while the lock is held.
+                pageHead = _core.JoinChains(chains);
+
+                var uploads = Uploads();
+                uploads.Sessions.Remove(sessionId);
+                SaveUploads(uploads);
+            }
+
+            var docId = _newId();
+            _core.BindIndex(docId, pageHead, out _);
+            return docId;
+        }
+
+        /// <inheritdoc />
+        public void AbortUpload(Guid sessionId)
+        {
+            UploadSession? session;
+            lock (_uploadLock)
+            {
+                var uploads = Uploads();
+                if (!uploads.Sessions.TryGetValue(sessionId, out session) || session == null) return;
+                uploads.Sessions.Remove(sessionId);
+                SaveUploads(uploads);
+            }
+            foreach (var chain in session.PartChains()) { _core.ReleaseChain(chain); }
+        }
+
+        /// <inheritdoc />
+        public int ReleaseUploads(DateTime startedBefore)
+        {
+            var expired = new List<UploadSession>();
+            lock (_uploadLock)
+            {
+                var uploads = Uploads();
+                foreach (var entry in uploads.Sessions.ToList())
+                {
+                    if (entry.Value == null || entry.Value.StartedAt >= startedBefore) continue;
+                    uploads.Sessions.Remove(entry.Key);
+                    expired.Add(entry.Value);
+                }
+                if (expired.Count < 1) return 0;
+                SaveUploads(uploads);
+            }
+            foreach (var chain in expired.SelectMany(session => session.PartChains())) { _core.ReleaseChain(chain); }
+            return expired.Count;
+        }
+
+        /// <summary>
+        /// Run a document read, retried on read replicas (see `PageStorage.ReplicaRead`)
+        /// </summary>
+        private T ConsistentRead<T>([NotNull]Func<T> read)
+        {
+            return _core is PageStorage pages ? pages.ReplicaRead(read, "document") : read();
+        }
+
+        /// <summary>
+        /// Release a newly written chain whose binding failed, so its pages aren't lost.
+        /// Errors are ignored, so the caller can rethrow the original failure.
+        /// </summary>
+        private void ReleaseUnbound(int pageHead)
+        {
+            try { _core.ReleaseChain(pageHead); }
+            catch { /* keep the binding error */ }
+        }
+
+        /// <summary>
+        /// Bytes remaining in a data stream, or -1 if the stream can't tell us
+        /// </summary>
+        private static long KnownLength(Stream? data)
+        {
+            if (data is KnownLengthStream known) return known.Length - known.Position;
+            if (data == null || !data.CanSeek) return -1;
+            return data.Length - data.Position;
+        }
+
+        [NotNull]private UploadSession GetUpload(Guid sessionId)
+        {
+            lock (_uploadLock)
+            {
+                if (!Uploads().Sessions.TryGetValue(sessionId, out var session) || session == null) throw new Exception($"Unknown upload session {sessionId}");
+                return session;
+            }
+        }
+
+        /// <summary>
+        /// Open upload sessions, read from storage the first time they are needed. Call while holding `_uploadLock`
+        /// </summary>
+        [NotNull]private UploadList Uploads()
+        {
+            if (_uploads != null) return _uploads;
+            var uploads = new UploadList();
+            var stream = ReadDocument(ReservedDocIds.Uploads);
+            if (stream != null) uploads.Defrost(stream);
+            _uploads = uploads;
+            return uploads;
+        }
+
+        private void SaveUploads([NotNull]UploadList uploads)
+        {
+            WriteDocumentVersion(ReservedDocIds.Uploads, uploads.Freeze());
+        }
+
+        /// <inheritdoc />
+        public void DeleteDocument(Guid oldId) {
+            var all = _core.GetPathsForDocument(oldId);
+            foreach (var path in all)
+            {
+                _core.UnbindPath(path);
+            }
+            var pageId = _core.GetDocumentHead(oldId, out var flags);
+            _core.UnbindIndex(oldId);
+            if (pageId >= 0)
+            {
+                var stored = _core.GetStream(pageId);
+                if ((flags & DocumentFlags.Deduplicated) != 0) _chunks.ReleaseManifest(_tiers.Resolve(oldId, stored, flags));
+                _tiers.ReleaseStub(oldId, flags);
+            }
+            _core.ReleaseChain(pageId);
+        }
+
+        /// <inheritdoc />
+        public void DeleteSinglePathForDocument(Guid documentId, string path) {
+            _core.UnbindPath(path);
+        }
+
+        /// <inheritdoc />
+        public void RemoveFromIndex(Guid id) {
+            _core.UnbindIndex(id);
+        }
+
+        /// <inheritdoc />
+        public void DeletePathsForDocument(Guid id) {
+            var all = _core.GetPathsForDocument(id);
+            foreach (var path in all)
+            {
+                _core.UnbindPath(path);
+            }
+        }
+
+        /// <inheritdoc />
+        public Guid GetDocumentIdByPath(string path) { 
+            return _core.GetDocumentIdByPath(path) ?? Guid.Empty;
+        }
+
+        /// <inheritdoc />
+        public BindingInfo? GetBindingInfo(string path) {
+            return _core.GetBindingInfo(path);
+        }
+
+        /// <inheritdoc />
+        public IEnumerable<string> SearchPaths(string pathPrefix) {
+            return _core.SearchPaths(pathPrefix);
+        }
+
+        /// <inheritdoc />
+        public IEnumerable<string> SearchPathSuffix(string pathSuffix) {
+            return _core.SearchPathSuffix(pathSuffix);
+        }
+
+        /// <inheritdoc />
+        public IEnumerable<string> ListPathsForDocument(Guid documentId) { 
+            return _core.GetPathsForDocument(documentId);
+        }
+
+        /// <inheritdoc />
+        public Stream? ReadDocument(Guid id) {
+            try
+            {
+                return ConsistentRead<Stream?>(() => {
+                    var pageHead = _core.GetDocumentHead(id, out var flags);
+                    if (pageHead < 0) return null;
+                    if (_promoteOnRead && (flags & DocumentFlags.Cold) != 0)
+                    {
+                        _tiers.Promote(id);
+                        return ReadDocument(id);
+                    }
+                    var result = OpenChain(id, pageHead, flags);
+                    if (_core is PageStorage pages && pages.IsReadReplica) _ = result.Length; // load the chain now, while it is still valid
+                    return result;
+                });
+            }
+            catch (Exception ex) when (!(ex is ReplicaInconsistencyException))
+            {
+                throw new Exception("Data integrity check failed", ex);
+            }
+        }
+        
+        /// <inheritdoc />
+        public string GetInfo(Guid id) {
+            try
+            {
+                var pageHead = _core.GetDocumentHead(id);
+                if (pageHead < 0) return "Document not found";
+                if (!(_core is PageStorage pages)) return $"{_core.GetStream(pageHead).Length} bytes; chain = {pageHead};";
+                var page = pages.GetRawPage(pageHead);
+                if (page == null) return "Failed to read document header";
+                return $"{page.DataLength} bytes; file index = {page.PageId}; CRC = {page.CrcHash:X};";
+            }
+            catch (Exception ex)
+            {
+                return "Data integrity check failed: " + ex.Message;
+            }
+        }
+
+        /// <inheritdoc />
+        public DocumentStat? GetDocumentStat(Guid id)
+        {
+            var pageHead = _core.GetDocumentHead(id);
+            if (pageHead < 0) return null;
+
+            var stat = _core.GetIndexStat(id);
+            if (stat != null && stat.Length >= 0) return stat;
+
+            // Not in the index (older data, or unknown length). Open the document to find out.
+            using (var doc = ReadDocument(id))
+            {
+                if (doc == null) return null;
+                return new DocumentStat {
+                    DocumentId = id,
+                    Length = doc.Length,
+                    LastModified = stat?.LastModified,
+                    Flags = stat?.Flags ?? DocumentFlags.None,
+                    FromIndex = false
+                };
+            }
+        }
+
+        /// <inheritdoc />
+        public int CountFreePages() { return _core is PageStorage pages ? (int)pages.FreePageCount() : 0; }
+
+        /// <inheritdoc />
+        public long CountDocuments() { return _core.DocumentCount(); }
+
+        /// <inheritdoc />
+        public Guid[] ListDocumentIds()
+        {
+            var chunks = _chunks.ChunkIds();
+            return _core.DocumentIds().Where(id => !chunks.Contains(id)).ToArray();
+        }
+
+        /// <inheritdoc />
+        public bool NeedsRepair() { return _core is PageStorage pages && pages.NeedsRepair; }
+
+        /// <inheritdoc />
+        public IntegrityReport CheckIntegrity(int workers) { return _core.CheckIntegrity(workers); }
+
+        /// <inheritdoc />
+        public HealthReport HealthCheck(HealthCheckLevel level) { return _core.HealthCheck(level); }
+
+        /// <inheritdoc />
+        public void ReleaseDeferredPages() { if (_core is PageStorage pages) pages.ReleaseDeferredPages(); }
+
+        /// <inheritdoc />
+        public CrcSamplingStats CrcSampling() { return _core is PageStorage pages ? pages.CrcSampling : new CrcSamplingStats(); }
+
+        /// <inheritdoc />
+        public FragmentationReport? AnalyzeDocument(Guid id)
+        {
+            var pageHead = _core.GetDocumentHead(id);
+            if (pageHead < 0) return null;
+            if (!(_core is PageStorage pages)) return new FragmentationReport { DocumentId = id }; // nothing is stored in pages
+
+            var report = pages.AnalyzeChain(pageHead);
+            report.DocumentId = id;
+            return report;
+        }
+
+        /// <inheritdoc />
+        public DatabaseSnapshot OpenSnapshot()
+        {
+            var bindings = new List<BindingInfo>();
+            var stats = new Dictionary<Guid, DocumentStat>();
+
+            if (!(_core is PageStorage pages))
+            {
+                // Other engines can't hold chains, so copy the data out now
+                var copies = new Dictionary<Guid, byte[]>();
+                foreach (var id in CaptureBindings(bindings, stats))
+                {
+                    using (var doc = ReadDocument(id))
+                    {
+                        if (doc == null) continue;
+                        var ms = new MemoryStream();
+                        doc.CopyTo(ms);
+                        copies[id] = ms.ToArray();
+                    }
+                }
+                return new DatabaseSnapshot(bindings, stats, id => copies.TryGetValue(id, out var data) ? new MemoryStream(data, false) : null, null);
+            }
+
+            var hold = pages.HoldReleasedPages();
+            try
+            {
+                // Fixed documents and circular logs are overwritten in place, so holding their chains isn't enough. Copy them now.
+                var fixedCopies = new Dictionary<Guid, byte[]>();
+                var heads = pages.ReadExclusive(() => CaptureBindings(bindings, stats).ToDictionary(id => id, id => {
+                    var head = _core.GetDocumentHead(id, out var flags);
+                    if (head >= 0 && stats.TryGetValue(id, out var stat) && MayBeFixed(stat)) CopyIfFixed(id, head, fixedCopies);
+                    return new KeyValuePair<int, DocumentFlags>(head, flags);
+                }));
+                return new DatabaseSnapshot(bindings, stats, id => {
+                    if (fixedCopies.TryGetValue(id, out var data)) return new MemoryStream(data, false);
+                    return heads.TryGetValue(id, out var head) && head.Key >= 0 ? OpenChain(id, head.Key, head.Value) : null;
+                }, hold);
+            }
+            catch
+            {
+                hold.Dispose();
+                throw;
+            }
+        }
+
+        /// <summary>
+        /// Fixed documents are bound with a length of whole pages, and are never deduplicated or tiered
+        /// </summary>
+        private static bool MayBeFixed(DocumentStat stat)
+        {
+            return stat.Flags == DocumentFlags.None && stat.Length > 0 && stat.Length % BasicPage.PageDataCapacity == 0;
+        }
+
+        /// <summary>
+        /// Copy the stored data of a chain into `copies` if it holds a fixed document
+        /// </summary>
+        private void CopyIfFixed(Guid id, int head, [NotNull]Dictionary<Guid, byte[]> copies)
+        {
+            using (var stored = _core.GetStream(head))
+            {
+                if (!FixedDocumentStore.IsFixed(stored)) return;
+                var ms = new MemoryStream();
+                stored.CopyTo(ms);
+                copies[id] = ms.ToArray();
+            }
+        }
+
+        /// <summary>
+        /// Read every path binding, and the index details of each bound document. Returns the IDs of bound documents
+        /// </summary>
+        [NotNull]private HashSet<Guid> CaptureBindings([NotNull]List<BindingInfo> bindings, [NotNull]Dictionary<Guid, DocumentStat> stats)
+        {
+            var ids = new HashSet<Guid>();
+            foreach (var path in _core.SearchPaths("").ToList())
+            {
+                var binding = _core.GetBindingInfo(path);
+                if (binding == null) continue;
+                bindings.Add(binding);
+                if (!ids.Add(binding.DocumentId)) continue;
+
+                var stat = _core.GetIndexStat(binding.DocumentId);
+                if (stat != null && stat.Length >= 0) stats[binding.DocumentId] = stat;
+            }
+            return ids;
+        }
+
+        /// <summary>
+        /// Open a document's data from a known chain, rather than the chain its index entry points to now.
+        /// The flags must come from the same index read as the chain.
+        /// </summary>
+        [NotNull]private Stream OpenChain(Guid id, int pageHead, DocumentFlags flags)
+        {
+            var stored = _tiers.Resolve(id, _core.GetStream(pageHead), flags);
+            return (flags & DocumentFlags.Deduplicated) != 0 ? _chunks.OpenDocument(stored) : stored;
+        }
+
+        /// <inheritdoc />
+        public bool OptimizeDocument(Guid id)
+        {
+            var pageHead = _core.GetDocumentHead(id);
+            if (pageHead < 0 || !(_core is PageStorage pages)) return false;
+            return pages.OptimizeChain(pageHead) != pageHead;
+        }
+
+        /// <inheritdoc />
+        public bool ShardIndex()
+        {
+            return _core is PageStorage pages && pages.MigrateToShardedIndex();
+        }
+
+        /// <inheritdoc />
+        public bool RepairHeaderLinks()
+        {
+            return !(_core is PageStorage pages) || pages.RepairHeaderLinks();
+        }
+
+        /// <inheritdoc />
+        public void QuarantinePages(int[] pageIds)
+        {
+            if (_core is PageStorage pages) pages.QuarantinePages(pageIds);
+        }
+
+        /// <inheritdoc />
+        public long CacheMemoryUsed => _core is PageStorage pages ? pages.CacheMemoryUsed : 0;
+
+        /// <inheritdoc />
+        public bool PurgeOldVersion(Guid id)
+        {
+            var expired = _core.DropPreviousVersion(id);
+            if (expired < 0) return false;
+            _core.ReleaseChain(expired);
+            return true;
+        }
+
+        /// <inheritdoc />
+        public int PurgeAllOldVersions()
+        {
+            var expired = _core.DropAllPreviousVersions();
+            foreach (var chainId in expired) { _core.ReleaseChain(chainId); }
+            return expired.Length;
+        }
+
+        /// <inheritdoc />
+        public VersionReport VersionStatistics() { return _core.VersionStatistics(); }
+
+        /// <inheritdoc />
+        public StorageTier GetTier(Guid id)
+        {
+            var pageHead = _core.GetDocumentHead(id, out var flags);
+            if (pageHead < 0) throw new Exception("Document not found");
+            return (flags & DocumentFlags.Cold) != 0 ? StorageTier.Cold : StorageTier.Hot;
+        }
+
+        /// <inheritdoc />
+        public void MoveToTier(Guid id, StorageTier tier)
+        {
+            switch (tier)
+            {
+                case StorageTier.Hot: _tiers.Promote(id); return;
+                case StorageTier.Cold: _tiers.Demote(id); return;
+                default: throw new Exception("Non exhaustive switch");
+            }
+        }
+
+        /// <inheritdoc />
+        public Guid CreateFixedDocument(int sizePages)
+        {
+            var pageHead = _fixed.Create(sizePages);
+            var docId = _newId();
+            _core.BindIndex(docId, pageHead, out _, (long)sizePages * BasicPage.PageDataCapacity);
+            return docId;
+        }
+
+        /// <inheritdoc />
+        public void AppendToFixedDocument(Guid id, byte[] data)
+        {
+            if (data == null) throw new Exception("Data must not be null");
+            var pageHead = _core.GetDocumentHead(id);
+            if (pageHead < 0) throw new Exception("Document not found");
+            _fixed.Append(pageHead, data);
+        }
+
+        /// <inheritdoc />
+        public Stream? ReadFixedDocument(Guid id)
+        {
+            return ConsistentRead<Stream?>(() => {
+                var pageHead = _core.GetDocumentHead(id);
+                if (pageHead < 0) return null;
+                return _fixed.Read(pageHead, out _);
+            });
+        }
+
+        /// <inheritdoc />
+        public long AppendLogRecord(Guid id, byte[] record)
+        {
+            if (record == null) throw new Exception("Record must not be null");
+            var pageHead = _core.GetDocumentHead(id);
+            if (pageHead < 0) throw new Exception("Document not found");
+            return _fixed.Append(pageHead, CircularLog.Encode(record));
+        }
+
+        /// <inheritdoc />
+        public IEnumerable<LogRecord> ReadLogRecords(Guid id, long since)
+        {
+            return ConsistentRead(() => {
+                var pageHead = _core.GetDocumentHead(id);
+                if (pageHead < 0) throw new Exception("Document not found");
+
+                var ms = new MemoryStream();
+                _fixed.Read(pageHead, out var tail).CopyTo(ms);
+                return CircularLog.Decode(ms.ToArray(), tail, since);
+            });
+        }
+    }
 }
\ No newline at end of file
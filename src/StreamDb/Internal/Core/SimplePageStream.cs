@@ -1,134 +1,275 @@
-﻿using System;
-using System.Collections.Generic;
-using System.IO;
-using JetBrains.Annotations;
-using StreamDb.Internal.DbStructure;
-
-namespace StreamDb.Internal.Core
-{
-    /// <summary>
-    /// READ-ONLY stream abstraction over a page-chain
-    /// </summary>
-    public class SimplePageStream : Stream
-    {
-        [NotNull]private readonly PageStorage _parent;
-        private readonly int _endPageId;
-
-        /// <summary>Pages loaded from the DB</summary>
-        [NotNull]private readonly List<BasicPage> _pageIdCache;
-
-        private long _length;
-        private bool _cached;
-
-        public SimplePageStream([NotNull]PageStorage parent, int endPageId)
-        {
-            _cached = false;
-            _parent = parent;
-            _endPageId = endPageId;
-            _pageIdCache = new List<BasicPage>();
-        }
-
-        private void LoadPageIdCache()
-        {
-            if (_cached) return;
-            long length = 0;
-            var s = new Stack<BasicPage>();
-            var p = _parent.GetRawPage(_endPageId);
-            while (p != null)
-            {
-                s.Push(p);
-                length += p.DataLength;
-                p = _parent.GetRawPage(p.PrevPageId); // we end up checking all the CRCs here
-            }
-
-            while (s.Count > 0) _pageIdCache.Add(s.Pop()); // cache in forward-order
-            _length = length;
-            _cached = true;
-        }
-
-        /// <inheritdoc />
-        public override void Flush() { }
-
-        /// <inheritdoc />
-        public override int Read(byte[] buffer, int offset, int count)
-        {
-            if (buffer == null) throw new Exception("Destination buffer must not be null");
-            LoadPageIdCache(); // make sure data is loaded
-
-            var pageIdx = (int) (Position / BasicPage.PageDataCapacity);
-            var startingOffset = (int) (Position % BasicPage.PageDataCapacity);
-
-            if (pageIdx < 0) throw new Exception("Read started out of the bounds of page chain");
-            if (pageIdx >= _pageIdCache.Count) return 0; // ran off the end
-
-            var remains = (int)Math.Min(count, Length - Position);
-            var written = 0;
-
-            while (remains > 0) {
-                var page = _pageIdCache[pageIdx]; // ignore CRCs here, as we checked them at stream creation time
-                if (page == null) throw new Exception($"Page {_pageIdCache[pageIdx]} lost between cache and read");
-                var available = (int) (page.DataLength - startingOffset);
-                if (available < 1) throw new Exception($"Read from page chain returned nonsense bytes available ({available})");
-
-                var stream = page.BodyStream();
-                stream.Seek(startingOffset, SeekOrigin.Begin);
-
-                var request = Math.Min(available, count - written);
-                if (request < 1) throw new Exception("Read stalled");
-                if (request + written + offset > buffer.Length) throw new Exception($"Would overrun buffer ({request}+{written}+{offset} > {buffer.Length})");
-
-                var actual = stream.Read(buffer, written + offset, request);
-                if (actual < 1) throw new Exception("Stream read did not progress");
-                written += actual;
-                remains -= actual;
-
-                pageIdx++;
-                startingOffset = 0;
-            }
-            
-            Position += written;
-            return written;
-        }
-
-        /// <inheritdoc />
-        public override long Seek(long offset, SeekOrigin origin)
-        {
-            switch (origin)
-            {
-                case SeekOrigin.Begin:
-                    Position = offset;
-                    return Position;
-
-                case SeekOrigin.Current:
-                    Position = Math.Min(Position + offset, Length);
-                    return Position;
-
-                case SeekOrigin.End:
-                    Position = Length + offset;
-                    return Position;
-
-                default: throw new Exception("Non exhaustive switch");
-            }
-        }
-
-        /// <inheritdoc />
-        public override void SetLength(long value) { throw new InvalidOperationException("Page stream is not writable"); }
-
-        /// <inheritdoc />
-        public override void Write(byte[] buffer, int offset, int count) { throw new InvalidOperationException("Page stream is not writable"); }
-
-        /// <inheritdoc />
-        public override bool CanRead => true;
-        /// <inheritdoc />
-        public override bool CanSeek => true;
-
-        /// <inheritdoc />
-        public override bool CanWrite => false;
-
-        /// <inheritdoc />
-        public override long Length { get { LoadPageIdCache(); return _length; } }
-
-        /// <inheritdoc />
-        public override long Position { get; set; }
-    }
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using JetBrains.Annotations;
+using StreamDb.Internal.DbStructure;
+
+namespace StreamDb.Internal.Core
+{
+    /// <summary>
+    /// READ-ONLY stream abstraction over a page-chain.
+    /// <para></para>
+    /// A single stream is not safe to share between threads. Use `Clone` to give each reader its own stream over the same loaded pages.
+    /// </summary>
+    public class SimplePageStream : Stream
+    {
+        [NotNull]private readonly PageStorage _parent;
+        private readonly int _endPageId;
+        private readonly bool _sampleCrc;
+
+        /// <summary>Pages of the chain, shared with clones of this stream</summary>
+        [NotNull]private readonly ChainPages _chain;
+
+        private BasicPage? _currentPage;
+        private long _position;
+        private bool _disposed;
+
+        /// <summary>
+        /// The loaded chain, shared by a stream and its clones. Lock on this before loading or releasing.
+        /// </summary>
+        private class ChainPages
+        {
+            /// <summary>Pages loaded from the DB. Empty in page-at-a-time mode</summary>
+            [NotNull]public readonly List<BasicPage> Pages = new List<BasicPage>();
+            /// <summary>IDs of pages in the chain, in forward order</summary>
+            [NotNull]public readonly List<int> PageIds = new List<int>();
+
+            public long Length;
+            public volatile bool Loaded; // checked before taking the lock
+            public bool PageAtATime;
+            public long Reserved;
+            public int Readers = 1;
+        }
+
+        /// <param name="parent">Storage holding the chain</param>
+        /// <param name="endPageId">Last page of the chain</param>
+        /// <param name="sampleCrc">If true, CRCs are checked at the storage's sample rate. See `PageStorage.GetDataPage`</param>
+        public SimplePageStream([NotNull]PageStorage parent, int endPageId, bool sampleCrc = false)
+        {
+            _parent = parent;
+            _endPageId = endPageId;
+            _sampleCrc = sampleCrc;
+            _chain = new ChainPages();
+        }
+
+        private SimplePageStream([NotNull]SimplePageStream source)
+        {
+            _parent = source._parent;
+            _endPageId = source._endPageId;
+            _sampleCrc = source._sampleCrc;
+            _chain = source._chain;
+        }
+
+        /// <summary>
+        /// Create an independent reader over the same chain, starting at the beginning.
+        /// Pages already loaded are shared rather than read again, and are kept until the original and all clones are disposed.
+        /// Each clone may be used on a different thread.
+        /// </summary>
+        [NotNull]public SimplePageStream Clone()
+        {
+            lock (_chain)
+            {
+                if (_disposed) throw new ObjectDisposedException(nameof(SimplePageStream));
+                _chain.Readers++;
+            }
+            return new SimplePageStream(this);
+        }
+
+        /// <summary>
+        /// True if the memory budget could not hold this stream's pages, so they are read from storage as needed.
+        /// See `DatabaseOptions.MemoryBudget`
+        /// </summary>
+        public bool IsPageAtATime { get { LoadPageIdCache(); return _chain.PageAtATime; } }
+
+        private void LoadPageIdCache()
+        {
+            if (_chain.Loaded) return;
+            lock (_chain)
+            {
+                if (_chain.Loaded) return; // a clone got here first
+                LoadChain();
+            }
+        }
+
+        private void LoadChain()
+        {
+            using (var span = _parent.Tracer.StartSpan("StreamDb.GetStream"))
+            {
+                span.SetAttribute("endPageId", _endPageId);
+                long length = 0;
+                var s = new Stack<BasicPage>();
+                var ids = new Stack<int>();
+                var walk = _parent.StartWalk(_endPageId);
+                var p = ReadPage(_endPageId);
+                while (p != null)
+                {
+                    walk.Visit(p.PageId);
+                    ids.Push(p.PageId);
+                    if (!_chain.PageAtATime)
+                    {
+                        if (_parent.Memory.TryReserve(BasicPage.PageRawSize))
+                        {
+                            _chain.Reserved += BasicPage.PageRawSize;
+                            s.Push(p);
+                        }
+                        else
+                        {
+                            // Over budget. Drop what we've kept, and only remember page IDs
+                            _chain.PageAtATime = true;
+                            s.Clear();
+                            ReleaseReserved();
+                        }
+                    }
+                    length += p.DataLength;
+                    p = ReadPage(p.PrevPageId); // we end up checking all the CRCs here (or a sample of them)
+                }
+
+                span.SetAttribute("pages", ids.Count);
+                span.SetAttribute("bytes", length);
+                span.SetAttribute("pageAtATime", _chain.PageAtATime);
+                while (s.Count > 0) _chain.Pages.Add(s.Pop()); // cache in forward-order
+                while (ids.Count > 0) _chain.PageIds.Add(ids.Pop());
+                _chain.Length = length;
+                _chain.Loaded = true;
+            }
+        }
+
+        /// <summary>
+        /// Get a page of the chain by its position, from the cache or from storage
+        /// </summary>
+        [NotNull]private BasicPage PageAt(int pageIdx)
+        {
+            if (!_chain.PageAtATime) return _chain.Pages[pageIdx] ?? throw new Exception($"Page {_chain.PageIds[pageIdx]} lost between cache and read");
+
+            var pageId = _chain.PageIds[pageIdx];
+            if (_currentPage?.PageId == pageId) return _currentPage;
+            _currentPage = ReadPage(pageId) ?? throw new Exception($"Page {pageId} lost between chain walk and read");
+            return _currentPage;
+        }
+
+        private BasicPage? ReadPage(int pageId)
+        {
+            return _sampleCrc ? _parent.GetDataPage(pageId) : _parent.GetRawPage(pageId);
+        }
+
+        private void ReleaseReserved()
+        {
+            if (_chain.Reserved == 0) return;
+            _parent.Memory.Release(_chain.Reserved);
+            _chain.Reserved = 0;
+        }
+
+        /// <inheritdoc />
+        protected override void Dispose(bool disposing)
+        {
+            lock (_chain)
+            {
+                if (!_disposed)
+                {
+                    _disposed = true;
+                    if (--_chain.Readers < 1)
+                    {
+                        ReleaseReserved();
+                        _chain.Pages.Clear();
+                    }
+                }
+            }
+            base.Dispose(disposing);
+        }
+
+        ~SimplePageStream() { Dispose(false); }
+
+        /// <inheritdoc />
+        public override void Flush() { }
+
+        /// <inheritdoc />
+        public override int Read(byte[] buffer, int offset, int count)
+        {
+            if (_disposed) throw new ObjectDisposedException(nameof(SimplePageStream));
+            if (buffer == null) throw new Exception("Destination buffer must not be null");
+            LoadPageIdCache(); // make sure data is loaded
+            if (Position >= Length) return 0; // at or seeked past the end
+
+            var pageIdx = (int) (Position / BasicPage.PageDataCapacity);
+            var startingOffset = (int) (Position % BasicPage.PageDataCapacity);
+
+            if (pageIdx < 0) throw new Exception("Read started out of the bounds of page chain");
+            if (pageIdx >= _chain.PageIds.Count) return 0; // ran off the end
+
+            var remains = (int)Math.Min(count, Length - Position);
+            var written = 0;
+
+            while (remains > 0) {
+                var page = PageAt(pageIdx); // cached pages had their CRCs checked at stream creation time
+                var available = (int) (page.DataLength - startingOffset);
+                if (available < 1) throw new Exception($"Read from page chain returned nonsense bytes available ({available})");
+
+                var stream = page.BodyStream();
+                stream.Seek(startingOffset, SeekOrigin.Begin);
+
+                var request = Math.Min(available, count - written);
+                if (request < 1) throw new Exception("Read stalled");
+                if (request + written + offset > buffer.Length) throw new Exception($"Would overrun buffer ({request}+{written}+{offset} > {buffer.Length})");
+
+                var actual = stream.Read(buffer, written + offset, request);
+                if (actual < 1) throw new Exception("Stream read did not progress");
+                written += actual;
+                remains -= actual;
+
+                pageIdx++;
+                startingOffset = 0;
+            }
+            
+            Position += written;
+            return written;
+        }
+
+        /// <summary>
+        /// Move the read position. As with other .Net streams, seeking past the end is allowed (reads there return nothing),
+        /// but seeking before the start throws `IOException`, and leaves the position unchanged.
+        /// </summary>
+        public override long Seek(long offset, SeekOrigin origin)
+        {
+            if (_disposed) throw new ObjectDisposedException(nameof(SimplePageStream));
+            long target;
+            switch (origin)
+            {
+                case SeekOrigin.Begin: target = offset; break;
+                case SeekOrigin.Current: target = Position + offset; break;
+                case SeekOrigin.End: target = Length + offset; break;
+                default: throw new ArgumentException($"Unknown seek origin {origin}", nameof(origin));
+            }
+            if (target < 0) throw new IOException($"Can't seek to {target}, which is before the start of the stream");
+            Position = target;
+            return Position;
+        }
+
+        /// <inheritdoc />
+        public override void SetLength(long value) { throw new InvalidOperationException("Page stream is not writable"); }
+
+        /// <inheritdoc />
+        public override void Write(byte[] buffer, int offset, int count) { throw new InvalidOperationException("Page stream is not writable"); }
+
+        /// <inheritdoc />
+        public override bool CanRead => true;
+        /// <inheritdoc />
+        public override bool CanSeek => true;
+
+        /// <inheritdoc />
+        public override bool CanWrite => false;
+
+        /// <inheritdoc />
+        public override long Length { get { LoadPageIdCache(); return _chain.Length; } }
+
+        /// <inheritdoc />
+        public override long Position
+        {
+            get => _position;
+            set
+            {
+                if (value < 0) throw new ArgumentOutOfRangeException(nameof(value), "Stream position must not be negative");
+                _position = value;
+            }
+        }
+    }
 }
\ No newline at end of file
@@ -0,0 +1,183 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using JetBrains.Annotations;
+
+namespace StreamDb.Internal.Core
+{
+    /// <summary>
+    /// Wraps a back-end so that every mutation is applied by a single writer, in order.
+    /// Reads go straight to the wrapped back-end, so they run concurrently with each other and with the writer.
+    /// </summary>
+    internal class SingleWriterBackend : IDatabaseBackend
+    {
+        [NotNull] private readonly IDatabaseBackend _inner;
+        [NotNull] private readonly WriterLoop _writer;
+
+        public SingleWriterBackend([NotNull]IDatabaseBackend inner, [NotNull]WriterLoop writer)
+        {
+            _inner = inner;
+            _writer = writer;
+        }
+
+        // ############## Mutations: through the writer ##############
+
+        /// <inheritdoc />
+        public Guid WriteDocument(Stream data) => _writer.Submit(() => _inner.WriteDocument(data));
+
+        /// <inheritdoc />
+        public Guid BindPathToDocument(string path, Guid id, string? annotation = null, BindingAttributes attributes = BindingAttributes.None) => _writer.Submit(() => _inner.BindPathToDocument(path, id, annotation, attributes));
+
+        /// <inheritdoc />
+        public void WriteDocumentVersion(Guid id, Stream data) => _writer.Submit(() => _inner.WriteDocumentVersion(id, data));
+
+        /// <inheritdoc />
+        public int RenamePrefix(string oldPrefix, string newPrefix, out Guid[] replacedIds)
+        {
+            var replaced = new Guid[0];
+            var count = _writer.Submit(() => _inner.RenamePrefix(oldPrefix, newPrefix, out replaced));
+            replacedIds = replaced;
+            return count;
+        }
+
+        /// <inheritdoc />
+        public Guid[] ApplyPathChanges(IList<BindingInfo> changes) => _writer.Submit(() => _inner.ApplyPathChanges(changes));
+
+        /// <inheritdoc />
+        public void AppendAuditRecord(AuditRecord record) => _writer.Submit(() => _inner.AppendAuditRecord(record));
+
+        /// <inheritdoc />
+        public Guid StartUpload(string path) => _writer.Submit(() => _inner.StartUpload(path));
+
+        /// <inheritdoc />
+        public string? GetUploadPath(Guid sessionId) => _inner.GetUploadPath(sessionId);
+
+        /// <inheritdoc />
+        public void UploadPart(Guid sessionId, int partNumber, Stream data) => _writer.Submit(() => _inner.UploadPart(sessionId, partNumber, data));
+
+        /// <inheritdoc />
+        public Guid CompleteUpload(Guid sessionId) => _writer.Submit(() => _inner.CompleteUpload(sessionId));
+
+        /// <inheritdoc />
+        public void AbortUpload(Guid sessionId) => _writer.Submit(() => _inner.AbortUpload(sessionId));
+
+        /// <inheritdoc />
+        public int ReleaseUploads(DateTime startedBefore) => _writer.Submit(() => _inner.ReleaseUploads(startedBefore));
+
+        /// <inheritdoc />
+        public void DeleteDocument(Guid oldId) => _writer.Submit(() => _inner.DeleteDocument(oldId));
+
+        /// <inheritdoc />
+        public void DeleteSinglePathForDocument(Guid documentId, string path) => _writer.Submit(() => _inner.DeleteSinglePathForDocument(documentId, path));
+
+        /// <inheritdoc />
+        public void RemoveFromIndex(Guid id) => _writer.Submit(() => _inner.RemoveFromIndex(id));
+
+        /// <inheritdoc />
+        public void DeletePathsForDocument(Guid id) => _writer.Submit(() => _inner.DeletePathsForDocument(id));
+
+        /// <inheritdoc />
+        public void MoveToTier(Guid id, StorageTier tier) => _writer.Submit(() => _inner.MoveToTier(id, tier));
+
+        /// <inheritdoc />
+        public Guid CreateFixedDocument(int sizePages) => _writer.Submit(() => _inner.CreateFixedDocument(sizePages));
+
+        /// <inheritdoc />
+        public void AppendToFixedDocument(Guid id, byte[] data) => _writer.Submit(() => _inner.AppendToFixedDocument(id, data));
+
+        /// <inheritdoc />
+        public long AppendLogRecord(Guid id, byte[] record) => _writer.Submit(() => _inner.AppendLogRecord(id, record));
+
+        // ############## Reads: direct ##############
+
+        /// <inheritdoc />
+        public Guid GetDocumentIdByPath(string path) => _inner.GetDocumentIdByPath(path);
+
+        /// <inheritdoc />
+        public BindingInfo? GetBindingInfo(string path) => _inner.GetBindingInfo(path);
+
+        /// <inheritdoc />
+        public IEnumerable<AuditRecord> ReadAuditRecords() => _inner.ReadAuditRecords();
+
+        /// <inheritdoc />
+        public IEnumerable<string> SearchPaths(string pathPrefix) => _inner.SearchPaths(pathPrefix);
+
+        /// <inheritdoc />
+        public IEnumerable<string> SearchPathSuffix(string pathSuffix) => _inner.SearchPathSuffix(pathSuffix);
+
+        /// <inheritdoc />
+        public IEnumerable<string> ListPathsForDocument(Guid documentId) => _inner.ListPathsForDocument(documentId);
+
+        /// <inheritdoc />
+        public Stream? ReadDocument(Guid id) => _inner.ReadDocument(id);
+
+        /// <inheritdoc />
+        public int CountFreePages() => _inner.CountFreePages();
+
+        /// <inheritdoc />
+        public long CountDocuments() => _inner.CountDocuments();
+
+        /// <inheritdoc />
+        public Guid[] ListDocumentIds() => _inner.ListDocumentIds();
+
+        /// <inheritdoc />
+        public bool NeedsRepair() => _inner.NeedsRepair();
+
+        /// <inheritdoc />
+        public string GetInfo(Guid id) => _inner.GetInfo(id);
+
+        /// <inheritdoc />
+        public DocumentStat? GetDocumentStat(Guid id) => _inner.GetDocumentStat(id);
+
+        /// <inheritdoc />
+        public IntegrityReport CheckIntegrity(int workers) => _inner.CheckIntegrity(workers);
+
+        /// <inheritdoc />
+        public HealthReport HealthCheck(HealthCheckLevel level) => _inner.HealthCheck(level);
+
+        /// <inheritdoc />
+        public void ReleaseDeferredPages() => _writer.Submit(() => _inner.ReleaseDeferredPages());
+
+        /// <inheritdoc />
+        public CrcSamplingStats CrcSampling() => _inner.CrcSampling();
+
+        /// <inheritdoc />
+        public FragmentationReport? AnalyzeDocument(Guid id) => _inner.AnalyzeDocument(id);
+
+        /// <inheritdoc />
+        public bool OptimizeDocument(Guid id) => _writer.Submit(() => _inner.OptimizeDocument(id));
+
+        /// <inheritdoc />
+        public DatabaseSnapshot OpenSnapshot() => _writer.Submit(() => _inner.OpenSnapshot());
+
+        /// <inheritdoc />
+        public bool ShardIndex() => _writer.Submit(() => _inner.ShardIndex());
+
+        /// <inheritdoc />
+        public bool RepairHeaderLinks() => _writer.Submit(() => _inner.RepairHeaderLinks());
+
+        /// <inheritdoc />
+        public void QuarantinePages(int[] pageIds) => _writer.Submit(() => _inner.QuarantinePages(pageIds));
+
+        /// <inheritdoc />
+        public long CacheMemoryUsed => _inner.CacheMemoryUsed;
+
+        /// <inheritdoc />
+        public bool PurgeOldVersion(Guid id) => _writer.Submit(() => _inner.PurgeOldVersion(id));
+
+        /// <inheritdoc />
+        public int PurgeAllOldVersions() => _writer.Submit(() => _inner.PurgeAllOldVersions());
+
+        /// <inheritdoc />
+        public VersionReport VersionStatistics() => _inner.VersionStatistics();
+
+        /// <inheritdoc />
+        public StorageTier GetTier(Guid id) => _inner.GetTier(id);
+
+        /// <inheritdoc />
+        public Stream? ReadFixedDocument(Guid id) => _inner.ReadFixedDocument(id);
+
+        /// <inheritdoc />
+        public IEnumerable<LogRecord> ReadLogRecords(Guid id, long since) => _inner.ReadLogRecords(id, since);
+    }
+}
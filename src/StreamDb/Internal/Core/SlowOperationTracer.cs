@@ -0,0 +1,73 @@
+﻿using System.Collections.Generic;
+using System.Diagnostics;
+using System.Linq;
+using JetBrains.Annotations;
+
+namespace StreamDb.Internal.Core
+{
+    /// <summary>
+    /// Wraps the configured tracer, timing every span. Spans that run for at least the threshold are
+    /// written to the logger as a warning, with all the attributes set on them (document, path, pages touched...).
+    /// See `DatabaseOptions.SlowOperationThreshold`
+    /// </summary>
+    internal class SlowOperationTracer : ITracer
+    {
+        [NotNull] private readonly ITracer _inner;
+        [NotNull] private readonly ILogger _log;
+        private readonly long _thresholdTicks; // in Stopwatch ticks
+
+        public SlowOperationTracer([NotNull]ITracer inner, [NotNull]ILogger log, System.TimeSpan threshold)
+        {
+            _inner = inner;
+            _log = log;
+            _thresholdTicks = (long)(threshold.TotalSeconds * Stopwatch.Frequency);
+        }
+
+        /// <inheritdoc />
+        public ISpan StartSpan(string operationName)
+        {
+            return new TimedSpan(this, operationName, _inner.StartSpan(operationName));
+        }
+
+        private class TimedSpan : ISpan
+        {
+            [NotNull] private readonly SlowOperationTracer _parent;
+            [NotNull] private readonly string _operation;
+            [NotNull] private readonly ISpan _inner;
+            [NotNull] private readonly Dictionary<string, object?> _attributes = new Dictionary<string, object?>();
+            private readonly long _started;
+            private bool _ended;
+
+            public TimedSpan([NotNull]SlowOperationTracer parent, [NotNull]string operation, [NotNull]ISpan inner)
+            {
+                _parent = parent;
+                _operation = operation;
+                _inner = inner;
+                _started = Stopwatch.GetTimestamp();
+            }
+
+            public void SetAttribute(string key, object? value)
+            {
+                _attributes[key] = value; // last value wins, as the span's final state is what's logged
+                _inner.SetAttribute(key, value);
+            }
+
+            public void Dispose()
+            {
+                if (_ended) return;
+                _ended = true;
+
+                var elapsed = Stopwatch.GetTimestamp() - _started;
+                if (elapsed >= _parent._thresholdTicks)
+                {
+                    var durationMs = elapsed * 1000.0 / Stopwatch.Frequency;
+                    _inner.SetAttribute("slow", true);
+                    var fields = new List<object?> { "operation", _operation, "durationMs", durationMs };
+                    fields.AddRange(_attributes.SelectMany(kvp => new[] { kvp.Key, kvp.Value }));
+                    _parent._log.Warn("Slow operation", fields.ToArray());
+                }
+                _inner.Dispose();
+            }
+        }
+    }
+}
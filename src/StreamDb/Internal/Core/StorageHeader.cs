@@ -0,0 +1,57 @@
+﻿namespace StreamDb.Internal.Core
+{
+    /// <summary>
+    /// Snapshot of the storage header, as read by `PageStorage.Header()`.
+    /// This is for tooling and diagnostics. It is not kept up to date.
+    /// </summary>
+    public class StorageHeader
+    {
+        /// <summary> True if the stream starts with the expected magic bytes </summary>
+        public bool MagicValid { get; set; }
+
+        /// <summary> Storage format version stored in the header, or zero if the magic number is not valid. See `PageStorage.FORMAT_VERSION` </summary>
+        public int FormatVersion { get; set; }
+
+        /// <summary> Size of header in bytes. Pages start directly after this </summary>
+        public int HeaderSize { get; set; }
+
+        /// <summary> Total length of the storage stream in bytes </summary>
+        public long StreamLength { get; set; }
+
+        /// <summary> Number of whole pages that fit in the stream after the header </summary>
+        public int PageCount { get; set; }
+
+        /// <summary> Link to the end of the index page chain, or to the index root if the index is sharded </summary>
+        public HeaderLinkInfo IndexLink { get; set; } = new HeaderLinkInfo();
+
+        /// <summary> True if the index link points to a sharded index root. See `PageStorage.MigrateToShardedIndex` </summary>
+        public bool IndexSharded { get; set; }
+
+        /// <summary> Link to the end of the path-lookup page chain </summary>
+        public HeaderLinkInfo PathLookupLink { get; set; } = new HeaderLinkInfo();
+
+        /// <summary> Link to the end of the free-list page chain </summary>
+        public HeaderLinkInfo FreeListLink { get; set; } = new HeaderLinkInfo();
+    }
+
+    /// <summary>
+    /// Both revisions of a header `VersionedLink`
+    /// </summary>
+    public class HeaderLinkInfo
+    {
+        /// <summary> False if the link could not be decoded (e.g. both revisions claim the same version) </summary>
+        public bool IsValid { get; set; }
+
+        /// <summary> Page ID of the newest revision, or -1 if not set </summary>
+        public int Newest { get; set; } = -1;
+
+        /// <summary> Page ID of the previous revision, or -1 if not set </summary>
+        public int Previous { get; set; } = -1;
+
+        /// <inheritdoc />
+        public override string ToString()
+        {
+            return IsValid ? $"newest = {Newest}; previous = {Previous}" : "invalid";
+        }
+    }
+}
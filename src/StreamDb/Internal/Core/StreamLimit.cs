@@ -0,0 +1,161 @@
+﻿using System;
+using System.IO;
+using System.Threading;
+using JetBrains.Annotations;
+
+namespace StreamDb.Internal.Core
+{
+    /// <summary>
+    /// Counts document streams handed out to callers, against an optional limit.
+    /// Streams are wrapped so the count goes down when they are disposed (or closed), which also releases their cached pages.
+    /// Streams that are garbage collected without being disposed are logged. See `DatabaseOptions.MaxOpenStreams`
+    /// </summary>
+    internal class StreamLimit
+    {
+        [NotNull] private readonly object _lock = new object();
+        [NotNull] private readonly ILogger _log;
+        private readonly int _limit;
+        private readonly TimeSpan? _wait;
+        private int _open;
+
+        /// <param name="limit">Maximum streams open at once, or null for no limit</param>
+        /// <param name="wait">How long to wait for a stream to be disposed when at the limit, or null to fail straight away</param>
+        /// <param name="log">Logger for streams that were never disposed</param>
+        public StreamLimit(int? limit, TimeSpan? wait, [NotNull]ILogger log)
+        {
+            _log = log;
+            if (limit < 1) throw new ArgumentOutOfRangeException(nameof(limit), "Open stream limit must be at least one");
+            _limit = limit ?? int.MaxValue;
+            _wait = wait;
+        }
+
+        /// <summary>
+        /// Number of streams currently open
+        /// </summary>
+        public int Open { get { lock (_lock) { return _open; } } }
+
+        /// <summary>
+        /// Count a stream as open, and return a wrapper that releases it on dispose.
+        /// If the limit is reached, this waits (if allowed) then throws `StreamLimitException`.
+        /// The given stream is disposed if it can't be opened.
+        /// </summary>
+        /// <param name="stream">Stream to hand to the caller</param>
+        /// <param name="path">Path of the document, for diagnostics</param>
+        /// <param name="owner">Optional stream that `stream` reads through, to be disposed with it</param>
+        [NotNull]public Stream Track([NotNull]Stream stream, [NotNull]string path, Stream? owner = null)
+        {
+            try
+            {
+                Acquire();
+            }
+            catch
+            {
+                stream.Dispose();
+                owner?.Dispose();
+                throw;
+            }
+            return new TrackedStream(this, stream, path, owner);
+        }
+
+        private void Acquire()
+        {
+            lock (_lock)
+            {
+                if (_open >= _limit && _wait != null)
+                {
+                    var deadline = DateTime.UtcNow + _wait.Value;
+                    while (_open >= _limit)
+                    {
+                        var remaining = deadline - DateTime.UtcNow;
+                        if (remaining <= TimeSpan.Zero || !Monitor.Wait(_lock, remaining)) break;
+                    }
+                }
+                if (_open >= _limit) throw new StreamLimitException(_limit);
+                _open++;
+            }
+        }
+
+        private void Release()
+        {
+            lock (_lock)
+            {
+                _open = Math.Max(0, _open - 1);
+                Monitor.Pulse(_lock);
+            }
+        }
+
+        /// <summary>
+        /// Passes everything through to the wrapped stream, and releases its place in the count once, when disposed
+        /// </summary>
+        private class TrackedStream : Stream
+        {
+            [NotNull] private readonly StreamLimit _limit;
+            [NotNull] private readonly Stream _inner;
+            [NotNull] private readonly string _path;
+            private readonly Stream? _owner;
+            private int _released;
+
+            public TrackedStream([NotNull]StreamLimit limit, [NotNull]Stream inner, [NotNull]string path, Stream? owner)
+            {
+                _limit = limit;
+                _inner = inner;
+                _path = path;
+                _owner = owner;
+            }
+
+            /// <inheritdoc />
+            protected override void Dispose(bool disposing)
+            {
+                if (Interlocked.Exchange(ref _released, 1) == 0)
+                {
+                    _limit.Release();
+                    if (disposing)
+                    {
+                        _inner.Dispose();
+                        _owner?.Dispose();
+                    }
+                    else
+                    {
+                        // the inner streams have their own finalizers, which release their cached pages.
+                        // An exception thrown on the finalizer thread would end the process, so a failing logger is ignored.
+                        try { _limit._log.Warn("Document stream was not disposed", "path", _path); }
+                        catch { /* nowhere to report it */ }
+                    }
+                }
+                base.Dispose(disposing);
+            }
+
+            ~TrackedStream() { Dispose(false); }
+
+            /// <inheritdoc />
+            public override void Flush() { _inner.Flush(); }
+
+            /// <inheritdoc />
+            public override int Read(byte[] buffer, int offset, int count) { return _inner.Read(buffer, offset, count); }
+
+            /// <inheritdoc />
+            public override long Seek(long offset, SeekOrigin origin) { return _inner.Seek(offset, origin); }
+
+            /// <inheritdoc />
+            public override void SetLength(long value) { _inner.SetLength(value); }
+
+            /// <inheritdoc />
+            public override void Write(byte[] buffer, int offset, int count) { _inner.Write(buffer, offset, count); }
+
+            /// <inheritdoc />
+            public override bool CanRead => _inner.CanRead;
+
+            /// <inheritdoc />
+            public override bool CanSeek => _inner.CanSeek;
+
+            /// <inheritdoc />
+            public override bool CanWrite => _inner.CanWrite;
+
+            /// <inheritdoc />
+            public override long Length => _inner.Length;
+
+            /// <inheritdoc />
+            public override long Position { get => _inner.Position; set => _inner.Position = value; }
+        }
+    }
+}
@@ -0,0 +1,125 @@
+﻿using System;
+using System.IO;
+using JetBrains.Annotations;
+
+namespace StreamDb.Internal.Core
+{
+    /// <summary>
+    /// Moves document data between the main ('hot') storage and a second, 'cold' storage.
+    /// A demoted document keeps its index entry in hot storage, but the chain there is replaced
+    /// with a small stub, and the index entry gets the `Cold` flag. The data is held in the cold storage's
+    /// index under the same document ID.
+    /// </summary>
+    internal class TierStore
+    {
+        /*
+            Stub layout:
+                [ Magic (16 bytes) | Data length (int64) ]
+        */
+        [NotNull] private static readonly byte[] StubMagic = { 0x53, 0x44, 0x42, 0x2D, 0x43, 0x4F, 0x4C, 0x44, 0x2D, 0x53, 0x54, 0x55, 0x42, 0x2D, 0x0D, 0x0A };
+        private const int StubSize = 16 + 8;
+
+        [NotNull] private readonly IStorageEngine _hot;
+        private readonly IStorageEngine? _cold;
+        [NotNull] private readonly ILogger _log;
+        [NotNull] private readonly object _moveLock = new object();
+
+        public TierStore([NotNull]IStorageEngine hot, IStorageEngine? cold, [NotNull]ILogger log)
+        {
+            _hot = hot;
+            _cold = cold;
+            _log = log;
+        }
+
+        /// <summary>
+        /// Return a stream for the stored data. If the index flags mark the document as cold, this reads from cold storage instead.
+        /// </summary>
+        [NotNull]public Stream Resolve(Guid id, [NotNull]Stream stored, DocumentFlags flags)
+        {
+            if ((flags & DocumentFlags.Cold) == 0) return stored;
+            if (_cold == null) throw new Exception($"Document {id} is in cold storage, but no cold storage is configured");
+
+            var head = _cold.GetDocumentHead(id);
+            if (head < 0) throw new Exception($"Document {id} is missing from cold storage");
+            return _cold.GetStream(head);
+        }
+
+        /// <summary>
+        /// Copy a document's data to cold storage, and replace its hot chain with a stub.
+        /// Does nothing if the document is already cold.
+        /// </summary>
+        public void Demote(Guid id)
+        {
+            if (_cold == null) throw new Exception("Can't demote documents: no cold storage is configured");
+            lock (_moveLock)
+            {
+                var hotHead = _hot.GetDocumentHead(id, out var flags);
+                if (hotHead < 0) throw new Exception("Document not found");
+                if ((flags & DocumentFlags.Cold) != 0) return;
+                var data = _hot.GetStream(hotHead);
+                var stat = _hot.GetIndexStat(id);
+
+                var coldHead = _cold.WriteStream(data);
+                _cold.BindIndex(id, coldHead, out var coldExpired);
+                _cold.ReleaseChain(coldExpired);
+
+                var stub = new MemoryStream(StubSize);
+                var w = new BinaryWriter(stub);
+                w.Write(StubMagic);
+                w.Write(data.Length);
+                stub.Seek(0, SeekOrigin.Begin);
+
+                // Rebind from scratch, so the old hot data is not kept as the previous version
+                var stubHead = _hot.WriteStream(stub);
+                _hot.UnbindIndex(id);
+                _hot.BindIndex(id, stubHead, out _, stat?.Length ?? -1, flags | DocumentFlags.Cold);
+                _hot.ReleaseChain(hotHead);
+
+                _log.Debug("Demoted document", "id", id, "bytes", data.Length);
+            }
+        }
+
+        /// <summary>
+        /// Copy a document's data back from cold storage, and remove the cold copy.
+        /// Does nothing if the document is already hot.
+        /// </summary>
+        public void Promote(Guid id)
+        {
+            lock (_moveLock)
+            {
+                var hotHead = _hot.GetDocumentHead(id, out var flags);
+                if (hotHead < 0) throw new Exception("Document not found");
+                if ((flags & DocumentFlags.Cold) == 0) return;
+                if (_cold == null) throw new Exception("Can't promote documents: no cold storage is configured");
+
+                var coldHead = _cold.GetDocumentHead(id);
+                if (coldHead < 0) throw new Exception($"Document {id} is missing from cold storage");
+                var data = _cold.GetStream(coldHead);
+                var stat = _hot.GetIndexStat(id);
+
+                var newHead = _hot.WriteStream(data);
+                _hot.UnbindIndex(id);
+                _hot.BindIndex(id, newHead, out _, stat?.Length ?? -1, flags & ~DocumentFlags.Cold);
+                _hot.ReleaseChain(hotHead);
+
+                _cold.UnbindIndex(id);
+                _cold.ReleaseChain(coldHead);
+
+                _log.Debug("Promoted document", "id", id, "bytes", data.Length);
+            }
+        }
+
+        /// <summary>
+        /// If the index flags mark the document as cold, remove its data from cold storage.
+        /// Does nothing for hot documents.
+        /// </summary>
+        public void ReleaseStub(Guid id, DocumentFlags flags)
+        {
+            if (_cold == null || (flags & DocumentFlags.Cold) == 0) return;
+
+            var head = _cold.GetDocumentHead(id);
+            _cold.UnbindIndex(id);
+            _cold.ReleaseChain(head);
+        }
+    }
+}
@@ -0,0 +1,38 @@
+﻿using System;
+using JetBrains.Annotations;
+
+namespace StreamDb.Internal.Core
+{
+    /// <summary>
+    /// Kind of change staged in a `Transaction`
+    /// </summary>
+    internal enum TransactionOperation
+    {
+        /// <summary> Bind a newly written document to a path, replacing any document there </summary>
+        Write,
+        /// <summary> Bind an existing document to an additional path </summary>
+        Bind,
+        /// <summary> Delete the document bound to a path, and unbind all its paths </summary>
+        Delete
+    }
+
+    /// <summary>
+    /// A single change staged in a `Transaction`, waiting to be applied on commit
+    /// </summary>
+    internal class TransactionStep
+    {
+        public TransactionOperation Operation { get; set; }
+
+        [NotNull] public string Path { get; set; } = "";
+
+        /// <summary> Document written or bound. Empty for deletes </summary>
+        public Guid DocumentId { get; set; }
+
+        public string? Annotation { get; set; }
+
+        public BindingAttributes Attributes { get; set; }
+
+        /// <summary> Size of written data in bytes, for the audit log </summary>
+        public long Size { get; set; }
+    }
+}
@@ -0,0 +1,134 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using JetBrains.Annotations;
+using StreamDb.Internal.DbStructure;
+using StreamDb.Internal.Support;
+
+namespace StreamDb.Internal.Core
+{
+    /// <summary>
+    /// Redo log of index page images, kept in a separate stream. The index pages changed in place by a change are appended
+    /// and flushed here together before any of them is written to storage, and the log is cleared once storage has been
+    /// flushed. After a crash, the images left in the log are written again, so no index page is left torn.
+    /// Document data and path lookups are always written to new pages before a link flips, so they are not logged.
+    /// <para></para>
+    /// The log can't live in the storage file itself: the header is the magic number and the three core links with pages
+    /// straight after, so there is nowhere fixed to find a log chain without moving every page, and a chain found through
+    /// the index would depend on the pages it is there to repair. See `DatabaseOptions.WriteAheadLog`
+    /// </summary>
+    internal class WriteAheadLog
+    {
+        /*
+            Log layout: any number of records, each
+                [ Magic (4 bytes) | Page ID (int32) | CRC32 of page ID and image (uint32) | Page image (BasicPage.PageRawSize) ]
+
+            Records are only added at the end. A record cut short or failing its CRC was never applied to storage,
+            so it, and anything after it, is ignored.
+        */
+        [NotNull] private static readonly byte[] RecordMagic = { (byte)'S', (byte)'D', (byte)'B', (byte)'W' };
+        private const int RecordHeaderSize = 12;
+        public const int RecordSize = RecordHeaderSize + BasicPage.PageRawSize;
+
+        [NotNull] private readonly Stream _log;
+
+        public WriteAheadLog([NotNull]Stream log)
+        {
+            if (!log.CanRead || !log.CanWrite || !log.CanSeek) throw new ArgumentException("Write-ahead log stream must support reading, writing and seeking", nameof(log));
+            _log = log;
+        }
+
+        /// <summary>
+        /// True if the log holds records not yet cleared
+        /// </summary>
+        public bool HasRecords => _log.Length > 0;
+
+        /// <summary>
+        /// Add page images to the end of the log, then flush them through to disk together
+        /// </summary>
+        public void Append([NotNull]IEnumerable<KeyValuePair<int, byte[]>> images)
+        {
+            var record = new byte[RecordSize];
+            var start = _log.Seek(0, SeekOrigin.End);
+            try
+            {
+                foreach (var image in images)
+                {
+                    if (image.Value == null || image.Value.Length != BasicPage.PageRawSize) throw new Exception($"Page image for the write-ahead log must be {BasicPage.PageRawSize} bytes");
+
+                    Array.Copy(RecordMagic, record, RecordMagic.Length);
+                    Array.Copy(BitConverter.GetBytes(image.Key), 0, record, 4, 4);
+                    Array.Copy(image.Value, 0, record, RecordHeaderSize, image.Value.Length);
+                    Array.Copy(BitConverter.GetBytes(Checksum(record)), 0, record, 8, 4);
+                    _log.Write(record, 0, record.Length);
+                }
+                FlushToDisk();
+            }
+            catch
+            {
+                // Don't leave a torn record in the way of records appended later
+                try { _log.SetLength(start); } catch { /* replay stops at the torn record */ }
+                throw;
+            }
+        }
+
+        /// <summary>
+        /// Call `apply` for each complete record in the log, oldest first. Returns the number of records applied.
+        /// Reading stops at the first record that is cut short or fails its check.
+        /// </summary>
+        public int Replay([NotNull]Action<int, byte[]> apply)
+        {
+            var count = 0;
+            var record = new byte[RecordSize];
+            _log.Seek(0, SeekOrigin.Begin);
+            while (true)
+            {
+                var read = 0;
+                while (read < record.Length)
+                {
+                    var got = _log.Read(record, read, record.Length - read);
+                    if (got < 1) break;
+                    read += got;
+                }
+                if (read < record.Length) break;
+
+                var magicOk = true;
+                for (int i = 0; i < RecordMagic.Length; i++) { if (record[i] != RecordMagic[i]) magicOk = false; }
+                if (!magicOk || BitConverter.ToUInt32(record, 8) != Checksum(record)) break;
+
+                var image = new byte[BasicPage.PageRawSize];
+                Array.Copy(record, RecordHeaderSize, image, 0, image.Length);
+                apply(BitConverter.ToInt32(record, 4), image);
+                count++;
+            }
+            return count;
+        }
+
+        /// <summary>
+        /// Remove all records. Only call once the pages they hold have been flushed to storage.
+        /// </summary>
+        public void Clear()
+        {
+            if (_log.Length == 0) return;
+            _log.SetLength(0);
+            FlushToDisk();
+        }
+
+        private void FlushToDisk()
+        {
+            if (_log is FileStream file) file.Flush(flushToDisk: true);
+            else _log.Flush();
+        }
+
+        /// <summary>
+        /// CRC of a record's page ID and image, skipping the magic and the CRC slot itself
+        /// </summary>
+        private static uint Checksum([NotNull]byte[] record)
+        {
+            var covered = new byte[record.Length - 8];
+            Array.Copy(record, 4, covered, 0, 4);
+            Array.Copy(record, RecordHeaderSize, covered, 4, record.Length - RecordHeaderSize);
+            return Crc32.Compute(covered);
+        }
+    }
+}
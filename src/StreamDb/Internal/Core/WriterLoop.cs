@@ -0,0 +1,116 @@
+﻿using System;
+using System.Collections.Concurrent;
+using System.Runtime.ExceptionServices;
+using System.Threading;
+using System.Threading.Tasks;
+using JetBrains.Annotations;
+
+namespace StreamDb.Internal.Core
+{
+    /// <summary>
+    /// A single long-running writer that applies queued mutations one at a time, in submission order.
+    /// Mutations submitted from the writer itself run immediately, so a queued job can call back into the database.
+    /// </summary>
+    internal class WriterLoop : IDisposable
+    {
+        [NotNull] private readonly BlockingCollection<WriteJob> _queue = new BlockingCollection<WriteJob>();
+        [NotNull] private readonly Task _worker;
+        [NotNull] private readonly ILogger _log;
+        private volatile int _writerThreadId;
+
+        private class WriteJob
+        {
+            [NotNull] public readonly Action Action;
+            [NotNull] public readonly TaskCompletionSource<bool> Done = new TaskCompletionSource<bool>();
+            public WriteJob([NotNull]Action action) { Action = action; }
+        }
+
+        public WriterLoop([NotNull]ILogger log)
+        {
+            _log = log;
+            _worker = Task.Factory.StartNew(Run, CancellationToken.None, TaskCreationOptions.LongRunning, TaskScheduler.Default);
+        }
+
+        /// <summary>
+        /// True if the calling thread is the writer
+        /// </summary>
+        public bool OnWriter => Environment.CurrentManagedThreadId == _writerThreadId;
+
+        /// <summary>
+        /// Queue a mutation and wait for it to complete. Exceptions from the mutation are rethrown here.
+        /// </summary>
+        public T Submit<T>([NotNull]Func<T> mutation)
+        {
+            if (OnWriter) return mutation();
+
+            var result = default(T)!;
+            var task = Post(() => { result = mutation(); });
+            try
+            {
+                task.Wait();
+            }
+            catch (AggregateException ex) when (ex.InnerException != null)
+            {
+                ExceptionDispatchInfo.Capture(ex.InnerException).Throw();
+            }
+            return result;
+        }
+
+        /// <summary>
+        /// Queue a mutation and wait for it to complete. Exceptions from the mutation are rethrown here.
+        /// </summary>
+        public void Submit([NotNull]Action mutation)
+        {
+            Submit(() => { mutation(); return true; });
+        }
+
+        /// <summary>
+        /// Queue a mutation without waiting. The returned task completes when the mutation has been applied,
+        /// and carries any exception it threw.
+        /// </summary>
+        [NotNull]public Task Post([NotNull]Action mutation)
+        {
+            var job = new WriteJob(mutation);
+            if (OnWriter)
+            {
+                Apply(job);
+                return job.Done.Task;
+            }
+            if (_queue.IsAddingCompleted) throw new ObjectDisposedException(nameof(WriterLoop), "The database writer has been stopped");
+            _queue.Add(job);
+            return job.Done.Task;
+        }
+
+        private void Run()
+        {
+            _writerThreadId = Environment.CurrentManagedThreadId;
+            foreach (var job in _queue.GetConsumingEnumerable())
+            {
+                Apply(job);
+            }
+        }
+
+        private void Apply([NotNull]WriteJob job)
+        {
+            try
+            {
+                job.Action();
+                job.Done.SetResult(true);
+            }
+            catch (Exception ex)
+            {
+                _log.Debug("Queued write failed", "error", ex.Message);
+                job.Done.SetException(ex);
+            }
+        }
+
+        /// <summary>
+        /// Finish all queued mutations, then stop the writer
+        /// </summary>
+        public void Dispose()
+        {
+            _queue.CompleteAdding();
+            if (!OnWriter) _worker.Wait();
+        }
+    }
+}
@@ -0,0 +1,84 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using JetBrains.Annotations;
+using StreamDb.Internal.Support;
+
+namespace StreamDb.Internal.DbStructure
+{
+    /// <summary>
+    /// Content of the access control document: owner and grants for each document that has them.
+    /// This is stored as a normal document chain, bound in the index to a reserved ID (see `ReservedDocIds`) and to no paths.
+    /// </summary>
+    public class AccessList : IStreamSerialisable
+    {
+        /*
+            Layout: [ Entry count (int32) ] then for each entry:
+            [ Doc Guid (16 bytes) | Has owner (byte) | Owner (string, if present) | Grant count (int32) ]
+            then [ Principal (string) | Rights (byte) ] for each grant.
+            Strings are written by `BinaryWriter` (length prefixed UTF-8).
+        */
+
+        [NotNull] public Dictionary<Guid, AccessControl> Entries { get; } = new Dictionary<Guid, AccessControl>();
+
+        /// <inheritdoc />
+        public Stream Freeze()
+        {
+            var ms = new MemoryStream();
+            var w = new BinaryWriter(ms);
+
+            w.Write(Entries.Count);
+            foreach (var entry in Entries)
+            {
+                w.Write(entry.Key.ToByteArray());
+                w.Write(entry.Value.Owner != null);
+                if (entry.Value.Owner != null) w.Write(entry.Value.Owner);
+
+                w.Write(entry.Value.Grants.Count);
+                foreach (var grant in entry.Value.Grants)
+                {
+                    w.Write(grant.Key);
+                    w.Write((byte)grant.Value);
+                }
+            }
+
+            ms.Seek(0, SeekOrigin.Begin);
+            return ms;
+        }
+
+        /// <inheritdoc />
+        public void Defrost(Stream source)
+        {
+            Entries.Clear();
+            if (source == null || source.Length < 4) return;
+            var r = new BinaryReader(source);
+
+            try
+            {
+                var count = r.ReadInt32();
+                for (int i = 0; i < count; i++)
+                {
+                    var id = new Guid(r.ReadBytes(16));
+                    var control = new AccessControl();
+                    if (r.ReadBoolean()) control.Owner = r.ReadString();
+
+                    var grants = r.ReadInt32();
+                    for (int j = 0; j < grants; j++)
+                    {
+                        var principal = r.ReadString();
+                        control.Grants[principal] = (AccessRights)r.ReadByte();
+                    }
+                    Entries[id] = control;
+                }
+            }
+            catch (EndOfStreamException ex)
+            {
+                throw new Exception("Access control list is truncated", ex);
+            }
+            catch (ArgumentException ex)
+            {
+                throw new Exception("Access control list is truncated", ex);
+            }
+        }
+    }
+}
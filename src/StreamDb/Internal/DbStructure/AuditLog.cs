@@ -0,0 +1,54 @@
+﻿using System;
+using System.IO;
+using System.Text;
+using JetBrains.Annotations;
+
+namespace StreamDb.Internal.DbStructure
+{
+    /// <summary>
+    /// Encoding for audit log entries. The log is stored as an append-only record chain (see `PageStorage.AppendRecord`),
+    /// bound in the index to a reserved ID (see `ReservedDocIds`), and to a path under `Database.SystemNamespace`.
+    /// </summary>
+    internal static class AuditLog
+    {
+        /// <summary> Paths longer than this (in UTF-8 bytes) are truncated in the log </summary>
+        public const int MaxPathBytes = 2048;
+
+        /*
+            Layout: [ Timestamp, UTC ticks (int64) | Operation (byte) | Doc Guid (16 bytes) | Size (int64) | Path (UTF-8, rest of the record) ]
+        */
+
+        [NotNull]public static byte[] Encode([NotNull]AuditRecord record)
+        {
+            var ms = new MemoryStream();
+            var w = new BinaryWriter(ms);
+            w.Write(record.Timestamp.Ticks);
+            w.Write((byte)record.Operation);
+            w.Write(record.DocumentId.ToByteArray());
+            w.Write(record.Size);
+
+            if (record.Path != null)
+            {
+                var path = Encoding.UTF8.GetBytes(record.Path);
+                w.Write(path, 0, Math.Min(path.Length, MaxPathBytes));
+            }
+            return ms.ToArray() ?? throw new Exception("Failed to encode audit record");
+        }
+
+        [NotNull]public static AuditRecord Decode([NotNull]byte[] data)
+        {
+            const int fixedSize = 8 + 1 + 16 + 8;
+            if (data.Length < fixedSize) throw new Exception("Audit record is truncated");
+            var r = new BinaryReader(new MemoryStream(data));
+
+            var result = new AuditRecord {
+                Timestamp = new DateTime(r.ReadInt64(), DateTimeKind.Utc),
+                Operation = (AuditOperation)r.ReadByte(),
+                DocumentId = new Guid(r.ReadBytes(16)),
+                Size = r.ReadInt64()
+            };
+            if (data.Length > fixedSize) result.Path = Encoding.UTF8.GetString(data, fixedSize, data.Length - fixedSize);
+            return result;
+        }
+    }
+}
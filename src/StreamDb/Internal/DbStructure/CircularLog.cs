@@ -0,0 +1,35 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using System.Linq;
+using JetBrains.Annotations;
+using StreamDb.Internal.Support;
+
+namespace StreamDb.Internal.DbStructure
+{
+    /// <summary>
+    /// Circular logs: framed records (see `RecordFraming`) appended to a fixed document (see `FixedDocumentStore`),
+    /// so they run across page boundaries and wrap around the ring. When old data is overwritten, the oldest
+    /// record is usually cut part way through; the reader skips forward to the next whole record.
+    /// </summary>
+    internal static class CircularLog
+    {
+        [NotNull]public static byte[] Encode([NotNull]byte[] record)
+        {
+            return RecordFraming.Frame(record);
+        }
+
+        /// <summary>
+        /// Read the records held in a ring, oldest first.
+        /// </summary>
+        /// <param name="data">Data read from the ring, oldest first</param>
+        /// <param name="tail">Log position of the first byte of `data`</param>
+        /// <param name="since">Only return records at or after this position</param>
+        [NotNull, ItemNotNull]public static IEnumerable<LogRecord> Decode([NotNull]byte[] data, long tail, long since)
+        {
+            var start = Math.Max(0, since - tail);
+            return RecordFraming.Read(new MemoryStream(data, false), start)
+                .Select(r => new LogRecord { Position = tail + r.Key, Data = r.Value });
+        }
+    }
+}
@@ -1,211 +1,540 @@
-﻿using System;
-using System.IO;
-using JetBrains.Annotations;
-using StreamDb.Internal.Support;
-
-namespace StreamDb.Internal.DbStructure
-{
-    /// <summary>
-    /// Content of a single index page
-    /// </summary>
-    public class IndexPage : IStreamSerialisable
-    {
-
-        const int EntryCount = 126; // 2+4+8+16+32+64
-        const int PackedSize = 3276; // (16+5+5) * 126
-        
-        /// <summary> This is the implicit root index. It is not allowed as a real document ID </summary>
-        public static readonly Guid NeutralDocId = new Guid(new byte[] { 127, 127, 127, 127, 127, 127, 127, 127, 127, 127, 127, 127, 127, 127, 127, 127 });
-        /// <summary> This is an ID that means 'no document'. It is not allowed as a real document ID. </summary>
-        public static readonly Guid ZeroDocId = Guid.Empty;
-
-
-        [NotNull, ItemNotNull] private readonly VersionedLink[] _links;
-        [NotNull] private readonly Guid[] _docIds;
-
-        /*
-
-            Layout: [ Doc Guid (16 bytes) | PageLink[0] (5 bytes) | PageLink[1] (5 bytes) ] --> 26 bytes
-            We can fit 157 in a 4k page. Gives us 6 ranks (126 entries) -> 3276 bytes
-            Our pages are currently 4061 bytes, so we have plenty of spare space if we can find useful metadata to store.
-
-            We assume but don't store a root page with guid {127,127...,127}. The first two entries are 'left' and 'right' on the second level.
-
-        */
-
-        public IndexPage()
-        {
-            _links = new VersionedLink[EntryCount];
-            for (int i = 0; i < EntryCount; i++) { _links[i] = new VersionedLink(); }
-
-            _docIds = new Guid[EntryCount];
-        }
-
-        const int SAME =  0;
-        const int LESS =  -1;
-        const int GREATER =  1;
-
-        /// <summary>
-        /// Try to add a new link to the index.
-        /// Returns true if written, false if the index page has no space for this entry.
-        /// If the document already exists, an exception will be thrown.
-        /// </summary>
-        /// <param name="docId">Unique ID of the document to be inserted</param>
-        /// <param name="pageId">PageID of the LAST page in the document's chain.</param>
-        /// <returns>True if written, false if not</returns>
-        public bool TryInsert(Guid docId, int pageId)
-        {
-            var index = Find(docId);
-            if (index < 0 || index >= EntryCount) return false; // no space
-
-            if (_docIds[index] != ZeroDocId) throw new Exception("Tried to insert a duplicate document ID");
-
-            // found a space. Stick it in.
-            _links[index].WriteNewLink(pageId, out _);
-            _docIds[index] = docId;
-            return true;
-
-        }
-
-        /// <summary>
-        /// Try to find a link in this index page. Returns true if found, false if not found.
-        /// If found, this will return up to two page options. Use the newest one with a valid CRC in the page.
-        /// </summary>
-        /// <param name="docId">Document ID to find</param>
-        /// <param name="link">If found, this is the page link options. May be null</param>
-        public bool Search(Guid docId, out VersionedLink? link) {
-            link = null;
-
-            var index = Find(docId);
-            if (index < 0 || index >= EntryCount) return false; // not found
-            if (_docIds[index] == ZeroDocId) return false; // not found
-            if (_docIds[index] != docId) throw new Exception("IndexPage.Search: Logic error");
-
-            link = _links[index];
-
-            return true;
-        }
-
-        /// <summary>
-        /// Update a link with a new PageID. The oldest link will be updated.
-        /// Returns true if a change was made. False if the link was not found in this index page
-        /// </summary>
-        /// <param name="docId">ID of document to update</param>
-        /// <param name="pageId">PageID of the LAST page in the new document chain to be inserted</param>
-        /// <param name="expiredPage">If an old value is lost, this is PageID. Otherwise -1</param>
-        /// <remarks>If an existing chain is de-linked by this, all the pages should be added to the free list</remarks>
-        public bool Update(Guid docId, int pageId, out int expiredPage) {
-            expiredPage = -1;
-
-            // find the entry to update
-            var index = Find(docId);
-            if (index < 0 || index >= EntryCount) return false; // not found
-            if (_docIds[index] == ZeroDocId) return false; // not found
-            if (_docIds[index] != docId) throw new Exception("IndexPage.Search: Logic error");
-
-            _links[index].WriteNewLink(pageId, out expiredPage);
-            return true;
-        }
-
-        
-        /// <summary>
-        /// Update a link to set an invalid link. Both versions of the link will be lost.
-        /// Returns true if a change was made. False if the link was not found in this index page
-        /// </summary>
-        /// <param name="docId">ID of document to update</param>
-        /// <returns></returns>
-        public bool Remove(Guid docId)
-        {
-            // find the entry to update
-            var index = Find(docId);
-            if (index < 0 || index >= EntryCount) return false; // not found
-            if (_docIds[index] == ZeroDocId) return false; // not found
-            if (_docIds[index] != docId) throw new Exception("IndexPage.Search: Logic error");
-
-            _links[index] = new VersionedLink(); // entirely reset
-            return true;
-        }
-
-        /// <summary>
-        /// Find tries to find an entry index by a guid key. This is used in insert, search, update.
-        /// If no such entry exists, but there is a space for it, you will get a valid index whose
-        /// `_docIds` entry is Guid.Zero -- so always check.
-        /// </summary>
-        private int Find(Guid target) {
-            // the implicit node:
-            var cmpNode = NeutralDocId;
-            int leftIdx = 0;
-            int rightIdx = 1;
-
-            var current = -1;
-
-            // loop start
-            for (int i = 0; i < 7; i++)
-            {
-                switch (cmpNode.CompareTo(target))
-                {
-                    case SAME: return current;
-
-                    case LESS:
-                        // move left
-                        current = leftIdx;
-                        break;
-
-                    case GREATER:
-                        // move right
-                        current = rightIdx;
-                        break;
-
-                    default: throw new Exception("IndexTree.TryInsert: Unexpected case.");
-                }
-
-                // update next step pointers
-                leftIdx = (current * 2) + 2;
-                rightIdx = (current * 2) + 3;
-
-                // check we're in bounds
-                if (current < 0) throw new Exception("IndexTree.TryInsert: Logic error");
-                if (current >= EntryCount) return -1;
-                
-                cmpNode = _docIds[current];
-                if (cmpNode == ZeroDocId) { return current; } // empty space
-            }
-            // loop end
-
-            throw new Exception("IndexTree.TryInsert: Out of loops bounds. Exited due to safety check.");
-        }
-
-        /// <inheritdoc />
-        public void Defrost(Stream source)
-        {
-            if (source == null || source.Length < PackedSize) throw new Exception("IndexPage.FromBytes: data was too short.");
-            var r = new BinaryReader(source);
-
-            for (int i = 0; i < EntryCount; i++)
-            {
-                var bytes = r.ReadBytes(16);
-                if (bytes == null) throw new Exception("Failed to read doc guid");
-                _docIds[i] = new Guid(bytes);
-
-
-                _links[i].Defrost(r.BaseStream);
-            }
-        }
-
-        /// <inheritdoc />
-        public Stream Freeze()
-        {
-            var ms = new MemoryStream(PackedSize);
-            var w = new BinaryWriter(ms);
-
-            for (int i = 0; i < EntryCount; i++)
-            {
-                w.Write(_docIds[i].ToByteArray());
-                _links[i].Freeze().CopyTo(ms);
-            }
-
-            ms.Seek(0, SeekOrigin.Begin);
-            return ms;
-        }
-    }
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using JetBrains.Annotations;
+using StreamDb.Internal.Support;
+
+namespace StreamDb.Internal.DbStructure
+{
+    /// <summary>
+    /// Content of a single index page
+    /// </summary>
+    public class IndexPage : IStreamSerialisable
+    {
+
+        const int EntryCount = 126; // 2+4+8+16+32+64
+        const int PackedSize = 3276; // (16+5+5) * 126
+        const int MetadataSize = 756; // (4+2) * 126
+        const int PivotSize = 16; // one Guid
+
+        /// <summary> Largest length that can be stored in entry metadata. Longer documents are stored as 'length unknown' </summary>
+        public const long MaxMetadataLength = (1L << 28) - 1;
+        [NotNull] private static readonly DateTime DayZero = new DateTime(2000, 1, 1, 0, 0, 0, DateTimeKind.Utc);
+
+        // flag bits in the top nibble of the metadata word
+        private const uint MetaPresent = 1u << 28;
+        private const uint MetaLengthKnown = 1u << 29;
+        private const int MetaFlagShift = 30; // two bits of DocumentFlags
+        
+        /// <summary> This is an ID that means 'no document'. It is not allowed as a real document ID. </summary>
+        public static readonly Guid ZeroDocId = Guid.Empty;
+
+
+        [NotNull, ItemNotNull] private readonly VersionedLink[] _links;
+        [NotNull] private readonly Guid[] _docIds;
+        [NotNull] private readonly uint[] _meta;
+        [NotNull] private readonly ushort[] _modifiedDays;
+        private Guid _pivot;
+
+        /*
+
+            Layout: [ Doc Guid (16 bytes) | PageLink[0] (5 bytes) | PageLink[1] (5 bytes) ] --> 26 bytes
+            We can fit 157 in a 4k page. Gives us 6 ranks (126 entries) -> 3276 bytes
+
+            The spare space after the entries holds per-entry metadata, in the same order:
+            [ Length and flags (uint32) | Last modified (uint16, days since 2000-01-01) ] --> 6 bytes * 126 = 756 bytes
+            Length takes the low 28 bits. Bit 28 marks metadata as present, bit 29 marks the length as known,
+            and bits 30-31 are `DocumentFlags`. Pages written before metadata was added are shorter, and read as 'no metadata'.
+
+            We assume but don't store a root page with guid {127,127...,127}. The first two entries are 'left' and 'right' on the second level.
+
+            After the metadata is the pivot: the doc id used in place of that implicit root. A page that fills on one side
+            is rebuilt around the median of its entries (see `TryRebalanceInsert`), so a hot range of ids gets the whole page
+            rather than one 6-deep path. IDs equal to a custom pivot go 'left'. Pages written before this are read with the neutral pivot.
+
+            A removed entry keeps its doc id, with no valid links. This is a 'tombstone': it must stay in place to guide searches
+            through the tree, but its slot can be claimed by a new doc id that sorts correctly against the tombstone's subtrees.
+            `Compact` rebuilds the tree from live entries only, dropping all tombstones.
+
+        */
+
+        public IndexPage()
+        {
+            _links = new VersionedLink[EntryCount];
+            for (int i = 0; i < EntryCount; i++) { _links[i] = new VersionedLink(); }
+
+            _docIds = new Guid[EntryCount];
+            _meta = new uint[EntryCount];
+            _modifiedDays = new ushort[EntryCount];
+            _pivot = ReservedDocIds.Neutral;
+        }
+
+        const int SAME =  0;
+        const int LESS =  -1;
+        const int GREATER =  1;
+
+        /// <summary>
+        /// Try to add a new link to the index.
+        /// Returns true if written, false if the index page has no space for this entry.
+        /// If the document already exists, an exception will be thrown.
+        /// </summary>
+        /// <param name="docId">Unique ID of the document to be inserted</param>
+        /// <param name="pageId">PageID of the LAST page in the document's chain.</param>
+        /// <param name="length">Length of the document in bytes, or -1 if not known</param>
+        /// <param name="flags">Storage flags for the document</param>
+        /// <returns>True if written, false if not</returns>
+        public bool TryInsert(Guid docId, int pageId, long length = -1, DocumentFlags flags = DocumentFlags.None)
+        {
+            var index = FindInsertSlot(docId);
+            if (index < 0 || index >= EntryCount) return false; // no space
+
+            if (_docIds[index] != ZeroDocId && !IsTombstone(index)) throw new Exception("Tried to insert a duplicate document ID");
+
+            // found a space. Stick it in.
+            _links[index] = new VersionedLink();
+            _links[index].WriteNewLink(pageId, out _);
+            _docIds[index] = docId;
+            SetMetadata(index, length, flags);
+            return true;
+
+        }
+
+        /// <summary>
+        /// Try to add a new link to the index, rebuilding the page as a balanced tree around a new pivot if
+        /// the entry's region of the page is full. Use this when `TryInsert` fails, before extending the index.
+        /// Returns false only if every slot in the page holds a live entry.
+        /// </summary>
+        public bool TryRebalanceInsert(Guid docId, int pageId, long length = -1, DocumentFlags flags = DocumentFlags.None)
+        {
+            if (LiveCount() >= EntryCount) return false;
+            if (Find(docId) is var existing && existing >= 0 && existing < EntryCount && _docIds[existing] == docId && !IsTombstone(existing))
+                throw new Exception("Tried to insert a duplicate document ID");
+
+            // The new entry takes the extra slot at the end of the working arrays
+            var link = new VersionedLink();
+            link.WriteNewLink(pageId, out _);
+            MakeMetadata(length, flags, out var meta, out var day);
+
+            Rebuild(docId, link, meta, day, recentre: true);
+            return true;
+        }
+
+        /// <summary>
+        /// Number of slots holding a live entry. A page is full when this reaches 126;
+        /// before then, `TryRebalanceInsert` can always make space.
+        /// </summary>
+        public int LiveCount()
+        {
+            var count = 0;
+            for (int i = 0; i < EntryCount; i++)
+            {
+                if (_docIds[i] != ZeroDocId && !IsTombstone(i)) count++;
+            }
+            return count;
+        }
+
+        /// <summary>
+        /// Total number of entry slots in an index page
+        /// </summary>
+        public static int Capacity => EntryCount;
+
+        /// <summary>
+        /// The doc id this page's tree is arranged around. This is `ReservedDocIds.Neutral` unless the page has been rebalanced.
+        /// </summary>
+        public Guid Pivot => _pivot;
+
+        /// <summary>
+        /// Try to copy a live entry from another index page, keeping both its links and its metadata.
+        /// Returns true if written, false if the entry is not live in `source`, or this page has no space for it.
+        /// </summary>
+        public bool TryCopyEntry([NotNull]IndexPage source, Guid docId)
+        {
+            var from = source.Find(docId);
+            if (from < 0 || from >= EntryCount || source._docIds[from] != docId || source.IsTombstone(from)) return false;
+
+            var index = FindInsertSlot(docId);
+            if (index < 0 || index >= EntryCount) return false; // no space
+            if (_docIds[index] != ZeroDocId && !IsTombstone(index)) throw new Exception("Tried to insert a duplicate document ID");
+
+            var link = new VersionedLink();
+            link.Defrost(source._links[from].Freeze());
+            _links[index] = link;
+            _docIds[index] = docId;
+            _meta[index] = source._meta[from];
+            _modifiedDays[index] = source._modifiedDays[from];
+            return true;
+        }
+
+        /// <summary>
+        /// Try to find a link in this index page. Returns true if found, false if not found.
+        /// If found, this will return up to two page options. Use the newest one with a valid CRC in the page.
+        /// </summary>
+        /// <param name="docId">Document ID to find</param>
+        /// <param name="link">If found, this is the page link options. May be null</param>
+        public bool Search(Guid docId, out VersionedLink? link) {
+            link = null;
+
+            var index = Find(docId);
+            if (index < 0 || index >= EntryCount) return false; // not found
+            if (_docIds[index] == ZeroDocId) return false; // not found
+            if (_docIds[index] != docId) throw new Exception("IndexPage.Search: Logic error");
+            if (IsTombstone(index)) return false; // removed
+
+            link = _links[index];
+
+            return true;
+        }
+
+        /// <summary>
+        /// Update a link with a new PageID. The oldest link will be updated.
+        /// Returns true if a change was made. False if the link was not found in this index page
+        /// </summary>
+        /// <param name="docId">ID of document to update</param>
+        /// <param name="pageId">PageID of the LAST page in the new document chain to be inserted</param>
+        /// <param name="expiredPage">If an old value is lost, this is PageID. Otherwise -1</param>
+        /// <param name="length">Length of the new document version in bytes, or -1 if not known</param>
+        /// <param name="flags">Storage flags for the new document version</param>
+        /// <remarks>If an existing chain is de-linked by this, all the pages should be added to the free list</remarks>
+        public bool Update(Guid docId, int pageId, out int expiredPage, long length = -1, DocumentFlags flags = DocumentFlags.None) {
+            expiredPage = -1;
+
+            // find the entry to update
+            var index = Find(docId);
+            if (index < 0 || index >= EntryCount) return false; // not found
+            if (_docIds[index] == ZeroDocId) return false; // not found
+            if (_docIds[index] != docId) throw new Exception("IndexPage.Search: Logic error");
+
+            _links[index].WriteNewLink(pageId, out expiredPage);
+            SetMetadata(index, length, flags);
+            return true;
+        }
+
+        /// <summary>
+        /// Read the metadata stored for a document's newest version.
+        /// Returns null if the document is not in this page, or has no metadata.
+        /// </summary>
+        public DocumentStat? GetMetadata(Guid docId)
+        {
+            var index = Find(docId);
+            if (index < 0 || index >= EntryCount) return null;
+            if (_docIds[index] != docId) return null;
+
+            var meta = _meta[index];
+            if ((meta & MetaPresent) == 0) return null;
+            return new DocumentStat {
+                DocumentId = docId,
+                Length = (meta & MetaLengthKnown) != 0 ? (long)(meta & (uint)MaxMetadataLength) : -1,
+                Flags = (DocumentFlags)(meta >> MetaFlagShift),
+                LastModified = DayZero.AddDays(_modifiedDays[index]),
+                FromIndex = true
+            };
+        }
+
+        private void SetMetadata(int index, long length, DocumentFlags flags)
+        {
+            MakeMetadata(length, flags, out _meta[index], out _modifiedDays[index]);
+        }
+
+        private static void MakeMetadata(long length, DocumentFlags flags, out uint meta, out ushort day)
+        {
+            meta = MetaPresent | ((uint)flags << MetaFlagShift);
+            if (length >= 0 && length <= MaxMetadataLength) meta |= MetaLengthKnown | (uint)length;
+            day = (ushort)Math.Max(0, Math.Min(ushort.MaxValue, (DateTime.UtcNow - DayZero).TotalDays));
+        }
+
+        
+        /// <summary>
+        /// Update a link to set an invalid link. Both versions of the link will be lost.
+        /// The entry is left as a tombstone, and its slot may be reused by a later insert.
+        /// Returns true if a change was made. False if the link was not found in this index page
+        /// </summary>
+        /// <param name="docId">ID of document to update</param>
+        /// <returns></returns>
+        public bool Remove(Guid docId)
+        {
+            // find the entry to update
+            var index = Find(docId);
+            if (index < 0 || index >= EntryCount) return false; // not found
+            if (_docIds[index] == ZeroDocId) return false; // not found
+            if (_docIds[index] != docId) throw new Exception("IndexPage.Search: Logic error");
+
+            _links[index] = new VersionedLink(); // entirely reset
+            _meta[index] = 0;
+            _modifiedDays[index] = 0;
+            return true;
+        }
+
+        /// <summary>
+        /// List all document IDs in this page, with their page links.
+        /// Removed documents are included, with invalid links.
+        /// </summary>
+        [NotNull]public IEnumerable<KeyValuePair<Guid, VersionedLink>> Entries()
+        {
+            for (int i = 0; i < EntryCount; i++)
+            {
+                if (_docIds[i] == ZeroDocId) continue;
+                yield return new KeyValuePair<Guid, VersionedLink>(_docIds[i], _links[i]);
+            }
+        }
+
+        /// <summary>
+        /// Number of removed entries still taking space in this page
+        /// </summary>
+        public int TombstoneCount()
+        {
+            var count = 0;
+            for (int i = 0; i < EntryCount; i++)
+            {
+                if (IsTombstone(i)) count++;
+            }
+            return count;
+        }
+
+        /// <summary>
+        /// Rebuild the page from its live entries, dropping all tombstones.
+        /// The live entries are placed as a balanced tree, which always fits.
+        /// Returns the number of tombstones removed.
+        /// </summary>
+        public int Compact()
+        {
+            var removed = TombstoneCount();
+            if (removed < 1) return 0;
+
+            Rebuild(null, null, 0, 0, recentre: false);
+            return removed;
+        }
+
+        /// <summary>
+        /// Place all live entries, plus an optional new one, as a balanced tree.
+        /// If `recentre` is set, the pivot is moved to the median entry so both sides of the page are used;
+        /// otherwise the pivot is kept, and each side keeps the entries it already had.
+        /// </summary>
+        private void Rebuild(Guid? extraId, VersionedLink? extraLink, uint extraMeta, ushort extraDay, bool recentre)
+        {
+            var live = new List<int>();
+            for (int i = 0; i < EntryCount; i++)
+            {
+                if (_docIds[i] != ZeroDocId && !IsTombstone(i)) live.Add(i);
+            }
+
+            // one spare slot at the end for the new entry
+            var ids = new Guid[EntryCount + 1];
+            var links = new VersionedLink[EntryCount + 1];
+            var meta = new uint[EntryCount + 1];
+            var days = new ushort[EntryCount + 1];
+            Array.Copy(_docIds, ids, EntryCount);
+            Array.Copy(_links, links, EntryCount);
+            Array.Copy(_meta, meta, EntryCount);
+            Array.Copy(_modifiedDays, days, EntryCount);
+            if (extraId != null && extraLink != null)
+            {
+                ids[EntryCount] = extraId.Value;
+                links[EntryCount] = extraLink;
+                meta[EntryCount] = extraMeta;
+                days[EntryCount] = extraDay;
+                live.Add(EntryCount);
+            }
+
+            for (int i = 0; i < EntryCount; i++)
+            {
+                _docIds[i] = ZeroDocId;
+                _links[i] = new VersionedLink();
+                _meta[i] = 0;
+                _modifiedDays[i] = 0;
+            }
+
+            // Same split as the implicit root in `Find`
+            live.Sort((a, b) => ids[a].CompareTo(ids[b]));
+            if (recentre && live.Count > 0) _pivot = ids[live[live.Count / 2]];
+            var pivot = _pivot;
+            var above = live.FindAll(i => pivot.CompareTo(ids[i]) != GREATER);
+            var below = live.FindAll(i => pivot.CompareTo(ids[i]) == GREATER);
+
+            PlaceBalanced(0, above, 0, above.Count - 1, ids, links, meta, days);
+            PlaceBalanced(1, below, 0, below.Count - 1, ids, links, meta, days);
+        }
+
+        private void PlaceBalanced(int slot, [NotNull]List<int> sorted, int low, int high,
+            [NotNull]Guid[] ids, [NotNull]VersionedLink[] links, [NotNull]uint[] meta, [NotNull]ushort[] days)
+        {
+            if (low > high) return;
+            if (slot >= EntryCount) throw new Exception("IndexPage.Compact: Logic error. Entries did not fit");
+
+            var mid = (low + high) / 2;
+            var source = sorted[mid];
+            _docIds[slot] = ids[source];
+            _links[slot] = links[source];
+            _meta[slot] = meta[source];
+            _modifiedDays[slot] = days[source];
+
+            // see `Find`: the first child holds larger IDs, the second holds smaller ones
+            PlaceBalanced((slot * 2) + 2, sorted, mid + 1, high, ids, links, meta, days);
+            PlaceBalanced((slot * 2) + 3, sorted, low, mid - 1, ids, links, meta, days);
+        }
+
+        /// <summary>
+        /// True if the slot holds a removed entry
+        /// </summary>
+        private bool IsTombstone(int index)
+        {
+            return _docIds[index] != ZeroDocId && !_links[index].TryGetLink(0, out _);
+        }
+
+        /// <summary>
+        /// Like `Find`, but will stop at a tombstone if the target can take its place
+        /// without breaking the order of the tree.
+        /// </summary>
+        private int FindInsertSlot(Guid target)
+        {
+            var cmpNode = _pivot;
+            int leftIdx = 0;
+            int rightIdx = 1;
+
+            for (int i = 0; i < 7; i++)
+            {
+                int current;
+                switch (RootAwareCompare(cmpNode, target, i))
+                {
+                    case SAME: return -1; // only the neutral ID can match here, and it can't be stored
+                    case LESS: current = leftIdx; break;
+                    case GREATER: current = rightIdx; break;
+                    default: throw new Exception("IndexTree.FindInsertSlot: Unexpected case.");
+                }
+
+                leftIdx = (current * 2) + 2;
+                rightIdx = (current * 2) + 3;
+                if (current >= EntryCount) return -1;
+
+                cmpNode = _docIds[current];
+                if (cmpNode == ZeroDocId) return current; // empty space
+                if (cmpNode == target) return current; // existing entry or our own tombstone
+                if (IsTombstone(current)
+                    && SubtreeAll(leftIdx, id => id.CompareTo(target) == GREATER)
+                    && SubtreeAll(rightIdx, id => id.CompareTo(target) == LESS)) return current; // reuse
+            }
+
+            throw new Exception("IndexTree.FindInsertSlot: Out of loops bounds. Exited due to safety check.");
+        }
+
+        /// <summary>
+        /// True if every doc id (including tombstones) in the subtree rooted at `slot` passes the predicate
+        /// </summary>
+        private bool SubtreeAll(int slot, [NotNull]Func<Guid, bool> predicate)
+        {
+            if (slot >= EntryCount) return true;
+            var id = _docIds[slot];
+            if (id == ZeroDocId) return true;
+            if (!predicate(id)) return false;
+            return SubtreeAll((slot * 2) + 2, predicate) && SubtreeAll((slot * 2) + 3, predicate);
+        }
+
+        /// <summary>
+        /// Compare a tree node to a search target. A custom pivot at the root is not a stored entry,
+        /// so a target equal to it goes left with the larger IDs. The neutral pivot can never be a target.
+        /// </summary>
+        private int RootAwareCompare(Guid node, Guid target, int depth)
+        {
+            var order = node.CompareTo(target);
+            if (depth == 0 && order == SAME && node != ReservedDocIds.Neutral) return LESS;
+            return order;
+        }
+
+        /// <summary>
+        /// Find tries to find an entry index by a guid key. This is used in insert, search, update.
+        /// If no such entry exists, but there is a space for it, you will get a valid index whose
+        /// `_docIds` entry is Guid.Zero -- so always check.
+        /// </summary>
+        private int Find(Guid target) {
+            // the implicit node:
+            var cmpNode = _pivot;
+            int leftIdx = 0;
+            int rightIdx = 1;
+
+            var current = -1;
+
+            // loop start
+            for (int i = 0; i < 7; i++)
+            {
+                switch (RootAwareCompare(cmpNode, target, i))
+                {
+                    case SAME: return current;
+
+                    case LESS:
+                        // move left
+                        current = leftIdx;
+                        break;
+
+                    case GREATER:
+                        // move right
+                        current = rightIdx;
+                        break;
+
+                    default: throw new Exception("IndexTree.TryInsert: Unexpected case.");
+                }
+
+                // update next step pointers
+                leftIdx = (current * 2) + 2;
+                rightIdx = (current * 2) + 3;
+
+                // check we're in bounds
+                if (current < 0) throw new Exception("IndexTree.TryInsert: Logic error");
+                if (current >= EntryCount) return -1;
+                
+                cmpNode = _docIds[current];
+                if (cmpNode == ZeroDocId) { return current; } // empty space
+            }
+            // loop end
+
+            throw new Exception("IndexTree.TryInsert: Out of loops bounds. Exited due to safety check.");
+        }
+
+        /// <inheritdoc />
+        public void Defrost(Stream source)
+        {
+            if (source == null || source.Length < PackedSize) throw new Exception("IndexPage.FromBytes: data was too short.");
+            var r = new BinaryReader(source);
+
+            for (int i = 0; i < EntryCount; i++)
+            {
+                var bytes = r.ReadBytes(16);
+                if (bytes == null) throw new Exception("Failed to read doc guid");
+                _docIds[i] = new Guid(bytes);
+
+
+                _links[i].Defrost(r.BaseStream);
+            }
+
+            var hasMetadata = source.Length >= PackedSize + MetadataSize;
+            for (int i = 0; i < EntryCount; i++)
+            {
+                _meta[i] = hasMetadata ? r.ReadUInt32() : 0;
+                _modifiedDays[i] = hasMetadata ? r.ReadUInt16() : (ushort)0;
+            }
+
+            var hasPivot = source.Length >= PackedSize + MetadataSize + PivotSize;
+            _pivot = hasPivot ? new Guid(r.ReadBytes(PivotSize) ?? throw new Exception("Failed to read index pivot")) : ReservedDocIds.Neutral;
+        }
+
+        /// <inheritdoc />
+        public Stream Freeze()
+        {
+            var ms = new MemoryStream(PackedSize + MetadataSize + PivotSize);
+            var w = new BinaryWriter(ms);
+
+            for (int i = 0; i < EntryCount; i++)
+            {
+                w.Write(_docIds[i].ToByteArray());
+                _links[i].Freeze().CopyTo(ms);
+            }
+            for (int i = 0; i < EntryCount; i++)
+            {
+                w.Write(_meta[i]);
+                w.Write(_modifiedDays[i]);
+            }
+            w.Write(_pivot.ToByteArray());
+
+            ms.Seek(0, SeekOrigin.Begin);
+            return ms;
+        }
+    }
 }
\ No newline at end of file
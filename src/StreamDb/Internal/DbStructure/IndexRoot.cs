@@ -0,0 +1,92 @@
+﻿using System;
+using System.IO;
+using System.Linq;
+using JetBrains.Annotations;
+using StreamDb.Internal.Support;
+
+namespace StreamDb.Internal.DbStructure
+{
+    /// <summary>
+    /// Content of the root page of a sharded index. Each document ID is indexed in one of 256 separate
+    /// index page chains, chosen by the first byte of the ID, so a lookup only walks one shard's chain.
+    /// When the index is sharded, the header's index link points at this page rather than at an index page.
+    /// </summary>
+    public class IndexRoot : IStreamSerialisable
+    {
+        /*
+            Layout: [ Magic (8 bytes) | Shard count (int32) ] then [ Top page of shard chain (int32) ] for each shard.
+            An empty shard is -1. The layout is shorter than an `IndexPage`, and `IsRoot` checks both length and magic.
+        */
+        [NotNull] private static readonly byte[] RootMagic = { 0x53, 0x44, 0x42, 0x2D, 0x49, 0x44, 0x58, 0x52 };
+
+        /// <summary> Number of shards </summary>
+        public const int ShardCount = 256;
+
+        /// <summary> Size of the serialised root </summary>
+        public const int ByteSize = 8 + 4 + (ShardCount * 4);
+
+        /// <summary> Top page ID of each shard's index chain, or -1 if the shard is empty </summary>
+        [NotNull] public int[] ShardTops { get; } = Enumerable.Repeat(-1, ShardCount).ToArray();
+
+        /// <summary>
+        /// The shard that indexes a document ID
+        /// </summary>
+        public static int ShardOf(Guid documentId)
+        {
+            return documentId.ToByteArray()[0];
+        }
+
+        /// <summary>
+        /// Returns true if the page holds an index root, rather than an index page
+        /// </summary>
+        public static bool IsRoot([NotNull]BasicPage page)
+        {
+            if (page.DataLength != ByteSize) return false;
+            var magic = new byte[RootMagic.Length];
+            var body = page.BodyStream();
+            body.Read(magic, 0, magic.Length);
+            return magic.SequenceEqual(RootMagic);
+        }
+
+        /// <summary>
+        /// Point any shard whose top is `oldPageId` at `newPageId` instead.
+        /// Returns false if no shard has `oldPageId` as its top.
+        /// </summary>
+        public bool ReplacePageId(int oldPageId, int newPageId)
+        {
+            if (oldPageId < 0) return false;
+            var found = false;
+            for (int i = 0; i < ShardCount; i++)
+            {
+                if (ShardTops[i] != oldPageId) continue;
+                ShardTops[i] = newPageId;
+                found = true;
+            }
+            return found;
+        }
+
+        /// <inheritdoc />
+        public Stream Freeze()
+        {
+            var ms = new MemoryStream(ByteSize);
+            var w = new BinaryWriter(ms);
+            w.Write(RootMagic);
+            w.Write(ShardCount);
+            foreach (var top in ShardTops) { w.Write(top); }
+            ms.Seek(0, SeekOrigin.Begin);
+            return ms;
+        }
+
+        /// <inheritdoc />
+        public void Defrost(Stream source)
+        {
+            if (source == null || source.Length < ByteSize) throw new Exception("IndexRoot.Defrost: data was too short.");
+            var r = new BinaryReader(source);
+            var magic = r.ReadBytes(RootMagic.Length);
+            if (magic == null || !magic.SequenceEqual(RootMagic)) throw new Exception("IndexRoot.Defrost: not an index root");
+            var count = r.ReadInt32();
+            if (count != ShardCount) throw new Exception($"IndexRoot.Defrost: unsupported shard count {count}");
+            for (int i = 0; i < ShardCount; i++) { ShardTops[i] = r.ReadInt32(); }
+        }
+    }
+}
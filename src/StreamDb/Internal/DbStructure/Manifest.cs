@@ -0,0 +1,94 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using System.Linq;
+using System.Text;
+using JetBrains.Annotations;
+using StreamDb.Internal.Support;
+
+namespace StreamDb.Internal.DbStructure
+{
+    /// <summary>
+    /// Content of a signed manifest: the SHA-256 hash of every bound path, and an Ed25519 signature over the listing.
+    /// Stored as a system document. See `Database.SignManifest`
+    /// </summary>
+    public class Manifest : IStreamSerialisable
+    {
+        /*
+            Layout: [ Magic (8 bytes) | Entry count (int32) ]
+            then [ Path (string) | SHA-256 of content (32 bytes) ] for each entry, in ordinal path order,
+            then [ Signature (64 bytes) ] over everything before it.
+            Strings are written by `BinaryWriter` (length prefixed UTF-8).
+        */
+        [NotNull] private static readonly byte[] ManifestMagic = { 0x53, 0x44, 0x42, 0x2D, 0x4D, 0x41, 0x4E, 0x31 };
+
+        /// <summary> Length of each content hash in bytes </summary>
+        public const int HashSize = 32;
+
+        /// <summary> Content hash by path </summary>
+        [NotNull] public SortedDictionary<string, byte[]> Entries { get; } = new SortedDictionary<string, byte[]>(StringComparer.Ordinal);
+
+        /// <summary> Ed25519 signature over `SignedContent` </summary>
+        [NotNull] public byte[] Signature { get; set; } = new byte[Ed25519.SignatureSize];
+
+        /// <summary>
+        /// The bytes covered by the signature
+        /// </summary>
+        [NotNull]public byte[] SignedContent()
+        {
+            var ms = new MemoryStream();
+            var w = new BinaryWriter(ms, Encoding.UTF8);
+            w.Write(ManifestMagic);
+            w.Write(Entries.Count);
+            foreach (var entry in Entries)
+            {
+                w.Write(entry.Key);
+                w.Write(entry.Value);
+            }
+            w.Flush();
+            return ms.ToArray();
+        }
+
+        /// <inheritdoc />
+        public Stream Freeze()
+        {
+            var ms = new MemoryStream();
+            var content = SignedContent();
+            ms.Write(content, 0, content.Length);
+            ms.Write(Signature, 0, Signature.Length);
+            ms.Seek(0, SeekOrigin.Begin);
+            return ms;
+        }
+
+        /// <inheritdoc />
+        public void Defrost(Stream source)
+        {
+            Entries.Clear();
+            if (source == null) throw new Exception("Manifest stream must not be null");
+            var r = new BinaryReader(source, Encoding.UTF8);
+
+            try
+            {
+                var magic = r.ReadBytes(ManifestMagic.Length);
+                if (!magic.SequenceEqual(ManifestMagic)) throw new Exception("Document is not a StreamDb manifest");
+
+                var count = r.ReadInt32();
+                for (int i = 0; i < count; i++)
+                {
+                    var path = r.ReadString();
+                    var hash = r.ReadBytes(HashSize);
+                    if (hash.Length != HashSize) throw new EndOfStreamException();
+                    Entries[path] = hash;
+                }
+
+                var signature = r.ReadBytes(Ed25519.SignatureSize);
+                if (signature.Length != Ed25519.SignatureSize) throw new EndOfStreamException();
+                Signature = signature;
+            }
+            catch (EndOfStreamException ex)
+            {
+                throw new Exception("Manifest is truncated", ex);
+            }
+        }
+    }
+}
@@ -0,0 +1,131 @@
+﻿using System;
+using System.IO;
+using System.Linq;
+using System.Text;
+using JetBrains.Annotations;
+using StreamDb.Internal.Support;
+
+namespace StreamDb.Internal.DbStructure
+{
+    /// <summary>
+    /// Human readable descriptions of pages, for debugging and tooling.
+    /// </summary>
+    public static class PageDiagnostics
+    {
+        /// <summary> Maximum number of data bytes included in a hex dump </summary>
+        public const int HexPreviewBytes = 64;
+
+        /// <summary>
+        /// Describe the headers of a page, and decode its content according to the given page type.
+        /// </summary>
+        [NotNull]public static string DescribePage([NotNull]BasicPage page, PageType type = PageType.Unknown)
+        {
+            var sb = new StringBuilder();
+            sb.AppendLine($"Page {page.PageId} ({type})");
+            sb.AppendLine($"  CRC:    {page.CrcHash:X8} ({(page.ValidateCrc() ? "valid" : "INVALID")})");
+            sb.AppendLine($"  Length: {page.DataLength}");
+            sb.AppendLine($"  Prev:   {page.PrevPageId}");
+
+            try
+            {
+                switch (type)
+                {
+                    case PageType.Index:
+                        DescribeIndex(page, sb);
+                        break;
+
+                    case PageType.IndexRoot:
+                        DescribeIndexRoot(page, sb);
+                        break;
+
+                    case PageType.FreeList:
+                        DescribeFreeList(page, sb);
+                        break;
+
+                    case PageType.PathLookup:
+                        DescribeTriePrefix(page, sb);
+                        break;
+                }
+            }
+            catch (Exception ex)
+            {
+                sb.AppendLine($"  Failed to decode content: {ex.Message}");
+            }
+
+            sb.AppendLine($"  Data:   {HexPreview(page)}");
+            return sb.ToString();
+        }
+
+        private static void DescribeIndex([NotNull]BasicPage page, [NotNull]StringBuilder sb)
+        {
+            var index = new IndexPage();
+            index.Defrost(page.BodyStream());
+            var count = 0;
+            foreach (var entry in index.Entries())
+            {
+                entry.Value.TryGetLink(0, out var newest);
+                entry.Value.TryGetLink(1, out var previous);
+                sb.AppendLine($"  Entry:  {entry.Key} -> {newest} (previous {previous})");
+                count++;
+            }
+            sb.AppendLine($"  Index entries: {count} ({index.TombstoneCount()} removed), {index.LiveCount()} of {IndexPage.Capacity} slots live");
+            if (index.Pivot != ReservedDocIds.Neutral) sb.AppendLine($"  Pivot:  {index.Pivot}");
+        }
+
+        private static void DescribeIndexRoot([NotNull]BasicPage page, [NotNull]StringBuilder sb)
+        {
+            var root = new IndexRoot();
+            root.Defrost(page.BodyStream());
+            var used = root.ShardTops.Count(top => top >= 0);
+            sb.AppendLine($"  Index shards: {used} of {IndexRoot.ShardCount} in use");
+        }
+
+        private static void DescribeFreeList([NotNull]BasicPage page, [NotNull]StringBuilder sb)
+        {
+            // See `PageStorage.ReleaseSinglePage` for structure
+            var length = page.ReadDataInt32(0);
+            sb.AppendLine($"  Free slots used: {length} of {BasicPage.MaxInt32Index}");
+            if (length < 1 || length > BasicPage.MaxInt32Index) return;
+
+            var ids = new StringBuilder();
+            for (int i = 1; i <= length; i++)
+            {
+                if (i > 1) ids.Append(", ");
+                ids.Append(page.ReadDataInt32(i));
+            }
+            sb.AppendLine($"  Free pages: {ids}");
+        }
+
+        private static void DescribeTriePrefix([NotNull]BasicPage page, [NotNull]StringBuilder sb)
+        {
+            // Only the first page of a trie chain has the node count.
+            if (page.PrevPageId >= 0)
+            {
+                sb.AppendLine("  Trie continuation page");
+                return;
+            }
+
+            var src = new BitwiseStreamWrapper(page.BodyStream(), 64);
+            // The stored count includes the root node, plus one
+            if (!ReverseTrie<SerialGuid>.TryDecodeValue(src, out var nodeCount) || nodeCount < 2)
+            {
+                sb.AppendLine("  Trie prefix is invalid");
+                return;
+            }
+            sb.AppendLine($"  Trie nodes: {nodeCount - 2}");
+        }
+
+        [NotNull]private static string HexPreview([NotNull]BasicPage page)
+        {
+            var length = (int) Math.Min(page.DataLength, HexPreviewBytes);
+            var buf = new byte[length];
+            var body = page.BodyStream();
+            body.Read(buf, 0, length);
+
+            var sb = new StringBuilder();
+            foreach (var b in buf) sb.Append(b.ToString("x2"));
+            if (page.DataLength > HexPreviewBytes) sb.Append("...");
+            return sb.ToString();
+        }
+    }
+}
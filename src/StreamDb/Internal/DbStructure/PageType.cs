@@ -0,0 +1,33 @@
+﻿namespace StreamDb.Internal.DbStructure
+{
+    /// <summary>
+    /// What a page is being used for. Pages don't store their type, so this is always a guess
+    /// based on which chain a page was found in.
+    /// </summary>
+    public enum PageType
+    {
+        /// <summary> Not found in any known chain </summary>
+        Unknown = 0,
+
+        /// <summary> Part of the document index chain </summary>
+        Index,
+
+        /// <summary> Part of a path-lookup (trie) chain </summary>
+        PathLookup,
+
+        /// <summary> Part of the free-list chain </summary>
+        FreeList,
+
+        /// <summary> Listed as free in the free-list chain </summary>
+        Free,
+
+        /// <summary> Presumed to be document data </summary>
+        Data,
+
+        /// <summary> Listed in the bad-page map. Never allocated </summary>
+        Bad,
+
+        /// <summary> Root page of a sharded index, linked from the header </summary>
+        IndexRoot
+    }
+}
@@ -0,0 +1,95 @@
+﻿using System;
+using System.IO;
+using System.Text;
+using StreamDb.Internal.Support;
+
+namespace StreamDb.Internal.DbStructure
+{
+    /// <summary>
+    /// Value stored against each path in the path lookup trie: a document ID, with optional binding metadata.
+    /// Equality and ordering only consider the document ID.
+    /// </summary>
+    public class PathBinding : SerialGuid
+    {
+        /*
+            Layout: [ Doc Guid (16 bytes) ] then optionally
+                    [ Bound at, UTC ticks (int64) | Attributes (byte, only if flagged) | Annotation (UTF-8, rest of the value) ]
+            Bindings written before metadata was supported are just the Guid.
+            Ticks never use the top two bits, so bit 62 flags that an attributes byte follows.
+        */
+        private const long AttributesFollow = 1L << 62;
+
+        /// <summary> Longest annotation that can be stored, in UTF-8 bytes </summary>
+        public const int MaxAnnotationBytes = 1024;
+
+        /// <summary> Time the path was bound (UTC), if recorded </summary>
+        public DateTime? BoundAt;
+
+        /// <summary> Caller-supplied note, if any </summary>
+        public string? Annotation;
+
+        /// <summary> Attribute bits of the binding </summary>
+        public BindingAttributes Attributes;
+
+        public static implicit operator PathBinding(Guid other){ return new PathBinding { Value = other }; }
+
+        /// <inheritdoc />
+        public override Stream Freeze()
+        {
+            var ms = new MemoryStream();
+            var w = new BinaryWriter(ms);
+            w.Write(Value.ToByteArray());
+
+            if (BoundAt != null || Annotation != null || Attributes != BindingAttributes.None)
+            {
+                var ticks = (BoundAt ?? DateTime.MinValue).Ticks;
+                if (Attributes == BindingAttributes.None)
+                {
+                    w.Write(ticks);
+                }
+                else
+                {
+                    w.Write(ticks | AttributesFollow);
+                    w.Write((byte)Attributes);
+                }
+                if (Annotation != null)
+                {
+                    var bytes = Encoding.UTF8.GetBytes(Annotation);
+                    if (bytes.Length > MaxAnnotationBytes) throw new Exception($"Binding annotation is too long ({bytes.Length} bytes; limit is {MaxAnnotationBytes})");
+                    w.Write(bytes);
+                }
+            }
+
+            ms.Seek(0, SeekOrigin.Begin);
+            return ms;
+        }
+
+        /// <inheritdoc />
+        public override void Defrost(Stream source)
+        {
+            base.Defrost(source);
+            BoundAt = null;
+            Annotation = null;
+            Attributes = BindingAttributes.None;
+
+            var remaining = source.Length - source.Position;
+            if (remaining < 8) return;
+
+            var r = new BinaryReader(source);
+            var ticks = r.ReadInt64();
+            remaining -= 8;
+            if ((ticks & AttributesFollow) != 0)
+            {
+                ticks &= ~AttributesFollow;
+                if (remaining < 1) throw new Exception("Path binding is truncated");
+                Attributes = (BindingAttributes)r.ReadByte();
+                remaining--;
+            }
+            if (ticks != DateTime.MinValue.Ticks) BoundAt = new DateTime(ticks, DateTimeKind.Utc);
+
+            if (remaining < 1) return;
+            var bytes = r.ReadBytes((int)remaining);
+            Annotation = Encoding.UTF8.GetString(bytes, 0, bytes.Length);
+        }
+    }
+}
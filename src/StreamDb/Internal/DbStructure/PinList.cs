@@ -0,0 +1,50 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using JetBrains.Annotations;
+using StreamDb.Internal.Support;
+
+namespace StreamDb.Internal.DbStructure
+{
+    /// <summary>
+    /// Content of the pin document: the set of document IDs that must not be released.
+    /// This is stored as a normal document chain, bound in the index to a reserved ID (see `ReservedDocIds`), and to a path under `Database.SystemNamespace`.
+    /// </summary>
+    public class PinList : IStreamSerialisable
+    {
+        /*
+            Layout: [ Entry count (int32) ] then [ Doc Guid (16 bytes) ] for each entry
+        */
+
+        [NotNull] public HashSet<Guid> DocumentIds { get; } = new HashSet<Guid>();
+
+        /// <inheritdoc />
+        public Stream Freeze()
+        {
+            var ms = new MemoryStream();
+            var w = new BinaryWriter(ms);
+
+            w.Write(DocumentIds.Count);
+            foreach (var id in DocumentIds) { w.Write(id.ToByteArray()); }
+
+            ms.Seek(0, SeekOrigin.Begin);
+            return ms;
+        }
+
+        /// <inheritdoc />
+        public void Defrost(Stream source)
+        {
+            DocumentIds.Clear();
+            if (source == null || source.Length < 4) return;
+            var r = new BinaryReader(source);
+
+            var count = r.ReadInt32();
+            for (int i = 0; i < count; i++)
+            {
+                var bytes = r.ReadBytes(16);
+                if (bytes == null || bytes.Length != 16) throw new Exception("Pin list is truncated");
+                DocumentIds.Add(new Guid(bytes));
+            }
+        }
+    }
+}
@@ -0,0 +1,72 @@
+﻿using System;
+
+namespace StreamDb.Internal.DbStructure
+{
+    /// <summary>
+    /// Index IDs reserved for the records the storage engine and database keep about themselves.
+    /// None of these are allowed as real document IDs. All reserved IDs are declared here, so each number is only used once.
+    /// </summary>
+    /// <remarks>
+    /// Reserved IDs have 127 in their first 15 bytes, and the last byte picks the record. Numbers are written to storage,
+    /// so they must never be changed or reused.
+    /// </remarks>
+    public static class ReservedDocIds
+    {
+        /// <summary> Trash list. See `TrashList` </summary>
+        public static readonly Guid Trash = Reserved(1);
+
+        /// <summary> Pin list. See `PinList` </summary>
+        public static readonly Guid Pins = Reserved(2);
+
+        /// <summary> Write fence document, held by the connection allowed to write </summary>
+        public static readonly Guid Fence = Reserved(3);
+
+        /// <summary> Audit log. See `AuditLog` </summary>
+        public static readonly Guid Audit = Reserved(4);
+
+        /// <summary> Reference counts of deduplicated chunks </summary>
+        public static readonly Guid ChunkRefCounts = Reserved(5);
+
+        /// <summary> Map of pages that have failed CRC checks </summary>
+        public static readonly Guid BadPages = Reserved(6);
+
+        /// <summary> Immutable document list. See `ImmutableList` </summary>
+        public static readonly Guid Immutables = Reserved(7);
+
+        /// <summary> Access control document. See `AccessList` </summary>
+        public static readonly Guid Access = Reserved(8);
+
+        /// <summary> Stored document and free page counts </summary>
+        public static readonly Guid Counters = Reserved(9);
+
+        /// <summary> Temporary document list. See `TempList` </summary>
+        public static readonly Guid Temps = Reserved(10);
+
+        /// <summary> Upload session list. See `UploadList` </summary>
+        public static readonly Guid Uploads = Reserved(11);
+
+        /// <summary> Released pages still waiting to be reused </summary>
+        public static readonly Guid DeferredPages = Reserved(12);
+
+        /// <summary> Codec schema IDs of documents. See `SchemaList` </summary>
+        public static readonly Guid Schemas = Reserved(13);
+
+        /// <summary> The implicit root of the document index. See `IndexPage` </summary>
+        public static readonly Guid Neutral = Reserved(127);
+
+        /// <summary>
+        /// True for any ID in the reserved range, including numbers not yet used
+        /// </summary>
+        public static bool IsReserved(Guid documentId)
+        {
+            var bytes = documentId.ToByteArray();
+            for (int i = 0; i < 15; i++) { if (bytes[i] != 127) return false; }
+            return true;
+        }
+
+        private static Guid Reserved(byte number)
+        {
+            return new Guid(new byte[] { 127, 127, 127, 127, 127, 127, 127, 127, 127, 127, 127, 127, 127, 127, 127, number });
+        }
+    }
+}
@@ -0,0 +1,65 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using JetBrains.Annotations;
+using StreamDb.Internal.Support;
+
+namespace StreamDb.Internal.DbStructure
+{
+    /// <summary>
+    /// Content of the schema list: the codec schema ID of each document written by `Database.Put`.
+    /// This is stored as a normal document chain, bound in the index to a reserved ID (see `ReservedDocIds`) and to no paths.
+    /// </summary>
+    public class SchemaList : IStreamSerialisable
+    {
+        /*
+            Layout: [ Entry count (int32) ] then [ Doc Guid (16 bytes) | Schema ID (string) ] for each entry.
+            Strings are written by `BinaryWriter` (length prefixed UTF-8).
+        */
+
+        [NotNull] public Dictionary<Guid, string> Entries { get; } = new Dictionary<Guid, string>();
+
+        /// <inheritdoc />
+        public Stream Freeze()
+        {
+            var ms = new MemoryStream();
+            var w = new BinaryWriter(ms);
+
+            w.Write(Entries.Count);
+            foreach (var entry in Entries)
+            {
+                w.Write(entry.Key.ToByteArray());
+                w.Write(entry.Value);
+            }
+
+            ms.Seek(0, SeekOrigin.Begin);
+            return ms;
+        }
+
+        /// <inheritdoc />
+        public void Defrost(Stream source)
+        {
+            Entries.Clear();
+            if (source == null || source.Length < 4) return;
+            var r = new BinaryReader(source);
+
+            try
+            {
+                var count = r.ReadInt32();
+                for (int i = 0; i < count; i++)
+                {
+                    var id = new Guid(r.ReadBytes(16));
+                    Entries[id] = r.ReadString();
+                }
+            }
+            catch (EndOfStreamException ex)
+            {
+                throw new Exception("Schema list is truncated", ex);
+            }
+            catch (ArgumentException ex)
+            {
+                throw new Exception("Schema list is truncated", ex);
+            }
+        }
+    }
+}
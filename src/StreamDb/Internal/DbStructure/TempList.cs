@@ -0,0 +1,51 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using JetBrains.Annotations;
+using StreamDb.Internal.Support;
+
+namespace StreamDb.Internal.DbStructure
+{
+    /// <summary>
+    /// Content of the temporary document list: IDs written by `Database.PutTemp` that are released unless bound to a path
+    /// by the time the connection closes, or the database is next opened.
+    /// This is stored as a normal document chain, bound in the index to a reserved ID (see `ReservedDocIds`) and to no paths.
+    /// </summary>
+    public class TempList : IStreamSerialisable
+    {
+        /*
+            Layout: [ Entry count (int32) ] then [ Doc Guid (16 bytes) ] for each entry
+        */
+
+        [NotNull] public HashSet<Guid> DocumentIds { get; } = new HashSet<Guid>();
+
+        /// <inheritdoc />
+        public Stream Freeze()
+        {
+            var ms = new MemoryStream();
+            var w = new BinaryWriter(ms);
+
+            w.Write(DocumentIds.Count);
+            foreach (var id in DocumentIds) { w.Write(id.ToByteArray()); }
+
+            ms.Seek(0, SeekOrigin.Begin);
+            return ms;
+        }
+
+        /// <inheritdoc />
+        public void Defrost(Stream source)
+        {
+            DocumentIds.Clear();
+            if (source == null || source.Length < 4) return;
+            var r = new BinaryReader(source);
+
+            var count = r.ReadInt32();
+            for (int i = 0; i < count; i++)
+            {
+                var bytes = r.ReadBytes(16);
+                if (bytes == null || bytes.Length != 16) throw new Exception("Temporary document list is truncated");
+                DocumentIds.Add(new Guid(bytes));
+            }
+        }
+    }
+}
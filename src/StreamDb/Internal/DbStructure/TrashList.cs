@@ -0,0 +1,61 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using System.Text;
+using JetBrains.Annotations;
+using StreamDb.Internal.Support;
+
+namespace StreamDb.Internal.DbStructure
+{
+    /// <summary>
+    /// Content of the trash document: a list of soft-deleted path bindings.
+    /// This is stored as a normal document chain, bound in the index to a reserved ID (see `ReservedDocIds`), and to a path under `Database.SystemNamespace`.
+    /// </summary>
+    public class TrashList : IStreamSerialisable
+    {
+        /*
+            Layout: [ Entry count (int32) ] then for each entry:
+                    [ Doc Guid (16 bytes) | Deleted at, UTC ticks (int64) | Path (length-prefixed UTF-8) ]
+        */
+
+        [NotNull, ItemNotNull] public List<TrashEntry> Entries { get; } = new List<TrashEntry>();
+
+        /// <inheritdoc />
+        public Stream Freeze()
+        {
+            var ms = new MemoryStream();
+            var w = new BinaryWriter(ms, Encoding.UTF8);
+
+            w.Write(Entries.Count);
+            foreach (var entry in Entries)
+            {
+                w.Write(entry.DocumentId.ToByteArray());
+                w.Write(entry.DeletedAt.Ticks);
+                w.Write(entry.Path);
+            }
+
+            ms.Seek(0, SeekOrigin.Begin);
+            return ms;
+        }
+
+        /// <inheritdoc />
+        public void Defrost(Stream source)
+        {
+            Entries.Clear();
+            if (source == null || source.Length < 4) return;
+            var r = new BinaryReader(source, Encoding.UTF8);
+
+            var count = r.ReadInt32();
+            for (int i = 0; i < count; i++)
+            {
+                var bytes = r.ReadBytes(16);
+                if (bytes == null || bytes.Length != 16) throw new Exception("Trash list is truncated");
+                Entries.Add(new TrashEntry {
+                    DocumentId = new Guid(bytes),
+                    DeletedAt = new DateTime(r.ReadInt64(), DateTimeKind.Utc),
+                    Path = r.ReadString() ?? ""
+                });
+            }
+        }
+    }
+}
@@ -0,0 +1,75 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using System.Text;
+using JetBrains.Annotations;
+using StreamDb.Internal.Support;
+
+namespace StreamDb.Internal.DbStructure
+{
+    /// <summary>
+    /// Content of the upload document: multi-part upload sessions that have not been completed or aborted,
+    /// with the page chains written for their parts. Part pages are on no other chain or list until the upload finishes,
+    /// so this is what stops them being lost if the process exits mid-upload.
+    /// This is stored as a normal document chain, bound in the index to a reserved ID (see `ReservedDocIds`) and to no paths.
+    /// </summary>
+    public class UploadList : IStreamSerialisable
+    {
+        /*
+            Layout: [ Session count (int32) ] then for each session:
+                [ Session Guid (16 bytes) | Path (string) | Started (UTC ticks, int64) | Part count (int32) ]
+                then [ Part number (int32) | End page ID (int32) ] for each part
+        */
+
+        [NotNull] public Dictionary<Guid, UploadSession> Sessions { get; } = new Dictionary<Guid, UploadSession>();
+
+        /// <inheritdoc />
+        public Stream Freeze()
+        {
+            var ms = new MemoryStream();
+            var w = new BinaryWriter(ms, Encoding.UTF8);
+
+            w.Write(Sessions.Count);
+            foreach (var entry in Sessions)
+            {
+                w.Write(entry.Key.ToByteArray());
+                w.Write(entry.Value.Path);
+                w.Write(entry.Value.StartedAt.Ticks);
+
+                var parts = new List<KeyValuePair<int, int>>(entry.Value.Parts);
+                w.Write(parts.Count);
+                foreach (var part in parts)
+                {
+                    w.Write(part.Key);
+                    w.Write(part.Value);
+                }
+            }
+
+            ms.Seek(0, SeekOrigin.Begin);
+            return ms;
+        }
+
+        /// <inheritdoc />
+        public void Defrost(Stream source)
+        {
+            Sessions.Clear();
+            if (source == null || source.Length < 4) return;
+            var r = new BinaryReader(source, Encoding.UTF8);
+
+            var count = r.ReadInt32();
+            for (int i = 0; i < count; i++)
+            {
+                var bytes = r.ReadBytes(16);
+                if (bytes == null || bytes.Length != 16) throw new Exception("Upload list is truncated");
+
+                var session = new UploadSession { Path = r.ReadString(), StartedAt = new DateTime(r.ReadInt64(), DateTimeKind.Utc) };
+                var parts = r.ReadInt32();
+                for (int p = 0; p < parts; p++)
+                {
+                    session.SetPart(r.ReadInt32(), r.ReadInt32());
+                }
+                Sessions[new Guid(bytes)] = session;
+            }
+        }
+    }
+}
@@ -0,0 +1,47 @@
+﻿using System;
+using System.Collections.Generic;
+using System.Linq;
+using JetBrains.Annotations;
+
+namespace StreamDb.Internal.DbStructure
+{
+    /// <summary>
+    /// Tracks the page chains written for a multi-part upload, until they are joined into a single document.
+    /// Sessions are stored in the `UploadList`, so an upload can be resumed after the database is reopened.
+    /// </summary>
+    public class UploadSession
+    {
+        [NotNull] private readonly SortedDictionary<int, int> _parts = new SortedDictionary<int, int>();
+
+        /// <summary>
+        /// Path the document will be bound to when the upload is completed
+        /// </summary>
+        [NotNull] public string Path { get; set; } = "";
+
+        /// <summary>
+        /// Time the upload was started (UTC)
+        /// </summary>
+        public DateTime StartedAt { get; set; }
+
+        /// <summary>
+        /// Record the end page of a part. If the part number was already uploaded,
+        /// the end page of the replaced chain is returned so it can be released. Otherwise returns -1.
+        /// </summary>
+        public int SetPart(int partNumber, int endPageId)
+        {
+            var replaced = _parts.TryGetValue(partNumber, out var old) ? old : -1;
+            _parts[partNumber] = endPageId;
+            return replaced;
+        }
+
+        /// <summary>
+        /// Part numbers and end page IDs of all parts, in part number order
+        /// </summary>
+        [NotNull]public IEnumerable<KeyValuePair<int, int>> Parts => _parts;
+
+        /// <summary>
+        /// End page IDs of all parts, in part number order
+        /// </summary>
+        [NotNull]public int[] PartChains() => _parts.Values.ToArray();
+    }
+}
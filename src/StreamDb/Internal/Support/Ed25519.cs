@@ -0,0 +1,212 @@
+﻿using System;
+using System.Linq;
+using System.Numerics;
+using System.Security.Cryptography;
+using JetBrains.Annotations;
+
+namespace StreamDb.Internal.Support
+{
+    /// <summary>
+    /// Ed25519 signatures (RFC 8032), for signing manifests without a crypto library dependency.
+    /// </summary>
+    /// <remarks>
+    /// This follows the reference implementation in the RFC, on `BigInteger` with extended coordinates.
+    /// It is slow (a few milliseconds per operation) and not constant-time, which is fine for signing
+    /// and checking a manifest, but it should not be used with secret keys on shared hardware.
+    /// </remarks>
+    public static class Ed25519
+    {
+        /// <summary> Length of private keys (seeds) and public keys, in bytes </summary>
+        public const int KeySize = 32;
+        /// <summary> Length of signatures, in bytes </summary>
+        public const int SignatureSize = 64;
+
+        [NotNull] private static readonly BigInteger P = BigInteger.Pow(2, 255) - 19;
+        [NotNull] private static readonly BigInteger Q = BigInteger.Pow(2, 252) + BigInteger.Parse("27742317777372353535851937790883648493");
+        [NotNull] private static readonly BigInteger D = Mod(-121665 * Inverse(121666));
+        [NotNull] private static readonly BigInteger SqrtM1 = BigInteger.ModPow(2, (P - 1) / 4, P);
+        [NotNull] private static readonly Point G = BasePoint();
+
+        private class Point
+        {
+            public BigInteger X, Y, Z, T;
+            public Point(BigInteger x, BigInteger y, BigInteger z, BigInteger t) { X = x; Y = y; Z = z; T = t; }
+        }
+
+        /// <summary>
+        /// Derive the public key for a 32 byte private key
+        /// </summary>
+        [NotNull]public static byte[] PublicKey([NotNull]byte[] privateKey)
+        {
+            CheckLength(privateKey, KeySize, nameof(privateKey));
+            ExpandSecret(privateKey, out var a, out _);
+            return Compress(Multiply(a, G));
+        }
+
+        /// <summary>
+        /// Sign a message with a 32 byte private key. Returns a 64 byte signature.
+        /// </summary>
+        [NotNull]public static byte[] Sign([NotNull]byte[] privateKey, [NotNull]byte[] message)
+        {
+            CheckLength(privateKey, KeySize, nameof(privateKey));
+            if (message == null) throw new ArgumentNullException(nameof(message));
+
+            ExpandSecret(privateKey, out var a, out var prefix);
+            var publicKey = Compress(Multiply(a, G));
+            var r = HashModQ(prefix, message);
+            var rs = Compress(Multiply(r, G));
+            var h = HashModQ(rs, publicKey, message);
+            var s = Mod(r + h * a, Q);
+            return rs.Concat(ToBytes(s)).ToArray();
+        }
+
+        /// <summary>
+        /// Check a signature against a message and 32 byte public key.
+        /// Returns false for a bad signature, or for keys and signatures of the wrong length.
+        /// </summary>
+        public static bool Verify([NotNull]byte[] publicKey, [NotNull]byte[] message, [NotNull]byte[] signature)
+        {
+            if (publicKey == null || publicKey.Length != KeySize) return false;
+            if (signature == null || signature.Length != SignatureSize) return false;
+            if (message == null) return false;
+
+            var a = Decompress(publicKey);
+            if (a == null) return false;
+            var rs = signature.Take(KeySize).ToArray();
+            var r = Decompress(rs);
+            if (r == null) return false;
+            var s = FromBytes(signature.Skip(KeySize).ToArray());
+            if (s >= Q) return false;
+
+            var h = HashModQ(rs, publicKey, message);
+            return PointEqual(Multiply(s, G), Add(r, Multiply(h, a)));
+        }
+
+        private static void CheckLength(byte[] value, int length, [NotNull]string name)
+        {
+            if (value == null) throw new ArgumentNullException(name);
+            if (value.Length != length) throw new ArgumentException($"Expected {length} bytes, got {value.Length}", name);
+        }
+
+        private static void ExpandSecret([NotNull]byte[] secret, out BigInteger a, [NotNull]out byte[] prefix)
+        {
+            byte[] h;
+            using (var sha = SHA512.Create()) { h = sha.ComputeHash(secret); }
+            var low = h.Take(32).ToArray();
+            low[0] &= 248;   // clear the low three bits
+            low[31] &= 127;  // clear the top bit
+            low[31] |= 64;   // and set the next one
+            a = FromBytes(low);
+            prefix = h.Skip(32).ToArray();
+        }
+
+        private static BigInteger HashModQ([NotNull]params byte[][] parts)
+        {
+            using (var sha = SHA512.Create())
+            {
+                var all = parts.SelectMany(p => p).ToArray();
+                return Mod(FromBytes(sha.ComputeHash(all)), Q);
+            }
+        }
+
+        [NotNull]private static Point Add([NotNull]Point p, [NotNull]Point q)
+        {
+            var a = Mod((p.Y - p.X) * (q.Y - q.X));
+            var b = Mod((p.Y + p.X) * (q.Y + q.X));
+            var c = Mod(2 * p.T * q.T * D);
+            var d = Mod(2 * p.Z * q.Z);
+            var e = b - a;
+            var f = d - c;
+            var g = d + c;
+            var h = b + a;
+            return new Point(Mod(e * f), Mod(g * h), Mod(f * g), Mod(e * h));
+        }
+
+        [NotNull]private static Point Multiply(BigInteger s, [NotNull]Point p)
+        {
+            var result = new Point(0, 1, 1, 0); // neutral element
+            while (s > 0)
+            {
+                if (!s.IsEven) result = Add(result, p);
+                p = Add(p, p);
+                s >>= 1;
+            }
+            return result;
+        }
+
+        private static bool PointEqual([NotNull]Point p, [NotNull]Point q)
+        {
+            return Mod(p.X * q.Z - q.X * p.Z).IsZero && Mod(p.Y * q.Z - q.Y * p.Z).IsZero;
+        }
+
+        private static BigInteger? RecoverX(BigInteger y, bool sign)
+        {
+            if (y >= P) return null;
+            var x2 = Mod((y * y - 1) * Inverse(D * y * y + 1));
+            if (x2.IsZero) return sign ? (BigInteger?)null : BigInteger.Zero;
+
+            var x = BigInteger.ModPow(x2, (P + 3) / 8, P);
+            if (!Mod(x * x - x2).IsZero) x = Mod(x * SqrtM1);
+            if (!Mod(x * x - x2).IsZero) return null;
+
+            if (!x.IsEven != sign) x = P - x;
+            return x;
+        }
+
+        [NotNull]private static byte[] Compress([NotNull]Point p)
+        {
+            var zInv = Inverse(p.Z);
+            var x = Mod(p.X * zInv);
+            var y = Mod(p.Y * zInv);
+            var bytes = ToBytes(y);
+            if (!x.IsEven) bytes[31] |= 0x80;
+            return bytes;
+        }
+
+        private static Point? Decompress([NotNull]byte[] s)
+        {
+            if (s.Length != KeySize) return null;
+            var copy = (byte[])s.Clone();
+            var sign = (copy[31] & 0x80) != 0;
+            copy[31] &= 0x7F;
+            var y = FromBytes(copy);
+            var x = RecoverX(y, sign);
+            if (x == null) return null;
+            return new Point(x.Value, y, 1, Mod(x.Value * y));
+        }
+
+        [NotNull]private static Point BasePoint()
+        {
+            var y = Mod(4 * Inverse(5));
+            var x = RecoverX(y, false) ?? throw new Exception("Ed25519 base point is invalid");
+            return new Point(x, y, 1, Mod(x * y));
+        }
+
+        private static BigInteger Mod(BigInteger x) => Mod(x, P);
+
+        private static BigInteger Mod(BigInteger x, BigInteger m)
+        {
+            var r = BigInteger.Remainder(x, m);
+            return r.Sign < 0 ? r + m : r;
+        }
+
+        private static BigInteger Inverse(BigInteger x) => BigInteger.ModPow(Mod(x), P - 2, P);
+
+        /// <summary> Little-endian unsigned bytes to an integer </summary>
+        private static BigInteger FromBytes([NotNull]byte[] bytes)
+        {
+            var unsigned = new byte[bytes.Length + 1]; // trailing zero keeps the value positive
+            Array.Copy(bytes, unsigned, bytes.Length);
+            return new BigInteger(unsigned);
+        }
+
+        /// <summary> An integer below 2^256 to 32 little-endian bytes </summary>
+        [NotNull]private static byte[] ToBytes(BigInteger value)
+        {
+            var raw = value.ToByteArray();
+            var result = new byte[32];
+            Array.Copy(raw, result, Math.Min(raw.Length, 32));
+            return result;
+        }
+    }
+}
@@ -0,0 +1,67 @@
+﻿using System;
+using System.IO;
+using JetBrains.Annotations;
+
+namespace StreamDb.Internal.Support
+{
+    /// <summary>
+    /// Read-only wrapper for a forward-only stream whose length is known in advance
+    /// (e.g. a decompressing stream). Reports `Length` and `Position` so it can be
+    /// passed directly to `PageStorage.WriteStream` without buffering.
+    /// </summary>
+    public class KnownLengthStream : Stream
+    {
+        [NotNull]private readonly Stream _source;
+        private readonly long _length;
+        private long _position;
+
+        /// <summary>
+        /// Wrap a source stream. Reads will stop after `length` bytes, even if the source has more data.
+        /// </summary>
+        public KnownLengthStream([NotNull]Stream source, long length)
+        {
+            _source = source ?? throw new Exception("Source stream must not be null");
+            if (length < 0) throw new Exception("Stream length must not be negative");
+            _length = length;
+            _position = 0;
+        }
+
+        /// <inheritdoc />
+        public override int Read(byte[] buffer, int offset, int count)
+        {
+            var request = (int)Math.Min(count, _length - _position);
+            if (request < 1) return 0;
+            var actual = _source.Read(buffer, offset, request);
+            _position += actual;
+            return actual;
+        }
+
+        /// <inheritdoc />
+        public override long Seek(long offset, SeekOrigin origin) { throw new InvalidOperationException("Known length stream is forward-only"); }
+
+        /// <inheritdoc />
+        public override void SetLength(long value) { throw new InvalidOperationException("Known length stream is read only"); }
+
+        /// <inheritdoc />
+        public override void Write(byte[] buffer, int offset, int count) { throw new InvalidOperationException("Known length stream is read only"); }
+
+        /// <inheritdoc />
+        public override void Flush() { }
+
+        /// <inheritdoc />
+        public override bool CanRead => true;
+        /// <inheritdoc />
+        public override bool CanSeek => false;
+        /// <inheritdoc />
+        public override bool CanWrite => false;
+        /// <inheritdoc />
+        public override long Length => _length;
+
+        /// <inheritdoc />
+        public override long Position
+        {
+            get => _position;
+            set => throw new InvalidOperationException("Known length stream is forward-only");
+        }
+    }
+}
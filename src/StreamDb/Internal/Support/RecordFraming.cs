@@ -0,0 +1,129 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using JetBrains.Annotations;
+
+namespace StreamDb.Internal.Support
+{
+    /// <summary>
+    /// Frames variable length records so they can be packed into a single stream, for example
+    /// a page chain written with `PageStorage.WriteStream` and read back with `SimplePageStream`.
+    /// Each frame is checked on read, and the reader skips forward past damaged or partly overwritten frames
+    /// to the next one that checks out, so one bad record doesn't lose the rest.
+    /// </summary>
+    public static class RecordFraming
+    {
+        /*
+            Frame layout: [ Marker (2 bytes) | Length (int32) | CRC32 of record (uint32) | Record (Length bytes) ]
+        */
+        private const byte Marker0 = 0xC1;
+        private const byte Marker1 = 0x5E;
+
+        /// <summary> Bytes added to each record by framing </summary>
+        public const int FrameHeaderSize = 2 + 4 + 4;
+
+        /// <summary>
+        /// Frame a single record
+        /// </summary>
+        [NotNull]public static byte[] Frame([NotNull]byte[] record)
+        {
+            var ms = new MemoryStream(FrameHeaderSize + record.Length);
+            WriteFrame(ms, record);
+            return ms.ToArray() ?? throw new Exception("Failed to frame record");
+        }
+
+        /// <summary>
+        /// Write a framed record to the target stream, at its current position
+        /// </summary>
+        public static void WriteFrame([NotNull]Stream target, [NotNull]byte[] record)
+        {
+            if (record.Length < 1) throw new Exception("Record must not be empty");
+
+            var w = new BinaryWriter(target);
+            w.Write(Marker0);
+            w.Write(Marker1);
+            w.Write(record.Length);
+            w.Write(Crc32.Compute(record));
+            w.Write(record);
+            w.Flush();
+        }
+
+        /// <summary>
+        /// Frame a set of records into a single stream, positioned at the start, ready to be written to storage
+        /// </summary>
+        [NotNull]public static Stream Pack([NotNull, ItemNotNull]IEnumerable<byte[]> records)
+        {
+            var ms = new MemoryStream();
+            foreach (var record in records) { WriteFrame(ms, record); }
+            ms.Seek(0, SeekOrigin.Begin);
+            return ms;
+        }
+
+        /// <summary>
+        /// Read framed records from a seekable stream, in order. Each result is the offset of the frame in the stream, and the record.
+        /// Frames that fail their checks are skipped, and reading picks up at the next good frame.
+        /// </summary>
+        /// <param name="source">Seekable stream of framed records</param>
+        /// <param name="start">Offset to start reading. If this is not the start of a frame, reading picks up at the next one</param>
+        [NotNull]public static IEnumerable<KeyValuePair<long, byte[]>> Read([NotNull]Stream source, long start = 0)
+        {
+            if (!source.CanSeek) throw new Exception("Record stream must support seeking");
+
+            var header = new byte[FrameHeaderSize];
+            var position = Math.Max(0, start);
+            while (position + FrameHeaderSize <= source.Length)
+            {
+                source.Seek(position, SeekOrigin.Begin);
+                if (ReadFully(source, header) < FrameHeaderSize) yield break;
+
+                if (header[0] != Marker0 || header[1] != Marker1)
+                {
+                    position += SkipToMarker(header);
+                    continue;
+                }
+
+                var record = TryReadRecord(source, header);
+                if (record == null) { position++; continue; } // damaged or partly overwritten: look for the next frame
+
+                yield return new KeyValuePair<long, byte[]>(position, record);
+                position += FrameHeaderSize + record.Length;
+            }
+        }
+
+        private static byte[]? TryReadRecord([NotNull]Stream source, [NotNull]byte[] header)
+        {
+            var r = new BinaryReader(new MemoryStream(header, 2, FrameHeaderSize - 2, false));
+            var length = r.ReadInt32();
+            var crc = r.ReadUInt32();
+            if (length < 1 || length > source.Length - source.Position) return null;
+
+            var record = new byte[length];
+            if (ReadFully(source, record) < length) return null;
+            return Crc32.Compute(record) == crc ? record : null;
+        }
+
+        /// <summary>
+        /// Distance to the next possible frame start in a header that didn't match
+        /// </summary>
+        private static int SkipToMarker([NotNull]byte[] header)
+        {
+            for (int i = 1; i < header.Length; i++)
+            {
+                if (header[i] == Marker0) return i;
+            }
+            return header.Length;
+        }
+
+        private static int ReadFully([NotNull]Stream source, [NotNull]byte[] buffer)
+        {
+            var read = 0;
+            while (read < buffer.Length)
+            {
+                var count = source.Read(buffer, read, buffer.Length - read);
+                if (count < 1) break;
+                read += count;
+            }
+            return read;
+        }
+    }
+}
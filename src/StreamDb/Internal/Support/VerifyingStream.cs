@@ -0,0 +1,135 @@
+﻿using System;
+using System.IO;
+using System.Linq;
+using System.Security.Cryptography;
+using JetBrains.Annotations;
+using StreamDb.Internal.Core;
+
+namespace StreamDb.Internal.Support
+{
+    /// <summary>
+    /// Read-only, forward-only wrapper for a stored document that checks it as it is read.
+    /// Storage damage (failed page CRCs, broken chains) is reported as an `ExportVerificationException` naming the path.
+    /// On reaching the end, the number of bytes read and their SHA-256 hash are checked against expected values, if given.
+    /// </summary>
+    public class VerifyingStream : Stream
+    {
+        [NotNull]private readonly Stream _source;
+        [NotNull]private readonly string _path;
+        private readonly long _expectedLength;
+        private readonly byte[]? _expectedHash;
+        [NotNull]private readonly IncrementalHash _sha;
+        private long _position;
+        private bool _checked;
+
+        /// <summary>
+        /// Wrap a document stream
+        /// </summary>
+        /// <param name="source">Stream of the stored document</param>
+        /// <param name="path">Path of the document, used in errors</param>
+        /// <param name="expectedLength">Length recorded for the document, or -1 to not check</param>
+        /// <param name="expectedHash">SHA-256 of the document's content, or null to not check</param>
+        public VerifyingStream([NotNull]Stream source, [NotNull]string path, long expectedLength, byte[]? expectedHash)
+        {
+            _source = source ?? throw new Exception("Source stream must not be null");
+            _path = path ?? throw new Exception("Path must not be null");
+            _expectedLength = expectedLength;
+            _expectedHash = expectedHash;
+            _sha = IncrementalHash.CreateHash(HashAlgorithmName.SHA256) ?? throw new Exception("Failed to create hash");
+        }
+
+        /// <inheritdoc />
+        public override int Read(byte[] buffer, int offset, int count)
+        {
+            var actual = Guard(() => _source.Read(buffer, offset, count));
+            if (actual < 1)
+            {
+                CheckContent();
+                return 0;
+            }
+            _sha.AppendData(buffer, offset, actual);
+            _position += actual;
+            return actual;
+        }
+
+        private void CheckContent()
+        {
+            if (_checked) return;
+            _checked = true;
+
+            if (_expectedLength >= 0 && _position != _expectedLength)
+                throw new ExportVerificationException(_path, -1, $"read {_position} bytes, but the index records {_expectedLength}");
+
+            var hash = _sha.GetHashAndReset();
+            if (_expectedHash != null && !hash.SequenceEqual(_expectedHash))
+                throw new ExportVerificationException(_path, -1, "content does not match the manifest hash");
+        }
+
+        private T Guard<T>([NotNull]Func<T> read)
+        {
+            try
+            {
+                return read();
+            }
+            catch (Exception ex) when (!(ex is ExportVerificationException))
+            {
+                throw StorageFailure(_path, ex);
+            }
+        }
+
+        /// <summary>
+        /// Describe a failure to read a document from storage, naming the damaged page if one is known
+        /// </summary>
+        [NotNull]public static ExportVerificationException StorageFailure([NotNull]string path, [NotNull]Exception ex)
+        {
+            var pageId = -1;
+            for (var inner = ex; inner != null; inner = inner.InnerException)
+            {
+                if (inner is ChainException chain) pageId = chain.LoopEntryPageId;
+                else if (inner.Data?[PageStorage.PageIdDataKey] is int id) pageId = id;
+                else continue;
+                break;
+            }
+            return new ExportVerificationException(path, pageId, ex.Message, ex);
+        }
+
+        /// <inheritdoc />
+        protected override void Dispose(bool disposing)
+        {
+            if (disposing)
+            {
+                _sha.Dispose();
+                _source.Dispose();
+            }
+            base.Dispose(disposing);
+        }
+
+        /// <inheritdoc />
+        public override long Seek(long offset, SeekOrigin origin) { throw new InvalidOperationException("Verifying stream is forward-only"); }
+
+        /// <inheritdoc />
+        public override void SetLength(long value) { throw new InvalidOperationException("Verifying stream is read only"); }
+
+        /// <inheritdoc />
+        public override void Write(byte[] buffer, int offset, int count) { throw new InvalidOperationException("Verifying stream is read only"); }
+
+        /// <inheritdoc />
+        public override void Flush() { }
+
+        /// <inheritdoc />
+        public override bool CanRead => true;
+        /// <inheritdoc />
+        public override bool CanSeek => false;
+        /// <inheritdoc />
+        public override bool CanWrite => false;
+        /// <inheritdoc />
+        public override long Length => Guard(() => _source.Length);
+
+        /// <inheritdoc />
+        public override long Position
+        {
+            get => _position;
+            set => throw new InvalidOperationException("Verifying stream is forward-only");
+        }
+    }
+}
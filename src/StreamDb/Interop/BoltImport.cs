@@ -0,0 +1,184 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using System.Text;
+using JetBrains.Annotations;
+
+namespace StreamDb.Interop
+{
+    /// <summary>
+    /// Reads a BoltDB / bbolt database file, and writes every key as a StreamDb document.
+    /// Bucket names and the key are joined with '/' to make the document path,
+    /// so key `k` in bucket `a` nested in bucket `b` is stored at `b/a/k`.
+    /// </summary>
+    /// <remarks>
+    /// This reads the bolt file format directly, so no bolt library is needed.
+    /// Only the committed state (newest valid meta page) is read. Values are assumed to fit in memory.
+    /// </remarks>
+    public static class BoltImport
+    {
+        private const uint BoltMagic = 0xED0CDAED;
+        private const int PageHeaderSize = 16; // id:u64, flags:u16, count:u16, overflow:u32
+        private const int ElementSize = 16;    // both leaf and branch elements
+        private const int MetaSize = 64;       // including checksum
+
+        private const ushort BranchPageFlag = 0x01;
+        private const ushort LeafPageFlag = 0x02;
+        private const uint BucketLeafFlag = 0x01;
+
+        /// <summary>
+        /// Copy all keys from a bolt file into the target database. Returns the number of documents written.
+        /// Existing documents at the same paths are replaced.
+        /// </summary>
+        /// <param name="boltFile">Seekable, readable stream of a bolt database file</param>
+        /// <param name="target">Database to write into</param>
+        public static int ImportInto([NotNull]Stream boltFile, [NotNull]Database target)
+        {
+            if (!boltFile.CanSeek || !boltFile.CanRead) throw new Exception("Bolt file stream must be readable and seekable");
+
+            var reader = new BoltReader(boltFile);
+            var count = 0;
+            reader.Walk((path, value) => {
+                target.WriteDocument(path, new MemoryStream(value));
+                count++;
+            });
+            return count;
+        }
+
+        /// <summary>
+        /// Walks the B+tree pages of a bolt file
+        /// </summary>
+        private class BoltReader
+        {
+            [NotNull] private readonly Stream _file;
+            private readonly int _pageSize;
+            private readonly ulong _rootPageId;
+
+            public BoltReader([NotNull]Stream file)
+            {
+                _file = file;
+
+                // Meta pages are the first two pages. Page size is stored in the meta, so read the first one blind.
+                var meta0 = ReadBytes(PageHeaderSize, MetaSize);
+                var ok0 = TryReadMeta(meta0, out var pageSize0, out var root0, out var txid0);
+
+                // If the first meta is damaged, guess the usual page size to find the second.
+                var meta1Offset = (ok0 ? pageSize0 : 4096) + PageHeaderSize;
+                var meta1 = (meta1Offset + MetaSize <= file.Length) ? ReadBytes(meta1Offset, MetaSize) : new byte[MetaSize];
+                var ok1 = TryReadMeta(meta1, out var pageSize1, out var root1, out var txid1);
+
+                if (!ok0 && !ok1) throw new Exception("File is not a valid bolt database (no valid meta page)");
+
+                var useSecond = ok1 && (!ok0 || txid1 > txid0);
+                _pageSize = useSecond ? pageSize1 : pageSize0;
+                _rootPageId = useSecond ? root1 : root0;
+            }
+
+            /// <summary>
+            /// Call the action for every non-bucket key, with the full path
+            /// </summary>
+            public void Walk([NotNull]Action<string, byte[]> action)
+            {
+                WalkPage(ReadPage(_rootPageId), 0, "", action, new HashSet<ulong>());
+            }
+
+            private void WalkPage([NotNull]byte[] buf, int pageStart, [NotNull]string prefix, [NotNull]Action<string, byte[]> action, [NotNull]HashSet<ulong> seen)
+            {
+                var flags = BitConverter.ToUInt16(buf, pageStart + 8);
+                var count = BitConverter.ToUInt16(buf, pageStart + 10);
+
+                for (int i = 0; i < count; i++)
+                {
+                    var elem = pageStart + PageHeaderSize + (i * ElementSize);
+
+                    if ((flags & BranchPageFlag) != 0)
+                    {
+                        var childId = BitConverter.ToUInt64(buf, elem + 8);
+                        if (!seen.Add(childId)) throw new Exception($"Bolt file has a loop at page {childId}");
+                        WalkPage(ReadPage(childId), 0, prefix, action, seen);
+                        continue;
+                    }
+
+                    if ((flags & LeafPageFlag) == 0) throw new Exception($"Unexpected bolt page type {flags:X}");
+
+                    var elemFlags = BitConverter.ToUInt32(buf, elem);
+                    var pos = (int)BitConverter.ToUInt32(buf, elem + 4);
+                    var keySize = (int)BitConverter.ToUInt32(buf, elem + 8);
+                    var valueSize = (int)BitConverter.ToUInt32(buf, elem + 12);
+
+                    var key = Encoding.UTF8.GetString(buf, elem + pos, keySize);
+                    var valueStart = elem + pos + keySize;
+
+                    if ((elemFlags & BucketLeafFlag) == 0)
+                    {
+                        var value = new byte[valueSize];
+                        Buffer.BlockCopy(buf, valueStart, value, 0, valueSize);
+                        action(prefix + key, value);
+                        continue;
+                    }
+
+                    // Sub-bucket. Header is root:u64, sequence:u64. Root of zero means an inline page follows.
+                    var bucketRoot = BitConverter.ToUInt64(buf, valueStart);
+                    if (bucketRoot == 0)
+                    {
+                        WalkPage(buf, valueStart + 16, prefix + key + "/", action, seen);
+                    }
+                    else
+                    {
+                        if (!seen.Add(bucketRoot)) throw new Exception($"Bolt file has a loop at page {bucketRoot}");
+                        WalkPage(ReadPage(bucketRoot), 0, prefix + key + "/", action, seen);
+                    }
+                }
+            }
+
+            [NotNull]private byte[] ReadPage(ulong pageId)
+            {
+                var offset = (long)pageId * _pageSize;
+                var header = ReadBytes(offset, PageHeaderSize);
+                var overflow = BitConverter.ToUInt32(header, 12);
+                return ReadBytes(offset, (int)((overflow + 1) * _pageSize));
+            }
+
+            [NotNull]private byte[] ReadBytes(long offset, int length)
+            {
+                if (offset + length > _file.Length) throw new Exception($"Bolt file is truncated (wanted {length} bytes at {offset})");
+                var buf = new byte[length];
+                _file.Seek(offset, SeekOrigin.Begin);
+                var read = 0;
+                while (read < length)
+                {
+                    var got = _file.Read(buf, read, length - read);
+                    if (got < 1) throw new Exception("Bolt file read did not progress");
+                    read += got;
+                }
+                return buf;
+            }
+
+            private static bool TryReadMeta([NotNull]byte[] meta, out int pageSize, out ulong rootPageId, out ulong txid)
+            {
+                pageSize = (int)BitConverter.ToUInt32(meta, 8);
+                rootPageId = BitConverter.ToUInt64(meta, 16);
+                txid = BitConverter.ToUInt64(meta, 48);
+
+                if (BitConverter.ToUInt32(meta, 0) != BoltMagic) return false;
+                if (pageSize < 512) return false;
+                return BitConverter.ToUInt64(meta, 56) == Fnv64A(meta, 56);
+            }
+
+            /// <summary> FNV-1a, as used for bolt meta checksums </summary>
+            public static ulong Fnv64A([NotNull]byte[] data, int length)
+            {
+                var hash = 14695981039346656037UL;
+                unchecked
+                {
+                    for (int i = 0; i < length; i++)
+                    {
+                        hash ^= data[i];
+                        hash *= 1099511628211UL;
+                    }
+                }
+                return hash;
+            }
+        }
+    }
+}
@@ -0,0 +1,82 @@
+﻿using System;
+using System.Collections.Generic;
+using JetBrains.Annotations;
+
+namespace StreamDb.Interop
+{
+    /// <summary>
+    /// An item in a directory-style view of document paths
+    /// </summary>
+    public class DirectoryEntry
+    {
+        /// <summary> Last segment of the path </summary>
+        [NotNull] public string Name { get; set; } = "";
+
+        /// <summary> Full path from root, without leading or trailing separators </summary>
+        [NotNull] public string FullPath { get; set; } = "";
+
+        /// <summary> True if this is an implied directory rather than a document </summary>
+        public bool IsDirectory { get; set; }
+    }
+
+    /// <summary>
+    /// Presents document paths as a file system tree, splitting on '/'.
+    /// Directories are implied by paths -- they exist while any document path is inside them.
+    /// </summary>
+    public static class DirectoryListing
+    {
+        /// <summary> Path separator used to build the tree </summary>
+        public const char Separator = '/';
+
+        /// <summary>
+        /// List the immediate children of a directory. Use "" for the root.
+        /// A path may be both a document and a directory; if so, both entries are returned.
+        /// </summary>
+        [NotNull, ItemNotNull]public static IEnumerable<DirectoryEntry> ListChildren([NotNull]Database db, [NotNull]string directory)
+        {
+            var prefix = NormalisePath(directory);
+            if (prefix.Length > 0) prefix += Separator;
+
+            var seenDirectories = new HashSet<string>();
+            foreach (var path in db.Search(prefix))
+            {
+                var rest = path.Substring(prefix.Length);
+                if (rest.Length < 1) continue;
+                var split = rest.IndexOf(Separator);
+                if (split < 0)
+                {
+                    yield return new DirectoryEntry { Name = rest, FullPath = path, IsDirectory = false };
+                    continue;
+                }
+                if (split == 0) continue; // empty segment; not representable as a file
+
+                var name = rest.Substring(0, split);
+                if (seenDirectories.Add(name))
+                {
+                    yield return new DirectoryEntry { Name = name, FullPath = prefix + name, IsDirectory = true };
+                }
+            }
+        }
+
+        /// <summary>
+        /// Returns true if any document path is inside the given directory. The root always exists.
+        /// </summary>
+        public static bool DirectoryExists([NotNull]Database db, [NotNull]string directory)
+        {
+            var prefix = NormalisePath(directory);
+            if (prefix.Length < 1) return true;
+            using (var e = db.Search(prefix + Separator).GetEnumerator())
+            {
+                return e.MoveNext();
+            }
+        }
+
+        /// <summary>
+        /// Remove leading and trailing separators
+        /// </summary>
+        [NotNull]public static string NormalisePath(string? path)
+        {
+            return (path ?? "").Trim(Separator);
+        }
+    }
+}
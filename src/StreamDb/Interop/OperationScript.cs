@@ -0,0 +1,271 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using System.Linq;
+using System.Security.Cryptography;
+using System.Text;
+using JetBrains.Annotations;
+using StreamDb.Internal.Support;
+
+namespace StreamDb.Interop
+{
+    /// <summary>
+    /// Logical export of a database as an ordered script of operations ("put path = bytes", "bind path to same document
+    /// as other path", "delete path"). Replaying the script into a fresh database rebuilds an equivalent copy,
+    /// independent of the physical page layout. This makes a compact, defragmented backup.
+    /// A script of only the differences from an earlier backup can be made with `DiffSince`.
+    /// </summary>
+    /// <remarks>
+    /// Only documents bound to paths are exported. Trash, pins and the audit log are engine state, and are not included.
+    /// </remarks>
+    public static class OperationScript
+    {
+        /*
+            Script layout:
+                [ Magic (8 bytes) ]
+                then any number of operations:
+                    Put:    [ 1 | Path (string) | Annotation (optional string) | Length (int64) | Data (Length bytes) ]
+                    Bind:   [ 2 | Path (string) | Annotation (optional string) | Source path (string) ]
+                    Delete: [ 3 | Path (string) ]
+                ending with:
+                    End:    [ 0 ]
+
+            Strings are written with `BinaryWriter.Write(string)` in UTF-8.
+            Optional strings have a leading bool flag.
+        */
+        [NotNull] private static readonly byte[] ScriptMagic = { 0x53, 0x44, 0x42, 0x2D, 0x4F, 0x50, 0x53, 0x31 };
+
+        private const byte OpEnd = 0;
+        private const byte OpPut = 1;
+        private const byte OpBind = 2;
+        private const byte OpDelete = 3;
+
+        /// <summary>
+        /// Write every bound path in the database as a replayable operation script.
+        /// Each document's data is written once; any further paths to the same document are written as binds.
+        /// The export is read from a snapshot (see `Database.OpenSnapshot`), so writes made while it runs are not included.
+        /// The output stream does not need to be seekable.
+        /// </summary>
+        /// <param name="source">Database to export</param>
+        /// <param name="output">Writable stream for the script</param>
+        /// <param name="verify">If true, documents are checked as they are copied (see `VerifiedReader`),
+        /// and the export stops with an `ExportVerificationException` at the first damaged document</param>
+        /// <returns>Number of operations written</returns>
+        public static int ExportOps([NotNull]Database source, [NotNull]Stream output, bool verify = false)
+        {
+            var count = 0;
+            using (var snapshot = source.OpenSnapshot())
+            {
+                var reader = verify ? source.StartVerifiedRead(snapshot) : null;
+                var written = new Dictionary<Guid, string>();
+                var w = new BinaryWriter(output, Encoding.UTF8);
+                w.Write(ScriptMagic);
+
+                foreach (var path in snapshot.Search(""))
+                {
+                    var binding = snapshot.GetBindingInfo(path);
+                    if (binding == null) continue;
+
+                    if (written.TryGetValue(binding.DocumentId, out var firstPath))
+                    {
+                        WriteBind(w, binding, firstPath);
+                    }
+                    else
+                    {
+                        if (!WritePut(w, snapshot, reader, binding)) continue;
+                        written.Add(binding.DocumentId, path);
+                    }
+                    count++;
+                }
+
+                w.Write(OpEnd);
+                w.Flush();
+            }
+            return count;
+        }
+
+        /// <summary>
+        /// Write a script that updates a backup copy to match the current database.
+        /// Only paths whose content or annotation differ are written, along with deletes for paths no longer bound.
+        /// Both databases are read from snapshots (see `Database.OpenSnapshot`), so writes made while the diff runs are not included.
+        /// Apply the result to the backup with `ReplayOps`.
+        /// </summary>
+        /// <remarks>
+        /// Documents are compared by SHA-256 of their content, so both databases are read in full.
+        /// Documents shared between paths in `current` are shared in the backup after replay only where the shared paths change together.
+        /// </remarks>
+        /// <param name="backup">Previous copy of the database, e.g. made by replaying `ExportOps`</param>
+        /// <param name="current">Database to compare against the backup</param>
+        /// <param name="output">Writable stream for the script</param>
+        /// <param name="verify">If true, documents copied from `current` are checked as they are written (see `VerifiedReader`),
+        /// and the diff stops with an `ExportVerificationException` at the first damaged document</param>
+        /// <returns>Number of operations written</returns>
+        public static int DiffSince([NotNull]Database backup, [NotNull]Database current, [NotNull]Stream output, bool verify = false)
+        {
+            var count = 0;
+            var w = new BinaryWriter(output, Encoding.UTF8);
+            w.Write(ScriptMagic);
+
+            using (var sha = SHA256.Create())
+            using (var backupSnapshot = backup.OpenSnapshot())
+            using (var currentSnapshot = current.OpenSnapshot())
+            {
+                var reader = verify ? current.StartVerifiedRead(currentSnapshot) : null;
+                var currentHashes = new Dictionary<Guid, string>();
+                var available = new Dictionary<Guid, string>(); // current document -> a path that holds it in the backup after replay
+                var changed = new List<BindingInfo>();
+
+                var currentPaths = currentSnapshot.Search("").ToList();
+                foreach (var path in currentPaths)
+                {
+                    var binding = currentSnapshot.GetBindingInfo(path);
+                    if (binding == null) continue;
+
+                    if (!currentHashes.TryGetValue(binding.DocumentId, out var hash))
+                    {
+                        hash = HashOf(sha, currentSnapshot, path);
+                        currentHashes.Add(binding.DocumentId, hash);
+                    }
+
+                    var old = backupSnapshot.GetBindingInfo(path);
+                    if (old != null && old.Annotation == binding.Annotation && HashOf(sha, backupSnapshot, path) == hash)
+                    {
+                        if (!available.ContainsKey(binding.DocumentId)) available.Add(binding.DocumentId, path);
+                        continue;
+                    }
+                    changed.Add(binding);
+                }
+
+                var remaining = new HashSet<string>(currentPaths);
+                foreach (var path in backupSnapshot.Search(""))
+                {
+                    if (remaining.Contains(path)) continue;
+                    w.Write(OpDelete);
+                    w.Write(path);
+                    count++;
+                }
+
+                foreach (var binding in changed)
+                {
+                    if (available.TryGetValue(binding.DocumentId, out var sourcePath))
+                    {
+                        WriteBind(w, binding, sourcePath);
+                    }
+                    else
+                    {
+                        if (!WritePut(w, currentSnapshot, reader, binding)) continue;
+                        available.Add(binding.DocumentId, binding.Path);
+                    }
+                    count++;
+                }
+            }
+
+            w.Write(OpEnd);
+            w.Flush();
+            return count;
+        }
+
+        /// <summary>
+        /// Apply an operation script to a database, in order.
+        /// Replaying an export into an empty database gives an equivalent copy of the original.
+        /// </summary>
+        /// <param name="input">Readable stream containing a script written by `ExportOps`. It does not need to be seekable</param>
+        /// <param name="target">Database to write into</param>
+        /// <returns>Number of operations applied</returns>
+        public static int ReplayOps([NotNull]Stream input, [NotNull]Database target)
+        {
+            var count = 0;
+            var r = new BinaryReader(input, Encoding.UTF8);
+            var magic = r.ReadBytes(ScriptMagic.Length);
+            if (magic.Length != ScriptMagic.Length || !magic.SequenceEqual(ScriptMagic)) throw new Exception("Input is not a StreamDb operation script");
+
+            while (true)
+            {
+                var op = r.ReadByte();
+                switch (op)
+                {
+                    case OpEnd:
+                        return count;
+
+                    case OpPut:
+                    {
+                        var path = r.ReadString();
+                        var annotation = ReadOptional(r);
+                        var length = r.ReadInt64();
+                        var body = new KnownLengthStream(input, length);
+                        target.WriteDocument(path, body, annotation);
+                        body.CopyTo(Stream.Null); // make sure we are at the next operation, even if the write stopped early
+                        if (body.Position != length) throw new Exception($"Operation script ended inside the data for '{path}'");
+                        break;
+                    }
+
+                    case OpBind:
+                    {
+                        var path = r.ReadString();
+                        var annotation = ReadOptional(r);
+                        var sourcePath = r.ReadString();
+                        if (!target.GetIdByPath(sourcePath, out var id)) throw new Exception($"Operation script binds '{path}' to '{sourcePath}', which does not exist");
+                        target.BindToPath(id, path, annotation);
+                        break;
+                    }
+
+                    case OpDelete:
+                    {
+                        // only this path goes. The document is deleted with its last path.
+                        var path = r.ReadString();
+                        if (!target.GetIdByPath(path, out var id)) break;
+                        if (target.ListPaths(id).Skip(1).Any()) target.UnbindPath(id, path);
+                        else target.Delete(path);
+                        break;
+                    }
+
+                    default: throw new Exception($"Unknown operation {op} in operation script");
+                }
+                count++;
+            }
+        }
+
+        private static bool WritePut([NotNull]BinaryWriter w, [NotNull]DatabaseSnapshot source, VerifiedReader? reader, [NotNull]BindingInfo binding)
+        {
+            Stream? stream;
+            var found = reader?.Get(binding.Path, out stream) ?? source.Get(binding.Path, out stream);
+            if (!found || stream == null) return false;
+
+            using (stream)
+            {
+                w.Write(OpPut);
+                w.Write(binding.Path);
+                WriteOptional(w, binding.Annotation);
+                w.Write(stream.Length);
+                w.Flush();
+                stream.CopyTo(w.BaseStream);
+            }
+            return true;
+        }
+
+        private static void WriteBind([NotNull]BinaryWriter w, [NotNull]BindingInfo binding, [NotNull]string sourcePath)
+        {
+            w.Write(OpBind);
+            w.Write(binding.Path);
+            WriteOptional(w, binding.Annotation);
+            w.Write(sourcePath);
+        }
+
+        [NotNull]private static string HashOf([NotNull]HashAlgorithm sha, [NotNull]DatabaseSnapshot source, [NotNull]string path)
+        {
+            if (!source.Get(path, out var stream) || stream == null) return "";
+            using (stream) { return Convert.ToBase64String(sha.ComputeHash(stream)); }
+        }
+
+        private static void WriteOptional([NotNull]BinaryWriter w, string? value)
+        {
+            w.Write(value != null);
+            if (value != null) w.Write(value);
+        }
+
+        private static string? ReadOptional([NotNull]BinaryReader r)
+        {
+            return r.ReadBoolean() ? r.ReadString() : null;
+        }
+    }
+}
@@ -0,0 +1,32 @@
+﻿using System;
+using System.IO;
+using JetBrains.Annotations;
+
+namespace StreamDb.Interop
+{
+    /// <summary>
+    /// Codec for protocol buffer messages. The schema ID is "proto:" followed by the message type's full name.
+    /// </summary>
+    /// <remarks>
+    /// StreamDb doesn't take a dependency on a protobuf library, so the message's own write and parse methods are supplied.
+    /// With Google.Protobuf, this is:
+    /// <code>db.Codecs.Register(ProtoCodec.For&lt;MyMessage&gt;((m, s) => m.WriteTo(s), MyMessage.Parser.ParseFrom));</code>
+    /// </remarks>
+    public static class ProtoCodec
+    {
+        /// <summary>
+        /// Prefix of schema IDs for protobuf messages
+        /// </summary>
+        public const string SchemaPrefix = "proto:";
+
+        /// <summary>
+        /// Build a codec for a protobuf message type
+        /// </summary>
+        /// <param name="writeTo">Serialise a message to a stream</param>
+        /// <param name="parseFrom">Parse a message from a stream</param>
+        [NotNull]public static Codec<T> For<T>(Action<T, Stream> writeTo, Func<Stream, T> parseFrom)
+        {
+            return new DelegateCodec<T>(SchemaPrefix + typeof(T).FullName, writeTo, parseFrom);
+        }
+    }
+}
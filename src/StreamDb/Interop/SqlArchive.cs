@@ -0,0 +1,154 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using System.IO.Compression;
+using JetBrains.Annotations;
+
+namespace StreamDb.Interop
+{
+    /// <summary>
+    /// A single row of an SQLite Archive (sqlar) table
+    /// </summary>
+    public class SqlarRow
+    {
+        /// <summary> File name (document path) </summary>
+        [NotNull] public string Name { get; set; } = "";
+
+        /// <summary> Unix file mode. Regular files are 0100644 </summary>
+        public int Mode { get; set; }
+
+        /// <summary> Last modification time, in seconds since the Unix epoch </summary>
+        public long MTime { get; set; }
+
+        /// <summary> Original (uncompressed) size of the data </summary>
+        public long Size { get; set; }
+
+        /// <summary> Content. If this is shorter than `Size`, it is zlib compressed </summary>
+        [NotNull] public byte[] Data { get; set; } = new byte[0];
+    }
+
+    /// <summary>
+    /// Interchange with the SQLite Archive format (https://sqlite.org/sqlar.html).
+    /// </summary>
+    /// <remarks>
+    /// StreamDb doesn't depend on an SQLite engine, so this produces and consumes table rows.
+    /// Use your SQLite library to insert/select rows against `Schema`.
+    /// </remarks>
+    public static class SqlArchive
+    {
+        /// <summary> Table definition used by the sqlar tools </summary>
+        public const string Schema = "CREATE TABLE IF NOT EXISTS sqlar(name TEXT PRIMARY KEY, mode INT, mtime INT, sz INT, data BLOB);";
+
+        /// <summary> Insert statement matching `SqlarRow` fields, with named parameters </summary>
+        public const string InsertStatement = "REPLACE INTO sqlar(name, mode, mtime, sz, data) VALUES (@name, @mode, @mtime, @sz, @data);";
+
+        /// <summary> Mode for a regular file, readable by all, writable by owner </summary>
+        public const int RegularFileMode = 0x81A4; // 0100644
+
+        private const int FileTypeMask = 0xF000;  // 0170000
+
+        /// <summary>
+        /// Produce an sqlar row for every document path in the database.
+        /// Data is compressed where that makes it smaller, as the sqlar tools do.
+        /// The export is read from a snapshot (see `Database.OpenSnapshot`), so writes made while it runs are not included.
+        /// </summary>
+        /// <param name="source">Database to export</param>
+        /// <param name="writeRow">Called once per path. Insert the row into your sqlar table here</param>
+        /// <param name="compress">If false, data is always stored uncompressed</param>
+        /// <returns>Number of rows written</returns>
+        public static int ExportSqlar([NotNull]Database source, [NotNull]Action<SqlarRow> writeRow, bool compress = true)
+        {
+            var mtime = DateTimeOffset.UtcNow.ToUnixTimeSeconds();
+            var count = 0;
+            using (var snapshot = source.OpenSnapshot())
+            foreach (var path in snapshot.Search(""))
+            {
+                if (!snapshot.Get(path, out var stream) || stream == null) continue;
+                var raw = new MemoryStream();
+                using (stream) { stream.CopyTo(raw); }
+                var data = raw.ToArray();
+
+                var stored = data;
+                if (compress)
+                {
+                    var packed = ZlibCompress(data);
+                    if (packed.Length < data.Length) stored = packed;
+                }
+
+                writeRow(new SqlarRow { Name = path, Mode = RegularFileMode, MTime = mtime, Size = data.Length, Data = stored });
+                count++;
+            }
+            return count;
+        }
+
+        /// <summary>
+        /// Write each regular-file row into the database as a document, using the row name as the path.
+        /// Directory and symlink rows are skipped.
+        /// </summary>
+        /// <returns>Number of documents written</returns>
+        public static int ImportSqlar([NotNull]IEnumerable<SqlarRow> rows, [NotNull]Database target)
+        {
+            var count = 0;
+            foreach (var row in rows)
+            {
+                if (row == null || string.IsNullOrEmpty(row.Name)) continue;
+                var fileType = row.Mode & FileTypeMask;
+                if (fileType != 0 && fileType != (RegularFileMode & FileTypeMask)) continue; // directory, link, etc
+
+                var data = (row.Data.Length < row.Size) ? ZlibDecompress(row.Data, row.Size) : row.Data;
+                target.WriteDocument(row.Name, new MemoryStream(data));
+                count++;
+            }
+            return count;
+        }
+
+        /// <summary>
+        /// Compress with a zlib wrapper (as SQLite's `sqlar_compress`)
+        /// </summary>
+        [NotNull]public static byte[] ZlibCompress([NotNull]byte[] data)
+        {
+            var ms = new MemoryStream();
+            ms.WriteByte(0x78); // deflate, 32k window
+            ms.WriteByte(0x9C); // default compression, header check bits
+            using (var deflate = new DeflateStream(ms, CompressionLevel.Optimal, leaveOpen: true))
+            {
+                deflate.Write(data, 0, data.Length);
+            }
+
+            var adler = Adler32(data);
+            ms.WriteByte((byte)(adler >> 24));
+            ms.WriteByte((byte)(adler >> 16));
+            ms.WriteByte((byte)(adler >> 8));
+            ms.WriteByte((byte)adler);
+            return ms.ToArray();
+        }
+
+        /// <summary>
+        /// Decompress zlib wrapped data, checking the result length
+        /// </summary>
+        [NotNull]public static byte[] ZlibDecompress([NotNull]byte[] data, long expectedSize)
+        {
+            if (data.Length < 6 || (data[0] & 0x0F) != 8) throw new Exception("Data is not zlib compressed");
+
+            var output = new MemoryStream();
+            using (var deflate = new DeflateStream(new MemoryStream(data, 2, data.Length - 2), CompressionMode.Decompress))
+            {
+                deflate.CopyTo(output);
+            }
+            if (output.Length != expectedSize) throw new Exception($"Decompressed size was {output.Length}, but expected {expectedSize}");
+            return output.ToArray();
+        }
+
+        private static uint Adler32([NotNull]byte[] data)
+        {
+            const uint mod = 65521;
+            uint a = 1, b = 0;
+            foreach (var d in data)
+            {
+                a = (a + d) % mod;
+                b = (b + a) % mod;
+            }
+            return (b << 16) | a;
+        }
+    }
+}
@@ -0,0 +1,401 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using System.Linq;
+using System.Text;
+using System.Xml.Linq;
+using JetBrains.Annotations;
+using StreamDb.Internal.Support;
+
+namespace StreamDb.Interop
+{
+    /// <summary>
+    /// A WebDAV request, as received by whichever HTTP server is hosting the handler
+    /// </summary>
+    public class WebDavRequest
+    {
+        /// <summary> HTTP method, e.g. "PROPFIND" </summary>
+        [NotNull] public string Method { get; set; } = "GET";
+
+        /// <summary> Request path, still URL encoded, e.g. "/dav/images/a%20b.png" </summary>
+        [NotNull] public string Path { get; set; } = "/";
+
+        /// <summary> Request headers. Names are matched case-insensitively </summary>
+        [NotNull] public IDictionary<string, string> Headers { get; set; } = new Dictionary<string, string>(StringComparer.OrdinalIgnoreCase);
+
+        /// <summary> Request body, if any </summary>
+        public Stream? Body { get; set; }
+
+        /// <summary> Read a header value, or null if not present </summary>
+        public string? Header([NotNull]string name)
+        {
+            foreach (var kvp in Headers)
+            {
+                if (string.Equals(kvp.Key, name, StringComparison.OrdinalIgnoreCase)) return kvp.Value;
+            }
+            return null;
+        }
+    }
+
+    /// <summary>
+    /// Response to be sent by the hosting HTTP server
+    /// </summary>
+    public class WebDavResponse
+    {
+        /// <summary> HTTP status code </summary>
+        public int StatusCode { get; set; } = 200;
+
+        /// <summary> Response headers </summary>
+        [NotNull] public IDictionary<string, string> Headers { get; set; } = new Dictionary<string, string>();
+
+        /// <summary> Response body, if any. The host should dispose of this after sending </summary>
+        public Stream? Body { get; set; }
+    }
+
+    /// <summary>
+    /// Maps WebDAV (class 1) requests onto database operations, so OS file browsers can mount a store.
+    /// Paths are presented as a tree using `DirectoryListing`.
+    /// </summary>
+    /// <remarks>
+    /// This is transport-agnostic: host it in any HTTP server by converting requests and responses.
+    /// Locking (class 2) is not supported.
+    /// <para></para>
+    /// `GET /healthz` is answered with a `Database.HealthCheck` result, for service deployments, wherever the handler is mounted.
+    /// Add `?level=standard` or `?level=deep` for a more thorough check.
+    /// </remarks>
+    public class WebDavHandler
+    {
+        [NotNull] private static readonly XNamespace Dav = "DAV:";
+
+        /// <summary> Request path answered with a health check, rather than a document </summary>
+        public const string HealthPath = "/healthz";
+
+        [NotNull] private readonly Database _db;
+        [NotNull] private readonly string _urlPrefix;
+
+        /// <summary>
+        /// Create a handler for a database.
+        /// </summary>
+        /// <param name="db">Database to serve</param>
+        /// <param name="urlPrefix">URL path the handler is mounted at, e.g. "/dav". Stripped from request paths</param>
+        public WebDavHandler([NotNull]Database db, string urlPrefix = "")
+        {
+            _db = db;
+            _urlPrefix = "/" + DirectoryListing.NormalisePath(urlPrefix);
+            if (_urlPrefix.Length > 1) _urlPrefix += "/";
+        }
+
+        /// <summary>
+        /// Handle a single request. This does not throw for bad requests, but returns an error status.
+        /// </summary>
+        [NotNull]public WebDavResponse Handle([NotNull]WebDavRequest request)
+        {
+            try
+            {
+                if (IsHealthRequest(request, out var level)) return Health(level, request.Method.ToUpperInvariant() != "HEAD");
+
+                var path = ToDocumentPath(request.Path);
+                if (path == null) return Status(404);
+
+                switch (request.Method.ToUpperInvariant())
+                {
+                    case "OPTIONS": return Options();
+                    case "PROPFIND": return PropFind(path, request.Header("Depth"));
+                    case "GET": return Get(path, request.Header("Range"), true);
+                    case "HEAD": return Get(path, request.Header("Range"), false);
+                    case "PUT": return Put(path, request);
+                    case "DELETE": return Delete(path);
+                    case "MKCOL": return Status(201); // directories are implied by document paths
+                    case "MOVE": return Move(path, request);
+                    default: return Status(405);
+                }
+            }
+            catch (Exception ex)
+            {
+                var response = Status(500);
+                response.Body = new MemoryStream(Encoding.UTF8.GetBytes(ex.Message));
+                return response;
+            }
+        }
+
+        /// <summary>
+        /// True if this is a GET or HEAD of `HealthPath`. The level is read from an optional `level` query parameter.
+        /// </summary>
+        private static bool IsHealthRequest([NotNull]WebDavRequest request, out HealthCheckLevel level)
+        {
+            level = HealthCheckLevel.Quick;
+            var method = request.Method.ToUpperInvariant();
+            if (method != "GET" && method != "HEAD") return false;
+
+            var parts = request.Path.Split(new[] { '?' }, 2);
+            if (parts[0] != HealthPath) return false;
+            if (parts.Length < 2) return true;
+
+            foreach (var pair in parts[1].Split('&'))
+            {
+                var kv = pair.Split(new[] { '=' }, 2);
+                if (kv.Length != 2 || kv[0] != "level") continue;
+                switch (Uri.UnescapeDataString(kv[1]).ToLowerInvariant())
+                {
+                    case "standard": level = HealthCheckLevel.Standard; break;
+                    case "deep": level = HealthCheckLevel.Deep; break;
+                }
+            }
+            return true;
+        }
+
+        /// <summary>
+        /// Run a health check. Status is 200 if healthy, or 503 if not, with a JSON summary as the body
+        /// </summary>
+        [NotNull]private WebDavResponse Health(HealthCheckLevel level, bool includeBody)
+        {
+            var report = _db.HealthCheck(level);
+            var problems = string.Join(",", report.Problems.Select(p => "\"" + p.Replace("\\", "\\\\").Replace("\"", "\\\"") + "\""));
+            var json = "{\"status\":\"" + (report.IsHealthy ? "ok" : "unhealthy") + "\","
+                     + "\"level\":\"" + level.ToString().ToLowerInvariant() + "\","
+                     + "\"pagesChecked\":" + report.PagesChecked + ","
+                     + "\"problems\":[" + problems + "]}";
+
+            var response = Status(report.IsHealthy ? 200 : 503);
+            response.Headers["Content-Type"] = "application/json; charset=utf-8";
+            response.Headers["Cache-Control"] = "no-store";
+            if (includeBody) response.Body = new MemoryStream(Encoding.UTF8.GetBytes(json));
+            return response;
+        }
+
+        [NotNull]private static WebDavResponse Options()
+        {
+            var response = Status(200);
+            response.Headers["DAV"] = "1";
+            response.Headers["Allow"] = "OPTIONS, PROPFIND, GET, HEAD, PUT, DELETE, MKCOL, MOVE";
+            return response;
+        }
+
+        [NotNull]private WebDavResponse PropFind([NotNull]string path, string? depth)
+        {
+            var isDocument = path.Length > 0 && _db.GetIdByPath(path, out _);
+            var isDirectory = DirectoryListing.DirectoryExists(_db, path);
+            if (!isDocument && !isDirectory) return Status(404);
+
+            var multistatus = new XElement(Dav + "multistatus");
+            if (isDocument && !isDirectory)
+            {
+                multistatus.Add(DocumentProps(path));
+            }
+            else
+            {
+                multistatus.Add(DirectoryProps(path));
+                if (depth != "0")
+                {
+                    foreach (var child in DirectoryListing.ListChildren(_db, path))
+                    {
+                        multistatus.Add(child.IsDirectory ? DirectoryProps(child.FullPath) : DocumentProps(child.FullPath));
+                    }
+                }
+            }
+
+            var response = Status(207);
+            response.Headers["Content-Type"] = "application/xml; charset=utf-8";
+            var body = new MemoryStream();
+            new XDocument(multistatus).Save(body);
+            body.Seek(0, SeekOrigin.Begin);
+            response.Body = body;
+            return response;
+        }
+
+        [NotNull]private WebDavResponse Get([NotNull]string path, string? range, bool includeBody)
+        {
+            if (path.Length < 1 || !_db.Get(path, out var stream) || stream == null) return Status(404);
+            var length = stream.Length;
+            if (range != null || !includeBody) stream.Dispose(); // not the response body, so don't hold it open
+
+            WebDavResponse response;
+            if (range == null)
+            {
+                response = Status(200);
+                response.Headers["Content-Length"] = length.ToString();
+                if (includeBody) response.Body = stream;
+            }
+            else
+            {
+                if (!TryParseRange(range, length, out var start, out var end))
+                {
+                    response = Status(416);
+                    response.Headers["Content-Range"] = $"bytes */{length}";
+                    return response;
+                }
+
+                response = Status(206);
+                response.Headers["Content-Range"] = $"bytes {start}-{end}/{length}";
+                response.Headers["Content-Length"] = (end - start + 1).ToString();
+                if (includeBody && _db.ReadRange(path, start, end - start + 1, out var part)) response.Body = part;
+            }
+
+            response.Headers["Content-Type"] = "application/octet-stream";
+            response.Headers["Accept-Ranges"] = "bytes";
+            return response;
+        }
+
+        /// <summary>
+        /// Parse a single byte range (RFC 7233), e.g. "bytes=0-99", "bytes=100-", "bytes=-50".
+        /// Multiple ranges are not supported. Returns false if the range can't be satisfied.
+        /// </summary>
+        private static bool TryParseRange([NotNull]string header, long length, out long start, out long end)
+        {
+            start = 0; end = length - 1;
+            const string unit = "bytes=";
+            if (!header.StartsWith(unit, StringComparison.OrdinalIgnoreCase)) return false;
+
+            var spec = header.Substring(unit.Length).Trim();
+            if (spec.Contains(",")) return false;
+
+            var dash = spec.IndexOf('-');
+            if (dash < 0) return false;
+            var first = spec.Substring(0, dash).Trim();
+            var last = spec.Substring(dash + 1).Trim();
+
+            if (first.Length < 1) // suffix range: last N bytes
+            {
+                if (!long.TryParse(last, out var suffix) || suffix < 1) return false;
+                start = Math.Max(0, length - suffix);
+                return length > 0;
+            }
+
+            if (!long.TryParse(first, out start) || start >= length) return false;
+            if (last.Length < 1) return true;
+            if (!long.TryParse(last, out end) || end < start) return false;
+            end = Math.Min(end, length - 1);
+            return true;
+        }
+
+        [NotNull]private WebDavResponse Put([NotNull]string path, [NotNull]WebDavRequest request)
+        {
+            if (path.Length < 1) return Status(405);
+            var existed = _db.GetIdByPath(path, out _);
+
+            var body = request.Body ?? new MemoryStream();
+            if (!body.CanSeek)
+            {
+                if (long.TryParse(request.Header("Content-Length") ?? "", out var length)) {
+                    body = new KnownLengthStream(body, length);
+                } else {
+                    var buffer = new MemoryStream();
+                    body.CopyTo(buffer);
+                    buffer.Seek(0, SeekOrigin.Begin);
+                    body = buffer;
+                }
+            }
+
+            _db.WriteDocument(path, body);
+            return Status(existed ? 204 : 201);
+        }
+
+        [NotNull]private WebDavResponse Delete([NotNull]string path)
+        {
+            if (path.Length > 0 && _db.GetIdByPath(path, out _))
+            {
+                _db.Delete(path);
+                return Status(204);
+            }
+
+            if (path.Length < 1 || !DirectoryListing.DirectoryExists(_db, path)) return Status(404);
+            foreach (var doc in _db.Search(path + DirectoryListing.Separator).ToList())
+            {
+                _db.Delete(doc);
+            }
+            return Status(204);
+        }
+
+        [NotNull]private WebDavResponse Move([NotNull]string path, [NotNull]WebDavRequest request)
+        {
+            var destination = request.Header("Destination");
+            if (destination == null) return Status(400);
+            if (Uri.TryCreate(destination, UriKind.Absolute, out var uri)) destination = uri.AbsolutePath;
+            var target = ToDocumentPath(destination);
+            if (target == null || target.Length < 1 || path.Length < 1) return Status(403);
+            if (target == path) return Status(403);
+
+            var overwrite = request.Header("Overwrite") != "F";
+            var targetExisted = _db.GetIdByPath(target, out _);
+            if (targetExisted && !overwrite) return Status(412);
+
+            if (_db.GetIdByPath(path, out var docId))
+            {
+                MoveDocument(docId, path, target);
+                return Status(targetExisted ? 204 : 201);
+            }
+
+            if (!DirectoryListing.DirectoryExists(_db, path)) return Status(404);
+            _db.RenamePrefix(path + DirectoryListing.Separator, target + DirectoryListing.Separator);
+            return Status(201);
+        }
+
+        private void MoveDocument(Guid docId, [NotNull]string from, [NotNull]string to)
+        {
+            var replaced = _db.BindToPath(docId, to);
+            _db.UnbindPath(docId, from);
+
+            if (replaced != Guid.Empty && replaced != docId && !_db.ListPaths(replaced).Any()) _db.Delete(replaced);
+        }
+
+        [NotNull]private XElement DocumentProps([NotNull]string path)
+        {
+            long length = 0;
+            if (_db.Get(path, out var stream) && stream != null)
+            {
+                using (stream) { length = stream.Length; }
+            }
+
+            return Props(path, false,
+                new XElement(Dav + "getcontentlength", length),
+                new XElement(Dav + "getcontenttype", "application/octet-stream"));
+        }
+
+        [NotNull]private XElement DirectoryProps([NotNull]string path)
+        {
+            return Props(path, true);
+        }
+
+        [NotNull]private XElement Props([NotNull]string path, bool isDirectory, params object[] extra)
+        {
+            var name = path.Substring(path.LastIndexOf(DirectoryListing.Separator) + 1);
+            var prop = new XElement(Dav + "prop",
+                new XElement(Dav + "displayname", name),
+                new XElement(Dav + "resourcetype", isDirectory ? new XElement(Dav + "collection") : null),
+                extra);
+
+            return new XElement(Dav + "response",
+                new XElement(Dav + "href", ToHref(path, isDirectory)),
+                new XElement(Dav + "propstat", prop, new XElement(Dav + "status", "HTTP/1.1 200 OK")));
+        }
+
+        /// <summary>
+        /// Convert an encoded request path to a document path. Returns null if outside the URL prefix.
+        /// </summary>
+        private string? ToDocumentPath([NotNull]string requestPath)
+        {
+            var decoded = Uri.UnescapeDataString(requestPath);
+            if (!decoded.StartsWith("/")) decoded = "/" + decoded;
+            if (_urlPrefix.Length > 1)
+            {
+                if (decoded.TrimEnd('/') == _urlPrefix.TrimEnd('/')) return "";
+                if (!decoded.StartsWith(_urlPrefix, StringComparison.Ordinal)) return null;
+                decoded = decoded.Substring(_urlPrefix.Length);
+            }
+            return DirectoryListing.NormalisePath(decoded);
+        }
+
+        [NotNull]private string ToHref([NotNull]string path, bool isDirectory)
+        {
+            var encoded = string.Join("/", path.Split(DirectoryListing.Separator).Select(Uri.EscapeDataString));
+            var href = _urlPrefix + encoded;
+            if (isDirectory && !href.EndsWith("/")) href += "/";
+            return href;
+        }
+
+        [NotNull]private static WebDavResponse Status(int code)
+        {
+            return new WebDavResponse { StatusCode = code };
+        }
+    }
+}
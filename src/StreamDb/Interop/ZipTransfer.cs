@@ -0,0 +1,78 @@
+﻿using System;
+using System.IO;
+using System.IO.Compression;
+using JetBrains.Annotations;
+using StreamDb.Internal.Support;
+
+namespace StreamDb.Interop
+{
+    /// <summary>
+    /// Load documents from zip files, and write documents out to zip files.
+    /// Entry names are used directly as document paths.
+    /// </summary>
+    public static class ZipTransfer
+    {
+        /// <summary>
+        /// Write every file entry in a zip archive as a document, bound to the entry's full name.
+        /// Entry bodies are streamed directly into storage pages. Directory entries are skipped.
+        /// </summary>
+        /// <param name="zipFile">Readable and seekable zip archive</param>
+        /// <param name="target">Database to write into</param>
+        /// <returns>Number of documents written</returns>
+        public static int ImportZip([NotNull]Stream zipFile, [NotNull]Database target)
+        {
+            var count = 0;
+            using (var archive = new ZipArchive(zipFile, ZipArchiveMode.Read, leaveOpen: true))
+            {
+                foreach (var entry in archive.Entries)
+                {
+                    if (entry == null || string.IsNullOrEmpty(entry.Name)) continue; // directory entries have no name part
+
+                    using (var body = entry.Open())
+                    {
+                        target.WriteDocument(entry.FullName, new KnownLengthStream(body, entry.Length));
+                    }
+                    count++;
+                }
+            }
+            return count;
+        }
+
+        /// <summary>
+        /// Write every bound path in the database to a new zip archive.
+        /// If a document is bound to several paths, it is written once per path.
+        /// The export is read from a snapshot (see `Database.OpenSnapshot`), so writes made while it runs are not included.
+        /// The output stream does not need to be seekable.
+        /// </summary>
+        /// <param name="source">Database to export</param>
+        /// <param name="output">Writable stream for the zip archive</param>
+        /// <param name="pathPrefix">Optional filter. Only paths starting with this are exported</param>
+        /// <param name="verify">If true, documents are checked as they are copied (see `VerifiedReader`),
+        /// and the export stops with an `ExportVerificationException` at the first damaged document</param>
+        /// <returns>Number of entries written</returns>
+        public static int ExportZip([NotNull]Database source, [NotNull]Stream output, string pathPrefix = "", bool verify = false)
+        {
+            var count = 0;
+            using (var snapshot = source.OpenSnapshot())
+            using (var archive = new ZipArchive(output, ZipArchiveMode.Create, leaveOpen: true))
+            {
+                var reader = verify ? source.StartVerifiedRead(snapshot) : null;
+                foreach (var path in snapshot.Search(pathPrefix ?? ""))
+                {
+                    Stream? stream;
+                    var found = reader?.Get(path, out stream) ?? snapshot.Get(path, out stream);
+                    if (!found || stream == null) continue;
+
+                    var entry = archive.CreateEntry(path, CompressionLevel.Optimal) ?? throw new Exception($"Failed to create zip entry for '{path}'");
+                    using (stream)
+                    using (var body = entry.Open())
+                    {
+                        stream.CopyTo(body);
+                    }
+                    count++;
+                }
+            }
+            return count;
+        }
+    }
+}
@@ -0,0 +1,21 @@
+﻿using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// A single record read from a circular log. See `Database.AppendRecord`
+    /// </summary>
+    public class LogRecord
+    {
+        /// <summary>
+        /// Position of the record in the log. Positions only increase, so this can be passed
+        /// back to `Database.ReadRecords` to continue reading after a known record.
+        /// </summary>
+        public long Position { get; set; }
+
+        /// <summary>
+        /// Record contents
+        /// </summary>
+        [NotNull] public byte[] Data { get; set; } = new byte[0];
+    }
+}
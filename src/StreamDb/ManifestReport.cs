@@ -0,0 +1,50 @@
+﻿using System.Collections.Generic;
+using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Result of checking a database against its signed manifest. See `Database.VerifyManifest`
+    /// </summary>
+    public class ManifestReport
+    {
+        /// <summary>
+        /// True if a manifest was found
+        /// </summary>
+        public bool ManifestFound { get; set; }
+
+        /// <summary>
+        /// True if the manifest's signature matched the public key
+        /// </summary>
+        public bool SignatureValid { get; set; }
+
+        /// <summary>
+        /// Paths listed in the manifest that are not bound in the database
+        /// </summary>
+        [NotNull] public List<string> Missing { get; } = new List<string>();
+
+        /// <summary>
+        /// Paths whose content does not match the manifest's hash
+        /// </summary>
+        [NotNull] public List<string> Changed { get; } = new List<string>();
+
+        /// <summary>
+        /// Paths bound in the database that the manifest does not list
+        /// </summary>
+        [NotNull] public List<string> Unlisted { get; } = new List<string>();
+
+        /// <summary>
+        /// True if the manifest is signed by the expected key, and the database matches it exactly
+        /// </summary>
+        public bool IsValid => ManifestFound && SignatureValid && Missing.Count == 0 && Changed.Count == 0 && Unlisted.Count == 0;
+
+        /// <inheritdoc />
+        public override string ToString()
+        {
+            if (!ManifestFound) return "No manifest found";
+            if (!SignatureValid) return "Manifest signature is not valid";
+            if (IsValid) return "Database matches its manifest";
+            return $"Database does not match its manifest: {Missing.Count} missing, {Changed.Count} changed, {Unlisted.Count} unlisted";
+        }
+    }
+}
@@ -0,0 +1,22 @@
+﻿using System;
+using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Thrown when opening a database that must match a signed manifest (see `DatabaseOptions.ManifestKey`), and it does not.
+    /// </summary>
+    public class ManifestVerificationException : Exception
+    {
+        /// <summary>
+        /// What was wrong
+        /// </summary>
+        [NotNull] public ManifestReport Report { get; }
+
+        public ManifestVerificationException([NotNull]ManifestReport report)
+            : base("Database failed manifest verification: " + report)
+        {
+            Report = report;
+        }
+    }
+}
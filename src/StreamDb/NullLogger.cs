@@ -0,0 +1,19 @@
+﻿using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Logger that discards all messages. This is the default.
+    /// </summary>
+    public class NullLogger : ILogger
+    {
+        /// <summary> Shared instance </summary>
+        [NotNull] public static readonly NullLogger Instance = new NullLogger();
+
+        /// <inheritdoc />
+        public void Debug(string message, params object?[] fields) { }
+
+        /// <inheritdoc />
+        public void Warn(string message, params object?[] fields) { }
+    }
+}
@@ -0,0 +1,22 @@
+﻿using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Tracer that records nothing. This is the default.
+    /// </summary>
+    public class NullTracer : ITracer, ISpan
+    {
+        /// <summary> Shared instance </summary>
+        [NotNull] public static readonly NullTracer Instance = new NullTracer();
+
+        /// <inheritdoc />
+        public ISpan StartSpan(string operationName) { return this; }
+
+        /// <inheritdoc />
+        public void SetAttribute(string key, object? value) { }
+
+        /// <inheritdoc />
+        public void Dispose() { }
+    }
+}
@@ -0,0 +1,21 @@
+﻿namespace StreamDb
+{
+    /// <summary>
+    /// How the in-memory copy of the path lookup is kept in step with storage
+    /// </summary>
+    public enum PathCacheConsistency
+    {
+        /// <summary>
+        /// The cache is refreshed after this connection changes a path.
+        /// Changes made through other connections to the same storage may not be seen until reconnecting.
+        /// This is the fastest mode, and the default.
+        /// </summary>
+        Cached = 0,
+
+        /// <summary>
+        /// Every lookup checks the storage header, and reloads the cache if the path lookup has been rewritten by any connection.
+        /// This costs one small read per lookup.
+        /// </summary>
+        Validated = 1
+    }
+}
@@ -0,0 +1,94 @@
+﻿using System;
+using System.Collections.Generic;
+using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// A named ordering of paths, used for sorted listings and range queries. See `DatabaseOptions.Collation`.
+    /// The name is stored with the database, so it must be stable, and must always mean the same ordering.
+    /// </summary>
+    public class PathCollation : IComparer<string>
+    {
+        [NotNull] private readonly Comparison<string> _compare;
+
+        /// <summary>
+        /// Create a collation from a comparison function
+        /// </summary>
+        /// <param name="name">Name stored with the database. This must be stable</param>
+        /// <param name="compare">Orders two paths. Must only return zero for identical paths, so listings have a single order</param>
+        public PathCollation(string name, Comparison<string> compare)
+        {
+            if (string.IsNullOrEmpty(name)) throw new ArgumentNullException(nameof(name));
+            Name = name;
+            _compare = compare ?? throw new ArgumentNullException(nameof(compare));
+        }
+
+        /// <summary>
+        /// Name stored with the database
+        /// </summary>
+        [NotNull]public string Name { get; }
+
+        /// <inheritdoc />
+        public int Compare(string? x, string? y)
+        {
+            if (x == null || y == null) return x == null ? (y == null ? 0 : -1) : 1;
+            return _compare(x, y);
+        }
+
+        /// <summary>
+        /// Character code order ("item10" sorts before "item9"). This is the default.
+        /// </summary>
+        [NotNull]public static readonly PathCollation Ordinal = new PathCollation("ordinal", string.CompareOrdinal);
+
+        /// <summary>
+        /// Runs of digits are compared by their value, so "item9" sorts before "item10".
+        /// Everything else is in character code order. Paths that differ only in leading zeros are ordered by character code.
+        /// </summary>
+        [NotNull]public static readonly PathCollation Numeric = new PathCollation("numeric", CompareNumeric);
+
+        /// <summary>
+        /// Find a built-in collation by its stored name. Returns null if the name is not built in.
+        /// </summary>
+        internal static PathCollation? BuiltIn(string? name)
+        {
+            if (name == Ordinal.Name) return Ordinal;
+            if (name == Numeric.Name) return Numeric;
+            return null;
+        }
+
+        private static int CompareNumeric([NotNull]string x, [NotNull]string y)
+        {
+            int i = 0, j = 0;
+            while (i < x.Length && j < y.Length)
+            {
+                if (char.IsDigit(x[i]) && char.IsDigit(y[j]))
+                {
+                    // compare digit runs by value: skip leading zeros, then the longer run is larger
+                    var xStart = i; var yStart = j;
+                    while (xStart < x.Length - 1 && x[xStart] == '0' && char.IsDigit(x[xStart + 1])) xStart++;
+                    while (yStart < y.Length - 1 && y[yStart] == '0' && char.IsDigit(y[yStart + 1])) yStart++;
+                    var xEnd = xStart; var yEnd = yStart;
+                    while (xEnd < x.Length && char.IsDigit(x[xEnd])) xEnd++;
+                    while (yEnd < y.Length && char.IsDigit(y[yEnd])) yEnd++;
+
+                    var lengthOrder = (xEnd - xStart).CompareTo(yEnd - yStart);
+                    if (lengthOrder != 0) return lengthOrder;
+                    var valueOrder = string.CompareOrdinal(x, xStart, y, yStart, xEnd - xStart);
+                    if (valueOrder != 0) return valueOrder;
+
+                    i = xEnd;
+                    j = yEnd;
+                    continue;
+                }
+
+                if (x[i] != y[j]) return x[i].CompareTo(y[j]);
+                i++;
+                j++;
+            }
+
+            if (i < x.Length || j < y.Length) return i < x.Length ? 1 : -1;
+            return string.CompareOrdinal(x, y); // equal by value, e.g. "a01" and "a1"
+        }
+    }
+}
@@ -0,0 +1,23 @@
+﻿using System;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Thrown when the path lookup can't be read from storage, because of an I/O failure,
+    /// a damaged page, or a bad chain. The inner exception holds the original failure.
+    /// No path operations can succeed until the storage is repaired.
+    /// </summary>
+    public class PathLookupException : Exception
+    {
+        /// <summary>
+        /// End page of the path lookup chain that failed to load
+        /// </summary>
+        public int PageId { get; }
+
+        public PathLookupException(int pageId, string message, Exception? innerException = null)
+            : base(message, innerException)
+        {
+            PageId = pageId;
+        }
+    }
+}
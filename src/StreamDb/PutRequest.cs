@@ -0,0 +1,40 @@
+﻿using System.IO;
+using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// A write about to be stored, as given to checks registered with `Database.OnBeforePut`.
+    /// </summary>
+    public class PutRequest
+    {
+        internal PutRequest(string? path, string? annotation, BindingAttributes attributes, [NotNull]Stream data)
+        {
+            Path = path;
+            Annotation = annotation;
+            Attributes = attributes;
+            Data = data;
+        }
+
+        /// <summary>
+        /// Path the document will be bound to. Null for temporary documents (see `Database.PutTemp`)
+        /// </summary>
+        public string? Path { get; }
+
+        /// <summary>
+        /// Note that will be stored with the path binding, if any
+        /// </summary>
+        public string? Annotation { get; }
+
+        /// <summary>
+        /// Attribute bits that will be stored with the path binding
+        /// </summary>
+        public BindingAttributes Attributes { get; }
+
+        /// <summary>
+        /// Document data, from the start. Read as much as the check needs; the stream is rewound before the next check
+        /// and before the data is written. Don't write to or dispose of this stream.
+        /// </summary>
+        [NotNull] public Stream Data { get; }
+    }
+}
@@ -0,0 +1,37 @@
+﻿namespace StreamDb
+{
+    /// <summary>
+    /// What to do when opening storage finds problems in the header or the pages it links to. See `DatabaseOptions.Recovery`
+    /// </summary>
+    public enum RecoveryPolicy
+    {
+        /// <summary>
+        /// Open without checking. Damage is found, and skipped where possible, as it is read.
+        /// </summary>
+        Open = 0,
+
+        /// <summary>
+        /// Refuse to open damaged storage, with a `StorageRecoveryException`
+        /// </summary>
+        Fail = 1,
+
+        /// <summary>
+        /// Point header links away from damaged pages, falling back to the previous revision of each chain,
+        /// then quarantine the damaged pages. Changes in a dropped revision are lost.
+        /// If the index or path lookup has no undamaged revision, opening fails with a `StorageRecoveryException`.
+        /// </summary>
+        Repair = 2,
+
+        /// <summary>
+        /// Open damaged storage as a read-only replica (see `DatabaseOptions.ReadReplica`), so it is not changed
+        /// until it has been inspected or copied.
+        /// </summary>
+        ReadOnly = 3,
+
+        /// <summary>
+        /// Open as normal, but add damaged pages to the bad-page map, so they are never reused or released.
+        /// Chains that run through a quarantined page still point at it.
+        /// </summary>
+        Quarantine = 4
+    }
+}
@@ -0,0 +1,14 @@
+﻿using System;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Thrown by a read replica connection when storage changed underneath a read, and a consistent view
+    /// could not be read after retrying. The operation can be tried again later.
+    /// </summary>
+    public class ReplicaInconsistencyException : Exception
+    {
+        public ReplicaInconsistencyException(string message, Exception? innerException = null)
+            : base(message, innerException) { }
+    }
+}
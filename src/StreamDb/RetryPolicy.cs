@@ -0,0 +1,67 @@
+﻿using System;
+using System.IO;
+using System.Threading.Tasks;
+using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Controls how storage reads and writes are retried when the underlying stream reports a transient error.
+    /// Useful when the storage stream is backed by a network or remote file system.
+    /// </summary>
+    public class RetryPolicy
+    {
+        /// <summary>
+        /// A policy that never retries. This is the default.
+        /// Each read returns a new instance, so changing one can't affect other databases.
+        /// </summary>
+        [NotNull] public static RetryPolicy None => new RetryPolicy { Attempts = 1 };
+
+        /// <summary>
+        /// Total number of tries for each operation, including the first. Defaults to 3.
+        /// </summary>
+        public int Attempts { get; set; } = 3;
+
+        /// <summary>
+        /// Wait before the first retry. Defaults to 50ms.
+        /// </summary>
+        public TimeSpan InitialDelay { get; set; } = TimeSpan.FromMilliseconds(50);
+
+        /// <summary>
+        /// Factor the wait is multiplied by after each retry. Defaults to 2.
+        /// </summary>
+        public double BackoffMultiplier { get; set; } = 2.0;
+
+        /// <summary>
+        /// Longest wait between retries. Defaults to 2 seconds.
+        /// </summary>
+        public TimeSpan MaxDelay { get; set; } = TimeSpan.FromSeconds(2);
+
+        /// <summary>
+        /// Decides if an error is worth retrying. Defaults to retrying `IOException` only.
+        /// </summary>
+        [NotNull] public Func<Exception, bool> IsRetryable { get; set; } = ex => ex is IOException;
+
+        /// <summary>
+        /// Run an action, retrying according to this policy. The last error is re-thrown if all attempts fail.
+        /// </summary>
+        internal void Run([NotNull]Action action, [NotNull]ILogger log, [NotNull]string operation)
+        {
+            var delay = InitialDelay;
+            for (int attempt = 1; ; attempt++)
+            {
+                try
+                {
+                    action();
+                    return;
+                }
+                catch (Exception ex) when (attempt < Attempts && IsRetryable(ex))
+                {
+                    log.Warn("Retrying storage operation", "operation", operation, "attempt", attempt, "error", ex.Message);
+                    if (delay > TimeSpan.Zero) Task.Delay(delay).Wait();
+                    delay = TimeSpan.FromTicks(Math.Min(MaxDelay.Ticks, (long)(delay.Ticks * BackoffMultiplier)));
+                }
+            }
+        }
+    }
+}
@@ -0,0 +1,23 @@
+﻿using System.Collections.Generic;
+using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// One page of paths from `Database.SearchPaged`
+    /// </summary>
+    public class SearchResultPage
+    {
+        /// <summary>
+        /// Matching paths in this page, in the order of `Database.Collation`
+        /// </summary>
+        [NotNull, ItemNotNull] public List<string> Paths { get; } = new List<string>();
+
+        /// <summary>
+        /// Pass this to `Database.SearchPaged` to get the next page. Null if this is the last page.
+        /// <para></para>
+        /// The cursor is a plain string, and can be stored to resume a scan after a restart.
+        /// </summary>
+        public string? Cursor { get; set; }
+    }
+}
@@ -0,0 +1,32 @@
+﻿using System;
+using System.IO;
+using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// One document in a time series. See `Database.WriteSeries`
+    /// </summary>
+    public class SeriesEntry
+    {
+        /// <summary>
+        /// Time the entry was written for (UTC)
+        /// </summary>
+        public DateTime Timestamp { get; set; }
+
+        /// <summary>
+        /// Path the entry is stored at
+        /// </summary>
+        [NotNull] public string Path { get; set; } = "";
+
+        /// <summary>
+        /// ID of the entry's document
+        /// </summary>
+        public Guid DocumentId { get; set; }
+
+        /// <summary>
+        /// Document data
+        /// </summary>
+        public Stream? Data { get; set; }
+    }
+}
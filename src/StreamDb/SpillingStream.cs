@@ -0,0 +1,126 @@
+﻿using System;
+using System.IO;
+using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Temporary storage that starts in memory, and moves to a temporary file once it grows past a size threshold.
+    /// Pass this to `Database.TryConnect` for programs that usually hold small data sets, but sometimes get very large ones.
+    /// <para></para>
+    /// The move happens on the write that would cross the threshold, and is not seen by the database.
+    /// The temporary file is deleted when the stream is disposed (or, failing that, when the process ends).
+    /// </summary>
+    public class SpillingStream : Stream
+    {
+        [NotNull] private readonly object _lock = new object();
+        private readonly long _threshold;
+        private readonly string? _directory;
+        [NotNull] private Stream _inner = new MemoryStream();
+        private string? _spillPath;
+
+        /// <param name="threshold">Size in bytes the stream can reach in memory. It moves to a file when it would grow past this</param>
+        /// <param name="directory">Directory for the temporary file. If null, the system temporary directory is used</param>
+        public SpillingStream(long threshold, string? directory = null)
+        {
+            if (threshold < 0) throw new ArgumentOutOfRangeException(nameof(threshold), "Spill threshold must not be negative");
+            _threshold = threshold;
+            _directory = directory;
+        }
+
+        /// <summary>
+        /// True once the data has moved to a temporary file
+        /// </summary>
+        public bool IsSpilled { get { lock (_lock) { return _spillPath != null; } } }
+
+        /// <summary>
+        /// Path of the temporary file, or null if the data is still in memory
+        /// </summary>
+        public string? SpillPath { get { lock (_lock) { return _spillPath; } } }
+
+        /// <summary>
+        /// Move the data to a temporary file now, if it is still in memory
+        /// </summary>
+        public void Spill()
+        {
+            lock (_lock)
+            {
+                if (_spillPath != null) return;
+
+                var path = Path.Combine(_directory ?? Path.GetTempPath(), "streamdb-" + Guid.NewGuid().ToString("N") + ".tmp");
+                var file = new FileStream(path, FileMode.CreateNew, FileAccess.ReadWrite, FileShare.None, 4096, FileOptions.DeleteOnClose);
+                try
+                {
+                    var position = _inner.Position;
+                    _inner.Seek(0, SeekOrigin.Begin);
+                    _inner.CopyTo(file);
+                    file.Seek(position, SeekOrigin.Begin);
+                }
+                catch
+                {
+                    file.Dispose();
+                    throw;
+                }
+
+                _inner.Dispose();
+                _inner = file;
+                _spillPath = path;
+            }
+        }
+
+        /// <inheritdoc />
+        public override void Write(byte[] buffer, int offset, int count)
+        {
+            lock (_lock)
+            {
+                if (_spillPath == null && _inner.Position + count > _threshold) Spill();
+                _inner.Write(buffer, offset, count);
+            }
+        }
+
+        /// <inheritdoc />
+        public override void SetLength(long value)
+        {
+            lock (_lock)
+            {
+                if (_spillPath == null && value > _threshold) Spill();
+                _inner.SetLength(value);
+            }
+        }
+
+        /// <inheritdoc />
+        public override int Read(byte[] buffer, int offset, int count) { lock (_lock) { return _inner.Read(buffer, offset, count); } }
+
+        /// <inheritdoc />
+        public override long Seek(long offset, SeekOrigin origin) { lock (_lock) { return _inner.Seek(offset, origin); } }
+
+        /// <inheritdoc />
+        public override void Flush() { lock (_lock) { _inner.Flush(); } }
+
+        /// <inheritdoc />
+        protected override void Dispose(bool disposing)
+        {
+            if (disposing) { lock (_lock) { _inner.Dispose(); } }
+            base.Dispose(disposing);
+        }
+
+        /// <inheritdoc />
+        public override bool CanRead => true;
+
+        /// <inheritdoc />
+        public override bool CanSeek => true;
+
+        /// <inheritdoc />
+        public override bool CanWrite => true;
+
+        /// <inheritdoc />
+        public override long Length { get { lock (_lock) { return _inner.Length; } } }
+
+        /// <inheritdoc />
+        public override long Position
+        {
+            get { lock (_lock) { return _inner.Position; } }
+            set { lock (_lock) { _inner.Position = value; } }
+        }
+    }
+}
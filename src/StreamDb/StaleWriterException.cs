@@ -0,0 +1,28 @@
+﻿using System;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Thrown when a fenced connection tries to write after another connection has opened the same storage for writing.
+    /// The connection should be discarded; its view of the storage is out of date.
+    /// </summary>
+    public class StaleWriterException : Exception
+    {
+        /// <summary>
+        /// Epoch this connection acquired when it opened the storage
+        /// </summary>
+        public long OwnEpoch { get; }
+
+        /// <summary>
+        /// Epoch currently recorded in storage
+        /// </summary>
+        public long CurrentEpoch { get; }
+
+        public StaleWriterException(long ownEpoch, long currentEpoch)
+            : base($"Storage was taken over by another writer (epoch {currentEpoch}; this connection has epoch {ownEpoch})")
+        {
+            OwnEpoch = ownEpoch;
+            CurrentEpoch = currentEpoch;
+        }
+    }
+}
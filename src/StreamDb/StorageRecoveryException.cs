@@ -0,0 +1,22 @@
+﻿using System;
+using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Thrown when opening storage finds problems that the `DatabaseOptions.Recovery` policy does not allow past.
+    /// </summary>
+    public class StorageRecoveryException : Exception
+    {
+        /// <summary>
+        /// Problems found on open
+        /// </summary>
+        [NotNull] public HealthReport Report { get; }
+
+        public StorageRecoveryException([NotNull]HealthReport report, [NotNull]string message)
+            : base(message + ": " + report)
+        {
+            Report = report;
+        }
+    }
+}
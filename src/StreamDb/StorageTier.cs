@@ -0,0 +1,19 @@
+﻿namespace StreamDb
+{
+    /// <summary>
+    /// Which storage a document's data is held in. See `Database.Demote` and `Database.Promote`
+    /// </summary>
+    public enum StorageTier
+    {
+        /// <summary>
+        /// Data is in the main storage stream. All documents start here.
+        /// </summary>
+        Hot = 0,
+
+        /// <summary>
+        /// Data has been moved to the cold storage stream given in `DatabaseOptions.ColdStorage`.
+        /// The document keeps its ID and paths, and reads are redirected transparently.
+        /// </summary>
+        Cold = 1
+    }
+}
@@ -0,0 +1,22 @@
+﻿using System;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Thrown when a document stream is opened while `DatabaseOptions.MaxOpenStreams` streams are already open.
+    /// This usually means streams are not being disposed after use.
+    /// </summary>
+    public class StreamLimitException : Exception
+    {
+        /// <summary>
+        /// Limit that was reached
+        /// </summary>
+        public int Limit { get; }
+
+        public StreamLimitException(int limit)
+            : base($"Too many open document streams (limit is {limit}). Dispose of streams when finished with them, or raise DatabaseOptions.MaxOpenStreams")
+        {
+            Limit = limit;
+        }
+    }
+}
@@ -0,0 +1,24 @@
+﻿namespace StreamDb
+{
+    /// <summary>
+    /// How hard to push writes to storage at the end of an operation. See `SyncOptions`
+    /// </summary>
+    public enum SyncMode
+    {
+        /// <summary>
+        /// Don't flush. Writes reach storage when a later operation flushes, or when `Database.Flush` is called.
+        /// </summary>
+        None = 0,
+
+        /// <summary>
+        /// Call `Flush` on the storage stream. This empties stream buffers, but the operating system may still cache writes.
+        /// </summary>
+        Flush = 1,
+
+        /// <summary>
+        /// Flush through to the physical disk, where the storage stream is a `FileStream`.
+        /// Other streams are flushed as for `Flush`. This is the slowest and safest setting.
+        /// </summary>
+        Durable = 2
+    }
+}
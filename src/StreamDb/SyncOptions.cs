@@ -0,0 +1,32 @@
+﻿namespace StreamDb
+{
+    /// <summary>
+    /// Durability settings for each class of storage write. Any setting left as `null` uses `SyncMode.Flush`.
+    /// <para></para>
+    /// For example, to batch document data but keep index and path changes safe, set `DocumentData` to `None`
+    /// and `Index` and `Paths` to `Durable`. Data pages are always written before the index change that refers to them,
+    /// so they are flushed together with it.
+    /// </summary>
+    public class SyncOptions
+    {
+        /// <summary>
+        /// Sync after writing document data pages
+        /// </summary>
+        public SyncMode? DocumentData { get; set; }
+
+        /// <summary>
+        /// Sync after changing the document index
+        /// </summary>
+        public SyncMode? Index { get; set; }
+
+        /// <summary>
+        /// Sync after changing the path lookup
+        /// </summary>
+        public SyncMode? Paths { get; set; }
+
+        /// <summary>
+        /// Sync after allocating or releasing pages through the free list
+        /// </summary>
+        public SyncMode? FreeList { get; set; }
+    }
+}
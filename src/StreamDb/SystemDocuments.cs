@@ -0,0 +1,168 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using System.Linq;
+using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Typed access to the documents the engine keeps under `Database.SystemNamespace`.
+    /// These paths can't be written through the normal `Database` calls, so user data never collides with engine state.
+    /// </summary>
+    /// <remarks>
+    /// The trash, pin list and audit log are bound here as `TrashName`, `PinsName` and `AuditName`. They are kept by the engine,
+    /// so they can be read but not written or deleted through this class. Stores written before the namespace existed
+    /// get these bindings the first time a writing connection opens them.
+    /// </remarks>
+    public class SystemDocuments
+    {
+        /// <summary> Name of the per-database configuration document </summary>
+        public const string ConfigName = "config";
+
+        /// <summary> Name of the signed manifest document. See `Database.SignManifest` </summary>
+        public const string ManifestName = "manifest";
+
+        /// <summary> Name prefix of statistics snapshots. See `Database.WriteStatsSnapshot` </summary>
+        public const string StatsPrefix = "stats/";
+
+        /// <summary> Name of the trash list. See `Database.Undelete` </summary>
+        public const string TrashName = "trash";
+
+        /// <summary> Name of the pin list. See `Database.Pin` </summary>
+        public const string PinsName = "pins";
+
+        /// <summary> Name of the audit log. See `Database.ReadAuditLog` </summary>
+        public const string AuditName = "audit";
+
+        /// <summary> Number of statistics snapshots kept. Older snapshots are deleted as new ones are written </summary>
+        public const int MaxStatsSnapshots = 500;
+
+        [NotNull] private readonly Database _db;
+
+        internal SystemDocuments([NotNull]Database db)
+        {
+            _db = db;
+        }
+
+        /// <summary>
+        /// Full path of a system document
+        /// </summary>
+        [NotNull]public static string PathOf(string name)
+        {
+            if (string.IsNullOrEmpty(name)) throw new ArgumentException("System document name must not be empty", nameof(name));
+            return Database.SystemNamespace + name;
+        }
+
+        /// <summary>
+        /// Write a system document, replacing any existing document with the same name
+        /// </summary>
+        public Guid Write(string name, Stream data)
+        {
+            if (data == null) throw new ArgumentNullException(nameof(data));
+            CheckNotEngineRecord(name);
+            return _db.WriteSystemDocument(PathOf(name), data);
+        }
+
+        /// <summary>
+        /// Read a system document. Returns true if found, false if not found.
+        /// </summary>
+        public bool Get(string name, out Stream? stream)
+        {
+            return _db.Get(PathOf(name), out stream);
+        }
+
+        /// <summary>
+        /// Delete a system document. Does nothing if it does not exist.
+        /// </summary>
+        public void Delete(string name)
+        {
+            CheckNotEngineRecord(name);
+            _db.DeleteSystemDocument(PathOf(name));
+        }
+
+        private static void CheckNotEngineRecord(string name)
+        {
+            if (name == TrashName || name == PinsName || name == AuditName) throw new ArgumentException($"System document '{name}' is kept by the engine, and can't be replaced or deleted", nameof(name));
+        }
+
+        /// <summary>
+        /// Names of all system documents
+        /// </summary>
+        [NotNull, ItemNotNull]public IEnumerable<string> List()
+        {
+            return _db.Search(Database.SystemNamespace, includeHidden: true).Select(p => p.Substring(Database.SystemNamespace.Length));
+        }
+
+        /// <summary>
+        /// Names of the statistics snapshots held, oldest first. Read each with `Get`; the content is a UTF-8 JSON object.
+        /// </summary>
+        [NotNull, ItemNotNull]public IEnumerable<string> ListStatsSnapshots()
+        {
+            return List().Where(n => n.StartsWith(StatsPrefix, StringComparison.Ordinal)).OrderBy(n => n, StringComparer.Ordinal);
+        }
+
+        /*
+            Config layout: [ Count (int32) ] then for each setting: [ Key (string) | Value (string) ]
+            (strings are length-prefixed UTF-8, as written by BinaryWriter)
+        */
+
+        /// <summary>
+        /// Read the per-database configuration. Returns an empty set if none has been written.
+        /// </summary>
+        [NotNull]public IDictionary<string, string> ReadConfig()
+        {
+            var result = new Dictionary<string, string>();
+            if (!Get(ConfigName, out var stream) || stream == null) return result;
+
+            using (stream)
+            {
+                var r = new BinaryReader(stream);
+                var count = r.ReadInt32();
+                for (int i = 0; i < count; i++)
+                {
+                    var key = r.ReadString();
+                    result[key] = r.ReadString();
+                }
+            }
+            return result;
+        }
+
+        /// <summary>
+        /// Replace the per-database configuration
+        /// </summary>
+        public void WriteConfig([NotNull]IDictionary<string, string> settings)
+        {
+            if (settings == null) throw new ArgumentNullException(nameof(settings));
+
+            var ms = new MemoryStream();
+            var w = new BinaryWriter(ms);
+            w.Write(settings.Count);
+            foreach (var setting in settings.OrderBy(s => s.Key, StringComparer.Ordinal))
+            {
+                w.Write(setting.Key);
+                w.Write(setting.Value ?? "");
+            }
+            ms.Seek(0, SeekOrigin.Begin);
+            Write(ConfigName, ms);
+        }
+
+        /// <summary>
+        /// Read a single configuration setting, or null if it is not set
+        /// </summary>
+        public string? GetSetting(string key)
+        {
+            return ReadConfig().TryGetValue(key, out var value) ? value : null;
+        }
+
+        /// <summary>
+        /// Set a single configuration setting, keeping the others
+        /// </summary>
+        public void SetSetting([NotNull]string key, [NotNull]string value)
+        {
+            var config = ReadConfig();
+            config[key] = value;
+            WriteConfig(config);
+        }
+    }
+}
@@ -0,0 +1,125 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using JetBrains.Annotations;
+using StreamDb.Internal.Core;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// A set of writes, binds and deletes that are applied together. Get one from `Database.Begin`.
+    /// <para></para>
+    /// Document data is written to new page chains as soon as `Write` is called, but nothing is visible at any path
+    /// until `Commit`, when every path change is made in a single update to the path lookup. Readers see either all
+    /// of the transaction or none of it. `Rollback` (or disposing without committing) releases the data written.
+    /// <para></para>
+    /// Data written by a transaction that is never committed or rolled back (for example, if the process crashed) is
+    /// released the next time the database is opened, in the same way as `Database.PutTemp`.
+    /// </summary>
+    public class Transaction : IDisposable
+    {
+        [NotNull] private readonly Database _db;
+        [NotNull, ItemNotNull] private readonly List<TransactionStep> _steps = new List<TransactionStep>();
+        private bool _finished;
+
+        internal Transaction([NotNull]Database db)
+        {
+            _db = db;
+        }
+
+        /// <summary>
+        /// True once the transaction has been committed or rolled back. No more changes can be made.
+        /// </summary>
+        public bool IsFinished => _finished;
+
+        /// <summary>
+        /// Write a document to be bound to the given path on commit. If an existing document uses this path when the
+        /// transaction is committed, it will be deleted. Returns the new document ID, which can be used with `BindPath`.
+        /// </summary>
+        /// <param name="path">Path that the document will be bound to</param>
+        /// <param name="data">Stream containing document data. It will be read from current position to end.</param>
+        /// <param name="annotation">Optional note stored with the path binding. See `Database.GetBindingInfo`</param>
+        /// <param name="attributes">Attribute bits stored with the path binding</param>
+        public Guid Write(string path, Stream? data, string? annotation = null, BindingAttributes attributes = BindingAttributes.None)
+        {
+            if (path == null) throw new ArgumentNullException(nameof(path));
+            CheckOpen();
+            var step = _db.StageDocument(path, data, annotation, attributes);
+            _steps.Add(step);
+            return step.DocumentId;
+        }
+
+        /// <summary>
+        /// Bind a document to an additional path on commit. The document can be an existing one,
+        /// or one written earlier in this transaction.
+        /// </summary>
+        /// <param name="documentId">ID of the document to bind (this is not checked)</param>
+        /// <param name="path">Path that the document will be bound to</param>
+        /// <param name="annotation">Optional note stored with the path binding. See `Database.GetBindingInfo`</param>
+        /// <param name="attributes">Attribute bits stored with the path binding</param>
+        public void BindPath(Guid documentId, string path, string? annotation = null, BindingAttributes attributes = BindingAttributes.None)
+        {
+            if (path == null) throw new ArgumentNullException(nameof(path));
+            CheckOpen();
+            Database.CheckUserPath(path);
+            Database.CheckUserDocId(documentId);
+            _steps.Add(new TransactionStep { Operation = TransactionOperation.Bind, Path = path, DocumentId = documentId, Annotation = annotation, Attributes = attributes });
+        }
+
+        /// <summary>
+        /// Delete the document bound to a path on commit, and unbind all paths to it (as `Database.Delete`).
+        /// If the path is not bound when the transaction is committed, this step is ignored.
+        /// </summary>
+        /// <param name="path">Any path that the document is bound to</param>
+        public void Delete(string path)
+        {
+            if (path == null) throw new ArgumentNullException(nameof(path));
+            CheckOpen();
+            Database.CheckUserPath(path);
+            _steps.Add(new TransactionStep { Operation = TransactionOperation.Delete, Path = path });
+        }
+
+        /// <summary>
+        /// Apply all changes, in the order they were made. Every check is made before anything is changed:
+        /// if one fails, the transaction is rolled back and the exception is thrown.
+        /// </summary>
+        public void Commit()
+        {
+            CheckOpen();
+            _finished = true;
+            try
+            {
+                _db.CommitTransaction(_steps);
+            }
+            catch
+            {
+                _db.RollbackTransaction(_steps);
+                throw;
+            }
+        }
+
+        /// <summary>
+        /// Discard all changes, and release any data written.
+        /// Does nothing if the transaction has already been committed or rolled back.
+        /// </summary>
+        public void Rollback()
+        {
+            if (_finished) return;
+            _finished = true;
+            _db.RollbackTransaction(_steps);
+        }
+
+        /// <summary>
+        /// Roll back the transaction, if it was not committed
+        /// </summary>
+        public void Dispose()
+        {
+            Rollback();
+        }
+
+        private void CheckOpen()
+        {
+            if (_finished) throw new InvalidOperationException("Transaction has already been committed or rolled back");
+        }
+    }
+}
@@ -0,0 +1,26 @@
+﻿using System;
+using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// A path binding that has been soft-deleted, and can be restored with `Database.Undelete`
+    /// </summary>
+    public class TrashEntry
+    {
+        /// <summary>
+        /// Path the document was bound to when it was deleted
+        /// </summary>
+        [NotNull] public string Path { get; set; } = "";
+
+        /// <summary>
+        /// ID of the document that was bound to the path
+        /// </summary>
+        public Guid DocumentId { get; set; }
+
+        /// <summary>
+        /// Time of deletion (UTC)
+        /// </summary>
+        public DateTime DeletedAt { get; set; }
+    }
+}
@@ -0,0 +1,57 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using JetBrains.Annotations;
+using StreamDb.Internal.Support;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Reads documents while checking them against their stored records, for exports and backups that must be known-good.
+    /// Get one from `Database.StartVerifiedRead`.
+    /// <para></para>
+    /// Every page is CRC checked as it is read (pages are not checked in quick-and-dirty mode), the number of bytes read
+    /// is checked against the length in the index, and if the database has a manifest (see `Database.SignManifest`),
+    /// the SHA-256 of the content is checked against it. The manifest's signature is not checked here; use `Database.VerifyManifest` for that.
+    /// Any failure throws an `ExportVerificationException` while the stream is being read.
+    /// </summary>
+    public class VerifiedReader
+    {
+        [NotNull] private readonly Database _db;
+        [NotNull] private readonly IDictionary<string, byte[]> _hashes;
+        private readonly DatabaseSnapshot? _snapshot;
+
+        internal VerifiedReader([NotNull]Database db, [NotNull]IDictionary<string, byte[]> hashes, DatabaseSnapshot? snapshot = null)
+        {
+            _db = db;
+            _hashes = hashes;
+            _snapshot = snapshot;
+        }
+
+        /// <summary>
+        /// Open the document at a path for verified reading.
+        /// Returns true if found, false if not found. The stream is forward-only, and reports problems as it is read.
+        /// </summary>
+        public bool Get([NotNull]string path, out Stream? stream)
+        {
+            stream = null;
+            Stream? raw;
+            try
+            {
+                var found = _snapshot?.Get(path, out raw) ?? _db.Get(path, out raw);
+                if (!found || raw == null) return false;
+            }
+            catch (Exception ex) when (!(ex is UnauthorizedAccessException))
+            {
+                throw VerifyingStream.StorageFailure(path, ex);
+            }
+
+            var stat = _snapshot != null ? _snapshot.Stat(path) : _db.Stat(path);
+            var expectedLength = (stat != null && stat.FromIndex) ? stat.Length : -1;
+            _hashes.TryGetValue(path, out var expectedHash);
+
+            stream = new VerifyingStream(raw, path, expectedLength, expectedHash);
+            return true;
+        }
+    }
+}
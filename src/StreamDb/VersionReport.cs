@@ -0,0 +1,67 @@
+﻿using System;
+using System.Collections.Generic;
+using System.Linq;
+using JetBrains.Annotations;
+
+namespace StreamDb
+{
+    /// <summary>
+    /// Storage used by one document's current data and by its retained previous revision
+    /// </summary>
+    public class DocumentVersionStat
+    {
+        /// <summary>
+        /// ID of the document
+        /// </summary>
+        public Guid DocumentId { get; set; }
+
+        /// <summary>
+        /// Pages holding the current revision
+        /// </summary>
+        public int LivePages { get; set; }
+
+        /// <summary>
+        /// Pages holding the previous revision, kept so a failed write can fall back to it. Zero if there is none.
+        /// </summary>
+        public int RetainedPages { get; set; }
+    }
+
+    /// <summary>
+    /// How much storage the two-revision safety net costs, per document and overall. See `Database.VersionStatistics`
+    /// </summary>
+    public class VersionReport
+    {
+        /// <summary>
+        /// Every document in the index, including system documents
+        /// </summary>
+        [NotNull, ItemNotNull] public List<DocumentVersionStat> Documents { get; } = new List<DocumentVersionStat>();
+
+        /// <summary>
+        /// Total pages holding current revisions
+        /// </summary>
+        public long LivePages => Documents.Sum(d => (long)d.LivePages);
+
+        /// <summary>
+        /// Total pages holding previous revisions
+        /// </summary>
+        public long RetainedPages => Documents.Sum(d => (long)d.RetainedPages);
+
+        /// <summary>
+        /// Fraction of document pages that hold previous revisions, from 0 to 1
+        /// </summary>
+        public double RetainedFraction
+        {
+            get
+            {
+                var total = LivePages + RetainedPages;
+                return total == 0 ? 0.0 : (double)RetainedPages / total;
+            }
+        }
+
+        /// <inheritdoc />
+        public override string ToString()
+        {
+            return $"{Documents.Count} documents; {LivePages} live pages; {RetainedPages} retained pages ({RetainedFraction:P0})";
+        }
+    }
+}